@@ -18,6 +18,7 @@ import (
 
 	"github.com/rs/xid"
 
+	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
 )
 
@@ -113,12 +114,14 @@ type Client struct {
 
 // ClientConnection contains the connection transport and metadata for the client.
 type ClientConnection struct {
-	Conn     net.Conn      // the net.Conn used to establish the connection
-	bconn    *bufio.Reader // a buffered net.Conn for reading packets
-	outbuf   *bytes.Buffer // a buffer for writing packets
-	Remote   string        // the remote address of the client
-	Listener string        // listener id of the client
-	Inline   bool          // if true, the client is the built-in 'inline' embedded client
+	Conn     net.Conn                  // the net.Conn used to establish the connection
+	bconn    *bufio.Reader             // a buffered net.Conn for reading packets
+	header   []byte                    // the raw fixed header of the packet being read, if required by hooks
+	outbuf   *bytes.Buffer             // a buffer for writing packets
+	Remote   string                    // the remote address of the client
+	Listener string                    // listener id of the client
+	Inline   bool                      // if true, the client is the built-in 'inline' embedded client
+	Upgrade  *listeners.UpgradeRequest // the http request which established a websocket connection, with the headers and cookies selected by the listener
 }
 
 // ClientProperties contains the properties which define the client behaviour.
@@ -147,10 +150,12 @@ type ClientState struct {
 	stopCause       atomic.Value         // reason for stopping
 	Inflight        *Inflight            // a map of in-flight qos messages
 	Subscriptions   *Subscriptions       // a map of the subscription filters a client maintains
+	Queue           *OfflineQueue        // messages waiting to be delivered to a persistent session
 	disconnected    int64                // the time the client disconnected in unix time, for calculating expiry
 	outbound        chan *packets.Packet // queue for pending outbound packets
 	endOnce         sync.Once            // only end once
 	isTakenOver     atomic.Bool          // used to identify orphaned clients
+	queueOpen       atomic.Bool          // the connection is ready to receive queued messages
 	packetID        uint32               // the current highest packetID
 	open            context.Context      // indicate that the client is open for packet exchange
 	cancelOpen      context.CancelFunc   // cancel function for open context
@@ -167,6 +172,7 @@ func newClient(c net.Conn, o *ops) *Client {
 		State: ClientState{
 			Inflight:      NewInflights(),
 			Subscriptions: NewSubscriptions(),
+			Queue:         NewOfflineQueue(),
 			TopicAliases:  NewTopicAliases(o.options.Capabilities.TopicAliasMaximum),
 			open:          ctx,
 			cancelOpen:    cancel,
@@ -185,6 +191,10 @@ func newClient(c net.Conn, o *ops) *Client {
 			bconn:  bufio.NewReaderSize(c, o.options.ClientNetReadBufferSize),
 			Remote: c.RemoteAddr().String(),
 		}
+
+		if uc, ok := c.(listeners.UpgradeRequestConn); ok {
+			cl.Net.Upgrade = uc.UpgradeRequest()
+		}
 	}
 
 	return cl
@@ -228,7 +238,8 @@ func (cl *Client) ParseConnect(lid string, pk packets.Packet) {
 		)
 	}
 
-	cl.State.Keepalive = pk.Connect.Keepalive                                              // [MQTT-3.2.2-22]
+	cl.State.Keepalive = pk.Connect.Keepalive // [MQTT-3.2.2-22]
+	cl.applyKeepalivePolicy()
 	cl.State.Inflight.ResetReceiveQuota(int32(cl.ops.options.Capabilities.ReceiveMaximum)) // server receive max per client
 	cl.State.Inflight.ResetSendQuota(int32(cl.Properties.Props.ReceiveMaximum))            // client receive max
 	cl.State.TopicAliases.Outbound = NewOutboundTopicAliases(cl.Properties.Props.TopicAliasMaximum)
@@ -311,7 +322,7 @@ func (cl *Client) ResendInflightMessages(force bool) error {
 			tk.FixedHeader.Dup = true // [MQTT-3.3.1-1] [MQTT-3.3.1-3]
 		}
 
-		cl.ops.hooks.OnQosPublish(cl, tk, tk.Created, 0)
+		cl.ops.hooks.OnQosPublish(cl, tk, tk.Created, cl.State.Inflight.Resent(tk.PacketID))
 		err := cl.WritePacket(tk)
 		if err != nil {
 			return err
@@ -338,6 +349,14 @@ func (cl *Client) ClearInflights() {
 	}
 }
 
+// hasPersistentSession returns true if the client session outlives its network connection.
+func (cl *Client) hasPersistentSession() bool {
+	if cl.Properties.ProtocolVersion == 5 {
+		return cl.Properties.Props.SessionExpiryInterval > 0
+	}
+	return !cl.Properties.Clean
+}
+
 // ClearExpiredInflights deletes any inflight messages which have expired.
 func (cl *Client) ClearExpiredInflights(now, maximumExpiry int64) []uint16 {
 	deleted := []uint16{}
@@ -442,18 +461,32 @@ func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 		return err
 	}
 
+	raw := cl.ops.hooks.Provides(OnPacketReceived)
+	cl.Net.header = cl.Net.header[:0]
+	if raw {
+		cl.Net.header = append(cl.Net.header, b)
+	}
+
 	err = fh.Decode(b)
 	if err != nil {
+		cl.packetReceived(raw, packets.Packet{FixedHeader: *fh}, nil)
 		return err
 	}
 
 	var bu int
-	fh.Remaining, bu, err = packets.DecodeLength(cl.Net.bconn)
+	var br io.ByteReader = cl.Net.bconn
+	if raw {
+		br = &byteRecorder{r: cl.Net.bconn, b: &cl.Net.header}
+	}
+
+	fh.Remaining, bu, err = packets.DecodeLength(br)
 	if err != nil {
+		cl.packetReceived(raw, packets.Packet{FixedHeader: *fh}, nil)
 		return err
 	}
 
 	if cl.ops.options.Capabilities.MaximumPacketSize > 0 && uint32(fh.Remaining+1) > cl.ops.options.Capabilities.MaximumPacketSize {
+		cl.packetReceived(raw, packets.Packet{FixedHeader: *fh}, nil)
 		return packets.ErrPacketTooLarge // [MQTT-3.2.2-15]
 	}
 
@@ -470,6 +503,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	p := make([]byte, pk.FixedHeader.Remaining)
 	n, err := io.ReadFull(cl.Net.bconn, p)
 	if err != nil {
+		cl.packetReceived(len(cl.Net.header) > 0, pk, p[:n])
 		return pk, err
 	}
 
@@ -514,6 +548,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 		err = fmt.Errorf("invalid packet type; %v", pk.FixedHeader.Type)
 	}
 
+	cl.packetReceived(len(cl.Net.header) > 0, pk, p)
 	if err != nil {
 		return pk, err
 	}
@@ -522,6 +557,35 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 	return
 }
 
+// packetReceived passes the raw bytes of a packet read from the client, prefixed
+// with its fixed header, to any hooks which record them.
+func (cl *Client) packetReceived(raw bool, pk packets.Packet, body []byte) {
+	if !raw {
+		return
+	}
+
+	b := make([]byte, 0, len(cl.Net.header)+len(body))
+	b = append(append(b, cl.Net.header...), body...)
+	cl.Net.header = cl.Net.header[:0]
+	cl.ops.hooks.OnPacketReceived(cl, pk, b)
+}
+
+// byteRecorder is a byte reader which records each byte read from it.
+type byteRecorder struct {
+	r io.ByteReader
+	b *[]byte
+}
+
+// ReadByte reads and records the next byte.
+func (r *byteRecorder) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		*r.b = append(*r.b, c)
+	}
+
+	return c, err
+}
+
 // WritePacket encodes and writes a packet to the client.
 func (cl *Client) WritePacket(pk packets.Packet) error {
 	if cl.Closed() {
@@ -599,6 +663,7 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 		return packets.ErrPacketTooLarge // [MQTT-3.1.2-24] [MQTT-3.1.2-25]
 	}
 
+	b := buf.Bytes() // keep the encoded packet for the hooks, as writing may drain the buffer
 	n, err := func() (int64, error) {
 		cl.Lock()
 		defer cl.Unlock()
@@ -639,7 +704,7 @@ func (cl *Client) WritePacket(pk packets.Packet) error {
 		atomic.AddInt64(&cl.ops.info.MessagesSent, 1)
 	}
 
-	cl.ops.hooks.OnPacketSent(cl, pk, buf.Bytes())
+	cl.ops.hooks.OnPacketSent(cl, pk, b)
 
 	return err
 }
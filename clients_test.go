@@ -12,11 +12,13 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/mochi-mqtt/server/v2/system"
 
@@ -145,6 +147,30 @@ func TestNewClient(t *testing.T) {
 	require.NotNil(t, cl.ops)
 	require.NotNil(t, cl.ops.options.Capabilities)
 	require.False(t, cl.Net.Inline)
+	require.Nil(t, cl.Net.Upgrade)
+}
+
+// upgradedConn is a connection established by an http upgrade request.
+type upgradedConn struct {
+	net.Conn
+	upgrade *listeners.UpgradeRequest
+}
+
+func (c *upgradedConn) UpgradeRequest() *listeners.UpgradeRequest {
+	return c.upgrade
+}
+
+func TestNewClientUpgradeRequest(t *testing.T) {
+	_, w := net.Pipe()
+	upgrade := &listeners.UpgradeRequest{Path: "/mqtt", Header: http.Header{"Authorization": {"Bearer abc"}}}
+	cl := newClient(&upgradedConn{Conn: w, upgrade: upgrade}, &ops{
+		info:    new(system.Info),
+		hooks:   new(Hooks),
+		log:     logger,
+		options: &Options{Capabilities: NewDefaultServerCapabilities()},
+	})
+
+	require.Same(t, upgrade, cl.Net.Upgrade)
 }
 
 func TestClientParseConnect(t *testing.T) {
@@ -717,6 +743,96 @@ func TestClientReadPacketInvalidTypeError(t *testing.T) {
 	require.Contains(t, err.Error(), "invalid packet type")
 }
 
+type packetReceivedHook struct {
+	HookBase
+	received chan []byte
+}
+
+func (h *packetReceivedHook) Provides(b byte) bool {
+	return b == OnPacketReceived
+}
+
+func (h *packetReceivedHook) OnPacketReceived(cl *Client, pk packets.Packet, b []byte) {
+	h.received <- append([]byte{}, b...)
+}
+
+func TestClientReadPacketOnPacketReceivedBytes(t *testing.T) {
+	tt := []struct {
+		desc string
+		in   []byte
+	}{
+		{desc: "non-canonical length", in: []byte{packets.Pingreq << 4, 0x80, 0x00}},
+		{desc: "malformed body", in: []byte{packets.Publish<<4 | 1<<1, 2, 0, 5}},
+		{desc: "truncated body", in: []byte{packets.Publish << 4, 8, 0, 1, 'a'}},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			cl, r, _ := newTestClient()
+			defer cl.Stop(errClientStop)
+
+			h := &packetReceivedHook{received: make(chan []byte, 1)}
+			require.NoError(t, cl.ops.hooks.Add(h, nil))
+
+			go func() {
+				_, _ = r.Write(tx.in)
+				_ = r.Close()
+			}()
+
+			fh := new(packets.FixedHeader)
+			require.NoError(t, cl.ReadFixedHeader(fh))
+			_, _ = cl.ReadPacket(fh)
+			require.Equal(t, tx.in, <-h.received)
+		})
+	}
+}
+
+func TestClientReadFixedHeaderOnPacketReceivedBytes(t *testing.T) {
+	cl, r, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+
+	h := &packetReceivedHook{received: make(chan []byte, 1)}
+	require.NoError(t, cl.ops.hooks.Add(h, nil))
+
+	go func() {
+		_, _ = r.Write([]byte{packets.Connect<<4 | 1<<1, 0x00})
+		_ = r.Close()
+	}()
+
+	fh := new(packets.FixedHeader)
+	require.Error(t, cl.ReadFixedHeader(fh))
+	require.Equal(t, []byte{packets.Connect<<4 | 1<<1}, <-h.received)
+}
+
+type packetSentHook struct {
+	HookBase
+	sent chan []byte
+}
+
+func (h *packetSentHook) Provides(b byte) bool {
+	return b == OnPacketSent
+}
+
+func (h *packetSentHook) OnPacketSent(cl *Client, pk packets.Packet, b []byte) {
+	h.sent <- append([]byte{}, b...)
+}
+
+func TestClientWritePacketOnPacketSentBytes(t *testing.T) {
+	cl, r, _ := newTestClient()
+	defer cl.Stop(errClientStop)
+
+	h := &packetSentHook{sent: make(chan []byte, 1)}
+	require.NoError(t, cl.ops.hooks.Add(h, nil))
+
+	go func() {
+		_, _ = io.ReadAll(r)
+	}()
+
+	err := cl.WritePacket(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingresp}})
+	require.NoError(t, err)
+	require.Equal(t, []byte{packets.Pingresp << 4, 0}, <-h.sent)
+}
+
 func TestClientWritePacket(t *testing.T) {
 	for _, tt := range pkTable {
 		cl, r, _ := newTestClient()
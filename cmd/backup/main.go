@@ -0,0 +1,323 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Command backup creates, inspects and restores backup archives of broker state.
+//
+// Backups are taken from a running broker through its management api, or from the
+// store of a stopped broker, and restored in the same ways:
+//
+//	backup create -url http://localhost:8888 -user admin -out mochi.mbk
+//	backup create -from bolt:data.db -out mochi.mbk
+//	backup inspect -in mochi.mbk
+//	backup restore -in mochi.mbk -url http://localhost:8888 -user admin
+//	backup restore -in mochi.mbk -to pebble:./pebble
+//
+// Stores are given as type:location, for example bolt:data.db, badger:./badger,
+// pebble:./pebble, redis:localhost:6379 or sqlite:mochi.db.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/backup"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/badger"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/redis"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/sql"
+
+	_ "modernc.org/sqlite" // registers the sqlite driver for the sql hook
+)
+
+// api is a client for the management api of a running broker.
+type api struct {
+	url      string
+	user     string
+	password string
+	token    string
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var err error
+	switch os.Args[1] {
+	case "create":
+		err = create(os.Args[2:], logger)
+	case "restore":
+		err = restore(os.Args[2:], logger)
+	case "inspect":
+		err = inspect(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: backup create|restore|inspect [flags]")
+	os.Exit(2)
+}
+
+// apiFlags adds the flags for connecting to the management api.
+func apiFlags(fs *flag.FlagSet) *api {
+	a := new(api)
+	fs.StringVar(&a.url, "url", "", "management api base url of a running broker, e.g. http://localhost:8888")
+	fs.StringVar(&a.user, "user", "", "management api admin username")
+	fs.StringVar(&a.password, "password", os.Getenv("MOCHI_PASSWORD"), "management api admin password (default $MOCHI_PASSWORD)")
+	return a
+}
+
+// create writes a backup archive of a running broker or a store.
+func create(args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	client := apiFlags(fs)
+	from := fs.String("from", "", "store of a stopped broker as type:location, instead of -url")
+	out := fs.String("out", "mochi.mbk", "path of the archive to write")
+	passwords := fs.Bool("passwords", false, "keep the passwords of auth users in the archive")
+	_ = fs.Parse(args)
+
+	if (client.url == "") == (*from == "") {
+		return errors.New("exactly one of -url or -from is required")
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if client.url != "" {
+		body, err := client.do(http.MethodGet, "/api/v1/backup?passwords="+strconv.FormatBool(*passwords), nil)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		if _, err := io.Copy(f, body); err != nil {
+			return err
+		}
+	} else {
+		h, err := open(*from, logger)
+		if err != nil {
+			return err
+		}
+		defer h.Stop()
+
+		a, err := backup.Load(h)
+		if err != nil {
+			return err
+		}
+
+		if !*passwords {
+			a.RedactPasswords()
+		}
+
+		if _, err := a.WriteTo(f); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Println("wrote", *out)
+	return inspectFile(*out)
+}
+
+// restore loads a backup archive into a running broker or a store.
+func restore(args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	client := apiFlags(fs)
+	to := fs.String("to", "", "store of a stopped broker as type:location, instead of -url")
+	in := fs.String("in", "mochi.mbk", "path of the archive to restore")
+	_ = fs.Parse(args)
+
+	if (client.url == "") == (*to == "") {
+		return errors.New("exactly one of -url or -to is required")
+	}
+
+	if client.url != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		body, err := client.do(http.MethodPost, "/api/v1/backup/restore", f)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	}
+
+	a, err := readFile(*in)
+	if err != nil {
+		return err
+	}
+
+	h, err := open(*to, logger)
+	if err != nil {
+		return err
+	}
+	defer h.Stop()
+
+	report, err := backup.Restore(a, h, logger)
+	if report != nil {
+		fmt.Print(report)
+	}
+
+	return err
+}
+
+// inspect prints the header and record counts of an archive.
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	in := fs.String("in", "mochi.mbk", "path of the archive to inspect")
+	_ = fs.Parse(args)
+
+	return inspectFile(*in)
+}
+
+func inspectFile(path string) error {
+	a, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("format=%s version=%d created=%d broker=%s redacted=%t\n", a.Header.Format, a.Header.Version, a.Header.Created, a.Header.BrokerVersion, a.Header.Redacted)
+	counts := a.Counts()
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	for _, k := range kinds {
+		fmt.Printf("%-14s %d\n", k, counts[k])
+	}
+
+	return nil
+}
+
+func readFile(path string) (*backup.Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return backup.Read(f)
+}
+
+// do makes an authenticated request to the management api and returns the response
+// body, or an error if the request did not succeed.
+func (a *api) do(method, path string, body io.Reader) (io.ReadCloser, error) {
+	if a.token == "" {
+		if err := a.login(); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.url, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(b))
+	}
+
+	return resp.Body, nil
+}
+
+// login exchanges the username and password for an access token.
+func (a *api) login() error {
+	b, _ := json.Marshal(map[string]string{"username": a.user, "password": a.password})
+	resp, err := http.Post(strings.TrimSuffix(a.url, "/")+"/api/v1/login", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("login: %s", resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login: %s", out.Error)
+	}
+
+	a.token = out.AccessToken
+	return nil
+}
+
+// open initializes the storage hook described by a type:location string.
+func open(store string, logger *slog.Logger) (mqtt.Hook, error) {
+	kind, location, ok := strings.Cut(store, ":")
+	if !ok || location == "" {
+		return nil, fmt.Errorf("invalid store %q, expected type:location", store)
+	}
+
+	var h mqtt.Hook
+	var config any
+	switch kind {
+	case "bolt":
+		h, config = new(bolt.Hook), &bolt.Options{Path: location}
+	case "badger":
+		h, config = new(badger.Hook), &badger.Options{Path: location}
+	case "pebble":
+		h, config = new(pebble.Hook), &pebble.Options{Path: location}
+	case "redis":
+		h, config = new(redis.Hook), &redis.Options{Address: location}
+	case "sqlite":
+		h, config = new(sql.Hook), &sql.Options{Driver: "sqlite", DSN: location}
+	default:
+		return nil, fmt.Errorf("unknown store type %q", kind)
+	}
+
+	h.SetOpts(logger, nil)
+	if err := h.Init(config); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
@@ -6,18 +6,26 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/audit"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/capture"
+	"github.com/mochi-mqtt/server/v2/hooks/events"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/management"
+	"github.com/mochi-mqtt/server/v2/packets"
 )
 
 func main() {
@@ -51,39 +59,103 @@ INFO_PORT=:8080
 	// The user complained "parameters too many", so minimizing flags is good.
 	// But let's leave TLS flags for now as they weren't explicitly banned, just "wanted env config for ports".
 
-	tlsCertFile := flag.String("tls-cert-file", "", "TLS certificate file")
-	tlsKeyFile := flag.String("tls-key-file", "", "TLS key file")
+	tlsCertFile := flag.String("tls-cert-file", "", "TLS certificate file, or comma separated files for SNI")
+	tlsKeyFile := flag.String("tls-key-file", "", "TLS key file, or comma separated files matching tls-cert-file")
 	flag.Parse()
 
+	// Clients are drained over DRAIN_PERIOD (e.g. 30s) on SIGTERM, and told of
+	// DRAIN_SERVER_REFERENCE if set, so they don't all reconnect elsewhere at once.
+	drainPeriod, err := time.ParseDuration(os.Getenv("DRAIN_PERIOD"))
+	if err != nil && os.Getenv("DRAIN_PERIOD") != "" {
+		log.Fatal("invalid DRAIN_PERIOD: ", err)
+	}
+	drainReference := os.Getenv("DRAIN_SERVER_REFERENCE")
+
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
+	done := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-sigs
-		done <- true
+		done <- <-sigs
 	}()
 
-	var tlsConfig *tls.Config
+	// Certificates are served from stores so they can be replaced without
+	// restarting listeners, by file changes, SIGHUP, or the management api.
+	mqttsCerts := listeners.NewCertStore()
+	mgmtCerts := listeners.NewCertStore()
 
+	var tlsFiles []listeners.CertFile
 	if tlsCertFile != nil && tlsKeyFile != nil && *tlsCertFile != "" && *tlsKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
-		if err != nil {
-			return
+		certs := strings.Split(*tlsCertFile, ",")
+		keys := strings.Split(*tlsKeyFile, ",")
+		if len(certs) != len(keys) {
+			log.Fatal("tls-cert-file and tls-key-file must list the same number of files")
+		}
+
+		for i := range certs {
+			tlsFiles = append(tlsFiles, listeners.CertFile{Cert: strings.TrimSpace(certs[i]), Key: strings.TrimSpace(keys[i])})
 		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+
+		if err := mgmtCerts.LoadFiles(tlsFiles...); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	server := mqtt.New(nil)
+	// The inline client is required for publishing client events and management
+	// publishes, and is enabled with INLINE_CLIENT=true.
+	inlineClient := os.Getenv("INLINE_CLIENT") == "true"
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: inlineClient,
+	})
 	authHook := new(auth.Hook)
 	_ = server.AddHook(authHook, nil)
 
-	// Storage Hook (BoltDB)
+	// Audit log of management changes, auth failures and ACL denials, written to
+	// AUDIT_LOG if it is set.
+	var auditHook *audit.Hook
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		auditHook = new(audit.Hook)
+		err = server.AddHook(auditHook, &audit.Options{
+			Path: path,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Packet capture, started and stopped per client from the management api, with
+	// capture files written to CAPTURE_DIR if it is set.
+	var captureHook *capture.Hook
+	if dir := os.Getenv("CAPTURE_DIR"); dir != "" {
+		captureHook = new(capture.Hook)
+		err = server.AddHook(captureHook, &capture.Options{
+			Dir: dir,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Client lifecycle events published to $SYS/brokers/clients/{clientid}/...
+	if inlineClient {
+		err = server.AddHook(new(events.Hook), &events.Options{
+			Server: server,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Storage Hook (BoltDB), sealing records with the keys in STORAGE_KEY_FILE if set
+	var encryption *storage.EncryptionOptions
+	if path := os.Getenv("STORAGE_KEY_FILE"); path != "" {
+		encryption = &storage.EncryptionOptions{KeyFile: path}
+	}
+
 	storageHook := new(bolt.Hook)
 	err = server.AddHook(storageHook, &bolt.Options{
-		Path:    "data.db", // "Default to same folder as binary"
-		Options: nil,
+		Path:       "data.db", // "Default to same folder as binary"
+		Options:    nil,
+		Encryption: encryption,
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -114,18 +186,48 @@ INFO_PORT=:8080
 	mdnsCfg := settings.GetMDNS()
 	_ = mdns.Configure(mdnsCfg.Enabled, mdnsCfg.Name, mdnsCfg.Port)
 
+	// Listeners are recreated from their saved definitions. On first start, the
+	// definitions are seeded from the .env ports and the tls flags.
+	if !settings.HasListeners() {
+		seed := []management.ListenerConfig{}
+		if tcpAddr != "" {
+			t1 := management.ListenerConfig{Type: listeners.TypeTCP, ID: "t1", Address: tcpAddr}
+			if len(tlsFiles) > 0 {
+				t1.TLS = &management.ListenerTLS{Files: tlsFiles}
+			}
+			seed = append(seed, t1)
+		}
+
+		if wsAddr != "" {
+			ws1 := management.ListenerConfig{Type: listeners.TypeWS, ID: "ws1", Address: wsAddr}
+			if len(tlsFiles) > 0 {
+				ws1.TLS = &management.ListenerTLS{Files: tlsFiles}
+			}
+			seed = append(seed, ws1)
+		}
+
+		if err := settings.SetListeners(seed); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	listenerManager := management.NewListenerManager(server, settings)
+	if err := listenerManager.Restore(); err != nil {
+		log.Fatal(err)
+	}
+
 	// TLS Listener from Settings
 	tlsSettings := settings.GetTLS()
 	if tlsSettings.Enabled && tlsSettings.Cert != "" && tlsSettings.Key != "" {
 		cert, err := tls.X509KeyPair([]byte(tlsSettings.Cert), []byte(tlsSettings.Key))
 		if err == nil {
-			tlsConfig := &tls.Config{
-				Certificates: []tls.Certificate{cert},
-			}
+			err = mqttsCerts.Set(cert)
+		}
+		if err == nil {
 			tcp := listeners.NewTCP(listeners.Config{
 				ID:        "mqtts",
 				Address:   tlsSettings.Port,
-				TLSConfig: tlsConfig,
+				TLSConfig: mqttsCerts.TLSConfig(nil),
 			})
 			_ = server.AddListener(tcp)
 		} else {
@@ -134,34 +236,21 @@ INFO_PORT=:8080
 	}
 
 	if mgmtAddr != "" {
-		mgmt := management.New(listeners.Config{
+		config := listeners.Config{
 			ID:      "mgmt",
 			Address: mgmtAddr,
-		}, server, authHook, storageHook, mdns, settings)
-		err := server.AddListener(mgmt)
-		if err != nil {
-			log.Fatal(err)
 		}
-	}
-
-	if tcpAddr != "" {
-		tcp := listeners.NewTCP(listeners.Config{
-			ID:        "t1",
-			Address:   tcpAddr,
-			TLSConfig: tlsConfig,
-		})
-		err := server.AddListener(tcp)
-		if err != nil {
-			log.Fatal(err)
+		if len(tlsFiles) > 0 {
+			config.TLSConfig = mgmtCerts.TLSConfig(nil)
 		}
-	}
 
-	if wsAddr != "" {
-		ws := listeners.NewWebsocket(listeners.Config{
-			ID:      "ws1",
-			Address: wsAddr,
-		})
-		err := server.AddListener(ws)
+		mgmt := management.New(config, server, authHook, storageHook, mdns, settings)
+		mgmt.SetAudit(auditHook)
+		mgmt.SetCapture(captureHook)
+		mgmt.SetTLSCertificates(mqttsCerts)
+		mgmt.AddCertStores(mgmtCerts)
+		mgmt.SetListenerManager(listenerManager)
+		err := server.AddListener(mgmt)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -176,8 +265,37 @@ INFO_PORT=:8080
 		}
 	}()
 
-	<-done
-	server.Log.Warn("caught signal, stopping...")
+	// Reload file based certificates when they change, or on SIGHUP
+	stop := make(chan struct{})
+	go listenerManager.Watch(30*time.Second, server.Log, stop)
+	go mgmtCerts.Watch(30*time.Second, server.Log, stop)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := errors.Join(listenerManager.Reload(), mgmtCerts.Reload()); err != nil {
+				server.Log.Error("failed to reload tls certificates", "error", err)
+				continue
+			}
+			server.Log.Info("reloaded tls certificates")
+		}
+	}()
+
+	sig := <-done
+	close(stop)
+	server.Log.Warn("caught signal, stopping...", "signal", sig)
+	if sig == syscall.SIGTERM {
+		opts := mqtt.DrainOptions{
+			Code:            packets.ErrServerShuttingDown,
+			ServerReference: drainReference,
+			Period:          drainPeriod,
+		}
+		if drainReference != "" {
+			opts.Code = packets.ErrServerMoved
+		}
+		server.Drain(opts)
+	}
 	_ = server.Close()
 	server.Log.Info("mochi mqtt shutdown complete")
 }
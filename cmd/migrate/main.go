@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Command migrate copies sessions, subscriptions, retained and inflight messages,
+// system info and users from one storage backend to another.
+//
+// Backends are given as type:location, for example bolt:data.db, badger:./badger,
+// pebble:./pebble, redis:localhost:6379 or sqlite:mochi.db.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/badger"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/migrate"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/redis"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/sql"
+
+	_ "modernc.org/sqlite" // registers the sqlite driver for the sql hook
+)
+
+func main() {
+	from := flag.String("from", "", "source backend as type:location (bolt, badger, pebble, redis, sqlite)")
+	to := flag.String("to", "", "destination backend as type:location (bolt, badger, pebble, redis, sqlite)")
+	dryRun := flag.Bool("dry-run", false, "only report what would be migrated")
+	verify := flag.Bool("verify", true, "verify the destination contains every source key after migrating")
+	progress := flag.String("progress", "migrate.progress", "file recording progress so an interrupted migration can be resumed (empty to disable)")
+	checkpoint := flag.Int("checkpoint", 1000, "retained messages written between progress checkpoints")
+	asJSON := flag.Bool("json", false, "print the report as json")
+	flag.Parse()
+
+	if *from == "" || (*to == "" && !*dryRun) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*from, *to, *asJSON, &migrate.Options{
+		DryRun:     *dryRun,
+		Verify:     *verify,
+		Progress:   *progress,
+		Checkpoint: *checkpoint,
+		Log:        slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run opens the source and destination backends and migrates between them.
+func run(from, to string, asJSON bool, opts *migrate.Options) error {
+	src, err := open(from, opts.Log)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer src.Stop()
+
+	dst := src // a dry run only reads the source
+	if !opts.DryRun {
+		if dst, err = open(to, opts.Log); err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		defer dst.Stop()
+	}
+
+	report, err := migrate.Migrate(src, dst, opts)
+	if report != nil {
+		if asJSON {
+			b, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(b))
+		} else {
+			fmt.Print(report)
+		}
+	}
+
+	if errors.Is(err, migrate.ErrVerificationFailed) {
+		for stage, c := range report.Counts {
+			for _, k := range c.Missing {
+				fmt.Printf("missing %s: %s\n", stage, k)
+			}
+		}
+	}
+
+	return err
+}
+
+// open initializes the storage hook described by a type:location string.
+func open(backend string, logger *slog.Logger) (mqtt.Hook, error) {
+	kind, location, ok := strings.Cut(backend, ":")
+	if !ok || location == "" {
+		return nil, fmt.Errorf("invalid backend %q, expected type:location", backend)
+	}
+
+	var h mqtt.Hook
+	var config any
+	switch kind {
+	case "bolt":
+		h, config = new(bolt.Hook), &bolt.Options{Path: location}
+	case "badger":
+		h, config = new(badger.Hook), &badger.Options{Path: location}
+	case "pebble":
+		h, config = new(pebble.Hook), &pebble.Options{Path: location}
+	case "redis":
+		h, config = new(redis.Hook), &redis.Options{Address: location}
+	case "sqlite":
+		h, config = new(sql.Hook), &sql.Options{Driver: "sqlite", DSN: location}
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", kind)
+	}
+
+	h.SetOpts(logger, nil)
+	if err := h.Init(config); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Command replay feeds a packet capture back into an in-process broker and
+// reports whether the broker responds in the same way as when it was captured.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/config"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/capture"
+)
+
+func main() {
+	file := flag.String("file", "", "path to the .mqcap capture file to replay")
+	configFile := flag.String("config", "", "optional mochi config yaml or json file for the broker (default allows all clients)")
+	listener := flag.String("listener", "t1", "listener id the replayed client appears to connect on")
+	realtime := flag.Bool("realtime", false, "preserve the original timing between inbound packets")
+	timeout := flag.Duration("timeout", 0, "longest time to wait for the server to respond (default 5s)")
+	verbose := flag.Bool("v", false, "log broker output")
+	flag.Parse()
+
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := new(mqtt.Options)
+	if *configFile != "" {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if options, err = config.FromBytes(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !*verbose {
+		options.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	}
+
+	server := mqtt.New(options)
+	if *configFile == "" {
+		_ = server.AddHook(new(auth.AllowHook), nil)
+	}
+
+	res, err := capture.Replay(server, r, &capture.ReplayOptions{
+		Listener: *listener,
+		Realtime: *realtime,
+		Timeout:  *timeout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	_ = server.Close()
+
+	fmt.Printf("capture of client %q started %s\n\n", r.ClientID, r.Start.Format("2006-01-02 15:04:05"))
+	fmt.Println("captured:")
+	for _, rec := range res.Captured {
+		fmt.Println("  ", rec)
+	}
+
+	fmt.Println("\nreplayed:")
+	for _, rec := range res.Received {
+		fmt.Println("  ", rec)
+	}
+
+	if res.Error != nil {
+		fmt.Printf("\nconnection ended: %v\n", res.Error)
+	}
+
+	if i := capture.Diff(res.Captured, res.Received); i >= 0 {
+		fmt.Printf("\nresponses differ from the capture at outbound packet %d\n", i)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nresponses match the capture")
+}
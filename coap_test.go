@@ -0,0 +1,336 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/require"
+)
+
+// coapMsg is a CoAP message sent to or received from the gateway by the tests.
+type coapMsg struct {
+	typ     byte
+	code    byte
+	mid     uint16
+	token   []byte
+	options [][2]any // option number and value pairs, in option number order
+	payload []byte
+}
+
+// coapAuth are the Uri-Query options which authenticate a request as alice.
+var coapAuth = [][2]any{{15, "username=alice"}, {15, "password=secret"}}
+
+// newCoAPServer returns a served server with a CoAP gateway listener which accepts
+// plaintext credentials, and a udp client connected to the gateway.
+func newCoAPServer(t *testing.T) (*Server, *net.UDPConn) {
+	return newCoAPServerConfig(t, &listeners.CoAPConfig{AllowPlaintextCredentials: true})
+}
+
+// newCoAPServerConfig returns a served server with a CoAP gateway listener using a
+// config, and a udp client connected to the gateway.
+func newCoAPServerConfig(t *testing.T, config *listeners.CoAPConfig) (*Server, *net.UDPConn) {
+	gw := listeners.NewCoAP(listeners.Config{ID: "coap1", Address: "127.0.0.1:0", CoAP: config})
+	s := newListenerServer(t, new(gatewayAuthHook), gw)
+	return s, dialUDP(t, gw.Address())
+}
+
+// coapPath returns the Uri-Path options of a topic resource.
+func coapPath(topic string) [][2]any {
+	options := [][2]any{{11, "ps"}}
+	for _, level := range strings.Split(topic, "/") {
+		options = append(options, [2]any{11, level})
+	}
+	return options
+}
+
+// coapWrite sends a CoAP message to the gateway.
+func coapWrite(t *testing.T, c *net.UDPConn, m coapMsg) {
+	b := []byte{0x40 | m.typ<<4 | byte(len(m.token)), m.code, byte(m.mid >> 8), byte(m.mid)}
+	b = append(b, m.token...)
+
+	var prev int
+	for _, o := range m.options {
+		var v []byte
+		switch val := o[1].(type) {
+		case string:
+			v = []byte(val)
+		case int:
+			for n := val; n > 0; n >>= 8 {
+				v = append([]byte{byte(n)}, v...)
+			}
+		}
+
+		delta, length := o[0].(int)-prev, len(v)
+		require.Less(t, delta, 13)
+		if length < 13 {
+			b = append(b, byte(delta<<4|length))
+		} else {
+			b = append(b, byte(delta<<4|13), byte(length-13))
+		}
+		b = append(b, v...)
+		prev = o[0].(int)
+	}
+
+	if len(m.payload) > 0 {
+		b = append(append(b, 0xFF), m.payload...)
+	}
+
+	_, err := c.Write(b)
+	require.NoError(t, err)
+}
+
+// coapRead reads a CoAP message from the gateway, with uint option values.
+func coapRead(t *testing.T, c *net.UDPConn) coapMsg {
+	buf := make([]byte, 1024)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	b := buf[:n]
+
+	m := coapMsg{typ: b[0] >> 4 & 0x03, code: b[1], mid: binary.BigEndian.Uint16(b[2:])}
+	tkl := int(b[0] & 0x0F)
+	m.token = b[4 : 4+tkl]
+	b = b[4+tkl:]
+
+	var number int
+	for len(b) > 0 {
+		if b[0] == 0xFF {
+			m.payload = b[1:]
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		require.Less(t, length, 13)
+		b = b[1:]
+		if delta == 13 { // one byte extended delta, such as to max-age
+			delta, b = int(b[0])+13, b[1:]
+		}
+		number += delta
+
+		var v int
+		for _, x := range b[:length] {
+			v = v<<8 | int(x)
+		}
+		m.options = append(m.options, [2]any{number, v})
+		b = b[length:]
+	}
+
+	return m
+}
+
+// option returns the uint value of an option of a received message, or -1.
+func (m coapMsg) option(number int) int {
+	for _, o := range m.options {
+		if o[0].(int) == number {
+			return o[1].(int)
+		}
+	}
+	return -1
+}
+
+// coapDo sends a confirmable request and returns the piggybacked response.
+func coapDo(t *testing.T, c *net.UDPConn, mid uint16, code byte, options [][2]any, payload string) coapMsg {
+	coapWrite(t, c, coapMsg{typ: 0, code: code, mid: mid, token: []byte{byte(mid)}, options: options, payload: []byte(payload)})
+	m := coapRead(t, c)
+	require.Equal(t, byte(2), m.typ)
+	require.Equal(t, mid, m.mid)
+	require.Equal(t, []byte{byte(mid)}, m.token)
+	return m
+}
+
+// coapOptions returns the options of a request, in option number order.
+func coapOptions(groups ...[][2]any) [][2]any {
+	var options [][2]any
+	for _, g := range groups {
+		options = append(options, g...)
+	}
+
+	for i := 1; i < len(options); i++ { // insertion sort, keeping the order of repeated options
+		for j := i; j > 0 && options[j][0].(int) < options[j-1][0].(int); j-- {
+			options[j], options[j-1] = options[j-1], options[j]
+		}
+	}
+
+	return options
+}
+
+func TestCoAPPublish(t *testing.T) {
+	s, c := newCoAPServer(t)
+
+	m := coapDo(t, c, 1, 0x03, coapOptions(coapPath("allowed/temp"), coapAuth, [][2]any{
+		{12, 50}, // application/json
+		{14, 60}, // max-age
+		{15, "qos=1"},
+		{15, "retain=1"},
+	}), `{"t":21.5}`)
+	require.Equal(t, byte(0x44), m.code) // 2.04 changed
+
+	retained := s.Topics.Messages("allowed/temp")
+	require.Len(t, retained, 1)
+	pk := retained[0]
+	require.Equal(t, []byte(`{"t":21.5}`), pk.Payload)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.Equal(t, "application/json", pk.Properties.ContentType)
+	require.Equal(t, uint32(60), pk.Properties.MessageExpiryInterval)
+
+	// the request client is gone once the publish has been made
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("coap1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoAPPublishQos(t *testing.T) {
+	s, c := newCoAPServer(t)
+
+	for i, qos := range []string{"0", "2"} {
+		m := coapDo(t, c, uint16(i+1), 0x02, coapOptions(coapPath("allowed/q"+qos), coapAuth, [][2]any{{15, "qos=" + qos}, {15, "retain=true"}}), qos)
+		require.Equal(t, byte(0x44), m.code)
+		require.Len(t, s.Topics.Messages("allowed/q"+qos), 1)
+	}
+}
+
+func TestCoAPPublishRefused(t *testing.T) {
+	_, c := newCoAPServer(t)
+
+	tt := []struct {
+		desc    string
+		options [][2]any
+		code    byte
+	}{
+		{desc: "no credentials", options: coapPath("allowed/x"), code: 0x81},
+		{desc: "acl qos 0", options: coapOptions(coapPath("denied/x"), coapAuth), code: 0x83},
+		{desc: "acl", options: coapOptions(coapPath("denied/x"), coapAuth, [][2]any{{15, "qos=1"}}), code: 0x83},
+		{desc: "qos", options: coapOptions(coapPath("allowed/x"), coapAuth, [][2]any{{15, "qos=3"}}), code: 0x80},
+		{desc: "retain", options: coapOptions(coapPath("allowed/x"), coapAuth, [][2]any{{15, "retain=maybe"}}), code: 0x80},
+	}
+
+	for i, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			m := coapDo(t, c, uint16(i+1), 0x03, tx.options, "x")
+			require.Equal(t, tx.code, m.code)
+		})
+	}
+}
+
+func TestCoAPGetRetained(t *testing.T) {
+	s, c := newCoAPServer(t)
+	require.NoError(t, s.Publish("sensors/1", []byte("21.5"), true, 0))
+
+	m := coapDo(t, c, 1, 0x01, coapOptions(coapPath("sensors/1"), coapAuth), "")
+	require.Equal(t, byte(0x45), m.code) // 2.05 content
+	require.Equal(t, []byte("21.5"), m.payload)
+
+	m = coapDo(t, c, 2, 0x01, coapOptions(coapPath("sensors/2"), coapAuth), "")
+	require.Equal(t, byte(0x84), m.code) // 4.04 not found
+
+	m = coapDo(t, c, 3, 0x01, coapOptions(coapPath("denied/x"), coapAuth), "")
+	require.Equal(t, byte(0x83), m.code) // 4.03 forbidden
+}
+
+func TestCoAPObserve(t *testing.T) {
+	s, c := newCoAPServer(t)
+	require.NoError(t, s.Publish("sensors/1", []byte("retained"), true, 0))
+
+	m := coapDo(t, c, 1, 0x01, coapOptions(coapPath("sensors/#"), coapAuth, [][2]any{{6, 0}, {15, "qos=1"}}), "")
+	require.Equal(t, byte(0x45), m.code)
+	require.NotEqual(t, -1, m.option(6))
+	seq := m.option(6)
+
+	// the retained message is the first notification
+	n := coapRead(t, c)
+	require.Equal(t, byte(1), n.typ) // non-confirmable, received at qos 0
+	require.Equal(t, byte(0x45), n.code)
+	require.Equal(t, []byte{1}, n.token)
+	require.Equal(t, []byte("retained"), n.payload)
+	require.Greater(t, n.option(6), seq)
+	seq = n.option(6)
+
+	// messages received at qos 1 are confirmable notifications, acknowledged to the server
+	// once the client acknowledges them
+	require.NoError(t, s.Publish("sensors/2", []byte("hot"), false, 1))
+	n = coapRead(t, c)
+	require.Equal(t, byte(0), n.typ)
+	require.Equal(t, []byte("hot"), n.payload)
+	require.Greater(t, n.option(6), seq)
+
+	cl := s.Clients.GetByListener("coap1")
+	require.Len(t, cl, 1)
+	require.Equal(t, 1, cl[0].State.Inflight.Len())
+	coapWrite(t, c, coapMsg{typ: 2, mid: n.mid})
+	require.Eventually(t, func() bool {
+		return cl[0].State.Inflight.Len() == 0
+	}, time.Second, time.Millisecond)
+
+	// a reset of a notification cancels the observation
+	require.NoError(t, s.Publish("sensors/3", []byte("x"), false, 0))
+	n = coapRead(t, c)
+	coapWrite(t, c, coapMsg{typ: 3, mid: n.mid})
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("coap1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoAPObserveDeregister(t *testing.T) {
+	s, c := newCoAPServer(t)
+
+	m := coapDo(t, c, 1, 0x01, coapOptions(coapPath("sensors/+"), coapAuth, [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x45), m.code)
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Subscribers("sensors/1").Subscriptions) == 1
+	}, time.Second, time.Millisecond)
+
+	// a request with the token of the observation deregisters it
+	m = coapDo(t, c, 1+0x100, 0x01, coapOptions(coapPath("sensors/+"), coapAuth, [][2]any{{6, 1}}), "")
+	require.Equal(t, byte(0x45), m.code)
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("coap1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoAPObserveRefused(t *testing.T) {
+	s, c := newCoAPServer(t)
+
+	m := coapDo(t, c, 1, 0x01, coapOptions(coapPath("denied/#"), coapAuth, [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x83), m.code)
+
+	m = coapDo(t, c, 2, 0x01, coapOptions(coapPath("sensors/#"), [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x81), m.code)
+
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("coap1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoAPPlaintextCredentialsRefused(t *testing.T) {
+	s, c := newCoAPServerConfig(t, nil)
+
+	m := coapDo(t, c, 1, 0x03, coapOptions(coapPath("allowed/x"), coapAuth), "x")
+	require.Equal(t, byte(0x81), m.code) // 4.01 unauthorized
+	require.Contains(t, string(m.payload), "plain coap")
+	require.Empty(t, s.Topics.Messages("allowed/x"))
+}
+
+func TestCoAPObserveAddressLimit(t *testing.T) {
+	s, c := newCoAPServerConfig(t, &listeners.CoAPConfig{AllowPlaintextCredentials: true, MaxAddressObservers: 1})
+
+	m := coapDo(t, c, 1, 0x01, coapOptions(coapPath("sensors/1"), coapAuth, [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x45), m.code)
+
+	m = coapDo(t, c, 2, 0x01, coapOptions(coapPath("sensors/2"), coapAuth, [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x9D), m.code) // 4.29 too many requests
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("coap1")) == 1
+	}, time.Second, time.Millisecond)
+
+	// re-registering an existing observation replaces it
+	m = coapDo(t, c, 1+0x100, 0x01, coapOptions(coapPath("sensors/1"), coapAuth, [][2]any{{6, 0}}), "")
+	require.Equal(t, byte(0x45), m.code)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/redis"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/sql"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"gopkg.in/yaml.v3"
 
@@ -65,6 +66,7 @@ type HookStorageConfig struct {
 	Bolt   *bolt.Options   `yaml:"bolt" json:"bolt"`
 	Pebble *pebble.Options `yaml:"pebble" json:"pebble"`
 	Redis  *redis.Options  `yaml:"redis" json:"redis"`
+	SQL    *sql.Options    `yaml:"sql" json:"sql"` // the sql driver must be registered by the program
 }
 
 // ToHooks converts Hook file configurations into Hooks to be added to the server.
@@ -141,6 +143,13 @@ func (hc HookConfigs) toHooksStorage() []mqtt.HookLoadConfig {
 			Config: hc.Storage.Pebble,
 		})
 	}
+
+	if hc.Storage.SQL != nil {
+		hlc = append(hlc, mqtt.HookLoadConfig{
+			Hook:   new(sql.Hook),
+			Config: hc.Storage.SQL,
+		})
+	}
 	return hlc
 }
 
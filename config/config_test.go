@@ -16,6 +16,7 @@ import (
 	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/redis"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/sql"
 	"github.com/mochi-mqtt/server/v2/listeners"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -236,3 +237,76 @@ func TestToHooksStoragePebble(t *testing.T) {
 
 	require.Equal(t, expect, th)
 }
+
+func TestToHooksStorageSQL(t *testing.T) {
+	hc := HookConfigs{
+		Storage: &HookStorageConfig{
+			SQL: &sql.Options{
+				Driver: "sqlite",
+				DSN:    "mochi.db",
+			},
+		},
+	}
+
+	th := hc.toHooksStorage()
+	expect := []mqtt.HookLoadConfig{
+		{
+			Hook:   new(sql.Hook),
+			Config: hc.Storage.SQL,
+		},
+	}
+
+	require.Equal(t, expect, th)
+}
+
+func TestFromBytesListenerProxy(t *testing.T) {
+	o, err := FromBytes([]byte(`
+listeners:
+  - type: "tcp"
+    id: "t1"
+    address: ":1883"
+    proxy:
+      proxy_protocol: true
+      required: true
+      trusted_proxies: ["10.0.0.0/8", "192.0.2.1"]
+      header_timeout: 3
+`))
+	require.NoError(t, err)
+	require.Len(t, o.Listeners, 1)
+	require.Equal(t, &listeners.ProxyConfig{
+		ProxyProtocol:  true,
+		Required:       true,
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+		HeaderTimeout:  3,
+	}, o.Listeners[0].Proxy)
+}
+
+func TestFromBytesListenerPolicy(t *testing.T) {
+	o, err := FromBytes([]byte(`
+listeners:
+  - type: "tcp"
+    id: "devices"
+    address: ":1883"
+    policy:
+      maximum_packet_size: 65536
+      retain_available: 0
+      maximum_clients: 1000
+      maximum_keepalive: 300
+      auth_hooks: ["auth-ledger"]
+      protocol_versions: [4, 5]
+`))
+	require.NoError(t, err)
+	require.Len(t, o.Listeners, 1)
+
+	p := o.Listeners[0].Policy
+	require.NotNil(t, p)
+	require.NotNil(t, p.MaximumPacketSize)
+	require.Equal(t, uint32(65536), *p.MaximumPacketSize)
+	require.NotNil(t, p.RetainAvailable)
+	require.Equal(t, byte(0), *p.RetainAvailable)
+	require.Nil(t, p.MaximumQos)
+	require.Equal(t, int64(1000), p.MaximumClients)
+	require.Equal(t, uint16(300), p.MaximumKeepalive)
+	require.Equal(t, []string{"auth-ledger"}, p.AuthHooks)
+	require.Equal(t, []byte{4, 5}, p.ProtocolVersions)
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// defaultDrainBatchSize is the number of clients disconnected at a time when draining.
+const defaultDrainBatchSize = 100
+
+var (
+	ErrListenerNotFound = errors.New("listener not found") // no listener exists with the id
+)
+
+// DrainOptions configures how clients are disconnected when a listener or the server is drained.
+type DrainOptions struct {
+	Code            packets.Code  // the disconnect reason code, ErrServerShuttingDown if not set
+	ServerReference string        // another server clients may connect to, sent to v5 clients
+	Period          time.Duration // the period over which clients are disconnected, all at once if 0
+	BatchSize       int           // the number of clients disconnected at a time, 100 if 0
+	Except          []string      // ids of listeners which keep accepting connections when the server is drained
+	Background      bool          // disconnect clients in the background, returning once the listeners are stopped
+}
+
+// DrainListener stops a listener accepting new connections and removes it from the
+// server, then disconnects its clients in batches paced over the drain period. Clients
+// of other listeners are unaffected, so a listener can be drained and added again to
+// restart it. It returns the number of clients which were disconnected.
+func (s *Server) DrainListener(id string, opts DrainOptions) (int, error) {
+	if _, ok := s.Listeners.Get(id); !ok {
+		return 0, ErrListenerNotFound
+	}
+
+	s.Listeners.Close(id, func(id string) {})
+	s.Listeners.Delete(id)
+	s.Log.Info("draining listener", "listener", id, "period", opts.Period)
+
+	var clients []*Client
+	for _, cl := range s.Clients.GetByListener(id) {
+		if !cl.Net.Inline && !cl.Closed() {
+			clients = append(clients, cl)
+		}
+	}
+
+	return s.drainClients(clients, opts), nil
+}
+
+// Drain stops all listeners accepting new connections, except those in opts.Except, then
+// disconnects the clients of the stopped listeners in batches paced over the drain period.
+// It should be followed by Close to stop the server. It returns the number of clients
+// which were disconnected.
+func (s *Server) Drain(opts DrainOptions) int {
+	except := make(map[string]bool, len(opts.Except))
+	for _, id := range opts.Except {
+		except[id] = true
+	}
+
+	for id := range s.Listeners.GetAll() {
+		if !except[id] {
+			s.Listeners.Close(id, func(id string) {})
+		}
+	}
+	s.Log.Info("draining server", "period", opts.Period)
+
+	var clients []*Client
+	for _, cl := range s.Clients.GetAll() {
+		if !cl.Net.Inline && !cl.Closed() && !except[cl.Net.Listener] {
+			clients = append(clients, cl)
+		}
+	}
+
+	return s.drainClients(clients, opts)
+}
+
+// drainClients disconnects clients in batches spread evenly over the drain period. If the
+// server is closed while draining, the remaining clients are disconnected immediately.
+func (s *Server) drainClients(clients []*Client, opts DrainOptions) int {
+	if opts.Background {
+		opts.Background = false
+		go s.drainClients(clients, opts)
+		return len(clients)
+	}
+
+	if opts.Code == (packets.Code{}) {
+		opts.Code = packets.ErrServerShuttingDown
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultDrainBatchSize
+	}
+
+	batches := (len(clients) + opts.BatchSize - 1) / opts.BatchSize
+	var interval time.Duration
+	if batches > 1 {
+		interval = opts.Period / time.Duration(batches)
+	}
+
+	for i := 0; i < len(clients); i += opts.BatchSize {
+		if i > 0 && interval > 0 {
+			select {
+			case <-s.done:
+				interval = 0
+			case <-time.After(interval):
+			}
+		}
+
+		end := i + opts.BatchSize
+		if end > len(clients) {
+			end = len(clients)
+		}
+
+		for _, cl := range clients[i:end] {
+			props := packets.Properties{}
+			if opts.ServerReference != "" && cl.Properties.ProtocolVersion == 5 {
+				props.ServerReference = opts.ServerReference // 3.14.2.2.5 Server Reference
+			}
+			_ = s.disconnectClient(cl, opts.Code, props)
+		}
+	}
+
+	s.Log.Info("drained clients", "clients", len(clients), "code", opts.Code.Code)
+	return len(clients)
+}
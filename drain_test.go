@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// addDrainClient adds a v5 client to the server on a listener, returning the client and
+// a channel which receives the disconnect packet sent to it.
+func addDrainClient(t *testing.T, s *Server, id, listener string) (*Client, chan packets.Packet) {
+	cl, r, _ := newTestClient()
+	cl.ID = id
+	cl.Net.Listener = listener
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	recv := make(chan packets.Packet, 1)
+	go func() {
+		buf, err := io.ReadAll(r)
+		require.NoError(t, err)
+		pk := packets.Packet{ProtocolVersion: 5}
+		if len(buf) > 2 {
+			require.NoError(t, pk.FixedHeader.Decode(buf[0]))
+			pk.FixedHeader.Remaining = int(buf[1])
+			require.NoError(t, pk.DisconnectDecode(buf[2:]))
+		}
+		recv <- pk
+	}()
+
+	return cl, recv
+}
+
+func TestDrainListener(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883")))
+
+	a, recvA := addDrainClient(t, s, "a", "t1")
+	b, _ := addDrainClient(t, s, "b", "t2")
+
+	n, err := s.DrainListener("t1", DrainOptions{
+		Code:            packets.ErrServerMoved,
+		ServerReference: "mqtt2.example.com:1883",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	pk := <-recvA
+	require.Equal(t, packets.Disconnect, pk.FixedHeader.Type)
+	require.Equal(t, packets.ErrServerMoved.Code, pk.ReasonCode)
+	require.Equal(t, "mqtt2.example.com:1883", pk.Properties.ServerReference)
+	require.True(t, a.Closed())
+	require.False(t, b.Closed())
+
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	_, ok = s.Listeners.Get("t2")
+	require.True(t, ok)
+
+	// the listener can be added again once drained
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+}
+
+func TestDrainListenerSkipsClosedAndInline(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	_, recv := addDrainClient(t, s, "a", "t1")
+	b, _ := addDrainClient(t, s, "b", "t1")
+	b.Stop(packets.CodeDisconnect)
+	s.inlineClient.Net.Listener = "t1"
+
+	n, err := s.DrainListener("t1", DrainOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	<-recv
+	require.False(t, s.inlineClient.Closed())
+}
+
+func TestDrainListenerBackground(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	var recv []chan packets.Packet
+	for _, id := range []string{"a", "b"} {
+		_, r := addDrainClient(t, s, id, "t1")
+		recv = append(recv, r)
+	}
+
+	start := time.Now()
+	n, err := s.DrainListener("t1", DrainOptions{Period: 60 * time.Millisecond, BatchSize: 1, Background: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Less(t, time.Since(start), 30*time.Millisecond)
+
+	// the listener is removed before returning, and the clients are drained afterwards
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	for _, r := range recv {
+		<-r
+	}
+}
+
+func TestDrainListenerNotFound(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+
+	_, err := s.DrainListener("missing", DrainOptions{})
+	require.ErrorIs(t, err, ErrListenerNotFound)
+}
+
+func TestDrainPaced(t *testing.T) {
+	s := newServerWithInlineClient()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+
+	var recv []chan packets.Packet
+	for _, id := range []string{"a", "b", "c"} {
+		_, r := addDrainClient(t, s, id, "t1")
+		recv = append(recv, r)
+	}
+
+	start := time.Now()
+	n := s.Drain(DrainOptions{Period: 90 * time.Millisecond, BatchSize: 1})
+	require.Equal(t, 3, n)
+	require.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	for _, r := range recv {
+		pk := <-r
+		require.Equal(t, packets.ErrServerShuttingDown.Code, pk.ReasonCode)
+		require.Empty(t, pk.Properties.ServerReference)
+	}
+
+	require.False(t, s.inlineClient.Closed())
+	listener, _ := s.Listeners.Get("t1")
+	require.False(t, listener.(*listeners.MockListener).IsServing())
+}
+
+func TestDrainClientsServerClosed(t *testing.T) {
+	s := newServer()
+	for _, id := range []string{"a", "b"} {
+		addDrainClient(t, s, id, "t1")
+	}
+
+	_ = s.Close()
+	start := time.Now()
+	n := s.drainClients(s.Clients.GetByListener("t1"), DrainOptions{Period: time.Hour, BatchSize: 1})
+	require.Equal(t, 2, n)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestDrainExcept(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882")))
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t2", ":1883")))
+	go s.Listeners.ServeAll(s.EstablishConnection)
+
+	_, recv := addDrainClient(t, s, "a", "t1")
+	b, _ := addDrainClient(t, s, "b", "t2")
+
+	require.Equal(t, 1, s.Drain(DrainOptions{Except: []string{"t2"}}))
+	<-recv
+	require.False(t, b.Closed())
+
+	require.Eventually(t, func() bool {
+		t2, _ := s.Listeners.Get("t2")
+		return t2.(*listeners.MockListener).IsServing()
+	}, time.Second, time.Millisecond)
+}
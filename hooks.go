@@ -55,6 +55,12 @@ const (
 	StoredInflightMessages
 	StoredRetainedMessages
 	StoredSysInfo
+	OnConnectAuthenticateFailed
+	OnACLCheckFailed
+	OnQueued
+	OnDequeued
+	StoredQueuedMessages
+	OnPacketReceived
 )
 
 var (
@@ -81,6 +87,8 @@ type Hook interface {
 	OnStopped()
 	OnConnectAuthenticate(cl *Client, pk packets.Packet) bool
 	OnACLCheck(cl *Client, topic string, write bool) bool
+	OnConnectAuthenticateFailed(cl *Client, pk packets.Packet) // triggers when no hook allowed a client to authenticate
+	OnACLCheckFailed(cl *Client, topic string, write bool)     // triggers when no hook allowed a client to publish or subscribe
 	OnSysInfoTick(*system.Info)
 	OnConnect(cl *Client, pk packets.Packet) error
 	OnSessionEstablish(cl *Client, pk packets.Packet)
@@ -88,6 +96,7 @@ type Hook interface {
 	OnDisconnect(cl *Client, err error, expire bool)
 	OnAuthPacket(cl *Client, pk packets.Packet) (packets.Packet, error)
 	OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet, error) // triggers when a new packet is received by a client, but before packet validation
+	OnPacketReceived(cl *Client, pk packets.Packet, b []byte)           // triggers with the raw bytes of each packet read from a client, even if it could not be decoded
 	OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet        // modify a packet before it is byte-encoded and written to the client
 	OnPacketSent(cl *Client, pk packets.Packet, b []byte)               // triggers when packet bytes have been written to the client
 	OnPacketProcessed(cl *Client, pk packets.Packet, err error)         // triggers after a packet from the client been processed (handled)
@@ -109,10 +118,13 @@ type Hook interface {
 	OnWillSent(cl *Client, pk packets.Packet)
 	OnClientExpired(cl *Client)
 	OnRetainedExpired(filter string)
+	OnQueued(cl *Client, pk packets.Packet, seq int64) // triggers when a message is added to the offline queue of a client
+	OnDequeued(cl *Client, seq int64)                  // triggers when a message is sent, dropped, or expired from the offline queue
 	StoredClients() ([]storage.Client, error)
 	StoredSubscriptions() ([]storage.Subscription, error)
 	StoredInflightMessages() ([]storage.Message, error)
 	StoredRetainedMessages() ([]storage.Message, error)
+	StoredQueuedMessages() ([]storage.Message, error)
 	StoredSysInfo() (storage.SystemInfo, error)
 }
 
@@ -285,6 +297,18 @@ func (h *Hooks) OnPacketRead(cl *Client, pk packets.Packet) (pkx packets.Packet,
 	return
 }
 
+// OnPacketReceived is called with the raw bytes of each packet read from a client,
+// including the fixed header, exactly as they arrived. It is called before OnPacketRead,
+// and also for packets which could not be decoded, in which case the packet contains
+// only the values which were decoded before the failure.
+func (h *Hooks) OnPacketReceived(cl *Client, pk packets.Packet, b []byte) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnPacketReceived) {
+			hook.OnPacketReceived(cl, pk, b)
+		}
+	}
+}
+
 // OnAuthPacket is called when an auth packet is received. It is intended to allow developers
 // to create their own auth packet handling mechanisms.
 func (h *Hooks) OnAuthPacket(cl *Client, pk packets.Packet) (pkx packets.Packet, err error) {
@@ -550,6 +574,27 @@ func (h *Hooks) OnRetainedExpired(filter string) {
 	}
 }
 
+// OnQueued is called when a message is added to the offline queue of a client with
+// a persistent session. It is typically used to store the queued message.
+func (h *Hooks) OnQueued(cl *Client, pk packets.Packet, seq int64) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnQueued) {
+			hook.OnQueued(cl, pk, seq)
+		}
+	}
+}
+
+// OnDequeued is called when a message is removed from the offline queue of a client,
+// whether it was sent, dropped, or expired. It is typically used to delete the queued
+// message from a store.
+func (h *Hooks) OnDequeued(cl *Client, seq int64) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnDequeued) {
+			hook.OnDequeued(cl, seq)
+		}
+	}
+}
+
 // StoredClients returns all clients, e.g. from a persistent store, is used to
 // populate the server clients list before start.
 func (h *Hooks) StoredClients() (v []storage.Client, err error) {
@@ -630,6 +675,26 @@ func (h *Hooks) StoredRetainedMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all offline queued messages, e.g. from a persistent store,
+// and is used to populate the restored clients with queued messages before start.
+func (h *Hooks) StoredQueuedMessages() (v []storage.Message, err error) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(StoredQueuedMessages) {
+			v, err := hook.StoredQueuedMessages()
+			if err != nil {
+				h.Log.Error("failed to load queued messages", "error", err, "hook", hook.ID())
+				return v, err
+			}
+
+			if len(v) > 0 {
+				return v, nil
+			}
+		}
+	}
+
+	return
+}
+
 // StoredSysInfo returns a set of system info values.
 func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 	for _, hook := range h.GetAll() {
@@ -655,7 +720,7 @@ func (h *Hooks) StoredSysInfo() (v storage.SystemInfo, err error) {
 // check connecting users against an existing user database.
 func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnConnectAuthenticate) {
+		if hook.Provides(OnConnectAuthenticate) && cl.authHookAllowed(hook.ID()) {
 			if ok := hook.OnConnectAuthenticate(cl, pk); ok {
 				return true
 			}
@@ -671,7 +736,7 @@ func (h *Hooks) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
 // check publishing and subscribing users against an existing permissions or roles database.
 func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
 	for _, hook := range h.GetAll() {
-		if hook.Provides(OnACLCheck) {
+		if hook.Provides(OnACLCheck) && cl.authHookAllowed(hook.ID()) {
 			if ok := hook.OnACLCheck(cl, topic, write); ok {
 				return true
 			}
@@ -681,6 +746,27 @@ func (h *Hooks) OnACLCheck(cl *Client, topic string, write bool) bool {
 	return false
 }
 
+// OnConnectAuthenticateFailed is called when a client was not allowed to authenticate
+// by any hook and is about to be refused a connection.
+func (h *Hooks) OnConnectAuthenticateFailed(cl *Client, pk packets.Packet) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnConnectAuthenticateFailed) {
+			hook.OnConnectAuthenticateFailed(cl, pk)
+		}
+	}
+}
+
+// OnACLCheckFailed is called when a client was not allowed to publish (write) to a
+// topic or subscribe (read) to a filter by any hook. Messages withheld from subscribers
+// by an ACL check are not reported.
+func (h *Hooks) OnACLCheckFailed(cl *Client, topic string, write bool) {
+	for _, hook := range h.GetAll() {
+		if hook.Provides(OnACLCheckFailed) {
+			hook.OnACLCheckFailed(cl, topic, write)
+		}
+	}
+}
+
 // HookBase provides a set of default methods for each hook. It should be embedded in
 // all hooks.
 type HookBase struct {
@@ -737,6 +823,12 @@ func (h *HookBase) OnACLCheck(cl *Client, topic string, write bool) bool {
 	return false
 }
 
+// OnConnectAuthenticateFailed is called when a client failed to authenticate with the server.
+func (h *HookBase) OnConnectAuthenticateFailed(cl *Client, pk packets.Packet) {}
+
+// OnACLCheckFailed is called when a client was denied access to a topic.
+func (h *HookBase) OnACLCheckFailed(cl *Client, topic string, write bool) {}
+
 // OnConnect is called when a new client connects.
 func (h *HookBase) OnConnect(cl *Client, pk packets.Packet) error {
 	return nil
@@ -762,6 +854,9 @@ func (h *HookBase) OnPacketRead(cl *Client, pk packets.Packet) (packets.Packet,
 	return pk, nil
 }
 
+// OnPacketReceived is called with the raw bytes of a packet read from a client.
+func (h *HookBase) OnPacketReceived(cl *Client, pk packets.Packet, b []byte) {}
+
 // OnPacketEncode is called before a packet is byte-encoded and written to the client.
 func (h *HookBase) OnPacketEncode(cl *Client, pk packets.Packet) packets.Packet {
 	return pk
@@ -837,6 +932,12 @@ func (h *HookBase) OnClientExpired(cl *Client) {}
 // OnRetainedExpired is called when a retained message for a topic has expired.
 func (h *HookBase) OnRetainedExpired(topic string) {}
 
+// OnQueued is called when a message is added to the offline queue of a client.
+func (h *HookBase) OnQueued(cl *Client, pk packets.Packet, seq int64) {}
+
+// OnDequeued is called when a message is removed from the offline queue of a client.
+func (h *HookBase) OnDequeued(cl *Client, seq int64) {}
+
 // StoredClients returns all clients from a store.
 func (h *HookBase) StoredClients() (v []storage.Client, err error) {
 	return
@@ -857,6 +958,11 @@ func (h *HookBase) StoredRetainedMessages() (v []storage.Message, err error) {
 	return
 }
 
+// StoredQueuedMessages returns all offline queued messages from a store.
+func (h *HookBase) StoredQueuedMessages() (v []storage.Message, err error) {
+	return
+}
+
 // StoredSysInfo returns a set of system info values.
 func (h *HookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	return
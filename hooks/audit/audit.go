@@ -0,0 +1,404 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package audit provides an append-only, rotatable JSON-lines audit log of
+// administrative and security events, and a hook which records mqtt
+// authentication failures and ACL denials.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	// defaultPath is the default file path for the audit log.
+	defaultPath = "audit.log"
+
+	// defaultMaxSize is the default size in bytes at which the audit log is rotated.
+	defaultMaxSize int64 = 10 * 1024 * 1024
+
+	// defaultMaxBackups is the default number of rotated audit logs to keep.
+	defaultMaxBackups = 5
+
+	// MaxQueryLimit is the maximum number of records returned by a query.
+	MaxQueryLimit = 1000
+
+	SourceManagement = "management" // the event was caused by a management api request
+	SourceMQTT       = "mqtt"       // the event was caused by an mqtt client
+
+	ActionAuthFailed = "auth.failed" // an mqtt client failed to authenticate
+	ActionACLDenied  = "acl.denied"  // an mqtt client was denied access to a topic
+)
+
+var (
+	// ErrLogClosed indicates the audit log file is not open for writing.
+	ErrLogClosed = errors.New("audit log not open")
+)
+
+// Record is a single entry in the audit log.
+type Record struct {
+	Time   time.Time `json:"time"`             // the time the event occurred
+	Source string    `json:"source"`           // the subsystem the event originated from
+	Actor  string    `json:"actor"`            // the user responsible for the event
+	Action string    `json:"action"`           // the action which was performed or attempted
+	Target string    `json:"target,omitempty"` // the object the action was performed on
+	Remote string    `json:"remote,omitempty"` // the remote address of the actor
+	Client string    `json:"client,omitempty"` // the mqtt client id, if applicable
+	Before any       `json:"before,omitempty"` // a summary of the target before the change
+	After  any       `json:"after,omitempty"`  // a summary of the target after the change
+	Error  string    `json:"error,omitempty"`  // an error which prevented the action, if any
+}
+
+// Query contains the criteria for searching the audit log. Zero values are ignored.
+type Query struct {
+	From   time.Time // only records at or after this time
+	To     time.Time // only records at or before this time
+	Actor  string    // only records for this actor
+	Action string    // only records with an action starting with this prefix
+	Limit  int       // the maximum number of (most recent) records to return, up to MaxQueryLimit
+}
+
+// matches returns true if a record satisfies the query criteria.
+func (q Query) matches(r Record) bool {
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && r.Time.After(q.To) {
+		return false
+	}
+
+	if q.Actor != "" && r.Actor != q.Actor {
+		return false
+	}
+
+	if q.Action != "" && !strings.HasPrefix(r.Action, q.Action) {
+		return false
+	}
+
+	return true
+}
+
+// Options contains configuration settings for the audit log.
+type Options struct {
+	Path       string `yaml:"path" json:"path"`               // the path of the audit log file
+	MaxSize    int64  `yaml:"max_size" json:"max_size"`       // the size in bytes at which the log is rotated
+	MaxBackups int    `yaml:"max_backups" json:"max_backups"` // the number of rotated logs to keep
+}
+
+// Log is an append-only JSON-lines audit log which is rotated when it reaches
+// a maximum size. Rotated logs are suffixed .1 (newest) to .n (oldest).
+type Log struct {
+	sync.Mutex
+	config *Options
+	file   *os.File
+	size   int64
+}
+
+// NewLog opens (or creates) an audit log using the provided options.
+func NewLog(config *Options) (*Log, error) {
+	if config == nil {
+		config = new(Options)
+	}
+
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = defaultMaxBackups
+	}
+
+	l := &Log{config: config}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open opens the current audit log file for appending.
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// backupPath returns the file path of the nth rotated log.
+func (l *Log) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.config.Path, n)
+}
+
+// rotate closes the current log and shifts it and any existing backups along by one,
+// discarding the oldest backup.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	_ = os.Remove(l.backupPath(l.config.MaxBackups))
+	for i := l.config.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(l.backupPath(i), l.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(l.config.Path, l.backupPath(1)); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// Write appends a record to the audit log, rotating the log if it has grown too large.
+func (l *Log) Write(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		return ErrLogClosed
+	}
+
+	if l.size > 0 && l.size+int64(len(b)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// Query returns the most recent records from the current and rotated logs which match
+// the query, in chronological order. The log files are opened while the log is locked,
+// so that a rotation can't move them, but are read without holding up new records.
+func (l *Log) Query(q Query) ([]Record, error) {
+	if q.Limit <= 0 || q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	records := []Record{}
+	for _, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(io.LimitReader(f, info.Size())) // ignore records written after the query began
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var r Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				continue // skip partially written lines
+			}
+
+			if !q.matches(r) {
+				continue
+			}
+
+			records = append(records, r)
+			if len(records) >= q.Limit*2 {
+				records = append(records[:0], records[len(records)-q.Limit:]...)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	if len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+
+	return records, nil
+}
+
+// openFiles opens the rotated logs, oldest first, and the current log for reading.
+func (l *Log) openFiles() ([]*os.File, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	files := make([]*os.File, 0, l.config.MaxBackups+1)
+	for i := l.config.MaxBackups; i >= 0; i-- {
+		path := l.config.Path
+		if i > 0 {
+			path = l.backupPath(i)
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// Close closes the audit log file.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Hook is a hook which records mqtt authentication failures and ACL denials to
+// an audit log. The log is also available to other subsystems (such as the
+// management api) for recording administrative changes.
+type Hook struct {
+	mqtt.HookBase
+	log *Log
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "audit-log"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticateFailed,
+		mqtt.OnACLCheckFailed,
+	}, []byte{b})
+}
+
+// Init opens the audit log.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	var err error
+	h.log, err = NewLog(config.(*Options))
+	return err
+}
+
+// Stop closes the audit log.
+func (h *Hook) Stop() error {
+	if h.log == nil {
+		return nil
+	}
+
+	return h.log.Close()
+}
+
+// Log returns the audit log used by the hook.
+func (h *Hook) Log() *Log {
+	return h.log
+}
+
+// Record writes a record to the audit log, logging any failure.
+func (h *Hook) Record(r Record) {
+	if h.log == nil {
+		return
+	}
+
+	if err := h.log.Write(r); err != nil {
+		h.HookBase.Log.Error("failed to write audit record", "error", err, "action", r.Action)
+	}
+}
+
+// OnConnectAuthenticateFailed records a client which failed to authenticate.
+func (h *Hook) OnConnectAuthenticateFailed(cl *mqtt.Client, pk packets.Packet) {
+	h.Record(Record{
+		Source: SourceMQTT,
+		Actor:  string(pk.Connect.Username),
+		Action: ActionAuthFailed,
+		Target: cl.Net.Listener,
+		Remote: cl.Net.Remote,
+		Client: cl.ID,
+	})
+}
+
+// OnACLCheckFailed records a client which was denied permission to publish to a topic
+// or subscribe to a filter.
+func (h *Hook) OnACLCheckFailed(cl *mqtt.Client, topic string, write bool) {
+	access := "read"
+	if write {
+		access = "write"
+	}
+
+	h.Record(Record{
+		Source: SourceMQTT,
+		Actor:  string(cl.Properties.Username),
+		Action: ActionACLDenied + "." + access,
+		Target: topic,
+		Remote: cl.Net.Remote,
+		Client: cl.ID,
+	})
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package audit
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func newClient() *mqtt.Client {
+	return &mqtt.Client{
+		ID: "cl1",
+		Net: mqtt.ClientConnection{
+			Remote:   "127.0.0.1:1234",
+			Listener: "t1",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("mochi"),
+		},
+	}
+}
+
+func newHook(t *testing.T, opts *Options) *Hook {
+	if opts == nil {
+		opts = new(Options)
+	}
+	opts.Path = filepath.Join(t.TempDir(), "audit.log")
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(opts))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "audit-log", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnConnectAuthenticateFailed))
+	require.True(t, h.Provides(mqtt.OnACLCheckFailed))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitDefaults(t *testing.T) {
+	l, err := NewLog(&Options{Path: filepath.Join(t.TempDir(), "a.log")})
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, defaultMaxSize, l.config.MaxSize)
+	require.Equal(t, defaultMaxBackups, l.config.MaxBackups)
+}
+
+func TestStopNotInitialised(t *testing.T) {
+	h := new(Hook)
+	require.NoError(t, h.Stop())
+	h.Record(Record{Action: "noop"}) // no panic without a log
+}
+
+func TestOnConnectAuthenticateFailed(t *testing.T) {
+	h := newHook(t, nil)
+	pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte("bad")}}
+	h.OnConnectAuthenticateFailed(newClient(), pk)
+
+	records, err := h.Log().Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, SourceMQTT, records[0].Source)
+	require.Equal(t, ActionAuthFailed, records[0].Action)
+	require.Equal(t, "bad", records[0].Actor)
+	require.Equal(t, "t1", records[0].Target)
+	require.Equal(t, "127.0.0.1:1234", records[0].Remote)
+	require.Equal(t, "cl1", records[0].Client)
+	require.False(t, records[0].Time.IsZero())
+}
+
+func TestOnACLCheckFailed(t *testing.T) {
+	h := newHook(t, nil)
+	h.OnACLCheckFailed(newClient(), "a/b", true)
+	h.OnACLCheckFailed(newClient(), "c/#", false)
+
+	records, err := h.Log().Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, ActionACLDenied+".write", records[0].Action)
+	require.Equal(t, "a/b", records[0].Target)
+	require.Equal(t, "mochi", records[0].Actor)
+	require.Equal(t, ActionACLDenied+".read", records[1].Action)
+	require.Equal(t, "c/#", records[1].Target)
+}
+
+func TestQuery(t *testing.T) {
+	h := newHook(t, nil)
+	now := time.Now().UTC()
+	for i, actor := range []string{"admin", "ops", "admin", "admin"} {
+		require.NoError(t, h.Log().Write(Record{
+			Time:   now.Add(time.Duration(i) * time.Minute),
+			Source: SourceManagement,
+			Actor:  actor,
+			Action: "user.update",
+			Before: map[string]any{"i": i},
+		}))
+	}
+	require.NoError(t, h.Log().Write(Record{Time: now, Actor: "admin", Action: "listener.delete"}))
+
+	records, err := h.Log().Query(Query{Actor: "admin"})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	records, err = h.Log().Query(Query{Actor: "admin", Action: "user."})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	records, err = h.Log().Query(Query{From: now.Add(time.Minute), To: now.Add(2 * time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "ops", records[0].Actor)
+
+	records, err = h.Log().Query(Query{Action: "user.", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, map[string]any{"i": float64(3)}, records[1].Before)
+}
+
+func TestQueryMaxLimit(t *testing.T) {
+	h := newHook(t, &Options{MaxSize: 64 * 1024, MaxBackups: 3})
+	for i := 0; i < MaxQueryLimit+500; i++ {
+		require.NoError(t, h.Log().Write(Record{Actor: "admin", Action: "user.update", Target: strconv.Itoa(i)}))
+	}
+
+	records, err := h.Log().Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, records, MaxQueryLimit)
+	require.Equal(t, strconv.Itoa(MaxQueryLimit+499), records[len(records)-1].Target)
+
+	records, err = h.Log().Query(Query{Limit: MaxQueryLimit * 2})
+	require.NoError(t, err)
+	require.Len(t, records, MaxQueryLimit)
+
+	records, err = h.Log().Query(Query{Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, strconv.Itoa(MaxQueryLimit+497), records[0].Target)
+}
+
+func TestRotate(t *testing.T) {
+	h := newHook(t, &Options{MaxSize: 200, MaxBackups: 2})
+	for i := 0; i < 20; i++ {
+		require.NoError(t, h.Log().Write(Record{Actor: "admin", Action: "user.update", Target: "user"}))
+	}
+
+	_, err := os.Stat(h.Log().backupPath(1))
+	require.NoError(t, err)
+	_, err = os.Stat(h.Log().backupPath(2))
+	require.NoError(t, err)
+	_, err = os.Stat(h.Log().backupPath(3))
+	require.True(t, os.IsNotExist(err))
+
+	info, err := os.Stat(h.Log().config.Path)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(200))
+
+	records, err := h.Log().Query(Query{})
+	require.NoError(t, err)
+	require.NotEmpty(t, records)
+	require.Less(t, len(records), 20) // the oldest records were discarded
+}
+
+func TestWriteClosed(t *testing.T) {
+	h := newHook(t, nil)
+	require.NoError(t, h.Log().Close())
+	require.ErrorIs(t, h.Log().Write(Record{Action: "x"}), ErrLogClosed)
+	h.Record(Record{Action: "x"}) // logs the failure
+}
+
+func TestReopenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewLog(&Options{Path: path})
+	require.NoError(t, err)
+	require.NoError(t, l.Write(Record{Action: "one"}))
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(&Options{Path: path})
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.Write(Record{Action: "two"}))
+
+	records, err := l.Query(Query{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
@@ -173,6 +173,40 @@ func (l *Ledger) AddUser(username string, password string, allow bool, remarks s
 	return nil
 }
 
+// SetUser adds or replaces a user in the ledger with all of its rules, such as
+// when restoring users from a backup.
+func (l *Ledger) SetUser(u UserRule) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.Users == nil {
+		l.Users = make(Users)
+	}
+	l.Users[string(u.Username)] = u
+
+	if l.StorageHook != nil {
+		return l.StorageHook.SaveUser(u)
+	}
+	return nil
+}
+
+// SyncUser adds or replaces a user in the ledger without persisting it, such as when
+// the user was changed by another broker sharing the same store.
+func (l *Ledger) SyncUser(u UserRule) {
+	l.Lock()
+	defer l.Unlock()
+	if l.Users == nil {
+		l.Users = make(Users)
+	}
+	l.Users[string(u.Username)] = u
+}
+
+// SyncRemoveUser removes a user from the ledger without persisting the removal.
+func (l *Ledger) SyncRemoveUser(username string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.Users, username)
+}
+
 // RemoveUser removes a user from the ledger.
 func (l *Ledger) RemoveUser(username string) error {
 	l.Lock()
@@ -574,6 +574,50 @@ func TestLedgerUpdate(t *testing.T) {
 	require.NotSame(t, n, old)
 }
 
+// memoryStore is a ledger store which records saved users.
+type memoryStore struct {
+	users map[string]UserRule
+}
+
+func (m *memoryStore) SaveUser(u UserRule) error {
+	m.users[string(u.Username)] = u
+	return nil
+}
+
+func (m *memoryStore) DeleteUser(username string) error {
+	delete(m.users, username)
+	return nil
+}
+
+func (m *memoryStore) LoadUsers() ([]UserRule, error) {
+	return nil, nil
+}
+
+func TestLedgerSetUser(t *testing.T) {
+	store := &memoryStore{users: map[string]UserRule{}}
+	l := &Ledger{StorageHook: store}
+	u := UserRule{Username: "mochi", Password: "melon", ACL: Filters{"a/#": ReadOnly}, IsAdmin: true}
+
+	require.NoError(t, l.SetUser(u))
+	require.Equal(t, u, l.Users["mochi"])
+	require.Equal(t, u, store.users["mochi"])
+}
+
+func TestLedgerSyncUser(t *testing.T) {
+	store := &memoryStore{users: map[string]UserRule{}}
+	l := &Ledger{StorageHook: store}
+	u := UserRule{Username: "mochi", Password: "melon"}
+
+	l.SyncUser(u)
+	require.Equal(t, u, l.Users["mochi"])
+	require.Empty(t, store.users)
+
+	store.users["mochi"] = u
+	l.SyncRemoveUser("mochi")
+	require.Empty(t, l.Users)
+	require.Len(t, store.users, 1)
+}
+
 func TestLedgerToJSON(t *testing.T) {
 	data, err := ledgerStruct.ToJSON()
 	require.NoError(t, err)
@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package capture provides a hook which records the packets sent and received
+// by selected clients to capture files, and a replayer which feeds a capture
+// back into a server to reproduce its behaviour.
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	// FileExt is the file extension of capture files.
+	FileExt = ".mqcap"
+
+	// defaultDir is the default directory capture files are written to.
+	defaultDir = "captures"
+)
+
+var (
+	// ErrCaptureActive indicates a capture is already running for the client.
+	ErrCaptureActive = errors.New("capture already active for client")
+
+	// ErrCaptureNotActive indicates there is no running capture for the client.
+	ErrCaptureNotActive = errors.New("capture not active for client")
+
+	// ErrEmptyClientID indicates a capture was requested without a client id.
+	ErrEmptyClientID = errors.New("client id required")
+)
+
+// Options contains configuration settings for the capture hook.
+type Options struct {
+	Dir string `yaml:"dir" json:"dir"` // the directory capture files are written to
+}
+
+// Session describes a running capture.
+type Session struct {
+	ClientID string    `json:"client_id"` // the client id being captured
+	File     string    `json:"file"`      // the name of the capture file within the capture directory
+	Started  time.Time `json:"started"`   // the time the capture was started
+	Packets  int64     `json:"packets"`   // the number of packets captured so far
+}
+
+// session is a running capture and its open file.
+type session struct {
+	info    Session
+	packets int64
+	file    *os.File
+	writer  *Writer
+}
+
+// Hook is a hook which captures the packets read from and sent to selected clients.
+type Hook struct {
+	mqtt.HookBase
+	mu       sync.RWMutex
+	config   *Options
+	sessions map[string]*session
+	active   int32 // the number of running captures, to skip locking when idle
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "packet-capture"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPacketReceived,
+		mqtt.OnPacketSent,
+	}, []byte{b})
+}
+
+// Init configures the capture directory.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Dir == "" {
+		h.config.Dir = defaultDir
+	}
+
+	h.sessions = map[string]*session{}
+	return os.MkdirAll(h.config.Dir, 0700)
+}
+
+// Stop stops any running captures.
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, s := range h.sessions {
+		_ = s.file.Close()
+		delete(h.sessions, id)
+	}
+	atomic.StoreInt32(&h.active, 0)
+
+	return nil
+}
+
+// Dir returns the directory capture files are written to.
+func (h *Hook) Dir() string {
+	return h.config.Dir
+}
+
+// StartCapture starts capturing the packets of a client. The capture continues across
+// reconnections until it is stopped.
+func (h *Hook) StartCapture(clientID string) (Session, error) {
+	if clientID == "" {
+		return Session{}, ErrEmptyClientID
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.sessions[clientID]; ok {
+		return Session{}, ErrCaptureActive
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%d%s", fileSafe(clientID), now.UnixNano(), FileExt)
+	f, err := os.OpenFile(filepath.Join(h.config.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return Session{}, err
+	}
+
+	w, err := NewWriter(f, clientID, now)
+	if err != nil {
+		_ = f.Close()
+		return Session{}, err
+	}
+
+	s := &session{
+		info: Session{
+			ClientID: clientID,
+			File:     name,
+			Started:  now,
+		},
+		file:   f,
+		writer: w,
+	}
+
+	h.sessions[clientID] = s
+	atomic.AddInt32(&h.active, 1)
+	h.Log.Info("packet capture started", "client", clientID, "file", name)
+
+	return s.info, nil
+}
+
+// StopCapture stops capturing the packets of a client and closes the capture file.
+func (h *Hook) StopCapture(clientID string) (Session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[clientID]
+	if !ok {
+		return Session{}, ErrCaptureNotActive
+	}
+
+	delete(h.sessions, clientID)
+	atomic.AddInt32(&h.active, -1)
+
+	info := s.info
+	info.Packets = atomic.LoadInt64(&s.packets)
+	h.Log.Info("packet capture stopped", "client", clientID, "file", info.File, "packets", info.Packets)
+
+	return info, s.file.Close()
+}
+
+// Sessions returns the running captures, ordered by client id.
+func (h *Hook) Sessions() []Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		info := s.info
+		info.Packets = atomic.LoadInt64(&s.packets)
+		sessions = append(sessions, info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ClientID < sessions[j].ClientID
+	})
+
+	return sessions
+}
+
+// Files returns the names of the capture files in the capture directory.
+func (h *Hook) Files() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(h.config.Dir, "*"+FileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, len(matches))
+	for i, m := range matches {
+		files[i] = filepath.Base(m)
+	}
+
+	return files, nil
+}
+
+// Path returns the full path of a capture file by name, rejecting names which
+// would resolve outside the capture directory.
+func (h *Hook) Path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, FileExt) {
+		return "", os.ErrNotExist
+	}
+
+	return filepath.Join(h.config.Dir, name), nil
+}
+
+// OnPacketReceived captures the bytes of a packet received from a client exactly as
+// they arrived, including packets which could not be decoded.
+func (h *Hook) OnPacketReceived(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if atomic.LoadInt32(&h.active) == 0 {
+		return
+	}
+
+	id := cl.ID
+	if pk.FixedHeader.Type == packets.Connect {
+		id = pk.Connect.ClientIdentifier // the client id is not set until the connect packet is parsed
+	}
+
+	s := h.session(id)
+	if s == nil {
+		return
+	}
+
+	h.write(s, Record{
+		Direction:       In,
+		Time:            time.Now(),
+		ProtocolVersion: pk.ProtocolVersion,
+		Data:            b,
+	})
+}
+
+// OnPacketSent captures the bytes of a packet sent to a client.
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if atomic.LoadInt32(&h.active) == 0 {
+		return
+	}
+
+	s := h.session(cl.ID)
+	if s == nil {
+		return
+	}
+
+	h.write(s, Record{
+		Direction:       Out,
+		Time:            time.Now(),
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Data:            b,
+	})
+}
+
+// session returns the running capture for a client id, if any.
+func (h *Hook) session(id string) *session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[id]
+}
+
+// write writes a record to a capture, logging any failure.
+func (h *Hook) write(s *session, r Record) {
+	if err := s.writer.Write(r); errors.Is(err, os.ErrClosed) {
+		return // the capture was stopped while the packet was in flight
+	} else if err != nil {
+		h.Log.Error("failed to write captured packet", "error", err, "client", s.info.ClientID)
+		return
+	}
+
+	atomic.AddInt64(&s.packets, 1)
+}
+
+// fileSafe returns a version of a client id which is safe to use in a file name.
+func fileSafe(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+}
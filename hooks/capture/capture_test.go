@@ -0,0 +1,330 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// a short mqtt v3.1.1 session for client cl1.
+	connectPacket     = []byte{0x10, 0x0f, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 30, 0, 3, 'c', 'l', '1'}
+	subscribePacket   = []byte{0x82, 0x08, 0, 1, 0, 3, 'a', '/', 'b', 0}
+	pingreqPacket     = []byte{0xc0, 0x00}
+	disconnectPacket  = []byte{0xe0, 0x00}
+	connackPacket     = []byte{0x20, 0x02, 0, 0}
+	subackPacket      = []byte{0x90, 0x03, 0, 1, 0}
+	pingrespPacket    = []byte{0xd0, 0x00}
+	sessionPackets    = [][]byte{connectPacket, subscribePacket, pingreqPacket, disconnectPacket}
+	sessionResponses  = [][]byte{connackPacket, subackPacket, pingrespPacket}
+	replayTestOptions = &ReplayOptions{Listener: "t1"}
+)
+
+// newCapture returns a reader for an in-memory capture of the inbound test session.
+func newCapture(t *testing.T) *Reader {
+	return newCaptureOf(t, sessionPackets)
+}
+
+// newCaptureOf returns a reader for an in-memory capture of inbound packets.
+func newCaptureOf(t *testing.T, pks [][]byte) *Reader {
+	buf := new(bytes.Buffer)
+	start := time.Now()
+	w, err := NewWriter(buf, "cl1", start)
+	require.NoError(t, err)
+	for i, b := range pks {
+		require.NoError(t, w.Write(Record{
+			Direction:       In,
+			Time:            start.Add(time.Duration(i) * time.Millisecond),
+			ProtocolVersion: 4,
+			Data:            b,
+		}))
+	}
+
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	return r
+}
+
+func newServer(t *testing.T) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	return s
+}
+
+func newHook(t *testing.T) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Dir: t.TempDir()}))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "packet-capture", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnPacketReceived))
+	require.True(t, h.Provides(mqtt.OnPacketSent))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestWriterReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	start := time.Unix(1700000000, 5)
+	w, err := NewWriter(buf, "client/1", start)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Record{Direction: In, Time: start.Add(time.Second), ProtocolVersion: 5, Data: connectPacket}))
+	require.NoError(t, w.Write(Record{Direction: Out, Time: start.Add(2 * time.Second), ProtocolVersion: 5, Data: connackPacket}))
+	require.NoError(t, w.Write(Record{Direction: Out, Time: start.Add(-time.Second), Data: pingrespPacket}))
+
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	require.Equal(t, "client/1", r.ClientID)
+	require.True(t, start.Equal(r.Start))
+
+	records, err := r.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, In, records[0].Direction)
+	require.Equal(t, byte(5), records[0].ProtocolVersion)
+	require.Equal(t, connectPacket, records[0].Data)
+	require.Equal(t, packets.Connect, records[0].Type())
+	require.True(t, start.Add(time.Second).Equal(records[0].Time))
+	require.Equal(t, Out, records[1].Direction)
+	require.Equal(t, connackPacket, records[1].Data)
+	require.True(t, start.Equal(records[2].Time)) // negative offsets are clamped
+	require.Contains(t, records[1].String(), "-> Connack")
+}
+
+func TestReaderInvalid(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("MQ")))
+	require.ErrorIs(t, err, ErrInvalidCapture)
+
+	_, err = NewReader(bytes.NewReader([]byte("NOTCAP123456789")))
+	require.ErrorIs(t, err, ErrInvalidCapture)
+
+	_, err = NewReader(bytes.NewReader(append([]byte(magic), 9, 0, 0, 0, 0, 0, 0, 0, 0, 0)))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, "cl1", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Record{Direction: In, Time: time.Now(), Data: connectPacket}))
+
+	b := buf.Bytes()
+	r, err := NewReader(bytes.NewReader(b[:len(b)-3]))
+	require.NoError(t, err)
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStartStopCapture(t *testing.T) {
+	h := newHook(t)
+
+	_, err := h.StartCapture("")
+	require.ErrorIs(t, err, ErrEmptyClientID)
+
+	session, err := h.StartCapture("a/b")
+	require.NoError(t, err)
+	require.Equal(t, "a/b", session.ClientID)
+	require.Contains(t, session.File, "a_b-")
+
+	_, err = h.StartCapture("a/b")
+	require.ErrorIs(t, err, ErrCaptureActive)
+	require.Len(t, h.Sessions(), 1)
+
+	_, err = h.StopCapture("a/b")
+	require.NoError(t, err)
+	require.Len(t, h.Sessions(), 0)
+
+	_, err = h.StopCapture("a/b")
+	require.ErrorIs(t, err, ErrCaptureNotActive)
+
+	files, err := h.Files()
+	require.NoError(t, err)
+	require.Equal(t, []string{session.File}, files)
+}
+
+func TestPath(t *testing.T) {
+	h := newHook(t)
+	_, err := h.Path("../secret" + FileExt)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = h.Path("data.db")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	p, err := h.Path("cl1-1" + FileExt)
+	require.NoError(t, err)
+	require.Equal(t, h.Dir(), p[:len(h.Dir())])
+}
+
+func TestNotCapturing(t *testing.T) {
+	h := newHook(t)
+	cl := &mqtt.Client{ID: "cl1"}
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}
+	h.OnPacketReceived(cl, pk, pingreqPacket)
+	h.OnPacketSent(cl, packets.Packet{}, pingrespPacket)
+
+	_, err := h.StartCapture("other")
+	require.NoError(t, err)
+	h.OnPacketReceived(cl, pk, pingreqPacket)
+	h.OnPacketSent(cl, packets.Packet{}, pingrespPacket)
+	require.Equal(t, int64(0), h.Sessions()[0].Packets)
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	// capture a live session on one server
+	h := new(Hook)
+	s := newServer(t)
+	require.NoError(t, s.AddHook(h, &Options{Dir: t.TempDir()}))
+
+	session, err := h.StartCapture("cl1")
+	require.NoError(t, err)
+
+	res, err := Replay(s, newCapture(t), replayTestOptions)
+	require.NoError(t, err)
+	require.Len(t, res.Sent, len(sessionPackets))
+
+	session, err = h.StopCapture("cl1")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(sessionPackets)+len(sessionResponses)), session.Packets)
+
+	path, err := h.Path(session.File)
+	require.NoError(t, err)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := NewReader(f)
+	require.NoError(t, err)
+	require.Equal(t, "cl1", r.ClientID)
+
+	// the captured packets should match the original bytes in each direction
+	res, err = Replay(newServer(t), r, replayTestOptions)
+	require.NoError(t, err)
+
+	var in, out [][]byte
+	for _, rec := range res.Captured {
+		if rec.Direction == In {
+			in = append(in, rec.Data)
+		} else {
+			out = append(out, rec.Data)
+		}
+	}
+	require.Equal(t, sessionPackets, in)
+	require.Equal(t, sessionResponses, out)
+
+	// and replaying the capture into a fresh server should reproduce the responses
+	require.Equal(t, -1, Diff(res.Captured, res.Received))
+	require.Equal(t, byte(4), res.Received[0].ProtocolVersion)
+}
+
+func TestCaptureRawBytes(t *testing.T) {
+	h := new(Hook)
+	s := newServer(t)
+	require.NoError(t, s.AddHook(h, &Options{Dir: t.TempDir()}))
+
+	session, err := h.StartCapture("cl1")
+	require.NoError(t, err)
+
+	// a pingreq with a non-canonical remaining length, then a publish which can't be decoded
+	nonCanonical := []byte{0xc0, 0x80, 0x00}
+	malformed := []byte{0x32, 0x02, 0, 5}
+	res, err := Replay(s, newCaptureOf(t, [][]byte{connectPacket, nonCanonical, malformed}), replayTestOptions)
+	require.NoError(t, err)
+	require.Error(t, res.Error)
+
+	session, err = h.StopCapture("cl1")
+	require.NoError(t, err)
+
+	path, err := h.Path(session.File)
+	require.NoError(t, err)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := NewReader(f)
+	require.NoError(t, err)
+	records, err := r.ReadAll()
+	require.NoError(t, err)
+
+	var in [][]byte
+	for _, rec := range records {
+		if rec.Direction == In {
+			in = append(in, rec.Data)
+		}
+	}
+	require.Equal(t, [][]byte{connectPacket, nonCanonical, malformed}, in)
+}
+
+func TestReplayTimeout(t *testing.T) {
+	// the capture expects a response which a fresh server never sends
+	buf := new(bytes.Buffer)
+	start := time.Now()
+	w, err := NewWriter(buf, "cl1", start)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(Record{Direction: In, Time: start, ProtocolVersion: 4, Data: connectPacket}))
+	require.NoError(t, w.Write(Record{Direction: Out, Time: start, ProtocolVersion: 4, Data: connackPacket}))
+	require.NoError(t, w.Write(Record{Direction: Out, Time: start, ProtocolVersion: 4, Data: pingrespPacket}))
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+
+	res, err := Replay(newServer(t), r, &ReplayOptions{Listener: "t1", Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.Len(t, res.Received, 1)
+	require.Equal(t, 1, Diff(res.Captured, res.Received))
+}
+
+func TestReplayNoInbound(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_, err := NewWriter(buf, "cl1", time.Now())
+	require.NoError(t, err)
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+
+	_, err = Replay(newServer(t), r, nil)
+	require.ErrorIs(t, err, ErrNoInbound)
+}
+
+func TestDiff(t *testing.T) {
+	captured := []Record{
+		{Direction: In, Data: connectPacket},
+		{Direction: Out, Data: connackPacket},
+		{Direction: Out, Data: subackPacket},
+	}
+	require.Equal(t, -1, Diff(captured, []Record{{Data: connackPacket}, {Data: subackPacket}}))
+	require.Equal(t, 1, Diff(captured, []Record{{Data: connackPacket}, {Data: pingrespPacket}}))
+	require.Equal(t, 1, Diff(captured, []Record{{Data: connackPacket}}))
+	require.Equal(t, 2, Diff(captured, []Record{{Data: connackPacket}, {Data: subackPacket}, {Data: pingrespPacket}}))
+}
+
+func TestReadPacketMalformedLength(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}))
+	_, err := readPacket(br)
+	require.ErrorIs(t, err, packets.ErrMalformedVariableByteInteger)
+}
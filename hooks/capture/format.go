@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// A capture file consists of a header followed by any number of records:
+//
+//	header: magic "MQCAP" | version (1 byte) | start unix nanoseconds (8 bytes, big endian) |
+//	        client id length (uvarint) | client id
+//	record: direction (1 byte) | nanoseconds since start (uvarint) | protocol version (1 byte) |
+//	        packet length (uvarint) | packet bytes
+const (
+	magic         = "MQCAP"
+	formatVersion = 1
+
+	In  byte = 0 // the packet was received from the client
+	Out byte = 1 // the packet was sent to the client
+
+	// maxRecordSize is the largest packet length which will be read from a capture.
+	maxRecordSize = 268435455 + 5
+)
+
+var (
+	// ErrInvalidCapture indicates the data being read is not a capture file.
+	ErrInvalidCapture = errors.New("invalid capture file")
+
+	// ErrUnsupportedVersion indicates the capture file was written by a newer format version.
+	ErrUnsupportedVersion = errors.New("unsupported capture file version")
+)
+
+// Record is a single captured packet.
+type Record struct {
+	Direction       byte      // In or Out
+	Time            time.Time // the time the packet was read or sent
+	ProtocolVersion byte      // the mqtt protocol version of the client at the time
+	Data            []byte    // the encoded packet, including the fixed header
+}
+
+// Type returns the mqtt packet type of the record.
+func (r Record) Type() byte {
+	if len(r.Data) == 0 {
+		return 0
+	}
+
+	return r.Data[0] >> 4
+}
+
+// String returns a short human-readable description of the record.
+func (r Record) String() string {
+	dir := "<-"
+	if r.Direction == Out {
+		dir = "->"
+	}
+
+	return fmt.Sprintf("%s %s %s (%d bytes)", r.Time.Format(time.RFC3339Nano), dir, packets.PacketNames[r.Type()], len(r.Data))
+}
+
+// Writer writes capture records to an underlying writer.
+type Writer struct {
+	sync.Mutex
+	w     io.Writer
+	start time.Time
+	buf   []byte
+}
+
+// NewWriter writes a capture header for a client to w and returns a Writer for its records.
+func NewWriter(w io.Writer, clientID string, start time.Time) (*Writer, error) {
+	b := make([]byte, 0, len(magic)+1+8+binary.MaxVarintLen64+len(clientID))
+	b = append(b, magic...)
+	b = append(b, formatVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(start.UnixNano()))
+	b = binary.AppendUvarint(b, uint64(len(clientID)))
+	b = append(b, clientID...)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:     w,
+		start: start,
+	}, nil
+}
+
+// Write writes a record. Each record is written with a single call to the underlying writer.
+func (w *Writer) Write(r Record) error {
+	w.Lock()
+	defer w.Unlock()
+
+	offset := r.Time.Sub(w.start)
+	if offset < 0 {
+		offset = 0
+	}
+
+	b := w.buf[:0]
+	b = append(b, r.Direction)
+	b = binary.AppendUvarint(b, uint64(offset))
+	b = append(b, r.ProtocolVersion)
+	b = binary.AppendUvarint(b, uint64(len(r.Data)))
+	b = append(b, r.Data...)
+	w.buf = b
+
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Reader reads capture records from an underlying reader.
+type Reader struct {
+	r        *bufio.Reader
+	ClientID string    // the client id the capture was started for
+	Start    time.Time // the time the capture was started
+}
+
+// NewReader reads a capture header from r and returns a Reader for its records.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	head := make([]byte, len(magic)+1+8)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapture, err)
+	}
+
+	if !bytes.Equal(head[:len(magic)], []byte(magic)) {
+		return nil, ErrInvalidCapture
+	}
+
+	if head[len(magic)] != formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, head[len(magic)])
+	}
+
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > 65535 {
+		return nil, ErrInvalidCapture
+	}
+
+	id := make([]byte, n)
+	if _, err := io.ReadFull(br, id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCapture, err)
+	}
+
+	return &Reader{
+		r:        br,
+		ClientID: string(id),
+		Start:    time.Unix(0, int64(binary.BigEndian.Uint64(head[len(magic)+1:]))),
+	}, nil
+}
+
+// Next returns the next record in the capture, or io.EOF when there are no more records.
+func (r *Reader) Next() (rec Record, err error) {
+	rec.Direction, err = r.r.ReadByte()
+	if err != nil {
+		return rec, err // io.EOF at a record boundary is the end of the capture
+	}
+
+	if rec.Direction != In && rec.Direction != Out {
+		return rec, ErrInvalidCapture
+	}
+
+	offset, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return rec, unexpected(err)
+	}
+	rec.Time = r.Start.Add(time.Duration(offset))
+
+	rec.ProtocolVersion, err = r.r.ReadByte()
+	if err != nil {
+		return rec, unexpected(err)
+	}
+
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return rec, unexpected(err)
+	}
+
+	if n > maxRecordSize {
+		return rec, ErrInvalidCapture
+	}
+
+	rec.Data = make([]byte, n)
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		return rec, unexpected(err)
+	}
+
+	return rec, nil
+}
+
+// ReadAll returns all remaining records in the capture.
+func (r *Reader) ReadAll() ([]Record, error) {
+	var records []Record
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+
+		records = append(records, rec)
+	}
+}
+
+// unexpected converts an EOF within a record into an unexpected EOF.
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
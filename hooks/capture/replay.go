@@ -0,0 +1,231 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+var (
+	// ErrNoInbound indicates a capture contains no inbound packets to replay.
+	ErrNoInbound = errors.New("capture contains no inbound packets")
+)
+
+const (
+	// defaultTimeout is the default longest time to wait for the server to respond.
+	defaultTimeout = 5 * time.Second
+)
+
+// ReplayOptions contains configuration settings for replaying a capture.
+type ReplayOptions struct {
+	Listener string        // the listener id the replayed client appears to connect on
+	Realtime bool          // preserve the original gaps between inbound packets
+	Timeout  time.Duration // the longest time to wait for the expected responses (default 5s)
+}
+
+// ReplayResult contains the packets exchanged while replaying a capture.
+type ReplayResult struct {
+	Captured []Record // all of the records read from the capture
+	Sent     []Record // the inbound packets written to the server
+	Received []Record // the packets the server sent in response
+	Error    error    // the error returned by the server when the connection ended, if any
+}
+
+// Replay feeds the inbound packets of a capture into a server over an in-memory
+// connection, as though they were sent by the original client, and collects
+// the packets the server sends back. The received packets can be compared to
+// the outbound records of the capture to check the broker behaves the same way.
+// Once every inbound packet is written, Replay waits until the server has sent as
+// many packets as the capture recorded or has closed the connection, up to Timeout.
+func Replay(server *mqtt.Server, r *Reader, opts *ReplayOptions) (*ReplayResult, error) {
+	if opts == nil {
+		opts = new(ReplayOptions)
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	inbound, outbound := 0, 0
+	for _, rec := range records {
+		if rec.Direction == In {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+
+	if inbound == 0 {
+		return nil, ErrNoInbound
+	}
+
+	client, conn := net.Pipe()
+	res := &ReplayResult{Captured: records}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		res.Error = server.EstablishConnection(opts.Listener, conn)
+	}()
+
+	var mu sync.Mutex
+	var received []Record
+	notify := make(chan struct{}, 1) // signalled each time a packet is received
+	closed := make(chan struct{})    // closed when the server ends the connection
+	go func() {
+		defer wg.Done()
+		defer close(closed)
+		br := bufio.NewReader(client)
+		for {
+			b, err := readPacket(br)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			received = append(received, Record{
+				Direction: Out,
+				Time:      time.Now(),
+				Data:      b,
+			})
+			mu.Unlock()
+
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	timeout := time.NewTimer(opts.Timeout)
+	defer timeout.Stop()
+
+	var last time.Time
+	for _, rec := range records {
+		if rec.Direction != In {
+			continue
+		}
+
+		if opts.Realtime && !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		_ = client.SetWriteDeadline(time.Now().Add(opts.Timeout))
+		if _, err := client.Write(rec.Data); err != nil {
+			break // the server closed the connection
+		}
+
+		res.Sent = append(res.Sent, rec)
+	}
+
+wait:
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= outbound {
+			break
+		}
+
+		select {
+		case <-notify:
+		case <-closed:
+			break wait
+		case <-timeout.C:
+			break wait
+		}
+	}
+
+	_ = client.Close()
+	wg.Wait()
+
+	res.Received = received
+	for i := range res.Received {
+		res.Received[i].ProtocolVersion = protocolVersion(res.Sent)
+	}
+
+	return res, nil
+}
+
+// protocolVersion returns the protocol version of the first replayed packet.
+func protocolVersion(records []Record) byte {
+	if len(records) == 0 {
+		return 0
+	}
+
+	return records[0].ProtocolVersion
+}
+
+// readPacket reads the bytes of a single mqtt packet from a stream.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	hb, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{hb}
+	n, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, packets.ErrMalformedVariableByteInteger
+		}
+
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, c)
+		n += int(c&127) * multiplier
+		if c&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return append(b, body...), nil
+}
+
+// Diff compares the outbound packets of a capture with the packets received during
+// a replay, returning the index of the first difference, or -1 if they match.
+// Packets which depend on the time of the capture, such as those containing
+// assigned client identifiers, may legitimately differ.
+func Diff(captured, replayed []Record) int {
+	var out []Record
+	for _, rec := range captured {
+		if rec.Direction == Out {
+			out = append(out, rec)
+		}
+	}
+
+	for i := 0; i < len(out) || i < len(replayed); i++ {
+		if i >= len(out) || i >= len(replayed) || !bytes.Equal(out[i].Data, replayed[i].Data) {
+			return i
+		}
+	}
+
+	return -1
+}
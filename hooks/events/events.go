@@ -0,0 +1,256 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package events provides a hook which publishes client lifecycle events as
+// structured JSON messages to $SYS topics.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	// DefaultTopicPrefix is the topic prefix which client events are published under.
+	DefaultTopicPrefix = "$SYS/brokers/clients"
+
+	Connected    = "connected"    // a client has established a session
+	Disconnected = "disconnected" // a client has disconnected
+	Subscribed   = "subscribed"   // a client has subscribed to one or more filters
+	Unsubscribed = "unsubscribed" // a client has unsubscribed from one or more filters
+)
+
+var (
+	// ErrServerRequired indicates the hook was initialised without a server to publish to.
+	ErrServerRequired = errors.New("events hook requires a server instance")
+
+	// ErrUnknownEvent indicates an unrecognised event name was provided in the options.
+	ErrUnknownEvent = errors.New("unknown client event")
+
+	// ErrInvalidQos indicates the qos in the options was greater than 2.
+	ErrInvalidQos = errors.New("invalid event qos")
+
+	// topicEscaper escapes the characters of a client id which have a meaning in topics.
+	topicEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23", "\x00", "%00")
+
+	// allEvents is the set of events published when no events are explicitly configured.
+	allEvents = []string{Connected, Disconnected, Subscribed, Unsubscribed}
+)
+
+// Options contains configuration settings for the events hook.
+type Options struct {
+	Server      *mqtt.Server `yaml:"-" json:"-"`                       // the server to publish events through (requires InlineClient)
+	TopicPrefix string       `yaml:"topic_prefix" json:"topic_prefix"` // the topic prefix to publish under (default $SYS/brokers/clients)
+	Events      []string     `yaml:"events" json:"events"`             // the events to publish (default all)
+	Qos         byte         `yaml:"qos" json:"qos"`                   // the maximum qos subscribers receive events with
+}
+
+// Event is the JSON payload published for each client lifecycle event.
+type Event struct {
+	Event           string   `json:"event"`                      // the name of the event
+	ClientID        string   `json:"clientid"`                   // the id of the client
+	Username        string   `json:"username,omitempty"`         // the username the client connected with
+	Remote          string   `json:"remote,omitempty"`           // the remote address of the client
+	Listener        string   `json:"listener,omitempty"`         // the id of the listener the client connected on
+	ProtocolVersion byte     `json:"protocol_version,omitempty"` // the mqtt protocol version of the client
+	Keepalive       uint16   `json:"keepalive,omitempty"`        // the keepalive of the client in seconds
+	Clean           bool     `json:"clean,omitempty"`            // the client requested a clean start/session
+	Reason          string   `json:"reason,omitempty"`           // the reason the client disconnected
+	Error           string   `json:"error,omitempty"`            // the connection error which caused the disconnect, if different to reason
+	Expire          bool     `json:"expire,omitempty"`           // the session was discarded on disconnect
+	Filters         []Filter `json:"filters,omitempty"`          // the filters subscribed or unsubscribed
+	Timestamp       int64    `json:"ts"`                         // the time of the event in unix milliseconds
+}
+
+// Filter describes a single subscription or unsubscription filter within an event.
+type Filter struct {
+	Filter     string `json:"filter"`                // the topic filter
+	Qos        byte   `json:"qos,omitempty"`         // the requested subscription qos
+	ReasonCode byte   `json:"reason_code,omitempty"` // the reason code returned to the client, if subscribing
+	Identifier int    `json:"identifier,omitempty"`  // the subscription identifier, if any
+}
+
+// Hook is a hook which publishes client lifecycle events to $SYS topics.
+type Hook struct {
+	mqtt.HookBase
+	config  *Options
+	enabled map[string]bool
+}
+
+// ID returns the ID of the hook.
+func (h *Hook) ID() string {
+	return "client-events"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+	}, []byte{b})
+}
+
+// Init configures the hook with the server and the events to publish.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		return ErrServerRequired
+	}
+
+	h.config = config.(*Options)
+	if h.config.Server == nil {
+		return ErrServerRequired
+	}
+
+	if !h.config.Server.Options.InlineClient {
+		return mqtt.ErrInlineClientNotEnabled
+	}
+
+	if h.config.Qos > 2 {
+		return ErrInvalidQos
+	}
+
+	if h.config.TopicPrefix == "" {
+		h.config.TopicPrefix = DefaultTopicPrefix
+	}
+	h.config.TopicPrefix = strings.TrimSuffix(h.config.TopicPrefix, "/")
+
+	events := h.config.Events
+	if len(events) == 0 {
+		events = allEvents
+	}
+
+	h.enabled = make(map[string]bool, len(events))
+	for _, e := range events {
+		e = strings.ToLower(e)
+		switch e {
+		case Connected, Disconnected, Subscribed, Unsubscribed:
+			h.enabled[e] = true
+		default:
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, e)
+		}
+	}
+
+	return nil
+}
+
+// OnSessionEstablished publishes a connected event when a client establishes a session.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if !h.enabled[Connected] || cl.Net.Inline {
+		return
+	}
+
+	h.publish(cl, h.newEvent(Connected, cl))
+}
+
+// OnDisconnect publishes a disconnected event when a client disconnects, including
+// the reason the connection was stopped.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if !h.enabled[Disconnected] || cl.Net.Inline {
+		return
+	}
+
+	e := h.newEvent(Disconnected, cl)
+	e.Expire = expire
+	if cause := cl.StopCause(); cause != nil {
+		e.Reason = cause.Error()
+	}
+
+	if err != nil && err.Error() != e.Reason {
+		e.Error = err.Error()
+	}
+
+	h.publish(cl, e)
+}
+
+// OnSubscribed publishes a subscribed event listing the filters and their granted reason codes.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if !h.enabled[Subscribed] || cl.Net.Inline || len(pk.Filters) == 0 {
+		return
+	}
+
+	e := h.newEvent(Subscribed, cl)
+	e.Filters = make([]Filter, len(pk.Filters))
+	for i, sub := range pk.Filters {
+		e.Filters[i] = Filter{
+			Filter:     sub.Filter,
+			Qos:        sub.Qos,
+			Identifier: sub.Identifier,
+		}
+
+		if i < len(reasonCodes) {
+			e.Filters[i].ReasonCode = reasonCodes[i]
+		}
+	}
+
+	h.publish(cl, e)
+}
+
+// OnUnsubscribed publishes an unsubscribed event listing the removed filters.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if !h.enabled[Unsubscribed] || cl.Net.Inline || len(pk.Filters) == 0 {
+		return
+	}
+
+	e := h.newEvent(Unsubscribed, cl)
+	e.Filters = make([]Filter, len(pk.Filters))
+	for i, sub := range pk.Filters {
+		e.Filters[i] = Filter{Filter: sub.Filter}
+	}
+
+	h.publish(cl, e)
+}
+
+// newEvent returns an event populated with the common client values.
+func (h *Hook) newEvent(name string, cl *mqtt.Client) Event {
+	return Event{
+		Event:           name,
+		ClientID:        cl.ID,
+		Username:        string(cl.Properties.Username),
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Keepalive:       cl.State.Keepalive,
+		Clean:           cl.Properties.Clean,
+		Timestamp:       time.Now().UnixMilli(),
+	}
+}
+
+// Topic returns the topic an event for a client is published to. The client id is
+// escaped with EscapeClientID so that it is always a single topic level.
+func (h *Hook) Topic(client, event string) string {
+	return h.config.TopicPrefix + "/" + EscapeClientID(client) + "/" + event
+}
+
+// EscapeClientID percent-encodes the characters of a client id which can't be used
+// within a topic level: %, /, +, # and null.
+func EscapeClientID(id string) string {
+	return topicEscaper.Replace(id)
+}
+
+// publish encodes and publishes an event for a client.
+func (h *Hook) publish(cl *mqtt.Client, e Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		h.Log.Error("failed to encode client event", "error", err, "client", cl.ID, "event", e.Event)
+		return
+	}
+
+	err = h.config.Server.Publish(h.Topic(cl.ID, e.Event), payload, false, h.config.Qos)
+	if err != nil {
+		h.Log.Error("failed to publish client event", "error", err, "client", cl.ID, "event", e.Event)
+	}
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package events
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func newClient() *mqtt.Client {
+	cl := &mqtt.Client{
+		ID: "cl1",
+		Net: mqtt.ClientConnection{
+			Remote:   "127.0.0.1:1234",
+			Listener: "t1",
+		},
+		Properties: mqtt.ClientProperties{
+			Username:        []byte("mochi"),
+			ProtocolVersion: 5,
+		},
+	}
+	cl.State.Keepalive = 30
+	return cl
+}
+
+// newServer returns a server and hook, and a slice which collects any published events.
+func newServer(t *testing.T, opts *Options) (*mqtt.Server, *Hook, *[]Event) {
+	s := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       logger,
+	})
+
+	h := new(Hook)
+	if opts == nil {
+		opts = new(Options)
+	}
+	opts.Server = s
+	err := s.AddHook(h, opts)
+	require.NoError(t, err)
+
+	events := new([]Event)
+	err = s.Subscribe(DefaultTopicPrefix+"/+/+", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		var e Event
+		require.NoError(t, json.Unmarshal(pk.Payload, &e))
+		require.Equal(t, h.Topic(e.ClientID, e.Event), pk.TopicName)
+		*events = append(*events, e)
+	})
+	require.NoError(t, err)
+
+	return s, h, events
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "client-events", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.False(t, h.Provides(mqtt.OnPublish))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitNoServer(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.Init(nil), ErrServerRequired)
+	require.ErrorIs(t, h.Init(new(Options)), ErrServerRequired)
+}
+
+func TestInitInlineClientDisabled(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(&Options{Server: mqtt.New(&mqtt.Options{Logger: logger})})
+	require.ErrorIs(t, err, mqtt.ErrInlineClientNotEnabled)
+}
+
+func TestInitUnknownEvent(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(&Options{
+		Server: mqtt.New(&mqtt.Options{InlineClient: true, Logger: logger}),
+		Events: []string{Connected, "exploded"},
+	})
+	require.ErrorIs(t, err, ErrUnknownEvent)
+}
+
+func TestInitInvalidQos(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(&Options{
+		Server: mqtt.New(&mqtt.Options{InlineClient: true, Logger: logger}),
+		Qos:    3,
+	})
+	require.ErrorIs(t, err, ErrInvalidQos)
+}
+
+func TestInitDefaults(t *testing.T) {
+	h := new(Hook)
+	err := h.Init(&Options{
+		Server:      mqtt.New(&mqtt.Options{InlineClient: true, Logger: logger}),
+		TopicPrefix: "events/",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "events/cl1/connected", h.Topic("cl1", Connected))
+	require.Len(t, h.enabled, len(allEvents))
+}
+
+func TestOnSessionEstablished(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	h.OnSessionEstablished(newClient(), packets.Packet{})
+
+	require.Len(t, *events, 1)
+	e := (*events)[0]
+	require.Equal(t, Connected, e.Event)
+	require.Equal(t, "cl1", e.ClientID)
+	require.Equal(t, "mochi", e.Username)
+	require.Equal(t, "127.0.0.1:1234", e.Remote)
+	require.Equal(t, "t1", e.Listener)
+	require.Equal(t, byte(5), e.ProtocolVersion)
+	require.Equal(t, uint16(30), e.Keepalive)
+	require.NotZero(t, e.Timestamp)
+}
+
+func TestOnSessionEstablishedTopicCharacters(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	cl := newClient()
+	cl.ID = "site/a+b#c%d"
+	h.OnSessionEstablished(cl, packets.Packet{})
+
+	require.Len(t, *events, 1) // received by the single level wildcard subscription
+	require.Equal(t, "site/a+b#c%d", (*events)[0].ClientID)
+	require.Equal(t, DefaultTopicPrefix+"/site%2Fa%2Bb%23c%25d/connected", h.Topic(cl.ID, Connected))
+}
+
+func TestEscapeClientID(t *testing.T) {
+	require.Equal(t, "cl1", EscapeClientID("cl1"))
+	require.Equal(t, "%2F%2B%23%25%00", EscapeClientID("/+#%\x00"))
+}
+
+func TestOnDisconnect(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	cl := newClient()
+	cl.Stop(packets.ErrKeepAliveTimeout)
+	h.OnDisconnect(cl, os.ErrDeadlineExceeded, true)
+
+	require.Len(t, *events, 1)
+	e := (*events)[0]
+	require.Equal(t, Disconnected, e.Event)
+	require.Equal(t, packets.ErrKeepAliveTimeout.Error(), e.Reason)
+	require.Equal(t, os.ErrDeadlineExceeded.Error(), e.Error)
+	require.True(t, e.Expire)
+}
+
+func TestOnDisconnectSameError(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	cl := newClient()
+	cl.Stop(packets.ErrSessionTakenOver)
+	h.OnDisconnect(cl, packets.ErrSessionTakenOver, false)
+
+	require.Len(t, *events, 1)
+	require.Equal(t, packets.ErrSessionTakenOver.Error(), (*events)[0].Reason)
+	require.Empty(t, (*events)[0].Error)
+}
+
+func TestOnSubscribed(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	h.OnSubscribed(newClient(), packets.Packet{
+		Filters: packets.Subscriptions{
+			{Filter: "a/b", Qos: 1, Identifier: 4},
+			{Filter: "c/#", Qos: 2},
+		},
+	}, []byte{1, packets.ErrNotAuthorized.Code})
+
+	require.Len(t, *events, 1)
+	e := (*events)[0]
+	require.Equal(t, Subscribed, e.Event)
+	require.Equal(t, []Filter{
+		{Filter: "a/b", Qos: 1, ReasonCode: 1, Identifier: 4},
+		{Filter: "c/#", Qos: 2, ReasonCode: packets.ErrNotAuthorized.Code},
+	}, e.Filters)
+}
+
+func TestOnUnsubscribed(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	h.OnUnsubscribed(newClient(), packets.Packet{
+		Filters: packets.Subscriptions{{Filter: "a/b"}},
+	})
+
+	require.Len(t, *events, 1)
+	require.Equal(t, Unsubscribed, (*events)[0].Event)
+	require.Equal(t, []Filter{{Filter: "a/b"}}, (*events)[0].Filters)
+}
+
+func TestOnUnsubscribedNoFilters(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	h.OnUnsubscribed(newClient(), packets.Packet{})
+	require.Len(t, *events, 0)
+}
+
+func TestEventsDisabled(t *testing.T) {
+	_, h, events := newServer(t, &Options{Events: []string{Disconnected}})
+	cl := newClient()
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}}, []byte{0})
+	h.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}})
+	require.Len(t, *events, 0)
+
+	h.OnDisconnect(cl, nil, false)
+	require.Len(t, *events, 1)
+}
+
+func TestInlineClientIgnored(t *testing.T) {
+	_, h, events := newServer(t, nil)
+	cl := newClient()
+	cl.Net.Inline = true
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnDisconnect(cl, nil, false)
+	require.Len(t, *events, 0)
+}
@@ -0,0 +1,570 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package backup captures broker state into a portable archive and restores it,
+// independently of the storage backend in use.
+//
+// An archive is a gzip compressed stream of json records, one per line. The first
+// record is a header carrying the archive format and version, and each following
+// record holds a single client, subscription, retained, inflight or queued message,
+// system info or user. Readers ignore unknown record kinds and fields, so archives written
+// by newer versions can still be restored.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/migrate"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	Format  = "mochi-backup" // the format name in the archive header
+	Version = 1              // the archive version written by this package
+
+	KindClient       = "client"       // a storage.Client record
+	KindSubscription = "subscription" // a storage.Subscription record
+	KindRetained     = "retained"     // a retained storage.Message record
+	KindInflight     = "inflight"     // an inflight storage.Message record
+	KindQueued       = "queued"       // an offline queued storage.Message record
+	KindSysInfo      = "sysinfo"      // a storage.SystemInfo record
+	KindUser         = "user"         // an auth.UserRule record
+
+	maxRecordSize = 256 * 1024 * 1024 // the largest single record which will be read
+)
+
+var (
+	// ErrInvalidArchive indicates the data is not a backup archive.
+	ErrInvalidArchive = errors.New("invalid backup archive")
+
+	// ErrNotEmpty indicates a backup cannot be restored because the destination already has state.
+	ErrNotEmpty = errors.New("destination is not empty")
+
+	// errReadOnly indicates a write to an archive presented as a storage hook.
+	errReadOnly = errors.New("backup archive is read only")
+)
+
+// Header is the first record of an archive.
+type Header struct {
+	Format        string `json:"format"`                   // always Format
+	Version       int    `json:"version"`                  // the archive version
+	Created       int64  `json:"created"`                  // the unix time the snapshot was taken
+	BrokerVersion string `json:"broker_version,omitempty"` // the version of the broker the snapshot was taken from
+	Redacted      bool   `json:"redacted,omitempty"`       // the passwords of users were removed from the archive
+}
+
+// record is a single line of an archive.
+type record struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Archive is a point-in-time snapshot of broker state.
+type Archive struct {
+	Header        Header
+	Clients       []storage.Client
+	Subscriptions []storage.Subscription
+	Retained      []storage.Message
+	Inflight      []storage.Message
+	Queued        []storage.Message
+	SysInfo       storage.SystemInfo
+	Users         []auth.UserRule
+}
+
+// RedactPasswords removes the passwords of the users in the archive, and marks the
+// archive as redacted. Users restored from a redacted archive can't log in with a
+// password until one is set.
+func (a *Archive) RedactPasswords() {
+	for i := range a.Users {
+		a.Users[i].Password = ""
+	}
+
+	a.Header.Redacted = true
+}
+
+// Counts returns the number of records of each kind in the archive.
+func (a *Archive) Counts() map[string]int {
+	c := map[string]int{
+		KindClient:       len(a.Clients),
+		KindSubscription: len(a.Subscriptions),
+		KindRetained:     len(a.Retained),
+		KindInflight:     len(a.Inflight),
+		KindQueued:       len(a.Queued),
+		KindUser:         len(a.Users),
+	}
+
+	if a.SysInfo.Info.Version != "" || a.SysInfo.Info.Started != 0 {
+		c[KindSysInfo] = 1
+	}
+
+	return c
+}
+
+// Capture takes a snapshot of the state of a running server and the users of its
+// auth ledger, if not nil, without stopping the broker. The state is copied from
+// memory, so it doesn't depend on the storage backend, but the server keeps running
+// while it is copied: each client is copied in turn, along with its subscriptions,
+// inflight and queued messages, and then the retained messages. A message delivered
+// during the capture may therefore appear in one part of the snapshot and not another.
+// Users are included with their passwords, see RedactPasswords.
+func Capture(server *mqtt.Server, ledger *auth.Ledger) *Archive {
+	a := &Archive{
+		Header: Header{
+			Format:        Format,
+			Version:       Version,
+			Created:       time.Now().Unix(),
+			BrokerVersion: server.Info.Version,
+		},
+	}
+
+	for _, cl := range server.Clients.GetAll() {
+		if cl.Net.Inline {
+			continue
+		}
+
+		a.Clients = append(a.Clients, storedClient(cl))
+		for filter, sub := range cl.State.Subscriptions.GetAll() {
+			a.Subscriptions = append(a.Subscriptions, storage.Subscription{
+				ID:                storage.SubscriptionKey + "_" + cl.ID + ":" + filter,
+				T:                 storage.SubscriptionKey,
+				Client:            cl.ID,
+				Filter:            filter,
+				Identifier:        sub.Identifier,
+				RetainHandling:    sub.RetainHandling,
+				Qos:               sub.Qos,
+				RetainAsPublished: sub.RetainAsPublished,
+				NoLocal:           sub.NoLocal,
+			})
+		}
+
+		for _, pk := range cl.State.Inflight.GetAll(false) {
+			m := storedMessage(cl.ID, pk)
+			m.ID = storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
+			m.T = storage.InflightKey
+			a.Inflight = append(a.Inflight, m)
+		}
+
+		for _, qm := range cl.State.Queue.GetAll() {
+			m := storedMessage(cl.ID, qm.Packet)
+			m.ID = storage.QueuedKey + "_" + cl.ID + ":" + fmt.Sprintf("%020d", qm.Sequence)
+			m.T = storage.QueuedKey
+			m.Sequence = qm.Sequence
+			a.Queued = append(a.Queued, m)
+		}
+	}
+
+	for _, pk := range server.Topics.Retained.GetAll() {
+		if strings.HasPrefix(pk.TopicName, mqtt.SysPrefix) {
+			continue // regenerated by the server
+		}
+
+		m := storedMessage("", pk)
+		m.ID = storage.RetainedKey + "_" + pk.TopicName
+		m.T = storage.RetainedKey
+		a.Retained = append(a.Retained, m)
+	}
+
+	a.SysInfo = storage.SystemInfo{
+		ID:   storage.SysInfoKey,
+		T:    storage.SysInfoKey,
+		Info: *server.Info.Clone(),
+	}
+
+	if ledger != nil {
+		a.Users = ledger.GetUsers()
+	}
+
+	return a
+}
+
+// Load takes a snapshot of the state persisted by a storage hook, such as the
+// store of a stopped broker. Users are included if the hook stores them.
+func Load(h mqtt.Hook) (a *Archive, err error) {
+	a = &Archive{
+		Header: Header{
+			Format:  Format,
+			Version: Version,
+			Created: time.Now().Unix(),
+		},
+	}
+
+	if a.Clients, err = h.StoredClients(); err != nil {
+		return nil, fmt.Errorf("reading clients: %w", err)
+	}
+
+	if a.Subscriptions, err = h.StoredSubscriptions(); err != nil {
+		return nil, fmt.Errorf("reading subscriptions: %w", err)
+	}
+
+	if a.Retained, err = h.StoredRetainedMessages(); err != nil {
+		return nil, fmt.Errorf("reading retained messages: %w", err)
+	}
+
+	if a.Inflight, err = h.StoredInflightMessages(); err != nil {
+		return nil, fmt.Errorf("reading inflight messages: %w", err)
+	}
+
+	if a.Queued, err = h.StoredQueuedMessages(); err != nil {
+		return nil, fmt.Errorf("reading queued messages: %w", err)
+	}
+
+	if a.SysInfo, err = h.StoredSysInfo(); err != nil {
+		return nil, fmt.Errorf("reading system info: %w", err)
+	}
+	a.Header.BrokerVersion = a.SysInfo.Info.Version
+
+	if ls, ok := h.(auth.LedgerStore); ok {
+		if a.Users, err = ls.LoadUsers(); err != nil {
+			return nil, fmt.Errorf("reading users: %w", err)
+		}
+	}
+
+	return a, nil
+}
+
+// WriteTo streams the archive to w.
+func (a *Archive) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	enc := json.NewEncoder(zw)
+
+	header := a.Header
+	header.Format = Format
+	header.Version = Version
+	if err := enc.Encode(header); err != nil {
+		return cw.n, err
+	}
+
+	write := func(kind string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(record{Kind: kind, Data: data})
+	}
+
+	var err error
+	for i := 0; i < len(a.Clients) && err == nil; i++ {
+		err = write(KindClient, a.Clients[i])
+	}
+
+	for i := 0; i < len(a.Subscriptions) && err == nil; i++ {
+		err = write(KindSubscription, a.Subscriptions[i])
+	}
+
+	for i := 0; i < len(a.Retained) && err == nil; i++ {
+		err = write(KindRetained, a.Retained[i])
+	}
+
+	for i := 0; i < len(a.Inflight) && err == nil; i++ {
+		err = write(KindInflight, a.Inflight[i])
+	}
+
+	for i := 0; i < len(a.Queued) && err == nil; i++ {
+		err = write(KindQueued, a.Queued[i])
+	}
+
+	if err == nil && a.Counts()[KindSysInfo] > 0 {
+		err = write(KindSysInfo, a.SysInfo)
+	}
+
+	for i := 0; i < len(a.Users) && err == nil; i++ {
+		err = write(KindUser, a.Users[i])
+	}
+
+	if err != nil {
+		return cw.n, err
+	}
+
+	err = zw.Close()
+	return cw.n, err
+}
+
+// Read reads an archive from r. Records of unknown kinds and unknown fields are
+// ignored, so that archives written by newer versions can be read.
+func Read(r io.Reader) (*Archive, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer zr.Close()
+
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+
+	a := new(Archive)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidArchive)
+	}
+
+	if err := json.Unmarshal(scanner.Bytes(), &a.Header); err != nil || a.Header.Format != Format {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidArchive)
+	}
+
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		switch rec.Kind {
+		case KindClient:
+			err = appendRecord(rec.Data, &a.Clients)
+		case KindSubscription:
+			err = appendRecord(rec.Data, &a.Subscriptions)
+		case KindRetained:
+			err = appendRecord(rec.Data, &a.Retained)
+		case KindInflight:
+			err = appendRecord(rec.Data, &a.Inflight)
+		case KindQueued:
+			err = appendRecord(rec.Data, &a.Queued)
+		case KindSysInfo:
+			err = json.Unmarshal(rec.Data, &a.SysInfo)
+		case KindUser:
+			err = appendRecord(rec.Data, &a.Users)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s record: %v", ErrInvalidArchive, rec.Kind, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	return a, nil
+}
+
+// appendRecord decodes a record and appends it to a slice.
+func appendRecord[T any](data json.RawMessage, to *[]T) error {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*to = append(*to, v)
+	return nil
+}
+
+// Restore writes an archive into a storage hook which has no stored clients,
+// subscriptions, retained, inflight or queued messages, such as the store of a stopped
+// broker. The hook is read back afterwards to verify every record was written.
+// Progress is logged to log, if not nil.
+func Restore(a *Archive, dst mqtt.Hook, log *slog.Logger) (*migrate.Report, error) {
+	if err := hookEmpty(dst); err != nil {
+		return nil, err
+	}
+
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return migrate.Migrate(&source{archive: a}, dst, &migrate.Options{Verify: true, Log: log})
+}
+
+// RestoreServer loads an archive into a running server which has no clients or
+// retained messages. If store is not nil the archive is also written to it, so that
+// the restored state survives a restart, and users are added to the ledger if it is
+// not nil.
+func RestoreServer(a *Archive, server *mqtt.Server, ledger *auth.Ledger, store mqtt.Hook) error {
+	for _, cl := range server.Clients.GetAll() {
+		if !cl.Net.Inline {
+			return fmt.Errorf("%w: server has clients", ErrNotEmpty)
+		}
+	}
+
+	for _, pk := range server.Topics.Retained.GetAll() {
+		if !strings.HasPrefix(pk.TopicName, mqtt.SysPrefix) {
+			return fmt.Errorf("%w: server has retained messages", ErrNotEmpty)
+		}
+	}
+
+	if store != nil {
+		if _, err := Restore(a, store, server.Log); err != nil {
+			return err
+		}
+	}
+
+	server.RestoreState(a.Clients, a.Subscriptions, a.Inflight, a.Retained, a.SysInfo.Info)
+	server.RestoreQueued(a.Queued)
+
+	if ledger != nil {
+		for _, u := range a.Users {
+			if err := ledger.SetUser(u); err != nil {
+				return fmt.Errorf("restoring user %s: %w", u.Username, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hookEmpty returns ErrNotEmpty if a storage hook has any stored session state.
+func hookEmpty(h mqtt.Hook) error {
+	clients, err := h.StoredClients()
+	if err != nil {
+		return err
+	}
+
+	subs, err := h.StoredSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	retained, err := h.StoredRetainedMessages()
+	if err != nil {
+		return err
+	}
+
+	inflight, err := h.StoredInflightMessages()
+	if err != nil {
+		return err
+	}
+
+	queued, err := h.StoredQueuedMessages()
+	if err != nil {
+		return err
+	}
+
+	if len(clients)+len(subs)+len(retained)+len(inflight)+len(queued) > 0 {
+		return fmt.Errorf("%w: store has %d clients, %d subscriptions, %d retained, %d inflight and %d queued messages",
+			ErrNotEmpty, len(clients), len(subs), len(retained), len(inflight), len(queued))
+	}
+
+	return nil
+}
+
+// source presents an archive as a storage hook so that it can be migrated into
+// another storage hook.
+type source struct {
+	mqtt.HookBase
+	archive *Archive
+}
+
+// ID returns the id of the hook.
+func (s *source) ID() string {
+	return "backup-archive"
+}
+
+// StoredClients returns the clients in the archive.
+func (s *source) StoredClients() ([]storage.Client, error) {
+	return s.archive.Clients, nil
+}
+
+// StoredSubscriptions returns the subscriptions in the archive.
+func (s *source) StoredSubscriptions() ([]storage.Subscription, error) {
+	return s.archive.Subscriptions, nil
+}
+
+// StoredRetainedMessages returns the retained messages in the archive.
+func (s *source) StoredRetainedMessages() ([]storage.Message, error) {
+	return s.archive.Retained, nil
+}
+
+// StoredInflightMessages returns the inflight messages in the archive.
+func (s *source) StoredInflightMessages() ([]storage.Message, error) {
+	return s.archive.Inflight, nil
+}
+
+// StoredQueuedMessages returns the offline queued messages in the archive.
+func (s *source) StoredQueuedMessages() ([]storage.Message, error) {
+	return s.archive.Queued, nil
+}
+
+// StoredSysInfo returns the system info in the archive.
+func (s *source) StoredSysInfo() (storage.SystemInfo, error) {
+	return s.archive.SysInfo, nil
+}
+
+// LoadUsers returns the users in the archive.
+func (s *source) LoadUsers() ([]auth.UserRule, error) {
+	return s.archive.Users, nil
+}
+
+// SaveUser is not supported by archives.
+func (s *source) SaveUser(u auth.UserRule) error {
+	return errReadOnly
+}
+
+// DeleteUser is not supported by archives.
+func (s *source) DeleteUser(username string) error {
+	return errReadOnly
+}
+
+// storedClient converts a client into a stored client.
+func storedClient(cl *mqtt.Client) storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	return storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval:     props.SessionExpiryInterval,
+			SessionExpiryIntervalFlag: props.SessionExpiryIntervalFlag,
+			AuthenticationMethod:      props.AuthenticationMethod,
+			AuthenticationData:        props.AuthenticationData,
+			RequestProblemInfoFlag:    props.RequestProblemInfoFlag,
+			RequestProblemInfo:        props.RequestProblemInfo,
+			RequestResponseInfo:       props.RequestResponseInfo,
+			ReceiveMaximum:            props.ReceiveMaximum,
+			TopicAliasMaximum:         props.TopicAliasMaximum,
+			User:                      props.User,
+			MaximumPacketSize:         props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+}
+
+// storedMessage converts a publish packet into a stored message.
+func storedMessage(client string, pk packets.Packet) storage.Message {
+	props := pk.Properties.Copy(false)
+	return storage.Message{
+		Client:      client,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		PacketID:    pk.PacketID,
+		Sent:        pk.Created,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+}
+
+// countWriter counts the bytes written to an underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
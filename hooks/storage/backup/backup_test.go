@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+// newServer returns a server with a persistent client, a subscription, an inflight
+// message, a queued message and a retained message.
+func newServer(t *testing.T) *mqtt.Server {
+	s := mqtt.New(&mqtt.Options{Logger: logger, InlineClient: true})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+
+	s.RestoreState(
+		[]storage.Client{{ID: "cl1", ProtocolVersion: 5, Username: []byte("alice"), Properties: storage.ClientProperties{SessionExpiryInterval: 60}}},
+		[]storage.Subscription{{Client: "cl1", Filter: "a/#", Qos: 1, NoLocal: true}},
+		[]storage.Message{{Client: "cl1", PacketID: 7, TopicName: "a/1", Payload: []byte("inflight"), FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}}},
+		[]storage.Message{{TopicName: "a/2", Payload: []byte("retained"), FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}}},
+		system.Info{Started: 1700000000},
+	)
+	s.RestoreQueued([]storage.Message{{Client: "cl1", Sequence: 4, TopicName: "a/3", Payload: []byte("queued"), FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}}})
+
+	// $SYS messages are regenerated by the server and not backed up
+	s.Topics.RetainMessage(packets.Packet{TopicName: mqtt.SysPrefix + "/broker/version", Payload: []byte("2.0.0")})
+
+	return s
+}
+
+func newLedger() *auth.Ledger {
+	l := new(auth.Ledger)
+	_ = l.SetUser(auth.UserRule{Username: "alice", Password: "secret", ACL: auth.Filters{"a/#": auth.ReadWrite}})
+	return l
+}
+
+func newBolt(t *testing.T) *bolt.Hook {
+	h := new(bolt.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&bolt.Options{Path: filepath.Join(t.TempDir(), "bolt.db")}))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func TestCapture(t *testing.T) {
+	a := Capture(newServer(t), newLedger())
+	require.Equal(t, Format, a.Header.Format)
+	require.Equal(t, Version, a.Header.Version)
+
+	require.Len(t, a.Clients, 1) // the inline client is excluded
+	require.Equal(t, "cl1", a.Clients[0].ID)
+	require.Equal(t, []byte("alice"), a.Clients[0].Username)
+	require.Equal(t, uint32(60), a.Clients[0].Properties.SessionExpiryInterval)
+
+	require.Len(t, a.Subscriptions, 1)
+	require.Equal(t, "a/#", a.Subscriptions[0].Filter)
+	require.True(t, a.Subscriptions[0].NoLocal)
+
+	require.Len(t, a.Inflight, 1)
+	require.Equal(t, uint16(7), a.Inflight[0].PacketID)
+	require.Equal(t, "cl1", a.Inflight[0].Client)
+
+	require.Len(t, a.Queued, 1)
+	require.Equal(t, int64(4), a.Queued[0].Sequence)
+	require.Equal(t, "cl1", a.Queued[0].Client)
+
+	require.Len(t, a.Retained, 1)
+	require.Equal(t, "a/2", a.Retained[0].TopicName)
+
+	require.Equal(t, mqtt.Version, a.SysInfo.Version)
+	require.Len(t, a.Users, 1)
+	require.Equal(t, 1, a.Counts()[KindSysInfo])
+}
+
+func TestRedactPasswords(t *testing.T) {
+	a := Capture(newServer(t), newLedger())
+	require.Equal(t, auth.RString("secret"), a.Users[0].Password)
+	require.False(t, a.Header.Redacted)
+
+	a.RedactPasswords()
+	require.Empty(t, a.Users[0].Password)
+	require.Equal(t, auth.RString("alice"), a.Users[0].Username)
+	require.True(t, a.Header.Redacted)
+
+	var buf bytes.Buffer
+	_, err := a.WriteTo(&buf)
+	require.NoError(t, err)
+	b, err := Read(&buf)
+	require.NoError(t, err)
+	require.True(t, b.Header.Redacted)
+	require.Empty(t, b.Users[0].Password)
+}
+
+func TestWriteRead(t *testing.T) {
+	a := Capture(newServer(t), newLedger())
+
+	var buf bytes.Buffer
+	n, err := a.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+
+	got, err := Read(&buf)
+	require.NoError(t, err)
+	require.Equal(t, a.Header, got.Header)
+	require.Equal(t, a.Counts(), got.Counts())
+	require.Equal(t, a.Inflight[0].Payload, got.Inflight[0].Payload)
+	require.Equal(t, a.Queued[0].Sequence, got.Queued[0].Sequence)
+	require.Equal(t, a.Users[0].ACL, got.Users[0].ACL)
+}
+
+func TestReadToleratesFutureVersions(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(`{"format":"mochi-backup","version":9,"created":1,"compression":"zstd"}
+{"kind":"client","data":{"id":"cl1","t":"CL","future_field":true}}
+{"kind":"shared_group","data":{"name":"g1"}}
+{"kind":"retained","data":{"topic_name":"a/b","payload":"aGk="}}
+`))
+	require.NoError(t, zw.Close())
+
+	a, err := Read(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 9, a.Header.Version)
+	require.Len(t, a.Clients, 1)
+	require.Equal(t, "cl1", a.Clients[0].ID)
+	require.Len(t, a.Retained, 1)
+	require.Equal(t, []byte("hi"), a.Retained[0].Payload)
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := Read(bytes.NewReader([]byte("not gzip")))
+	require.ErrorIs(t, err, ErrInvalidArchive)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(`{"format":"something-else","version":1}` + "\n"))
+	require.NoError(t, zw.Close())
+	_, err = Read(&buf)
+	require.ErrorIs(t, err, ErrInvalidArchive)
+
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(`{"format":"mochi-backup","version":1}` + "\n" + `{"kind":"client","data":[]}` + "\n"))
+	require.NoError(t, zw.Close())
+	_, err = Read(&buf)
+	require.ErrorIs(t, err, ErrInvalidArchive)
+
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	require.NoError(t, zw.Close())
+	_, err = Read(&buf)
+	require.ErrorIs(t, err, ErrInvalidArchive)
+}
+
+func TestRestoreLoad(t *testing.T) {
+	a := Capture(newServer(t), newLedger())
+	dst := newBolt(t)
+
+	report, err := Restore(a, dst, logger)
+	require.NoError(t, err)
+	require.True(t, report.Verified)
+
+	got, err := Load(dst)
+	require.NoError(t, err)
+	require.Equal(t, a.Counts(), got.Counts())
+	require.Equal(t, a.Header.BrokerVersion, got.Header.BrokerVersion)
+	require.Equal(t, auth.RString("secret"), got.Users[0].Password)
+
+	_, err = Restore(a, dst, logger)
+	require.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestRestoreWithoutUserStore(t *testing.T) {
+	dst := new(pebble.Hook)
+	dst.SetOpts(logger, nil)
+	require.NoError(t, dst.Init(&pebble.Options{Path: filepath.Join(t.TempDir(), "pebble")}))
+	defer dst.Stop()
+
+	a := Capture(newServer(t), nil)
+	report, err := Restore(a, dst, logger)
+	require.NoError(t, err)
+	require.True(t, report.Verified)
+}
+
+func TestRestoreServer(t *testing.T) {
+	a := Capture(newServer(t), newLedger())
+
+	s := mqtt.New(&mqtt.Options{Logger: logger, InlineClient: true})
+	ledger := new(auth.Ledger)
+	store := newBolt(t)
+	require.NoError(t, RestoreServer(a, s, ledger, store))
+
+	cl, ok := s.Clients.Get("cl1")
+	require.True(t, ok)
+	require.Equal(t, 1, cl.State.Subscriptions.Len())
+	_, ok = cl.State.Inflight.Get(7)
+	require.True(t, ok)
+	require.Equal(t, 1, cl.State.Queue.Len())
+	require.Len(t, s.Topics.Messages("a/2"), 1)
+	require.Len(t, ledger.GetUsers(), 1)
+
+	clients, err := store.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	err = RestoreServer(a, s, ledger, nil)
+	require.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestRestoreServerRetainedNotEmpty(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	s.Topics.RetainMessage(packets.Packet{TopicName: "a/b", Payload: []byte("x")})
+	err := RestoreServer(new(Archive), s, nil, nil)
+	require.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestSourceReadOnly(t *testing.T) {
+	s := &source{archive: new(Archive)}
+	require.Equal(t, "backup-archive", s.ID())
+	require.ErrorIs(t, s.SaveUser(auth.UserRule{}), errReadOnly)
+	require.ErrorIs(t, s.DeleteUser("a"), errReadOnly)
+}
@@ -45,6 +45,12 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for an offline queued message. The sequence is
+// zero-padded so that the messages of a client are kept in order.
+func queuedKey(cl *mqtt.Client, seq int64) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + fmt.Sprintf("%020d", seq)
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -66,14 +72,20 @@ type Options struct {
 	// discardRatio must be in the range (0.0, 1.0), both endpoints excluded, otherwise, it will be set to the default value of 0.5.
 	GcDiscardRatio float64 `yaml:"gc_discard_ratio" json:"gc_discard_ratio"`
 	GcInterval     int64   `yaml:"gc_interval" json:"gc_interval"`
+	// WriteBehind optionally queues and coalesces writes, applying them in batches.
+	WriteBehind *storage.WriteBehindOptions `yaml:"write_behind" json:"write_behind"`
+	// Encryption optionally seals records at rest with AES-GCM.
+	Encryption *storage.EncryptionOptions `yaml:"encryption" json:"encryption"`
 }
 
 // Hook is a persistent storage hook based using BadgerDB file store as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config   *Options     // options for configuring the BadgerDB instance.
-	gcTicker *time.Ticker // Ticker for BadgerDB garbage collection.
-	db       *badgerdb.DB // the BadgerDB instance.
+	storage.Encryption
+	config   *Options             // options for configuring the BadgerDB instance.
+	gcTicker *time.Ticker         // Ticker for BadgerDB garbage collection.
+	db       *badgerdb.DB         // the BadgerDB instance.
+	wb       *storage.WriteBehind // optional write-behind layer.
 }
 
 // ID returns the id of the hook.
@@ -93,12 +105,15 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueued,
+		mqtt.OnDequeued,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
+		mqtt.StoredQueuedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
 	}, []byte{b})
@@ -155,6 +170,22 @@ func (h *Hook) Init(config any) error {
 		return err
 	}
 
+	err = h.InitEncryption(h.config.Encryption, h.Log, h.scanRecords, h.replaceRecord)
+	if err != nil {
+		_ = h.db.Close()
+		return err
+	}
+
+	if h.config.WriteBehind != nil {
+		h.wb, err = storage.NewWriteBehind(*h.config.WriteBehind, h.applyWrites, h.Log, storage.InflightKey, storage.QueuedKey)
+		if err != nil {
+			_ = h.db.Close()
+			return err
+		}
+	}
+
+	h.Reencrypt()
+
 	h.gcTicker = time.NewTicker(time.Duration(h.config.GcInterval) * time.Second)
 	go h.gcLoop()
 
@@ -166,7 +197,22 @@ func (h *Hook) Stop() error {
 	if h.gcTicker != nil {
 		h.gcTicker.Stop()
 	}
-	return h.db.Close()
+
+	h.StopEncryption()
+
+	var err error
+	if h.wb != nil {
+		if err = h.wb.Close(); err != nil {
+			h.Log.Error("failed to flush write-behind writes on stop, pending writes are lost", "error", err, "pending", h.wb.Metrics().Pending)
+		}
+		h.wb = nil
+	}
+
+	if cerr := h.db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
 }
 
 // OnSessionEstablished adds a client to the store when their session is established.
@@ -362,6 +408,49 @@ func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	h.OnQosComplete(cl, pk)
 }
 
+// OnQueued adds a message to the store when it is added to the offline queue of a client.
+func (h *Hook) OnQueued(cl *mqtt.Client, pk packets.Packet, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          queuedKey(cl, seq),
+		T:           storage.QueuedKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Sequence:    seq,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnDequeued removes a message from the store when it leaves the offline queue of a client.
+func (h *Hook) OnDequeued(cl *mqtt.Client, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(queuedKey(cl, seq))
+}
+
 // OnSysInfoTick stores the latest system info in the store.
 func (h *Hook) OnSysInfoTick(sys *system.Info) {
 	if h.db == nil {
@@ -471,6 +560,31 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		err = obj.UnmarshalBinary(value)
 		if err == nil {
 			v = append(v, obj)
+			if h.wb != nil {
+				h.wb.MarkStored(obj.ID)
+			}
+		}
+		return err
+	})
+	return
+}
+
+// StoredQueuedMessages returns all stored offline queued messages from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+			if h.wb != nil {
+				h.wb.MarkStored(obj.ID)
+			}
 		}
 		return err
 	})
@@ -514,8 +628,17 @@ func (h *Hook) Debugf(m string, v ...any) {
 
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
-	err := h.db.Update(func(txn *badgerdb.Txn) error {
-		data, _ := v.MarshalBinary()
+	data, err := h.Record(v).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal data", "error", err, "key", k)
+		return err
+	}
+
+	if h.wb != nil {
+		return h.wb.Set(k, data)
+	}
+
+	err = h.db.Update(func(txn *badgerdb.Txn) error {
 		return txn.Set([]byte(k), data)
 	})
 	if err != nil {
@@ -526,6 +649,10 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
+	if h.wb != nil {
+		return h.wb.Delete(k)
+	}
+
 	err := h.db.Update(func(txn *badgerdb.Txn) error {
 		return txn.Delete([]byte(k))
 	})
@@ -538,6 +665,7 @@ func (h *Hook) delKv(k string) error {
 
 // getKv retrieves the value associated with a key from the database.
 func (h *Hook) getKv(k string, v storage.Serializable) error {
+	h.flushWrites()
 	return h.db.View(func(txn *badgerdb.Txn) error {
 		item, err := txn.Get([]byte(k))
 		if err != nil {
@@ -547,12 +675,13 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 		if err != nil {
 			return err
 		}
-		return v.UnmarshalBinary(value)
+		return h.Record(v).UnmarshalBinary(value)
 	})
 }
 
 // iterKv iterates over key-value pairs with keys having the specified prefix in the database.
 func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	h.flushWrites()
 	err := h.db.View(func(txn *badgerdb.Txn) error {
 		iterator := txn.NewIterator(badgerdb.DefaultIteratorOptions)
 		defer iterator.Close()
@@ -560,7 +689,11 @@ func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
 		for iterator.Seek([]byte(prefix)); iterator.ValidForPrefix([]byte(prefix)); iterator.Next() {
 			item := iterator.Item()
 			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
 
+			value, err = h.OpenRecord(value)
 			if err != nil {
 				return err
 			}
@@ -576,3 +709,84 @@ func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
 	}
 	return err
 }
+
+// applyWrites applies a batch of writes from the write-behind layer.
+func (h *Hook) applyWrites(writes []storage.Write) error {
+	batch := h.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for _, w := range writes {
+		var err error
+		if w.Delete {
+			err = batch.Delete([]byte(w.Key))
+		} else {
+			err = batch.Set([]byte(w.Key), w.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
+
+// flushWrites applies any writes pending in the write-behind layer so they can be read.
+func (h *Hook) flushWrites() {
+	if h.wb != nil {
+		_ = h.wb.Flush()
+	}
+}
+
+// scanRecords visits the raw value of every record in the database.
+func (h *Hook) scanRecords(visit func(key string, value []byte) error) error {
+	h.flushWrites()
+	return h.db.View(func(txn *badgerdb.Txn) error {
+		iterator := txn.NewIterator(badgerdb.DefaultIteratorOptions)
+		defer iterator.Close()
+
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := visit(string(item.Key()), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replaceRecord replaces the raw value of a record if it has not changed since it was
+// scanned. A record written concurrently causes a conflict, and is left as written.
+func (h *Hook) replaceRecord(k string, old, data []byte) error {
+	err := h.db.Update(func(txn *badgerdb.Txn) error {
+		item, err := txn.Get([]byte(k))
+		if errors.Is(err, badgerdb.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil || !bytes.Equal(value, old) {
+			return err
+		}
+
+		return txn.Set([]byte(k), data)
+	})
+	if errors.Is(err, badgerdb.ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+// WriteBehindMetrics returns the write-behind counters, or false if write-behind is not enabled.
+func (h *Hook) WriteBehindMetrics() (storage.WriteBehindMetrics, bool) {
+	if h.wb == nil {
+		return storage.WriteBehindMetrics{}, false
+	}
+	return h.wb.Metrics(), true
+}
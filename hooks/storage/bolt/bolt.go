@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -54,6 +55,12 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for an offline queued message. The sequence is
+// zero-padded so that the messages of a client are kept in order.
+func queuedKey(cl *mqtt.Client, seq int64) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + fmt.Sprintf("%020d", seq)
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -61,16 +68,20 @@ func sysInfoKey() string {
 
 // Options contains configuration settings for the bolt instance.
 type Options struct {
-	Options *bbolt.Options
-	Bucket  string `yaml:"bucket" json:"bucket"`
-	Path    string `yaml:"path" json:"path"`
+	Options     *bbolt.Options
+	Bucket      string                      `yaml:"bucket" json:"bucket"`
+	Path        string                      `yaml:"path" json:"path"`
+	WriteBehind *storage.WriteBehindOptions `yaml:"write_behind" json:"write_behind"` // optional batching of writes
+	Encryption  *storage.EncryptionOptions  `yaml:"encryption" json:"encryption"`     // optional encryption of records at rest
 }
 
 // Hook is a persistent storage hook based using boltdb file store as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options  // options for configuring the boltdb instance.
-	db     *bbolt.DB // the boltdb instance.
+	storage.Encryption
+	config *Options             // options for configuring the boltdb instance.
+	db     *bbolt.DB            // the boltdb instance.
+	wb     *storage.WriteBehind // optional write-behind layer.
 }
 
 // ID returns the id of the hook.
@@ -90,12 +101,15 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueued,
+		mqtt.OnDequeued,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
+		mqtt.StoredQueuedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
 	}, []byte{b})
@@ -135,12 +149,39 @@ func (h *Hook) Init(config any) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(h.config.Bucket))
 		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	err = h.InitEncryption(h.config.Encryption, h.Log, h.scanRecords, h.replaceRecord)
+	if err != nil {
+		return err
+	}
+	h.Reencrypt()
+
+	if h.config.WriteBehind != nil {
+		h.wb, err = storage.NewWriteBehind(*h.config.WriteBehind, h.applyWrites, h.Log, storage.InflightKey, storage.QueuedKey)
+	}
+
 	return err
 }
 
 // Stop closes the boltdb instance.
 func (h *Hook) Stop() error {
-	err := h.db.Close()
+	h.StopEncryption()
+
+	var err error
+	if h.wb != nil {
+		if err = h.wb.Close(); err != nil {
+			h.Log.Error("failed to flush write-behind writes on stop, pending writes are lost", "error", err, "pending", h.wb.Metrics().Pending)
+		}
+		h.wb = nil
+	}
+
+	if cerr := h.db.Close(); err == nil {
+		err = cerr
+	}
+
 	h.db = nil
 	return err
 }
@@ -331,6 +372,49 @@ func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	h.OnQosComplete(cl, pk)
 }
 
+// OnQueued adds a message to the store when it is added to the offline queue of a client.
+func (h *Hook) OnQueued(cl *mqtt.Client, pk packets.Packet, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          queuedKey(cl, seq),
+		T:           storage.QueuedKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Sequence:    seq,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	_ = h.setKv(in.ID, in)
+}
+
+// OnDequeued removes a message from the store when it leaves the offline queue of a client.
+func (h *Hook) OnDequeued(cl *mqtt.Client, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	_ = h.delKv(queuedKey(cl, seq))
+}
+
 // OnSysInfoTick stores the latest system info in the store.
 func (h *Hook) OnSysInfoTick(sys *system.Info) {
 	if h.db == nil {
@@ -434,6 +518,31 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		err = obj.UnmarshalBinary(value)
 		if err == nil {
 			v = append(v, obj)
+			if h.wb != nil {
+				h.wb.MarkStored(obj.ID)
+			}
+		}
+		return err
+	})
+	return
+}
+
+// StoredQueuedMessages returns all stored offline queued messages from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.iterKv(storage.QueuedKey, func(value []byte) error {
+		obj := storage.Message{}
+		err = obj.UnmarshalBinary(value)
+		if err == nil {
+			v = append(v, obj)
+			if h.wb != nil {
+				h.wb.MarkStored(obj.ID)
+			}
 		}
 		return err
 	})
@@ -457,10 +566,23 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
-	err := h.db.Update(func(tx *bbolt.Tx) error {
+	data, err := h.Record(v).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal data", "error", err, "key", k)
+		return err
+	}
+
+	return h.setRaw(k, data)
+}
 
+// setRaw stores an encoded value in the database.
+func (h *Hook) setRaw(k string, data []byte) error {
+	if h.wb != nil {
+		return h.wb.Set(k, data)
+	}
+
+	err := h.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
-		data, _ := v.MarshalBinary()
 		err := bucket.Put([]byte(k), data)
 		if err != nil {
 			return err
@@ -475,6 +597,10 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
+	if h.wb != nil {
+		return h.wb.Delete(k)
+	}
+
 	err := h.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 		err := bucket.Delete([]byte(k))
@@ -491,6 +617,7 @@ func (h *Hook) delKv(k string) error {
 
 // getKv retrieves the value associated with a key from the database.
 func (h *Hook) getKv(k string, v storage.Serializable) error {
+	h.flushWrites()
 	err := h.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 
@@ -499,7 +626,7 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 			return ErrKeyNotFound
 		}
 
-		return v.UnmarshalBinary(value)
+		return h.Record(v).UnmarshalBinary(value)
 	})
 	if err != nil {
 		h.Log.Error("failed to get data", "error", err, "key", k)
@@ -509,12 +636,18 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 
 // iterKv iterates over key-value pairs with keys having the specified prefix in the database.
 func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
+	h.flushWrites()
 	err := h.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(h.config.Bucket))
 
 		c := bucket.Cursor()
 		for k, v := c.Seek([]byte(prefix)); k != nil && string(k[:len(prefix)]) == prefix; k, v = c.Next() {
-			if err := visit(v); err != nil {
+			plain, err := h.OpenRecord(v)
+			if err != nil {
+				return err
+			}
+
+			if err := visit(plain); err != nil {
 				return err
 			}
 		}
@@ -527,6 +660,61 @@ func (h *Hook) iterKv(prefix string, visit func([]byte) error) error {
 	return err
 }
 
+// applyWrites applies a batch of writes from the write-behind layer in a single transaction.
+func (h *Hook) applyWrites(writes []storage.Write) error {
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(h.config.Bucket))
+		for _, w := range writes {
+			var err error
+			if w.Delete {
+				err = bucket.Delete([]byte(w.Key))
+			} else {
+				err = bucket.Put([]byte(w.Key), w.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// flushWrites applies any writes pending in the write-behind layer so they can be read.
+func (h *Hook) flushWrites() {
+	if h.wb != nil {
+		_ = h.wb.Flush()
+	}
+}
+
+// scanRecords visits the raw value of every record in the database.
+func (h *Hook) scanRecords(visit func(key string, value []byte) error) error {
+	h.flushWrites()
+	return h.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(h.config.Bucket)).ForEach(func(k, v []byte) error {
+			return visit(string(k), v)
+		})
+	})
+}
+
+// replaceRecord replaces the raw value of a record if it has not changed since it was scanned.
+func (h *Hook) replaceRecord(k string, old, data []byte) error {
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(h.config.Bucket))
+		if !bytes.Equal(bucket.Get([]byte(k)), old) {
+			return nil
+		}
+		return bucket.Put([]byte(k), data)
+	})
+}
+
+// WriteBehindMetrics returns the write-behind counters, or false if write-behind is not enabled.
+func (h *Hook) WriteBehindMetrics() (storage.WriteBehindMetrics, bool) {
+	if h.wb == nil {
+		return storage.WriteBehindMetrics{}, false
+	}
+	return h.wb.Metrics(), true
+}
+
 // DeleteClient removes a client from the store by id.
 func (h *Hook) DeleteClient(id string) error {
 	if h.db == nil {
@@ -564,15 +752,7 @@ func (h *Hook) SaveUser(u auth.UserRule) error {
 		return storage.ErrDBFileNotOpen
 	}
 
-	key := "USER_" + string(u.Username)
-	return h.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(h.config.Bucket))
-		data, err := json.Marshal(u)
-		if err != nil {
-			return err
-		}
-		return bucket.Put([]byte(key), data)
-	})
+	return h.setKv("USER_"+string(u.Username), storage.JSONValue{V: u})
 }
 
 // DeleteUser removes a user rule from the store.
@@ -5,6 +5,8 @@
 package bolt
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"log/slog"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/hooks/storage"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/mochi-mqtt/server/v2/system"
@@ -63,6 +66,11 @@ func TestInflightKey(t *testing.T) {
 	require.Equal(t, storage.InflightKey+"_cl1:1", k)
 }
 
+func TestQueuedKey(t *testing.T) {
+	k := queuedKey(&mqtt.Client{ID: "cl1"}, 12)
+	require.Equal(t, storage.QueuedKey+"_cl1:00000000000000000012", k)
+}
+
 func TestSysInfoKey(t *testing.T) {
 	require.Equal(t, storage.SysInfoKey, sysInfoKey())
 }
@@ -82,10 +90,13 @@ func TestProvides(t *testing.T) {
 	require.True(t, h.Provides(mqtt.OnQosPublish))
 	require.True(t, h.Provides(mqtt.OnQosComplete))
 	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnQueued))
+	require.True(t, h.Provides(mqtt.OnDequeued))
 	require.True(t, h.Provides(mqtt.OnSysInfoTick))
 	require.True(t, h.Provides(mqtt.StoredClients))
 	require.True(t, h.Provides(mqtt.StoredInflightMessages))
 	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredQueuedMessages))
 	require.True(t, h.Provides(mqtt.StoredSubscriptions))
 	require.True(t, h.Provides(mqtt.StoredSysInfo))
 	require.False(t, h.Provides(mqtt.OnACLCheck))
@@ -443,6 +454,223 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 	require.Equal(t, ErrKeyNotFound, err)
 }
 
+func TestOnQueuedThenOnDequeued(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Qos: 1,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		Created:   time.Now().Unix(),
+	}
+
+	h.OnQueued(client, pk, 10)
+	h.OnQueued(client, pk, 9)
+	h.OnQueued(client, pk, 11)
+
+	r, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, int64(9), r[0].Sequence) // keys keep the queue order
+	require.Equal(t, int64(10), r[1].Sequence)
+	require.Equal(t, int64(11), r[2].Sequence)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, pk.Created, r[0].Created)
+
+	h.OnDequeued(client, 9)
+	h.OnDequeued(client, 11)
+	r, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, int64(10), r[0].Sequence)
+}
+
+func TestOnQueuedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQueued(client, packets.Packet{}, 1)
+	h.OnDequeued(client, 1)
+}
+
+func TestWriteBehind(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: &storage.WriteBehindOptions{Mode: storage.DurabilityAsync, FlushInterval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Qos: 1,
+		},
+		PacketID:  1,
+		TopicName: "a/b/c",
+	}
+
+	// an inflight message completed before it is flushed never reaches the store
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	h.OnQosComplete(client, pk)
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1) // pending writes are flushed before reading
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Empty(t, inflight)
+
+	metrics, ok := h.WriteBehindMetrics()
+	require.True(t, ok)
+	require.Equal(t, int64(1), metrics.Cancelled)
+	require.Equal(t, int64(1), metrics.Applied)
+}
+
+func TestWriteBehindStopError(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: &storage.WriteBehindOptions{Mode: storage.DurabilityAsync, FlushInterval: time.Hour}})
+	require.NoError(t, err)
+	defer os.Remove(h.config.Path)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.db.Close())
+	require.Error(t, h.Stop()) // the pending write could not be flushed
+}
+
+func TestWriteBehindMetricsDisabled(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	_, ok := h.WriteBehindMetrics()
+	require.False(t, ok)
+}
+
+func TestEncryption(t *testing.T) {
+	t.Setenv("MOCHI_TEST_KEYS", "k1:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("secret-payload")}, 1)
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "secret-password"}))
+
+	err = h.scanRecords(func(key string, value []byte) error {
+		require.False(t, bytes.Contains(value, []byte("secret")), key)
+		id, ok := storage.KeyID(value)
+		require.True(t, ok, key)
+		require.Equal(t, "k1", id)
+		return nil
+	})
+	require.NoError(t, err)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("secret-payload"), retained[0].Payload)
+
+	users, err := h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, auth.RString("secret-password"), users[0].Password)
+
+	status, ok := h.EncryptionStatus()
+	require.True(t, ok)
+	require.Equal(t, "k1", status.ActiveKey)
+}
+
+func TestEncryptionRotateKeys(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	require.NoError(t, h.Stop())
+
+	// records written before encryption was enabled are sealed in the background.
+	k1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	t.Setenv("MOCHI_TEST_KEYS", k1)
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	err = h.Init(&Options{Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+	h.WaitEncryption()
+
+	keyIDs := func() map[string]string {
+		ids := make(map[string]string)
+		_ = h.scanRecords(func(key string, value []byte) error {
+			ids[key], _ = storage.KeyID(value)
+			return nil
+		})
+		return ids
+	}
+	require.Equal(t, map[string]string{clientKey(client): "k1", retainedKey("a/b/c"): "k1"}, keyIDs())
+
+	t.Setenv("MOCHI_TEST_KEYS", k1+",k2:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, h.RotateKeys())
+	h.WaitEncryption()
+	require.Equal(t, map[string]string{clientKey(client): "k2", retainedKey("a/b/c"): "k2"}, keyIDs())
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	status, _ := h.EncryptionStatus()
+	require.Equal(t, int64(4), status.Reencrypted)
+}
+
+func TestEncryptionDisabled(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	require.ErrorIs(t, h.RotateKeys(), storage.ErrEncryptionDisabled)
+	_, ok := h.EncryptionStatus()
+	require.False(t, ok)
+}
+
+func TestEncryptionInvalidKeys(t *testing.T) {
+	t.Setenv("MOCHI_TEST_KEYS", "")
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}})
+	require.ErrorIs(t, err, storage.ErrNoEncryptionKeys)
+	teardown(t, h.config.Path, h)
+}
+
+func TestSaveUserWriteBehind(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{WriteBehind: &storage.WriteBehindOptions{Mode: storage.DurabilityAsync, FlushInterval: time.Hour}})
+	require.NoError(t, err)
+	defer teardown(t, h.config.Path, h)
+
+	// a user saved after a pending delete must not be removed when the delete is flushed.
+	require.NoError(t, h.DeleteUser("alice"))
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice"}))
+
+	users, err := h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+}
+
 func TestOnQosPublishNoDB(t *testing.T) {
 	h := new(Hook)
 	h.SetOpts(logger, nil)
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// sealedMagic prefixes every encrypted record. Cleartext records are json, so
+	// never begin with a zero byte.
+	sealedMagic   = "\x00MQE"
+	sealedVersion = 1
+)
+
+var (
+	// ErrNoEncryptionKeys indicates encryption was enabled without any keys.
+	ErrNoEncryptionKeys = errors.New("no encryption keys configured")
+
+	// ErrInvalidEncryptionKey indicates a key could not be parsed or is not a valid AES key size.
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+	// ErrUnknownEncryptionKey indicates a record was sealed with a key which is not configured.
+	ErrUnknownEncryptionKey = errors.New("record sealed with unknown encryption key")
+
+	// ErrSealedRecord indicates an encrypted record is malformed or failed authentication.
+	ErrSealedRecord = errors.New("invalid sealed record")
+
+	// ErrEncryptionDisabled indicates an encryption operation was requested for a hook without encryption.
+	ErrEncryptionDisabled = errors.New("encryption not enabled")
+)
+
+// EncryptionOptions contains configuration settings for encrypting stored records.
+// Keys are given as id:base64 pairs, one per line in KeyFile and separated by commas
+// or newlines in the KeyEnv environment variable. Keys must decode to 16, 24 or 32
+// bytes, selecting AES-128, AES-192 or AES-256.
+type EncryptionOptions struct {
+	KeyFile   string `yaml:"key_file" json:"key_file"`     // path of a file containing keys
+	KeyEnv    string `yaml:"key_env" json:"key_env"`       // name of an environment variable containing keys
+	ActiveKey string `yaml:"active_key" json:"active_key"` // id of the key new records are sealed with (default last key)
+}
+
+// EncryptionStatus describes the keys and re-encryption activity of an envelope.
+type EncryptionStatus struct {
+	ActiveKey   string   `json:"active_key"`  // the key new records are sealed with
+	Keys        []string `json:"keys"`        // the ids of all loaded keys
+	Rotating    bool     `json:"rotating"`    // records are being re-encrypted
+	Reencrypted int64    `json:"reencrypted"` // records re-encrypted with the active key
+	Errors      int64    `json:"errors"`      // records which could not be re-encrypted
+}
+
+// Envelope seals stored records with AES-GCM. Each sealed record carries the id of
+// the key it was sealed with, so keys can be rotated by loading a new active key and
+// re-encrypting existing records in the background while older keys remain available
+// for reading. Cleartext records written before encryption was enabled are read
+// unchanged and sealed when re-encrypted.
+type Envelope struct {
+	opts     EncryptionOptions
+	log      *slog.Logger
+	mu       sync.RWMutex           // protects keys and active
+	keys     map[string]cipher.AEAD // ciphers keyed on key id
+	active   string                 // the id of the key new records are sealed with
+	rotating int32                  // a re-encryption pass is running
+	again    int32                  // another pass was requested while one was running
+	stop     chan struct{}          // closed to stop re-encryption
+	wg       sync.WaitGroup         // tracks the re-encryption goroutine
+	reenc    int64                  // records re-encrypted
+	errs     int64                  // records which failed to re-encrypt
+}
+
+// NewEnvelope returns an envelope with keys loaded from the configured sources.
+func NewEnvelope(opts EncryptionOptions, log *slog.Logger) (*Envelope, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+
+	e := &Envelope{
+		opts: opts,
+		log:  log,
+		stop: make(chan struct{}),
+	}
+
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Reload reads the keys again from the configured sources, so that a new active key
+// can be introduced without restarting.
+func (e *Envelope) Reload() error {
+	var lines []string
+	if e.opts.KeyFile != "" {
+		b, err := os.ReadFile(e.opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("reading encryption keys: %w", err)
+		}
+		lines = append(lines, strings.Split(string(b), "\n")...)
+	}
+
+	if e.opts.KeyEnv != "" {
+		lines = append(lines, strings.FieldsFunc(os.Getenv(e.opts.KeyEnv), func(r rune) bool {
+			return r == ',' || r == '\n'
+		})...)
+	}
+
+	keys := make(map[string]cipher.AEAD)
+	var last string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, key, err := parseKey(line)
+		if err != nil {
+			return err
+		}
+
+		keys[id] = key
+		last = id
+	}
+
+	if len(keys) == 0 {
+		return ErrNoEncryptionKeys
+	}
+
+	active := e.opts.ActiveKey
+	if active == "" {
+		active = last
+	}
+
+	if _, ok := keys[active]; !ok {
+		return fmt.Errorf("%w: active key %q not found", ErrInvalidEncryptionKey, active)
+	}
+
+	e.mu.Lock()
+	e.keys = keys
+	e.active = active
+	e.mu.Unlock()
+
+	return nil
+}
+
+// parseKey parses an id:base64 key line into an AES-GCM cipher.
+func parseKey(line string) (string, cipher.AEAD, error) {
+	id, encoded, ok := strings.Cut(line, ":")
+	id = strings.TrimSpace(id)
+	if !ok || id == "" || len(id) > 255 {
+		return "", nil, fmt.Errorf("%w: expected id:base64", ErrInvalidEncryptionKey)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: key %q: %v", ErrInvalidEncryptionKey, id, err)
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: key %q: %v", ErrInvalidEncryptionKey, id, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, aead, nil
+}
+
+// ActiveKey returns the id of the key new records are sealed with.
+func (e *Envelope) ActiveKey() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.active
+}
+
+// Seal encrypts a record with the active key. A nil envelope returns the record unchanged.
+func (e *Envelope) Seal(plain []byte) ([]byte, error) {
+	if e == nil {
+		return plain, nil
+	}
+
+	e.mu.RLock()
+	id, aead := e.active, e.keys[e.active]
+	e.mu.RUnlock()
+
+	header := make([]byte, 0, len(sealedMagic)+2+len(id))
+	header = append(header, sealedMagic...)
+	header = append(header, sealedVersion, byte(len(id)))
+	header = append(header, id...)
+
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(plain)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, plain, header), nil
+}
+
+// Open decrypts a sealed record. Cleartext records, and any record read through a
+// nil envelope, are returned unchanged.
+func (e *Envelope) Open(data []byte) ([]byte, error) {
+	if e == nil || !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		return data, nil
+	}
+
+	id, header, ok := sealedKeyID(data)
+	if !ok {
+		return nil, ErrSealedRecord
+	}
+
+	e.mu.RLock()
+	aead, ok := e.keys[id]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEncryptionKey, id)
+	}
+
+	rest := data[header:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrSealedRecord
+	}
+
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], data[:header])
+	if err != nil {
+		return nil, ErrSealedRecord
+	}
+
+	return plain, nil
+}
+
+// sealedKeyID returns the key id of a sealed record and the length of its header.
+func sealedKeyID(data []byte) (string, int, bool) {
+	n := len(sealedMagic)
+	if len(data) < n+2 || data[n] != sealedVersion {
+		return "", 0, false
+	}
+
+	end := n + 2 + int(data[n+1])
+	if len(data) < end {
+		return "", 0, false
+	}
+
+	return string(data[n+2 : end]), end, true
+}
+
+// KeyID returns the id of the key a record was sealed with, or false if the record
+// is in cleartext.
+func KeyID(data []byte) (string, bool) {
+	if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		return "", false
+	}
+
+	id, _, ok := sealedKeyID(data)
+	return id, ok
+}
+
+// Stale returns true if a record is in cleartext or sealed with a key other than
+// the active key.
+func (e *Envelope) Stale(data []byte) bool {
+	id, ok := KeyID(data)
+	return !ok || id != e.ActiveKey()
+}
+
+// Wrap returns a Serializable which seals v when marshalled and opens it when
+// unmarshalled. A nil envelope returns v unchanged.
+func (e *Envelope) Wrap(v Serializable) Serializable {
+	if e == nil {
+		return v
+	}
+
+	return &sealed{env: e, v: v}
+}
+
+// sealed is a Serializable sealed by an envelope.
+type sealed struct {
+	env *Envelope
+	v   Serializable
+}
+
+// MarshalBinary encodes and seals the value.
+func (s *sealed) MarshalBinary() ([]byte, error) {
+	data, err := s.v.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.env.Seal(data)
+}
+
+// UnmarshalBinary opens and decodes the value.
+func (s *sealed) UnmarshalBinary(data []byte) error {
+	plain, err := s.env.Open(data)
+	if err != nil {
+		return err
+	}
+
+	return s.v.UnmarshalBinary(plain)
+}
+
+// Reencrypt starts a background pass which seals every stale record with the active
+// key. scan visits the key and raw value of every record in the store, and replace
+// must only write the new value if the record still holds the old value, so that
+// newer writes are never overwritten. If a pass is already running, another pass
+// is made once it completes.
+func (e *Envelope) Reencrypt(scan func(visit func(key string, value []byte) error) error, replace func(key string, old, new []byte) error) {
+	atomic.StoreInt32(&e.again, 1)
+	if !atomic.CompareAndSwapInt32(&e.rotating, 0, 1) {
+		return
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for atomic.CompareAndSwapInt32(&e.again, 1, 0) {
+			n, err := e.reencrypt(scan, replace)
+			if err != nil {
+				e.log.Error("failed to re-encrypt records", "error", err, "reencrypted", n)
+			} else if n > 0 {
+				e.log.Info("re-encrypted records", "key", e.ActiveKey(), "reencrypted", n)
+			}
+		}
+		atomic.StoreInt32(&e.rotating, 0)
+	}()
+}
+
+// reencrypt makes a single pass over the store.
+func (e *Envelope) reencrypt(scan func(visit func(key string, value []byte) error) error, replace func(key string, old, new []byte) error) (int, error) {
+	type record struct {
+		key   string
+		value []byte
+	}
+
+	var stale []record
+	err := scan(func(key string, value []byte) error {
+		if e.Stale(value) {
+			stale = append(stale, record{key: key, value: append([]byte(nil), value...)})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, r := range stale {
+		select {
+		case <-e.stop:
+			return n, nil
+		default:
+		}
+
+		plain, err := e.Open(r.value)
+		if err == nil {
+			var sealed []byte
+			if sealed, err = e.Seal(plain); err == nil {
+				err = replace(r.key, r.value, sealed)
+			}
+		}
+
+		if err != nil {
+			atomic.AddInt64(&e.errs, 1)
+			e.log.Warn("failed to re-encrypt record", "error", err, "key", r.key)
+			continue
+		}
+
+		atomic.AddInt64(&e.reenc, 1)
+		n++
+	}
+
+	return n, nil
+}
+
+// Wait blocks until any running re-encryption pass has completed.
+func (e *Envelope) Wait() {
+	e.wg.Wait()
+}
+
+// Close stops any running re-encryption pass and waits for it to return.
+func (e *Envelope) Close() {
+	select {
+	case <-e.stop:
+	default:
+		close(e.stop)
+	}
+	e.wg.Wait()
+}
+
+// Status returns the keys and re-encryption counters of the envelope.
+func (e *Envelope) Status() EncryptionStatus {
+	e.mu.RLock()
+	keys := make([]string, 0, len(e.keys))
+	for id := range e.keys {
+		keys = append(keys, id)
+	}
+	active := e.active
+	e.mu.RUnlock()
+	sort.Strings(keys)
+
+	return EncryptionStatus{
+		ActiveKey:   active,
+		Keys:        keys,
+		Rotating:    atomic.LoadInt32(&e.rotating) == 1,
+		Reencrypted: atomic.LoadInt64(&e.reenc),
+		Errors:      atomic.LoadInt64(&e.errs),
+	}
+}
+
+// Encryption is embedded by storage hooks to seal their records with an optional
+// envelope. Records are marshalled through Record, so every hook seals and opens
+// them in the same way, and the hook gains the RotateKeys and EncryptionStatus
+// methods used by the management api.
+type Encryption struct {
+	env     *Envelope                                              // the envelope, or nil if encryption is not enabled
+	scan    func(visit func(key string, value []byte) error) error // visits the raw value of every record in the store
+	replace func(key string, old, new []byte) error                // replaces the raw value of a record if it is unchanged
+}
+
+// InitEncryption loads the keys of the encryption options, if set. scan and replace
+// are used by Reencrypt to re-seal stale records, as described by Envelope.Reencrypt.
+func (e *Encryption) InitEncryption(opts *EncryptionOptions, log *slog.Logger, scan func(visit func(key string, value []byte) error) error, replace func(key string, old, new []byte) error) error {
+	e.scan = scan
+	e.replace = replace
+	if opts == nil {
+		return nil
+	}
+
+	env, err := NewEnvelope(*opts, log)
+	if err != nil {
+		return err
+	}
+
+	e.env = env
+	return nil
+}
+
+// StopEncryption stops any running re-encryption pass.
+func (e *Encryption) StopEncryption() {
+	if e.env != nil {
+		e.env.Close()
+	}
+}
+
+// Record returns a Serializable which is sealed when marshalled and opened when
+// unmarshalled, if encryption is enabled.
+func (e *Encryption) Record(v Serializable) Serializable {
+	return e.env.Wrap(v)
+}
+
+// OpenRecord returns the marshalled value of a stored record.
+func (e *Encryption) OpenRecord(data []byte) ([]byte, error) {
+	return e.env.Open(data)
+}
+
+// Reencrypt starts re-sealing any records not sealed with the active key in the
+// background, if encryption is enabled.
+func (e *Encryption) Reencrypt() {
+	if e.env != nil {
+		e.env.Reencrypt(e.scan, e.replace)
+	}
+}
+
+// WaitEncryption blocks until any running re-encryption pass has completed.
+func (e *Encryption) WaitEncryption() {
+	if e.env != nil {
+		e.env.Wait()
+	}
+}
+
+// RotateKeys reloads the encryption keys and re-encrypts any records not sealed with
+// the active key in the background.
+func (e *Encryption) RotateKeys() error {
+	if e.env == nil {
+		return ErrEncryptionDisabled
+	}
+
+	if err := e.env.Reload(); err != nil {
+		return err
+	}
+
+	e.Reencrypt()
+	return nil
+}
+
+// EncryptionStatus returns the encryption keys and re-encryption counters, or false
+// if encryption is not enabled.
+func (e *Encryption) EncryptionStatus() (EncryptionStatus, bool) {
+	if e.env == nil {
+		return EncryptionStatus{}, false
+	}
+
+	return e.env.Status(), true
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(id string, size int) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(len(id))}, size))
+}
+
+func newTestEnvelope(t *testing.T, keys ...string) *Envelope {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# test keys\n"+joinLines(keys)), 0600))
+	e, err := NewEnvelope(EncryptionOptions{KeyFile: path}, nil)
+	require.NoError(t, err)
+	t.Cleanup(e.Close)
+	return e
+}
+
+func joinLines(lines []string) string {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+	return b.String()
+}
+
+func TestNewEnvelopeKeySources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(testKey("k1", 16)+"\n\n"), 0600))
+	t.Setenv("MOCHI_TEST_KEYS", testKey("k2", 24)+","+testKey("k3", 32))
+
+	e, err := NewEnvelope(EncryptionOptions{KeyFile: path, KeyEnv: "MOCHI_TEST_KEYS"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "k3", e.ActiveKey())
+	require.Equal(t, []string{"k1", "k2", "k3"}, e.Status().Keys)
+
+	e, err = NewEnvelope(EncryptionOptions{KeyFile: path, KeyEnv: "MOCHI_TEST_KEYS", ActiveKey: "k1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "k1", e.ActiveKey())
+}
+
+func TestNewEnvelopeInvalid(t *testing.T) {
+	t.Setenv("MOCHI_TEST_KEYS", "")
+	_, err := NewEnvelope(EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}, nil)
+	require.ErrorIs(t, err, ErrNoEncryptionKeys)
+
+	_, err = NewEnvelope(EncryptionOptions{KeyFile: filepath.Join(t.TempDir(), "missing")}, nil)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	for _, keys := range []string{
+		"no-separator",
+		":" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"k1:not-base64!",
+		"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 10)),
+	} {
+		t.Setenv("MOCHI_TEST_KEYS", keys)
+		_, err = NewEnvelope(EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}, nil)
+		require.ErrorIs(t, err, ErrInvalidEncryptionKey, keys)
+	}
+
+	t.Setenv("MOCHI_TEST_KEYS", testKey("k1", 16))
+	_, err = NewEnvelope(EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS", ActiveKey: "k2"}, nil)
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	e := newTestEnvelope(t, testKey("k1", 32))
+
+	plain := []byte(`{"t":"RET","payload":"c2VjcmV0"}`)
+	sealed, err := e.Seal(plain)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, plain))
+
+	id, ok := KeyID(sealed)
+	require.True(t, ok)
+	require.Equal(t, "k1", id)
+	require.False(t, e.Stale(sealed))
+
+	again, err := e.Seal(plain)
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, again) // random nonce
+
+	got, err := e.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, plain, got)
+
+	// cleartext records written before encryption was enabled are read unchanged.
+	got, err = e.Open(plain)
+	require.NoError(t, err)
+	require.Equal(t, plain, got)
+	require.True(t, e.Stale(plain))
+	_, ok = KeyID(plain)
+	require.False(t, ok)
+}
+
+func TestEnvelopeOpenInvalid(t *testing.T) {
+	e := newTestEnvelope(t, testKey("k1", 16))
+	sealed, err := e.Seal([]byte("hello"))
+	require.NoError(t, err)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = e.Open(tampered)
+	require.ErrorIs(t, err, ErrSealedRecord)
+
+	_, err = e.Open(sealed[:len(sealedMagic)+1])
+	require.ErrorIs(t, err, ErrSealedRecord)
+
+	_, err = e.Open(sealed[:len(sealedMagic)+4+8])
+	require.ErrorIs(t, err, ErrSealedRecord)
+
+	other := newTestEnvelope(t, testKey("k2", 16))
+	_, err = other.Open(sealed)
+	require.ErrorIs(t, err, ErrUnknownEncryptionKey)
+}
+
+func TestEnvelopeNil(t *testing.T) {
+	var e *Envelope
+	got, err := e.Seal([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), got)
+
+	got, err = e.Open([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), got)
+
+	v := &Subscription{ID: "a"}
+	require.Equal(t, v, e.Wrap(v))
+}
+
+func TestEnvelopeWrap(t *testing.T) {
+	e := newTestEnvelope(t, testKey("k1", 16))
+	in := &Message{ID: "RET_a/b", T: RetainedKey, TopicName: "a/b", Payload: []byte("secret")}
+
+	data, err := e.Wrap(in).MarshalBinary()
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(data, []byte("a/b")))
+
+	var out Message
+	require.NoError(t, e.Wrap(&out).UnmarshalBinary(data))
+	require.Equal(t, in.TopicName, out.TopicName)
+	require.Equal(t, in.Payload, out.Payload)
+}
+
+func TestEnvelopeReencrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(testKey("k1", 16)), 0600))
+	e, err := NewEnvelope(EncryptionOptions{KeyFile: path}, nil)
+	require.NoError(t, err)
+	defer e.Close()
+
+	m := newMemStore()
+	m.data["plain"] = []byte(`{"id":"plain"}`)
+	m.data["old"], _ = e.Seal([]byte(`{"id":"old"}`))
+
+	require.NoError(t, os.WriteFile(path, []byte(testKey("k1", 16)+"\n"+testKey("k2", 32)), 0600))
+	require.NoError(t, e.Reload())
+	require.Equal(t, "k2", e.ActiveKey())
+
+	scan := func(visit func(key string, value []byte) error) error {
+		m.Lock()
+		defer m.Unlock()
+		for k, v := range m.data {
+			if err := visit(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	replace := func(key string, old, data []byte) error {
+		m.Lock()
+		defer m.Unlock()
+		if bytes.Equal(m.data[key], old) {
+			m.data[key] = data
+		}
+		return nil
+	}
+
+	e.Reencrypt(scan, replace)
+	e.Wait()
+
+	for k, v := range m.data {
+		id, ok := KeyID(v)
+		require.True(t, ok, k)
+		require.Equal(t, "k2", id, k)
+
+		plain, err := e.Open(v)
+		require.NoError(t, err)
+		require.Contains(t, string(plain), k)
+	}
+
+	status := e.Status()
+	require.Equal(t, "k2", status.ActiveKey)
+	require.Equal(t, []string{"k1", "k2"}, status.Keys)
+	require.False(t, status.Rotating)
+	require.Equal(t, int64(2), status.Reencrypted)
+	require.Equal(t, int64(0), status.Errors)
+}
+
+func TestEnvelopeReencryptErrors(t *testing.T) {
+	e := newTestEnvelope(t, testKey("k1", 16))
+	corrupt := append([]byte(sealedMagic), sealedVersion, 2, 'k', '9')
+
+	e.Reencrypt(func(visit func(key string, value []byte) error) error {
+		return visit("a", corrupt)
+	}, func(key string, old, data []byte) error {
+		return nil
+	})
+	e.Wait()
+	require.Equal(t, int64(1), e.Status().Errors)
+
+	e.Reencrypt(func(visit func(key string, value []byte) error) error {
+		return ErrSealedRecord
+	}, nil)
+	e.Wait()
+	require.Equal(t, int64(0), e.Status().Reencrypted)
+}
+
+func TestEnvelopeCloseStopsReencrypt(t *testing.T) {
+	e := newTestEnvelope(t, testKey("k1", 16))
+	e.Close()
+	e.Close()
+
+	var replaced int
+	e.Reencrypt(func(visit func(key string, value []byte) error) error {
+		return visit("a", []byte("{}"))
+	}, func(key string, old, data []byte) error {
+		replaced++
+		return nil
+	})
+	e.Wait()
+	require.Equal(t, 0, replaced)
+}
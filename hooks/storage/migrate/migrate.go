@@ -0,0 +1,510 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package migrate copies persisted broker state between storage hooks, so that
+// a broker can move from one storage backend to another without losing
+// sessions, subscriptions, retained or queued messages, or users.
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	StageClients       = "clients"       // stored clients
+	StageSubscriptions = "subscriptions" // stored subscriptions
+	StageRetained      = "retained"      // stored retained messages
+	StageInflight      = "inflight"      // stored inflight messages
+	StageQueued        = "queued"        // stored offline queued messages
+	StageSysInfo       = "sysinfo"       // stored system info
+	StageUsers         = "users"         // stored auth ledger users
+
+	defaultCheckpoint = 1000
+)
+
+var (
+	// ErrUsersUnsupported indicates the source has users but the destination cannot store them.
+	ErrUsersUnsupported = errors.New("destination does not support storing users")
+
+	// ErrVerificationFailed indicates keys from the source were missing from the destination after migrating.
+	ErrVerificationFailed = errors.New("migration verification failed")
+)
+
+// stages are the migration stages in the order they are applied.
+var stages = []string{StageClients, StageSubscriptions, StageRetained, StageInflight, StageQueued, StageSysInfo, StageUsers}
+
+// Options contains configuration settings for a migration.
+type Options struct {
+	DryRun     bool         // only read the source and report what would be migrated
+	Verify     bool         // compare the keys in the destination with the source after migrating
+	Progress   string       // optional path of a file recording progress, so an interrupted migration can be resumed
+	Checkpoint int          // retained messages written between progress checkpoints
+	Log        *slog.Logger // optional logger for progress messages
+}
+
+// Count contains the number of keys of a single type in the source and destination.
+type Count struct {
+	Source      int      `json:"source"`                // keys read from the source
+	Written     int      `json:"written"`               // keys written to the destination in this run
+	Skipped     int      `json:"skipped"`               // keys skipped as they were written by a previous run
+	Destination int      `json:"destination,omitempty"` // keys found in the destination when verifying
+	Missing     []string `json:"missing,omitempty"`     // source keys missing from the destination when verifying
+}
+
+// Report describes the outcome of a migration.
+type Report struct {
+	DryRun   bool              `json:"dry_run"`  // nothing was written to the destination
+	Verified bool              `json:"verified"` // all source keys were found in the destination
+	Counts   map[string]*Count `json:"counts"`   // counts keyed on stage
+}
+
+// String returns a human readable summary of the report.
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, stage := range stages {
+		c, ok := r.Counts[stage]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&b, "%-14s source=%d written=%d skipped=%d", stage, c.Source, c.Written, c.Skipped)
+		if r.Verified || len(c.Missing) > 0 || c.Destination > 0 {
+			fmt.Fprintf(&b, " destination=%d missing=%d", c.Destination, len(c.Missing))
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// progress is the persisted state of a migration.
+type progress struct {
+	Done     []string `json:"done"`     // stages which have been completed
+	Retained string   `json:"retained"` // the last retained topic written
+}
+
+// has returns true if the stage has been completed.
+func (p *progress) has(stage string) bool {
+	for _, s := range p.Done {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot is the full set of state read from a storage hook.
+type snapshot struct {
+	clients       []storage.Client
+	subscriptions []storage.Subscription
+	retained      []storage.Message
+	inflight      []storage.Message
+	queued        []storage.Message
+	sysInfo       storage.SystemInfo
+	users         []auth.UserRule
+}
+
+// Migrate reads all state from the src storage hook through its Stored methods (and
+// LoadUsers, if it stores users) and writes it into the dst storage hook through the
+// same events the broker would use. Both hooks must already be initialized.
+func Migrate(src, dst mqtt.Hook, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+
+	if opts.Checkpoint <= 0 {
+		opts.Checkpoint = defaultCheckpoint
+	}
+
+	log := opts.Log
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+
+	snap, err := read(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := dst.(auth.LedgerStore); !ok && len(snap.users) > 0 {
+		return nil, ErrUsersUnsupported
+	}
+
+	report := &Report{
+		DryRun: opts.DryRun,
+		Counts: map[string]*Count{
+			StageClients:       {Source: len(snap.clients)},
+			StageSubscriptions: {Source: len(snap.subscriptions)},
+			StageRetained:      {Source: len(snap.retained)},
+			StageInflight:      {Source: len(snap.inflight)},
+			StageQueued:        {Source: len(snap.queued)},
+			StageSysInfo:       {Source: sysInfoCount(snap.sysInfo)},
+			StageUsers:         {Source: len(snap.users)},
+		},
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	p, err := loadProgress(opts.Progress)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range stages {
+		c := report.Counts[stage]
+		if p.has(stage) {
+			c.Skipped = c.Source
+			log.Info("migration stage already complete", "stage", stage)
+			continue
+		}
+
+		switch stage {
+		case StageClients:
+			for _, v := range snap.clients {
+				dst.OnSessionEstablished(storedClient(v), packets.Packet{})
+				c.Written++
+			}
+		case StageSubscriptions:
+			for _, v := range snap.subscriptions {
+				dst.OnSubscribed(&mqtt.Client{ID: v.Client}, packets.Packet{
+					Filters: packets.Subscriptions{storedSubscription(v)},
+				}, []byte{v.Qos})
+				c.Written++
+			}
+		case StageRetained:
+			err = migrateRetained(dst, snap.retained, p, opts, c, log)
+		case StageInflight:
+			for _, v := range snap.inflight {
+				pk := v.ToPacket()
+				pk.PacketID = inflightPacketID(v)
+				dst.OnQosPublish(&mqtt.Client{ID: v.Client}, pk, v.Sent, 0)
+				c.Written++
+			}
+		case StageQueued:
+			for _, v := range snap.queued {
+				dst.OnQueued(&mqtt.Client{ID: v.Client}, v.ToPacket(), v.Sequence)
+				c.Written++
+			}
+		case StageSysInfo:
+			if c.Source > 0 {
+				dst.OnSysInfoTick(&snap.sysInfo.Info)
+				c.Written++
+			}
+		case StageUsers:
+			for _, u := range snap.users {
+				if err = dst.(auth.LedgerStore).SaveUser(u); err != nil {
+					break
+				}
+				c.Written++
+			}
+		}
+
+		if err != nil {
+			return report, fmt.Errorf("migrating %s: %w", stage, err)
+		}
+
+		p.Done = append(p.Done, stage)
+		if err := saveProgress(opts.Progress, p); err != nil {
+			return report, err
+		}
+
+		log.Info("migration stage complete", "stage", stage, "written", c.Written)
+	}
+
+	if opts.Verify {
+		if err := verify(dst, snap, report); err != nil {
+			return report, err
+		}
+
+		if !report.Verified {
+			return report, ErrVerificationFailed
+		}
+	}
+
+	if opts.Progress != "" {
+		if err := os.Remove(opts.Progress); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// migrateRetained writes retained messages in topic order, checkpointing the last
+// written topic so that a resumed migration skips the messages already written.
+func migrateRetained(dst mqtt.Hook, retained []storage.Message, p *progress, opts *Options, c *Count, log *slog.Logger) error {
+	sort.Slice(retained, func(i, j int) bool {
+		return retained[i].TopicName < retained[j].TopicName
+	})
+
+	for i, v := range retained {
+		if p.Retained != "" && v.TopicName <= p.Retained {
+			c.Skipped++
+			continue
+		}
+
+		dst.OnRetainMessage(&mqtt.Client{ID: v.Client}, v.ToPacket(), 1)
+		c.Written++
+
+		if c.Written%opts.Checkpoint == 0 || i == len(retained)-1 {
+			p.Retained = v.TopicName
+			if err := saveProgress(opts.Progress, p); err != nil {
+				return err
+			}
+			log.Info("migrated retained messages", "written", c.Written, "skipped", c.Skipped, "total", len(retained))
+		}
+	}
+
+	return nil
+}
+
+// read reads all stored state from a storage hook.
+func read(h mqtt.Hook) (s snapshot, err error) {
+	if s.clients, err = h.StoredClients(); err != nil {
+		return s, fmt.Errorf("reading clients: %w", err)
+	}
+
+	if s.subscriptions, err = h.StoredSubscriptions(); err != nil {
+		return s, fmt.Errorf("reading subscriptions: %w", err)
+	}
+
+	if s.retained, err = h.StoredRetainedMessages(); err != nil {
+		return s, fmt.Errorf("reading retained messages: %w", err)
+	}
+
+	if s.inflight, err = h.StoredInflightMessages(); err != nil {
+		return s, fmt.Errorf("reading inflight messages: %w", err)
+	}
+
+	if s.queued, err = h.StoredQueuedMessages(); err != nil {
+		return s, fmt.Errorf("reading queued messages: %w", err)
+	}
+
+	if s.sysInfo, err = h.StoredSysInfo(); err != nil {
+		return s, fmt.Errorf("reading system info: %w", err)
+	}
+
+	if ls, ok := h.(auth.LedgerStore); ok {
+		if s.users, err = ls.LoadUsers(); err != nil {
+			return s, fmt.Errorf("reading users: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// verify reads the destination back and records any source keys which are missing.
+func verify(dst mqtt.Hook, src snapshot, report *Report) error {
+	got, err := read(dst)
+	if err != nil {
+		return err
+	}
+
+	compare := func(stage string, want, have []string) {
+		c := report.Counts[stage]
+		c.Destination = len(have)
+		found := make(map[string]struct{}, len(have))
+		for _, k := range have {
+			found[k] = struct{}{}
+		}
+
+		for _, k := range want {
+			if _, ok := found[k]; !ok {
+				c.Missing = append(c.Missing, k)
+			}
+		}
+	}
+
+	compare(StageClients, clientKeys(src.clients), clientKeys(got.clients))
+	compare(StageSubscriptions, subscriptionKeys(src.subscriptions), subscriptionKeys(got.subscriptions))
+	compare(StageRetained, retainedKeys(src.retained), retainedKeys(got.retained))
+	compare(StageInflight, inflightKeys(src.inflight), inflightKeys(got.inflight))
+	compare(StageQueued, queuedKeys(src.queued), queuedKeys(got.queued))
+	compare(StageUsers, userKeys(src.users), userKeys(got.users))
+
+	c := report.Counts[StageSysInfo]
+	c.Destination = sysInfoCount(got.sysInfo)
+	if c.Source > c.Destination {
+		c.Missing = append(c.Missing, storage.SysInfoKey)
+	}
+
+	report.Verified = true
+	for _, c := range report.Counts {
+		if len(c.Missing) > 0 {
+			report.Verified = false
+		}
+	}
+
+	return nil
+}
+
+// storedClient converts a stored client into a client for the storage events.
+func storedClient(c storage.Client) *mqtt.Client {
+	cl := &mqtt.Client{
+		ID: c.ID,
+		Net: mqtt.ClientConnection{
+			Remote:   c.Remote,
+			Listener: c.Listener,
+		},
+	}
+
+	cl.Properties.Username = c.Username
+	cl.Properties.Clean = c.Clean
+	cl.Properties.ProtocolVersion = c.ProtocolVersion
+	cl.Properties.Props = packets.Properties{
+		SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
+		SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
+		AuthenticationMethod:      c.Properties.AuthenticationMethod,
+		AuthenticationData:        c.Properties.AuthenticationData,
+		RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
+		RequestProblemInfo:        c.Properties.RequestProblemInfo,
+		RequestResponseInfo:       c.Properties.RequestResponseInfo,
+		ReceiveMaximum:            c.Properties.ReceiveMaximum,
+		TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
+		User:                      c.Properties.User,
+		MaximumPacketSize:         c.Properties.MaximumPacketSize,
+	}
+	cl.Properties.Will = mqtt.Will(c.Will)
+
+	return cl
+}
+
+// storedSubscription converts a stored subscription into a packet subscription.
+func storedSubscription(s storage.Subscription) packets.Subscription {
+	return packets.Subscription{
+		Filter:            s.Filter,
+		Identifier:        s.Identifier,
+		RetainHandling:    s.RetainHandling,
+		Qos:               s.Qos,
+		RetainAsPublished: s.RetainAsPublished,
+		NoLocal:           s.NoLocal,
+	}
+}
+
+// inflightPacketID returns the packet id of a stored inflight message. Some stores
+// only record the packet id in the storage key, so it is recovered from the key if
+// the message does not carry it.
+func inflightPacketID(m storage.Message) uint16 {
+	if m.PacketID != 0 {
+		return m.PacketID
+	}
+
+	if i := strings.LastIndex(m.ID, ":"); i >= 0 {
+		if id, err := strconv.ParseUint(m.ID[i+1:], 10, 16); err == nil {
+			return uint16(id)
+		}
+	}
+
+	return 0
+}
+
+// sysInfoCount returns 1 if the system info has been stored, otherwise 0.
+func sysInfoCount(s storage.SystemInfo) int {
+	if s.ID == "" && s.Version == "" && s.Started == 0 {
+		return 0
+	}
+	return 1
+}
+
+func clientKeys(v []storage.Client) []string {
+	keys := make([]string, len(v))
+	for i, c := range v {
+		keys[i] = c.ID
+	}
+	return keys
+}
+
+func subscriptionKeys(v []storage.Subscription) []string {
+	keys := make([]string, len(v))
+	for i, s := range v {
+		keys[i] = s.Client + ":" + s.Filter
+	}
+	return keys
+}
+
+func retainedKeys(v []storage.Message) []string {
+	keys := make([]string, len(v))
+	for i, m := range v {
+		keys[i] = m.TopicName
+	}
+	return keys
+}
+
+func inflightKeys(v []storage.Message) []string {
+	keys := make([]string, len(v))
+	for i, m := range v {
+		keys[i] = m.Client + ":" + strconv.Itoa(int(inflightPacketID(m)))
+	}
+	return keys
+}
+
+func queuedKeys(v []storage.Message) []string {
+	keys := make([]string, len(v))
+	for i, m := range v {
+		keys[i] = m.Client + ":" + strconv.FormatInt(m.Sequence, 10)
+	}
+	return keys
+}
+
+func userKeys(v []auth.UserRule) []string {
+	keys := make([]string, len(v))
+	for i, u := range v {
+		keys[i] = string(u.Username)
+	}
+	return keys
+}
+
+// loadProgress reads the progress of a previous migration, if any.
+func loadProgress(path string) (*progress, error) {
+	p := new(progress)
+	if path == "" {
+		return p, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("reading migration progress %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// saveProgress atomically writes the progress of the migration.
+func saveProgress(path string, p *progress) error {
+	if path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
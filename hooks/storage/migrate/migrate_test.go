@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package migrate
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/pebble"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/sql"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+
+	_ "modernc.org/sqlite"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// newBolt returns a bolt hook populated with a client, subscription, retained,
+// inflight and queued messages, system info and a user.
+func newBolt(t *testing.T) *bolt.Hook {
+	h := new(bolt.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&bolt.Options{Path: filepath.Join(t.TempDir(), "bolt.db")}))
+	t.Cleanup(func() { _ = h.Stop() })
+
+	cl := &mqtt.Client{ID: "cl1", Net: mqtt.ClientConnection{Remote: "10.0.0.1", Listener: "t1"}}
+	cl.Properties.Username = []byte("alice")
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 60
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	h.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#"}, {Filter: "b/+", NoLocal: true}}}, []byte{1, 2})
+	for _, topic := range []string{"a/1", "a/2", "b/1", "c/1"} {
+		h.OnRetainMessage(cl, packets.Packet{TopicName: topic, Payload: []byte(topic), FixedHeader: packets.FixedHeader{Retain: true}}, 1)
+	}
+	h.OnQosPublish(cl, packets.Packet{TopicName: "a/1", PacketID: 7, FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}}, time.Now().Unix(), 0)
+	h.OnQueued(cl, packets.Packet{TopicName: "b/1", Payload: []byte("q"), FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}}, 3)
+	h.OnSysInfoTick(&system.Info{Version: "2.0.0", Started: 1700000000})
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "secret"}))
+
+	return h
+}
+
+func newPebble(t *testing.T) *pebble.Hook {
+	h := new(pebble.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&pebble.Options{Path: filepath.Join(t.TempDir(), "pebble")}))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+func newSQL(t *testing.T) *sql.Hook {
+	h := new(sql.Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&sql.Options{DSN: filepath.Join(t.TempDir(), "mochi.db")}))
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+// lossyHook is a destination which fails to store retained messages.
+type lossyHook struct {
+	*sql.Hook
+}
+
+func (h *lossyHook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {}
+
+func TestMigrate(t *testing.T) {
+	src := newBolt(t)
+	dst := newSQL(t)
+
+	report, err := Migrate(src, dst, &Options{Verify: true, Log: logger})
+	require.NoError(t, err)
+	require.True(t, report.Verified)
+	require.Equal(t, 1, report.Counts[StageClients].Written)
+	require.Equal(t, 2, report.Counts[StageSubscriptions].Written)
+	require.Equal(t, 4, report.Counts[StageRetained].Written)
+	require.Equal(t, 1, report.Counts[StageInflight].Written)
+	require.Equal(t, 1, report.Counts[StageQueued].Written)
+	require.Equal(t, 1, report.Counts[StageSysInfo].Written)
+	require.Equal(t, 1, report.Counts[StageUsers].Written)
+	require.Equal(t, 4, report.Counts[StageRetained].Destination)
+
+	clients, err := dst.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "10.0.0.1", clients[0].Remote)
+	require.Equal(t, []byte("alice"), clients[0].Username)
+	require.Equal(t, uint32(60), clients[0].Properties.SessionExpiryInterval)
+
+	subs, err := dst.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, byte(2), subs[1].Qos)
+	require.True(t, subs[1].NoLocal)
+
+	inflight, err := dst.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID) // recovered from the bolt key
+
+	queued, err := dst.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, int64(3), queued[0].Sequence)
+	require.Equal(t, "cl1", queued[0].Client)
+
+	sys, err := dst.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", sys.Version)
+
+	users, err := dst.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, auth.RString("secret"), users[0].Password)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	src := newBolt(t)
+	dst := newSQL(t)
+
+	report, err := Migrate(src, dst, &Options{DryRun: true, Verify: true})
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, 4, report.Counts[StageRetained].Source)
+	require.Equal(t, 0, report.Counts[StageRetained].Written)
+	require.Contains(t, report.String(), "retained       source=4 written=0 skipped=0")
+
+	retained, err := dst.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, retained)
+}
+
+func TestMigrateUsersUnsupported(t *testing.T) {
+	_, err := Migrate(newBolt(t), newPebble(t), nil)
+	require.ErrorIs(t, err, ErrUsersUnsupported)
+}
+
+func TestMigrateToPebble(t *testing.T) {
+	src := newSQL(t)
+	src.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	src.OnRetainMessage(&mqtt.Client{ID: "cl1"}, packets.Packet{TopicName: "a/b"}, 1)
+
+	dst := newPebble(t)
+	report, err := Migrate(src, dst, &Options{Verify: true})
+	require.NoError(t, err)
+	require.True(t, report.Verified)
+
+	retained, err := dst.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+}
+
+func TestMigrateVerificationFailed(t *testing.T) {
+	report, err := Migrate(newBolt(t), &lossyHook{newSQL(t)}, &Options{Verify: true})
+	require.ErrorIs(t, err, ErrVerificationFailed)
+	require.False(t, report.Verified)
+	require.Equal(t, []string{"a/1", "a/2", "b/1", "c/1"}, report.Counts[StageRetained].Missing)
+	require.Empty(t, report.Counts[StageClients].Missing)
+}
+
+func TestMigrateResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.progress")
+	b, err := json.Marshal(progress{Done: []string{StageClients, StageSubscriptions}, Retained: "a/2"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+
+	dst := newSQL(t)
+	report, err := Migrate(newBolt(t), dst, &Options{Progress: path, Checkpoint: 1})
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Counts[StageClients].Written)
+	require.Equal(t, 1, report.Counts[StageClients].Skipped)
+	require.Equal(t, 2, report.Counts[StageSubscriptions].Skipped)
+	require.Equal(t, 2, report.Counts[StageRetained].Written)
+	require.Equal(t, 2, report.Counts[StageRetained].Skipped)
+
+	retained, err := dst.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 2)
+	require.Equal(t, "b/1", retained[0].TopicName)
+
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist) // progress is removed once complete
+}
+
+func TestMigrateCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.progress")
+	p := new(progress)
+	c := new(Count)
+	dst := newSQL(t)
+	retained := []storage.Message{{TopicName: "c"}, {TopicName: "a"}, {TopicName: "b"}}
+
+	err := migrateRetained(dst, retained, p, &Options{Progress: path, Checkpoint: 2}, c, logger)
+	require.NoError(t, err)
+	require.Equal(t, 3, c.Written)
+
+	saved, err := loadProgress(path)
+	require.NoError(t, err)
+	require.Equal(t, "c", saved.Retained)
+}
+
+func TestLoadProgressInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.progress")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	_, err := loadProgress(path)
+	require.Error(t, err)
+
+	p, err := loadProgress("")
+	require.NoError(t, err)
+	require.Empty(t, p.Done)
+}
+
+func TestInflightPacketID(t *testing.T) {
+	require.Equal(t, uint16(3), inflightPacketID(storage.Message{PacketID: 3, ID: "IFM_cl1:9"}))
+	require.Equal(t, uint16(9), inflightPacketID(storage.Message{ID: "IFM_cl1:9"}))
+	require.Equal(t, uint16(9), inflightPacketID(storage.Message{ID: "cl:1:9"}))
+	require.Equal(t, uint16(0), inflightPacketID(storage.Message{ID: "IFM_cl1"}))
+}
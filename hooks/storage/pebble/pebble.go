@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	pebbledb "github.com/cockroachdb/pebble"
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -42,6 +43,12 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for an offline queued message. The sequence is
+// zero-padded so that the messages of a client are kept in order.
+func queuedKey(cl *mqtt.Client, seq int64) string {
+	return storage.QueuedKey + "_" + cl.ID + ":" + fmt.Sprintf("%020d", seq)
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
@@ -68,17 +75,22 @@ const (
 
 // Options contains configuration settings for the pebble DB instance.
 type Options struct {
-	Options *pebbledb.Options
-	Mode    string `yaml:"mode" json:"mode"`
-	Path    string `yaml:"path" json:"path"`
+	Options     *pebbledb.Options
+	Mode        string                      `yaml:"mode" json:"mode"`
+	Path        string                      `yaml:"path" json:"path"`
+	WriteBehind *storage.WriteBehindOptions `yaml:"write_behind" json:"write_behind"` // optional batching of writes
+	Encryption  *storage.EncryptionOptions  `yaml:"encryption" json:"encryption"`     // optional encryption of records at rest
 }
 
 // Hook is a persistent storage hook based using pebble DB file store as a backend.
 type Hook struct {
 	mqtt.HookBase
+	storage.Encryption
 	config *Options               // options for configuring the pebble DB instance.
 	db     *pebbledb.DB           // the pebble DB instance
 	mode   *pebbledb.WriteOptions // mode holds the optional per-query parameters for Set and Delete operations
+	wb     *storage.WriteBehind   // optional write-behind layer.
+	mu     sync.Mutex             // serializes writes with the re-encryption of records.
 }
 
 // ID returns the id of the hook.
@@ -98,12 +110,15 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosPublish,
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
+		mqtt.OnQueued,
+		mqtt.OnDequeued,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
+		mqtt.StoredQueuedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
 	}, []byte{b})
@@ -140,12 +155,41 @@ func (h *Hook) Init(config any) error {
 		return err
 	}
 
+	err = h.InitEncryption(h.config.Encryption, h.Log, h.scanRecords, h.replaceRecord)
+	if err != nil {
+		_ = h.db.Close()
+		return err
+	}
+
+	if h.config.WriteBehind != nil {
+		h.wb, err = storage.NewWriteBehind(*h.config.WriteBehind, h.applyWrites, h.Log, storage.InflightKey, storage.QueuedKey)
+		if err != nil {
+			_ = h.db.Close()
+			return err
+		}
+	}
+
+	h.Reencrypt()
+
 	return nil
 }
 
 // Stop closes the pebble instance.
 func (h *Hook) Stop() error {
-	err := h.db.Close()
+	h.StopEncryption()
+
+	var err error
+	if h.wb != nil {
+		if err = h.wb.Close(); err != nil {
+			h.Log.Error("failed to flush write-behind writes on stop, pending writes are lost", "error", err, "pending", h.wb.Metrics().Pending)
+		}
+		h.wb = nil
+	}
+
+	if cerr := h.db.Close(); err == nil {
+		err = cerr
+	}
+
 	h.db = nil
 	return err
 }
@@ -336,6 +380,49 @@ func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	h.OnQosComplete(cl, pk)
 }
 
+// OnQueued adds a message to the store when it is added to the offline queue of a client.
+func (h *Hook) OnQueued(cl *mqtt.Client, pk packets.Packet, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          queuedKey(cl, seq),
+		T:           storage.QueuedKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Sequence:    seq,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	h.setKv(in.ID, in)
+}
+
+// OnDequeued removes a message from the store when it leaves the offline queue of a client.
+func (h *Hook) OnDequeued(cl *mqtt.Client, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.delKv(queuedKey(cl, seq))
+}
+
 // OnSysInfoTick stores the latest system info in the store.
 func (h *Hook) OnSysInfoTick(sys *system.Info) {
 	if h.db == nil {
@@ -376,6 +463,7 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
+	h.flushWrites()
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
 		LowerBound: []byte(storage.ClientKey),
 		UpperBound: keyUpperBound([]byte(storage.ClientKey)),
@@ -383,7 +471,7 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Client{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.Record(&item).UnmarshalBinary(iter.Value()); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -397,6 +485,7 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
+	h.flushWrites()
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
 		LowerBound: []byte(storage.SubscriptionKey),
 		UpperBound: keyUpperBound([]byte(storage.SubscriptionKey)),
@@ -404,7 +493,7 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Subscription{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.Record(&item).UnmarshalBinary(iter.Value()); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -418,6 +507,7 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
+	h.flushWrites()
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
 		LowerBound: []byte(storage.RetainedKey),
 		UpperBound: keyUpperBound([]byte(storage.RetainedKey)),
@@ -425,7 +515,7 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Message{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.Record(&item).UnmarshalBinary(iter.Value()); err == nil {
 			v = append(v, item)
 		}
 	}
@@ -439,6 +529,7 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
+	h.flushWrites()
 	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
 		LowerBound: []byte(storage.InflightKey),
 		UpperBound: keyUpperBound([]byte(storage.InflightKey)),
@@ -446,8 +537,37 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		item := storage.Message{}
-		if err := item.UnmarshalBinary(iter.Value()); err == nil {
+		if err := h.Record(&item).UnmarshalBinary(iter.Value()); err == nil {
 			v = append(v, item)
+			if h.wb != nil {
+				h.wb.MarkStored(string(iter.Key()))
+			}
+		}
+	}
+	return v, nil
+}
+
+// StoredQueuedMessages returns all stored offline queued messages from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.flushWrites()
+	iter, _ := h.db.NewIter(&pebbledb.IterOptions{
+		LowerBound: []byte(storage.QueuedKey),
+		UpperBound: keyUpperBound([]byte(storage.QueuedKey)),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		item := storage.Message{}
+		if err := h.Record(&item).UnmarshalBinary(iter.Value()); err == nil {
+			v = append(v, item)
+			if h.wb != nil {
+				h.wb.MarkStored(string(iter.Key()))
+			}
 		}
 	}
 	return v, nil
@@ -491,7 +611,13 @@ func (h *Hook) Debugf(m string, v ...any) {
 
 // delKv deletes a key-value pair from the database.
 func (h *Hook) delKv(k string) error {
+	if h.wb != nil {
+		return h.wb.Delete(k)
+	}
+
+	h.mu.Lock()
 	err := h.db.Delete([]byte(k), h.mode)
+	h.mu.Unlock()
 	if err != nil {
 		h.Log.Error("failed to delete data", "error", err, "key", k)
 		return err
@@ -501,8 +627,19 @@ func (h *Hook) delKv(k string) error {
 
 // setKv stores a key-value pair in the database.
 func (h *Hook) setKv(k string, v storage.Serializable) error {
-	bs, _ := v.MarshalBinary()
-	err := h.db.Set([]byte(k), bs, h.mode)
+	bs, err := h.Record(v).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal data", "error", err, "key", k)
+		return err
+	}
+
+	if h.wb != nil {
+		return h.wb.Set(k, bs)
+	}
+
+	h.mu.Lock()
+	err = h.db.Set([]byte(k), bs, h.mode)
+	h.mu.Unlock()
 	if err != nil {
 		h.Log.Error("failed to update data", "error", err, "key", k)
 		return err
@@ -512,6 +649,7 @@ func (h *Hook) setKv(k string, v storage.Serializable) error {
 
 // getKv retrieves the value associated with a key from the database.
 func (h *Hook) getKv(k string, v storage.Serializable) error {
+	h.flushWrites()
 	value, closer, err := h.db.Get([]byte(k))
 	if err != nil {
 		return err
@@ -522,5 +660,80 @@ func (h *Hook) getKv(k string, v storage.Serializable) error {
 			closer.Close()
 		}
 	}()
-	return v.UnmarshalBinary(value)
+	return h.Record(v).UnmarshalBinary(value)
+}
+
+// applyWrites applies a batch of writes from the write-behind layer as a single pebble batch.
+func (h *Hook) applyWrites(writes []storage.Write) error {
+	batch := h.db.NewBatch()
+	defer batch.Close()
+
+	for _, w := range writes {
+		var err error
+		if w.Delete {
+			err = batch.Delete([]byte(w.Key), nil)
+		} else {
+			err = batch.Set([]byte(w.Key), w.Value, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return batch.Commit(h.mode)
+}
+
+// flushWrites applies any writes pending in the write-behind layer so they can be read.
+func (h *Hook) flushWrites() {
+	if h.wb != nil {
+		_ = h.wb.Flush()
+	}
+}
+
+// scanRecords visits the raw value of every record in the database.
+func (h *Hook) scanRecords(visit func(key string, value []byte) error) error {
+	h.flushWrites()
+	iter, err := h.db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := visit(string(iter.Key()), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// replaceRecord replaces the raw value of a record if it has not changed since it was scanned.
+func (h *Hook) replaceRecord(k string, old, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	value, closer, err := h.db.Get([]byte(k))
+	if errors.Is(err, pebbledb.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	changed := !bytes.Equal(value, old)
+	closer.Close()
+	if changed {
+		return nil
+	}
+
+	return h.db.Set([]byte(k), data, h.mode)
+}
+
+// WriteBehindMetrics returns the write-behind counters, or false if write-behind is not enabled.
+func (h *Hook) WriteBehindMetrics() (storage.WriteBehindMetrics, bool) {
+	if h.wb == nil {
+		return storage.WriteBehindMetrics{}, false
+	}
+	return h.wb.Metrics(), true
 }
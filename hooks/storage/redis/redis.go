@@ -2,15 +2,37 @@
 // SPDX-FileCopyrightText: 2022 mochi-mqtt, mochi-co
 // SPDX-FileContributor: mochi-co
 
+// Package redis provides a persistent storage hook using redis or redis cluster.
+//
+// Each record is stored under its own key. Session records (clients, subscriptions,
+// inflight messages and system info) are scoped to a broker id so that several
+// brokers can share one redis, and are hash tagged on the client id so that all the
+// records of a client share a cluster slot. Retained messages and users are shared by
+// all brokers using the same prefix, and changes to them can be announced over pub/sub
+// so that the other brokers refresh their topics index and auth ledger:
+//
+//	{prefix}{broker}:CL:{client}
+//	{prefix}{broker}:SUB:{client}:{filter}
+//	{prefix}{broker}:IFM:{client}:{packet id}
+//	{prefix}{broker}:QUE:{client}:{sequence}
+//	{prefix}{broker}:SYS
+//	{prefix}RET:{topic}
+//	{prefix}USER:{username}
 package redis
 
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/hooks/storage"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/mochi-mqtt/server/v2/system"
@@ -21,9 +43,31 @@ import (
 // defaultAddr is the default address to the redis service.
 const defaultAddr = "localhost:6379"
 
-// defaultHPrefix is a prefix to better identify hsets created by mochi mqtt.
+// defaultHPrefix is a prefix to better identify keys created by mochi mqtt.
 const defaultHPrefix = "mochi-"
 
+// defaultBrokerID is the broker id session records are scoped to if none is set.
+const defaultBrokerID = "default"
+
+const (
+	userKey       = "USER"   // the key type of auth users
+	notifyChannel = "notify" // the pub/sub channel change notifications are published on
+	scanCount     = 500      // the number of keys requested by each scan and fetched per pipeline
+)
+
+const (
+	NotifyRetained = "retained" // a retained message was set or deleted
+	NotifyUser     = "user"     // an auth user was saved or deleted
+)
+
+// replaceScript sets a key only if it still holds the expected value.
+var replaceScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("SET", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
 // clientKey returns a primary key for a client.
 func clientKey(cl *mqtt.Client) string {
 	return cl.ID
@@ -44,12 +88,18 @@ func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
 	return cl.ID + ":" + pk.FormatID()
 }
 
+// queuedKey returns a primary key for an offline queued message. The sequence is
+// zero-padded so that the messages of a client are kept in order.
+func queuedKey(cl *mqtt.Client, seq int64) string {
+	return cl.ID + ":" + fmt.Sprintf("%020d", seq)
+}
+
 // sysInfoKey returns a primary key for system info.
 func sysInfoKey() string {
 	return storage.SysInfoKey
 }
 
-// Options contains configuration settings for the bolt instance.
+// Options contains configuration settings for the redis instance.
 type Options struct {
 	Address  string `yaml:"address" json:"address"`
 	Username string `yaml:"username" json:"username"`
@@ -57,14 +107,38 @@ type Options struct {
 	Database int    `yaml:"database" json:"database"`
 	HPrefix  string `yaml:"h_prefix" json:"h_prefix"`
 	Options  *redis.Options
+	// Addresses of redis cluster nodes. If set, the hook connects to a cluster instead of Address.
+	Addresses      []string `yaml:"addresses" json:"addresses"`
+	ClusterOptions *redis.ClusterOptions
+	// BrokerID scopes session records, and must be unique and stable for each broker sharing a redis.
+	BrokerID string `yaml:"broker_id" json:"broker_id"`
+	// Notify publishes retained message and user changes, and applies changes published
+	// by other brokers to Server and Ledger.
+	Notify bool         `yaml:"notify" json:"notify"`
+	Server *mqtt.Server `yaml:"-" json:"-"` // the server whose topics index is refreshed
+	Ledger *auth.Ledger `yaml:"-" json:"-"` // the auth ledger which is refreshed
+	// Encryption optionally seals records at rest with AES-GCM.
+	Encryption *storage.EncryptionOptions `yaml:"encryption" json:"encryption"`
+}
+
+// Notification is published when a shared record is changed.
+type Notification struct {
+	Origin string `json:"origin"` // the hook instance which made the change
+	Kind   string `json:"kind"`   // the kind of record, NotifyRetained or NotifyUser
+	ID     string `json:"id"`     // the topic or username of the record
 }
 
 // Hook is a persistent storage hook based using Redis as a backend.
 type Hook struct {
 	mqtt.HookBase
-	config *Options        // options for connecting to the Redis instance.
-	db     *redis.Client   // the Redis instance
-	ctx    context.Context // a context for the connection
+	storage.Encryption
+	config *Options              // options for connecting to the Redis instance.
+	db     redis.UniversalClient // the Redis or Redis Cluster instance
+	ctx    context.Context       // a context for the connection
+	cancel context.CancelFunc    // cancels the context when the hook is stopped
+	origin string                // a unique id for this instance, to ignore its own notifications
+	pubsub *redis.PubSub         // the subscription to change notifications
+	wg     sync.WaitGroup        // tracks the notification listener
 }
 
 // ID returns the id of the hook.
@@ -84,34 +158,88 @@ func (h *Hook) Provides(b byte) bool {
 		mqtt.OnQosComplete,
 		mqtt.OnQosDropped,
 		mqtt.OnWillSent,
+		mqtt.OnQueued,
+		mqtt.OnDequeued,
 		mqtt.OnSysInfoTick,
 		mqtt.OnClientExpired,
 		mqtt.OnRetainedExpired,
 		mqtt.StoredClients,
 		mqtt.StoredInflightMessages,
 		mqtt.StoredRetainedMessages,
+		mqtt.StoredQueuedMessages,
 		mqtt.StoredSubscriptions,
 		mqtt.StoredSysInfo,
 	}, []byte{b})
 }
 
-// hKey returns a hash set key with a unique prefix.
+// hKey returns a key with a unique prefix.
 func (h *Hook) hKey(s string) string {
 	return h.config.HPrefix + s
 }
 
+// sessionKey returns the key of a session record of this broker, hash tagged on the
+// client id. An empty id returns the key of the client record.
+func (h *Hook) sessionKey(t, client, id string) string {
+	k := h.config.HPrefix + h.config.BrokerID + ":" + t + ":{" + client + "}"
+	if id != "" {
+		k += ":" + id
+	}
+	return k
+}
+
+// sessionMatch returns a scan pattern matching all session records of a type.
+func (h *Hook) sessionMatch(t string) string {
+	return escapeMatch(h.config.HPrefix+h.config.BrokerID) + ":" + t + ":{*"
+}
+
+// sharedKey returns the key of a record shared by all brokers, hash tagged on its id.
+func (h *Hook) sharedKey(t, id string) string {
+	return h.hKey(t + ":{" + id + "}")
+}
+
+// sharedMatch returns a scan pattern matching all shared records of a type.
+func (h *Hook) sharedMatch(t string) string {
+	return escapeMatch(h.config.HPrefix) + t + ":{*"
+}
+
+// sysKey returns the key of the system info record of this broker.
+func (h *Hook) sysKey() string {
+	return h.config.HPrefix + h.config.BrokerID + ":" + storage.SysInfoKey
+}
+
+// escapeMatch escapes the glob characters of a scan pattern.
+func escapeMatch(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // Init initializes and connects to the redis service.
 func (h *Hook) Init(config any) error {
 	if _, ok := config.(*Options); !ok && config != nil {
 		return mqtt.ErrInvalidConfigType
 	}
 
-	h.ctx = context.Background()
+	h.ctx, h.cancel = context.WithCancel(context.Background())
 
 	if config == nil {
 		config = new(Options)
 	}
 	h.config = config.(*Options)
+	if len(h.config.Addresses) > 0 && h.config.ClusterOptions == nil {
+		h.config.ClusterOptions = &redis.ClusterOptions{
+			Addrs:    h.config.Addresses,
+			Username: h.config.Username,
+			Password: h.config.Password,
+		}
+	}
+
 	if h.config.Options == nil {
 		h.config.Options = &redis.Options{
 			Addr: defaultAddr,
@@ -126,16 +254,37 @@ func (h *Hook) Init(config any) error {
 		h.config.HPrefix = defaultHPrefix
 	}
 
-	h.Log.Info(
-		"connecting to redis service",
-		"prefix", h.config.HPrefix,
-		"address", h.config.Options.Addr,
-		"username", h.config.Options.Username,
-		"password-len", len(h.config.Options.Password),
-		"db", h.config.Options.DB,
-	)
+	if h.config.BrokerID == "" {
+		h.config.BrokerID = defaultBrokerID
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	h.origin = hex.EncodeToString(id)
+
+	if h.config.ClusterOptions != nil {
+		h.Log.Info(
+			"connecting to redis cluster",
+			"prefix", h.config.HPrefix,
+			"broker", h.config.BrokerID,
+			"addresses", h.config.ClusterOptions.Addrs,
+			"username", h.config.ClusterOptions.Username,
+			"password-len", len(h.config.ClusterOptions.Password),
+		)
+		h.db = redis.NewClusterClient(h.config.ClusterOptions)
+	} else {
+		h.Log.Info(
+			"connecting to redis service",
+			"prefix", h.config.HPrefix,
+			"broker", h.config.BrokerID,
+			"address", h.config.Options.Addr,
+			"username", h.config.Options.Username,
+			"password-len", len(h.config.Options.Password),
+			"db", h.config.Options.DB,
+		)
+		h.db = redis.NewClient(h.config.Options)
+	}
 
-	h.db = redis.NewClient(h.config.Options)
 	_, err := h.db.Ping(context.Background()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to ping service: %w", err)
@@ -143,13 +292,39 @@ func (h *Hook) Init(config any) error {
 
 	h.Log.Info("connected to redis service")
 
+	if err := h.InitEncryption(h.config.Encryption, h.Log, h.scanRecords, h.replaceRecord); err != nil {
+		return err
+	}
+
+	if err := h.migrateLegacy(); err != nil {
+		return fmt.Errorf("failed to migrate legacy records: %w", err)
+	}
+
+	h.Reencrypt()
+
+	if h.config.Notify {
+		return h.listen()
+	}
+
 	return nil
 }
 
 // Stop closes the redis connection.
 func (h *Hook) Stop() error {
+	h.StopEncryption()
+
+	if h.pubsub != nil {
+		_ = h.pubsub.Close()
+		h.wg.Wait()
+		h.pubsub = nil
+	}
+
 	h.Log.Info("disconnecting from redis service")
 
+	if h.cancel != nil {
+		h.cancel()
+	}
+
 	return h.db.Close()
 }
 
@@ -193,9 +368,9 @@ func (h *Hook) updateClient(cl *mqtt.Client) {
 		Will: storage.ClientWill(cl.Properties.Will),
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), clientKey(cl), in).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, ""), h.Record(in), 0).Err()
 	if err != nil {
-		h.Log.Error("failed to hset client data", "error", err, "data", in)
+		h.Log.Error("failed to set client data", "error", err, "data", in)
 	}
 }
 
@@ -214,7 +389,7 @@ func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
+	err := h.db.Del(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, "")).Err()
 	if err != nil {
 		h.Log.Error("failed to delete client", "error", err, "id", clientKey(cl))
 	}
@@ -241,9 +416,9 @@ func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []by
 			RetainAsPublished: pk.Filters[i].RetainAsPublished,
 		}
 
-		err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter), in).Err()
+		err := h.db.Set(h.ctx, h.sessionKey(storage.SubscriptionKey, cl.ID, pk.Filters[i].Filter), h.Record(in), 0).Err()
 		if err != nil {
-			h.Log.Error("failed to hset subscription data", "error", err, "data", in)
+			h.Log.Error("failed to set subscription data", "error", err, "data", in)
 		}
 	}
 }
@@ -256,7 +431,7 @@ func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
 	}
 
 	for i := 0; i < len(pk.Filters); i++ {
-		err := h.db.HDel(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(cl, pk.Filters[i].Filter)).Err()
+		err := h.db.Del(h.ctx, h.sessionKey(storage.SubscriptionKey, cl.ID, pk.Filters[i].Filter)).Err()
 		if err != nil {
 			h.Log.Error("failed to delete subscription data", "error", err, "id", clientKey(cl))
 		}
@@ -271,11 +446,13 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 	}
 
 	if r == -1 {
-		err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Err()
+		err := h.db.Del(h.ctx, h.sharedKey(storage.RetainedKey, pk.TopicName)).Err()
 		if err != nil {
 			h.Log.Error("failed to delete retained message data", "error", err, "id", retainedKey(pk.TopicName))
+			return
 		}
 
+		h.notify(NotifyRetained, pk.TopicName)
 		return
 	}
 
@@ -301,10 +478,13 @@ func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName), in).Err()
+	err := h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, pk.TopicName), h.Record(in), 0).Err()
 	if err != nil {
-		h.Log.Error("failed to hset retained message data", "error", err, "data", in)
+		h.Log.Error("failed to set retained message data", "error", err, "data", in)
+		return
 	}
+
+	h.notify(NotifyRetained, pk.TopicName)
 }
 
 // OnQosPublish adds or updates an inflight message in the store.
@@ -337,9 +517,9 @@ func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, rese
 		},
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk), in).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.InflightKey, cl.ID, pk.FormatID()), h.Record(in), 0).Err()
 	if err != nil {
-		h.Log.Error("failed to hset qos inflight message data", "error", err, "data", in)
+		h.Log.Error("failed to set qos inflight message data", "error", err, "data", in)
 	}
 }
 
@@ -350,7 +530,7 @@ func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.InflightKey), inflightKey(cl, pk)).Err()
+	err := h.db.Del(h.ctx, h.sessionKey(storage.InflightKey, cl.ID, pk.FormatID())).Err()
 	if err != nil {
 		h.Log.Error("failed to delete qos inflight message data", "error", err, "id", inflightKey(cl, pk))
 	}
@@ -365,6 +545,55 @@ func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
 	h.OnQosComplete(cl, pk)
 }
 
+// OnQueued adds a message to the store when it is added to the offline queue of a client.
+func (h *Hook) OnQueued(cl *mqtt.Client, pk packets.Packet, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          queuedKey(cl, seq),
+		T:           storage.QueuedKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Sequence:    seq,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	err := h.db.Set(h.ctx, h.sessionKey(storage.QueuedKey, cl.ID, fmt.Sprintf("%020d", seq)), h.Record(in), 0).Err()
+	if err != nil {
+		h.Log.Error("failed to set queued message data", "error", err, "data", in)
+	}
+}
+
+// OnDequeued removes a message from the store when it leaves the offline queue of a client.
+func (h *Hook) OnDequeued(cl *mqtt.Client, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	err := h.db.Del(h.ctx, h.sessionKey(storage.QueuedKey, cl.ID, fmt.Sprintf("%020d", seq))).Err()
+	if err != nil {
+		h.Log.Error("failed to delete queued message data", "error", err, "id", queuedKey(cl, seq))
+	}
+}
+
 // OnSysInfoTick stores the latest system info in the store.
 func (h *Hook) OnSysInfoTick(sys *system.Info) {
 	if h.db == nil {
@@ -378,9 +607,9 @@ func (h *Hook) OnSysInfoTick(sys *system.Info) {
 		Info: *sys,
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.SysInfoKey), sysInfoKey(), in).Err()
+	err := h.db.Set(h.ctx, h.sysKey(), h.Record(in), 0).Err()
 	if err != nil {
-		h.Log.Error("failed to hset server info data", "error", err, "data", in)
+		h.Log.Error("failed to set server info data", "error", err, "data", in)
 	}
 }
 
@@ -391,10 +620,13 @@ func (h *Hook) OnRetainedExpired(filter string) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.RetainedKey), retainedKey(filter)).Err()
+	err := h.db.Del(h.ctx, h.sharedKey(storage.RetainedKey, filter)).Err()
 	if err != nil {
 		h.Log.Error("failed to delete expired retained message", "error", err, "id", retainedKey(filter))
+		return
 	}
+
+	h.notify(NotifyRetained, filter)
 }
 
 // OnClientExpired deleted expired clients from the store.
@@ -404,7 +636,7 @@ func (h *Hook) OnClientExpired(cl *mqtt.Client) {
 		return
 	}
 
-	err := h.db.HDel(h.ctx, h.hKey(storage.ClientKey), clientKey(cl)).Err()
+	err := h.db.Del(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, "")).Err()
 	if err != nil {
 		h.Log.Error("failed to delete expired client", "error", err, "id", clientKey(cl))
 	}
@@ -417,19 +649,18 @@ func (h *Hook) StoredClients() (v []storage.Client, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.ClientKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll client data", "error", err)
-		return
-	}
-
-	for _, row := range rows {
+	err = h.loadAll(h.sessionMatch(storage.ClientKey), func(_ string, row []byte) error {
 		var d storage.Client
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
 			h.Log.Error("failed to unmarshal client data", "error", err, "data", row)
 		}
 
 		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to load client data", "error", err)
+		return nil, err
 	}
 
 	return v, nil
@@ -442,19 +673,18 @@ func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.SubscriptionKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll subscription data", "error", err)
-		return
-	}
-
-	for _, row := range rows {
+	err = h.loadAll(h.sessionMatch(storage.SubscriptionKey), func(_ string, row []byte) error {
 		var d storage.Subscription
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
 			h.Log.Error("failed to unmarshal subscription data", "error", err, "data", row)
 		}
 
 		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to load subscription data", "error", err)
+		return nil, err
 	}
 
 	return v, nil
@@ -467,19 +697,18 @@ func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.RetainedKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll retained message data", "error", err)
-		return
-	}
-
-	for _, row := range rows {
+	err = h.loadAll(h.sharedMatch(storage.RetainedKey), func(_ string, row []byte) error {
 		var d storage.Message
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
 			h.Log.Error("failed to unmarshal retained message data", "error", err, "data", row)
 		}
 
 		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to load retained message data", "error", err)
+		return nil, err
 	}
 
 	return v, nil
@@ -492,19 +721,42 @@ func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
 		return
 	}
 
-	rows, err := h.db.HGetAll(h.ctx, h.hKey(storage.InflightKey)).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		h.Log.Error("failed to HGetAll inflight message data", "error", err)
+	err = h.loadAll(h.sessionMatch(storage.InflightKey), func(_ string, row []byte) error {
+		var d storage.Message
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		}
+
+		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to load inflight message data", "error", err)
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// StoredQueuedMessages returns all stored offline queued messages from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
 		return
 	}
 
-	for _, row := range rows {
+	err = h.loadAll(h.sessionMatch(storage.QueuedKey), func(_ string, row []byte) error {
 		var d storage.Message
-		if err = d.UnmarshalBinary([]byte(row)); err != nil {
-			h.Log.Error("failed to unmarshal inflight message data", "error", err, "data", row)
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
+			h.Log.Error("failed to unmarshal queued message data", "error", err, "data", row)
 		}
 
 		v = append(v, d)
+		return nil
+	})
+	if err != nil {
+		h.Log.Error("failed to load queued message data", "error", err)
+		return nil, err
 	}
 
 	return v, nil
@@ -517,14 +769,336 @@ func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
 		return
 	}
 
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
+	row, err := h.db.Get(h.ctx, h.sysKey()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return v, nil
+	} else if err != nil {
 		return
 	}
 
-	if err = v.UnmarshalBinary([]byte(row)); err != nil {
+	if err = h.Record(&v).UnmarshalBinary(row); err != nil {
 		h.Log.Error("failed to unmarshal sys info data", "error", err, "data", row)
 	}
 
 	return v, nil
 }
+
+// SaveUser saves a user rule to the store.
+func (h *Hook) SaveUser(u auth.UserRule) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	err := h.db.Set(h.ctx, h.sharedKey(userKey, string(u.Username)), h.Record(storage.JSONValue{V: u}), 0).Err()
+	if err != nil {
+		return err
+	}
+
+	h.notify(NotifyUser, string(u.Username))
+	return nil
+}
+
+// DeleteUser removes a user rule from the store.
+func (h *Hook) DeleteUser(username string) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	err := h.db.Del(h.ctx, h.sharedKey(userKey, username)).Err()
+	if err != nil {
+		return err
+	}
+
+	h.notify(NotifyUser, username)
+	return nil
+}
+
+// LoadUsers loads all user rules from the store.
+func (h *Hook) LoadUsers() ([]auth.UserRule, error) {
+	if h.db == nil {
+		return nil, storage.ErrDBFileNotOpen
+	}
+
+	var users []auth.UserRule
+	err := h.loadAll(h.sharedMatch(userKey), func(_ string, row []byte) error {
+		u, err := h.decodeUser(row)
+		if err != nil {
+			return err
+		}
+
+		users = append(users, u)
+		return nil
+	})
+
+	return users, err
+}
+
+// decodeUser opens and decodes a stored user rule.
+func (h *Hook) decodeUser(row []byte) (u auth.UserRule, err error) {
+	err = h.Record(storage.JSONValue{V: &u}).UnmarshalBinary(row)
+	return
+}
+
+// scanKeys calls fn with each batch of keys matching a pattern. In a cluster, the keys
+// of every master node are scanned.
+func (h *Hook) scanKeys(match string, fn func(keys []string) error) error {
+	if cc, ok := h.db.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		return cc.ForEachMaster(h.ctx, func(ctx context.Context, c *redis.Client) error {
+			return scanNode(ctx, c, match, func(keys []string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return fn(keys)
+			})
+		})
+	}
+
+	return scanNode(h.ctx, h.db, match, fn)
+}
+
+// scanNode calls fn with each batch of keys matching a pattern on a single node.
+func scanNode(ctx context.Context, c redis.Cmdable, match string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, match, scanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// loadAll visits the key and value of every record matching a pattern, fetching the
+// values of each scanned batch in a single pipeline.
+func (h *Hook) loadAll(match string, visit func(key string, value []byte) error) error {
+	return h.scanKeys(match, func(keys []string) error {
+		cmds := make([]*redis.StringCmd, len(keys))
+		_, err := h.db.Pipelined(h.ctx, func(p redis.Pipeliner) error {
+			for i, k := range keys {
+				cmds[i] = p.Get(h.ctx, k)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		for i, cmd := range cmds {
+			value, err := cmd.Bytes()
+			if errors.Is(err, redis.Nil) {
+				continue // deleted since it was scanned
+			} else if err != nil {
+				return err
+			}
+
+			if err := visit(keys[i], value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// notify publishes a change to a shared record to the other brokers. Changes are published
+// by the hook on its own channel rather than relying on keyspace notifications, which must
+// be enabled in the redis configuration (and often can't be on managed services), are only
+// delivered by the cluster node holding the key, and don't carry the origin of a change,
+// so a broker could not ignore its own writes.
+func (h *Hook) notify(kind, id string) {
+	if !h.config.Notify {
+		return
+	}
+
+	data, _ := json.Marshal(Notification{Origin: h.origin, Kind: kind, ID: id})
+	if err := h.db.Publish(h.ctx, h.hKey(notifyChannel), data).Err(); err != nil {
+		h.Log.Error("failed to publish change notification", "error", err, "kind", kind, "id", id)
+	}
+}
+
+// listen subscribes to the change notifications published by other brokers.
+func (h *Hook) listen() error {
+	h.pubsub = h.db.Subscribe(h.ctx, h.hKey(notifyChannel))
+	if _, err := h.pubsub.Receive(h.ctx); err != nil {
+		_ = h.pubsub.Close()
+		h.pubsub = nil
+		return fmt.Errorf("failed to subscribe to change notifications: %w", err)
+	}
+
+	ch := h.pubsub.Channel()
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for msg := range ch {
+			h.applyNotification([]byte(msg.Payload))
+		}
+	}()
+
+	return nil
+}
+
+// applyNotification refreshes the record described by a change notification from another broker.
+func (h *Hook) applyNotification(data []byte) {
+	var n Notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		h.Log.Warn("invalid change notification", "error", err, "data", string(data))
+		return
+	}
+
+	if n.Origin == h.origin {
+		return
+	}
+
+	var err error
+	switch n.Kind {
+	case NotifyRetained:
+		err = h.refreshRetained(n.ID)
+	case NotifyUser:
+		err = h.refreshUser(n.ID)
+	}
+
+	if err != nil {
+		h.Log.Error("failed to apply change notification", "error", err, "kind", n.Kind, "id", n.ID)
+	}
+}
+
+// refreshRetained reloads a retained message into the topics index of the server,
+// applying the retained limits of the server.
+func (h *Hook) refreshRetained(topic string) error {
+	if h.config.Server == nil {
+		return nil
+	}
+
+	row, err := h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, topic)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return h.config.Server.SyncRetained(packets.Packet{TopicName: topic}) // an empty payload removes the message
+	} else if err != nil {
+		return err
+	}
+
+	var d storage.Message
+	if err := h.Record(&d).UnmarshalBinary(row); err != nil {
+		return err
+	}
+
+	return h.config.Server.SyncRetained(d.ToPacket())
+}
+
+// refreshUser reloads a user into the auth ledger.
+func (h *Hook) refreshUser(username string) error {
+	if h.config.Ledger == nil {
+		return nil
+	}
+
+	row, err := h.db.Get(h.ctx, h.sharedKey(userKey, username)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		h.config.Ledger.SyncRemoveUser(username)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	u, err := h.decodeUser(row)
+	if err != nil {
+		return err
+	}
+
+	h.config.Ledger.SyncUser(u)
+	return nil
+}
+
+// migrateLegacy moves records from the layout used by earlier versions of the hook,
+// which kept every record of a type in a single hash, to their own keys.
+func (h *Hook) migrateLegacy() error {
+	for _, t := range []string{
+		storage.ClientKey,
+		storage.SubscriptionKey,
+		storage.RetainedKey,
+		storage.InflightKey,
+		storage.SysInfoKey,
+	} {
+		rows, err := h.db.HGetAll(h.ctx, h.hKey(t)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		for field, row := range rows {
+			key, err := h.legacyKey(t, field, []byte(row))
+			if err != nil {
+				h.Log.Warn("skipping unreadable legacy record", "error", err, "type", t, "id", field)
+				continue
+			}
+
+			if err := h.db.Set(h.ctx, key, row, 0).Err(); err != nil {
+				return err
+			}
+		}
+
+		if err := h.db.Del(h.ctx, h.hKey(t)).Err(); err != nil {
+			return err
+		}
+
+		h.Log.Info("migrated legacy redis records", "type", t, "records", len(rows))
+	}
+
+	return nil
+}
+
+// legacyKey returns the key of a record stored in a legacy hash.
+func (h *Hook) legacyKey(t, field string, row []byte) (string, error) {
+	switch t {
+	case storage.ClientKey:
+		return h.sessionKey(t, field, ""), nil
+	case storage.SubscriptionKey:
+		var d storage.Subscription
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
+			return "", err
+		}
+		return h.sessionKey(t, d.Client, d.Filter), nil
+	case storage.InflightKey:
+		var d storage.Message
+		if err := h.Record(&d).UnmarshalBinary(row); err != nil {
+			return "", err
+		}
+		return h.sessionKey(t, d.Client, strings.TrimPrefix(field, d.Client+":")), nil
+	case storage.RetainedKey:
+		return h.sharedKey(t, field), nil
+	default:
+		return h.sysKey(), nil
+	}
+}
+
+// scanRecords visits the raw value of every session record of this broker and every
+// shared record.
+func (h *Hook) scanRecords(visit func(key string, value []byte) error) error {
+	for _, match := range []string{
+		escapeMatch(h.config.HPrefix+h.config.BrokerID) + ":*",
+		h.sharedMatch(storage.RetainedKey),
+		h.sharedMatch(userKey),
+	} {
+		if err := h.loadAll(match, visit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceRecord replaces the raw value of a record if it has not changed since it was scanned.
+func (h *Hook) replaceRecord(k string, old, data []byte) error {
+	return replaceScript.Run(h.ctx, h.db, []string{k}, old, data).Err()
+}
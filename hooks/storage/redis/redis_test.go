@@ -5,13 +5,20 @@
 package redis
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/hooks/storage"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/mochi-mqtt/server/v2/system"
@@ -103,6 +110,9 @@ func TestProvides(t *testing.T) {
 	require.True(t, h.Provides(mqtt.OnQosComplete))
 	require.True(t, h.Provides(mqtt.OnQosDropped))
 	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.OnQueued))
+	require.True(t, h.Provides(mqtt.OnDequeued))
+	require.True(t, h.Provides(mqtt.StoredQueuedMessages))
 	require.True(t, h.Provides(mqtt.StoredClients))
 	require.True(t, h.Provides(mqtt.StoredInflightMessages))
 	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
@@ -186,7 +196,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 	h.OnSessionEstablished(client, packets.Packet{})
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err := h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, client.ID, "")).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -200,7 +210,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 
 	h.OnDisconnect(client, nil, false)
 	r2 := new(storage.Client)
-	row, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err = h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, client.ID, "")).Result()
 	require.NoError(t, err)
 	err = r2.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -208,7 +218,7 @@ func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
 
 	h.OnDisconnect(client, nil, true)
 	r3 := new(storage.Client)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	_, err = h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, client.ID, "")).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 	require.Empty(t, r3.ID)
@@ -242,7 +252,7 @@ func TestOnWillSent(t *testing.T) {
 	h.OnWillSent(c1, packets.Packet{})
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey(client)).Result()
+	row, err := h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, client.ID, "")).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -260,18 +270,18 @@ func TestOnClientExpired(t *testing.T) {
 	cl := &mqtt.Client{ID: "cl1"}
 	clientKey := clientKey(cl)
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), clientKey, &storage.Client{ID: cl.ID}).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, ""), &storage.Client{ID: cl.ID}, 0).Err()
 	require.NoError(t, err)
 
 	r := new(storage.Client)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey).Result()
+	row, err := h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, "")).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
 	require.Equal(t, clientKey, r.ID)
 
 	h.OnClientExpired(cl)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.ClientKey), clientKey).Result()
+	_, err = h.db.Get(h.ctx, h.sessionKey(storage.ClientKey, cl.ID, "")).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, redis.Nil, err)
 }
@@ -339,7 +349,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	h.OnSubscribed(client, pkf, []byte{0})
 
 	r := new(storage.Subscription)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	row, err := h.db.Get(h.ctx, h.sessionKey(storage.SubscriptionKey, client.ID, pkf.Filters[0].Filter)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -348,7 +358,7 @@ func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
 	require.Equal(t, byte(0), r.Qos)
 
 	h.OnUnsubscribed(client, pkf)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.SubscriptionKey), subscriptionKey(client, pkf.Filters[0].Filter)).Result()
+	_, err = h.db.Get(h.ctx, h.sessionKey(storage.SubscriptionKey, client.ID, pkf.Filters[0].Filter)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -402,7 +412,7 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	h.OnRetainMessage(client, pk, 1)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	row, err := h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, pk.TopicName)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -412,13 +422,13 @@ func TestOnRetainMessageThenUnset(t *testing.T) {
 	require.Equal(t, pk.Payload, r.Payload)
 
 	h.OnRetainMessage(client, pk, -1)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	_, err = h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, pk.TopicName)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 
 	// coverage: delete deleted
 	h.OnRetainMessage(client, pk, -1)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), retainedKey(pk.TopicName)).Result()
+	_, err = h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, pk.TopicName)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -435,11 +445,11 @@ func TestOnRetainedExpired(t *testing.T) {
 		TopicName: "a/b/c",
 	}
 
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), m.ID, m).Err()
+	err := h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, m.TopicName), m, 0).Err()
 	require.NoError(t, err)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), m.ID).Result()
+	row, err := h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, m.TopicName)).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -448,7 +458,7 @@ func TestOnRetainedExpired(t *testing.T) {
 
 	h.OnRetainedExpired(m.TopicName)
 
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.RetainedKey), m.ID).Result()
+	_, err = h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, m.TopicName)).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
@@ -503,7 +513,7 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
 
 	r := new(storage.Message)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	row, err := h.db.Get(h.ctx, h.sessionKey(storage.InflightKey, client.ID, pk.FormatID())).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -516,11 +526,56 @@ func TestOnQosPublishThenQOSComplete(t *testing.T) {
 
 	// OnQosDropped is a passthrough to OnQosComplete here
 	h.OnQosDropped(client, pk)
-	_, err = h.db.HGet(h.ctx, h.hKey(storage.InflightKey), inflightKey(client, pk)).Result()
+	_, err = h.db.Get(h.ctx, h.sessionKey(storage.InflightKey, client.ID, pk.FormatID())).Result()
 	require.Error(t, err)
 	require.ErrorIs(t, err, redis.Nil)
 }
 
+func TestOnQueuedThenOnDequeued(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+
+	h.OnQueued(client, pk, 10)
+	h.OnQueued(client, pk, 11)
+
+	r, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+	sort.Slice(r[:], func(i, j int) bool { return r[i].Sequence < r[j].Sequence })
+	require.Equal(t, int64(10), r[0].Sequence)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	h.OnDequeued(client, 10)
+	_, err = h.db.Get(h.ctx, h.sessionKey(storage.QueuedKey, client.ID, fmt.Sprintf("%020d", 10))).Result()
+	require.ErrorIs(t, err, redis.Nil)
+
+	r, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, int64(11), r[0].Sequence)
+}
+
+func TestOnQueuedNoDB(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	h.db = nil
+	h.OnQueued(client, packets.Packet{}, 1)
+	h.OnDequeued(client, 1)
+	_, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+}
+
 func TestOnQosPublishNoDB(t *testing.T) {
 	s := miniredis.RunT(t)
 	defer s.Close()
@@ -575,7 +630,7 @@ func TestOnSysInfoTick(t *testing.T) {
 	h.OnSysInfoTick(info)
 
 	r := new(storage.SystemInfo)
-	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
+	row, err := h.db.Get(h.ctx, h.sysKey()).Result()
 	require.NoError(t, err)
 	err = r.UnmarshalBinary([]byte(row))
 	require.NoError(t, err)
@@ -606,13 +661,13 @@ func TestStoredClients(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with clients
-	err := h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey}).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.ClientKey, "cl1", ""), &storage.Client{ID: "cl1", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl2", &storage.Client{ID: "cl2", T: storage.ClientKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.ClientKey, "cl2", ""), &storage.Client{ID: "cl2", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.ClientKey), "cl3", &storage.Client{ID: "cl3", T: storage.ClientKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.ClientKey, "cl3", ""), &storage.Client{ID: "cl3", T: storage.ClientKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredClients()
@@ -653,13 +708,13 @@ func TestStoredSubscriptions(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with subscriptions
-	err := h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub1", &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.SubscriptionKey, "cl1", "sub1"), &storage.Subscription{ID: "sub1", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub2", &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.SubscriptionKey, "cl1", "sub2"), &storage.Subscription{ID: "sub2", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.SubscriptionKey), "sub3", &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.SubscriptionKey, "cl1", "sub3"), &storage.Subscription{ID: "sub3", T: storage.SubscriptionKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredSubscriptions()
@@ -699,16 +754,16 @@ func TestStoredRetainedMessages(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with messages
-	err := h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m1", &storage.Message{ID: "m1", T: storage.RetainedKey}).Err()
+	err := h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "m1"), &storage.Message{ID: "m1", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m2", &storage.Message{ID: "m2", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "m2"), &storage.Message{ID: "m2", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "m3"), &storage.Message{ID: "m3", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.InflightKey, "cl1", "i3"), &storage.Message{ID: "i3", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredRetainedMessages()
@@ -748,16 +803,16 @@ func TestStoredInflightMessages(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with messages
-	err := h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i1", &storage.Message{ID: "i1", T: storage.InflightKey}).Err()
+	err := h.db.Set(h.ctx, h.sessionKey(storage.InflightKey, "cl1", "i1"), &storage.Message{ID: "i1", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i2", &storage.Message{ID: "i2", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.InflightKey, "cl1", "i2"), &storage.Message{ID: "i2", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.InflightKey), "i3", &storage.Message{ID: "i3", T: storage.InflightKey}).Err()
+	err = h.db.Set(h.ctx, h.sessionKey(storage.InflightKey, "cl1", "i3"), &storage.Message{ID: "i3", T: storage.InflightKey}, 0).Err()
 	require.NoError(t, err)
 
-	err = h.db.HSet(h.ctx, h.hKey(storage.RetainedKey), "m3", &storage.Message{ID: "m3", T: storage.RetainedKey}).Err()
+	err = h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "m3"), &storage.Message{ID: "m3", T: storage.RetainedKey}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredInflightMessages()
@@ -797,14 +852,14 @@ func TestStoredSysInfo(t *testing.T) {
 	defer teardown(t, h)
 
 	// populate with sys info
-	err := h.db.HSet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey,
+	err := h.db.Set(h.ctx, h.sysKey(),
 		&storage.SystemInfo{
 			ID: storage.SysInfoKey,
 			Info: system.Info{
 				Version: "2.0.0",
 			},
 			T: storage.SysInfoKey,
-		}).Err()
+		}, 0).Err()
 	require.NoError(t, err)
 
 	r, err := h.StoredSysInfo()
@@ -832,3 +887,361 @@ func TestStoredSysInfoClosedDB(t *testing.T) {
 	require.Empty(t, v)
 	require.Error(t, err)
 }
+
+func newEncryptedHook(t *testing.T, addr string) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(&Options{
+		Options: &redis.Options{
+			Addr: addr,
+		},
+		Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"},
+	})
+	require.NoError(t, err)
+
+	return h
+}
+
+func TestEncryption(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	t.Setenv("MOCHI_TEST_KEYS", "k1:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	h := newEncryptedHook(t, s.Addr())
+	defer teardown(t, h)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("secret-payload")}, 1)
+
+	row, err := h.db.Get(h.ctx, h.sharedKey(storage.RetainedKey, "a/b/c")).Result()
+	require.NoError(t, err)
+	require.NotContains(t, row, "secret")
+	id, ok := storage.KeyID([]byte(row))
+	require.True(t, ok)
+	require.Equal(t, "k1", id)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("secret-payload"), retained[0].Payload)
+}
+
+func TestEncryptionRotateKeys(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	// records written before encryption was enabled are sealed in the background.
+	h := newHook(t, s.Addr())
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	require.NoError(t, h.Stop())
+
+	k1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	t.Setenv("MOCHI_TEST_KEYS", k1)
+	h = newEncryptedHook(t, s.Addr())
+	defer teardown(t, h)
+	h.WaitEncryption()
+
+	keyIDs := func() map[string]string {
+		ids := make(map[string]string)
+		_ = h.scanRecords(func(key string, value []byte) error {
+			ids[key], _ = storage.KeyID(value)
+			return nil
+		})
+		return ids
+	}
+	require.Equal(t, map[string]string{
+		h.sessionKey(storage.ClientKey, client.ID, ""): "k1",
+		h.sharedKey(storage.RetainedKey, "a/b/c"):      "k1",
+	}, keyIDs())
+
+	t.Setenv("MOCHI_TEST_KEYS", k1+",k2:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, h.RotateKeys())
+	h.WaitEncryption()
+	for _, id := range keyIDs() {
+		require.Equal(t, "k2", id)
+	}
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Equal(t, client.ID, clients[0].ID)
+
+	status, ok := h.EncryptionStatus()
+	require.True(t, ok)
+	require.Equal(t, int64(4), status.Reencrypted)
+}
+
+func TestReplaceRecordChanged(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	key := h.sharedKey(storage.RetainedKey, "a/b")
+	require.NoError(t, h.db.Set(h.ctx, key, "new", 0).Err())
+	require.NoError(t, h.replaceRecord(key, []byte("old"), []byte("sealed")))
+	require.Equal(t, "new", mustGet(t, s, key))
+
+	require.NoError(t, h.replaceRecord(key, []byte("new"), []byte("sealed")))
+	require.Equal(t, "sealed", mustGet(t, s, key))
+}
+
+func TestEncryptionDisabled(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.ErrorIs(t, h.RotateKeys(), storage.ErrEncryptionDisabled)
+	_, ok := h.EncryptionStatus()
+	require.False(t, ok)
+}
+
+func mustGet(t *testing.T, s *miniredis.Miniredis, key string) string {
+	v, err := s.Get(key)
+	require.NoError(t, err)
+	return v
+}
+
+func TestKeyLayout(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.Equal(t, "mochi-default:CL:{cl1}", h.sessionKey(storage.ClientKey, "cl1", ""))
+	require.Equal(t, "mochi-default:SUB:{cl1}:a/b/#", h.sessionKey(storage.SubscriptionKey, "cl1", "a/b/#"))
+	require.Equal(t, "mochi-default:IFM:{cl1}:7", h.sessionKey(storage.InflightKey, "cl1", "7"))
+	require.Equal(t, "mochi-default:SYS", h.sysKey())
+	require.Equal(t, "mochi-RET:{a/b}", h.sharedKey(storage.RetainedKey, "a/b"))
+	require.Equal(t, "mochi-USER:{alice}", h.sharedKey(userKey, "alice"))
+	require.Equal(t, `mochi-default:CL:{*`, h.sessionMatch(storage.ClientKey))
+	require.Equal(t, `a\*b\?c\[d\]\\:RET:{*`, escapeMatch(`a*b?c[d]\:`)+"RET:{*")
+}
+
+func TestBrokerIsolation(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h1 := new(Hook)
+	h1.SetOpts(logger, nil)
+	require.NoError(t, h1.Init(&Options{Address: s.Addr(), BrokerID: "b1"}))
+	defer teardown(t, h1)
+
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	require.NoError(t, h2.Init(&Options{Address: s.Addr(), BrokerID: "b2"}))
+	defer h2.Stop()
+
+	h1.OnSessionEstablished(client, packets.Packet{})
+	h1.OnSubscribed(client, pkf, []byte{0})
+	h1.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	clients, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+
+	subs, err := h2.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	retained, err := h2.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+
+	clients, err = h1.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
+
+func TestStoredRetainedMessagesManyKeys(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	n := scanCount*2 + 10
+	for i := 0; i < n; i++ {
+		h.OnRetainMessage(client, packets.Packet{TopicName: fmt.Sprintf("a/%d", i), Payload: []byte("x")}, 1)
+	}
+
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, n)
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.ClientKey, "cl1", &storage.Client{ID: "cl1", T: storage.ClientKey}).Err())
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.SubscriptionKey, "cl:1:a/b", &storage.Subscription{ID: "cl:1:a/b", Client: "cl:1", Filter: "a/b"}).Err())
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.InflightKey, "cl:1:7", &storage.Message{ID: "cl:1:7", Client: "cl:1", PacketID: 7}).Err())
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.InflightKey, "bad", "not-json").Err())
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.RetainedKey, "a/b", &storage.Message{ID: "a/b", TopicName: "a/b"}).Err())
+	require.NoError(t, rdb.HSet(ctx, defaultHPrefix+storage.SysInfoKey, storage.SysInfoKey, &storage.SystemInfo{Info: system.Info{Version: "2.0.0"}}).Err())
+
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	for _, k := range []string{storage.ClientKey, storage.SubscriptionKey, storage.InflightKey, storage.RetainedKey, storage.SysInfoKey} {
+		require.False(t, s.Exists(h.hKey(k)), k)
+	}
+
+	require.True(t, s.Exists(h.sessionKey(storage.SubscriptionKey, "cl:1", "a/b")))
+	require.True(t, s.Exists(h.sessionKey(storage.InflightKey, "cl:1", "7")))
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	inflight, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+
+	info, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "2.0.0", info.Version)
+}
+
+func TestUsers(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+	h := newHook(t, s.Addr())
+	defer teardown(t, h)
+
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "secret"}))
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "bob"}))
+
+	users, err := h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	require.NoError(t, h.DeleteUser("bob"))
+	users, err = h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, auth.RString("secret"), users[0].Password)
+}
+
+func TestUsersNoDB(t *testing.T) {
+	h := new(Hook)
+	require.ErrorIs(t, h.SaveUser(auth.UserRule{}), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.DeleteUser("a"), storage.ErrDBFileNotOpen)
+	_, err := h.LoadUsers()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+}
+
+func TestNotify(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h1 := new(Hook)
+	h1.SetOpts(logger, nil)
+	require.NoError(t, h1.Init(&Options{Address: s.Addr(), BrokerID: "b1", Notify: true}))
+	defer teardown(t, h1)
+
+	server := mqtt.New(&mqtt.Options{Logger: logger})
+	ledger := new(auth.Ledger)
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	require.NoError(t, h2.Init(&Options{Address: s.Addr(), BrokerID: "b2", Notify: true, Server: server, Ledger: ledger}))
+	defer h2.Stop()
+
+	h1.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello"), FixedHeader: packets.FixedHeader{Retain: true}}, 1)
+	require.Eventually(t, func() bool {
+		return len(server.Topics.Messages("a/b/c")) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, []byte("hello"), server.Topics.Messages("a/b/c")[0].Payload)
+
+	h1.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, -1)
+	require.Eventually(t, func() bool {
+		return len(server.Topics.Messages("a/b/c")) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, h1.SaveUser(auth.UserRule{Username: "alice", Password: "secret"}))
+	require.Eventually(t, func() bool {
+		return len(ledger.GetUsers()) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, h1.DeleteUser("alice"))
+	require.Eventually(t, func() bool {
+		return len(ledger.GetUsers()) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestApplyNotificationIgnored(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	server := mqtt.New(&mqtt.Options{Logger: logger})
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Address: s.Addr(), Server: server}))
+	defer teardown(t, h)
+
+	require.NoError(t, h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "a/b"), &storage.Message{TopicName: "a/b", Payload: []byte("x")}, 0).Err())
+
+	// notifications from this instance, invalid notifications and unknown kinds are ignored.
+	own, _ := json.Marshal(Notification{Origin: h.origin, Kind: NotifyRetained, ID: "a/b"})
+	h.applyNotification(own)
+	h.applyNotification([]byte("{"))
+	other, _ := json.Marshal(Notification{Origin: "other", Kind: "shared_group", ID: "a/b"})
+	h.applyNotification(other)
+	require.Empty(t, server.Topics.Messages("a/b"))
+
+	// without a ledger, user notifications are ignored.
+	user, _ := json.Marshal(Notification{Origin: "other", Kind: NotifyUser, ID: "alice"})
+	h.applyNotification(user)
+
+	retained, _ := json.Marshal(Notification{Origin: "other", Kind: NotifyRetained, ID: "a/b"})
+	h.applyNotification(retained)
+	require.Len(t, server.Topics.Messages("a/b"), 1)
+	require.Equal(t, int64(1), atomic.LoadInt64(&server.Info.Retained))
+
+	// the retained limits of the server are applied to refreshed messages
+	server.Options.RetainedLimits = &mqtt.RetainedLimitsOptions{RetainedLimits: mqtt.RetainedLimits{MaxMessageSize: 4}}
+	require.NoError(t, h.db.Set(h.ctx, h.sharedKey(storage.RetainedKey, "a/c"), &storage.Message{TopicName: "a/c", Payload: []byte("hello")}, 0).Err())
+	retained, _ = json.Marshal(Notification{Origin: "other", Kind: NotifyRetained, ID: "a/c"})
+	h.applyNotification(retained)
+	require.Empty(t, server.Topics.Messages("a/c"))
+	require.Equal(t, int64(1), atomic.LoadInt64(&server.Info.RetainedRejected))
+}
+
+func TestCluster(t *testing.T) {
+	s := miniredis.RunT(t)
+	defer s.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{Addresses: []string{s.Addr()}}))
+	defer teardown(t, h)
+	_, ok := h.db.(*redis.ClusterClient)
+	require.True(t, ok)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+}
@@ -0,0 +1,1186 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+// Package sql provides a persistent storage hook backed by a relational database
+// through database/sql. SQLite and PostgreSQL are supported; the database driver
+// must be registered by the program, for example by importing modernc.org/sqlite
+// or github.com/jackc/pgx/v5/stdlib.
+package sql
+
+import (
+	"bytes"
+	dbsql "database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+)
+
+const (
+	DialectSQLite   = "sqlite"   // sqlite 3.24 or later
+	DialectPostgres = "postgres" // postgresql 9.5 or later
+
+	defaultDriver        = "sqlite"
+	defaultDSN           = "mochi.db"
+	defaultTablePrefix   = "mochi_"
+	defaultBatchSize     = 100
+	defaultFlushInterval = 100 * time.Millisecond
+	recordKeySep         = "\x00" // separates the table and key columns of a record key
+)
+
+var (
+	ErrUnsupportedDialect = errors.New("unsupported sql dialect")
+	ErrInvalidTablePrefix = errors.New("invalid table prefix")
+)
+
+// migrations are the schema changes applied to the database in order. The schema
+// version is the number of migrations applied, so existing entries must never be
+// changed or reordered; add a new entry instead. {p} is replaced with the table
+// prefix and {blob} with the binary column type of the dialect.
+var migrations = [][]string{
+	{ // 1: initial schema
+		`CREATE TABLE IF NOT EXISTS {p}clients (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			remote TEXT NOT NULL,
+			listener TEXT NOT NULL,
+			protocol_version SMALLINT NOT NULL,
+			clean BOOLEAN NOT NULL,
+			data {blob} NOT NULL,
+			updated BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS {p}clients_username_idx ON {p}clients (username)`,
+		`CREATE TABLE IF NOT EXISTS {p}subscriptions (
+			client_id TEXT NOT NULL,
+			filter TEXT NOT NULL,
+			qos SMALLINT NOT NULL,
+			data {blob} NOT NULL,
+			PRIMARY KEY (client_id, filter)
+		)`,
+		`CREATE INDEX IF NOT EXISTS {p}subscriptions_filter_idx ON {p}subscriptions (filter)`,
+		`CREATE TABLE IF NOT EXISTS {p}retained (
+			topic TEXT PRIMARY KEY,
+			origin TEXT NOT NULL,
+			qos SMALLINT NOT NULL,
+			created BIGINT NOT NULL,
+			data {blob} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {p}inflight (
+			client_id TEXT NOT NULL,
+			packet_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			sent BIGINT NOT NULL,
+			data {blob} NOT NULL,
+			PRIMARY KEY (client_id, packet_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS {p}inflight_sent_idx ON {p}inflight (sent)`,
+		`CREATE TABLE IF NOT EXISTS {p}sysinfo (
+			id TEXT PRIMARY KEY,
+			data {blob} NOT NULL,
+			updated BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS {p}users (
+			username TEXT PRIMARY KEY,
+			data {blob} NOT NULL
+		)`,
+	},
+	{ // 2: offline queues
+		`CREATE TABLE IF NOT EXISTS {p}queued (
+			client_id TEXT NOT NULL,
+			sequence BIGINT NOT NULL,
+			topic TEXT NOT NULL,
+			data {blob} NOT NULL,
+			PRIMARY KEY (client_id, sequence)
+		)`,
+	},
+}
+
+// sealedTables are the tables whose data column is sealed when encryption is enabled,
+// with the columns of their primary keys.
+var sealedTables = []struct {
+	name string
+	keys []string
+}{
+	{name: "clients", keys: []string{"id"}},
+	{name: "subscriptions", keys: []string{"client_id", "filter"}},
+	{name: "retained", keys: []string{"topic"}},
+	{name: "inflight", keys: []string{"client_id", "packet_id"}},
+	{name: "queued", keys: []string{"client_id", "sequence"}},
+	{name: "sysinfo", keys: []string{"id"}},
+	{name: "users", keys: []string{"username"}},
+}
+
+// Options contains configuration settings for the sql database.
+type Options struct {
+	DB            *dbsql.DB     `yaml:"-" json:"-"`                           // an open database to use instead of opening Driver and DSN
+	Driver        string        `yaml:"driver" json:"driver"`                 // the registered database/sql driver name
+	DSN           string        `yaml:"dsn" json:"dsn"`                       // the data source name passed to the driver
+	Dialect       string        `yaml:"dialect" json:"dialect"`               // sqlite or postgres, inferred from the driver if empty
+	TablePrefix   string        `yaml:"table_prefix" json:"table_prefix"`     // prefix for all table and index names
+	BatchSize     int           `yaml:"batch_size" json:"batch_size"`         // queued writes which trigger an immediate flush
+	FlushInterval time.Duration `yaml:"flush_interval" json:"flush_interval"` // maximum time a write is queued before it is flushed
+	MaxQueued     int           `yaml:"max_queued" json:"max_queued"`         // most writes queued before writes to other rows are refused
+	MaxQueuedMB   int           `yaml:"max_queued_mb" json:"max_queued_mb"`   // most megabytes of writes queued before writes to other rows are refused
+
+	Encryption *storage.EncryptionOptions `yaml:"encryption" json:"encryption"` // optional encryption of the data column of each record at rest
+}
+
+// statement is a write statement for a single row of a table. The leading arguments
+// of the statement are the primary key columns of the row.
+type statement struct {
+	query  string
+	table  string
+	keys   int  // leading arguments which are the primary key of the row
+	delete bool // the statement deletes the row
+}
+
+// op is a single queued write.
+type op struct {
+	query string
+	args  []any
+}
+
+// Size returns the approximate size of the write in bytes.
+func (o op) Size() int {
+	n := len(o.query)
+	for _, arg := range o.args {
+		switch v := arg.(type) {
+		case []byte:
+			n += len(v)
+		case string:
+			n += len(v)
+		default:
+			n += 8
+		}
+	}
+
+	return n
+}
+
+// queries contains the statements used by the hook, built for the dialect and table prefix.
+type queries struct {
+	upsertClient       statement
+	deleteClient       statement
+	upsertSubscription statement
+	deleteSubscription statement
+	upsertRetained     statement
+	deleteRetained     statement
+	upsertInflight     statement
+	deleteInflight     statement
+	upsertQueued       statement
+	deleteQueued       statement
+	upsertSysInfo      statement
+	upsertUser         statement
+	deleteUser         statement
+	selectClients      string
+	selectSubscription string
+	selectRetained     string
+	selectInflight     string
+	selectQueued       string
+	selectSysInfo      string
+	selectUsers        string
+}
+
+// Hook is a persistent storage hook using a sql database as a backend. Writes are
+// queued in the shared asynchronous write-behind layer, keyed on the row they write
+// so only the latest write to each row reaches the database, and flushed in batches,
+// each batch in a single transaction.
+type Hook struct {
+	mqtt.HookBase
+	storage.Encryption
+	config *Options             // options for configuring the sql database.
+	db     *dbsql.DB            // the sql database.
+	owned  bool                 // the database was opened by the hook and is closed on stop.
+	q      queries              // statements for the configured dialect.
+	wb     *storage.WriteBehind // queues writes and flushes them in batches.
+}
+
+// ID returns the id of the hook.
+func (h *Hook) ID() string {
+	return "sql-db"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnWillSent,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnQueued,
+		mqtt.OnDequeued,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredQueuedMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// Init opens the database, applies any outstanding schema migrations and starts
+// the batch writer.
+func (h *Hook) Init(config any) error {
+	if _, ok := config.(*Options); !ok && config != nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	if config == nil {
+		config = new(Options)
+	}
+
+	h.config = config.(*Options)
+	if h.config.Driver == "" {
+		h.config.Driver = defaultDriver
+	}
+
+	if h.config.DSN == "" {
+		h.config.DSN = defaultDSN
+	}
+
+	if h.config.TablePrefix == "" {
+		h.config.TablePrefix = defaultTablePrefix
+	}
+
+	if h.config.BatchSize <= 0 {
+		h.config.BatchSize = defaultBatchSize
+	}
+
+	if h.config.FlushInterval <= 0 {
+		h.config.FlushInterval = defaultFlushInterval
+	}
+
+	if h.config.Dialect == "" {
+		h.config.Dialect = dialectForDriver(h.config.Driver)
+	}
+
+	if h.config.Dialect != DialectSQLite && h.config.Dialect != DialectPostgres {
+		return fmt.Errorf("%w: %q", ErrUnsupportedDialect, h.config.Dialect)
+	}
+
+	if !validIdentifier(h.config.TablePrefix) {
+		return fmt.Errorf("%w: %q", ErrInvalidTablePrefix, h.config.TablePrefix)
+	}
+
+	h.q = buildQueries(h.config.Dialect, h.config.TablePrefix)
+
+	if err := h.InitEncryption(h.config.Encryption, h.Log, h.scanRecords, h.replaceRecord); err != nil {
+		return err
+	}
+
+	db := h.config.DB
+	if db == nil {
+		var err error
+		db, err = dbsql.Open(h.config.Driver, h.config.DSN)
+		if err != nil {
+			return err
+		}
+
+		if h.config.Dialect == DialectSQLite {
+			db.SetMaxOpenConns(1) // sqlite allows a single writer, and each connection to :memory: is a new database
+		}
+		h.owned = true
+	}
+
+	if err := migrate(db, h.config.Dialect, h.config.TablePrefix); err != nil {
+		if h.owned {
+			_ = db.Close()
+		}
+		return err
+	}
+
+	wb, err := storage.NewWriteBehind(storage.WriteBehindOptions{
+		Mode:          storage.DurabilityAsync,
+		FlushInterval: h.config.FlushInterval,
+		MaxPending:    h.config.BatchSize,
+		MaxQueued:     h.config.MaxQueued,
+		MaxQueuedMB:   h.config.MaxQueuedMB,
+	}, h.applyWrites, h.Log)
+	if err != nil {
+		if h.owned {
+			_ = db.Close()
+		}
+		return err
+	}
+
+	h.db = db
+	h.wb = wb
+	h.Reencrypt()
+
+	return nil
+}
+
+// Stop flushes any queued writes and closes the database if it was opened by the hook.
+func (h *Hook) Stop() error {
+	if h.db == nil {
+		return nil
+	}
+
+	h.StopEncryption()
+
+	err := h.wb.Close()
+	if err != nil {
+		h.Log.Error("failed to flush queued writes on stop, pending writes are lost", "error", err, "pending", h.wb.Metrics().Pending)
+	}
+
+	if h.owned {
+		if cerr := h.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	h.db = nil
+	return err
+}
+
+// OnSessionEstablished adds a client to the store when their session is established.
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when a client sends a Will Message and the Will Message is removed from the client record.
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient writes the client data to the store.
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := cl.Properties.Props.Copy(false)
+	in := &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+
+	data, err := h.Record(in).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal client", "error", err, "client", cl.ID)
+		return
+	}
+
+	h.enqueue(h.q.upsertClient, in.ID, string(in.Username), in.Remote, in.Listener,
+		int(in.ProtocolVersion), in.Clean, data, time.Now().Unix())
+}
+
+// OnDisconnect removes a client from the store if their session has expired.
+func (h *Hook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if !expire {
+		return
+	}
+
+	if cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+
+	h.enqueue(h.q.deleteClient, cl.ID)
+}
+
+// OnSubscribed adds one or more client subscriptions to the store.
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		in := &storage.Subscription{
+			ID:                storage.SubscriptionKey + "_" + cl.ID + ":" + pk.Filters[i].Filter,
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            pk.Filters[i].Filter,
+			Identifier:        pk.Filters[i].Identifier,
+			NoLocal:           pk.Filters[i].NoLocal,
+			RetainHandling:    pk.Filters[i].RetainHandling,
+			RetainAsPublished: pk.Filters[i].RetainAsPublished,
+		}
+
+		data, err := h.Record(in).MarshalBinary()
+		if err != nil {
+			h.Log.Error("failed to marshal subscription", "error", err, "client", cl.ID)
+			continue
+		}
+
+		h.enqueue(h.q.upsertSubscription, in.Client, in.Filter, int(in.Qos), data)
+	}
+}
+
+// OnUnsubscribed removes one or more client subscriptions from the store.
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	for i := 0; i < len(pk.Filters); i++ {
+		h.enqueue(h.q.deleteSubscription, cl.ID, pk.Filters[i].Filter)
+	}
+}
+
+// OnRetainMessage adds a retained message for a topic to the store.
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	if r == -1 {
+		h.enqueue(h.q.deleteRetained, pk.TopicName)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          storage.RetainedKey + "_" + pk.TopicName,
+		T:           storage.RetainedKey,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := h.Record(in).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal retained message", "error", err, "topic", pk.TopicName)
+		return
+	}
+
+	h.enqueue(h.q.upsertRetained, in.TopicName, in.Origin, int(in.FixedHeader.Qos), in.Created, data)
+}
+
+// OnQosPublish adds or updates an inflight message in the store.
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          storage.InflightKey + "_" + cl.ID + ":" + pk.FormatID(),
+		T:           storage.InflightKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Sent:        sent,
+		Created:     pk.Created,
+		PacketID:    pk.PacketID,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+
+	data, err := h.Record(in).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal inflight message", "error", err, "client", cl.ID)
+		return
+	}
+
+	h.enqueue(h.q.upsertInflight, cl.ID, pk.FormatID(), in.TopicName, in.Sent, data)
+}
+
+// OnQosComplete removes a resolved inflight message from the store.
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.enqueue(h.q.deleteInflight, cl.ID, pk.FormatID())
+}
+
+// OnQosDropped removes a dropped inflight message from the store.
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+// OnQueued adds a message to the store when it is added to the offline queue of a client.
+func (h *Hook) OnQueued(cl *mqtt.Client, pk packets.Packet, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	props := pk.Properties.Copy(false)
+	in := &storage.Message{
+		ID:          storage.QueuedKey + "_" + cl.ID + ":" + fmt.Sprintf("%020d", seq),
+		T:           storage.QueuedKey,
+		Client:      cl.ID,
+		Origin:      pk.Origin,
+		Sequence:    seq,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			PayloadFormatFlag:      props.PayloadFormatFlag,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			User:                   props.User,
+		},
+	}
+
+	data, err := h.Record(in).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal queued message", "error", err, "client", cl.ID)
+		return
+	}
+
+	h.enqueue(h.q.upsertQueued, cl.ID, seq, in.TopicName, data)
+}
+
+// OnDequeued removes a message from the store when it leaves the offline queue of a client.
+func (h *Hook) OnDequeued(cl *mqtt.Client, seq int64) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.enqueue(h.q.deleteQueued, cl.ID, seq)
+}
+
+// OnSysInfoTick stores the latest system info in the store.
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	in := &storage.SystemInfo{
+		ID:   storage.SysInfoKey,
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+
+	data, err := h.Record(in).MarshalBinary()
+	if err != nil {
+		h.Log.Error("failed to marshal system info", "error", err)
+		return
+	}
+
+	h.enqueue(h.q.upsertSysInfo, in.ID, data, time.Now().Unix())
+}
+
+// OnRetainedExpired deletes expired retained messages from the store.
+func (h *Hook) OnRetainedExpired(filter string) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.enqueue(h.q.deleteRetained, filter)
+}
+
+// OnClientExpired deleted expired clients from the store.
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return
+	}
+
+	h.enqueue(h.q.deleteClient, cl.ID)
+}
+
+// StoredClients returns all stored clients from the store.
+func (h *Hook) StoredClients() (v []storage.Client, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Client, 0)
+	err = h.queryRows(h.q.selectClients, func(data []byte) error {
+		obj := storage.Client{}
+		if err := h.Record(&obj).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSubscriptions returns all stored subscriptions from the store.
+func (h *Hook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Subscription, 0)
+	err = h.queryRows(h.q.selectSubscription, func(data []byte) error {
+		obj := storage.Subscription{}
+		if err := h.Record(&obj).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredRetainedMessages returns all stored retained messages from the store.
+func (h *Hook) StoredRetainedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.queryRows(h.q.selectRetained, func(data []byte) error {
+		obj := storage.Message{}
+		if err := h.Record(&obj).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredInflightMessages returns all stored inflight messages from the store.
+func (h *Hook) StoredInflightMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.queryRows(h.q.selectInflight, func(data []byte) error {
+		obj := storage.Message{}
+		if err := h.Record(&obj).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredQueuedMessages returns all stored offline queued messages from the store.
+func (h *Hook) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	v = make([]storage.Message, 0)
+	err = h.queryRows(h.q.selectQueued, func(data []byte) error {
+		obj := storage.Message{}
+		if err := h.Record(&obj).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		v = append(v, obj)
+		return nil
+	})
+	return
+}
+
+// StoredSysInfo returns the system info from the store.
+func (h *Hook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		h.Log.Error("", "error", storage.ErrDBFileNotOpen)
+		return v, storage.ErrDBFileNotOpen
+	}
+
+	h.flushBeforeRead()
+
+	var data []byte
+	err = h.db.QueryRow(h.q.selectSysInfo, storage.SysInfoKey).Scan(&data)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return v, nil
+	} else if err != nil {
+		h.Log.Error("failed to get data", "error", err, "key", storage.SysInfoKey)
+		return
+	}
+
+	err = h.Record(&v).UnmarshalBinary(data)
+	return
+}
+
+// DeleteClient removes a client from the store by id.
+func (h *Hook) DeleteClient(id string) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	h.enqueue(h.q.deleteClient, id)
+	return h.flush()
+}
+
+// DeleteSubscription removes a subscription from the store.
+func (h *Hook) DeleteSubscription(clientID, filter string) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	h.enqueue(h.q.deleteSubscription, clientID, filter)
+	return h.flush()
+}
+
+// DeleteRetained removes a retained message from the store.
+func (h *Hook) DeleteRetained(topic string) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	h.enqueue(h.q.deleteRetained, topic)
+	return h.flush()
+}
+
+// SaveUser saves a user rule to the store.
+func (h *Hook) SaveUser(u auth.UserRule) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	data, err := h.Record(storage.JSONValue{V: u}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	h.enqueue(h.q.upsertUser, string(u.Username), data)
+	return h.flush()
+}
+
+// DeleteUser removes a user rule from the store.
+func (h *Hook) DeleteUser(username string) error {
+	if h.db == nil {
+		return storage.ErrDBFileNotOpen
+	}
+
+	h.enqueue(h.q.deleteUser, username)
+	return h.flush()
+}
+
+// LoadUsers loads all user rules from the store.
+func (h *Hook) LoadUsers() ([]auth.UserRule, error) {
+	if h.db == nil {
+		return nil, storage.ErrDBFileNotOpen
+	}
+
+	var users []auth.UserRule
+	err := h.queryRows(h.q.selectUsers, func(data []byte) error {
+		var u auth.UserRule
+		if err := h.Record(storage.JSONValue{V: &u}).UnmarshalBinary(data); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	})
+
+	return users, err
+}
+
+// enqueue queues a write for the next flush. The write is keyed on the table and
+// primary key of the row, so it replaces any queued write to the same row.
+func (h *Hook) enqueue(st statement, args ...any) {
+	in := storage.Write{
+		Key:    recordKey(st.table, args[:st.keys]...),
+		Delete: st.delete,
+		Data:   op{query: st.query, args: args},
+	}
+
+	if err := h.wb.Put(in); err != nil && !errors.Is(err, storage.ErrWriteBehindFull) { // logged by the write-behind layer
+		h.Log.Error("failed to queue write", "error", err, "key", in.Key)
+	}
+}
+
+// recordKey returns the key of a row from its table and primary key values, matching
+// the keys of the records visited by scanRecords.
+func recordKey(table string, values ...any) string {
+	key := table
+	for _, v := range values {
+		key += recordKeySep + fmt.Sprint(v)
+	}
+
+	return key
+}
+
+// flush writes all queued operations to the database.
+func (h *Hook) flush() error {
+	return h.wb.Flush()
+}
+
+// WriteBehindMetrics returns the counters of the write-behind layer queueing the writes.
+func (h *Hook) WriteBehindMetrics() (storage.WriteBehindMetrics, bool) {
+	if h.wb == nil {
+		return storage.WriteBehindMetrics{}, false
+	}
+	return h.wb.Metrics(), true
+}
+
+// applyWrites applies a batch of writes from the write-behind layer.
+func (h *Hook) applyWrites(writes []storage.Write) error {
+	ops := make([]op, len(writes))
+	for i, w := range writes {
+		ops[i] = w.Data.(op)
+	}
+
+	return h.applyBatch(ops)
+}
+
+// applyBatch executes the operations within a transaction, preparing each distinct
+// statement once.
+func (h *Hook) applyBatch(ops []op) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback() // no-op once committed
+	}()
+
+	stmts := make(map[string]*dbsql.Stmt)
+	for _, o := range ops {
+		stmt, ok := stmts[o.query]
+		if !ok {
+			stmt, err = tx.Prepare(o.query)
+			if err != nil {
+				return err
+			}
+			stmts[o.query] = stmt
+		}
+
+		if _, err := stmt.Exec(o.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// flushBeforeRead flushes queued writes so they can be read back. Reads do not depend
+// on the flush succeeding, and return the data already in the database if it fails.
+func (h *Hook) flushBeforeRead() {
+	if err := h.flush(); err != nil {
+		h.Log.Warn("reading without queued writes", "error", err)
+	}
+}
+
+// queryRows flushes queued writes and calls visit with the data column of each row
+// returned by the query.
+func (h *Hook) queryRows(query string, visit func([]byte) error) error {
+	h.flushBeforeRead()
+
+	rows, err := h.db.Query(query)
+	if err != nil {
+		h.Log.Error("failed to query data", "error", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+
+		if err := visit(data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// scanRecords visits the data column of every record in the database, keyed on the
+// table and primary key of the record.
+func (h *Hook) scanRecords(visit func(key string, value []byte) error) error {
+	h.flushBeforeRead()
+	for _, t := range sealedTables {
+		if err := h.scanTable(t.name, t.keys, visit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanTable visits the data column of every record in a table.
+func (h *Hook) scanTable(table string, keys []string, visit func(key string, value []byte) error) error {
+	rows, err := h.db.Query("SELECT " + strings.Join(keys, ", ") + ", data FROM " + h.config.TablePrefix + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]string, len(keys))
+		dest := make([]any, 0, len(keys)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		var data []byte
+		if err := rows.Scan(append(dest, &data)...); err != nil {
+			return err
+		}
+
+		if err := visit(table+recordKeySep+strings.Join(values, recordKeySep), data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// replaceRecord replaces the data column of a record scanned by scanRecords if it
+// has not changed since it was scanned.
+func (h *Hook) replaceRecord(key string, old, data []byte) error {
+	table, rest, _ := strings.Cut(key, recordKeySep)
+	for _, t := range sealedTables {
+		if t.name != table {
+			continue
+		}
+
+		values := strings.SplitN(rest, recordKeySep, len(t.keys))
+		if len(values) != len(t.keys) {
+			return fmt.Errorf("invalid record key %q", key)
+		}
+
+		where := make([]string, 0, len(t.keys)+1)
+		args := []any{data}
+		for i, k := range t.keys {
+			where = append(where, k+" = ?")
+			if k == "sequence" {
+				seq, err := strconv.ParseInt(values[i], 10, 64)
+				if err != nil {
+					return err
+				}
+				args = append(args, seq)
+				continue
+			}
+			args = append(args, values[i])
+		}
+		where = append(where, "data = ?")
+		args = append(args, old)
+
+		_, err := h.db.Exec(rebind(h.config.Dialect, "UPDATE "+h.config.TablePrefix+table+" SET data = ? WHERE "+strings.Join(where, " AND ")), args...)
+		return err
+	}
+
+	return fmt.Errorf("invalid record key %q", key)
+}
+
+// migrate applies any schema migrations which have not yet been applied, each
+// within its own transaction.
+func migrate(db *dbsql.DB, dialect, prefix string) error {
+	r := schemaReplacer(dialect, prefix)
+	versions := prefix + "schema_migrations"
+
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + versions + " (version INTEGER PRIMARY KEY, applied BIGINT NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + versions).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(r.Replace(stmt)); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("schema migration %d: %w", i+1, err)
+			}
+		}
+
+		q := rebind(dialect, "INSERT INTO "+versions+" (version, applied) VALUES (?, ?)")
+		if _, err := tx.Exec(q, i+1, time.Now().Unix()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaReplacer returns a replacer which fills the migration templates for the dialect.
+func schemaReplacer(dialect, prefix string) *strings.Replacer {
+	blob := "BLOB"
+	if dialect == DialectPostgres {
+		blob = "BYTEA"
+	}
+
+	return strings.NewReplacer("{p}", prefix, "{blob}", blob)
+}
+
+// buildQueries returns the statements used by the hook for the dialect and table prefix.
+func buildQueries(dialect, prefix string) queries {
+	upsert := func(table string, keys, cols []string) statement {
+		all := append(append([]string{}, keys...), cols...)
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(all)), ", ")
+		sets := make([]string, len(cols))
+		for i, c := range cols {
+			sets[i] = c + " = excluded." + c
+		}
+
+		return statement{
+			query: rebind(dialect, "INSERT INTO "+prefix+table+" ("+strings.Join(all, ", ")+") VALUES ("+marks+
+				") ON CONFLICT ("+strings.Join(keys, ", ")+") DO UPDATE SET "+strings.Join(sets, ", ")),
+			table: table,
+			keys:  len(keys),
+		}
+	}
+
+	remove := func(table string, keys ...string) statement {
+		where := make([]string, len(keys))
+		for i, k := range keys {
+			where[i] = k + " = ?"
+		}
+
+		return statement{
+			query:  rebind(dialect, "DELETE FROM "+prefix+table+" WHERE "+strings.Join(where, " AND ")),
+			table:  table,
+			keys:   len(keys),
+			delete: true,
+		}
+	}
+
+	return queries{
+		upsertClient:       upsert("clients", []string{"id"}, []string{"username", "remote", "listener", "protocol_version", "clean", "data", "updated"}),
+		deleteClient:       remove("clients", "id"),
+		upsertSubscription: upsert("subscriptions", []string{"client_id", "filter"}, []string{"qos", "data"}),
+		deleteSubscription: remove("subscriptions", "client_id", "filter"),
+		upsertRetained:     upsert("retained", []string{"topic"}, []string{"origin", "qos", "created", "data"}),
+		deleteRetained:     remove("retained", "topic"),
+		upsertInflight:     upsert("inflight", []string{"client_id", "packet_id"}, []string{"topic", "sent", "data"}),
+		deleteInflight:     remove("inflight", "client_id", "packet_id"),
+		upsertQueued:       upsert("queued", []string{"client_id", "sequence"}, []string{"topic", "data"}),
+		deleteQueued:       remove("queued", "client_id", "sequence"),
+		upsertSysInfo:      upsert("sysinfo", []string{"id"}, []string{"data", "updated"}),
+		upsertUser:         upsert("users", []string{"username"}, []string{"data"}),
+		deleteUser:         remove("users", "username"),
+		selectClients:      "SELECT data FROM " + prefix + "clients ORDER BY id",
+		selectSubscription: "SELECT data FROM " + prefix + "subscriptions ORDER BY client_id, filter",
+		selectRetained:     "SELECT data FROM " + prefix + "retained ORDER BY topic",
+		selectInflight:     "SELECT data FROM " + prefix + "inflight ORDER BY client_id, sent",
+		selectQueued:       "SELECT data FROM " + prefix + "queued ORDER BY client_id, sequence",
+		selectSysInfo:      rebind(dialect, "SELECT data FROM "+prefix+"sysinfo WHERE id = ?"),
+		selectUsers:        "SELECT data FROM " + prefix + "users ORDER BY username",
+	}
+}
+
+// rebind converts ? placeholders to the numbered $n placeholders used by postgres.
+func rebind(dialect, query string) string {
+	if dialect != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// dialectForDriver returns the dialect of a well-known driver name, or an empty string.
+func dialectForDriver(driver string) string {
+	switch driver {
+	case "sqlite", "sqlite3":
+		return DialectSQLite
+	case "postgres", "pgx", "pgx/v5":
+		return DialectPostgres
+	default:
+		return ""
+	}
+}
+
+// validIdentifier returns true if s is safe to use unquoted in table and index names.
+func validIdentifier(s string) bool {
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
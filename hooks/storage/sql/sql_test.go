@@ -0,0 +1,848 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package sql
+
+import (
+	"bytes"
+	dbsql "database/sql"
+	"encoding/base64"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	client = &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	pkf = packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b/c"}}}
+)
+
+// newHook returns a hook using a new sqlite database in a temporary directory.
+func newHook(t *testing.T) *Hook {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{
+		DSN:           filepath.Join(t.TempDir(), "mochi.db"),
+		FlushInterval: time.Hour, // tests flush explicitly
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Stop() })
+	return h
+}
+
+// count returns the number of rows in a table.
+func count(t *testing.T, h *Hook, table string) int {
+	require.NoError(t, h.flush())
+	var n int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM "+h.config.TablePrefix+table).Scan(&n))
+	return n
+}
+
+func TestID(t *testing.T) {
+	h := new(Hook)
+	require.Equal(t, "sql-db", h.ID())
+}
+
+func TestProvides(t *testing.T) {
+	h := new(Hook)
+	require.True(t, h.Provides(mqtt.OnSessionEstablished))
+	require.True(t, h.Provides(mqtt.OnDisconnect))
+	require.True(t, h.Provides(mqtt.OnSubscribed))
+	require.True(t, h.Provides(mqtt.OnUnsubscribed))
+	require.True(t, h.Provides(mqtt.OnRetainMessage))
+	require.True(t, h.Provides(mqtt.OnQosPublish))
+	require.True(t, h.Provides(mqtt.OnQosComplete))
+	require.True(t, h.Provides(mqtt.OnQosDropped))
+	require.True(t, h.Provides(mqtt.OnQueued))
+	require.True(t, h.Provides(mqtt.OnDequeued))
+	require.True(t, h.Provides(mqtt.OnSysInfoTick))
+	require.True(t, h.Provides(mqtt.StoredClients))
+	require.True(t, h.Provides(mqtt.StoredInflightMessages))
+	require.True(t, h.Provides(mqtt.StoredQueuedMessages))
+	require.True(t, h.Provides(mqtt.StoredRetainedMessages))
+	require.True(t, h.Provides(mqtt.StoredSubscriptions))
+	require.True(t, h.Provides(mqtt.StoredSysInfo))
+	require.False(t, h.Provides(mqtt.OnACLCheck))
+	require.False(t, h.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInitBadConfig(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	err := h.Init(map[string]any{})
+	require.ErrorIs(t, err, mqtt.ErrInvalidConfigType)
+}
+
+func TestInitUseDefaults(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, h.Stop())
+		require.NoError(t, os.Remove(defaultDSN))
+	}()
+
+	require.Equal(t, defaultDriver, h.config.Driver)
+	require.Equal(t, DialectSQLite, h.config.Dialect)
+	require.Equal(t, defaultTablePrefix, h.config.TablePrefix)
+	require.Equal(t, defaultBatchSize, h.config.BatchSize)
+	require.Equal(t, defaultFlushInterval, h.config.FlushInterval)
+}
+
+func TestInitBadDialect(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Driver: "mysql"})
+	require.ErrorIs(t, err, ErrUnsupportedDialect)
+}
+
+func TestInitBadTablePrefix(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{TablePrefix: "mochi; DROP TABLE x; --"})
+	require.ErrorIs(t, err, ErrInvalidTablePrefix)
+}
+
+func TestInitUnknownDriver(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	err := h.Init(&Options{Driver: "unknown", Dialect: DialectSQLite})
+	require.Error(t, err)
+}
+
+func TestInitExistingDB(t *testing.T) {
+	db, err := dbsql.Open("sqlite", filepath.Join(t.TempDir(), "shared.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{DB: db, Dialect: DialectSQLite, TablePrefix: "broker_"}))
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	// the database is owned by the caller and remains open
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM broker_clients").Scan(&n))
+	require.Equal(t, 1, n)
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.db")
+	for i := 0; i < 2; i++ {
+		h := new(Hook)
+		h.SetOpts(logger, nil)
+		require.NoError(t, h.Init(&Options{DSN: path}))
+
+		var version, rows int
+		err := h.db.QueryRow("SELECT MAX(version), COUNT(*) FROM mochi_schema_migrations").Scan(&version, &rows)
+		require.NoError(t, err)
+		require.Equal(t, len(migrations), version)
+		require.Equal(t, len(migrations), rows) // migrations are only applied once
+		require.NoError(t, h.Stop())
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	h := newHook(t)
+	require.NoError(t, h.Stop())
+	require.NoError(t, h.Stop())
+}
+
+func TestOnSessionEstablishedThenOnDisconnect(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].ID)
+	require.Equal(t, client.Net.Remote, r[0].Remote)
+	require.Equal(t, client.Net.Listener, r[0].Listener)
+	require.Equal(t, client.Properties.Username, r[0].Username)
+	require.Equal(t, client.Properties.Clean, r[0].Clean)
+
+	var username string
+	require.NoError(t, h.db.QueryRow("SELECT username FROM mochi_clients WHERE id = ?", client.ID).Scan(&username))
+	require.Equal(t, "username", username)
+
+	h.OnDisconnect(client, nil, false)
+	require.Equal(t, 1, count(t, h, "clients"))
+
+	h.OnDisconnect(client, nil, true)
+	require.Equal(t, 0, count(t, h, "clients"))
+}
+
+func TestOnSessionEstablishedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSessionEstablished(client, packets.Packet{})
+}
+
+func TestOnWillSent(t *testing.T) {
+	h := newHook(t)
+
+	c1 := &mqtt.Client{ID: "cl1"}
+	c1.Properties.Will.Flag = 1
+	h.OnWillSent(c1, packets.Packet{})
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, uint32(1), r[0].Will.Flag)
+}
+
+func TestOnClientExpired(t *testing.T) {
+	h := newHook(t)
+
+	cl := &mqtt.Client{ID: "cl1"}
+	h.OnSessionEstablished(cl, packets.Packet{})
+	require.Equal(t, 1, count(t, h, "clients"))
+
+	h.OnClientExpired(cl)
+	require.Equal(t, 0, count(t, h, "clients"))
+}
+
+func TestOnClientExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnClientExpired(client)
+}
+
+func TestOnDisconnectNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnDisconnect(client, nil, false)
+}
+
+func TestOnDisconnectSessionTakenOver(t *testing.T) {
+	h := newHook(t)
+
+	testClient := &mqtt.Client{
+		ID: "test",
+		Net: mqtt.ClientConnection{
+			Remote:   "test.addr",
+			Listener: "listener",
+		},
+		Properties: mqtt.ClientProperties{
+			Username: []byte("username"),
+			Clean:    false,
+		},
+	}
+
+	h.OnSessionEstablished(testClient, packets.Packet{})
+	testClient.Stop(packets.ErrSessionTakenOver)
+	h.OnDisconnect(testClient, nil, true)
+	require.Equal(t, 1, count(t, h, "clients"))
+}
+
+func TestOnSubscribedThenOnUnsubscribed(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSubscribed(client, pkf, []byte{1})
+	r, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, client.ID, r[0].Client)
+	require.Equal(t, pkf.Filters[0].Filter, r[0].Filter)
+	require.Equal(t, byte(1), r[0].Qos)
+
+	h.OnSubscribed(client, pkf, []byte{2}) // resubscribing replaces the subscription
+	r, err = h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, byte(2), r[0].Qos)
+
+	h.OnUnsubscribed(client, pkf)
+	require.Equal(t, 0, count(t, h, "subscriptions"))
+}
+
+func TestOnSubscribedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSubscribed(client, pkf, []byte{0})
+}
+
+func TestOnUnsubscribedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnUnsubscribed(client, pkf)
+}
+
+func TestOnRetainMessageThenUnset(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Retain: true,
+			Qos:    1,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		Origin:    "cl1",
+		Created:   time.Now().Unix(),
+	}
+
+	h.OnRetainMessage(client, pk, 1)
+	r, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, pk.FixedHeader, r[0].FixedHeader)
+
+	var origin string
+	require.NoError(t, h.db.QueryRow("SELECT origin FROM mochi_retained WHERE topic = ?", pk.TopicName).Scan(&origin))
+	require.Equal(t, "cl1", origin)
+
+	h.OnRetainMessage(client, pk, -1)
+	require.Equal(t, 0, count(t, h, "retained"))
+}
+
+func TestOnRetainedExpired(t *testing.T) {
+	h := newHook(t)
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 1)
+	require.Equal(t, 1, count(t, h, "retained"))
+
+	h.OnRetainedExpired("a/b/c")
+	require.Equal(t, 0, count(t, h, "retained"))
+}
+
+func TestOnRetainedExpiredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnRetainedExpired("a/b/c")
+}
+
+func TestOnRetainMessageNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnRetainMessage(client, packets.Packet{}, 0)
+}
+
+func TestOnQosPublishThenQOSComplete(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+			Qos:    2,
+		},
+		Payload:   []byte("hello"),
+		TopicName: "a/b/c",
+		PacketID:  7,
+	}
+
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	r, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+	require.Equal(t, pk.PacketID, r[0].PacketID)
+	require.Equal(t, pk.FixedHeader.Qos, r[0].FixedHeader.Qos)
+
+	h.OnQosPublish(client, pk, time.Now().Unix()+1, 1) // resends update the same row
+	require.Equal(t, 1, count(t, h, "inflight"))
+
+	h.OnQosComplete(client, pk)
+	require.Equal(t, 0, count(t, h, "inflight"))
+}
+
+func TestOnQosDropped(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{PacketID: 3, TopicName: "a/b/c"}
+	h.OnQosPublish(client, pk, time.Now().Unix(), 0)
+	require.Equal(t, 1, count(t, h, "inflight"))
+
+	h.OnQosDropped(client, pk)
+	require.Equal(t, 0, count(t, h, "inflight"))
+}
+
+func TestOnQosPublishNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQosPublish(client, packets.Packet{}, time.Now().Unix(), 0)
+}
+
+func TestOnQosCompleteNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQosComplete(client, packets.Packet{})
+}
+
+func TestOnQueuedThenOnDequeued(t *testing.T) {
+	h := newHook(t)
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		Payload:     []byte("hello"),
+		TopicName:   "a/b/c",
+	}
+
+	h.OnQueued(client, pk, 11)
+	h.OnQueued(client, pk, 9)
+	h.OnQueued(client, pk, 10)
+
+	r, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+	require.Equal(t, int64(9), r[0].Sequence)
+	require.Equal(t, int64(10), r[1].Sequence)
+	require.Equal(t, int64(11), r[2].Sequence)
+	require.Equal(t, pk.TopicName, r[0].TopicName)
+	require.Equal(t, pk.Payload, r[0].Payload)
+
+	h.OnDequeued(client, 9)
+	require.Equal(t, 2, count(t, h, "queued"))
+}
+
+func TestOnQueuedNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnQueued(client, packets.Packet{}, 1)
+	h.OnDequeued(client, 1)
+}
+
+func TestOnSysInfoTick(t *testing.T) {
+	h := newHook(t)
+
+	info := &system.Info{
+		Version:       "2.0.0",
+		BytesReceived: 100,
+	}
+
+	h.OnSysInfoTick(info)
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, info.Version, r.Version)
+	require.Equal(t, info.BytesReceived, r.BytesReceived)
+
+	info.BytesReceived = 200
+	h.OnSysInfoTick(info)
+	r, err = h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, int64(200), r.BytesReceived)
+	require.Equal(t, 1, count(t, h, "sysinfo"))
+}
+
+func TestOnSysInfoTickNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	h.OnSysInfoTick(new(system.Info))
+}
+
+func TestStoredSysInfoEmpty(t *testing.T) {
+	h := newHook(t)
+	r, err := h.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, "", r.Version)
+}
+
+func TestStoredNoDB(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+
+	_, err := h.StoredClients()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredSubscriptions()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredRetainedMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredInflightMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredQueuedMessages()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.StoredSysInfo()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	_, err = h.LoadUsers()
+	require.ErrorIs(t, err, storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.DeleteClient("cl1"), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.DeleteSubscription("cl1", "a/b"), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.DeleteRetained("a/b"), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.SaveUser(auth.UserRule{}), storage.ErrDBFileNotOpen)
+	require.ErrorIs(t, h.DeleteUser("user"), storage.ErrDBFileNotOpen)
+}
+
+func TestStoredEmpty(t *testing.T) {
+	h := newHook(t)
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Empty(t, subs)
+}
+
+func TestDeleteHelpers(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c"}, 1)
+
+	require.NoError(t, h.DeleteClient(client.ID))
+	require.NoError(t, h.DeleteSubscription(client.ID, "a/b/c"))
+	require.NoError(t, h.DeleteRetained("a/b/c"))
+
+	require.Equal(t, 0, count(t, h, "clients"))
+	require.Equal(t, 0, count(t, h, "subscriptions"))
+	require.Equal(t, 0, count(t, h, "retained"))
+}
+
+func TestUsers(t *testing.T) {
+	h := newHook(t)
+
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "a"}))
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "bob", Password: "b"}))
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "c"}))
+
+	users, err := h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, auth.RString("alice"), users[0].Username)
+	require.Equal(t, auth.RString("c"), users[0].Password)
+
+	require.NoError(t, h.DeleteUser("alice"))
+	users, err = h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, auth.RString("bob"), users[0].Username)
+}
+
+func TestBatchedWrites(t *testing.T) {
+	h := newHook(t)
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{0})
+
+	// writes are queued until the batch is flushed
+	var n int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM mochi_clients").Scan(&n))
+	require.Equal(t, 0, n)
+	require.Equal(t, int64(2), h.wb.Metrics().Pending)
+
+	require.NoError(t, h.flush())
+	require.Equal(t, int64(0), h.wb.Metrics().Pending)
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM mochi_clients").Scan(&n))
+	require.Equal(t, 1, n)
+}
+
+func TestBatchSizeTriggersFlush(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		DSN:           filepath.Join(t.TempDir(), "mochi.db"),
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	}))
+	defer h.Stop()
+
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+
+	require.Eventually(t, func() bool {
+		return h.wb.Metrics().Applied == 2
+	}, time.Second, 5*time.Millisecond)
+
+	var n int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM mochi_clients").Scan(&n))
+	require.Equal(t, 2, n)
+}
+
+func TestFlushInterval(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		DSN:           filepath.Join(t.TempDir(), "mochi.db"),
+		FlushInterval: 10 * time.Millisecond,
+	}))
+	defer h.Stop()
+
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Eventually(t, func() bool {
+		var n int
+		_ = h.db.QueryRow("SELECT COUNT(*) FROM mochi_clients").Scan(&n)
+		return n == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestStopFlushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.db")
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{DSN: path, FlushInterval: time.Hour}))
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.NoError(t, h.Stop())
+
+	h2 := new(Hook)
+	h2.SetOpts(logger, nil)
+	require.NoError(t, h2.Init(&Options{DSN: path}))
+	defer h2.Stop()
+
+	r, err := h2.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+}
+
+func TestFlushFailureRetriesBatch(t *testing.T) {
+	h := newHook(t)
+	late := statement{query: "INSERT INTO late_table (id) VALUES (?)", table: "late_table", keys: 1}
+	h.enqueue(late, 1)
+	require.Error(t, h.flush())
+	require.Equal(t, int64(1), h.wb.Metrics().Pending) // the failed batch is kept
+
+	h.enqueue(late, 2)
+	require.Error(t, h.flush())
+	require.Equal(t, int64(2), h.wb.Metrics().Pending)
+
+	_, err := h.db.Exec("CREATE TABLE late_table (id INTEGER)")
+	require.NoError(t, err)
+	require.NoError(t, h.flush())
+	require.Equal(t, int64(0), h.wb.Metrics().Pending)
+
+	var n int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM late_table").Scan(&n))
+	require.Equal(t, 2, n)
+}
+
+func TestFlushFailureDiscardsPoisonWrite(t *testing.T) {
+	h := newHook(t)
+	h.enqueue(statement{query: "INSERT INTO missing_table (id) VALUES (?)", table: "missing_table", keys: 1}, 1) // always fails
+	h.OnSessionEstablished(client, packets.Packet{})
+	require.Error(t, h.flush())
+
+	// reads do not fail with the queued writes
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Empty(t, r)
+
+	// after repeated failures the writes are applied one at a time
+	for i := 0; h.wb.Metrics().Applied == 0; i++ {
+		require.Less(t, i, 10)
+		require.Error(t, h.flush())
+	}
+
+	var n int
+	require.NoError(t, h.db.QueryRow("SELECT COUNT(*) FROM mochi_clients").Scan(&n))
+	require.Equal(t, 1, n)
+
+	// and the failing write is discarded once it has failed repeatedly while others were applied
+	for i := 0; h.wb.Metrics().Discarded == 0; i++ {
+		require.Less(t, i, 10)
+		h.OnSessionEstablished(&mqtt.Client{ID: "cl" + strconv.Itoa(i)}, packets.Packet{})
+		_ = h.flush()
+	}
+	require.NoError(t, h.flush())
+	require.Equal(t, int64(0), h.wb.Metrics().Pending)
+}
+
+func TestQueueLimits(t *testing.T) {
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		DSN:           filepath.Join(t.TempDir(), "mochi.db"),
+		FlushInterval: time.Hour,
+		MaxQueued:     2,
+	}))
+	defer h.Stop()
+
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl1"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl2"}, packets.Packet{})
+	h.OnSessionEstablished(&mqtt.Client{ID: "cl3"}, packets.Packet{}) // refused
+	h.OnDisconnect(&mqtt.Client{ID: "cl1"}, nil, true)                // replaces the queued write to the row
+	require.Equal(t, int64(2), h.wb.Metrics().Pending)
+	require.Equal(t, int64(1), h.wb.Metrics().Rejected)
+	require.Equal(t, int64(1), h.wb.Metrics().Coalesced)
+
+	r, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Equal(t, "cl2", r[0].ID)
+}
+
+func TestRecordKey(t *testing.T) {
+	require.Equal(t, "queued"+recordKeySep+"cl1"+recordKeySep+"4", recordKey("queued", "cl1", int64(4)))
+}
+
+func TestEncryption(t *testing.T) {
+	t.Setenv("MOCHI_TEST_KEYS", "k1:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{
+		DSN:        filepath.Join(t.TempDir(), "mochi.db"),
+		Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"},
+	}))
+	defer h.Stop()
+
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("secret-payload")}, 1)
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "secret-password"}))
+
+	var n int
+	err := h.scanRecords(func(key string, value []byte) error {
+		require.False(t, bytes.Contains(value, []byte("secret")), key)
+		id, ok := storage.KeyID(value)
+		require.True(t, ok, key)
+		require.Equal(t, "k1", id)
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	retained, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("secret-payload"), retained[0].Payload)
+
+	users, err := h.LoadUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, auth.RString("secret-password"), users[0].Password)
+
+	status, ok := h.EncryptionStatus()
+	require.True(t, ok)
+	require.Equal(t, "k1", status.ActiveKey)
+}
+
+func TestEncryptionRotateKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mochi.db")
+	h := new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{DSN: path}))
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnQueued(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("hello")}, 7)
+	require.NoError(t, h.SaveUser(auth.UserRule{Username: "alice", Password: "secret"}))
+	require.ErrorIs(t, h.RotateKeys(), storage.ErrEncryptionDisabled)
+	require.NoError(t, h.Stop())
+
+	// records written before encryption was enabled are sealed in the background.
+	k1 := "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	t.Setenv("MOCHI_TEST_KEYS", k1)
+	h = new(Hook)
+	h.SetOpts(logger, nil)
+	require.NoError(t, h.Init(&Options{DSN: path, Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"}}))
+	defer h.Stop()
+	h.WaitEncryption()
+
+	keyIDs := func() map[string]string {
+		ids := make(map[string]string)
+		_ = h.scanRecords(func(key string, value []byte) error {
+			ids[key], _ = storage.KeyID(value)
+			return nil
+		})
+		return ids
+	}
+	require.Equal(t, map[string]string{
+		"clients\x00test":     "k1",
+		"queued\x00test\x007": "k1",
+		"users\x00alice":      "k1",
+	}, keyIDs())
+
+	t.Setenv("MOCHI_TEST_KEYS", k1+",k2:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, h.RotateKeys())
+	h.WaitEncryption()
+	require.Equal(t, map[string]string{
+		"clients\x00test":     "k2",
+		"queued\x00test\x007": "k2",
+		"users\x00alice":      "k2",
+	}, keyIDs())
+
+	queued, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), queued[0].Payload)
+
+	status, _ := h.EncryptionStatus()
+	require.Equal(t, int64(6), status.Reencrypted)
+}
+
+func TestRebind(t *testing.T) {
+	require.Equal(t, "a = ? AND b = ?", rebind(DialectSQLite, "a = ? AND b = ?"))
+	require.Equal(t, "a = $1 AND b = $2", rebind(DialectPostgres, "a = ? AND b = ?"))
+}
+
+func TestBuildQueriesPostgres(t *testing.T) {
+	q := buildQueries(DialectPostgres, "mq_")
+	require.Equal(t, "INSERT INTO mq_subscriptions (client_id, filter, qos, data) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (client_id, filter) DO UPDATE SET qos = excluded.qos, data = excluded.data", q.upsertSubscription.query)
+	require.Equal(t, statement{
+		query:  "DELETE FROM mq_inflight WHERE client_id = $1 AND packet_id = $2",
+		table:  "inflight",
+		keys:   2,
+		delete: true,
+	}, q.deleteInflight)
+	require.Equal(t, "SELECT data FROM mq_sysinfo WHERE id = $1", q.selectSysInfo)
+
+	r := schemaReplacer(DialectPostgres, "mq_")
+	require.Contains(t, r.Replace(migrations[0][0]), "CREATE TABLE IF NOT EXISTS mq_clients")
+	require.Contains(t, r.Replace(migrations[0][0]), "data BYTEA NOT NULL")
+}
+
+func TestDialectForDriver(t *testing.T) {
+	require.Equal(t, DialectSQLite, dialectForDriver("sqlite3"))
+	require.Equal(t, DialectPostgres, dialectForDriver("pgx"))
+	require.Equal(t, DialectPostgres, dialectForDriver("postgres"))
+	require.Equal(t, "", dialectForDriver("mysql"))
+}
+
+func TestValidIdentifier(t *testing.T) {
+	require.True(t, validIdentifier("mochi_"))
+	require.True(t, validIdentifier("_Broker2_"))
+	require.False(t, validIdentifier("2mochi"))
+	require.False(t, validIdentifier("mochi-"))
+	require.False(t, validIdentifier("mochi."))
+}
+
+func TestRestoreServerState(t *testing.T) {
+	h := newHook(t)
+	h.OnSessionEstablished(client, packets.Packet{})
+	h.OnSubscribed(client, pkf, []byte{1})
+	h.OnRetainMessage(client, packets.Packet{TopicName: "a/b/c", Payload: []byte("retained")}, 1)
+	require.NoError(t, h.flush())
+
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, s.AddHook(new(Hook), &Options{DSN: h.config.DSN}))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	cl, ok := s.Clients.Get(client.ID)
+	require.True(t, ok)
+	require.Equal(t, client.Properties.Username, cl.Properties.Username)
+	require.Len(t, s.Topics.Subscribers("a/b/c").Subscriptions, 1)
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+}
@@ -17,6 +17,7 @@ const (
 	SysInfoKey      = "SYS" // unique key to denote server system information in a store
 	RetainedKey     = "RET" // unique key to denote retained messages in a store
 	InflightKey     = "IFM" // unique key to denote inflight messages in a store
+	QueuedKey       = "QUE" // unique key to denote offline queued messages in a store
 	ClientKey       = "CL"  // unique key to denote clients in a store
 )
 
@@ -96,6 +97,7 @@ type Message struct {
 	Created     int64               `json:"created,omitempty"`       // the time the message was created in unixtime
 	Sent        int64               `json:"sent,omitempty"`          // the last time the message was sent (for retries) in unixtime (if inflight)
 	PacketID    uint16              `json:"packet_id,omitempty"`     // the unique id of the packet (if inflight)
+	Sequence    int64               `json:"sequence,omitempty"`      // the position of the message in the client's offline queue (if queued)
 }
 
 // MessageProperties contains a limited subset of mqtt v5 properties specific to publish messages.
@@ -199,3 +201,19 @@ func (d *SystemInfo) UnmarshalBinary(data []byte) error {
 	}
 	return json.Unmarshal(data, d)
 }
+
+// JSONValue is a storable representation of any other json encoded value, such as
+// the rules of an auth user.
+type JSONValue struct {
+	V any // the value, which must be a pointer when unmarshalling
+}
+
+// MarshalBinary encodes the value into a json string.
+func (d JSONValue) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(d.V)
+}
+
+// UnmarshalBinary decodes a json string into the value.
+func (d JSONValue) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, d.V)
+}
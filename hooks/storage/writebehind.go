@@ -0,0 +1,517 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DurabilitySync    = "sync"    // each write is applied to the store before returning
+	DurabilityBatched = "batched" // writes wait for a shared group commit before returning
+	DurabilityAsync   = "async"   // writes return immediately and are flushed on an interval or size threshold
+
+	defaultWriteBehindInterval   = 100 * time.Millisecond
+	defaultWriteBehindMaxPending = 1024
+	defaultWriteBehindMaxQueued  = 100000
+	defaultWriteBehindMaxQueueMB = 64
+	maxWriteBehindBackoff        = 30 * time.Second // the longest wait between retries of a failing store
+	writeBehindIsolateAfter      = 3                // failed batches after which writes are applied one at a time
+	writeBehindDiscardAfter      = 3                // failures on its own after which a write is discarded
+)
+
+var (
+	// ErrWriteBehindClosed indicates a write was made after the write-behind layer was closed.
+	ErrWriteBehindClosed = errors.New("write-behind closed")
+
+	// ErrInvalidDurability indicates an unknown durability mode was configured.
+	ErrInvalidDurability = errors.New("invalid write-behind durability mode")
+
+	// ErrWriteBehindFull indicates a write to a new key was refused because too many writes are queued.
+	ErrWriteBehindFull = errors.New("write-behind queue full")
+)
+
+// WriteBehindOptions contains configuration settings for the write-behind layer.
+type WriteBehindOptions struct {
+	Mode          string        `yaml:"mode" json:"mode"`                     // sync, batched (default) or async
+	FlushInterval time.Duration `yaml:"flush_interval" json:"flush_interval"` // maximum time an async write is pending before it is flushed
+	MaxPending    int           `yaml:"max_pending" json:"max_pending"`       // pending async writes which trigger an immediate flush
+	MaxQueued     int           `yaml:"max_queued" json:"max_queued"`         // most writes waiting to be applied before writes to new keys are refused (default 100000)
+	MaxQueuedMB   int           `yaml:"max_queued_mb" json:"max_queued_mb"`   // most megabytes of writes waiting to be applied before writes to new keys are refused (default 64)
+}
+
+// Write is a single key write applied to a store.
+type Write struct {
+	Key    string // the storage key
+	Value  []byte // the value to set, if not deleting
+	Delete bool   // delete the key
+	Data   any    // store specific data applied with the write, such as a sql statement
+	failed int    // times the write has failed to apply on its own
+}
+
+// size returns the approximate size of the write in bytes. Data implementing
+// a Size method is included.
+func (in *Write) size() int {
+	n := len(in.Key) + len(in.Value)
+	if d, ok := in.Data.(interface{ Size() int }); ok {
+		n += d.Size()
+	}
+	return n
+}
+
+// WriteBehindMetrics contains counters describing the activity of a write-behind layer.
+type WriteBehindMetrics struct {
+	Writes    int64 `json:"writes"`    // writes submitted
+	Coalesced int64 `json:"coalesced"` // writes merged into a pending write for the same key
+	Cancelled int64 `json:"cancelled"` // sets of new keys cancelled by a delete before reaching the store
+	Flushes   int64 `json:"flushes"`   // batches applied to the store
+	Applied   int64 `json:"applied"`   // writes applied to the store
+	Errors    int64 `json:"errors"`    // batches which failed to apply
+	Retried   int64 `json:"retried"`   // writes re-queued after their batch failed to apply
+	Rejected  int64 `json:"rejected"`  // writes refused because the queue was full
+	Discarded int64 `json:"discarded"` // writes discarded after repeatedly failing to apply on their own
+	Pending   int64 `json:"pending"`   // writes waiting to be flushed
+	Bytes     int64 `json:"bytes"`     // approximate size of the writes waiting to be flushed
+}
+
+// flushWait is shared by the writes of a single batch, which are released once the
+// batch has been applied.
+type flushWait struct {
+	done chan struct{}
+	err  error
+}
+
+// WriteBehind is a write-behind layer for key-value storage hooks. Writes are queued
+// and coalesced by key, so only the latest write for each key reaches the store, and
+// are applied in batches by the apply function. Writes to tracked keys which are
+// set and then deleted before being flushed are cancelled entirely if the key is not
+// known to be in the store. Writes in a batch which fails to apply are re-queued and
+// retried with an increasing backoff. After several consecutive failures, writes are
+// applied one at a time so a write the store always rejects cannot block the others;
+// it is discarded once it has failed on its own several times while other writes
+// were applied. Writes to new keys are refused with ErrWriteBehindFull while the
+// queue holds MaxQueued writes or MaxQueuedMB megabytes.
+type WriteBehind struct {
+	opts     WriteBehindOptions
+	apply    func([]Write) error // applies a batch of writes to the store
+	log      *slog.Logger        // logs failed batches
+	tracked  []string            // key prefixes whose presence in the store is tracked
+	stored   map[string]struct{} // tracked keys known to be in the store
+	pending  map[string]*Write   // writes waiting to be flushed, keyed on storage key
+	size     int                 // approximate size of the pending writes in bytes
+	full     bool                // writes have been refused since the last applied batch
+	wait     *flushWait          // released when the pending writes have been applied
+	mu       sync.Mutex          // protects pending, size, full, stored and wait
+	flushMu  sync.Mutex          // serializes flushes so batches are applied in order
+	kick     chan struct{}       // signals the flusher to flush immediately
+	stop     chan struct{}       // closed to stop the flusher
+	done     chan struct{}       // closed when the flusher has stopped
+	closed   bool                // the layer has been closed
+	failures int64               // consecutive batches which failed to apply
+	metrics  WriteBehindMetrics  // atomic counters
+}
+
+// NewWriteBehind returns a new write-behind layer applying batches of writes with the
+// apply function. Keys beginning with any of the tracked prefixes have their presence
+// in the store tracked so that short-lived keys, such as inflight messages, never
+// reach the store if they are deleted before being flushed. Keys which are already in
+// the store when the layer starts should be reported with MarkStored.
+func NewWriteBehind(opts WriteBehindOptions, apply func([]Write) error, log *slog.Logger, tracked ...string) (*WriteBehind, error) {
+	if opts.Mode == "" {
+		opts.Mode = DurabilityBatched
+	}
+
+	if opts.Mode != DurabilitySync && opts.Mode != DurabilityBatched && opts.Mode != DurabilityAsync {
+		return nil, ErrInvalidDurability
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultWriteBehindInterval
+	}
+
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultWriteBehindMaxPending
+	}
+
+	if opts.MaxQueued <= 0 {
+		opts.MaxQueued = defaultWriteBehindMaxQueued
+	}
+
+	if opts.MaxQueuedMB <= 0 {
+		opts.MaxQueuedMB = defaultWriteBehindMaxQueueMB
+	}
+
+	w := &WriteBehind{
+		opts:    opts,
+		apply:   apply,
+		log:     log,
+		tracked: tracked,
+		stored:  make(map[string]struct{}),
+		pending: make(map[string]*Write),
+		wait:    &flushWait{done: make(chan struct{})},
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go w.flusher()
+
+	return w, nil
+}
+
+// Mode returns the durability mode of the layer.
+func (w *WriteBehind) Mode() string {
+	return w.opts.Mode
+}
+
+// Set queues a write setting the value of a key.
+func (w *WriteBehind) Set(key string, value []byte) error {
+	return w.write(Write{Key: key, Value: value})
+}
+
+// Delete queues a write deleting a key.
+func (w *WriteBehind) Delete(key string) error {
+	return w.write(Write{Key: key, Delete: true})
+}
+
+// Put queues a write carrying store specific data, such as a sql statement.
+func (w *WriteBehind) Put(in Write) error {
+	in.failed = 0
+	return w.write(in)
+}
+
+// MarkStored records that a tracked key is known to be in the store, such as
+// when it was read from the store on startup.
+func (w *WriteBehind) MarkStored(key string) {
+	if !w.isTracked(key) {
+		return
+	}
+
+	w.mu.Lock()
+	w.stored[key] = struct{}{}
+	w.mu.Unlock()
+}
+
+// write queues a write and, depending on the durability mode, waits for it to be applied.
+func (w *WriteBehind) write(in Write) error {
+	atomic.AddInt64(&w.metrics.Writes, 1)
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWriteBehindClosed
+	}
+
+	if err := w.merge(in); err != nil {
+		logFull := !w.full
+		w.full = true
+		n := len(w.pending)
+		w.mu.Unlock()
+		if logFull && w.log != nil {
+			w.log.Error("write-behind queue full, refusing writes to new keys", "pending", n)
+		}
+		return err
+	}
+	n := len(w.pending)
+	wait := w.wait
+	w.mu.Unlock()
+
+	switch w.opts.Mode {
+	case DurabilitySync:
+		return w.Flush()
+	case DurabilityBatched:
+		w.signal()
+		<-wait.done
+		return wait.err
+	default:
+		if n >= w.opts.MaxPending {
+			w.signal()
+		}
+		return nil
+	}
+}
+
+// merge coalesces a write into the pending writes, refusing writes to new keys
+// while the queue is full. The lock must be held.
+func (w *WriteBehind) merge(in Write) error {
+	p, ok := w.pending[in.Key]
+	if !ok {
+		if len(w.pending) > 0 && (len(w.pending) >= w.opts.MaxQueued || w.size+in.size() > w.opts.MaxQueuedMB<<20) {
+			atomic.AddInt64(&w.metrics.Rejected, 1)
+			return ErrWriteBehindFull
+		}
+
+		w.pending[in.Key] = &in
+		w.addSize(in.size())
+		atomic.AddInt64(&w.metrics.Pending, 1)
+		return nil
+	}
+
+	if in.Delete && !p.Delete && w.isTracked(in.Key) {
+		if _, stored := w.stored[in.Key]; !stored {
+			delete(w.pending, in.Key) // the key never reached the store
+			w.addSize(-p.size())
+			atomic.AddInt64(&w.metrics.Cancelled, 1)
+			atomic.AddInt64(&w.metrics.Pending, -1)
+			return nil
+		}
+	}
+
+	w.addSize(in.size() - p.size())
+	*p = in
+	atomic.AddInt64(&w.metrics.Coalesced, 1)
+	return nil
+}
+
+// addSize adjusts the size of the pending writes. The lock must be held.
+func (w *WriteBehind) addSize(n int) {
+	w.size += n
+	atomic.StoreInt64(&w.metrics.Bytes, int64(w.size))
+}
+
+// signal asks the flusher to flush without waiting for the next interval.
+func (w *WriteBehind) signal() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// flusher flushes pending writes on each interval, or when signalled. After a batch
+// fails to apply, the next flush is delayed by a backoff which doubles with each
+// consecutive failure. In async mode, signals are ignored until it has passed.
+func (w *WriteBehind) flusher() {
+	defer close(w.done)
+
+	timer := time.NewTimer(w.opts.FlushInterval)
+	defer timer.Stop()
+
+	var failing bool
+	for {
+		kick := w.kick
+		if failing && w.opts.Mode == DurabilityAsync {
+			kick = nil // backing off from a failing store, as no writers are waiting
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+		case <-kick:
+		}
+
+		delay := w.opts.FlushInterval
+		failing = w.Flush() != nil
+		if failing {
+			delay = w.backoff()
+		}
+
+		timer.Reset(delay)
+	}
+}
+
+// backoff returns the time to wait before retrying after consecutive failed batches.
+func (w *WriteBehind) backoff() time.Duration {
+	delay := w.opts.FlushInterval
+	for i := int64(1); i < atomic.LoadInt64(&w.failures) && delay < maxWriteBehindBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxWriteBehindBackoff && w.opts.FlushInterval < maxWriteBehindBackoff {
+		delay = maxWriteBehindBackoff
+	}
+
+	return delay
+}
+
+// Flush applies all pending writes to the store as a single batch, or one at a time
+// if the store has been failing. If writes fail to apply, the error is returned to
+// any waiting writers and the writes are re-queued to be retried, unless they have
+// since been replaced by newer writes to the same keys.
+func (w *WriteBehind) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	pending := w.pending
+	wait := w.wait
+	w.pending = make(map[string]*Write)
+	w.wait = &flushWait{done: make(chan struct{})}
+	w.addSize(-w.size)
+	w.mu.Unlock()
+
+	if len(pending) == 0 {
+		close(wait.done)
+		return nil
+	}
+
+	batch := make([]Write, 0, len(pending))
+	for _, in := range pending {
+		batch = append(batch, *in)
+	}
+	atomic.AddInt64(&w.metrics.Pending, -int64(len(batch)))
+
+	// tracked keys being set are considered stored from now on, so a delete
+	// queued while the batch is applied is never cancelled.
+	w.mu.Lock()
+	for _, in := range batch {
+		if !in.Delete && w.isTracked(in.Key) {
+			w.stored[in.Key] = struct{}{}
+		}
+	}
+	w.mu.Unlock()
+
+	var failed []Write
+	var err error
+	if atomic.LoadInt64(&w.failures) >= writeBehindIsolateAfter {
+		failed, err = w.applyEach(batch)
+	} else if err = w.apply(batch); err != nil {
+		failed = batch
+	} else {
+		atomic.AddInt64(&w.metrics.Applied, int64(len(batch)))
+	}
+
+	retry := make(map[string]struct{}, len(failed))
+	for _, in := range failed {
+		retry[in.Key] = struct{}{}
+	}
+
+	w.mu.Lock()
+	for _, in := range batch {
+		if _, ok := retry[in.Key]; !ok && in.Delete {
+			delete(w.stored, in.Key)
+		}
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		w.requeue(failed)
+		failures := atomic.AddInt64(&w.failures, 1)
+		atomic.AddInt64(&w.metrics.Errors, 1)
+		if w.log != nil {
+			w.log.Error("failed to apply write-behind batch, retrying", "error", err, "writes", len(failed), "failures", failures)
+		}
+	} else {
+		atomic.StoreInt64(&w.failures, 0)
+		atomic.AddInt64(&w.metrics.Flushes, 1)
+		w.mu.Lock()
+		w.full = false
+		w.mu.Unlock()
+	}
+
+	wait.err = err
+	close(wait.done)
+
+	return err
+}
+
+// applyEach applies the writes of a batch one at a time, returning the writes which
+// failed and the last error. If every write fails, the store is assumed to be failing
+// rather than the writes. Otherwise, writes which have failed on their own
+// writeBehindDiscardAfter times are discarded so they cannot block the queue.
+func (w *WriteBehind) applyEach(batch []Write) ([]Write, error) {
+	var failed []Write
+	var err error
+	for _, in := range batch {
+		if aerr := w.apply([]Write{in}); aerr != nil {
+			in.failed++
+			failed = append(failed, in)
+			err = aerr
+			continue
+		}
+		atomic.AddInt64(&w.metrics.Applied, 1)
+	}
+
+	if len(failed) == len(batch) {
+		return failed, err
+	}
+
+	kept := failed[:0]
+	for _, in := range failed {
+		if in.failed < writeBehindDiscardAfter {
+			kept = append(kept, in)
+			continue
+		}
+
+		atomic.AddInt64(&w.metrics.Discarded, 1)
+		if w.log != nil {
+			w.log.Error("discarding write-behind write which cannot be applied", "error", err, "key", in.Key, "failures", in.failed)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, nil
+	}
+
+	return kept, err
+}
+
+// requeue returns the writes of a failed batch to the pending writes, except for
+// keys which have been written again while the batch was being applied.
+func (w *WriteBehind) requeue(batch []Write) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range batch {
+		if _, ok := w.pending[batch[i].Key]; ok {
+			continue // the newer write supersedes the failed one
+		}
+
+		w.pending[batch[i].Key] = &batch[i]
+		w.addSize(batch[i].size())
+		atomic.AddInt64(&w.metrics.Pending, 1)
+		atomic.AddInt64(&w.metrics.Retried, 1)
+	}
+}
+
+// Close stops the flusher and applies any pending writes. If the final batch fails
+// to apply, its writes remain pending and the error is returned. Writes made after
+// the layer is closed return ErrWriteBehindClosed.
+func (w *WriteBehind) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	<-w.done
+
+	return w.Flush()
+}
+
+// Metrics returns a snapshot of the write-behind counters.
+func (w *WriteBehind) Metrics() WriteBehindMetrics {
+	return WriteBehindMetrics{
+		Writes:    atomic.LoadInt64(&w.metrics.Writes),
+		Coalesced: atomic.LoadInt64(&w.metrics.Coalesced),
+		Cancelled: atomic.LoadInt64(&w.metrics.Cancelled),
+		Flushes:   atomic.LoadInt64(&w.metrics.Flushes),
+		Applied:   atomic.LoadInt64(&w.metrics.Applied),
+		Errors:    atomic.LoadInt64(&w.metrics.Errors),
+		Retried:   atomic.LoadInt64(&w.metrics.Retried),
+		Rejected:  atomic.LoadInt64(&w.metrics.Rejected),
+		Discarded: atomic.LoadInt64(&w.metrics.Discarded),
+		Pending:   atomic.LoadInt64(&w.metrics.Pending),
+		Bytes:     atomic.LoadInt64(&w.metrics.Bytes),
+	}
+}
+
+// isTracked returns true if the presence of the key in the store is tracked.
+func (w *WriteBehind) isTracked(key string) bool {
+	for _, prefix := range w.tracked {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package storage
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is an in-memory store recording the batches applied to it.
+type memStore struct {
+	sync.Mutex
+	data    map[string][]byte
+	batches [][]Write
+	err     error
+	poison  string // a key whose writes are always rejected
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string][]byte)}
+}
+
+func (m *memStore) apply(writes []Write) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+
+	for _, w := range writes {
+		if w.Key == m.poison {
+			return errors.New("constraint violation")
+		}
+	}
+
+	sort.Slice(writes, func(i, j int) bool { return writes[i].Key < writes[j].Key })
+	m.batches = append(m.batches, writes)
+	for _, w := range writes {
+		if w.Delete {
+			delete(m.data, w.Key)
+		} else {
+			m.data[w.Key] = w.Value
+		}
+	}
+	return nil
+}
+
+func (m *memStore) get(key string) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+func newTestWriteBehind(t *testing.T, mode string, m *memStore) *WriteBehind {
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: mode, FlushInterval: time.Hour}, m.apply, nil, InflightKey)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+func TestNewWriteBehindDefaults(t *testing.T) {
+	w, err := NewWriteBehind(WriteBehindOptions{}, newMemStore().apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, DurabilityBatched, w.Mode())
+	require.Equal(t, defaultWriteBehindInterval, w.opts.FlushInterval)
+	require.Equal(t, defaultWriteBehindMaxPending, w.opts.MaxPending)
+	require.Equal(t, defaultWriteBehindMaxQueued, w.opts.MaxQueued)
+	require.Equal(t, defaultWriteBehindMaxQueueMB, w.opts.MaxQueuedMB)
+}
+
+func TestNewWriteBehindInvalidMode(t *testing.T) {
+	_, err := NewWriteBehind(WriteBehindOptions{Mode: "eventually"}, newMemStore().apply, nil)
+	require.ErrorIs(t, err, ErrInvalidDurability)
+}
+
+func TestWriteBehindSync(t *testing.T) {
+	m := newMemStore()
+	w := newTestWriteBehind(t, DurabilitySync, m)
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	v, ok := m.get("CL_a")
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), v)
+
+	require.NoError(t, w.Delete("CL_a"))
+	_, ok = m.get("CL_a")
+	require.False(t, ok)
+	require.Equal(t, int64(2), w.Metrics().Flushes)
+}
+
+func TestWriteBehindBatched(t *testing.T) {
+	m := newMemStore()
+	w := newTestWriteBehind(t, DurabilityBatched, m)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, w.Set("CL_"+string(rune('a'+i%26)), []byte{byte(i)}))
+		}(i)
+	}
+	wg.Wait()
+
+	// every write has been applied when it returns, sharing fewer batches than writes
+	for i := 0; i < 26; i++ {
+		_, ok := m.get("CL_" + string(rune('a'+i)))
+		require.True(t, ok)
+	}
+
+	metrics := w.Metrics()
+	require.Equal(t, int64(50), metrics.Writes)
+	require.Equal(t, int64(0), metrics.Pending)
+	require.LessOrEqual(t, metrics.Flushes, int64(50))
+}
+
+func TestWriteBehindAsyncCoalesce(t *testing.T) {
+	m := newMemStore()
+	w := newTestWriteBehind(t, DurabilityAsync, m)
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.NoError(t, w.Set("CL_a", []byte("2")))
+	require.NoError(t, w.Set("RET_a/b", []byte("x")))
+	require.NoError(t, w.Delete("RET_a/b")) // untracked keys still delete from the store
+
+	_, ok := m.get("CL_a")
+	require.False(t, ok) // nothing is applied until flushed
+
+	require.NoError(t, w.Flush())
+	require.Len(t, m.batches, 1)
+	require.Equal(t, []Write{
+		{Key: "CL_a", Value: []byte("2")},
+		{Key: "RET_a/b", Delete: true},
+	}, m.batches[0])
+
+	metrics := w.Metrics()
+	require.Equal(t, int64(4), metrics.Writes)
+	require.Equal(t, int64(2), metrics.Coalesced)
+	require.Equal(t, int64(2), metrics.Applied)
+	require.Equal(t, int64(1), metrics.Flushes)
+}
+
+func TestWriteBehindCancelInflight(t *testing.T) {
+	m := newMemStore()
+	w := newTestWriteBehind(t, DurabilityAsync, m)
+
+	// a new inflight message completed before it is flushed never reaches the store
+	require.NoError(t, w.Set(InflightKey+"_cl1:1", []byte("1")))
+	require.NoError(t, w.Delete(InflightKey+"_cl1:1"))
+	require.NoError(t, w.Flush())
+	require.Empty(t, m.batches)
+	require.Equal(t, int64(1), w.Metrics().Cancelled)
+
+	// once stored, a later set and delete must still delete the stored key
+	require.NoError(t, w.Set(InflightKey+"_cl1:2", []byte("1")))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Set(InflightKey+"_cl1:2", []byte("2")))
+	require.NoError(t, w.Delete(InflightKey+"_cl1:2"))
+	require.NoError(t, w.Flush())
+	_, ok := m.get(InflightKey + "_cl1:2")
+	require.False(t, ok)
+
+	// and after the delete is applied, the key is known to be absent again
+	require.NoError(t, w.Set(InflightKey+"_cl1:2", []byte("3")))
+	require.NoError(t, w.Delete(InflightKey+"_cl1:2"))
+	require.Equal(t, int64(2), w.Metrics().Cancelled)
+}
+
+func TestWriteBehindMarkStored(t *testing.T) {
+	m := newMemStore()
+	m.data[InflightKey+"_cl1:1"] = []byte("restored")
+	w := newTestWriteBehind(t, DurabilityAsync, m)
+	w.MarkStored(InflightKey + "_cl1:1")
+	w.MarkStored(ClientKey + "_cl1") // untracked keys are ignored
+	require.Len(t, w.stored, 1)
+
+	require.NoError(t, w.Set(InflightKey+"_cl1:1", []byte("resent")))
+	require.NoError(t, w.Delete(InflightKey+"_cl1:1"))
+	require.NoError(t, w.Flush())
+	_, ok := m.get(InflightKey + "_cl1:1")
+	require.False(t, ok)
+}
+
+func TestWriteBehindAsyncMaxPending(t *testing.T) {
+	m := newMemStore()
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: time.Hour, MaxPending: 2}, m.apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.NoError(t, w.Set("CL_b", []byte("1")))
+	require.Eventually(t, func() bool {
+		_, ok := m.get("CL_b")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWriteBehindAsyncInterval(t *testing.T) {
+	m := newMemStore()
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: 5 * time.Millisecond}, m.apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.Eventually(t, func() bool {
+		_, ok := m.get("CL_a")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWriteBehindError(t *testing.T) {
+	m := newMemStore()
+	m.err = errors.New("disk full")
+	w := newTestWriteBehind(t, DurabilityBatched, m)
+
+	require.ErrorIs(t, w.Set(InflightKey+"_cl1:1", []byte("1")), m.err)
+	require.Equal(t, int64(1), w.Metrics().Errors)
+
+	// a failed set may have reached the store, so the delete is not cancelled
+	m.err = nil
+	require.NoError(t, w.Delete(InflightKey+"_cl1:1"))
+	require.Equal(t, []Write{{Key: InflightKey + "_cl1:1", Delete: true}}, m.batches[0])
+}
+
+func TestWriteBehindClose(t *testing.T) {
+	m := newMemStore()
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: time.Hour}, m.apply, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.NoError(t, w.Close())
+	_, ok := m.get("CL_a")
+	require.True(t, ok) // pending writes are applied on close
+
+	require.ErrorIs(t, w.Set("CL_b", nil), ErrWriteBehindClosed)
+	require.NoError(t, w.Close())
+}
+
+func TestWriteBehindAsyncErrorRequeued(t *testing.T) {
+	m := newMemStore()
+	m.err = errors.New("disk full")
+	w := newTestWriteBehind(t, DurabilityAsync, m)
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.NoError(t, w.Set("CL_b", []byte("1")))
+	require.ErrorIs(t, w.Flush(), m.err)
+	require.Equal(t, int64(2), w.Metrics().Pending) // the failed writes are kept
+	require.Equal(t, int64(2), w.Metrics().Retried)
+
+	// a newer write replaces the failed write for the same key
+	require.NoError(t, w.Set("CL_b", []byte("2")))
+	require.ErrorIs(t, w.Flush(), m.err)
+	require.Equal(t, int64(2), w.Metrics().Pending)
+
+	m.Lock()
+	m.err = nil
+	m.Unlock()
+
+	require.NoError(t, w.Flush())
+	v, ok := m.get("CL_a")
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), v)
+	v, ok = m.get("CL_b")
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), v)
+	require.Equal(t, int64(0), w.Metrics().Pending)
+	require.Equal(t, int64(2), w.Metrics().Errors)
+}
+
+func TestWriteBehindAsyncErrorRetried(t *testing.T) {
+	m := newMemStore()
+	m.err = errors.New("disk full")
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: time.Millisecond}, m.apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.Eventually(t, func() bool {
+		return w.Metrics().Errors > 0
+	}, time.Second, time.Millisecond)
+
+	m.Lock()
+	m.err = nil
+	m.Unlock()
+
+	// the flusher retries the failed batch once the backoff has passed
+	require.Eventually(t, func() bool {
+		_, ok := m.get("CL_a")
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteBehindBackoff(t *testing.T) {
+	w := &WriteBehind{opts: WriteBehindOptions{FlushInterval: time.Second}}
+	w.failures = 1
+	require.Equal(t, time.Second, w.backoff())
+	w.failures = 3
+	require.Equal(t, 4*time.Second, w.backoff())
+	w.failures = 100
+	require.Equal(t, maxWriteBehindBackoff, w.backoff())
+}
+
+func TestWriteBehindBackoffLongInterval(t *testing.T) {
+	w := &WriteBehind{opts: WriteBehindOptions{FlushInterval: time.Hour}}
+	w.failures = 5
+	require.Equal(t, time.Hour, w.backoff()) // never sooner than the flush interval
+}
+
+// sizedData is write data with a size.
+type sizedData int
+
+func (d sizedData) Size() int {
+	return int(d)
+}
+
+func TestWriteBehindFull(t *testing.T) {
+	m := newMemStore()
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: time.Hour, MaxQueued: 2}, m.apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("CL_a", []byte("1")))
+	require.NoError(t, w.Put(Write{Key: "CL_b", Data: sizedData(100)}))
+	require.Equal(t, int64(4+1+4+100), w.Metrics().Bytes)
+
+	require.ErrorIs(t, w.Set("CL_c", []byte("1")), ErrWriteBehindFull)
+	require.NoError(t, w.Set("CL_a", []byte("22"))) // pending keys can still be replaced
+	require.Equal(t, int64(1), w.Metrics().Rejected)
+	require.Equal(t, int64(4+2+4+100), w.Metrics().Bytes)
+
+	require.NoError(t, w.Flush())
+	require.Equal(t, int64(0), w.Metrics().Bytes)
+	require.NoError(t, w.Set("CL_c", []byte("1")))
+}
+
+func TestWriteBehindFullBytes(t *testing.T) {
+	m := newMemStore()
+	w, err := NewWriteBehind(WriteBehindOptions{Mode: DurabilityAsync, FlushInterval: time.Hour, MaxQueuedMB: 1}, m.apply, nil)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Set("CL_a", make([]byte, 1<<20))) // a single write is never refused
+	require.ErrorIs(t, w.Set("CL_b", []byte("1")), ErrWriteBehindFull)
+}
+
+func TestWriteBehindDiscardsPoisonWrite(t *testing.T) {
+	m := newMemStore()
+	m.poison = "CL_bad"
+	w := newTestWriteBehind(t, DurabilityAsync, m)
+
+	require.NoError(t, w.Set("CL_bad", []byte("1")))
+	for i := 0; i < writeBehindIsolateAfter; i++ {
+		require.NoError(t, w.Set("CL_"+string(rune('a'+i)), []byte("1")))
+		require.Error(t, w.Flush()) // the poison write fails the whole batch
+	}
+	_, ok := m.get("CL_a")
+	require.False(t, ok)
+
+	// writes are now applied one at a time, so the others reach the store
+	require.Error(t, w.Flush())
+	_, ok = m.get("CL_a")
+	require.True(t, ok)
+	require.Equal(t, int64(1), w.Metrics().Pending)
+
+	// a store failing every write is not mistaken for poison writes
+	m.Lock()
+	m.err = errors.New("disk full")
+	m.Unlock()
+	require.NoError(t, w.Set("CL_z", []byte("1")))
+	for i := 0; i < writeBehindDiscardAfter; i++ {
+		require.Error(t, w.Flush())
+	}
+	require.Equal(t, int64(2), w.Metrics().Pending)
+
+	m.Lock()
+	m.err = nil
+	m.Unlock()
+	require.NoError(t, w.Flush())
+	_, ok = m.get("CL_z")
+	require.True(t, ok)
+	require.Equal(t, int64(0), w.Metrics().Pending)
+	require.Equal(t, int64(1), w.Metrics().Discarded)
+	require.Equal(t, int64(0), atomic.LoadInt64(&w.failures)) // batches resume once the store recovers
+}
@@ -158,6 +158,17 @@ func (h *modifiedHookBase) StoredInflightMessages() (v []storage.Message, err er
 	}, nil
 }
 
+func (h *modifiedHookBase) StoredQueuedMessages() (v []storage.Message, err error) {
+	if h.fail || h.failAt == 6 {
+		return v, errTestHook
+	}
+
+	return []storage.Message{
+		{ID: "q1"},
+		{ID: "q2"},
+	}, nil
+}
+
 func (h *modifiedHookBase) StoredSysInfo() (v storage.SystemInfo, err error) {
 	if h.fail || h.failAt == 5 {
 		return v, errTestHook
@@ -240,6 +251,7 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnSessionEstablished(cl, packets.Packet{})
 			h.OnDisconnect(cl, nil, false)
 			h.OnPacketSent(cl, packets.Packet{}, []byte{})
+			h.OnPacketReceived(cl, packets.Packet{}, []byte{})
 			h.OnPacketProcessed(cl, packets.Packet{}, nil)
 			h.OnSubscribed(cl, packets.Packet{}, []byte{1})
 			h.OnUnsubscribed(cl, packets.Packet{})
@@ -254,6 +266,10 @@ func TestHooksNonReturns(t *testing.T) {
 			h.OnWillSent(cl, packets.Packet{})
 			h.OnClientExpired(cl)
 			h.OnRetainedExpired("a/b/c")
+			h.OnConnectAuthenticateFailed(cl, packets.Packet{})
+			h.OnACLCheckFailed(cl, "a/b/c", true)
+			h.OnQueued(cl, packets.Packet{}, 1)
+			h.OnDequeued(cl, 1)
 
 			// on second iteration, check added hook methods
 			err := h.Add(new(modifiedHookBase), nil)
@@ -535,6 +551,28 @@ func TestHooksStoredInflightMessages(t *testing.T) {
 	require.Len(t, v, 0)
 }
 
+func TestHooksStoredQueuedMessages(t *testing.T) {
+	h := new(Hooks)
+	h.Log = logger
+
+	v, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 0)
+
+	hook := new(modifiedHookBase)
+	err = h.Add(hook, nil)
+	require.NoError(t, err)
+
+	v, err = h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Len(t, v, 2)
+
+	hook.fail = true
+	v, err = h.StoredQueuedMessages()
+	require.Error(t, err)
+	require.Len(t, v, 0)
+}
+
 func TestHooksStoredSysInfo(t *testing.T) {
 	h := new(Hooks)
 	h.Log = logger
@@ -652,6 +690,13 @@ func TestHookBaseStoredInflightMessages(t *testing.T) {
 	require.Empty(t, v)
 }
 
+func TestHookBaseStoredQueuedMessages(t *testing.T) {
+	h := new(HookBase)
+	v, err := h.StoredQueuedMessages()
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
 func TestHookBaseStoredRetainedMessages(t *testing.T) {
 	h := new(HookBase)
 	v, err := h.StoredRetainedMessages()
@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// gatewayAuthHook allows the user alice to connect, publish to allowed/ topics and
+// subscribe to any topic except denied/ topics.
+type gatewayAuthHook struct {
+	HookBase
+}
+
+func (h *gatewayAuthHook) ID() string {
+	return "gateway-auth"
+}
+
+func (h *gatewayAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{OnConnectAuthenticate, OnACLCheck}, []byte{b})
+}
+
+func (h *gatewayAuthHook) OnConnectAuthenticate(cl *Client, pk packets.Packet) bool {
+	return string(pk.Connect.Username) == "alice" && string(pk.Connect.Password) == "secret"
+}
+
+func (h *gatewayAuthHook) OnACLCheck(cl *Client, topic string, write bool) bool {
+	if write {
+		return strings.HasPrefix(topic, "allowed/")
+	}
+	return !strings.HasPrefix(topic, "denied/")
+}
+
+// newHTTPGatewayServer returns a served server with an HTTP gateway listener, and the url
+// of the gateway topics.
+func newHTTPGatewayServer(t *testing.T) (*Server, string) {
+	gw := listeners.NewHTTPGateway(listeners.Config{ID: "http1", Address: "127.0.0.1:0"})
+	s := newListenerServer(t, new(gatewayAuthHook), gw)
+	return s, "http://" + gw.Address() + "/topics/"
+}
+
+// gatewayRequest makes a request to the gateway as alice.
+func gatewayRequest(t *testing.T, method, url, body string, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth("alice", "secret")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestHTTPGatewayPublish(t *testing.T) {
+	s, url := newHTTPGatewayServer(t)
+
+	resp := gatewayRequest(t, http.MethodPost, url+"allowed/temp", "21.5", http.Header{
+		"X-Mqtt-Qos":              {"1"},
+		"X-Mqtt-Retain":           {"true"},
+		"Content-Type":            {"text/plain"},
+		"X-Mqtt-Message-Expiry":   {"60"},
+		"X-Mqtt-Response-Topic":   {"allowed/reply"},
+		"X-Mqtt-Correlation-Data": {"req-1"},
+		"X-Mqtt-User-Property":    {"unit=celsius", "sensor=1"},
+	})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("X-Mqtt-Client-Id"))
+
+	retained := s.Topics.Messages("allowed/temp")
+	require.Len(t, retained, 1)
+	pk := retained[0]
+	require.Equal(t, []byte("21.5"), pk.Payload)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.Equal(t, "text/plain", pk.Properties.ContentType)
+	require.Equal(t, uint32(60), pk.Properties.MessageExpiryInterval)
+	require.Equal(t, "allowed/reply", pk.Properties.ResponseTopic)
+	require.Equal(t, []byte("req-1"), pk.Properties.CorrelationData)
+	require.Equal(t, []packets.UserProperty{{Key: "unit", Val: "celsius"}, {Key: "sensor", Val: "1"}}, pk.Properties.User)
+
+	// the request client is gone once the publish has been made
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("http1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestHTTPGatewayPublishQos(t *testing.T) {
+	s, url := newHTTPGatewayServer(t)
+
+	for _, qos := range []string{"0", "2"} {
+		resp := gatewayRequest(t, http.MethodPost, url+"allowed/q"+qos+"?retain=1&qos="+qos, qos, nil)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		require.Len(t, s.Topics.Messages("allowed/q"+qos), 1)
+	}
+}
+
+func TestHTTPGatewayPublishRefused(t *testing.T) {
+	_, url := newHTTPGatewayServer(t)
+
+	tt := []struct {
+		desc   string
+		url    string
+		header http.Header
+		body   string
+		status int
+	}{
+		{desc: "acl qos 0", url: url + "denied/x", status: http.StatusForbidden},
+		{desc: "acl", url: url + "denied/x", header: http.Header{"X-Mqtt-Qos": {"1"}}, status: http.StatusForbidden},
+		{desc: "acl qos 2", url: url + "denied/x", header: http.Header{"X-Mqtt-Qos": {"2"}}, status: http.StatusForbidden},
+		{desc: "wildcard", url: url + "allowed/+", status: http.StatusBadRequest},
+		{desc: "sys", url: url + "$SYS/x", status: http.StatusBadRequest},
+		{desc: "qos", url: url + "allowed/x", header: http.Header{"X-Mqtt-Qos": {"3"}}, status: http.StatusBadRequest},
+		{desc: "retain", url: url + "allowed/x", header: http.Header{"X-Mqtt-Retain": {"maybe"}}, status: http.StatusBadRequest},
+		{desc: "user property", url: url + "allowed/x", header: http.Header{"X-Mqtt-User-Property": {"x"}}, status: http.StatusBadRequest},
+		{desc: "too large", url: url + "allowed/x", body: strings.Repeat("x", 1<<20+1), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			resp := gatewayRequest(t, http.MethodPost, tx.url, tx.body, tx.header)
+			require.Equal(t, tx.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestHTTPGatewayAuthentication(t *testing.T) {
+	_, url := newHTTPGatewayServer(t)
+
+	resp, err := http.Post(url+"allowed/x", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, `Basic realm="mqtt"`, resp.Header.Get("WWW-Authenticate"))
+
+	req, _ := http.NewRequest(http.MethodGet, url+"allowed/x?timeout=0", nil)
+	req.SetBasicAuth("alice", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHTTPGatewaySubscribeStream(t *testing.T) {
+	s, url := newHTTPGatewayServer(t)
+	require.NoError(t, s.Publish("sensors/1", []byte("retained"), true, 0))
+
+	resp := gatewayRequest(t, http.MethodGet, url+"sensors/%23?qos=1", "", http.Header{"Accept": {"text/event-stream"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	next := func() map[string]any {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(line, "data: "), line)
+		_, _ = events.ReadString('\n')
+
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line[6:]), &m))
+		return m
+	}
+
+	m := next()
+	require.Equal(t, "sensors/1", m["topic"])
+	require.Equal(t, "retained", m["payload"])
+	require.Equal(t, true, m["retain"])
+
+	require.NoError(t, s.Publish("sensors/2", []byte{0xFF, 0x00}, false, 1))
+	m = next()
+	require.Equal(t, "sensors/2", m["topic"])
+	require.Equal(t, "/wA=", m["payload_base64"])
+	require.Equal(t, float64(1), m["qos"])
+
+	require.Len(t, s.Clients.GetByListener("http1"), 1)
+	_ = resp.Body.Close()
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("http1")) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestHTTPGatewaySubscribePoll(t *testing.T) {
+	s, url := newHTTPGatewayServer(t)
+
+	// nothing arrives
+	resp := gatewayRequest(t, http.MethodGet, url+"sensors/1?timeout=0", "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// a message arrives while waiting
+	go func() {
+		for len(s.Topics.Subscribers("sensors/1").Subscriptions) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		_ = s.Publish("sensors/1", []byte("hello"), false, 0)
+	}()
+
+	resp = gatewayRequest(t, http.MethodGet, url+"sensors/1?timeout=5", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var messages []map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&messages))
+	require.Len(t, messages, 1)
+	require.Equal(t, "hello", messages[0]["payload"])
+}
+
+func TestHTTPGatewaySubscribePollSession(t *testing.T) {
+	s, url := newHTTPGatewayServer(t)
+	poll := url + "sensors/1?qos=1&timeout=0&client_id=backend&session_expiry=60"
+
+	resp := gatewayRequest(t, http.MethodGet, poll, "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "backend", resp.Header.Get("X-Mqtt-Client-Id"))
+
+	// messages published between polls are kept by the session
+	require.Eventually(t, func() bool {
+		cl, ok := s.Clients.Get("backend")
+		return ok && cl.Closed()
+	}, time.Second, time.Millisecond)
+	require.NoError(t, s.Publish("sensors/1", []byte("missed"), false, 1))
+
+	resp = gatewayRequest(t, http.MethodGet, poll, "", nil)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Contains(t, string(body), `"payload":"missed"`)
+}
+
+func TestHTTPGatewaySubscribeRefused(t *testing.T) {
+	_, url := newHTTPGatewayServer(t)
+
+	resp := gatewayRequest(t, http.MethodGet, url+"denied/x?timeout=0", "", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = gatewayRequest(t, http.MethodGet, url+"a/%23/b?timeout=0", "", nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPGatewayClosed(t *testing.T) {
+	s := New(&Options{Logger: logger, InlineClient: true})
+	_ = s.AddHook(new(gatewayAuthHook), nil)
+	gw := listeners.NewHTTPGateway(listeners.Config{ID: "http1", Address: "127.0.0.1:0"})
+	require.NoError(t, s.AddListener(gw))
+	require.NoError(t, s.Serve())
+
+	resp := gatewayRequest(t, http.MethodGet, "http://"+gw.Address()+"/topics/x", "", http.Header{"Accept": {"text/event-stream"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		return len(s.Clients.GetByListener("http1")) == 1
+	}, time.Second, time.Millisecond)
+
+	// closing the server ends the event stream
+	require.NoError(t, s.Close())
+	_, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+}
@@ -16,6 +16,7 @@ import (
 type Inflight struct {
 	sync.RWMutex
 	internal            map[uint16]packets.Packet // internal contains the inflight packets
+	resends             map[uint16]int            // the number of times each inflight packet has been resent
 	receiveQuota        int32                     // remaining inbound qos quota for flow control
 	sendQuota           int32                     // remaining outbound qos quota for flow control
 	maximumReceiveQuota int32                     // maximum allowed receive quota
@@ -26,6 +27,7 @@ type Inflight struct {
 func NewInflights() *Inflight {
 	return &Inflight{
 		internal: map[uint16]packets.Packet{},
+		resends:  map[uint16]int{},
 	}
 }
 
@@ -36,6 +38,10 @@ func (i *Inflight) Set(m packets.Packet) bool {
 
 	_, ok := i.internal[m.PacketID]
 	i.internal[m.PacketID] = m
+	if !ok {
+		delete(i.resends, m.PacketID)
+	}
+
 	return !ok
 }
 
@@ -67,6 +73,9 @@ func (i *Inflight) Clone() *Inflight {
 	for k, v := range i.internal {
 		c.internal[k] = v
 	}
+	for k, v := range i.resends {
+		c.resends[k] = v
+	}
 	return c
 }
 
@@ -111,10 +120,32 @@ func (i *Inflight) Delete(id uint16) bool {
 
 	_, ok := i.internal[id]
 	delete(i.internal, id)
+	delete(i.resends, id)
 
 	return ok
 }
 
+// Resent records that an inflight packet has been resent, returning the number of
+// times it has now been resent.
+func (i *Inflight) Resent(id uint16) int {
+	i.Lock()
+	defer i.Unlock()
+
+	if _, ok := i.internal[id]; !ok {
+		return 0
+	}
+
+	i.resends[id]++
+	return i.resends[id]
+}
+
+// Resends returns the number of times an inflight packet has been resent.
+func (i *Inflight) Resends(id uint16) int {
+	i.RLock()
+	defer i.RUnlock()
+	return i.resends[id]
+}
+
 // TakeRecieveQuota reduces the receive quota by 1.
 func (i *Inflight) DecreaseReceiveQuota() {
 	if atomic.LoadInt32(&i.receiveQuota) > 0 {
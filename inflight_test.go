@@ -88,6 +88,27 @@ func TestInflightDelete(t *testing.T) {
 	require.False(t, r)
 }
 
+func TestInflightResent(t *testing.T) {
+	i := NewInflights()
+	require.Equal(t, 0, i.Resent(4))
+
+	i.Set(packets.Packet{PacketID: 4})
+	require.Equal(t, 1, i.Resent(4))
+	require.Equal(t, 2, i.Resent(4))
+	require.Equal(t, 2, i.Resends(4))
+
+	i.Set(packets.Packet{PacketID: 4, FixedHeader: packets.FixedHeader{Type: packets.Pubrel}})
+	require.Equal(t, 2, i.Resends(4))
+
+	cloned := i.Clone()
+	require.Equal(t, 2, cloned.Resends(4))
+
+	i.Delete(4)
+	require.Equal(t, 0, i.Resends(4))
+	i.Set(packets.Packet{PacketID: 4})
+	require.Equal(t, 0, i.Resends(4))
+}
+
 func TestResetReceiveQuota(t *testing.T) {
 	i := NewInflights()
 	require.Equal(t, int32(0), atomic.LoadInt32(&i.maximumReceiveQuota))
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoCertificates indicates a certificate store has no certificates to present.
+	ErrNoCertificates = errors.New("no tls certificates available")
+)
+
+// CertFile is the location of a PEM encoded certificate and private key.
+type CertFile struct {
+	Cert string `yaml:"cert" json:"cert"` // the path to the certificate (chain)
+	Key  string `yaml:"key" json:"key"`   // the path to the private key
+}
+
+// CertStore holds the tls certificates presented by listeners, which can be replaced
+// while the listeners are serving. Each handshake selects a certificate by the server
+// name (SNI) requested by the client, so existing connections are unaffected by a
+// change and new connections use the new certificates.
+type CertStore struct {
+	sync.RWMutex
+	certs  []*tls.Certificate          // all certificates, the first is the default
+	byName map[string]*tls.Certificate // certificates keyed on lowercase dns name, including wildcards
+	files  []CertFile                  // the files certificates are loaded from, if any
+	loaded map[string]certFileState    // the state of the files when last loaded
+}
+
+// certFileState identifies the content of a certificate file, so that a change is
+// noticed even if the modification time is unchanged or too coarse to differ.
+type certFileState struct {
+	modTime time.Time // the modification time of the file
+	size    int64     // the size of the file
+	sum     [32]byte  // the sha256 sum of the file
+}
+
+// NewCertStore returns a new, empty instance of CertStore.
+func NewCertStore() *CertStore {
+	return &CertStore{
+		byName: map[string]*tls.Certificate{},
+		loaded: map[string]certFileState{},
+	}
+}
+
+// Set replaces the certificates in the store. The first certificate is presented to
+// clients which don't request a server name, or request one no certificate matches.
+func (s *CertStore) Set(certs ...tls.Certificate) error {
+	if len(certs) == 0 {
+		return ErrNoCertificates
+	}
+
+	all := make([]*tls.Certificate, 0, len(certs))
+	byName := map[string]*tls.Certificate{}
+	for i := range certs {
+		cert := &certs[i]
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+			cert.Leaf = leaf
+		}
+
+		all = append(all, cert)
+		if cert.Leaf == nil {
+			continue
+		}
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = cert
+			}
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.certs = all
+	s.byName = byName
+	return nil
+}
+
+// LoadFiles loads certificates from PEM files, and remembers the files so that they
+// can be reloaded later.
+func (s *CertStore) LoadFiles(files ...CertFile) error {
+	s.Lock()
+	s.files = files
+	s.Unlock()
+
+	return s.Reload()
+}
+
+// Reload reloads the certificates from their files. If any certificate fails to load,
+// the current certificates are kept.
+func (s *CertStore) Reload() error {
+	s.RLock()
+	files := s.files
+	s.RUnlock()
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	loaded := map[string]certFileState{}
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, f := range files {
+		var pem [2][]byte
+		for i, p := range []string{f.Cert, f.Key} {
+			b, state, err := readCertFile(p)
+			if err != nil {
+				return fmt.Errorf("load %s: %w", f.Cert, err)
+			}
+			pem[i], loaded[p] = b, state
+		}
+
+		cert, err := tls.X509KeyPair(pem[0], pem[1])
+		if err != nil {
+			return fmt.Errorf("load %s: %w", f.Cert, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if err := s.Set(certs...); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.loaded = loaded
+	s.Unlock()
+	return nil
+}
+
+// equal returns true if two states are of the same file content.
+func (c certFileState) equal(o certFileState) bool {
+	return c.modTime.Equal(o.modTime) && c.size == o.size && c.sum == o.sum
+}
+
+// readCertFile reads a certificate or key file, returning its content and state.
+func readCertFile(p string) ([]byte, certFileState, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, certFileState{}, err
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, certFileState{}, err
+	}
+
+	return b, certFileState{modTime: fi.ModTime(), size: int64(len(b)), sum: sha256.Sum256(b)}, nil
+}
+
+// changed returns true if any of the certificate files have been modified since they
+// were loaded, comparing their modification time, size and content.
+func (s *CertStore) changed() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, f := range s.files {
+		for _, p := range []string{f.Cert, f.Key} {
+			_, state, err := readCertFile(p)
+			if err != nil {
+				continue // the file may be mid-replacement, check again on the next pass
+			}
+
+			if !state.equal(s.loaded[p]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Watch checks the certificate files for changes at each interval, reloading the
+// certificates when they are modified, until stop is closed.
+func (s *CertStore) Watch(interval time.Duration, log *slog.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := s.ReloadIfChanged()
+			if err != nil {
+				log.Error("failed to reload tls certificates", "error", err)
+				continue
+			}
+
+			if reloaded {
+				log.Info("reloaded tls certificates")
+			}
+		}
+	}
+}
+
+// ReloadIfChanged reloads the certificates if any of their files have been modified
+// since they were loaded, returning true if they were reloaded.
+func (s *CertStore) ReloadIfChanged() (bool, error) {
+	if !s.changed() {
+		return false, nil
+	}
+
+	return true, s.Reload()
+}
+
+// GetCertificate returns the certificate for a tls handshake, matching the requested
+// server name exactly, then by wildcard, and otherwise returning the default certificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.certs) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := s.byName[name]; ok {
+			return cert, nil
+		}
+
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := s.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	return s.certs[0], nil
+}
+
+// TLSConfig returns a copy of base (or a new config if base is nil) which presents the
+// certificates in the store.
+func (s *CertStore) TLSConfig(base *tls.Config) *tls.Config {
+	c := new(tls.Config)
+	if base != nil {
+		c = base.Clone()
+	}
+
+	c.Certificates = nil
+	c.GetCertificate = s.GetCertificate
+	return c
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCert returns a self-signed PEM certificate and key for the given dns names.
+func newTestCert(t *testing.T, cn string, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+// newTestKeyPair returns a parsed self-signed certificate for the given dns names.
+func newTestKeyPair(t *testing.T, cn string, names ...string) tls.Certificate {
+	c, k := newTestCert(t, cn, names...)
+	cert, err := tls.X509KeyPair(c, k)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeTestCert writes a self-signed certificate and key to files in dir.
+func writeTestCert(t *testing.T, dir, cn string) CertFile {
+	c, k := newTestCert(t, cn)
+	f := CertFile{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")}
+	require.NoError(t, os.WriteFile(f.Cert, c, 0600))
+	require.NoError(t, os.WriteFile(f.Key, k, 0600))
+	return f
+}
+
+func TestCertStoreEmpty(t *testing.T) {
+	s := NewCertStore()
+	_, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	require.ErrorIs(t, err, ErrNoCertificates)
+	require.ErrorIs(t, s.Set(), ErrNoCertificates)
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	s := NewCertStore()
+	require.NoError(t, s.Set(
+		newTestKeyPair(t, "default", "mqtt.example.com"),
+		newTestKeyPair(t, "wildcard", "*.example.org"),
+		newTestKeyPair(t, "cn.example.net"),
+	))
+
+	tt := map[string]string{
+		"":                  "default",
+		"mqtt.example.com":  "default",
+		"MQTT.Example.com.": "default",
+		"a.example.org":     "wildcard",
+		"a.b.example.org":   "default",
+		"cn.example.net":    "cn.example.net",
+		"unknown.test":      "default",
+	}
+
+	for name, want := range tt {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+		require.Equal(t, want, cert.Leaf.Subject.CommonName, name)
+	}
+}
+
+func TestCertStoreReloadFiles(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestCert(t, dir, "first")
+
+	s := NewCertStore()
+	require.NoError(t, s.LoadFiles(f))
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "first", cert.Leaf.Subject.CommonName)
+	require.False(t, s.changed())
+
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.Cert, future, future))
+	require.True(t, s.changed())
+
+	require.NoError(t, s.Reload())
+	cert, err = s.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	require.False(t, s.changed())
+}
+
+func TestCertStoreChangedContent(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestCert(t, dir, "first")
+
+	s := NewCertStore()
+	require.NoError(t, s.LoadFiles(f))
+	fi, err := os.Stat(f.Cert)
+	require.NoError(t, err)
+
+	// a replacement with the same modification time is still noticed
+	writeTestCert(t, dir, "second")
+	require.NoError(t, os.Chtimes(f.Cert, fi.ModTime(), fi.ModTime()))
+	require.NoError(t, os.Chtimes(f.Key, fi.ModTime(), fi.ModTime()))
+	require.True(t, s.changed())
+}
+
+func TestCertStoreReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestCert(t, dir, "first")
+
+	s := NewCertStore()
+	require.NoError(t, s.LoadFiles(f))
+	reloaded, err := s.ReloadIfChanged()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.Cert, future, future))
+
+	reloaded, err = s.ReloadIfChanged()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "second", cert.Leaf.Subject.CommonName)
+}
+
+func TestCertStoreReloadFailureKeepsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestCert(t, dir, "first")
+
+	s := NewCertStore()
+	require.NoError(t, s.LoadFiles(f))
+	require.NoError(t, os.WriteFile(f.Key, []byte("broken"), 0600))
+	require.Error(t, s.Reload())
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "first", cert.Leaf.Subject.CommonName)
+}
+
+func TestCertStoreReloadNoFiles(t *testing.T) {
+	require.NoError(t, NewCertStore().Reload())
+}
+
+func TestCertStoreWatch(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestCert(t, dir, "first")
+
+	s := NewCertStore()
+	require.NoError(t, s.LoadFiles(f))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(10*time.Millisecond, logger, stop)
+
+	writeTestCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(f.Cert, future, future))
+
+	require.Eventually(t, func() bool {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+		return err == nil && cert.Leaf.Subject.CommonName == "second"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCertStoreTLSConfig(t *testing.T) {
+	s := NewCertStore()
+	base := &tls.Config{MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{{}}}
+
+	c := s.TLSConfig(base)
+	require.Nil(t, c.Certificates)
+	require.NotNil(t, c.GetCertificate)
+	require.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+	require.Len(t, base.Certificates, 1)
+
+	require.NotNil(t, s.TLSConfig(nil).GetCertificate)
+}
+
+func TestTCPCertStoreHotReload(t *testing.T) {
+	s := NewCertStore()
+	require.NoError(t, s.Set(newTestKeyPair(t, "first")))
+
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", TLSConfig: s.TLSConfig(nil)})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	go l.Serve(func(id string, c net.Conn) error {
+		_ = c.(*tls.Conn).Handshake()
+		<-time.After(time.Second)
+		return c.Close()
+	})
+
+	dial := func() string {
+		c, err := tls.Dial("tcp", l.Address(), &tls.Config{InsecureSkipVerify: true}) // #nosec G402 -- self-signed test certificate
+		require.NoError(t, err)
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	require.Equal(t, "first", dial())
+	require.NoError(t, s.Set(newTestKeyPair(t, "second")))
+	require.Equal(t, "second", dial())
+}
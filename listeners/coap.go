@@ -0,0 +1,956 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const TypeCoAP = "coap"
+
+const (
+	defaultCoAPPrefix       = "ps"              // the Uri-Path before topic names
+	coapAckTimeout          = 2 * time.Second   // ACK_TIMEOUT, the initial wait for a confirmable notification to be acknowledged
+	coapMaxRetransmit       = 4                 // MAX_RETRANSMIT, the times a confirmable notification is resent
+	coapExchangeLifetime    = 247 * time.Second // EXCHANGE_LIFETIME, how long request message ids are kept to detect duplicates
+	coapRecentNotifications = 16                // message ids of each observation kept to match resets to notifications
+
+	defaultCoAPMaxRequests         = 64    // requests handled at once by a listener
+	defaultCoAPMaxAddressRequests  = 4     // requests handled at once for a client address
+	defaultCoAPMaxExchanges        = 16384 // recent requests remembered by a listener
+	defaultCoAPMaxAddressExchanges = 512   // recent requests remembered for a client address
+	defaultCoAPMaxObservers        = 1024  // observations held by a listener
+	defaultCoAPMaxAddressObservers = 16    // observations held for a client address
+)
+
+// coapContentFormats are the media types of the CoAP content formats which are mapped to
+// and from the content type property of messages.
+var coapContentFormats = map[uint32]string{
+	0:  "text/plain;charset=utf-8",
+	40: "application/link-format",
+	41: "application/xml",
+	42: "application/octet-stream",
+	47: "application/exi",
+	50: "application/json",
+	60: "application/cbor",
+}
+
+// CoAPConfig contains configuration values specific to CoAP gateway listeners.
+type CoAPConfig struct {
+	Prefix                    string `yaml:"prefix" json:"prefix"`                                           // the Uri-Path before topic names, default ps
+	MaxRequests               int    `yaml:"max_requests" json:"max_requests"`                               // requests handled at once, default 64
+	MaxAddressRequests        int    `yaml:"max_address_requests" json:"max_address_requests"`               // requests handled at once for a client address, default 4
+	MaxExchanges              int    `yaml:"max_exchanges" json:"max_exchanges"`                             // recent requests remembered to detect duplicates, default 16384
+	MaxAddressExchanges       int    `yaml:"max_address_exchanges" json:"max_address_exchanges"`             // recent requests remembered for a client address, default 512
+	MaxObservers              int    `yaml:"max_observers" json:"max_observers"`                             // observations held at once, default 1024
+	MaxAddressObservers       int    `yaml:"max_address_observers" json:"max_address_observers"`             // observations held at once for a client address, default 16
+	AllowPlaintextCredentials bool   `yaml:"allow_plaintext_credentials" json:"allow_plaintext_credentials"` // accept the username and password Uri-Query parameters, which are sent in the clear
+}
+
+// CoAP is a CoAP (RFC 7252) gateway listener. Each request is made as an MQTT v5 client of
+// the server, authenticated with the client_id, username and password Uri-Query parameters,
+// so the server hooks authenticate requests and check their ACLs as for any other client.
+// DTLS is not supported, so credentials would be sent in the clear, and requests carrying
+// them are refused unless AllowPlaintextCredentials is set.
+// PUT or POST {prefix}/{topic} publishes the payload, GET {prefix}/{topic} returns the
+// retained message of a topic, and GET {prefix}/{filter} with the Observe option (RFC 7641)
+// subscribes, sending matching messages as notifications until the observation is cancelled.
+type CoAP struct {
+	sync.RWMutex
+	id            string                   // the internal id of the listener
+	address       string                   // the network address to bind to
+	config        Config                   // configuration values for the listener
+	conn          net.PacketConn           // the udp socket of the gateway
+	log           *slog.Logger             // server logger
+	establish     EstablishFn              // the server's establish connection handler
+	acl           ACLCheckFn               // the server's publish acl check
+	ackTimeout    time.Duration            // the initial wait for a confirmable notification to be acknowledged
+	mu            sync.Mutex               // protects exchanges, pruned, observers, notifications and the counts
+	exchanges     map[string]*coapExchange // recent requests by client address and message id
+	pruned        time.Time                // when expired exchanges were last removed
+	observers     map[string]*coapObserver // observations by client address and token
+	requests      int                      // requests being handled
+	counts        map[string]*coapCounts   // requests, exchanges and observations by client address
+	notifications map[string]*coapObserver // observations by client address and the message ids of their recent notifications
+	mid           uint32                   // the last message id sent by the gateway
+	done          chan struct{}            // closed when the listener is closed
+	end           uint32                   // ensure the close methods are only called once
+}
+
+// coapExchange is a request received from a client.
+type coapExchange struct {
+	addr     string    // the address of the client
+	received time.Time // when the request was first received
+	response []byte    // the response to a confirmable request, resent for duplicates
+}
+
+// coapCounts are the requests, exchanges and observations of a client address.
+type coapCounts struct {
+	requests  int
+	exchanges int
+	observers int
+}
+
+// NewCoAP initializes and returns a new CoAP gateway listener, listening on an address.
+func NewCoAP(config Config) *CoAP {
+	if config.CoAP == nil {
+		config.CoAP = new(CoAPConfig)
+	}
+
+	return &CoAP{
+		id:            config.ID,
+		address:       config.Address,
+		config:        config,
+		ackTimeout:    coapAckTimeout,
+		exchanges:     map[string]*coapExchange{},
+		observers:     map[string]*coapObserver{},
+		counts:        map[string]*coapCounts{},
+		notifications: map[string]*coapObserver{},
+		mid:           rand.Uint32(), // message ids should start unpredictably
+		done:          make(chan struct{}),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *CoAP) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *CoAP) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *CoAP) Protocol() string {
+	return "coap"
+}
+
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *CoAP) Policy() *Policy {
+	return l.config.Policy
+}
+
+// prefix returns the Uri-Path segments before topic names.
+func (l *CoAP) prefix() []string {
+	p := strings.Trim(l.config.CoAP.Prefix, "/")
+	if p == "" {
+		p = defaultCoAPPrefix
+	}
+
+	return strings.Split(p, "/")
+}
+
+// coapLimit returns a configured limit, or its default if not set.
+func coapLimit(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+
+	return v
+}
+
+// Init initializes the listener.
+func (l *CoAP) Init(log *slog.Logger) error {
+	l.log = log
+
+	conn, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return err
+	}
+
+	l.conn = conn
+	return nil
+}
+
+// SetACLCheck sets the function used to check qos 0 publishes before they are sent
+// to the server, which does not acknowledge them.
+func (l *CoAP) SetACLCheck(fn ACLCheckFn) {
+	l.acl = fn
+}
+
+// Serve starts receiving CoAP requests.
+func (l *CoAP) Serve(establish EstablishFn) {
+	if atomic.LoadUint32(&l.end) == 1 {
+		return
+	}
+
+	l.establish = establish
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			l.receive(addr, append([]byte{}, buf[:n]...))
+		}
+	}
+}
+
+// receive handles a datagram received from a client.
+func (l *CoAP) receive(addr net.Addr, b []byte) {
+	m, err := decodeCoAP(b)
+	if err != nil {
+		l.log.Debug("invalid coap message", "remote", addr.String(), "error", err)
+		if len(b) >= 4 && b[0]>>4&0x03 == coapConfirmable {
+			l.send(addr, coapMessage{Type: coapReset, MessageID: uint16(b[2])<<8 | uint16(b[3])})
+		}
+		return
+	}
+
+	switch {
+	case m.Type == coapAcknowledgment || m.Type == coapReset:
+		l.acknowledged(addr, m)
+		return
+	case m.Code == coapEmpty || m.Code>>5 != 0: // pings, and responses which weren't requested
+		if m.Type == coapConfirmable {
+			l.send(addr, coapMessage{Type: coapReset, MessageID: m.MessageID})
+		}
+		return
+	}
+
+	key := addr.String() + "#" + strconv.Itoa(int(m.MessageID))
+	ok, refused := l.admit(addr, key)
+	if !ok {
+		return // a duplicate
+	}
+
+	if refused != 0 {
+		l.respond(addr, key, m, coapError(refused, "too many requests"))
+		return
+	}
+
+	go l.request(addr, key, m)
+}
+
+// admit records a request by its key and reserves a slot to handle it, returning false
+// if it is a duplicate of a recent request, in which case the response to a confirmable
+// request is sent again. A request which would exceed the requests or exchanges held
+// for the listener or the client address is not recorded, and is refused with the
+// returned response code.
+func (l *CoAP) admit(addr net.Addr, key string) (ok bool, refused byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) > time.Second {
+		l.prune(now)
+	}
+
+	if e, ok := l.exchanges[key]; ok {
+		if e.response != nil {
+			l.write(addr, e.response)
+		}
+		return false, 0
+	}
+
+	host := addr.String()
+	c := l.counts[host]
+	if c == nil {
+		c = new(coapCounts)
+	}
+
+	if c.exchanges >= coapLimit(l.config.CoAP.MaxAddressExchanges, defaultCoAPMaxAddressExchanges) ||
+		len(l.exchanges) >= coapLimit(l.config.CoAP.MaxExchanges, defaultCoAPMaxExchanges) {
+		l.prune(now)
+	}
+
+	switch {
+	case c.requests >= coapLimit(l.config.CoAP.MaxAddressRequests, defaultCoAPMaxAddressRequests),
+		c.exchanges >= coapLimit(l.config.CoAP.MaxAddressExchanges, defaultCoAPMaxAddressExchanges):
+		return true, coapTooManyRequests
+	case l.requests >= coapLimit(l.config.CoAP.MaxRequests, defaultCoAPMaxRequests),
+		len(l.exchanges) >= coapLimit(l.config.CoAP.MaxExchanges, defaultCoAPMaxExchanges):
+		return true, coapServiceUnavailable
+	}
+
+	l.exchanges[key] = &coapExchange{addr: host, received: now}
+	l.counts[host] = c
+	c.exchanges++
+	c.requests++
+	l.requests++
+
+	return true, 0
+}
+
+// prune removes expired exchanges. The lock must be held.
+func (l *CoAP) prune(now time.Time) {
+	for k, e := range l.exchanges {
+		if now.Sub(e.received) > coapExchangeLifetime {
+			delete(l.exchanges, k)
+			l.count(e.addr, func(c *coapCounts) { c.exchanges-- })
+		}
+	}
+	l.pruned = now
+}
+
+// count updates the counts of a client address, forgetting the address once it has no
+// requests, exchanges or observations. The lock must be held.
+func (l *CoAP) count(host string, update func(c *coapCounts)) {
+	c, ok := l.counts[host]
+	if !ok {
+		return
+	}
+
+	update(c)
+	if c.requests <= 0 && c.exchanges <= 0 && c.observers <= 0 {
+		delete(l.counts, host)
+	}
+}
+
+// request responds to a request, releasing its slot once the response has been sent.
+func (l *CoAP) request(addr net.Addr, key string, m coapMessage) {
+	defer func() {
+		l.mu.Lock()
+		l.requests--
+		l.count(addr.String(), func(c *coapCounts) { c.requests-- })
+		l.mu.Unlock()
+	}()
+
+	resp, after := l.handle(addr, m)
+	l.respond(addr, key, m, resp)
+	if after != nil {
+		after()
+	}
+}
+
+// respond sends the response to a request. Confirmable requests are answered with a
+// piggybacked response in the acknowledgement, which is kept to be resent for duplicates.
+func (l *CoAP) respond(addr net.Addr, key string, m coapMessage, resp coapMessage) {
+	resp.Token = m.Token
+	if m.Type == coapConfirmable {
+		resp.Type = coapAcknowledgment
+		resp.MessageID = m.MessageID
+	} else {
+		resp.Type = coapNonConfirmable
+		resp.MessageID = l.nextMessageID()
+	}
+
+	b := resp.Encode()
+	if m.Type == coapConfirmable {
+		l.mu.Lock()
+		if e, ok := l.exchanges[key]; ok {
+			e.response = b
+		}
+		l.mu.Unlock()
+	}
+
+	l.write(addr, b)
+}
+
+// handle returns the response to a request, and an optional function to call once the
+// response has been sent.
+func (l *CoAP) handle(addr net.Addr, m coapMessage) (coapMessage, func()) {
+	if n, ok := m.unsupportedOption(); ok {
+		return coapError(coapBadOption, fmt.Sprintf("unsupported option %d", n)), nil
+	}
+
+	path := m.path()
+	if len(path) == 2 && path[0] == ".well-known" && path[1] == "core" && m.Code == coapGET {
+		return l.discovery(), nil
+	}
+
+	prefix := l.prefix()
+	if len(path) <= len(prefix) || strings.Join(path[:len(prefix)], "/") != strings.Join(prefix, "/") {
+		return coapError(coapNotFound, ""), nil
+	}
+	topic := strings.Join(path[len(prefix):], "/")
+
+	switch m.Code {
+	case coapPUT, coapPOST:
+		return l.publish(addr, m, topic), nil
+	case coapGET:
+		observe, ok := m.uintOption(coapOptionObserve)
+		if ok && observe == coapObserveRegister {
+			return l.observe(addr, m, topic)
+		}
+
+		if ok && observe == coapObserveDeregister {
+			l.cancel(addr, m.Token)
+			if strings.ContainsAny(topic, "+#") {
+				return coapMessage{Code: coapContent}, nil
+			}
+		}
+
+		return l.get(addr, m, topic), nil
+	default:
+		return coapError(coapMethodNotAllowed, ""), nil
+	}
+}
+
+// discovery returns the CoRE link format (RFC 6690) description of the topic resources.
+func (l *CoAP) discovery() coapMessage {
+	resp := coapMessage{
+		Code:    coapContent,
+		Payload: []byte(`</` + strings.Join(l.prefix(), "/") + `>;rt="core.ps";obs`),
+	}
+	resp.addUintOption(coapOptionContentFormat, 40)
+	return resp
+}
+
+// publish publishes the payload of a request to a topic, responding once the server has
+// processed the publish. The qos and retain flag are taken from the qos and retain Uri-Query
+// parameters, the content type from the Content-Format option, and the message expiry
+// interval from the Max-Age option.
+func (l *CoAP) publish(addr net.Addr, m coapMessage, topic string) coapMessage {
+	if !validTopicName(topic) {
+		return l.fail(packets.ErrTopicNameInvalid)
+	}
+
+	q := m.query()
+	qos, err := coapQos(q)
+	if err != nil {
+		return l.fail(err)
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos},
+		TopicName:   topic,
+		Payload:     m.Payload,
+	}
+
+	if qos > 0 {
+		pk.PacketID = gatewayPacketID
+	}
+
+	if v := q.Get("retain"); v != "" {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			return l.fail(fmt.Errorf("%w: invalid retain %q", errCoAPRequest, v))
+		}
+		pk.FixedHeader.Retain = retain
+	}
+
+	if format, ok := m.uintOption(coapOptionContentFormat); ok {
+		pk.Properties.ContentType = coapContentFormats[format]
+	}
+
+	if age, ok := m.uintOption(coapOptionMaxAge); ok {
+		pk.Properties.MessageExpiryInterval = age
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayAckTimeout)
+	defer cancel()
+
+	c, err := l.connect(ctx, addr, q)
+	if err != nil {
+		return l.fail(err)
+	}
+	defer c.close()
+
+	if err := c.publish(ctx, pk); err != nil {
+		return l.fail(err)
+	}
+
+	return coapMessage{Code: coapChanged}
+}
+
+// get responds to a request with the retained message of a topic, or not found.
+func (l *CoAP) get(addr net.Addr, m coapMessage, topic string) coapMessage {
+	if strings.ContainsAny(topic, "+#") {
+		return l.fail(fmt.Errorf("%w: topic filters can only be observed", errCoAPRequest))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayAckTimeout)
+	defer cancel()
+
+	c, err := l.connect(ctx, addr, m.query())
+	if err != nil {
+		return l.fail(err)
+	}
+	defer c.close()
+
+	// the server sends the retained message of a subscription before processing the ping.
+	err = c.subscribe(ctx, topic, 0)
+	if err == nil {
+		err = c.ping(ctx)
+	}
+
+	if err != nil {
+		return l.fail(err)
+	}
+
+	for pk, ok := c.queued(); ok; pk, ok = c.queued() {
+		if pk.FixedHeader.Type == packets.Publish && pk.FixedHeader.Retain {
+			return coapContentMessage(pk)
+		}
+	}
+
+	return coapError(coapNotFound, "")
+}
+
+// observe registers an observation of a topic filter, subscribing at the qos of the qos
+// Uri-Query parameter. Messages received at QoS 0 are sent as non-confirmable notifications,
+// and messages received at QoS 1 and 2 as confirmable notifications, which are acknowledged
+// to the server once the client acknowledges them.
+func (l *CoAP) observe(addr net.Addr, m coapMessage, filter string) (coapMessage, func()) {
+	q := m.query()
+	qos, err := coapQos(q)
+	if err != nil {
+		return l.fail(err), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayAckTimeout)
+	defer cancel()
+
+	c, err := l.connect(ctx, addr, q)
+	if err != nil {
+		return l.fail(err), nil
+	}
+
+	if err := c.subscribe(ctx, filter, qos); err != nil {
+		c.close()
+		return l.fail(err), nil
+	}
+
+	o := &coapObserver{
+		l:      l,
+		addr:   addr,
+		token:  m.Token,
+		key:    addr.String() + "#" + string(m.Token),
+		client: c,
+		acks:   make(chan uint16, 1),
+		done:   make(chan struct{}),
+	}
+
+	host := addr.String()
+	l.mu.Lock()
+	previous := l.observers[o.key]
+	if previous == nil {
+		var refused byte
+		if n := l.counts[host]; n != nil && n.observers >= coapLimit(l.config.CoAP.MaxAddressObservers, defaultCoAPMaxAddressObservers) {
+			refused = coapTooManyRequests
+		} else if len(l.observers) >= coapLimit(l.config.CoAP.MaxObservers, defaultCoAPMaxObservers) {
+			refused = coapServiceUnavailable
+		}
+
+		if refused != 0 {
+			l.mu.Unlock()
+			c.close()
+			return coapError(refused, "too many observations"), nil
+		}
+
+		if l.counts[host] == nil {
+			l.counts[host] = new(coapCounts)
+		}
+		l.counts[host].observers++
+	}
+	l.observers[o.key] = o
+	l.mu.Unlock()
+
+	if previous != nil {
+		previous.cancel() // a registration with the same token replaces the observation
+	}
+
+	resp := coapMessage{Code: coapContent}
+	resp.addUintOption(coapOptionObserve, o.next())
+	return resp, func() {
+		go o.run()
+	}
+}
+
+// cancel cancels the observation of a client address and token, if any.
+func (l *CoAP) cancel(addr net.Addr, token []byte) {
+	l.mu.Lock()
+	o, ok := l.observers[addr.String()+"#"+string(token)]
+	l.mu.Unlock()
+
+	if ok {
+		o.cancel()
+	}
+}
+
+// acknowledged handles an acknowledgement or reset of a notification. A reset cancels
+// the observation of the notification.
+func (l *CoAP) acknowledged(addr net.Addr, m coapMessage) {
+	l.mu.Lock()
+	o, ok := l.notifications[addr.String()+"#"+strconv.Itoa(int(m.MessageID))]
+	l.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if m.Type == coapReset {
+		o.cancel()
+		return
+	}
+
+	select {
+	case o.acks <- m.MessageID:
+	default:
+	}
+}
+
+// connect makes the client connection of a request to the server. The client id is taken
+// from the client_id Uri-Query parameter, or is assigned by the server. Requests with
+// credentials are refused unless plaintext credentials are allowed.
+func (l *CoAP) connect(ctx context.Context, addr net.Addr, q url.Values) (*gatewayClient, error) {
+	if (q.Has("username") || q.Has("password")) && !l.config.CoAP.AllowPlaintextCredentials {
+		return nil, errCoAPPlaintextCredentials
+	}
+
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			ClientIdentifier: q.Get("client_id"),
+		},
+	}
+
+	if q.Has("username") {
+		pk.Connect.UsernameFlag = true
+		pk.Connect.Username = []byte(q.Get("username"))
+	}
+
+	if q.Has("password") {
+		pk.Connect.PasswordFlag = true
+		pk.Connect.Password = []byte(q.Get("password"))
+	}
+
+	return dialGateway(ctx, l.establish, l.acl, l.id, l.conn.LocalAddr(), addr, pk, l.log)
+}
+
+// fail returns the error response of an error.
+func (l *CoAP) fail(err error) coapMessage {
+	var code packets.Code
+	switch {
+	case errors.As(err, &code):
+		return coapError(coapCode(code.Code), code.Reason)
+	case errors.Is(err, errCoAPRequest):
+		return coapError(coapBadRequest, err.Error())
+	case errors.Is(err, errCoAPPlaintextCredentials):
+		return coapError(coapUnauthorized, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return coapError(coapGatewayTimeout, "server timed out")
+	default:
+		return coapError(coapBadGateway, "server connection closed")
+	}
+}
+
+// nextMessageID returns a message id for a message sent by the gateway.
+func (l *CoAP) nextMessageID() uint16 {
+	return uint16(atomic.AddUint32(&l.mid, 1))
+}
+
+// send sends a message to a client.
+func (l *CoAP) send(addr net.Addr, m coapMessage) {
+	l.write(addr, m.Encode())
+}
+
+// write writes an encoded message to a client.
+func (l *CoAP) write(addr net.Addr, b []byte) {
+	if _, err := l.conn.WriteTo(b, addr); err != nil {
+		l.log.Debug("failed to send coap message", "remote", addr.String(), "error", err)
+	}
+}
+
+// Close closes the listener and any client connections, ending any observations.
+func (l *CoAP) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+		closeClients(l.id)
+	}
+
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+
+	l.mu.Lock()
+	observers := make([]*coapObserver, 0, len(l.observers))
+	for _, o := range l.observers {
+		observers = append(observers, o)
+	}
+	l.mu.Unlock()
+
+	for _, o := range observers {
+		o.cancel()
+	}
+}
+
+var (
+	// errCoAPRequest indicates a request had an invalid parameter.
+	errCoAPRequest = errors.New("invalid request")
+
+	// errCoAPPlaintextCredentials indicates a request carried credentials which the listener
+	// does not accept in the clear.
+	errCoAPPlaintextCredentials = errors.New("credentials are not accepted over plain coap")
+)
+
+// coapCodes are the response codes of the reason codes which refuse requests.
+var coapCodes = []struct {
+	code packets.Code
+	coap byte
+}{
+	{packets.ErrBadUsernameOrPassword, coapUnauthorized},
+	{packets.ErrNotAuthorized, coapForbidden},
+	{packets.ErrBanned, coapForbidden},
+	{packets.ErrClientIdentifierNotValid, coapBadRequest},
+	{packets.ErrTopicFilterInvalid, coapBadRequest},
+	{packets.ErrTopicNameInvalid, coapBadRequest},
+	{packets.ErrPayloadFormatInvalid, coapBadRequest},
+	{packets.ErrRetainNotSupported, coapBadRequest},
+	{packets.ErrQosNotSupported, coapBadRequest},
+	{packets.ErrSharedSubscriptionsNotSupported, coapBadRequest},
+	{packets.ErrWildcardSubscriptionsNotSupported, coapBadRequest},
+	{packets.ErrPacketTooLarge, coapRequestEntityTooLarge},
+	{packets.ErrMessageRateTooHigh, coapTooManyRequests},
+	{packets.ErrQuotaExceeded, coapTooManyRequests},
+	{packets.ErrConnectionRateExceeded, coapTooManyRequests},
+	{packets.ErrServerUnavailable, coapServiceUnavailable},
+	{packets.ErrServerBusy, coapServiceUnavailable},
+	{packets.ErrServerShuttingDown, coapServiceUnavailable},
+}
+
+// coapCode returns the response code of a reason code which refused a request.
+func coapCode(code byte) byte {
+	for _, c := range coapCodes {
+		if c.code.Code == code {
+			return c.coap
+		}
+	}
+
+	return coapInternalServerError
+}
+
+// coapError returns an error response with a diagnostic payload.
+func coapError(code byte, diagnostic string) coapMessage {
+	return coapMessage{Code: code, Payload: []byte(diagnostic)}
+}
+
+// coapContentMessage returns a content response or notification carrying a message.
+func coapContentMessage(pk packets.Packet) coapMessage {
+	m := coapMessage{Code: coapContent, Payload: pk.Payload}
+	if format, ok := coapContentFormat(pk.Properties.ContentType); ok {
+		m.addUintOption(coapOptionContentFormat, format)
+	}
+
+	if pk.Properties.MessageExpiryInterval > 0 {
+		m.addUintOption(coapOptionMaxAge, pk.Properties.MessageExpiryInterval)
+	}
+
+	return m
+}
+
+// coapContentFormat returns the content format of a media type, ignoring its parameters.
+func coapContentFormat(contentType string) (uint32, bool) {
+	if contentType == "" {
+		return 0, false
+	}
+
+	base, _, _ := strings.Cut(contentType, ";")
+	for format, t := range coapContentFormats {
+		if t == contentType || strings.HasPrefix(t, base) && (len(t) == len(base) || t[len(base)] == ';') {
+			return format, true
+		}
+	}
+
+	return 0, false
+}
+
+// coapQos returns the qos of the qos Uri-Query parameter.
+func coapQos(q url.Values) (byte, error) {
+	v := q.Get("qos")
+	if v == "" {
+		return 0, nil
+	}
+
+	if len(v) != 1 || v[0] < '0' || v[0] > '2' {
+		return 0, fmt.Errorf("%w: invalid qos %q", errCoAPRequest, v)
+	}
+
+	return v[0] - '0', nil
+}
+
+// coapObserver is an observation of a topic filter by a client.
+type coapObserver struct {
+	l      *CoAP          // the listener
+	addr   net.Addr       // the address of the client
+	token  []byte         // the token of the observe request, sent with each notification
+	key    string         // the client address and token
+	client *gatewayClient // the subscribed client connection to the server
+	seq    uint32         // the observe sequence number of the last notification
+	recent []uint16       // the message ids of recent notifications
+	acks   chan uint16    // the message ids of acknowledged notifications
+	done   chan struct{}  // closed when the observation is cancelled
+	once   sync.Once      // ensures the observation is only cancelled once
+}
+
+// next returns the next observe sequence number, which is 24 bits.
+func (o *coapObserver) next() uint32 {
+	o.seq = (o.seq + 1) & 0xFFFFFF
+	return o.seq
+}
+
+// run sends the messages received by the client as notifications until the observation
+// is cancelled, or the server ends the connection.
+func (o *coapObserver) run() {
+	defer o.remove()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+
+		pk, ok := o.client.queued()
+		if !ok {
+			select {
+			case <-o.done:
+				return
+			case pk, ok = <-o.client.in:
+				if !ok {
+					o.end(coapServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			if !o.notify(pk) {
+				return
+			}
+		case packets.Pubrel:
+			_ = o.client.ack(pk)
+		case packets.Disconnect:
+			o.end(coapCode(pk.ReasonCode))
+			return
+		}
+	}
+}
+
+// notify sends a message to the client, returning false if the client reset or failed to
+// acknowledge a confirmable notification, which ends the observation.
+func (o *coapObserver) notify(pk packets.Packet) bool {
+	m := coapContentMessage(pk)
+	m.Token = o.token
+	m.MessageID = o.l.nextMessageID()
+	m.addUintOption(coapOptionObserve, o.next())
+	o.track(m.MessageID)
+
+	if pk.FixedHeader.Qos == 0 {
+		m.Type = coapNonConfirmable
+		o.l.send(o.addr, m)
+		return true
+	}
+
+	m.Type = coapConfirmable
+	b := m.Encode()
+	timeout := o.l.ackTimeout + time.Duration(rand.Int63n(int64(o.l.ackTimeout/2)+1)) // ACK_RANDOM_FACTOR 1.5
+	for i := 0; i <= coapMaxRetransmit; i++ {
+		o.l.write(o.addr, b)
+		if o.await(m.MessageID, timeout) {
+			_ = o.client.ack(pk)
+			return true
+		}
+
+		select {
+		case <-o.done:
+			return false
+		default:
+		}
+		timeout *= 2
+	}
+
+	return false
+}
+
+// await waits for the acknowledgement of a notification, returning false if it wasn't
+// acknowledged before the timeout or the observation was cancelled.
+func (o *coapObserver) await(mid uint16, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return false
+		case <-timer.C:
+			return false
+		case acked := <-o.acks:
+			if acked == mid {
+				return true
+			}
+		}
+	}
+}
+
+// track records the message id of a notification, so that acknowledgements and resets
+// can be matched to the observation.
+func (o *coapObserver) track(mid uint16) {
+	o.l.mu.Lock()
+	defer o.l.mu.Unlock()
+
+	if len(o.recent) == coapRecentNotifications {
+		delete(o.l.notifications, o.addr.String()+"#"+strconv.Itoa(int(o.recent[0])))
+		o.recent = o.recent[1:]
+	}
+
+	o.recent = append(o.recent, mid)
+	o.l.notifications[o.addr.String()+"#"+strconv.Itoa(int(mid))] = o
+}
+
+// end sends a final notification with an error code, which tells the client that the
+// observation has ended.
+func (o *coapObserver) end(code byte) {
+	o.l.send(o.addr, coapMessage{
+		Type:      coapNonConfirmable,
+		Code:      code,
+		MessageID: o.l.nextMessageID(),
+		Token:     o.token,
+	})
+}
+
+// cancel cancels the observation.
+func (o *coapObserver) cancel() {
+	o.once.Do(func() {
+		close(o.done)
+	})
+}
+
+// remove disconnects the client of a finished observation and forgets it.
+func (o *coapObserver) remove() {
+	o.cancel()
+	o.client.close()
+
+	o.l.mu.Lock()
+	defer o.l.mu.Unlock()
+
+	if o.l.observers[o.key] == o {
+		delete(o.l.observers, o.key)
+		o.l.count(o.addr.String(), func(c *coapCounts) { c.observers-- })
+	}
+
+	for _, mid := range o.recent {
+		delete(o.l.notifications, o.addr.String()+"#"+strconv.Itoa(int(mid)))
+	}
+}
@@ -0,0 +1,291 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// CoAP (RFC 7252) message types.
+const (
+	coapConfirmable    byte = 0
+	coapNonConfirmable byte = 1
+	coapAcknowledgment byte = 2
+	coapReset          byte = 3
+)
+
+// CoAP method and response codes, as class << 5 | detail.
+const (
+	coapEmpty                 byte = 0x00 // 0.00
+	coapGET                   byte = 0x01 // 0.01
+	coapPOST                  byte = 0x02 // 0.02
+	coapPUT                   byte = 0x03 // 0.03
+	coapDELETE                byte = 0x04 // 0.04
+	coapChanged               byte = 0x44 // 2.04
+	coapContent               byte = 0x45 // 2.05
+	coapBadRequest            byte = 0x80 // 4.00
+	coapUnauthorized          byte = 0x81 // 4.01
+	coapBadOption             byte = 0x82 // 4.02
+	coapForbidden             byte = 0x83 // 4.03
+	coapNotFound              byte = 0x84 // 4.04
+	coapMethodNotAllowed      byte = 0x85 // 4.05
+	coapRequestEntityTooLarge byte = 0x8D // 4.13
+	coapTooManyRequests       byte = 0x9D // 4.29, RFC 8516
+	coapInternalServerError   byte = 0xA0 // 5.00
+	coapBadGateway            byte = 0xA2 // 5.02
+	coapServiceUnavailable    byte = 0xA3 // 5.03
+	coapGatewayTimeout        byte = 0xA4 // 5.04
+)
+
+const (
+	coapVersion           byte   = 1    // the protocol version of every message
+	coapPayloadMarker     byte   = 0xFF // separates the options from the payload
+	coapMaxTokenLength           = 8    // bytes allowed in a token
+	coapObserveRegister   uint32 = 0    // the observe option value of a request which registers an observation
+	coapObserveDeregister uint32 = 1    // the observe option value of a request which cancels an observation
+)
+
+// CoAP option numbers.
+const (
+	coapOptionURIHost       uint16 = 3
+	coapOptionObserve       uint16 = 6 // RFC 7641
+	coapOptionURIPort       uint16 = 7
+	coapOptionURIPath       uint16 = 11
+	coapOptionContentFormat uint16 = 12
+	coapOptionMaxAge        uint16 = 14
+	coapOptionURIQuery      uint16 = 15
+	coapOptionAccept        uint16 = 17
+)
+
+var (
+	// ErrCoAPMalformed indicates that a CoAP message could not be decoded.
+	ErrCoAPMalformed = errors.New("malformed coap message")
+)
+
+// coapOption is an option of a CoAP message.
+type coapOption struct {
+	Number uint16 // the option number
+	Value  []byte // the option value
+}
+
+// coapMessage is a CoAP message.
+type coapMessage struct {
+	Type      byte         // the message type
+	Code      byte         // the method or response code
+	MessageID uint16       // the message id, for deduplication and matching acknowledgements
+	Token     []byte       // the token which matches responses to requests
+	Options   []coapOption // the options, in the order received
+	Payload   []byte       // the payload
+}
+
+// Encode returns the encoded bytes of a message. Options are sorted by option number, as
+// their deltas require.
+func (m *coapMessage) Encode() []byte {
+	b := []byte{coapVersion<<6 | m.Type<<4 | byte(len(m.Token)), m.Code, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], m.MessageID)
+	b = append(b, m.Token...)
+
+	options := append([]coapOption{}, m.Options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+
+	var prev uint16
+	for _, o := range options {
+		delta, deltaExt := coapOptionNibble(int(o.Number - prev))
+		length, lengthExt := coapOptionNibble(len(o.Value))
+		b = append(b, delta<<4|length)
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, o.Value...)
+		prev = o.Number
+	}
+
+	if len(m.Payload) > 0 {
+		b = append(b, coapPayloadMarker)
+		b = append(b, m.Payload...)
+	}
+
+	return b
+}
+
+// coapOptionNibble returns the 4 bit value and extended bytes of an option delta or length.
+func coapOptionNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// decodeCoAP decodes a CoAP message from a datagram.
+func decodeCoAP(b []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(b) < 4 || b[0]>>6 != coapVersion {
+		return m, ErrCoAPMalformed
+	}
+
+	m.Type = b[0] >> 4 & 0x03
+	m.Code = b[1]
+	m.MessageID = binary.BigEndian.Uint16(b[2:])
+
+	tkl := int(b[0] & 0x0F)
+	if tkl > coapMaxTokenLength || len(b) < 4+tkl {
+		return m, ErrCoAPMalformed
+	}
+	m.Token = append([]byte{}, b[4:4+tkl]...)
+	b = b[4+tkl:]
+
+	var number int
+	for len(b) > 0 {
+		if b[0] == coapPayloadMarker {
+			if len(b) == 1 {
+				return m, ErrCoAPMalformed // a marker followed by a zero-length payload
+			}
+			m.Payload = append([]byte{}, b[1:]...)
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+
+		var ok bool
+		if delta, b, ok = coapOptionExtended(delta, b); !ok {
+			return m, ErrCoAPMalformed
+		}
+
+		if length, b, ok = coapOptionExtended(length, b); !ok {
+			return m, ErrCoAPMalformed
+		}
+
+		number += delta
+		if len(b) < length || number > 0xFFFF {
+			return m, ErrCoAPMalformed
+		}
+
+		m.Options = append(m.Options, coapOption{Number: uint16(number), Value: append([]byte{}, b[:length]...)})
+		b = b[length:]
+	}
+
+	if m.Code == coapEmpty && (len(m.Token) > 0 || len(m.Options) > 0 || len(m.Payload) > 0) {
+		return m, ErrCoAPMalformed // empty messages are only a header
+	}
+
+	return m, nil
+}
+
+// coapOptionExtended returns the value of an option delta or length nibble, reading any
+// extended bytes it has from b.
+func coapOptionExtended(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, b, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, b, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, b, false // reserved for the payload marker
+	default:
+		return v, b, true
+	}
+}
+
+// option returns the value of the first option with a number, and whether it was present.
+func (m *coapMessage) option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// uintOption returns the value of a uint option, and whether it was present.
+func (m *coapMessage) uintOption(number uint16) (uint32, bool) {
+	v, ok := m.option(number)
+	if !ok {
+		return 0, false
+	}
+
+	var n uint32
+	for _, b := range v {
+		n = n<<8 | uint32(b)
+	}
+
+	return n, true
+}
+
+// addOption adds an option to a message.
+func (m *coapMessage) addOption(number uint16, value []byte) {
+	m.Options = append(m.Options, coapOption{Number: number, Value: value})
+}
+
+// addUintOption adds a uint option to a message, with the fewest bytes for its value.
+func (m *coapMessage) addUintOption(number uint16, n uint32) {
+	var v []byte
+	for ; n > 0; n >>= 8 {
+		v = append([]byte{byte(n)}, v...)
+	}
+
+	m.addOption(number, v)
+}
+
+// path returns the Uri-Path segments of a request.
+func (m *coapMessage) path() []string {
+	var path []string
+	for _, o := range m.Options {
+		if o.Number == coapOptionURIPath {
+			path = append(path, string(o.Value))
+		}
+	}
+
+	return path
+}
+
+// query returns the Uri-Query parameters of a request.
+func (m *coapMessage) query() url.Values {
+	q := url.Values{}
+	for _, o := range m.Options {
+		if o.Number == coapOptionURIQuery {
+			key, val, _ := strings.Cut(string(o.Value), "=")
+			q.Add(key, val)
+		}
+	}
+
+	return q
+}
+
+// unsupportedOption returns the number of the first critical option of a request which
+// the gateway doesn't understand, if any. Critical options have odd numbers.
+func (m *coapMessage) unsupportedOption() (uint16, bool) {
+	for _, o := range m.Options {
+		if o.Number%2 == 0 {
+			continue
+		}
+
+		switch o.Number {
+		case coapOptionURIHost, coapOptionURIPort, coapOptionURIPath, coapOptionURIQuery, coapOptionAccept:
+		default:
+			return o.Number, true
+		}
+	}
+
+	return 0, false
+}
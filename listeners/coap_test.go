@@ -0,0 +1,596 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoAPMessageEncodeDecode(t *testing.T) {
+	tt := []coapMessage{
+		{Type: coapConfirmable, Code: coapEmpty, MessageID: 1},
+		{Type: coapReset, Code: coapEmpty, MessageID: 0xFFFF},
+		{Type: coapNonConfirmable, Code: coapGET, MessageID: 2, Token: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{
+			Type:      coapConfirmable,
+			Code:      coapPUT,
+			MessageID: 3,
+			Token:     []byte{9},
+			Options: []coapOption{
+				{Number: coapOptionObserve, Value: []byte{}},
+				{Number: coapOptionURIPath, Value: []byte("ps")},
+				{Number: coapOptionURIPath, Value: bytes.Repeat([]byte("a"), 20)},   // one byte extended length
+				{Number: coapOptionURIQuery, Value: bytes.Repeat([]byte("q"), 300)}, // two byte extended length
+				{Number: 60, Value: []byte{1}},                                      // one byte extended delta
+				{Number: 2048, Value: []byte{2}},                                    // two byte extended delta
+			},
+			Payload: []byte("21.5"),
+		},
+		{Type: coapAcknowledgment, Code: coapContent, MessageID: 4, Token: []byte{}, Payload: []byte{0xFF}},
+	}
+
+	for _, m := range tt {
+		got, err := decodeCoAP(m.Encode())
+		require.NoError(t, err)
+		if m.Token == nil && len(got.Token) == 0 {
+			got.Token = nil
+		}
+		require.Equal(t, m, got)
+	}
+}
+
+func TestCoAPMessageEncodeSortsOptions(t *testing.T) {
+	m := coapMessage{Code: coapContent}
+	m.addUintOption(coapOptionMaxAge, 60)
+	m.addUintOption(coapOptionObserve, 1)
+
+	got, err := decodeCoAP(m.Encode())
+	require.NoError(t, err)
+	require.Equal(t, coapOptionObserve, got.Options[0].Number)
+	require.Equal(t, coapOptionMaxAge, got.Options[1].Number)
+}
+
+func TestDecodeCoAPMalformed(t *testing.T) {
+	tt := [][]byte{
+		{},
+		{0x40, 0x01, 0x00},                   // short header
+		{0x80, 0x01, 0x00, 0x01},             // version 2
+		{0x49, 0x01, 0x00, 0x01},             // token length 9
+		{0x42, 0x01, 0x00, 0x01, 0x01},       // short token
+		{0x40, 0x01, 0x00, 0x01, 0xB5, 'p'},  // short option value
+		{0x40, 0x01, 0x00, 0x01, 0xD1},       // short extended delta
+		{0x40, 0x01, 0x00, 0x01, 0x1E, 0x00}, // short extended length
+		{0x40, 0x01, 0x00, 0x01, 0xF0},       // reserved delta
+		{0x40, 0x01, 0x00, 0x01, 0xFF},       // payload marker without payload
+		{0x41, 0x00, 0x00, 0x01, 0x01},       // empty message with a token
+	}
+
+	for _, b := range tt {
+		_, err := decodeCoAP(b)
+		require.ErrorIs(t, err, ErrCoAPMalformed, "%v", b)
+	}
+}
+
+func TestCoAPMessageOptions(t *testing.T) {
+	m := coapMessage{}
+	m.addOption(coapOptionURIPath, []byte("ps"))
+	m.addOption(coapOptionURIPath, []byte("a"))
+	m.addOption(coapOptionURIQuery, []byte("qos=1"))
+	m.addOption(coapOptionURIQuery, []byte("retain"))
+	m.addUintOption(coapOptionObserve, 0)
+	m.addUintOption(coapOptionMaxAge, 0x010203)
+
+	require.Equal(t, []string{"ps", "a"}, m.path())
+	require.Equal(t, "1", m.query().Get("qos"))
+	require.True(t, m.query().Has("retain"))
+
+	v, ok := m.option(coapOptionObserve)
+	require.True(t, ok)
+	require.Empty(t, v)
+
+	n, ok := m.uintOption(coapOptionMaxAge)
+	require.True(t, ok)
+	require.Equal(t, uint32(0x010203), n)
+
+	_, ok = m.uintOption(coapOptionContentFormat)
+	require.False(t, ok)
+
+	_, ok = m.unsupportedOption()
+	require.False(t, ok)
+
+	m.addOption(35, []byte("coap://proxied")) // Proxy-Uri
+	n16, ok := m.unsupportedOption()
+	require.True(t, ok)
+	require.Equal(t, uint16(35), n16)
+}
+
+func TestNewCoAP(t *testing.T) {
+	l := NewCoAP(Config{ID: "c1", Address: testAddr})
+	require.Equal(t, "c1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "coap", l.Protocol())
+	require.Nil(t, l.Policy())
+	require.NotNil(t, l.config.CoAP)
+	require.Equal(t, []string{"ps"}, l.prefix())
+
+	l = NewCoAP(Config{CoAP: &CoAPConfig{Prefix: "/api/ps/"}})
+	require.Equal(t, []string{"api", "ps"}, l.prefix())
+}
+
+func TestCoAPCode(t *testing.T) {
+	require.Equal(t, coapUnauthorized, coapCode(packets.ErrBadUsernameOrPassword.Code))
+	require.Equal(t, coapForbidden, coapCode(packets.ErrNotAuthorized.Code))
+	require.Equal(t, coapTooManyRequests, coapCode(packets.ErrQuotaExceeded.Code))
+	require.Equal(t, coapServiceUnavailable, coapCode(packets.ErrServerShuttingDown.Code))
+	require.Equal(t, coapInternalServerError, coapCode(packets.ErrUnspecifiedError.Code))
+}
+
+func TestCoAPContentFormat(t *testing.T) {
+	tt := map[string]uint32{
+		"text/plain":               0,
+		"text/plain;charset=utf-8": 0,
+		"application/json":         50,
+		"application/cbor":         60,
+	}
+
+	for contentType, want := range tt {
+		format, ok := coapContentFormat(contentType)
+		require.True(t, ok, contentType)
+		require.Equal(t, want, format)
+	}
+
+	for _, contentType := range []string{"", "text/html", "application/js"} {
+		_, ok := coapContentFormat(contentType)
+		require.False(t, ok, contentType)
+	}
+}
+
+func TestCoAPContentMessage(t *testing.T) {
+	m := coapContentMessage(packets.Packet{
+		Payload:    []byte("{}"),
+		Properties: packets.Properties{ContentType: "application/json", MessageExpiryInterval: 60},
+	})
+	require.Equal(t, coapContent, m.Code)
+	require.Equal(t, []byte("{}"), m.Payload)
+
+	format, _ := m.uintOption(coapOptionContentFormat)
+	require.Equal(t, uint32(50), format)
+	age, _ := m.uintOption(coapOptionMaxAge)
+	require.Equal(t, uint32(60), age)
+}
+
+// serveCoAP serves a CoAP listener on a loopback port, returning a udp client connected to it.
+func serveCoAP(t *testing.T, establish EstablishFn) (*CoAP, *net.UDPConn) {
+	return serveCoAPConfig(t, nil, establish)
+}
+
+// serveCoAPConfig serves a CoAP listener with a config on a loopback port, returning a udp
+// client connected to it.
+func serveCoAPConfig(t *testing.T, config *CoAPConfig, establish EstablishFn) (*CoAP, *net.UDPConn) {
+	l := NewCoAP(Config{ID: "c1", Address: "127.0.0.1:0", CoAP: config})
+	require.NoError(t, l.Init(logger))
+	go l.Serve(establish)
+	t.Cleanup(func() { l.Close(MockCloser) })
+
+	return l, dialCoAP(t, l)
+}
+
+// dialCoAP returns a new udp client connected to a listener.
+func dialCoAP(t *testing.T, l *CoAP) *net.UDPConn {
+	addr, err := net.ResolveUDPAddr("udp", l.Address())
+	require.NoError(t, err)
+	c, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c
+}
+
+// readCoAP reads a CoAP message from a udp connection.
+func readCoAP(t *testing.T, c net.Conn) coapMessage {
+	buf := make([]byte, 1024)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+
+	m, err := decodeCoAP(buf[:n])
+	require.NoError(t, err)
+	return m
+}
+
+// coapRequest returns a confirmable request for a path.
+func coapRequest(code byte, mid uint16, path ...string) coapMessage {
+	m := coapMessage{Type: coapConfirmable, Code: code, MessageID: mid, Token: []byte{0x7}}
+	for _, p := range path {
+		m.addOption(coapOptionURIPath, []byte(p))
+	}
+	return m
+}
+
+func TestCoAPPing(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	_, err := c.Write((&coapMessage{Type: coapConfirmable, MessageID: 7}).Encode())
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapReset, m.Type)
+	require.Equal(t, uint16(7), m.MessageID)
+}
+
+func TestCoAPMalformedConfirmableReset(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	_, err := c.Write([]byte{0x40, 0x01, 0x00, 0x09, 0xF0})
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapReset, m.Type)
+	require.Equal(t, uint16(9), m.MessageID)
+}
+
+func TestCoAPRequestErrors(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	proxy := coapRequest(coapGET, 4, "ps", "a")
+	proxy.addOption(35, []byte("coap://proxied"))
+
+	tt := []struct {
+		desc string
+		m    coapMessage
+		code byte
+	}{
+		{desc: "no topic", m: coapRequest(coapGET, 1, "ps"), code: coapNotFound},
+		{desc: "other prefix", m: coapRequest(coapGET, 2, "other", "a"), code: coapNotFound},
+		{desc: "delete", m: coapRequest(coapDELETE, 3, "ps", "a"), code: coapMethodNotAllowed},
+		{desc: "unsupported option", m: proxy, code: coapBadOption},
+		{desc: "publish wildcard", m: coapRequest(coapPUT, 5, "ps", "a", "+"), code: coapBadRequest},
+		{desc: "get wildcard", m: coapRequest(coapGET, 6, "ps", "a", "#"), code: coapBadRequest},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			_, err := c.Write(tx.m.Encode())
+			require.NoError(t, err)
+
+			m := readCoAP(t, c)
+			require.Equal(t, coapAcknowledgment, m.Type)
+			require.Equal(t, tx.m.MessageID, m.MessageID)
+			require.Equal(t, tx.m.Token, m.Token)
+			require.Equal(t, tx.code, m.Code)
+		})
+	}
+}
+
+func TestCoAPNonConfirmableRequest(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	req := coapRequest(coapGET, 1, "ps")
+	req.Type = coapNonConfirmable
+	_, err := c.Write(req.Encode())
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapNonConfirmable, m.Type)
+	require.Equal(t, req.Token, m.Token)
+	require.Equal(t, coapNotFound, m.Code)
+}
+
+func TestCoAPDuplicateRequest(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	req := coapRequest(coapGET, 11, "ps")
+	_, err := c.Write(req.Encode())
+	require.NoError(t, err)
+	first := readCoAP(t, c)
+
+	_, err = c.Write(req.Encode())
+	require.NoError(t, err)
+	require.Equal(t, first, readCoAP(t, c))
+}
+
+func TestCoAPDiscovery(t *testing.T) {
+	_, c := serveCoAP(t, MockEstablisher)
+
+	req := coapRequest(coapGET, 1, ".well-known", "core")
+	_, err := c.Write(req.Encode())
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapContent, m.Code)
+	require.Equal(t, `</ps>;rt="core.ps";obs`, string(m.Payload))
+	format, _ := m.uintOption(coapOptionContentFormat)
+	require.Equal(t, uint32(40), format)
+}
+
+func TestCoAPEstablish(t *testing.T) {
+	type established struct {
+		remote net.Addr
+		pk     packets.Packet
+	}
+
+	conns := make(chan established, 1)
+	_, c := serveCoAPConfig(t, &CoAPConfig{AllowPlaintextCredentials: true}, func(id string, conn net.Conn) error {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		hb, _ := r.ReadByte()
+		pk := packets.Packet{ProtocolVersion: 5}
+		_ = pk.FixedHeader.Decode(hb)
+		n, _, _ := packets.DecodeLength(r)
+		buf := make([]byte, n)
+		_, _ = io.ReadFull(r, buf)
+		_ = pk.ConnectDecode(buf)
+		conns <- established{remote: conn.RemoteAddr(), pk: pk}
+		return nil
+	})
+
+	req := coapRequest(coapPOST, 1, "ps", "a")
+	req.addOption(coapOptionURIQuery, []byte("client_id=sensor1"))
+	req.addOption(coapOptionURIQuery, []byte("username=alice"))
+	req.addOption(coapOptionURIQuery, []byte("password=secret"))
+	req.Payload = []byte("x")
+	_, err := c.Write(req.Encode())
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapBadGateway, m.Code) // the connection closed without a connack
+
+	e := <-conns
+	require.Equal(t, c.LocalAddr().String(), e.remote.String())
+	require.Equal(t, "sensor1", e.pk.Connect.ClientIdentifier)
+	require.Equal(t, []byte("alice"), e.pk.Connect.Username)
+	require.Equal(t, []byte("secret"), e.pk.Connect.Password)
+}
+
+func TestCoAPPlaintextCredentialsRefused(t *testing.T) {
+	established := make(chan bool, 1)
+	_, c := serveCoAP(t, func(id string, conn net.Conn) error {
+		established <- true
+		return conn.Close()
+	})
+
+	req := coapRequest(coapPOST, 1, "ps", "a")
+	req.addOption(coapOptionURIQuery, []byte("username=alice"))
+	req.addOption(coapOptionURIQuery, []byte("password=secret"))
+	_, err := c.Write(req.Encode())
+	require.NoError(t, err)
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapUnauthorized, m.Code)
+	require.Equal(t, errCoAPPlaintextCredentials.Error(), string(m.Payload))
+	require.Empty(t, established)
+}
+
+// blockingEstablisher returns an establish function which holds each connection open
+// until release is closed.
+func blockingEstablisher(started chan<- bool, release <-chan struct{}) EstablishFn {
+	return func(id string, conn net.Conn) error {
+		started <- true
+		<-release
+		return conn.Close()
+	}
+}
+
+func TestCoAPRequestLimits(t *testing.T) {
+	tt := []struct {
+		desc   string
+		config *CoAPConfig
+		other  bool // the second request is sent from another address
+		code   byte
+	}{
+		{desc: "address", config: &CoAPConfig{MaxAddressRequests: 1}, code: coapTooManyRequests},
+		{desc: "listener", config: &CoAPConfig{MaxRequests: 1}, other: true, code: coapServiceUnavailable},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			started, release := make(chan bool, 2), make(chan struct{})
+			l, c := serveCoAPConfig(t, tx.config, blockingEstablisher(started, release))
+
+			req := coapRequest(coapPOST, 1, "ps", "a")
+			_, err := c.Write(req.Encode())
+			require.NoError(t, err)
+			<-started
+
+			second := c
+			if tx.other {
+				second = dialCoAP(t, l)
+			}
+
+			req = coapRequest(coapPOST, 2, "ps", "a")
+			_, err = second.Write(req.Encode())
+			require.NoError(t, err)
+			m := readCoAP(t, second)
+			require.Equal(t, tx.code, m.Code)
+			require.Equal(t, uint16(2), m.MessageID)
+
+			close(release)
+			require.Equal(t, coapBadGateway, readCoAP(t, c).Code)
+
+			// the slot is released once the first request has been answered
+			require.Eventually(t, func() bool {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				return l.requests == 0
+			}, time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestCoAPExchangeLimits(t *testing.T) {
+	tt := []struct {
+		desc   string
+		config *CoAPConfig
+		code   byte
+	}{
+		{desc: "address", config: &CoAPConfig{MaxAddressExchanges: 2}, code: coapTooManyRequests},
+		{desc: "listener", config: &CoAPConfig{MaxExchanges: 2}, code: coapServiceUnavailable},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			l, c := serveCoAPConfig(t, tx.config, MockEstablisher)
+
+			get := func(mid uint16) byte {
+				req := coapRequest(coapGET, mid, "ps")
+				_, err := c.Write(req.Encode())
+				require.NoError(t, err)
+				return readCoAP(t, c).Code
+			}
+
+			require.Equal(t, coapNotFound, get(1))
+			require.Equal(t, coapNotFound, get(2))
+			require.Equal(t, tx.code, get(3))
+
+			// expired exchanges are removed to make room
+			l.mu.Lock()
+			for _, e := range l.exchanges {
+				e.received = e.received.Add(-coapExchangeLifetime * 2)
+			}
+			l.mu.Unlock()
+
+			require.Equal(t, coapNotFound, get(4))
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			require.Len(t, l.exchanges, 1)
+			require.Equal(t, 1, l.counts[c.LocalAddr().String()].exchanges)
+		})
+	}
+}
+
+func TestCoAPLimitDefaults(t *testing.T) {
+	require.Equal(t, defaultCoAPMaxRequests, coapLimit(0, defaultCoAPMaxRequests))
+	require.Equal(t, 3, coapLimit(3, defaultCoAPMaxRequests))
+}
+
+// newCoAPObserver returns an observer of a listener for a udp client, with a gateway client
+// whose server end is returned.
+func newCoAPObserver(t *testing.T) (*coapObserver, *net.UDPConn, net.Conn) {
+	l, c := serveCoAP(t, MockEstablisher)
+	l.ackTimeout = 10 * time.Millisecond
+
+	gw, srv := net.Pipe()
+	t.Cleanup(func() {
+		_ = gw.Close()
+		_ = srv.Close()
+	})
+
+	o := &coapObserver{
+		l:      l,
+		addr:   c.LocalAddr(),
+		token:  []byte{0x7},
+		key:    c.LocalAddr().String() + "#\x07",
+		client: &gatewayClient{conn: gw, in: make(chan packets.Packet, 1)},
+		acks:   make(chan uint16, 1),
+		done:   make(chan struct{}),
+	}
+
+	return o, c, srv
+}
+
+func TestCoAPObserverNotifyAcknowledged(t *testing.T) {
+	o, c, srv := newCoAPObserver(t)
+
+	acked := make(chan packets.Packet, 1)
+	go func() {
+		pk, _ := readMQTTPacket(bufio.NewReader(srv), 5)
+		acked <- pk
+	}()
+
+	notified := make(chan bool, 1)
+	go func() {
+		notified <- o.notify(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 3, Payload: []byte("hi")})
+	}()
+
+	m := readCoAP(t, c)
+	require.Equal(t, coapConfirmable, m.Type)
+	require.Equal(t, coapContent, m.Code)
+	require.Equal(t, []byte{0x7}, m.Token)
+	require.Equal(t, []byte("hi"), m.Payload)
+	seq, ok := m.uintOption(coapOptionObserve)
+	require.True(t, ok)
+	require.Equal(t, uint32(1), seq)
+
+	o.l.acknowledged(c.LocalAddr(), coapMessage{Type: coapAcknowledgment, MessageID: m.MessageID})
+	require.True(t, <-notified)
+
+	pk := <-acked
+	require.Equal(t, packets.Puback, pk.FixedHeader.Type)
+	require.Equal(t, uint16(3), pk.PacketID)
+}
+
+func TestCoAPObserverNotifyRetransmitted(t *testing.T) {
+	o, c, _ := newCoAPObserver(t)
+
+	notified := make(chan bool, 1)
+	go func() {
+		notified <- o.notify(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 3})
+	}()
+
+	first := readCoAP(t, c)
+	for i := 0; i < coapMaxRetransmit; i++ {
+		require.Equal(t, first, readCoAP(t, c))
+	}
+
+	require.False(t, <-notified) // never acknowledged
+}
+
+func TestCoAPObserverReset(t *testing.T) {
+	o, c, _ := newCoAPObserver(t)
+
+	require.True(t, o.notify(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}}))
+	m := readCoAP(t, c)
+	require.Equal(t, coapNonConfirmable, m.Type)
+
+	o.l.acknowledged(c.LocalAddr(), coapMessage{Type: coapReset, MessageID: m.MessageID})
+	select {
+	case <-o.done:
+	case <-time.After(time.Second):
+		t.Fatal("observation not cancelled")
+	}
+}
+
+func TestCoAPObserverTrack(t *testing.T) {
+	o, _, _ := newCoAPObserver(t)
+
+	for i := 0; i < coapRecentNotifications+4; i++ {
+		o.track(uint16(i))
+	}
+
+	require.Len(t, o.recent, coapRecentNotifications)
+	require.Len(t, o.l.notifications, coapRecentNotifications)
+	require.Equal(t, uint16(4), o.recent[0])
+}
+
+func TestCoAPServeAndClose(t *testing.T) {
+	l := NewCoAP(Config{ID: "c1", Address: "127.0.0.1:0"})
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
@@ -0,0 +1,407 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	gatewayAckTimeout   = 30 * time.Second // time allowed for the server to acknowledge a connect, publish or subscribe
+	gatewayInboundQueue = 64               // packets from the server queued for each gateway client
+	gatewayPacketID     = 0xFFFF           // the packet id of gateway requests, far from those assigned by the server to resumed sessions
+)
+
+// gatewayConn is the server end of a connection which a gateway listener makes on behalf
+// of a client of another protocol, with the address of that client.
+type gatewayConn struct {
+	net.Conn
+	local  net.Addr // the address of the gateway
+	remote net.Addr // the address of the client
+}
+
+// LocalAddr returns the address of the gateway.
+func (c *gatewayConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the gateway client.
+func (c *gatewayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// writeMQTTPacket encodes and writes an mqtt packet sent by a gateway to the server.
+func writeMQTTPacket(w io.Writer, pk packets.Packet) error {
+	var buf bytes.Buffer
+	var err error
+	pk.Mods.AllowResponseInfo = true // only restricted for the server connack
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(&buf)
+	case packets.Publish:
+		err = pk.PublishEncode(&buf)
+	case packets.Puback:
+		err = pk.PubackEncode(&buf)
+	case packets.Pubrec:
+		err = pk.PubrecEncode(&buf)
+	case packets.Pubrel:
+		err = pk.PubrelEncode(&buf)
+	case packets.Pubcomp:
+		err = pk.PubcompEncode(&buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(&buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeEncode(&buf)
+	case packets.Pingreq:
+		err = pk.PingreqEncode(&buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(&buf)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// readMQTTPacket reads an mqtt packet sent by the server to a gateway which connected
+// with a protocol version.
+func readMQTTPacket(r *bufio.Reader, version byte) (packets.Packet, error) {
+	pk := packets.Packet{ProtocolVersion: version}
+
+	hb, err := r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	if err := pk.FixedHeader.Decode(hb); err != nil {
+		return pk, err
+	}
+
+	n, _, err := packets.DecodeLength(r)
+	if err != nil {
+		return pk, err
+	}
+	pk.FixedHeader.Remaining = n
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(buf)
+	case packets.Publish:
+		err = pk.PublishDecode(buf)
+	case packets.Puback:
+		err = pk.PubackDecode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(buf)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(buf)
+	case packets.Suback:
+		err = pk.SubackDecode(buf)
+	case packets.Unsuback:
+		err = pk.UnsubackDecode(buf)
+	case packets.Disconnect:
+		err = pk.DisconnectDecode(buf)
+	}
+
+	return pk, err
+}
+
+// gatewayReasons are the reason codes which the server may send to refuse a gateway client
+// or its requests.
+var gatewayReasons = []packets.Code{
+	packets.ErrUnspecifiedError,
+	packets.ErrMalformedPacket,
+	packets.ErrProtocolViolation,
+	packets.ErrImplementationSpecificError,
+	packets.ErrBadUsernameOrPassword,
+	packets.ErrNotAuthorized,
+	packets.ErrServerUnavailable,
+	packets.ErrServerBusy,
+	packets.ErrBanned,
+	packets.ErrServerShuttingDown,
+	packets.ErrSessionTakenOver,
+	packets.ErrClientIdentifierNotValid,
+	packets.ErrTopicFilterInvalid,
+	packets.ErrTopicNameInvalid,
+	packets.ErrPacketIdentifierInUse,
+	packets.ErrPacketTooLarge,
+	packets.ErrMessageRateTooHigh,
+	packets.ErrQuotaExceeded,
+	packets.ErrPayloadFormatInvalid,
+	packets.ErrRetainNotSupported,
+	packets.ErrQosNotSupported,
+	packets.ErrSharedSubscriptionsNotSupported,
+	packets.ErrConnectionRateExceeded,
+	packets.ErrWildcardSubscriptionsNotSupported,
+}
+
+// reasonCode returns the code of a reason code sent by the server, with the reason string
+// sent with it or the standard reason.
+func reasonCode(code byte, reason string) packets.Code {
+	if reason != "" {
+		return packets.Code{Code: code, Reason: reason}
+	}
+
+	for _, c := range gatewayReasons {
+		if c.Code == code {
+			return c
+		}
+	}
+
+	return packets.Code{Code: code, Reason: fmt.Sprintf("reason code 0x%02x", code)}
+}
+
+// ackError returns the reason code of an ack which refused a publish, or nil.
+func ackError(ack packets.Packet) error {
+	if ack.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		return reasonCode(ack.ReasonCode, ack.Properties.ReasonString)
+	}
+
+	return nil
+}
+
+// subackError returns the reason code of a suback which refused a subscription, or nil.
+func subackError(ack packets.Packet) error {
+	if len(ack.ReasonCodes) == 0 {
+		return packets.ErrUnspecifiedError
+	}
+
+	if ack.ReasonCodes[0] >= packets.ErrUnspecifiedError.Code {
+		return reasonCode(ack.ReasonCodes[0], ack.Properties.ReasonString)
+	}
+
+	return nil
+}
+
+// validTopicName returns true if a topic name can be published to by clients, having no
+// wildcards or $SYS prefix.
+func validTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#") && !strings.HasPrefix(strings.ToUpper(topic), "$SYS")
+}
+
+// gatewayClient is an MQTT v5 client connection to the server made by a gateway on behalf
+// of a client of another protocol.
+type gatewayClient struct {
+	conn    net.Conn            // the gateway end of the connection to the server
+	in      chan packets.Packet // packets sent by the server, closed when the connection ends
+	pending []packets.Packet    // publishes and pubrels received while awaiting another packet
+	acl     ACLCheckFn          // checks qos 0 publishes, which the server does not acknowledge
+	id      string              // the client id
+	lid     string              // the id of the listener
+}
+
+// dialGateway connects a gateway client to the server through the establish handler of a
+// listener, returning once the server has accepted the connect packet. The client id is
+// that of the connect packet, or the one assigned by the server. If acl is set, it is
+// used to check qos 0 publishes before they are sent.
+func dialGateway(ctx context.Context, establish EstablishFn, acl ACLCheckFn, listener string, local, remote net.Addr, connect packets.Packet, log *slog.Logger) (*gatewayClient, error) {
+	gw, srv := net.Pipe()
+	c := &gatewayClient{
+		conn: gw,
+		in:   make(chan packets.Packet, gatewayInboundQueue),
+		acl:  acl,
+		id:   connect.Connect.ClientIdentifier,
+		lid:  listener,
+	}
+
+	go c.read()
+	go func() {
+		err := establish(listener, &gatewayConn{Conn: srv, local: local, remote: remote})
+		if err != nil {
+			log.Debug("gateway client closed", "remote", remote.String(), "error", err)
+		}
+		_ = srv.Close()
+	}()
+
+	err := c.write(connect)
+	var ack packets.Packet
+	if err == nil {
+		ack, err = c.await(ctx, packets.Connack)
+	}
+
+	if err == nil && ack.ReasonCode >= packets.ErrUnspecifiedError.Code {
+		err = reasonCode(ack.ReasonCode, ack.Properties.ReasonString)
+	}
+
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if ack.Properties.AssignedClientID != "" {
+		c.id = ack.Properties.AssignedClientID
+	}
+
+	return c, nil
+}
+
+// read queues the packets sent by the server until the connection is closed.
+func (c *gatewayClient) read() {
+	defer close(c.in)
+	r := bufio.NewReader(c.conn)
+	for {
+		pk, err := readMQTTPacket(r, 5)
+		if err != nil {
+			_ = c.conn.Close()
+			return
+		}
+
+		c.in <- pk
+	}
+}
+
+// write writes a packet to the server.
+func (c *gatewayClient) write(pk packets.Packet) error {
+	pk.ProtocolVersion = 5
+	return writeMQTTPacket(c.conn, pk)
+}
+
+// await returns the next packet of a type sent by the server. Publishes and pubrels which
+// arrive first, such as those resent to a resumed session, are kept to be handled later,
+// and a disconnect sent by the server is returned as its reason code.
+func (c *gatewayClient) await(ctx context.Context, t byte) (packets.Packet, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return packets.Packet{}, ctx.Err()
+		case pk, ok := <-c.in:
+			if !ok {
+				return pk, io.EOF
+			}
+
+			switch pk.FixedHeader.Type {
+			case t:
+				return pk, nil
+			case packets.Disconnect:
+				return pk, reasonCode(pk.ReasonCode, pk.Properties.ReasonString)
+			case packets.Publish, packets.Pubrel:
+				c.pending = append(c.pending, pk)
+			}
+		}
+	}
+}
+
+// queued returns the next packet kept while awaiting another packet, if any.
+func (c *gatewayClient) queued() (packets.Packet, bool) {
+	if len(c.pending) == 0 {
+		return packets.Packet{}, false
+	}
+
+	pk := c.pending[0]
+	c.pending = c.pending[1:]
+	return pk, true
+}
+
+// ping sends a pingreq and waits for the pingresp. The server processes the packets of a
+// client in order, so any earlier packet has been processed once the ping is answered.
+func (c *gatewayClient) ping(ctx context.Context) error {
+	if err := c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}); err != nil {
+		return err
+	}
+
+	_, err := c.await(ctx, packets.Pingresp)
+	return err
+}
+
+// publish publishes a packet, returning once the server has processed it at its qos.
+// The server silently drops a qos 0 publish which the client is not allowed to make,
+// so it is checked first and refused as not authorized.
+func (c *gatewayClient) publish(ctx context.Context, pk packets.Packet) error {
+	if pk.FixedHeader.Qos == 0 && c.acl != nil && !c.acl(c.lid, c.id, pk.TopicName) {
+		return packets.ErrNotAuthorized
+	}
+
+	if err := c.write(pk); err != nil {
+		return err
+	}
+
+	switch pk.FixedHeader.Qos {
+	case 1:
+		ack, err := c.await(ctx, packets.Puback)
+		if err != nil {
+			return err
+		}
+		return ackError(ack)
+	case 2:
+		ack, err := c.await(ctx, packets.Pubrec)
+		if err == nil {
+			err = ackError(ack)
+		}
+
+		if err == nil {
+			err = c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: pk.PacketID})
+		}
+
+		if err == nil {
+			_, err = c.await(ctx, packets.Pubcomp)
+		}
+		return err
+	default:
+		return c.ping(ctx)
+	}
+}
+
+// subscribe subscribes to a topic filter, returning once the server has accepted it.
+func (c *gatewayClient) subscribe(ctx context.Context, filter string, qos byte) error {
+	err := c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		PacketID:    gatewayPacketID,
+		Filters:     packets.Subscriptions{{Filter: filter, Qos: qos}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ack, err := c.await(ctx, packets.Suback)
+	if err != nil {
+		return err
+	}
+
+	return subackError(ack)
+}
+
+// ack acknowledges a publish or pubrel sent by the server.
+func (c *gatewayClient) ack(pk packets.Packet) error {
+	var t byte
+	switch {
+	case pk.FixedHeader.Type == packets.Pubrel:
+		t = packets.Pubcomp
+	case pk.FixedHeader.Qos == 1:
+		t = packets.Puback
+	case pk.FixedHeader.Qos == 2:
+		t = packets.Pubrec
+	default:
+		return nil
+	}
+
+	return c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: t}, PacketID: pk.PacketID})
+}
+
+// close disconnects the client from the server and waits for the connection to end.
+func (c *gatewayClient) close() {
+	_ = c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	_ = c.conn.Close()
+	for range c.in {
+	}
+}
@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatewayReasonCode(t *testing.T) {
+	require.Equal(t, packets.ErrNotAuthorized, reasonCode(0x87, ""))
+	require.Equal(t, packets.Code{Code: 0x87, Reason: "no"}, reasonCode(0x87, "no"))
+	require.Equal(t, packets.ErrUnspecifiedError, reasonCode(0x80, ""))
+	require.Equal(t, "reason code 0xfe", reasonCode(0xFE, "").Reason)
+
+	require.NoError(t, ackError(packets.Packet{ReasonCode: packets.CodeNoMatchingSubscribers.Code}))
+	require.ErrorIs(t, ackError(packets.Packet{ReasonCode: 0x87}), packets.ErrNotAuthorized)
+
+	require.NoError(t, subackError(packets.Packet{ReasonCodes: []byte{1}}))
+	require.ErrorIs(t, subackError(packets.Packet{ReasonCodes: []byte{0x8F}}), packets.ErrTopicFilterInvalid)
+	require.ErrorIs(t, subackError(packets.Packet{}), packets.ErrUnspecifiedError)
+}
+
+func TestValidTopicName(t *testing.T) {
+	require.True(t, validTopicName("a/b"))
+	require.False(t, validTopicName(""))
+	require.False(t, validTopicName("a/+"))
+	require.False(t, validTopicName("a/#"))
+	require.False(t, validTopicName("$sys/a"))
+}
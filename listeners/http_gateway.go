@@ -0,0 +1,700 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const TypeHTTPGateway = "httpgateway"
+
+const (
+	defaultHTTPGatewayPrefix         = "/topics/"
+	defaultHTTPGatewayMaxPayloadSize = 1 << 20               // bytes allowed in a publish request body
+	defaultHTTPGatewayPollTimeout    = 30                    // seconds a long-poll request waits for messages
+	httpGatewayPollLinger            = 10 * time.Millisecond // time a long-poll request waits for further messages once one has arrived
+)
+
+// HTTPGatewayConfig contains configuration values specific to HTTP publish/subscribe gateway listeners.
+type HTTPGatewayConfig struct {
+	Prefix         string `yaml:"prefix" json:"prefix"`                     // the path before topic names, default /topics/
+	MaxPayloadSize int64  `yaml:"max_payload_size" json:"max_payload_size"` // bytes allowed in a publish request body, default 1MB
+	PollTimeout    int64  `yaml:"poll_timeout" json:"poll_timeout"`         // the longest a long-poll request waits for messages in seconds, default 30
+	PingInterval   int64  `yaml:"ping_interval" json:"ping_interval"`       // seconds between comments sent to keep idle event streams open, 0 to disable
+}
+
+// HTTPGateway is a listener which lets HTTP callers publish and subscribe. Each request is
+// made as an MQTT v5 client of the server, authenticated with the basic auth credentials of
+// the request, so the server hooks authenticate requests and check their ACLs as for any
+// other client. Topics are published with POST {prefix}{topic}, and subscribed to with
+// GET {prefix}{filter}, as a Server-Sent Events stream or a long-poll request.
+type HTTPGateway struct {
+	sync.RWMutex
+	id        string         // the internal id of the listener
+	address   string         // the network address to bind to
+	config    Config         // configuration values for the listener
+	listen    *http.Server   // the http server
+	listener  net.Listener   // the network listener of the http server
+	log       *slog.Logger   // server logger
+	establish EstablishFn    // the server's establish connection handler
+	acl       ACLCheckFn     // the server's publish acl check
+	trusted   trustedProxies // proxies whose forwarding headers are trusted
+	end       uint32         // ensure the close methods are only called once
+}
+
+// NewHTTPGateway initializes and returns a new HTTP gateway listener, listening on an address.
+func NewHTTPGateway(config Config) *HTTPGateway {
+	if config.HTTPGateway == nil {
+		config.HTTPGateway = new(HTTPGatewayConfig)
+	}
+
+	return &HTTPGateway{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *HTTPGateway) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *HTTPGateway) Address() string {
+	if l.listener != nil {
+		return l.listener.Addr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *HTTPGateway) Protocol() string {
+	if l.config.TLSConfig != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *HTTPGateway) Policy() *Policy {
+	return l.config.Policy
+}
+
+// prefix returns the path before topic names.
+func (l *HTTPGateway) prefix() string {
+	p := l.config.HTTPGateway.Prefix
+	if p == "" {
+		return defaultHTTPGatewayPrefix
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+
+	return p
+}
+
+// Init initializes the listener.
+func (l *HTTPGateway) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.config.Proxy != nil {
+		trusted, err := newTrustedProxies(l.config.Proxy)
+		if err != nil {
+			return err
+		}
+		l.trusted = trusted
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(l.prefix(), l.handler)
+	l.listen = &http.Server{
+		Addr:              l.address,
+		Handler:           mux,
+		TLSConfig:         l.config.TLSConfig,
+		ReadHeaderTimeout: 10 * time.Second, // no read or write timeouts, which would end event streams
+		IdleTimeout:       60 * time.Second,
+	}
+
+	listen, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Proxy != nil && l.config.Proxy.ProxyProtocol {
+		proxied, err := newProxyListener(listen, l.config.Proxy)
+		if err != nil {
+			_ = listen.Close()
+			return err
+		}
+		listen = proxied
+	}
+
+	l.listener = listen
+	return nil
+}
+
+// SetACLCheck sets the function used to check qos 0 publishes before they are sent
+// to the server, which does not acknowledge them.
+func (l *HTTPGateway) SetACLCheck(fn ACLCheckFn) {
+	l.acl = fn
+}
+
+// Serve starts serving publish and subscribe requests.
+func (l *HTTPGateway) Serve(establish EstablishFn) {
+	if atomic.LoadUint32(&l.end) == 1 {
+		return
+	}
+
+	l.establish = establish
+
+	var err error
+	if l.listen.TLSConfig != nil {
+		err = l.listen.ServeTLS(l.listener, "", "")
+	} else {
+		err = l.listen.Serve(l.listener)
+	}
+
+	// After the listener has been shutdown, no need to print the http.ErrServerClosed error.
+	if err != nil && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close stops the listener accepting requests and closes the client connections of any
+// requests in progress, ending their event streams and long-polls.
+func (l *HTTPGateway) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) && l.listen != nil {
+		l.listen.SetKeepAlivesEnabled(false) // closes idle connections
+		_ = l.listener.Close()
+	}
+
+	closeClients(l.id)
+}
+
+// handler handles publish and subscribe requests.
+func (l *HTTPGateway) handler(w http.ResponseWriter, r *http.Request) {
+	topic := strings.TrimPrefix(r.URL.Path, l.prefix())
+	if topic == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		l.publish(w, r, topic)
+	case http.MethodGet:
+		l.subscribe(w, r, topic)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// publish publishes the body of a request to a topic, returning once the server has
+// processed the publish.
+func (l *HTTPGateway) publish(w http.ResponseWriter, r *http.Request, topic string) {
+	pk, err := l.publishPacket(w, r, topic)
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+
+	c, err := l.connect(w, r)
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+	defer c.close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayAckTimeout)
+	defer cancel()
+
+	if err := c.publish(ctx, pk); err != nil {
+		l.fail(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishPacket returns the publish packet of a publish request. The qos and retain flag
+// are taken from the X-Mqtt-Qos and X-Mqtt-Retain headers (or the qos and retain query
+// parameters), and the v5 properties from the Content-Type, X-Mqtt-Payload-Format,
+// X-Mqtt-Message-Expiry, X-Mqtt-Response-Topic, X-Mqtt-Correlation-Data and
+// X-Mqtt-User-Property (key=value, repeatable) headers.
+func (l *HTTPGateway) publishPacket(w http.ResponseWriter, r *http.Request, topic string) (packets.Packet, error) {
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish},
+		ProtocolVersion: 5,
+		TopicName:       topic,
+	}
+
+	if !validTopicName(topic) {
+		return pk, packets.ErrTopicNameInvalid
+	}
+
+	qos, err := requestQos(r)
+	if err != nil {
+		return pk, err
+	}
+	pk.FixedHeader.Qos = qos
+	if qos > 0 {
+		pk.PacketID = gatewayPacketID
+	}
+
+	if v := requestParam(r, "X-Mqtt-Retain", "retain"); v != "" {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			return pk, fmt.Errorf("%w: invalid retain %q", errHTTPGatewayRequest, v)
+		}
+		pk.FixedHeader.Retain = retain
+	}
+
+	pk.Properties.ContentType = r.Header.Get("Content-Type")
+	pk.Properties.ResponseTopic = r.Header.Get("X-Mqtt-Response-Topic")
+	if v := r.Header.Get("X-Mqtt-Correlation-Data"); v != "" {
+		pk.Properties.CorrelationData = []byte(v)
+	}
+
+	if v := r.Header.Get("X-Mqtt-Payload-Format"); v != "" {
+		if v != "0" && v != "1" {
+			return pk, fmt.Errorf("%w: invalid payload format %q", errHTTPGatewayRequest, v)
+		}
+		pk.Properties.PayloadFormat = v[0] - '0'
+		pk.Properties.PayloadFormatFlag = true
+	}
+
+	if v := r.Header.Get("X-Mqtt-Message-Expiry"); v != "" {
+		expiry, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return pk, fmt.Errorf("%w: invalid message expiry %q", errHTTPGatewayRequest, v)
+		}
+		pk.Properties.MessageExpiryInterval = uint32(expiry)
+	}
+
+	for _, v := range r.Header.Values("X-Mqtt-User-Property") {
+		key, val, ok := strings.Cut(v, "=")
+		if !ok {
+			return pk, fmt.Errorf("%w: invalid user property %q", errHTTPGatewayRequest, v)
+		}
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: strings.TrimSpace(key), Val: strings.TrimSpace(val)})
+	}
+
+	limit := l.config.HTTPGateway.MaxPayloadSize
+	if limit <= 0 {
+		limit = defaultHTTPGatewayMaxPayloadSize
+	}
+
+	pk.Payload, err = io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return pk, packets.ErrPacketTooLarge
+		}
+		return pk, err
+	}
+
+	return pk, nil
+}
+
+// subscribe subscribes a request to a topic filter. Requests which accept text/event-stream
+// receive matching messages as Server-Sent Events until the request ends; other requests
+// are long-polls, which receive a JSON array of the messages which arrive before the
+// timeout query parameter (seconds, up to the poll timeout of the listener), or no content.
+func (l *HTTPGateway) subscribe(w http.ResponseWriter, r *http.Request, filter string) {
+	qos, err := requestQos(r)
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+
+	timeout := l.config.HTTPGateway.PollTimeout
+	if timeout <= 0 {
+		timeout = defaultHTTPGatewayPollTimeout
+	}
+
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || t < 0 {
+			l.fail(w, r, fmt.Errorf("%w: invalid timeout %q", errHTTPGatewayRequest, v))
+			return
+		}
+
+		if t < timeout {
+			timeout = t
+		}
+	}
+
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	flusher, ok := w.(http.Flusher)
+	if stream && !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c, err := l.connect(w, r)
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+	defer c.close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayAckTimeout)
+	err = c.subscribe(ctx, filter, qos)
+	cancel()
+
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+
+	if stream {
+		l.stream(w, r, flusher, c)
+	} else {
+		l.poll(w, r, c, time.Duration(timeout)*time.Second)
+	}
+}
+
+// stream sends the messages received by a client to a request as Server-Sent Events.
+func (l *HTTPGateway) stream(w http.ResponseWriter, r *http.Request, flusher http.Flusher, c *gatewayClient) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var ping <-chan time.Time
+	if l.config.HTTPGateway.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(l.config.HTTPGateway.PingInterval) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		pk, ok := c.queued()
+		if !ok {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ping:
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			case pk, ok = <-c.in:
+				if !ok {
+					return
+				}
+			}
+		}
+
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			b, _ := json.Marshal(newHTTPGatewayMessage(pk))
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+			_ = c.ack(pk)
+		case packets.Pubrel:
+			_ = c.ack(pk)
+		case packets.Disconnect:
+			_, _ = fmt.Fprintf(w, "event: disconnect\ndata: {\"reason_code\":%d}\n\n", pk.ReasonCode)
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// poll waits for messages received by a client, responding with those which arrive before
+// the timeout. Messages are acknowledged once the response has been written.
+func (l *HTTPGateway) poll(w http.ResponseWriter, r *http.Request, c *gatewayClient, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var received []packets.Packet
+	var err error
+
+wait:
+	for {
+		pk, ok := c.queued()
+		if !ok {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timer.C:
+				break wait
+			case pk, ok = <-c.in:
+				if !ok {
+					break wait
+				}
+			}
+		}
+
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			received = append(received, pk)
+			if len(received) == 1 {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(httpGatewayPollLinger)
+			}
+		case packets.Pubrel: // for messages received by the session in an earlier poll
+			_ = c.ack(pk)
+		case packets.Disconnect:
+			if len(received) == 0 {
+				err = reasonCode(pk.ReasonCode, pk.Properties.ReasonString)
+			}
+			break wait
+		}
+	}
+
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+
+	if len(received) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	messages := make([]httpGatewayMessage, 0, len(received))
+	for _, pk := range received {
+		messages = append(messages, newHTTPGatewayMessage(pk))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(messages); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayAckTimeout)
+	defer cancel()
+	for _, pk := range received {
+		if c.ack(pk) == nil && pk.FixedHeader.Qos == 2 {
+			if rel, err := c.await(ctx, packets.Pubrel); err == nil {
+				_ = c.ack(rel)
+			}
+		}
+	}
+}
+
+// connect makes the client connection of a request to the server. The client id is taken
+// from the X-Mqtt-Client-Id header (or the client_id query parameter), or is assigned by
+// the server, and is returned in the X-Mqtt-Client-Id response header. A session expiry
+// interval in seconds in the X-Mqtt-Session-Expiry header (or the session_expiry query
+// parameter) keeps the session of the client between requests.
+func (l *HTTPGateway) connect(w http.ResponseWriter, r *http.Request) (*gatewayClient, error) {
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			ClientIdentifier: requestParam(r, "X-Mqtt-Client-Id", "client_id"),
+		},
+	}
+
+	if v := requestParam(r, "X-Mqtt-Session-Expiry", "session_expiry"); v != "" {
+		expiry, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid session expiry %q", errHTTPGatewayRequest, v)
+		}
+
+		pk.Properties.SessionExpiryInterval = uint32(expiry)
+		pk.Properties.SessionExpiryIntervalFlag = true
+		pk.Connect.Clean = expiry == 0 || pk.Connect.ClientIdentifier == ""
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		pk.Connect.UsernameFlag = true
+		pk.Connect.Username = []byte(username)
+		pk.Connect.PasswordFlag = true
+		pk.Connect.Password = []byte(password)
+	}
+
+	var remote net.Addr = l.listener.Addr()
+	if peer, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = peer
+		if l.config.Proxy != nil && l.config.Proxy.ForwardedHeaders && l.trusted.contains(peer.IP) {
+			if addr, ok := forwardedAddr(r, l.trusted); ok {
+				remote = addr
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayAckTimeout)
+	defer cancel()
+
+	c, err := dialGateway(ctx, l.establish, l.acl, l.id, l.listener.Addr(), remote, pk, l.log)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("X-Mqtt-Client-Id", c.id)
+
+	return c, nil
+}
+
+// fail responds to a request with the http status of an error.
+func (l *HTTPGateway) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return // the caller has gone
+	}
+
+	var code packets.Code
+	switch {
+	case errors.As(err, &code):
+		status := httpGatewayStatus(code.Code)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mqtt"`)
+		}
+		http.Error(w, code.Reason, status)
+	case errors.Is(err, errHTTPGatewayRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "server timed out", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "server connection closed", http.StatusBadGateway)
+	}
+}
+
+// errHTTPGatewayRequest indicates a request had an invalid parameter.
+var errHTTPGatewayRequest = errors.New("invalid request")
+
+// httpGatewayStatuses are the http statuses of the reason codes which refuse requests.
+var httpGatewayStatuses = []struct {
+	code   packets.Code
+	status int
+}{
+	{packets.ErrBadUsernameOrPassword, http.StatusUnauthorized},
+	{packets.ErrNotAuthorized, http.StatusForbidden},
+	{packets.ErrBanned, http.StatusForbidden},
+	{packets.ErrClientIdentifierNotValid, http.StatusBadRequest},
+	{packets.ErrTopicFilterInvalid, http.StatusBadRequest},
+	{packets.ErrTopicNameInvalid, http.StatusBadRequest},
+	{packets.ErrPayloadFormatInvalid, http.StatusBadRequest},
+	{packets.ErrRetainNotSupported, http.StatusBadRequest},
+	{packets.ErrQosNotSupported, http.StatusBadRequest},
+	{packets.ErrSharedSubscriptionsNotSupported, http.StatusBadRequest},
+	{packets.ErrWildcardSubscriptionsNotSupported, http.StatusBadRequest},
+	{packets.ErrPacketTooLarge, http.StatusRequestEntityTooLarge},
+	{packets.ErrMessageRateTooHigh, http.StatusTooManyRequests},
+	{packets.ErrQuotaExceeded, http.StatusTooManyRequests},
+	{packets.ErrConnectionRateExceeded, http.StatusTooManyRequests},
+	{packets.ErrServerUnavailable, http.StatusServiceUnavailable},
+	{packets.ErrServerBusy, http.StatusServiceUnavailable},
+	{packets.ErrServerShuttingDown, http.StatusServiceUnavailable},
+	{packets.ErrSessionTakenOver, http.StatusConflict},
+}
+
+// httpGatewayStatus returns the http status of a reason code which refused a request.
+func httpGatewayStatus(code byte) int {
+	for _, s := range httpGatewayStatuses {
+		if s.code.Code == code {
+			return s.status
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+// requestParam returns the value of a request header, or of a query parameter if the header
+// isn't set. Query parameters allow browser EventSource requests, which can't set headers.
+func requestParam(r *http.Request, header, query string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+
+	return r.URL.Query().Get(query)
+}
+
+// requestQos returns the qos of a request from the X-Mqtt-Qos header or qos query parameter.
+func requestQos(r *http.Request) (byte, error) {
+	v := requestParam(r, "X-Mqtt-Qos", "qos")
+	if v == "" {
+		return 0, nil
+	}
+
+	if len(v) != 1 || v[0] < '0' || v[0] > '2' {
+		return 0, fmt.Errorf("%w: invalid qos %q", errHTTPGatewayRequest, v)
+	}
+
+	return v[0] - '0', nil
+}
+
+// httpGatewayMessage is a message received by a subscribe request. Payloads which are valid
+// UTF-8 are sent as strings, and other payloads as base64.
+type httpGatewayMessage struct {
+	Topic           string                    `json:"topic"`
+	Payload         *string                   `json:"payload,omitempty"`
+	PayloadBase64   []byte                    `json:"payload_base64,omitempty"`
+	Qos             byte                      `json:"qos"`
+	Retain          bool                      `json:"retain,omitempty"`
+	ContentType     string                    `json:"content_type,omitempty"`
+	ResponseTopic   string                    `json:"response_topic,omitempty"`
+	CorrelationData string                    `json:"correlation_data,omitempty"`
+	MessageExpiry   uint32                    `json:"message_expiry,omitempty"`
+	UserProperties  []httpGatewayUserProperty `json:"user_properties,omitempty"`
+}
+
+// httpGatewayUserProperty is a user property of a message received by a subscribe request.
+type httpGatewayUserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// newHTTPGatewayMessage returns the message of a publish packet.
+func newHTTPGatewayMessage(pk packets.Packet) httpGatewayMessage {
+	m := httpGatewayMessage{
+		Topic:           pk.TopicName,
+		Qos:             pk.FixedHeader.Qos,
+		Retain:          pk.FixedHeader.Retain,
+		ContentType:     pk.Properties.ContentType,
+		ResponseTopic:   pk.Properties.ResponseTopic,
+		CorrelationData: string(pk.Properties.CorrelationData),
+		MessageExpiry:   pk.Properties.MessageExpiryInterval,
+	}
+
+	if utf8.Valid(pk.Payload) {
+		payload := string(pk.Payload)
+		m.Payload = &payload
+	} else {
+		m.PayloadBase64 = pk.Payload
+	}
+
+	for _, p := range pk.Properties.User {
+		m.UserProperties = append(m.UserProperties, httpGatewayUserProperty{Key: p.Key, Value: p.Val})
+	}
+
+	return m
+}
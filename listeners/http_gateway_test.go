@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPGateway(t *testing.T) {
+	l := NewHTTPGateway(basicConfig)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "http", l.Protocol())
+	require.Nil(t, l.Policy())
+	require.NotNil(t, l.config.HTTPGateway)
+
+	l = NewHTTPGateway(tlsConfig)
+	require.Equal(t, "https", l.Protocol())
+}
+
+func TestHTTPGatewayPrefix(t *testing.T) {
+	tt := map[string]string{
+		"":         "/topics/",
+		"mqtt":     "/mqtt/",
+		"/api/v1/": "/api/v1/",
+		"/api/v1":  "/api/v1/",
+	}
+
+	for prefix, want := range tt {
+		l := NewHTTPGateway(Config{HTTPGateway: &HTTPGatewayConfig{Prefix: prefix}})
+		require.Equal(t, want, l.prefix())
+	}
+}
+
+func TestHTTPGatewayStatus(t *testing.T) {
+	require.Equal(t, http.StatusUnauthorized, httpGatewayStatus(packets.ErrBadUsernameOrPassword.Code))
+	require.Equal(t, http.StatusForbidden, httpGatewayStatus(packets.ErrNotAuthorized.Code))
+	require.Equal(t, http.StatusTooManyRequests, httpGatewayStatus(packets.ErrQuotaExceeded.Code))
+	require.Equal(t, http.StatusServiceUnavailable, httpGatewayStatus(packets.ErrServerShuttingDown.Code))
+	require.Equal(t, http.StatusInternalServerError, httpGatewayStatus(packets.ErrUnspecifiedError.Code))
+}
+
+func TestRequestQos(t *testing.T) {
+	tt := []struct {
+		header string
+		query  string
+		qos    byte
+		err    bool
+	}{
+		{qos: 0},
+		{header: "1", qos: 1},
+		{query: "qos=2", qos: 2},
+		{header: "1", query: "qos=2", qos: 1},
+		{header: "3", err: true},
+		{header: "01", err: true},
+		{query: "qos=x", err: true},
+	}
+
+	for _, tx := range tt {
+		r := httptest.NewRequest(http.MethodGet, "/topics/a?"+tx.query, nil)
+		if tx.header != "" {
+			r.Header.Set("X-Mqtt-Qos", tx.header)
+		}
+
+		qos, err := requestQos(r)
+		if tx.err {
+			require.ErrorIs(t, err, errHTTPGatewayRequest)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, tx.qos, qos)
+	}
+}
+
+func TestHTTPGatewayPublishPacket(t *testing.T) {
+	l := NewHTTPGateway(Config{HTTPGateway: &HTTPGatewayConfig{MaxPayloadSize: 4}})
+
+	r := httptest.NewRequest(http.MethodPost, "/topics/a/b?retain=true", strings.NewReader("data"))
+	r.Header.Set("X-Mqtt-Qos", "2")
+	r.Header.Set("X-Mqtt-Payload-Format", "1")
+	r.Header.Add("X-Mqtt-User-Property", "a = b")
+	pk, err := l.publishPacket(httptest.NewRecorder(), r, "a/b")
+	require.NoError(t, err)
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("data"), pk.Payload)
+	require.Equal(t, byte(2), pk.FixedHeader.Qos)
+	require.True(t, pk.FixedHeader.Retain)
+	require.Equal(t, uint16(gatewayPacketID), pk.PacketID)
+	require.True(t, pk.Properties.PayloadFormatFlag)
+	require.Equal(t, byte(1), pk.Properties.PayloadFormat)
+	require.Equal(t, []packets.UserProperty{{Key: "a", Val: "b"}}, pk.Properties.User)
+
+	r = httptest.NewRequest(http.MethodPost, "/topics/a/b", strings.NewReader("toolong"))
+	_, err = l.publishPacket(httptest.NewRecorder(), r, "a/b")
+	require.ErrorIs(t, err, packets.ErrPacketTooLarge)
+
+	for header, value := range map[string]string{
+		"X-Mqtt-Payload-Format": "2",
+		"X-Mqtt-Message-Expiry": "-1",
+	} {
+		r = httptest.NewRequest(http.MethodPost, "/topics/a/b", nil)
+		r.Header.Set(header, value)
+		_, err = l.publishPacket(httptest.NewRecorder(), r, "a/b")
+		require.ErrorIs(t, err, errHTTPGatewayRequest)
+	}
+}
+
+func TestNewHTTPGatewayMessage(t *testing.T) {
+	m := newHTTPGatewayMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+		Properties: packets.Properties{
+			ContentType:     "text/plain",
+			CorrelationData: []byte("c"),
+			User:            []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	})
+	require.Equal(t, "hello", *m.Payload)
+	require.Nil(t, m.PayloadBase64)
+	require.Equal(t, "c", m.CorrelationData)
+	require.Equal(t, []httpGatewayUserProperty{{Key: "k", Value: "v"}}, m.UserProperties)
+
+	m = newHTTPGatewayMessage(packets.Packet{Payload: []byte{0xFF}})
+	require.Nil(t, m.Payload)
+	require.Equal(t, []byte{0xFF}, m.PayloadBase64)
+}
+
+// serveHTTPGateway serves an HTTP gateway listener on a loopback port.
+func serveHTTPGateway(t *testing.T, config Config, establish EstablishFn) *HTTPGateway {
+	config.Address = "127.0.0.1:0"
+	l := NewHTTPGateway(config)
+	require.NoError(t, l.Init(logger))
+	go l.Serve(establish)
+	t.Cleanup(func() { l.Close(MockCloser) })
+	return l
+}
+
+func TestHTTPGatewayRoutes(t *testing.T) {
+	l := serveHTTPGateway(t, Config{ID: "h1"}, MockEstablisher)
+	url := "http://" + l.Address()
+
+	resp, err := http.Get(url + "/topics/")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodDelete, url+"/topics/a", nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+}
+
+func TestHTTPGatewayEstablish(t *testing.T) {
+	type established struct {
+		remote net.Addr
+		pk     packets.Packet
+	}
+
+	conns := make(chan established, 1)
+	l := serveHTTPGateway(t, Config{ID: "h1", Proxy: &ProxyConfig{ForwardedHeaders: true, TrustedProxies: []string{"127.0.0.1"}}}, func(id string, c net.Conn) error {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		hb, _ := r.ReadByte()
+		pk := packets.Packet{ProtocolVersion: 5}
+		_ = pk.FixedHeader.Decode(hb)
+		n, _, _ := packets.DecodeLength(r)
+		buf := make([]byte, n)
+		_, _ = io.ReadFull(r, buf)
+		_ = pk.ConnectDecode(buf)
+		conns <- established{remote: c.RemoteAddr(), pk: pk}
+		return nil
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+l.Address()+"/topics/a", strings.NewReader("x"))
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Mqtt-Client-Id", "backend")
+	req.Header.Set("X-Mqtt-Session-Expiry", "60")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode) // the connection closed without a connack
+
+	c := <-conns
+	require.Equal(t, "203.0.113.7:0", c.remote.String())
+	require.Equal(t, "backend", c.pk.Connect.ClientIdentifier)
+	require.Equal(t, []byte("alice"), c.pk.Connect.Username)
+	require.Equal(t, []byte("secret"), c.pk.Connect.Password)
+	require.False(t, c.pk.Connect.Clean)
+	require.Equal(t, uint32(60), c.pk.Properties.SessionExpiryInterval)
+}
+
+func TestHTTPGatewayForwardedHeadersUntrusted(t *testing.T) {
+	remote := make(chan net.Addr, 1)
+	l := serveHTTPGateway(t, Config{ID: "h1", Proxy: &ProxyConfig{ForwardedHeaders: true, TrustedProxies: []string{"10.0.0.0/8"}}}, func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr()
+		return c.Close()
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+l.Address()+"/topics/a", strings.NewReader("x"))
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	require.True(t, strings.HasPrefix((<-remote).String(), "127.0.0.1:"))
+}
+
+func TestHTTPGatewayNoTrustedProxies(t *testing.T) {
+	l := NewHTTPGateway(Config{ID: "h1", Address: "127.0.0.1:0", Proxy: &ProxyConfig{ForwardedHeaders: true}})
+	require.ErrorIs(t, l.Init(logger), ErrNoTrustedProxies)
+}
+
+func TestHTTPGatewayServeAndClose(t *testing.T) {
+	l := NewHTTPGateway(Config{ID: "h1", Address: "127.0.0.1:0"})
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
@@ -19,6 +19,20 @@ type Config struct {
 	Address string
 	// TLSConfig is a tls.Config configuration to be used with the listener. See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+	// Proxy configures the TCP and Websocket listeners to accept the original client address from proxies and load balancers.
+	Proxy *ProxyConfig `yaml:"proxy" json:"proxy"`
+	// Websocket configures the paths, origins, subprotocols and limits of a Websocket listener.
+	Websocket *WebsocketConfig `yaml:"websocket" json:"websocket"`
+	// QUIC configures the application protocols, idle timeout, stream limit and 0-RTT resumption of a QUIC listener.
+	QUIC *QUICConfig `yaml:"quic" json:"quic"`
+	// MQTTSN configures the gateway id, predefined topics, advertising and sleeping client buffers of an MQTT-SN gateway listener.
+	MQTTSN *MQTTSNConfig `yaml:"mqttsn" json:"mqttsn"`
+	// HTTPGateway configures the path prefix, payload limit, poll timeout and event stream pings of an HTTP gateway listener.
+	HTTPGateway *HTTPGatewayConfig `yaml:"http_gateway" json:"http_gateway"`
+	// CoAP configures the topic path prefix, limits and credentials of a CoAP gateway listener.
+	CoAP *CoAPConfig `yaml:"coap" json:"coap"`
+	// Policy overrides the server capabilities, client limits, keepalive bounds, auth hooks and protocol versions for clients of the listener.
+	Policy *Policy `yaml:"policy" json:"policy"`
 }
 
 // EstablishFn is a callback function for establishing new clients.
@@ -27,6 +41,10 @@ type EstablishFn func(id string, c net.Conn) error
 // CloseFn is a callback function for closing all listener clients.
 type CloseFn func(id string)
 
+// ACLCheckFn is a callback function returning true if a client of a listener may
+// publish to a topic.
+type ACLCheckFn func(listener, clientID, topic string) bool
+
 // Listener is an interface for network listeners. A network listener listens
 // for incoming client connections and adds them to the server.
 type Listener interface {
@@ -38,10 +56,18 @@ type Listener interface {
 	Close(CloseFn)           // stop and close the listener
 }
 
+// ACLListener is a listener which checks whether its clients may publish before
+// sending their messages to the server, such as a gateway which must report a
+// refused message to its client even when the server would not acknowledge it.
+type ACLListener interface {
+	SetACLCheck(ACLCheckFn) // sets the server's publish acl check
+}
+
 // Listeners contains the network listeners for the broker.
 type Listeners struct {
 	ClientsWg sync.WaitGroup      // a waitgroup that waits for all clients in all listeners to finish.
 	internal  map[string]Listener // a map of active listeners.
+	closed    map[string]bool     // ids of listeners which have been closed.
 	sync.RWMutex
 }
 
@@ -49,6 +75,7 @@ type Listeners struct {
 func New() *Listeners {
 	return &Listeners{
 		internal: map[string]Listener{},
+		closed:   map[string]bool{},
 	}
 }
 
@@ -57,6 +84,7 @@ func (l *Listeners) Add(val Listener) {
 	l.Lock()
 	defer l.Unlock()
 	l.internal[val.ID()] = val
+	delete(l.closed, val.ID())
 }
 
 // Get returns the value of a listener if it exists.
@@ -90,6 +118,7 @@ func (l *Listeners) Delete(id string) {
 	l.Lock()
 	defer l.Unlock()
 	delete(l.internal, id)
+	delete(l.closed, id)
 }
 
 // Serve starts a listener serving from the internal map.
@@ -119,13 +148,19 @@ func (l *Listeners) ServeAll(establisher EstablishFn) {
 	}
 }
 
-// Close stops a listener from the internal map.
+// Close stops a listener from the internal map. A listener is only closed once, so a
+// drained listener is not closed again when the server closes.
 func (l *Listeners) Close(id string, closer CloseFn) {
-	l.RLock()
-	defer l.RUnlock()
-	if listener, ok := l.internal[id]; ok {
-		listener.Close(closer)
+	l.Lock()
+	listener, ok := l.internal[id]
+	if !ok || l.closed[id] {
+		l.Unlock()
+		return
 	}
+	l.closed[id] = true
+	l.Unlock()
+
+	listener.Close(closer)
 }
 
 // CloseAll iterates and closes all registered listeners.
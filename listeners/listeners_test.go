@@ -158,6 +158,21 @@ func TestCloseListener(t *testing.T) {
 	require.True(t, closed)
 }
 
+func TestCloseListenerOnce(t *testing.T) {
+	l := New()
+	l.Add(NewMockListener("t1", testAddr))
+
+	var closed int
+	l.Close("t1", func(id string) { closed++ })
+	l.Close("t1", func(id string) { closed++ })
+	require.Equal(t, 1, closed)
+
+	// a listener added again can be closed again
+	l.Add(NewMockListener("t1", testAddr))
+	l.Close("t1", func(id string) { closed++ })
+	require.Equal(t, 2, closed)
+}
+
 func TestCloseAllListeners(t *testing.T) {
 	l := New()
 	l.Add(NewMockListener("t1", testAddr))
@@ -81,6 +81,14 @@ func (l *MockListener) Protocol() string {
 	return "mock"
 }
 
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *MockListener) Policy() *Policy {
+	if l.Config == nil {
+		return nil
+	}
+	return l.Config.Policy
+}
+
 // Close closes the mock listener.
 func (l *MockListener) Close(closer CloseFn) {
 	l.Lock()
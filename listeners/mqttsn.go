@@ -0,0 +1,1037 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const TypeMQTTSN = "mqttsn"
+
+const (
+	defaultMQTTSNAdvertiseInterval = 900 // seconds between advertise packets
+	defaultMQTTSNBufferedMessages  = 100 // messages held for each sleeping client
+	mqttsnInboundQueue             = 64  // packets queued for each client before datagrams are dropped
+)
+
+// MQTTSNConfig contains configuration values specific to MQTT-SN gateway listeners.
+type MQTTSNConfig struct {
+	GatewayID           byte              `yaml:"gateway_id" json:"gateway_id"`                       // the id of the gateway in advertise and gwinfo packets
+	PredefinedTopics    map[uint16]string `yaml:"predefined_topics" json:"predefined_topics"`         // topic names by predefined topic id
+	AdvertiseAddress    string            `yaml:"advertise_address" json:"advertise_address"`         // a broadcast or multicast address to advertise the gateway on, eg. 255.255.255.255:1884
+	AdvertiseInterval   uint16            `yaml:"advertise_interval" json:"advertise_interval"`       // seconds between advertise packets, default 900
+	MaxBufferedMessages int               `yaml:"max_buffered_messages" json:"max_buffered_messages"` // publishes held for each sleeping client before the server is no longer read, default 100
+	AnonymousClientID   string            `yaml:"anonymous_client_id" json:"anonymous_client_id"`     // the client id used to publish QoS -1 messages, default mqttsn-{listener id}
+}
+
+// MQTTSN is an MQTT-SN v1.2 gateway listener. Each MQTT-SN client is translated into an
+// MQTT v3.1.1 connection to the server, so that gateway clients have ordinary sessions
+// which are authenticated and checked by the server hooks.
+type MQTTSN struct {
+	sync.RWMutex
+	id         string                // the internal id of the listener
+	address    string                // the network address to bind to
+	config     Config                // configuration values for the listener
+	conn       net.PacketConn        // the udp socket of the gateway
+	log        *slog.Logger          // server logger
+	establish  EstablishFn           // the server's establish connection handler
+	advertise  *net.UDPAddr          // the address to send advertise packets to
+	predefined map[string]uint16     // predefined topic ids by topic name
+	mu         sync.Mutex            // protects sessions and anon
+	sessions   map[string]*snSession // client sessions by client address
+	anon       *snSession            // the session which publishes QoS -1 messages
+	done       chan struct{}         // closed when the listener is closed
+	end        uint32                // ensure the close methods are only called once
+}
+
+// NewMQTTSN initializes and returns a new MQTT-SN gateway listener, listening on an address.
+func NewMQTTSN(config Config) *MQTTSN {
+	if config.MQTTSN == nil {
+		config.MQTTSN = new(MQTTSNConfig)
+	}
+
+	predefined := make(map[string]uint16, len(config.MQTTSN.PredefinedTopics))
+	for id, name := range config.MQTTSN.PredefinedTopics {
+		predefined[name] = id
+	}
+
+	return &MQTTSN{
+		id:         config.ID,
+		address:    config.Address,
+		config:     config,
+		predefined: predefined,
+		sessions:   map[string]*snSession{},
+		done:       make(chan struct{}),
+	}
+}
+
+// ID returns the id of the listener.
+func (l *MQTTSN) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *MQTTSN) Address() string {
+	if l.conn != nil {
+		return l.conn.LocalAddr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *MQTTSN) Protocol() string {
+	return "mqttsn"
+}
+
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *MQTTSN) Policy() *Policy {
+	return l.config.Policy
+}
+
+// Init initializes the listener.
+func (l *MQTTSN) Init(log *slog.Logger) error {
+	l.log = log
+
+	for id, name := range l.config.MQTTSN.PredefinedTopics {
+		if id == 0 || id == 0xFFFF || name == "" || strings.ContainsAny(name, "+#") {
+			return fmt.Errorf("invalid predefined topic %d %q", id, name)
+		}
+	}
+
+	if l.config.MQTTSN.AdvertiseAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", l.config.MQTTSN.AdvertiseAddress)
+		if err != nil {
+			return err
+		}
+		l.advertise = addr
+	}
+
+	conn, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return err
+	}
+
+	l.conn = conn
+	return nil
+}
+
+// Serve starts receiving MQTT-SN packets, establishing a connection to the server for
+// each client which connects.
+func (l *MQTTSN) Serve(establish EstablishFn) {
+	if atomic.LoadUint32(&l.end) == 1 {
+		return
+	}
+
+	l.establish = establish
+	if l.advertise != nil {
+		go l.advertiseLoop()
+	}
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			l.receive(addr, append([]byte{}, buf[:n]...))
+		}
+	}
+}
+
+// advertiseLoop sends advertise packets to the advertise address until the listener is closed.
+func (l *MQTTSN) advertiseLoop() {
+	interval := l.config.MQTTSN.AdvertiseInterval
+	if interval == 0 {
+		interval = defaultMQTTSNAdvertiseInterval
+	}
+
+	pk := snPacket{Type: snAdvertise, GatewayID: l.config.MQTTSN.GatewayID, Duration: interval}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		_, _ = l.conn.WriteTo(pk.Encode(), l.advertise)
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// receive handles a datagram received from a client.
+func (l *MQTTSN) receive(addr net.Addr, b []byte) {
+	pk, err := decodeSN(b)
+	if err != nil {
+		l.log.Debug("invalid mqtt-sn packet", "remote", addr.String(), "error", err)
+		return
+	}
+
+	switch pk.Type {
+	case snSearchGw:
+		l.send(addr, snPacket{Type: snGwInfo, GatewayID: l.config.MQTTSN.GatewayID})
+		return
+	case snAdvertise, snGwInfo:
+		return // other gateways
+	case snConnect:
+		l.connect(addr, pk)
+		return
+	}
+
+	s := l.session(addr, pk)
+	if s == nil {
+		switch {
+		case pk.Type == snPublish && pk.Qos == snQosMinusOne:
+			l.anonymous().enqueue(pk)
+		case pk.Type != snDisconnect:
+			l.send(addr, snPacket{Type: snDisconnect}) // unknown client
+		}
+		return
+	}
+
+	s.enqueue(pk)
+}
+
+// connect starts a session for a client connect packet. A sleeping client which connects
+// without a clean session resumes its existing session.
+func (l *MQTTSN) connect(addr net.Addr, pk snPacket) {
+	l.mu.Lock()
+	s, ok := l.sessions[addr.String()]
+	l.mu.Unlock()
+
+	if ok {
+		if s.resumes(pk) {
+			s.enqueue(pk)
+			return
+		}
+		s.replace()
+	}
+
+	l.newSession(addr).enqueue(pk)
+}
+
+// session returns the session of a client address. A sleeping client which wakes from a
+// new address is found by the client id of its pingreq.
+func (l *MQTTSN) session(addr net.Addr, pk snPacket) *snSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.sessions[addr.String()]; ok {
+		return s
+	}
+
+	if pk.Type != snPingreq || pk.ClientID == "" {
+		return nil
+	}
+
+	for key, s := range l.sessions {
+		if s.rebind(addr, pk.ClientID) {
+			delete(l.sessions, key)
+			l.sessions[addr.String()] = s
+			return s
+		}
+	}
+
+	return nil
+}
+
+// anonymous returns the session which publishes QoS -1 messages from clients without a
+// session, connecting it if needed.
+func (l *MQTTSN) anonymous() *snSession {
+	l.mu.Lock()
+	s := l.anon
+	l.mu.Unlock()
+	if s != nil {
+		return s
+	}
+
+	id := l.config.MQTTSN.AnonymousClientID
+	if id == "" {
+		id = "mqttsn-" + l.id
+	}
+
+	s = l.newSession(nil)
+	s.enqueue(snPacket{Type: snConnect, Clean: true, ClientID: id, ProtocolID: 0x01})
+	return s
+}
+
+// newSession creates a session for a client address and establishes its connection to
+// the server. The anonymous session has no address.
+func (l *MQTTSN) newSession(addr net.Addr) *snSession {
+	gw, srv := net.Pipe()
+	s := &snSession{
+		l:           l,
+		addr:        addr,
+		conn:        gw,
+		inbound:     make(chan snPacket, mqttsnInboundQueue),
+		done:        make(chan struct{}),
+		read:        make(chan struct{}),
+		closing:     make(chan struct{}),
+		drained:     make(chan struct{}, 1),
+		ids:         map[string]uint16{},
+		names:       map[uint16]string{},
+		pubacks:     map[uint16]uint16{},
+		subacks:     map[uint16]uint16{},
+		registering: map[uint16][]packets.Packet{},
+	}
+
+	remote := addr
+	l.mu.Lock()
+	if addr != nil {
+		l.sessions[addr.String()] = s
+	} else {
+		l.anon = s
+		remote = l.conn.LocalAddr()
+	}
+	l.mu.Unlock()
+
+	go s.run()
+	go s.readServer()
+	go func() {
+		err := l.establish(l.id, &gatewayConn{Conn: srv, local: l.conn.LocalAddr(), remote: remote})
+		if err != nil {
+			l.log.Warn("", "error", err)
+		}
+		s.end()
+	}()
+
+	return s
+}
+
+// remove removes a session from the listener.
+func (l *MQTTSN) remove(s *snSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.anon == s {
+		l.anon = nil
+	}
+
+	for key, v := range l.sessions {
+		if v == s {
+			delete(l.sessions, key)
+		}
+	}
+}
+
+// send sends a packet to a client address.
+func (l *MQTTSN) send(addr net.Addr, pk snPacket) {
+	if addr == nil {
+		return
+	}
+
+	if _, err := l.conn.WriteTo(pk.Encode(), addr); err != nil {
+		l.log.Debug("failed to send mqtt-sn packet", "remote", addr.String(), "error", err)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *MQTTSN) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+		closeClients(l.id)
+	}
+
+	if l.conn != nil {
+		err := l.conn.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	l.mu.Lock()
+	sessions := make([]*snSession, 0, len(l.sessions)+1)
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	if l.anon != nil {
+		sessions = append(sessions, l.anon)
+	}
+	l.mu.Unlock()
+
+	for _, s := range sessions {
+		_ = s.conn.Close()
+	}
+}
+
+// The states of an MQTT-SN client session.
+const (
+	snStateNew          byte = iota // waiting for the client connect
+	snStateWillTopic                // waiting for the will topic
+	snStateWillMsg                  // waiting for the will message
+	snStateConnecting               // waiting for the server connack
+	snStateActive                   // connected
+	snStateAsleep                   // sleeping, with messages held by the gateway
+	snStateAwake                    // awake to receive the held messages
+	snStateDisconnected             // disconnected, or replaced by a new session
+)
+
+// snSession translates between the MQTT-SN packets of a client and the MQTT packets of
+// its connection to the server.
+type snSession struct {
+	sync.Mutex
+	l           *MQTTSN
+	addr        net.Addr                    // the client address, nil for the anonymous session
+	conn        net.Conn                    // the gateway end of the connection to the server
+	inbound     chan snPacket               // packets received from the client
+	done        chan struct{}               // closed when the session ends
+	read        chan struct{}               // closed when the server connection has been read to the end
+	closing     chan struct{}               // closed when the session starts ending
+	drained     chan struct{}               // signalled when the publishes held for a sleeping client are delivered
+	once        sync.Once                   // ensure the session only ends once
+	state       byte                        // the state of the client
+	clientID    string                      // the client id of the client
+	keepalive   uint16                      // the keepalive of the client in seconds
+	sleep       time.Duration               // the sleep duration of a sleeping client
+	connect     packets.Packet              // the connect packet, held during the will exchange
+	ids         map[string]uint16           // registered topic ids by topic name
+	names       map[uint16]string           // registered topic names by topic id
+	nextID      uint16                      // the last registered topic id
+	nextMsgID   uint16                      // the last message id of a gateway register packet
+	pubacks     map[uint16]uint16           // topic ids of client qos 1 publishes by message id
+	subacks     map[uint16]uint16           // topic ids of client subscriptions by message id
+	registering map[uint16][]packets.Packet // publishes waiting for the client to acknowledge a topic id
+	buffered    []packets.Packet            // publishes held while the client sleeps
+	pings       int                         // pingreqs sent to the server for a sleeping client
+	sleepTimer  *time.Timer                 // ends the session if a sleeping client doesn't wake
+	pingStop    chan struct{}               // stops the pings sent for a sleeping client
+}
+
+// run handles the packets received from the client until the session ends.
+func (s *snSession) run() {
+	for {
+		select {
+		case pk := <-s.inbound:
+			s.handle(pk)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// enqueue queues a packet received from the client, dropping it if the queue is full.
+func (s *snSession) enqueue(pk snPacket) {
+	select {
+	case s.inbound <- pk:
+	case <-s.done:
+	default:
+		s.l.log.Debug("mqtt-sn client queue full, packet dropped", "client", s.clientID)
+	}
+}
+
+// resumes returns true if a connect packet resumes the session of a sleeping client.
+func (s *snSession) resumes(pk snPacket) bool {
+	s.Lock()
+	defer s.Unlock()
+	return (s.state == snStateAsleep || s.state == snStateAwake) && !pk.Clean && pk.ClientID == s.clientID
+}
+
+// rebind moves the session of a sleeping client to a new address, returning true if the
+// session belongs to the client.
+func (s *snSession) rebind(addr net.Addr, clientID string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.clientID != clientID || (s.state != snStateAsleep && s.state != snStateAwake) {
+		return false
+	}
+
+	s.addr = addr
+	return true
+}
+
+// replace ends a session which has been replaced by a new connect from the same address.
+func (s *snSession) replace() {
+	s.Lock()
+	s.state = snStateDisconnected
+	s.Unlock()
+	_ = s.conn.Close()
+}
+
+// end ends the session once its server connection is closed, telling the client unless
+// it disconnected.
+func (s *snSession) end() {
+	s.once.Do(func() {
+		_ = s.conn.Close()
+		close(s.closing)
+		<-s.read // the last packets from the server, such as a refused connack
+
+		s.Lock()
+		notify := s.state != snStateDisconnected
+		s.state = snStateDisconnected
+		s.stopSleeping()
+		addr := s.addr
+		s.Unlock()
+
+		close(s.done)
+		s.l.remove(s)
+
+		if notify {
+			s.l.send(addr, snPacket{Type: snDisconnect})
+		}
+	})
+}
+
+// snBatch collects the packets to send as the result of a received packet.
+type snBatch struct {
+	server []packets.Packet // packets to send to the server
+	client []snPacket       // packets to send to the client
+}
+
+// handle translates a packet received from the client.
+func (s *snSession) handle(pk snPacket) {
+	var b snBatch
+	s.Lock()
+	s.process(pk, &b)
+	addr := s.addr
+	s.Unlock()
+
+	// the server connection is only written to without the lock held, as the server
+	// may be waiting to write to the session.
+	for _, p := range b.server {
+		if err := s.writeServer(p); err != nil {
+			break
+		}
+	}
+
+	for _, p := range b.client {
+		s.l.send(addr, p)
+	}
+}
+
+// process translates a packet received from the client into the packets to send.
+func (s *snSession) process(pk snPacket, b *snBatch) {
+	switch pk.Type {
+	case snConnect:
+		if s.state == snStateAsleep || s.state == snStateAwake { // resumed
+			s.stopSleeping()
+			s.state = snStateActive
+			b.client = append(b.client, snPacket{Type: snConnack, ReturnCode: snAccepted})
+			s.deliverBuffered(b)
+			return
+		}
+
+		s.clientID = pk.ClientID
+		s.keepalive = pk.Duration
+		s.connect = packets.Packet{
+			FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+			ProtocolVersion: 4,
+			Connect: packets.ConnectParams{
+				ProtocolName:     []byte("MQTT"),
+				Clean:            pk.Clean,
+				Keepalive:        pk.Duration,
+				ClientIdentifier: pk.ClientID,
+			},
+		}
+
+		if pk.Will {
+			s.state = snStateWillTopic
+			b.client = append(b.client, snPacket{Type: snWillTopicReq})
+			return
+		}
+
+		s.state = snStateConnecting
+		b.server = append(b.server, s.connect)
+
+	case snWillTopic:
+		if s.state != snStateWillTopic {
+			return
+		}
+
+		if pk.TopicName == "" { // no will
+			s.state = snStateConnecting
+			b.server = append(b.server, s.connect)
+			return
+		}
+
+		s.connect.Connect.WillFlag = true
+		s.connect.Connect.WillTopic = pk.TopicName
+		s.connect.Connect.WillQos = snQos(pk.Qos)
+		s.connect.Connect.WillRetain = pk.Retain
+		s.state = snStateWillMsg
+		b.client = append(b.client, snPacket{Type: snWillMsgReq})
+
+	case snWillMsg:
+		if s.state != snStateWillMsg {
+			return
+		}
+
+		s.connect.Connect.WillPayload = pk.Data
+		s.state = snStateConnecting
+		b.server = append(b.server, s.connect)
+
+	case snRegister:
+		if !s.connected() {
+			return
+		}
+
+		ack := snPacket{Type: snRegack, MsgID: pk.MsgID, ReturnCode: snRejectedNotSupported}
+		if pk.TopicName != "" && !strings.ContainsAny(pk.TopicName, "+#") {
+			ack.TopicID, ack.ReturnCode = s.register(pk.TopicName), snAccepted
+		}
+		b.client = append(b.client, ack)
+
+	case snRegack:
+		pending := s.registering[pk.TopicID]
+		delete(s.registering, pk.TopicID)
+		if pk.ReturnCode != snAccepted {
+			s.unregister(pk.TopicID)
+		} else {
+			for _, p := range pending {
+				s.deliver(p, b)
+			}
+		}
+
+		if s.state == snStateAwake && len(s.registering) == 0 {
+			s.state = snStateAsleep
+			b.client = append(b.client, snPacket{Type: snPingresp})
+		}
+
+	case snPublish:
+		if !s.connected() {
+			return
+		}
+
+		topic, ok := s.topicName(pk.TopicIDType, pk.TopicID)
+		if !ok {
+			if pk.Qos != snQosMinusOne {
+				b.client = append(b.client, snPacket{Type: snPuback, TopicID: pk.TopicID, MsgID: pk.MsgID, ReturnCode: snRejectedTopicID})
+			}
+			return
+		}
+
+		qos := snQos(pk.Qos)
+		if qos == 1 {
+			s.pubacks[pk.MsgID] = pk.TopicID
+		}
+
+		b.server = append(b.server, packets.Packet{
+			FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: qos, Retain: pk.Retain, Dup: pk.Dup && qos > 0},
+			ProtocolVersion: 4,
+			TopicName:       topic,
+			PacketID:        pk.MsgID,
+			Payload:         pk.Data,
+		})
+
+	case snPuback:
+		if pk.ReturnCode == snRejectedTopicID {
+			s.unregister(pk.TopicID) // registered again on the next publish
+		}
+		b.server = append(b.server, snAck(packets.Puback, pk.MsgID))
+
+	case snPubrec:
+		b.server = append(b.server, snAck(packets.Pubrec, pk.MsgID))
+
+	case snPubrel:
+		b.server = append(b.server, snAck(packets.Pubrel, pk.MsgID))
+
+	case snPubcomp:
+		b.server = append(b.server, snAck(packets.Pubcomp, pk.MsgID))
+
+	case snSubscribe, snUnsubscribe:
+		if !s.connected() {
+			return
+		}
+
+		filter, topicID, ok := s.filter(pk, pk.Type == snSubscribe)
+		if !ok {
+			if pk.Type == snSubscribe {
+				b.client = append(b.client, snPacket{Type: snSuback, MsgID: pk.MsgID, ReturnCode: snRejectedTopicID})
+			} else {
+				b.client = append(b.client, snPacket{Type: snUnsuback, MsgID: pk.MsgID})
+			}
+			return
+		}
+
+		p := packets.Packet{
+			FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+			ProtocolVersion: 4,
+			PacketID:        pk.MsgID,
+			Filters:         packets.Subscriptions{{Filter: filter, Qos: snQos(pk.Qos)}},
+		}
+
+		if pk.Type == snUnsubscribe {
+			p.FixedHeader.Type = packets.Unsubscribe
+		} else {
+			s.subacks[pk.MsgID] = topicID
+		}
+		b.server = append(b.server, p)
+
+	case snPingreq:
+		switch s.state {
+		case snStateAsleep:
+			s.wake(b)
+		case snStateActive:
+			b.server = append(b.server, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}})
+		}
+
+	case snDisconnect:
+		if pk.Duration > 0 && s.connected() {
+			s.startSleeping(time.Duration(pk.Duration) * time.Second)
+			b.client = append(b.client, snPacket{Type: snDisconnect})
+			return
+		}
+
+		s.state = snStateDisconnected
+		b.server = append(b.server, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}, ProtocolVersion: 4})
+		b.client = append(b.client, snPacket{Type: snDisconnect})
+
+	case snWillTopicUpd:
+		b.client = append(b.client, snPacket{Type: snWillTopicResp, ReturnCode: snRejectedNotSupported})
+
+	case snWillMsgUpd:
+		b.client = append(b.client, snPacket{Type: snWillMsgResp, ReturnCode: snRejectedNotSupported})
+	}
+}
+
+// connected returns true if the client may publish and subscribe.
+func (s *snSession) connected() bool {
+	return s.state >= snStateConnecting && s.state <= snStateAwake
+}
+
+// snQos returns the mqtt qos of an MQTT-SN qos, which is 0 for QoS -1.
+func snQos(qos byte) byte {
+	if qos == snQosMinusOne {
+		return 0
+	}
+	return qos
+}
+
+// snAck returns an mqtt puback, pubrec, pubrel or pubcomp packet.
+func snAck(t byte, id uint16) packets.Packet {
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: t}, ProtocolVersion: 4, PacketID: id}
+	if t == packets.Pubrel {
+		pk.FixedHeader.Qos = 1
+	}
+	return pk
+}
+
+// topicName returns the topic name of a topic id.
+func (s *snSession) topicName(idType byte, id uint16) (string, bool) {
+	switch idType {
+	case snTopicNormal:
+		name, ok := s.names[id]
+		return name, ok
+	case snTopicPredefined:
+		name, ok := s.l.config.MQTTSN.PredefinedTopics[id]
+		return name, ok
+	case snTopicShort:
+		return shortTopic(id), true
+	default:
+		return "", false
+	}
+}
+
+// filter returns the topic filter of a subscribe or unsubscribe packet, and the topic id
+// returned to the client in the suback. Topic names without wildcards are registered
+// when subscribing.
+func (s *snSession) filter(pk snPacket, register bool) (string, uint16, bool) {
+	switch pk.TopicIDType {
+	case snTopicPredefined:
+		name, ok := s.l.config.MQTTSN.PredefinedTopics[pk.TopicID]
+		return name, pk.TopicID, ok
+	case snTopicShort:
+		return pk.TopicName, 0, len(pk.TopicName) == 2
+	case snTopicNormal:
+		if pk.TopicName == "" {
+			return "", 0, false
+		}
+
+		if !register || strings.ContainsAny(pk.TopicName, "+#") {
+			return pk.TopicName, 0, true
+		}
+
+		return pk.TopicName, s.register(pk.TopicName), true
+	default:
+		return "", 0, false
+	}
+}
+
+// register returns the topic id of a topic name, registering it if needed.
+func (s *snSession) register(name string) uint16 {
+	if id, ok := s.ids[name]; ok {
+		return id
+	}
+
+	for {
+		s.nextID++
+		if _, ok := s.names[s.nextID]; !ok && s.nextID != 0 && s.nextID != 0xFFFF {
+			break
+		}
+	}
+
+	s.ids[name] = s.nextID
+	s.names[s.nextID] = name
+	return s.nextID
+}
+
+// unregister forgets a registered topic id.
+func (s *snSession) unregister(id uint16) {
+	delete(s.ids, s.names[id])
+	delete(s.names, id)
+}
+
+// bufferLimit returns the most publishes held for a sleeping client.
+func (s *snSession) bufferLimit() int {
+	if s.l.config.MQTTSN.MaxBufferedMessages <= 0 {
+		return defaultMQTTSNBufferedMessages
+	}
+
+	return s.l.config.MQTTSN.MaxBufferedMessages
+}
+
+// deliver translates a publish from the server for the client, registering its topic
+// with the client first if needed. Publishes are held while the client sleeps. Only
+// QoS 0 publishes are dropped when the buffer is full, as the server is waiting for
+// QoS 1 and 2 publishes to be acknowledged.
+func (s *snSession) deliver(p packets.Packet, b *snBatch) {
+	if s.state == snStateAsleep {
+		if len(s.buffered) >= s.bufferLimit() && p.FixedHeader.Qos == 0 {
+			s.l.log.Warn("mqtt-sn sleeping client buffer full, message dropped", "client", s.clientID, "topic", p.TopicName)
+			return
+		}
+
+		s.buffered = append(s.buffered, p)
+		return
+	}
+
+	pk := snPacket{
+		Type:   snPublish,
+		Dup:    p.FixedHeader.Dup,
+		Qos:    p.FixedHeader.Qos,
+		Retain: p.FixedHeader.Retain,
+		MsgID:  p.PacketID,
+		Data:   p.Payload,
+	}
+
+	if id, ok := s.l.predefined[p.TopicName]; ok {
+		pk.TopicIDType, pk.TopicID = snTopicPredefined, id
+	} else if len(p.TopicName) == 2 {
+		pk.TopicIDType, pk.TopicID = snTopicShort, shortTopicID(p.TopicName)
+	} else if id, ok := s.ids[p.TopicName]; ok && s.registering[id] == nil {
+		pk.TopicIDType, pk.TopicID = snTopicNormal, id
+	} else {
+		id := s.register(p.TopicName)
+		if _, pending := s.registering[id]; !pending {
+			s.nextMsgID++
+			if s.nextMsgID == 0 {
+				s.nextMsgID = 1
+			}
+			b.client = append(b.client, snPacket{Type: snRegister, TopicID: id, MsgID: s.nextMsgID, TopicName: p.TopicName})
+		}
+		s.registering[id] = append(s.registering[id], p)
+		return
+	}
+
+	b.client = append(b.client, pk)
+}
+
+// deliverBuffered delivers the publishes held while the client was asleep.
+func (s *snSession) deliverBuffered(b *snBatch) {
+	buffered := s.buffered
+	s.buffered = nil
+	for _, p := range buffered {
+		s.deliver(p, b)
+	}
+
+	if len(buffered) > 0 {
+		select {
+		case s.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wake delivers the publishes held for a sleeping client which has woken with a pingreq,
+// then tells the client to sleep again with a pingresp.
+func (s *snSession) wake(b *snBatch) {
+	s.sleepTimer.Reset(s.sleep * 3 / 2)
+	s.state = snStateAwake
+	s.deliverBuffered(b)
+	if len(s.registering) == 0 {
+		s.state = snStateAsleep
+		b.client = append(b.client, snPacket{Type: snPingresp})
+	}
+}
+
+// startSleeping puts the client to sleep. The gateway keeps the server connection alive
+// while the client sleeps, and ends the session if the client doesn't wake within the
+// sleep duration.
+func (s *snSession) startSleeping(d time.Duration) {
+	s.state = snStateAsleep
+	s.sleep = d
+
+	if s.sleepTimer != nil {
+		s.sleepTimer.Reset(d * 3 / 2)
+	} else {
+		s.sleepTimer = time.AfterFunc(d*3/2, func() {
+			s.l.log.Info("mqtt-sn sleeping client lost", "client", s.clientID)
+			_ = s.conn.Close()
+		})
+	}
+
+	if s.keepalive > 0 && s.pingStop == nil {
+		s.pingStop = make(chan struct{})
+		go s.pingLoop(time.Duration(s.keepalive)*time.Second, s.pingStop)
+	}
+}
+
+// stopSleeping stops the timers of a sleeping client.
+func (s *snSession) stopSleeping() {
+	if s.sleepTimer != nil {
+		s.sleepTimer.Stop()
+		s.sleepTimer = nil
+	}
+
+	if s.pingStop != nil {
+		close(s.pingStop)
+		s.pingStop = nil
+	}
+}
+
+// pingLoop sends pingreqs to the server for a sleeping client, so that the server
+// doesn't close the connection when its keepalive expires.
+func (s *snSession) pingLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.Lock()
+			s.pings++
+			s.Unlock()
+			if err := s.writeServer(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readServer translates the packets sent by the server until the connection is closed.
+func (s *snSession) readServer() {
+	defer close(s.read)
+	r := bufio.NewReader(s.conn)
+	for {
+		pk, err := readMQTTPacket(r, 4)
+		if err != nil {
+			_ = s.conn.Close()
+			return
+		}
+
+		s.fromServer(pk)
+		s.holdServer()
+	}
+}
+
+// holdServer stops reading from the server while the buffer of a sleeping client is
+// full, so that further publishes are held by the server until the client wakes.
+func (s *snSession) holdServer() {
+	for {
+		s.Lock()
+		full := s.state == snStateAsleep && len(s.buffered) >= s.bufferLimit()
+		s.Unlock()
+		if !full {
+			return
+		}
+
+		select {
+		case <-s.drained:
+		case <-s.closing:
+			return
+		case <-s.l.done: // the server disconnects its clients before the listener closes
+			return
+		}
+	}
+}
+
+// fromServer translates a packet sent by the server into packets for the client.
+func (s *snSession) fromServer(p packets.Packet) {
+	var b snBatch
+	s.Lock()
+	switch p.FixedHeader.Type {
+	case packets.Connack:
+		if p.ReasonCode == packets.CodeSuccess.Code {
+			s.state = snStateActive
+			b.client = append(b.client, snPacket{Type: snConnack, ReturnCode: snAccepted})
+			break
+		}
+
+		rc := snRejectedNotSupported
+		if p.ReasonCode == packets.Err3ServerUnavailable.Code {
+			rc = snRejectedCongestion
+		}
+		s.state = snStateDisconnected
+		b.client = append(b.client, snPacket{Type: snConnack, ReturnCode: rc})
+
+	case packets.Publish:
+		s.deliver(p, &b)
+
+	case packets.Puback:
+		topicID := s.pubacks[p.PacketID]
+		delete(s.pubacks, p.PacketID)
+		b.client = append(b.client, snPacket{Type: snPuback, TopicID: topicID, MsgID: p.PacketID, ReturnCode: snAccepted})
+
+	case packets.Pubrec:
+		b.client = append(b.client, snPacket{Type: snPubrec, MsgID: p.PacketID})
+
+	case packets.Pubrel:
+		b.client = append(b.client, snPacket{Type: snPubrel, MsgID: p.PacketID})
+
+	case packets.Pubcomp:
+		b.client = append(b.client, snPacket{Type: snPubcomp, MsgID: p.PacketID})
+
+	case packets.Suback:
+		topicID := s.subacks[p.PacketID]
+		delete(s.subacks, p.PacketID)
+		ack := snPacket{Type: snSuback, TopicID: topicID, MsgID: p.PacketID, ReturnCode: snAccepted}
+		if len(p.ReasonCodes) == 0 || p.ReasonCodes[0] >= packets.ErrUnspecifiedError.Code {
+			ack.TopicID, ack.ReturnCode = 0, snRejectedNotSupported
+		} else {
+			ack.Qos = p.ReasonCodes[0]
+		}
+		b.client = append(b.client, ack)
+
+	case packets.Unsuback:
+		b.client = append(b.client, snPacket{Type: snUnsuback, MsgID: p.PacketID})
+
+	case packets.Pingresp:
+		if s.pings > 0 {
+			s.pings-- // sent for a sleeping client
+		} else {
+			b.client = append(b.client, snPacket{Type: snPingresp})
+		}
+	}
+	addr := s.addr
+	s.Unlock()
+
+	for _, pk := range b.client {
+		s.l.send(addr, pk)
+	}
+}
+
+// writeServer writes an mqtt packet to the server connection.
+func (s *snSession) writeServer(pk packets.Packet) error {
+	return writeMQTTPacket(s.conn, pk)
+}
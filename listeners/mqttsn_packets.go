@@ -0,0 +1,332 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// MQTT-SN v1.2 message types.
+const (
+	snAdvertise     byte = 0x00
+	snSearchGw      byte = 0x01
+	snGwInfo        byte = 0x02
+	snConnect       byte = 0x04
+	snConnack       byte = 0x05
+	snWillTopicReq  byte = 0x06
+	snWillTopic     byte = 0x07
+	snWillMsgReq    byte = 0x08
+	snWillMsg       byte = 0x09
+	snRegister      byte = 0x0A
+	snRegack        byte = 0x0B
+	snPublish       byte = 0x0C
+	snPuback        byte = 0x0D
+	snPubcomp       byte = 0x0E
+	snPubrec        byte = 0x0F
+	snPubrel        byte = 0x10
+	snSubscribe     byte = 0x12
+	snSuback        byte = 0x13
+	snUnsubscribe   byte = 0x14
+	snUnsuback      byte = 0x15
+	snPingreq       byte = 0x16
+	snPingresp      byte = 0x17
+	snDisconnect    byte = 0x18
+	snWillTopicUpd  byte = 0x1A
+	snWillTopicResp byte = 0x1B
+	snWillMsgUpd    byte = 0x1C
+	snWillMsgResp   byte = 0x1D
+)
+
+// MQTT-SN v1.2 return codes.
+const (
+	snAccepted             byte = 0x00
+	snRejectedCongestion   byte = 0x01
+	snRejectedTopicID      byte = 0x02
+	snRejectedNotSupported byte = 0x03
+)
+
+// MQTT-SN v1.2 topic id types.
+const (
+	snTopicNormal     byte = 0x00 // a topic id registered with REGISTER, or a topic name in SUBSCRIBE
+	snTopicPredefined byte = 0x01 // a topic id configured on the gateway
+	snTopicShort      byte = 0x02 // a two character topic name carried in the topic id
+)
+
+// snQosMinusOne is the flags qos value of QoS -1 publishes, which are sent without a connection.
+const snQosMinusOne byte = 3
+
+var (
+	// ErrMQTTSNMalformed indicates that an MQTT-SN packet could not be decoded.
+	ErrMQTTSNMalformed = errors.New("malformed mqtt-sn packet")
+)
+
+// snPacket is an MQTT-SN packet. As with packets.Packet, a single type covers all
+// message types, and only the fields of the message type are used.
+type snPacket struct {
+	Type        byte   // the message type
+	Dup         bool   // the flags dup bit
+	Qos         byte   // the flags qos, with 3 for QoS -1
+	Retain      bool   // the flags retain bit
+	Will        bool   // the flags will bit
+	Clean       bool   // the flags clean session bit
+	TopicIDType byte   // the flags topic id type
+	ProtocolID  byte   // the protocol id of a connect packet
+	GatewayID   byte   // the gateway id of advertise and gwinfo packets
+	Radius      byte   // the broadcast radius of a searchgw packet
+	ReturnCode  byte   // the return code of ack packets
+	Duration    uint16 // the keepalive, sleep or advertise interval in seconds
+	TopicID     uint16 // the topic id, or the characters of a short topic
+	MsgID       uint16 // the message id
+	ClientID    string // the client id of connect and pingreq packets
+	TopicName   string // the topic name of register, subscribe, unsubscribe and will topic packets
+	Data        []byte // the publish payload, will message or gateway address
+}
+
+// flags returns the flags byte of the packet.
+func (pk *snPacket) flags() byte {
+	var b byte
+	if pk.Dup {
+		b |= 0x80
+	}
+	b |= (pk.Qos & 0x03) << 5
+	if pk.Retain {
+		b |= 0x10
+	}
+	if pk.Will {
+		b |= 0x08
+	}
+	if pk.Clean {
+		b |= 0x04
+	}
+	return b | pk.TopicIDType&0x03
+}
+
+// setFlags sets the fields of the packet from a flags byte.
+func (pk *snPacket) setFlags(b byte) {
+	pk.Dup = b&0x80 > 0
+	pk.Qos = (b >> 5) & 0x03
+	pk.Retain = b&0x10 > 0
+	pk.Will = b&0x08 > 0
+	pk.Clean = b&0x04 > 0
+	pk.TopicIDType = b & 0x03
+}
+
+// shortTopic returns the topic name of a short topic id.
+func shortTopic(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+// shortTopicID returns the topic id of a two character topic name.
+func shortTopicID(name string) uint16 {
+	return uint16(name[0])<<8 | uint16(name[1])
+}
+
+// Encode returns the packet encoded as an MQTT-SN message.
+func (pk *snPacket) Encode() []byte {
+	var body bytes.Buffer
+	u16 := func(v uint16) {
+		body.Write(binary.BigEndian.AppendUint16(nil, v))
+	}
+
+	switch pk.Type {
+	case snAdvertise:
+		body.WriteByte(pk.GatewayID)
+		u16(pk.Duration)
+	case snSearchGw:
+		body.WriteByte(pk.Radius)
+	case snGwInfo:
+		body.WriteByte(pk.GatewayID)
+		body.Write(pk.Data)
+	case snConnect:
+		body.WriteByte(pk.flags())
+		body.WriteByte(pk.ProtocolID)
+		u16(pk.Duration)
+		body.WriteString(pk.ClientID)
+	case snConnack, snWillTopicResp, snWillMsgResp:
+		body.WriteByte(pk.ReturnCode)
+	case snWillTopic, snWillTopicUpd:
+		if pk.TopicName != "" {
+			body.WriteByte(pk.flags())
+			body.WriteString(pk.TopicName)
+		}
+	case snWillMsg, snWillMsgUpd:
+		body.Write(pk.Data)
+	case snRegister:
+		u16(pk.TopicID)
+		u16(pk.MsgID)
+		body.WriteString(pk.TopicName)
+	case snRegack, snPuback:
+		u16(pk.TopicID)
+		u16(pk.MsgID)
+		body.WriteByte(pk.ReturnCode)
+	case snPublish:
+		body.WriteByte(pk.flags())
+		u16(pk.TopicID)
+		u16(pk.MsgID)
+		body.Write(pk.Data)
+	case snPubcomp, snPubrec, snPubrel, snUnsuback:
+		u16(pk.MsgID)
+	case snSubscribe, snUnsubscribe:
+		body.WriteByte(pk.flags())
+		u16(pk.MsgID)
+		if pk.TopicIDType == snTopicPredefined {
+			u16(pk.TopicID)
+		} else {
+			body.WriteString(pk.TopicName)
+		}
+	case snSuback:
+		body.WriteByte(pk.flags())
+		u16(pk.TopicID)
+		u16(pk.MsgID)
+		body.WriteByte(pk.ReturnCode)
+	case snPingreq:
+		body.WriteString(pk.ClientID)
+	case snDisconnect:
+		if pk.Duration > 0 {
+			u16(pk.Duration)
+		}
+	}
+
+	var out []byte
+	if n := body.Len() + 2; n <= 0xFF {
+		out = append(out, byte(n), pk.Type)
+	} else {
+		out = append(out, 0x01)
+		out = binary.BigEndian.AppendUint16(out, uint16(n+2))
+		out = append(out, pk.Type)
+	}
+
+	return append(out, body.Bytes()...)
+}
+
+// decodeSN decodes an MQTT-SN message.
+func decodeSN(b []byte) (snPacket, error) {
+	var pk snPacket
+	if len(b) < 2 {
+		return pk, ErrMQTTSNMalformed
+	}
+
+	var body []byte
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return pk, ErrMQTTSNMalformed
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if n < 4 || n > len(b) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.Type, body = b[3], b[4:n]
+	} else {
+		n := int(b[0])
+		if n < 2 || n > len(b) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.Type, body = b[1], b[2:n]
+	}
+
+	// need returns false if the body is shorter than n bytes.
+	need := func(n int) bool {
+		return len(body) >= n
+	}
+	u16 := func(i int) uint16 {
+		return binary.BigEndian.Uint16(body[i : i+2])
+	}
+
+	switch pk.Type {
+	case snAdvertise:
+		if !need(3) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.GatewayID, pk.Duration = body[0], u16(1)
+	case snSearchGw:
+		if !need(1) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.Radius = body[0]
+	case snGwInfo:
+		if !need(1) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.GatewayID, pk.Data = body[0], body[1:]
+	case snConnect:
+		if !need(4) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.setFlags(body[0])
+		pk.ProtocolID, pk.Duration, pk.ClientID = body[1], u16(2), string(body[4:])
+	case snConnack, snWillTopicResp, snWillMsgResp:
+		if !need(1) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.ReturnCode = body[0]
+	case snWillTopic, snWillTopicUpd:
+		if need(1) {
+			pk.setFlags(body[0])
+			pk.TopicName = string(body[1:])
+		}
+	case snWillMsg, snWillMsgUpd:
+		pk.Data = body
+	case snRegister:
+		if !need(4) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.TopicID, pk.MsgID, pk.TopicName = u16(0), u16(2), string(body[4:])
+	case snRegack, snPuback:
+		if !need(5) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.TopicID, pk.MsgID, pk.ReturnCode = u16(0), u16(2), body[4]
+	case snPublish:
+		if !need(5) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.setFlags(body[0])
+		pk.TopicID, pk.MsgID, pk.Data = u16(1), u16(3), body[5:]
+	case snPubcomp, snPubrec, snPubrel, snUnsuback:
+		if !need(2) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.MsgID = u16(0)
+	case snSubscribe, snUnsubscribe:
+		if !need(3) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.setFlags(body[0])
+		pk.MsgID = u16(1)
+		switch pk.TopicIDType {
+		case snTopicPredefined:
+			if !need(5) {
+				return pk, ErrMQTTSNMalformed
+			}
+			pk.TopicID = u16(3)
+		case snTopicShort:
+			if len(body) != 5 {
+				return pk, ErrMQTTSNMalformed
+			}
+			pk.TopicName = string(body[3:])
+		default:
+			pk.TopicName = string(body[3:])
+		}
+	case snSuback:
+		if !need(6) {
+			return pk, ErrMQTTSNMalformed
+		}
+		pk.setFlags(body[0])
+		pk.TopicID, pk.MsgID, pk.ReturnCode = u16(1), u16(3), body[5]
+	case snPingreq:
+		pk.ClientID = string(body)
+	case snDisconnect:
+		if need(2) {
+			pk.Duration = u16(0)
+		}
+	case snWillTopicReq, snWillMsgReq, snPingresp:
+	default:
+		return pk, ErrMQTTSNMalformed
+	}
+
+	return pk, nil
+}
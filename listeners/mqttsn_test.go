@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNPacketEncodeDecode(t *testing.T) {
+	tt := []snPacket{
+		{Type: snAdvertise, GatewayID: 3, Duration: 900},
+		{Type: snSearchGw, Radius: 1},
+		{Type: snGwInfo, GatewayID: 3, Data: []byte{}},
+		{Type: snConnect, Will: true, Clean: true, ProtocolID: 1, Duration: 60, ClientID: "sensor1"},
+		{Type: snConnack, ReturnCode: snRejectedCongestion},
+		{Type: snWillTopicReq},
+		{Type: snWillTopic, Qos: 1, Retain: true, TopicName: "sensors/1/status"},
+		{Type: snWillMsg, Data: []byte("offline")},
+		{Type: snRegister, TopicID: 1, MsgID: 2, TopicName: "sensors/1/temp"},
+		{Type: snRegack, TopicID: 1, MsgID: 2, ReturnCode: snAccepted},
+		{Type: snPublish, Dup: true, Qos: 2, Retain: true, TopicIDType: snTopicPredefined, TopicID: 7, MsgID: 3, Data: []byte("21")},
+		{Type: snPuback, TopicID: 1, MsgID: 3, ReturnCode: snRejectedTopicID},
+		{Type: snPubrec, MsgID: 4},
+		{Type: snPubrel, MsgID: 4},
+		{Type: snPubcomp, MsgID: 4},
+		{Type: snSubscribe, Qos: 1, MsgID: 5, TopicName: "sensors/#"},
+		{Type: snSubscribe, TopicIDType: snTopicPredefined, MsgID: 5, TopicID: 7},
+		{Type: snSubscribe, TopicIDType: snTopicShort, MsgID: 5, TopicName: "ab"},
+		{Type: snSuback, Qos: 1, TopicID: 1, MsgID: 5, ReturnCode: snAccepted},
+		{Type: snUnsubscribe, MsgID: 6, TopicName: "sensors/#"},
+		{Type: snUnsuback, MsgID: 6},
+		{Type: snPingreq, ClientID: "sensor1"},
+		{Type: snPingresp},
+		{Type: snDisconnect, Duration: 60},
+		{Type: snWillTopicResp, ReturnCode: snRejectedNotSupported},
+	}
+
+	for _, pk := range tt {
+		b := pk.Encode()
+		require.Equal(t, int(b[0]), len(b))
+
+		got, err := decodeSN(b)
+		require.NoError(t, err)
+		if pk.Data == nil && got.Data != nil && len(got.Data) == 0 {
+			got.Data = nil
+		}
+		require.Equal(t, pk, got, "type %x", pk.Type)
+	}
+}
+
+func TestSNPacketLongEncoding(t *testing.T) {
+	pk := snPacket{Type: snPublish, TopicID: 1, MsgID: 1, Data: bytes.Repeat([]byte{'a'}, 300)}
+	b := pk.Encode()
+	require.Equal(t, byte(0x01), b[0])
+	require.Equal(t, []byte{0x01, 0x35}, b[1:3]) // 4 byte header, 5 byte publish header, 300 byte payload
+	require.Equal(t, snPublish, b[3])
+
+	got, err := decodeSN(b)
+	require.NoError(t, err)
+	require.Equal(t, pk, got)
+}
+
+func TestDecodeSNMalformed(t *testing.T) {
+	tt := [][]byte{
+		{},
+		{0x02},
+		{0x05, snPublish},               // length exceeds datagram
+		{0x01, 0x00},                    // short long header
+		{0x01, 0x00, 0x02, snPublish},   // long length too short
+		{0x03, snConnack},               // length exceeds datagram
+		{0x04, snPublish, 0x00, 0x00},   // short publish
+		{0x05, snRegister, 0x00, 0x01},  // short register
+		{0x04, snSubscribe, 0x02, 0x00}, // short subscribe
+		{0x02, 0x03},                    // unknown type
+	}
+
+	for _, b := range tt {
+		_, err := decodeSN(b)
+		require.ErrorIs(t, err, ErrMQTTSNMalformed, "%v", b)
+	}
+}
+
+func TestShortTopic(t *testing.T) {
+	require.Equal(t, uint16(0x6162), shortTopicID("ab"))
+	require.Equal(t, "ab", shortTopic(0x6162))
+}
+
+func TestNewMQTTSN(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "sn1", Address: testAddr, MQTTSN: &MQTTSNConfig{
+		PredefinedTopics: map[uint16]string{7: "sensors/shared"},
+	}})
+
+	require.Equal(t, "sn1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "mqttsn", l.Protocol())
+	require.Nil(t, l.Policy())
+	require.Equal(t, uint16(7), l.predefined["sensors/shared"])
+
+	l = NewMQTTSN(basicConfig)
+	require.NotNil(t, l.config.MQTTSN)
+}
+
+func TestMQTTSNInitInvalidPredefinedTopic(t *testing.T) {
+	for _, topics := range []map[uint16]string{{0: "a/b"}, {1: ""}, {2: "a/#"}} {
+		l := NewMQTTSN(Config{ID: "sn1", Address: "127.0.0.1:0", MQTTSN: &MQTTSNConfig{PredefinedTopics: topics}})
+		require.Error(t, l.Init(logger))
+	}
+}
+
+// serveMQTTSN serves an MQTT-SN listener on a loopback port, returning a udp client
+// connected to it.
+func serveMQTTSN(t *testing.T, config *MQTTSNConfig) (*MQTTSN, *net.UDPConn) {
+	l := NewMQTTSN(Config{ID: "sn1", Address: "127.0.0.1:0", MQTTSN: config})
+	require.NoError(t, l.Init(logger))
+	go l.Serve(MockEstablisher)
+	t.Cleanup(func() { l.Close(MockCloser) })
+
+	addr, err := net.ResolveUDPAddr("udp", l.Address())
+	require.NoError(t, err)
+	c, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	return l, c
+}
+
+// readSN reads an MQTT-SN packet from a udp connection.
+func readSN(t *testing.T, c net.Conn) snPacket {
+	buf := make([]byte, 1024)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+
+	pk, err := decodeSN(buf[:n])
+	require.NoError(t, err)
+	return pk
+}
+
+func TestMQTTSNSearchGateway(t *testing.T) {
+	_, c := serveMQTTSN(t, &MQTTSNConfig{GatewayID: 9})
+
+	_, err := c.Write((&snPacket{Type: snSearchGw, Radius: 1}).Encode())
+	require.NoError(t, err)
+
+	pk := readSN(t, c)
+	require.Equal(t, snGwInfo, pk.Type)
+	require.Equal(t, byte(9), pk.GatewayID)
+}
+
+func TestMQTTSNUnknownClientDisconnected(t *testing.T) {
+	_, c := serveMQTTSN(t, nil)
+
+	_, err := c.Write((&snPacket{Type: snPingreq}).Encode())
+	require.NoError(t, err)
+	require.Equal(t, snDisconnect, readSN(t, c).Type)
+}
+
+func TestMQTTSNAdvertise(t *testing.T) {
+	recv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer recv.Close()
+
+	serveMQTTSN(t, &MQTTSNConfig{
+		GatewayID:         4,
+		AdvertiseAddress:  recv.LocalAddr().String(),
+		AdvertiseInterval: 60,
+	})
+
+	pk := readSN(t, recv)
+	require.Equal(t, snAdvertise, pk.Type)
+	require.Equal(t, byte(4), pk.GatewayID)
+	require.Equal(t, uint16(60), pk.Duration)
+}
+
+func TestMQTTSNServeAndClose(t *testing.T) {
+	l := NewMQTTSN(Config{ID: "sn1", Address: "127.0.0.1:0"})
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import "errors"
+
+var (
+	// ErrInvalidPolicyQos indicates the maximum qos of a policy was greater than 2.
+	ErrInvalidPolicyQos = errors.New("policy maximum qos must be 0, 1 or 2")
+
+	// ErrInvalidPolicyReceiveMaximum indicates the receive maximum of a policy was 0.
+	ErrInvalidPolicyReceiveMaximum = errors.New("policy receive maximum must be greater than 0")
+
+	// ErrInvalidPolicyKeepalive indicates the minimum keepalive of a policy was greater than its maximum.
+	ErrInvalidPolicyKeepalive = errors.New("policy minimum keepalive must not exceed the maximum keepalive")
+
+	// ErrInvalidPolicyProtocol indicates a policy accepted an unknown mqtt protocol version.
+	ErrInvalidPolicyProtocol = errors.New("policy protocol versions must be 3, 4 or 5")
+)
+
+// Policy overrides the server capabilities and connection policy for the clients
+// of a listener. Fields which are not set inherit the server values.
+type Policy struct {
+	MaximumPacketSize            *uint32  `yaml:"maximum_packet_size" json:"maximum_packet_size"`                         // maximum packet size, no limit if 0
+	MaximumSessionExpiryInterval *uint32  `yaml:"maximum_session_expiry_interval" json:"maximum_session_expiry_interval"` // maximum number of seconds to keep disconnected sessions
+	MaximumClientWritesPending   *int32   `yaml:"maximum_client_writes_pending" json:"maximum_client_writes_pending"`     // maximum number of pending message writes for a client
+	ReceiveMaximum               *uint16  `yaml:"receive_maximum" json:"receive_maximum"`                                 // maximum number of concurrent qos messages per client
+	MaximumInflight              *uint16  `yaml:"maximum_inflight" json:"maximum_inflight"`                               // maximum number of qos > 0 messages can be stored
+	TopicAliasMaximum            *uint16  `yaml:"topic_alias_maximum" json:"topic_alias_maximum"`                         // maximum topic alias value
+	MaximumQos                   *byte    `yaml:"maximum_qos" json:"maximum_qos"`                                         // maximum qos value available to clients
+	RetainAvailable              *byte    `yaml:"retain_available" json:"retain_available"`                               // support of retain messages
+	MaximumClients               int64    `yaml:"maximum_clients" json:"maximum_clients"`                                 // maximum number of clients connected to the listener, no limit if 0
+	MinimumKeepalive             uint16   `yaml:"minimum_keepalive" json:"minimum_keepalive"`                             // minimum keepalive in seconds, no minimum if 0
+	MaximumKeepalive             uint16   `yaml:"maximum_keepalive" json:"maximum_keepalive"`                             // maximum keepalive in seconds, no maximum if 0
+	AuthHooks                    []string `yaml:"auth_hooks" json:"auth_hooks"`                                           // ids of the hooks which authenticate clients and check acls, all hooks if empty
+	ProtocolVersions             []byte   `yaml:"protocol_versions" json:"protocol_versions"`                             // mqtt protocol versions accepted (3, 4, 5), all versions if empty
+}
+
+// PolicyListener is implemented by listeners which apply a Policy to their clients.
+type PolicyListener interface {
+	Policy() *Policy // the policy of the listener, or nil if the server policy applies
+}
+
+// Validate returns an error if the policy can't be applied to clients.
+func (p *Policy) Validate() error {
+	if p.MaximumQos != nil && *p.MaximumQos > 2 {
+		return ErrInvalidPolicyQos
+	}
+
+	if p.ReceiveMaximum != nil && *p.ReceiveMaximum == 0 {
+		return ErrInvalidPolicyReceiveMaximum // a receive maximum of 0 is a protocol error
+	}
+
+	if p.MaximumKeepalive > 0 && p.MinimumKeepalive > p.MaximumKeepalive {
+		return ErrInvalidPolicyKeepalive
+	}
+
+	for _, v := range p.ProtocolVersions {
+		if v < 3 || v > 5 {
+			return ErrInvalidPolicyProtocol
+		}
+	}
+
+	return nil
+}
+
+// AllowsProtocol returns true if clients may connect with the mqtt protocol version.
+func (p *Policy) AllowsProtocol(v byte) bool {
+	if len(p.ProtocolVersions) == 0 {
+		return true
+	}
+
+	for _, pv := range p.ProtocolVersions {
+		if pv == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsAuthHook returns true if the hook with the given id may authenticate clients
+// and check their acls.
+func (p *Policy) AllowsAuthHook(id string) bool {
+	if len(p.AuthHooks) == 0 {
+		return true
+	}
+
+	for _, h := range p.AuthHooks {
+		if h == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keepalive returns the keepalive to use for a client requesting keepalive k, bounded by
+// the minimum and maximum keepalive of the policy. A keepalive of 0 disables keepalive,
+// so it is bounded to the maximum if one is set, or otherwise raised to the minimum.
+func (p *Policy) Keepalive(k uint16) uint16 {
+	if p.MaximumKeepalive > 0 && (k == 0 || k > p.MaximumKeepalive) {
+		return p.MaximumKeepalive
+	}
+
+	if k < p.MinimumKeepalive {
+		return p.MinimumKeepalive
+	}
+
+	return k
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	qos2, qos3 := byte(2), byte(3)
+	rm0, rm1 := uint16(0), uint16(1)
+
+	tt := []struct {
+		desc   string
+		policy Policy
+		err    error
+	}{
+		{desc: "empty", policy: Policy{}},
+		{desc: "qos", policy: Policy{MaximumQos: &qos2}},
+		{desc: "invalid qos", policy: Policy{MaximumQos: &qos3}, err: ErrInvalidPolicyQos},
+		{desc: "receive maximum", policy: Policy{ReceiveMaximum: &rm1}},
+		{desc: "zero receive maximum", policy: Policy{ReceiveMaximum: &rm0}, err: ErrInvalidPolicyReceiveMaximum},
+		{desc: "keepalive", policy: Policy{MinimumKeepalive: 10, MaximumKeepalive: 10}},
+		{desc: "minimum keepalive without maximum", policy: Policy{MinimumKeepalive: 10}},
+		{desc: "minimum keepalive above maximum", policy: Policy{MinimumKeepalive: 11, MaximumKeepalive: 10}, err: ErrInvalidPolicyKeepalive},
+		{desc: "protocol versions", policy: Policy{ProtocolVersions: []byte{3, 4, 5}}},
+		{desc: "protocol version 2", policy: Policy{ProtocolVersions: []byte{2}}, err: ErrInvalidPolicyProtocol},
+		{desc: "protocol version 6", policy: Policy{ProtocolVersions: []byte{5, 6}}, err: ErrInvalidPolicyProtocol},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			require.ErrorIs(t, tx.policy.Validate(), tx.err)
+		})
+	}
+}
+
+func TestPolicyAllowsProtocol(t *testing.T) {
+	p := new(Policy)
+	require.True(t, p.AllowsProtocol(3))
+	require.True(t, p.AllowsProtocol(5))
+
+	p.ProtocolVersions = []byte{4, 5}
+	require.False(t, p.AllowsProtocol(3))
+	require.True(t, p.AllowsProtocol(4))
+	require.True(t, p.AllowsProtocol(5))
+}
+
+func TestPolicyAllowsAuthHook(t *testing.T) {
+	p := new(Policy)
+	require.True(t, p.AllowsAuthHook("auth-ledger"))
+
+	p.AuthHooks = []string{"auth-ledger"}
+	require.True(t, p.AllowsAuthHook("auth-ledger"))
+	require.False(t, p.AllowsAuthHook("allow-all-auth"))
+}
+
+func TestPolicyKeepalive(t *testing.T) {
+	tt := []struct {
+		min, max, k, want uint16
+	}{
+		{0, 0, 0, 0},
+		{0, 0, 30, 30},
+		{10, 0, 5, 10},
+		{10, 0, 0, 10},
+		{0, 60, 90, 60},
+		{0, 60, 0, 60},
+		{10, 60, 30, 30},
+	}
+
+	for _, tx := range tt {
+		p := &Policy{MinimumKeepalive: tx.min, MaximumKeepalive: tx.max}
+		require.Equal(t, tx.want, p.Keepalive(tx.k), tx)
+	}
+}
+
+func TestListenerPolicy(t *testing.T) {
+	p := &Policy{MaximumClients: 10}
+	var ls = []Listener{
+		NewTCP(Config{ID: "t1", Policy: p}),
+		NewWebsocket(Config{ID: "ws1", Policy: p}),
+		NewUnixSock(Config{ID: "unix1", Policy: p}),
+	}
+
+	for _, l := range ls {
+		pl, ok := l.(PolicyListener)
+		require.True(t, ok, l.ID())
+		require.Same(t, p, pl.Policy())
+	}
+
+	ml := NewMockListener("m1", ":1882")
+	require.Nil(t, ml.Policy())
+	ml.Config = &Config{Policy: p}
+	require.Same(t, p, ml.Policy())
+}
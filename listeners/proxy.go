@@ -0,0 +1,477 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyV1Prefix          = "PROXY "        // the beginning of a v1 header
+	proxyV1MaxLength       = 107             // the maximum length of a v1 header, including the line ending
+	proxyV2HeaderLength    = 16              // the length of the fixed part of a v2 header
+	proxyV2CmdLocal        = 0x0             // a v2 connection established by the proxy itself, eg. a health check
+	proxyV2CmdProxy        = 0x1             // a v2 connection relayed on behalf of a client
+	proxyV2FamilyInet      = 0x1             // v2 ipv4 address family
+	proxyV2FamilyInet6     = 0x2             // v2 ipv6 address family
+	proxyDefaultTimeout    = 5 * time.Second // the default time allowed for a proxy to send a header
+	ProxyTLVAlpn           = 0x01            // v2 tlv carrying the negotiated application protocol
+	ProxyTLVAuthority      = 0x02            // v2 tlv carrying the host name the client requested (sni)
+	ProxyTLVUniqueID       = 0x05            // v2 tlv carrying a unique id for the connection
+	ProxyTLVSSL            = 0x20            // v2 tlv carrying details of a tls connection terminated by the proxy
+	ProxyTLVNetNS          = 0x30            // v2 tlv carrying the network namespace
+	ProxyTLVAWSVPCEndpoint = 0xEA            // v2 tlv carrying the aws vpc endpoint id
+)
+
+var (
+	// proxyV2Signature is the signature which begins every v2 header.
+	proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	// ErrProxyHeaderMissing indicates a trusted proxy did not send a required PROXY protocol header.
+	ErrProxyHeaderMissing = errors.New("proxy protocol header missing")
+
+	// ErrProxyHeaderInvalid indicates a PROXY protocol header could not be parsed.
+	ErrProxyHeaderInvalid = errors.New("proxy protocol header invalid")
+
+	// ErrNoTrustedProxies indicates proxy handling was enabled without any trusted proxies.
+	ErrNoTrustedProxies = errors.New("proxy handling requires at least one trusted proxy")
+)
+
+// ProxyConfig configures how a listener accepts the original address of clients which
+// connect through proxies and load balancers.
+type ProxyConfig struct {
+	ProxyProtocol    bool     `yaml:"proxy_protocol" json:"proxy_protocol"`       // parse PROXY protocol v1 and v2 headers before the mqtt or tls handshake
+	Required         bool     `yaml:"required" json:"required"`                   // reject connections from trusted proxies which don't send a PROXY protocol header
+	ForwardedHeaders bool     `yaml:"forwarded_headers" json:"forwarded_headers"` // websocket and http gateway: use the X-Forwarded-For and Forwarded headers sent by trusted proxies
+	TrustedProxies   []string `yaml:"trusted_proxies" json:"trusted_proxies"`     // addresses or CIDRs of the proxies to trust, required if proxy handling is enabled
+	HeaderTimeout    int64    `yaml:"header_timeout" json:"header_timeout"`       // seconds allowed for a proxy to send a PROXY protocol header, default 5
+}
+
+// ProxyTLV is a type-length-value field of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	Version     byte       // the protocol version of the header, 1 or 2
+	Source      net.Addr   // the address of the client, nil if the proxy did not relay one
+	Destination net.Addr   // the address the client connected to, nil if the proxy did not relay one
+	TLVs        []ProxyTLV // any v2 type-length-value fields
+}
+
+// TLV returns the value of the first type-length-value field of a type.
+func (h *ProxyHeader) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// trustedProxies is a set of networks which proxy headers are accepted from.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of addresses and CIDRs into trusted networks.
+func parseTrustedProxies(v []string) (trustedProxies, error) {
+	t := make(trustedProxies, 0, len(v))
+	for _, s := range v {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		t = append(t, n)
+	}
+
+	return t, nil
+}
+
+// newTrustedProxies returns the trusted networks of a proxy config. Proxy handling must name
+// the proxies it trusts, otherwise any client could claim any address.
+func newTrustedProxies(config *ProxyConfig) (trustedProxies, error) {
+	if (config.ProxyProtocol || config.ForwardedHeaders) && len(config.TrustedProxies) == 0 {
+		return nil, ErrNoTrustedProxies
+	}
+
+	return parseTrustedProxies(config.TrustedProxies)
+}
+
+// contains returns true if an ip belongs to a trusted network. No addresses are trusted
+// if no networks are configured.
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addrIP returns the ip of a network address, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// proxyListener is a net.Listener which accepts connections carrying PROXY protocol headers.
+type proxyListener struct {
+	net.Listener
+	config  *ProxyConfig
+	trusted trustedProxies
+	timeout time.Duration
+}
+
+// newProxyListener wraps a listener so that accepted connections from trusted proxies
+// report the client address sent in their PROXY protocol header.
+func newProxyListener(l net.Listener, config *ProxyConfig) (net.Listener, error) {
+	trusted, err := newTrustedProxies(config)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := proxyDefaultTimeout
+	if config.HeaderTimeout > 0 {
+		timeout = time.Duration(config.HeaderTimeout) * time.Second
+	}
+
+	return &proxyListener{
+		Listener: l,
+		config:   config,
+		trusted:  trusted,
+		timeout:  timeout,
+	}, nil
+}
+
+// Accept returns the next connection. Headers are read by the connection when it is
+// first used, so a slow proxy does not hold up the listener.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.trusted.contains(addrIP(c.RemoteAddr())) {
+		return c, nil
+	}
+
+	return &ProxyConn{
+		Conn:     c,
+		r:        bufio.NewReader(c),
+		required: l.config.Required,
+		timeout:  l.timeout,
+	}, nil
+}
+
+// ProxyConn is a connection from a trusted proxy which may begin with a PROXY protocol header.
+type ProxyConn struct {
+	net.Conn
+	r        *bufio.Reader // buffers the header and any bytes read after it
+	header   *ProxyHeader  // the parsed header, nil if none was sent
+	err      error         // any error reading the header
+	once     sync.Once     // the header is read once
+	required bool          // the connection must begin with a header
+	timeout  time.Duration // the time allowed for the header to arrive
+}
+
+// readHeader reads the PROXY protocol header, if any, from the start of the connection.
+func (c *ProxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.header, c.err = readProxyHeader(c.r)
+		if c.err == nil && c.header == nil && c.required {
+			c.err = ErrProxyHeaderMissing
+		}
+	})
+}
+
+// Read reads data from the connection, following any PROXY protocol header.
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address sent by the proxy, or the address of the proxy
+// if it didn't send one.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, as sent by the proxy.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// ProxyHeader returns the PROXY protocol header sent at the start of the connection.
+func (c *ProxyConn) ProxyHeader() (*ProxyHeader, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+// ProxyHeaderOf returns the PROXY protocol header of a client connection, if any,
+// looking through tls and websocket connections to the underlying connection.
+func ProxyHeaderOf(c net.Conn) (*ProxyHeader, bool) {
+	for c != nil {
+		switch v := c.(type) {
+		case *ProxyConn:
+			h, err := v.ProxyHeader()
+			return h, err == nil && h != nil
+		case *tls.Conn:
+			c = v.NetConn()
+		case *wsConn:
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from the reader. If the data
+// does not begin with a header, nothing is consumed and a nil header is returned.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyV1Prefix[0]:
+		if b, err = r.Peek(len(proxyV1Prefix)); err != nil || string(b) != proxyV1Prefix {
+			return nil, nil
+		}
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		if b, err = r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyHeaderV2(r)
+	}
+
+	return nil, nil
+}
+
+// readProxyHeaderV1 reads a human-readable v1 header, eg. PROXY TCP4 1.2.3.4 5.6.7.8 1000 1883.
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrProxyHeaderInvalid
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	h := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	h.Source = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return h, nil
+}
+
+// readProxyHeaderV2 reads a binary v2 header and any type-length-value fields.
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 2 {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	cmd := fixed[12] & 0x0F
+	if cmd == proxyV2CmdLocal {
+		return h, nil // the proxy's own address is the real one
+	}
+
+	if cmd != proxyV2CmdProxy {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	var n int
+	switch fixed[13] >> 4 {
+	case proxyV2FamilyInet:
+		n = 4
+	case proxyV2FamilyInet6:
+		n = 16
+	}
+
+	if n > 0 {
+		if len(body) < n*2+4 {
+			return nil, ErrProxyHeaderInvalid
+		}
+
+		h.Source = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[n*2:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[n : n*2]), Port: int(binary.BigEndian.Uint16(body[n*2+2:]))}
+		body = body[n*2+4:]
+	} else {
+		body = nil // unix and unspecified addresses aren't useful to the broker, and their tlvs can't be located
+	}
+
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, ErrProxyHeaderInvalid
+		}
+
+		l := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+l {
+			return nil, ErrProxyHeaderInvalid
+		}
+
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: body[0], Value: body[3 : 3+l]})
+		body = body[3+l:]
+	}
+
+	return h, nil
+}
+
+// forwardedAddr returns the address of the client which made a request through trusted
+// proxies, using the Forwarded or X-Forwarded-For headers. The chain of addresses is
+// walked from the nearest proxy, and the first untrusted address is the client.
+func forwardedAddr(r *http.Request, trusted trustedProxies) (net.Addr, bool) {
+	var chain []string
+	if v := r.Header.Values("Forwarded"); len(v) > 0 {
+		for _, elem := range strings.Split(strings.Join(v, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					chain = append(chain, strings.Trim(val, `"`))
+				}
+			}
+		}
+	} else if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 {
+		for _, s := range strings.Split(strings.Join(v, ","), ",") {
+			chain = append(chain, strings.TrimSpace(s))
+		}
+	}
+
+	var addr net.Addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		a := parseForwardedNode(chain[i])
+		if a == nil {
+			break // unknown or obfuscated identifiers can't be followed
+		}
+
+		addr = a
+		if !trusted.contains(a.IP) {
+			break
+		}
+	}
+
+	return addr, addr != nil
+}
+
+// parseForwardedNode parses a node address from a forwarding header, with an optional port
+// and ipv6 brackets.
+func parseForwardedNode(s string) *net.TCPAddr {
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
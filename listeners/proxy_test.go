@@ -0,0 +1,374 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a v2 PROXY header for an ipv4 tcp connection with the given tlvs.
+func proxyV2Header(cmd byte, src, dst string, srcPort, dstPort uint16, tlvs ...ProxyTLV) []byte {
+	body := new(bytes.Buffer)
+	body.Write(net.ParseIP(src).To4())
+	body.Write(net.ParseIP(dst).To4())
+	_ = binary.Write(body, binary.BigEndian, srcPort)
+	_ = binary.Write(body, binary.BigEndian, dstPort)
+	for _, tlv := range tlvs {
+		body.WriteByte(tlv.Type)
+		_ = binary.Write(body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, proxyV2FamilyInet<<4|0x1)
+	b = binary.BigEndian.AppendUint16(b, uint16(body.Len()))
+	return append(b, body.Bytes()...)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n\x10rest"))
+	h, err := readProxyHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), h.Version)
+	require.Equal(t, "192.0.2.1:56324", h.Source.String())
+	require.Equal(t, "198.51.100.1:1883", h.Destination.String())
+
+	rest, _ := io.ReadAll(r)
+	require.Equal(t, "\x10rest", string(rest))
+}
+
+func TestReadProxyHeaderV1IPv6(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1883\r\n"))
+	h, err := readProxyHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:4000", h.Source.String())
+}
+
+func TestReadProxyHeaderV1Unknown(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	h, err := readProxyHeader(r)
+	require.NoError(t, err)
+	require.Nil(t, h.Source)
+}
+
+func TestReadProxyHeaderV1Invalid(t *testing.T) {
+	tt := []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 nope 198.51.100.1 56324 1883\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 99999 1883\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 1883\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\n",
+		"PROXY " + strings.Repeat("a", proxyV1MaxLength) + "\r\n",
+	}
+
+	for _, tx := range tt {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(tx)))
+		require.ErrorIs(t, err, ErrProxyHeaderInvalid, tx)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	b := proxyV2Header(proxyV2CmdProxy, "192.0.2.1", "198.51.100.1", 56324, 1883,
+		ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("mqtt.example.com")},
+		ProxyTLV{Type: ProxyTLVAWSVPCEndpoint, Value: []byte("\x01vpce-123")},
+	)
+
+	r := bufio.NewReader(bytes.NewReader(append(b, 0x10)))
+	h, err := readProxyHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, byte(2), h.Version)
+	require.Equal(t, "192.0.2.1:56324", h.Source.String())
+	require.Equal(t, "198.51.100.1:1883", h.Destination.String())
+	require.Len(t, h.TLVs, 2)
+
+	v, ok := h.TLV(ProxyTLVAuthority)
+	require.True(t, ok)
+	require.Equal(t, "mqtt.example.com", string(v))
+	_, ok = h.TLV(ProxyTLVSSL)
+	require.False(t, ok)
+
+	next, err := r.ReadByte()
+	require.NoError(t, err)
+	require.Equal(t, byte(0x10), next)
+}
+
+func TestReadProxyHeaderV2Local(t *testing.T) {
+	b := proxyV2Header(proxyV2CmdLocal, "192.0.2.1", "198.51.100.1", 56324, 1883)
+	h, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+	require.NoError(t, err)
+	require.Nil(t, h.Source)
+}
+
+func TestReadProxyHeaderV2Invalid(t *testing.T) {
+	b := proxyV2Header(proxyV2CmdProxy, "192.0.2.1", "198.51.100.1", 56324, 1883)
+	b[12] = 0x11 // version 1
+	_, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+	require.ErrorIs(t, err, ErrProxyHeaderInvalid)
+
+	b = proxyV2Header(proxyV2CmdProxy, "192.0.2.1", "198.51.100.1", 56324, 1883, ProxyTLV{Type: 1, Value: []byte("x")})
+	b[len(b)-2] = 0x09 // tlv length overruns the header
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+	require.ErrorIs(t, err, ErrProxyHeaderInvalid)
+
+	b = proxyV2Header(proxyV2CmdProxy, "192.0.2.1", "198.51.100.1", 56324, 1883)
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(b[:20])))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadProxyHeaderNone(t *testing.T) {
+	for _, tx := range []string{"\x10\x0c\x00\x04MQTT", "PRO\x10", "\r\n\r\n\x00nope"} {
+		r := bufio.NewReader(strings.NewReader(tx))
+		h, err := readProxyHeader(r)
+		require.NoError(t, err)
+		require.Nil(t, h)
+
+		rest, _ := io.ReadAll(r)
+		require.Equal(t, tx, string(rest))
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.1", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.True(t, trusted.contains(net.ParseIP("10.1.2.3")))
+	require.True(t, trusted.contains(net.ParseIP("192.0.2.1")))
+	require.True(t, trusted.contains(net.ParseIP("2001:db8::5")))
+	require.False(t, trusted.contains(net.ParseIP("192.0.2.2")))
+	require.False(t, trusted.contains(nil))
+
+	_, err = parseTrustedProxies([]string{"nope"})
+	require.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/99"})
+	require.Error(t, err)
+
+	var none trustedProxies
+	require.False(t, none.contains(net.ParseIP("203.0.113.9")))
+}
+
+// dialProxyListener accepts a single connection on a proxy listener after writing data to it.
+func dialProxyListener(t *testing.T, config *ProxyConfig, data []byte) net.Conn {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { raw.Close() })
+
+	l, err := newProxyListener(raw, config)
+	require.NoError(t, err)
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	_, err = client.Write(data)
+	require.NoError(t, err)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	conn := dialProxyListener(t, &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}},
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n\x10\x00"))
+
+	require.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	require.Equal(t, "198.51.100.1:1883", conn.LocalAddr().String())
+
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, buf)
+
+	h, ok := ProxyHeaderOf(conn)
+	require.True(t, ok)
+	require.Equal(t, byte(1), h.Version)
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	conn := dialProxyListener(t, &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}},
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"))
+
+	require.IsType(t, new(net.TCPConn), conn)
+	require.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+
+	_, ok := ProxyHeaderOf(conn)
+	require.False(t, ok)
+}
+
+func TestProxyListenerOptionalHeader(t *testing.T) {
+	conn := dialProxyListener(t, &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}}, []byte{0x10, 0x00})
+	require.True(t, strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:"))
+
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, buf)
+}
+
+func TestProxyListenerRequiredHeader(t *testing.T) {
+	conn := dialProxyListener(t, &ProxyConfig{ProxyProtocol: true, Required: true, TrustedProxies: []string{"127.0.0.1"}}, []byte{0x10, 0x00})
+	_, err := conn.Read(make([]byte, 2))
+	require.ErrorIs(t, err, ErrProxyHeaderMissing)
+}
+
+func TestProxyListenerInvalidTrustedProxies(t *testing.T) {
+	_, err := newProxyListener(nil, &ProxyConfig{TrustedProxies: []string{"nope"}})
+	require.Error(t, err)
+}
+
+func TestProxyListenerNoTrustedProxies(t *testing.T) {
+	_, err := newProxyListener(nil, &ProxyConfig{ProxyProtocol: true})
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", Proxy: &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}}})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	remote := make(chan string, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr().String()
+		return nil
+	})
+
+	client, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write(proxyV2Header(proxyV2CmdProxy, "192.0.2.1", "198.51.100.1", 56324, 1883))
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:56324", <-remote)
+}
+
+func TestTCPProxyProtocolInvalidConfig(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", Proxy: &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"nope"}}})
+	require.Error(t, l.Init(logger))
+
+	l = NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", Proxy: &ProxyConfig{ProxyProtocol: true}})
+	require.ErrorIs(t, l.Init(logger), ErrNoTrustedProxies)
+}
+
+func TestTCPProxyProtocolSpoofedUntrusted(t *testing.T) {
+	l := NewTCP(Config{ID: "t1", Address: "127.0.0.1:0", Proxy: &ProxyConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}}})
+	require.NoError(t, l.Init(logger))
+	defer l.Close(MockCloser)
+
+	type accepted struct {
+		remote string
+		data   []byte
+	}
+
+	conns := make(chan accepted, 1)
+	go l.Serve(func(id string, c net.Conn) error {
+		buf := make([]byte, len(proxyV1Prefix))
+		_, _ = io.ReadFull(c, buf)
+		conns <- accepted{remote: c.RemoteAddr().String(), data: buf}
+		return nil
+	})
+
+	client, err := net.Dial("tcp", l.Address())
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n"))
+	require.NoError(t, err)
+
+	c := <-conns
+	require.True(t, strings.HasPrefix(c.remote, "127.0.0.1:"))
+	require.Equal(t, proxyV1Prefix, string(c.data)) // the header is passed through as client data
+}
+
+func TestForwardedAddr(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tt := []struct {
+		desc    string
+		headers map[string]string
+		want    string
+	}{
+		{desc: "none", headers: map[string]string{}},
+		{desc: "xff single", headers: map[string]string{"X-Forwarded-For": "192.0.2.1"}, want: "192.0.2.1:0"},
+		{desc: "xff spoofed chain", headers: map[string]string{"X-Forwarded-For": "203.0.113.5, 192.0.2.1, 10.0.0.2"}, want: "192.0.2.1:0"},
+		{desc: "xff all trusted", headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, want: "10.0.0.3:0"},
+		{desc: "forwarded", headers: map[string]string{"Forwarded": `for=192.0.2.60;proto=https;by=203.0.113.43`}, want: "192.0.2.60:0"},
+		{desc: "forwarded ipv6 port", headers: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, want: "[2001:db8:cafe::17]:4711"},
+		{desc: "forwarded preferred", headers: map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "192.0.2.1"}, want: "192.0.2.60:0"},
+		{desc: "forwarded obfuscated", headers: map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"}, want: "10.0.0.2:0"},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tx.headers {
+				r.Header.Set(k, v)
+			}
+
+			addr, ok := forwardedAddr(r, trusted)
+			require.Equal(t, tx.want != "", ok)
+			if ok {
+				require.Equal(t, tx.want, addr.String())
+			}
+		})
+	}
+}
+
+func TestWebsocketForwardedHeaders(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Proxy: &ProxyConfig{ForwardedHeaders: true, TrustedProxies: []string{"127.0.0.1"}}})
+	require.NoError(t, l.Init(logger))
+
+	remote := make(chan string, 1)
+	l.establish = func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr().String()
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), http.Header{"X-Forwarded-For": {"192.0.2.1"}})
+	require.NoError(t, err)
+	defer ws.Close()
+	require.Equal(t, "192.0.2.1:0", <-remote)
+}
+
+func TestWebsocketForwardedHeadersUntrusted(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Proxy: &ProxyConfig{ForwardedHeaders: true, TrustedProxies: []string{"10.0.0.0/8"}}})
+	require.NoError(t, l.Init(logger))
+
+	remote := make(chan string, 1)
+	l.establish = func(id string, c net.Conn) error {
+		remote <- c.RemoteAddr().String()
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), http.Header{"X-Forwarded-For": {"192.0.2.1"}})
+	require.NoError(t, err)
+	defer ws.Close()
+	require.True(t, strings.HasPrefix(<-remote, "127.0.0.1:"))
+}
+
+func TestWebsocketInitInvalidTrustedProxies(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Proxy: &ProxyConfig{TrustedProxies: []string{"nope"}}})
+	require.Error(t, l.Init(logger))
+
+	l = NewWebsocket(Config{ID: "t1", Address: testAddr, Proxy: &ProxyConfig{ForwardedHeaders: true}})
+	require.ErrorIs(t, l.Init(logger), ErrNoTrustedProxies)
+}
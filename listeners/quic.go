@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/quic-go/quic-go"
+)
+
+const TypeQUIC = "quic"
+
+var (
+	// ErrQUICRequiresTLS indicates that a QUIC listener was configured without a tls config.
+	ErrQUICRequiresTLS = errors.New("quic listener requires a tls config")
+
+	// defaultQUICNextProtos are the application protocols negotiated by quic listeners.
+	defaultQUICNextProtos = []string{"mqtt"}
+)
+
+// QUICConfig contains configuration values specific to QUIC listeners.
+type QUICConfig struct {
+	NextProtos      []string `yaml:"next_protos" json:"next_protos"`           // the application protocols to negotiate, default mqtt
+	MaxIdleTimeout  int64    `yaml:"max_idle_timeout" json:"max_idle_timeout"` // seconds a connection may be idle before it is closed, default 30
+	KeepAlivePeriod int64    `yaml:"keepalive_period" json:"keepalive_period"` // seconds between quic keepalive frames, 0 disables keepalives
+	MaxStreams      int64    `yaml:"max_streams" json:"max_streams"`           // the maximum concurrent mqtt connections per quic connection, default 100
+	Allow0RTT       bool     `yaml:"allow_0rtt" json:"allow_0rtt"`             // accept 0-RTT resumption, which allows the connect packet to be replayed
+}
+
+// QUIC is a listener for establishing client connections over QUIC. Each bidirectional
+// stream opened by a client is a separate mqtt connection. Clients may resume sessions
+// with 0-RTT if it is allowed, and connections survive changes to the client address
+// (connection migration).
+type QUIC struct {
+	sync.RWMutex
+	id      string              // the internal id of the listener
+	address string              // the network address to bind to
+	config  Config              // configuration values for the listener
+	listen  *quic.EarlyListener // a quic listener which will listen for new clients
+	log     *slog.Logger        // server logger
+	end     uint32              // ensure the close methods are only called once
+}
+
+// NewQUIC initializes and returns a new QUIC listener, listening on an address.
+func NewQUIC(config Config) *QUIC {
+	if config.QUIC == nil {
+		config.QUIC = new(QUICConfig)
+	}
+
+	return &QUIC{
+		id:      config.ID,
+		address: config.Address,
+		config:  config,
+	}
+}
+
+// ID returns the id of the listener.
+func (l *QUIC) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *QUIC) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the address of the listener.
+func (l *QUIC) Protocol() string {
+	return "quic"
+}
+
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *QUIC) Policy() *Policy {
+	return l.config.Policy
+}
+
+// Init initializes the listener.
+func (l *QUIC) Init(log *slog.Logger) error {
+	l.log = log
+
+	if l.config.TLSConfig == nil {
+		return ErrQUICRequiresTLS
+	}
+
+	tlsConfig := l.config.TLSConfig.Clone()
+	tlsConfig.NextProtos = l.config.QUIC.NextProtos
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = defaultQUICNextProtos
+	}
+
+	listen, err := quic.ListenAddrEarly(l.address, tlsConfig, l.quicConfig())
+	if err != nil {
+		return err
+	}
+
+	l.listen = listen
+	return nil
+}
+
+// quicConfig returns the quic transport configuration for the listener.
+func (l *QUIC) quicConfig() *quic.Config {
+	c := &quic.Config{
+		Allow0RTT:          l.config.QUIC.Allow0RTT,
+		MaxIncomingStreams: l.config.QUIC.MaxStreams,
+		MaxIdleTimeout:     time.Duration(l.config.QUIC.MaxIdleTimeout) * time.Second,
+		KeepAlivePeriod:    time.Duration(l.config.QUIC.KeepAlivePeriod) * time.Second,
+	}
+
+	if c.MaxIncomingStreams <= 0 {
+		c.MaxIncomingStreams = 100
+	}
+
+	if c.MaxIdleTimeout <= 0 {
+		c.MaxIdleTimeout = 30 * time.Second
+	}
+
+	return c
+}
+
+// Serve starts waiting for new QUIC connections, and calls the establish
+// connection callback for each stream opened on them.
+func (l *QUIC) Serve(establish EstablishFn) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go l.serveConn(conn, establish)
+		}
+	}
+}
+
+// serveConn accepts the streams opened on a QUIC connection, establishing each as a
+// separate client, until the connection is closed.
+func (l *QUIC) serveConn(conn *quic.Conn, establish EstablishFn) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		_ = conn.CloseWithError(0, "")
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&l.end) == 1 {
+			stream.CancelRead(0)
+			_ = stream.Close()
+			continue
+		}
+
+		qc := &QUICConn{Stream: stream, conn: conn}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := establish(l.id, qc)
+			if err != nil {
+				l.log.Warn("", "error", err)
+			}
+		}()
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *QUIC) Close(closeClients CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.listen != nil {
+		err := l.listen.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// QUICConn is a QUIC stream presented as a net.Conn. The addresses are those of the QUIC
+// connection the stream belongs to, so the remote address follows the client when the
+// connection migrates.
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn // the quic connection the stream was opened on
+}
+
+// LocalAddr returns the local address of the QUIC connection.
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the current remote address of the QUIC connection.
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream. The QUIC connection stays open for new
+// streams until the client closes it or it is idle for longer than the idle timeout.
+func (c *QUICConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// ConnectionState returns the tls state of the QUIC connection.
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Used0RTT returns true if the connection was resumed with 0-RTT.
+func (c *QUICConn) Used0RTT() bool {
+	return c.conn.ConnectionState().Used0RTT
+}
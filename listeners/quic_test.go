@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// quicClientTLS returns a client tls config for connecting to a test QUIC listener.
+func quicClientTLS() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true, // nolint: gosec
+		NextProtos:         []string{"mqtt"},
+	}
+}
+
+// serveQUIC initializes and serves a QUIC listener on a loopback port, returning the
+// listener and a channel receiving each connection passed to the establisher.
+func serveQUIC(t *testing.T, config Config) (*QUIC, chan net.Conn) {
+	config.Address = "127.0.0.1:0"
+	config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{newTestKeyPair(t, "mochi")}} // unexpired, so sessions resume
+	l := NewQUIC(config)
+	require.NoError(t, l.Init(logger))
+
+	conns := make(chan net.Conn, 4)
+	go l.Serve(func(id string, c net.Conn) error {
+		conns <- c
+		_, err := io.Copy(c, c)
+		return err
+	})
+
+	t.Cleanup(func() { l.Close(MockCloser) })
+	return l, conns
+}
+
+// echoStream opens a stream on a QUIC connection and checks data is echoed back.
+func echoStream(t *testing.T, conn *quic.Conn) *quic.Stream {
+	stream, err := conn.OpenStreamSync(context.Background())
+	require.NoError(t, err)
+
+	_, err = stream.Write([]byte("mochi"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, "mochi", string(buf))
+	return stream
+}
+
+func TestNewQUIC(t *testing.T) {
+	l := NewQUIC(basicConfig)
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, testAddr, l.Address())
+	require.Equal(t, "quic", l.Protocol())
+	require.NotNil(t, l.config.QUIC)
+	require.Nil(t, l.Policy())
+}
+
+func TestQUICInitRequiresTLS(t *testing.T) {
+	l := NewQUIC(basicConfig)
+	require.ErrorIs(t, l.Init(logger), ErrQUICRequiresTLS)
+}
+
+func TestQUICConfigDefaults(t *testing.T) {
+	c := NewQUIC(basicConfig).quicConfig()
+	require.False(t, c.Allow0RTT)
+	require.Equal(t, int64(100), c.MaxIncomingStreams)
+	require.Equal(t, 30*time.Second, c.MaxIdleTimeout)
+
+	c = NewQUIC(Config{QUIC: &QUICConfig{Allow0RTT: true, MaxStreams: 2, MaxIdleTimeout: 5}}).quicConfig()
+	require.True(t, c.Allow0RTT)
+	require.Equal(t, int64(2), c.MaxIncomingStreams)
+	require.Equal(t, 5*time.Second, c.MaxIdleTimeout)
+}
+
+func TestQUICServeStreams(t *testing.T) {
+	l, conns := serveQUIC(t, Config{ID: "q1"})
+
+	conn, err := quic.DialAddr(context.Background(), l.Address(), quicClientTLS(), nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+
+	// each stream is a separate connection to the server
+	echoStream(t, conn)
+	echoStream(t, conn)
+
+	for i := 0; i < 2; i++ {
+		c := <-conns
+		require.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, c.RemoteAddr().(*net.UDPAddr).Port)
+		require.Equal(t, l.Address(), c.LocalAddr().String())
+		require.Equal(t, "mqtt", c.(*QUICConn).ConnectionState().NegotiatedProtocol)
+	}
+}
+
+func TestQUIC0RTT(t *testing.T) {
+	l, conns := serveQUIC(t, Config{ID: "q1", QUIC: &QUICConfig{Allow0RTT: true}})
+
+	tlsConf := quicClientTLS()
+	tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	conn, err := quic.DialAddr(context.Background(), l.Address(), tlsConf, nil)
+	require.NoError(t, err)
+	echoStream(t, conn)
+	require.False(t, (<-conns).(*QUICConn).Used0RTT())
+	_ = conn.CloseWithError(0, "")
+
+	conn, err = quic.DialAddrEarly(context.Background(), l.Address(), tlsConf, nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+	echoStream(t, conn)
+	require.True(t, conn.ConnectionState().Used0RTT)
+	require.True(t, (<-conns).(*QUICConn).Used0RTT())
+}
+
+func TestQUIC0RTTRefusedByDefault(t *testing.T) {
+	l, conns := serveQUIC(t, Config{ID: "q1"})
+
+	tlsConf := quicClientTLS()
+	tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	conn, err := quic.DialAddr(context.Background(), l.Address(), tlsConf, nil)
+	require.NoError(t, err)
+	echoStream(t, conn)
+	<-conns
+	_ = conn.CloseWithError(0, "")
+
+	// the resumed connection waits for the handshake rather than accepting early data
+	conn, err = quic.DialAddrEarly(context.Background(), l.Address(), tlsConf, nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+	echoStream(t, conn)
+	require.False(t, conn.ConnectionState().Used0RTT)
+	require.False(t, (<-conns).(*QUICConn).Used0RTT())
+}
+
+func TestQUICConnectionMigration(t *testing.T) {
+	l, conns := serveQUIC(t, Config{ID: "q1"})
+
+	// migrating clients need connection ids to tell their paths apart
+	transport := func() (*quic.Transport, *net.UDPConn) {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		tr := &quic.Transport{Conn: udp, ConnectionIDLength: 4}
+		t.Cleanup(func() { _ = tr.Close() })
+		return tr, udp
+	}
+
+	tr, _ := transport()
+	addr, err := net.ResolveUDPAddr("udp", l.Address())
+	require.NoError(t, err)
+	conn, err := tr.Dial(context.Background(), addr, quicClientTLS(), nil)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+
+	stream := echoStream(t, conn)
+	c := <-conns
+	require.Equal(t, conn.LocalAddr().String(), c.RemoteAddr().String())
+
+	tr, udp := transport()
+	path, err := conn.AddPath(tr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, path.Probe(ctx))
+	require.NoError(t, path.Switch())
+
+	// the stream continues on the new path, and the client address follows it
+	_, err = stream.Write([]byte("again"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	require.Equal(t, "again", string(buf))
+	require.Equal(t, udp.LocalAddr().String(), c.RemoteAddr().String())
+}
+
+func TestQUICServeAndClose(t *testing.T) {
+	l := NewQUIC(Config{ID: "q1", Address: "127.0.0.1:0", TLSConfig: tlsConfigBasic})
+	require.NoError(t, l.Init(logger))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+
+	require.True(t, closed)
+	<-o
+
+	l.Close(MockCloser)      // coverage: close closed
+	l.Serve(MockEstablisher) // coverage: serve closed
+}
@@ -53,18 +53,35 @@ func (l *TCP) Protocol() string {
 	return "tcp"
 }
 
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *TCP) Policy() *Policy {
+	return l.config.Policy
+}
+
 // Init initializes the listener.
 func (l *TCP) Init(log *slog.Logger) error {
 	l.log = log
 
-	var err error
+	listen, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Proxy != nil && l.config.Proxy.ProxyProtocol {
+		proxied, err := newProxyListener(listen, l.config.Proxy) // headers precede the tls handshake
+		if err != nil {
+			_ = listen.Close()
+			return err
+		}
+		listen = proxied
+	}
+
 	if l.config.TLSConfig != nil {
-		l.listen, err = tls.Listen("tcp", l.address, l.config.TLSConfig)
-	} else {
-		l.listen, err = net.Listen("tcp", l.address)
+		listen = tls.NewListener(listen, l.config.TLSConfig)
 	}
 
-	return err
+	l.listen = listen
+	return nil
 }
 
 // Serve starts waiting for new TCP connections, and calls the establish
@@ -50,6 +50,11 @@ func (l *UnixSock) Protocol() string {
 	return "unix"
 }
 
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *UnixSock) Policy() *Policy {
+	return l.config.Policy
+}
+
 // Init initializes the listener.
 func (l *UnixSock) Init(log *slog.Logger) error {
 	l.log = log
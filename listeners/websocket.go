@@ -7,9 +7,12 @@ package listeners
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,8 +27,52 @@ const TypeWS = "ws"
 var (
 	// ErrInvalidMessage indicates that a message payload was not valid.
 	ErrInvalidMessage = errors.New("message type not binary")
+
+	// defaultWebsocketSubprotocols are the websocket subprotocols used by mqtt clients, in order of preference.
+	defaultWebsocketSubprotocols = []string{"mqtt", "mqttv3.1"}
 )
 
+// WebsocketConfig contains configuration values specific to websocket listeners.
+type WebsocketConfig struct {
+	Paths             []string `yaml:"paths" json:"paths"`                           // the paths to accept connections on, default /
+	AllowedOrigins    []string `yaml:"allowed_origins" json:"allowed_origins"`       // origins allowed to connect, eg. https://*.example.com, all origins if empty
+	Subprotocols      []string `yaml:"subprotocols" json:"subprotocols"`             // the subprotocols to negotiate, in order of preference, default mqtt and mqttv3.1
+	StrictSubprotocol bool     `yaml:"strict_subprotocol" json:"strict_subprotocol"` // refuse connections which don't request one of the subprotocols
+	Compression       bool     `yaml:"compression" json:"compression"`               // negotiate permessage-deflate compression
+	ReadLimit         int64    `yaml:"read_limit" json:"read_limit"`                 // the maximum size of an inbound websocket message in bytes, 0 is unlimited
+	ReadBufferSize    int      `yaml:"read_buffer_size" json:"read_buffer_size"`     // the size of the connection read buffer in bytes
+	WriteBufferSize   int      `yaml:"write_buffer_size" json:"write_buffer_size"`   // the size of the connection write buffer in bytes
+	PingInterval      int64    `yaml:"ping_interval" json:"ping_interval"`           // seconds between websocket pings sent to the client, 0 disables pings
+	Headers           []string `yaml:"headers" json:"headers"`                       // upgrade request headers exposed to hooks, eg. Authorization
+	Cookies           []string `yaml:"cookies" json:"cookies"`                       // upgrade request cookies exposed to hooks
+}
+
+// UpgradeRequest contains the details of the http request which established a websocket
+// connection. Only the headers and cookies selected in the listener config are kept.
+type UpgradeRequest struct {
+	Path        string         // the path of the request
+	Subprotocol string         // the negotiated websocket subprotocol
+	Header      http.Header    // the selected request headers
+	Cookies     []*http.Cookie // the selected request cookies
+}
+
+// Cookie returns the named cookie of the request, if it was selected.
+func (u *UpgradeRequest) Cookie(name string) (*http.Cookie, bool) {
+	for _, c := range u.Cookies {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// UpgradeRequestConn is implemented by connections which were established by an http
+// upgrade request, such as websockets.
+type UpgradeRequestConn interface {
+	UpgradeRequest() *UpgradeRequest
+}
+
 // Websocket is a listener for establishing websocket connections.
 type Websocket struct { // [MQTT-4.2.0-1]
 	sync.RWMutex
@@ -36,22 +83,36 @@ type Websocket struct { // [MQTT-4.2.0-1]
 	log       *slog.Logger        // server logger
 	establish EstablishFn         // the server's establish connection handler
 	upgrader  *websocket.Upgrader //  upgrade the incoming http/tcp connection to a websocket compliant connection.
+	trusted   trustedProxies      // proxies whose forwarding headers are trusted
 	end       uint32              // ensure the close methods are only called once
 }
 
 // NewWebsocket initializes and returns a new Websocket listener, listening on an address.
 func NewWebsocket(config Config) *Websocket {
-	return &Websocket{
+	if config.Websocket == nil {
+		config.Websocket = new(WebsocketConfig)
+	}
+
+	subprotocols := config.Websocket.Subprotocols
+	if len(subprotocols) == 0 {
+		subprotocols = defaultWebsocketSubprotocols
+	}
+
+	l := &Websocket{
 		id:      config.ID,
 		address: config.Address,
 		config:  config,
-		upgrader: &websocket.Upgrader{
-			Subprotocols: []string{"mqtt"},
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
 	}
+
+	l.upgrader = &websocket.Upgrader{
+		Subprotocols:      subprotocols,
+		CheckOrigin:       l.checkOrigin,
+		EnableCompression: config.Websocket.Compression,
+		ReadBufferSize:    config.Websocket.ReadBufferSize,
+		WriteBufferSize:   config.Websocket.WriteBufferSize,
+	}
+
+	return l
 }
 
 // ID returns the id of the listener.
@@ -73,12 +134,38 @@ func (l *Websocket) Protocol() string {
 	return "ws"
 }
 
+// Policy returns the capability and policy overrides for clients of the listener.
+func (l *Websocket) Policy() *Policy {
+	return l.config.Policy
+}
+
 // Init initializes the listener.
 func (l *Websocket) Init(log *slog.Logger) error {
 	l.log = log
 
+	if l.config.Proxy != nil {
+		trusted, err := newTrustedProxies(l.config.Proxy)
+		if err != nil {
+			return err
+		}
+		l.trusted = trusted
+	}
+
+	for _, origin := range l.config.Websocket.AllowedOrigins {
+		if _, err := path.Match(strings.ToLower(origin), ""); err != nil {
+			return fmt.Errorf("invalid allowed origin %q: %w", origin, err)
+		}
+	}
+
+	paths, err := websocketPaths(l.config.Websocket.Paths)
+	if err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", l.handler)
+	for _, p := range paths {
+		mux.HandleFunc(p, l.handler)
+	}
 	l.listen = &http.Server{
 		Addr:         l.address,
 		Handler:      mux,
@@ -90,15 +177,134 @@ func (l *Websocket) Init(log *slog.Logger) error {
 	return nil
 }
 
+// websocketPaths validates and de-duplicates the paths to accept connections on, so that
+// they can be registered with a http.ServeMux without panicking.
+func websocketPaths(v []string) ([]string, error) {
+	if len(v) == 0 {
+		return []string{"/"}, nil
+	}
+
+	paths := make([]string, 0, len(v))
+	seen := make(map[string]bool, len(v))
+	for _, p := range v {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, " \t{}") {
+			return nil, fmt.Errorf("invalid websocket path %q", p)
+		}
+
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	return paths, nil
+}
+
+// checkOrigin returns true if the origin of an upgrade request is allowed. Requests without
+// an origin are not made by browsers, and are always allowed.
+func (l *Websocket) checkOrigin(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" || len(l.config.Websocket.AllowedOrigins) == 0 {
+		return true
+	}
+
+	for _, allowed := range l.config.Websocket.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+
+		if ok, _ := path.Match(strings.ToLower(allowed), origin); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upgradeRequest returns the details of an upgrade request to be kept with the connection.
+func (l *Websocket) upgradeRequest(r *http.Request, subprotocol string) *UpgradeRequest {
+	u := &UpgradeRequest{
+		Path:        r.URL.Path,
+		Subprotocol: subprotocol,
+		Header:      http.Header{},
+	}
+
+	for _, h := range l.config.Websocket.Headers {
+		if v := r.Header.Values(h); len(v) > 0 {
+			u.Header[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+
+	for _, name := range l.config.Websocket.Cookies {
+		if c, err := r.Cookie(name); err == nil {
+			u.Cookies = append(u.Cookies, c)
+		}
+	}
+
+	return u
+}
+
+// requestsSubprotocol returns true if an upgrade request asks for one of the listener's subprotocols.
+func (l *Websocket) requestsSubprotocol(r *http.Request) bool {
+	for _, requested := range websocket.Subprotocols(r) {
+		for _, supported := range l.upgrader.Subprotocols {
+			if requested == supported {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ping sends websocket pings to the client until done is closed.
+func (l *Websocket) ping(c *websocket.Conn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		}
+	}
+}
+
 // handler upgrades and handles an incoming websocket connection.
 func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
+	if l.config.Websocket.StrictSubprotocol && websocket.IsWebSocketUpgrade(r) && !l.requestsSubprotocol(r) {
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		return
+	}
+
 	c, err := l.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	defer c.Close()
 
-	err = l.establish(l.id, &wsConn{Conn: c.UnderlyingConn(), c: c})
+	if l.config.Websocket.ReadLimit > 0 {
+		c.SetReadLimit(l.config.Websocket.ReadLimit)
+	}
+
+	if l.config.Websocket.PingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go l.ping(c, time.Duration(l.config.Websocket.PingInterval)*time.Second, done)
+	}
+
+	conn := &wsConn{Conn: c.UnderlyingConn(), c: c, upgrade: l.upgradeRequest(r, c.Subprotocol())}
+	if l.config.Proxy != nil && l.config.Proxy.ForwardedHeaders {
+		if peer, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil && l.trusted.contains(peer.IP) {
+			conn.remote, _ = forwardedAddr(r, l.trusted)
+		}
+	}
+
+	err = l.establish(l.id, conn)
 	if err != nil {
 		l.log.Warn("", "error", err)
 	}
@@ -107,13 +313,15 @@ func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
 // Serve starts waiting for new Websocket connections, and calls the connection
 // establishment callback for any received.
 func (l *Websocket) Serve(establish EstablishFn) {
-	var err error
 	l.establish = establish
 
-	if l.listen.TLSConfig != nil {
-		err = l.listen.ListenAndServeTLS("", "")
-	} else {
-		err = l.listen.ListenAndServe()
+	listen, err := l.netListener()
+	if err == nil {
+		if l.listen.TLSConfig != nil {
+			err = l.listen.ServeTLS(listen, "", "")
+		} else {
+			err = l.listen.Serve(listen)
+		}
 	}
 
 	// After the listener has been shutdown, no need to print the http.ErrServerClosed error.
@@ -122,6 +330,22 @@ func (l *Websocket) Serve(establish EstablishFn) {
 	}
 }
 
+// netListener opens the network address, accepting PROXY protocol headers if configured.
+func (l *Websocket) netListener() (net.Listener, error) {
+	listen, err := net.Listen("tcp", l.address)
+	if err != nil || l.config.Proxy == nil || !l.config.Proxy.ProxyProtocol {
+		return listen, err
+	}
+
+	proxied, err := newProxyListener(listen, l.config.Proxy) // headers precede the tls handshake
+	if err != nil {
+		_ = listen.Close()
+		return nil, err
+	}
+
+	return proxied, nil
+}
+
 // Close closes the listener and any client connections.
 func (l *Websocket) Close(closeClients CloseFn) {
 	l.Lock()
@@ -143,6 +367,26 @@ type wsConn struct {
 
 	// reader for the current message (can be nil)
 	r io.Reader
+
+	// the client address sent by a trusted proxy (can be nil)
+	remote net.Addr
+
+	// the request which established the connection
+	upgrade *UpgradeRequest
+}
+
+// UpgradeRequest returns the details of the http request which established the connection.
+func (ws *wsConn) UpgradeRequest() *UpgradeRequest {
+	return ws.upgrade
+}
+
+// RemoteAddr returns the address of the client, as forwarded by a trusted proxy if available.
+func (ws *wsConn) RemoteAddr() net.Addr {
+	if ws.remote != nil {
+		return ws.remote
+	}
+
+	return ws.Conn.RemoteAddr()
 }
 
 // Read reads the next span of bytes from the websocket connection and returns the number of bytes read.
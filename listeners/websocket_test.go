@@ -171,3 +171,199 @@ func TestWebsocketConnectionReads(t *testing.T) {
 	s.Close()
 	_ = ws.Close()
 }
+
+func TestNewWebsocketDefaults(t *testing.T) {
+	l := NewWebsocket(basicConfig)
+	require.NotNil(t, l.config.Websocket)
+	require.Equal(t, []string{"mqtt", "mqttv3.1"}, l.upgrader.Subprotocols)
+	require.False(t, l.upgrader.EnableCompression)
+}
+
+func TestWebsocketInitInvalidOrigin(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{AllowedOrigins: []string{"https://[.example.com"}}})
+	require.Error(t, l.Init(logger))
+}
+
+func TestWebsocketCheckOrigin(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+	}})
+
+	tt := map[string]bool{
+		"":                         true,
+		"https://app.example.com":  true,
+		"https://APP.example.com":  true,
+		"https://x.example.org":    true,
+		"http://app.example.com":   false,
+		"https://evil.example.com": false,
+		"https://example.org":      false,
+	}
+
+	for origin, want := range tt {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		require.Equal(t, want, l.checkOrigin(r), origin)
+	}
+
+	l.config.Websocket.AllowedOrigins = []string{"*"}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://anything.test")
+	require.True(t, l.checkOrigin(r))
+}
+
+func TestWebsocketPaths(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{Paths: []string{"/mqtt"}}})
+	require.NoError(t, l.Init(logger))
+
+	e := make(chan bool, 1)
+	l.establish = func(id string, c net.Conn) error {
+		e <- true
+		return nil
+	}
+
+	s := httptest.NewServer(l.listen.Handler)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url+"/mqtt", nil)
+	require.NoError(t, err)
+	require.True(t, <-e)
+	_ = ws.Close()
+}
+
+func TestWebsocketInitInvalidPaths(t *testing.T) {
+	for _, p := range []string{"", "mqtt", "/mqtt/{id}", "GET /mqtt"} {
+		l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{Paths: []string{"/", p}}})
+		require.Error(t, l.Init(logger), p)
+	}
+}
+
+func TestWebsocketInitDuplicatePaths(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{Paths: []string{"/mqtt", "/", "/mqtt"}}})
+	require.NoError(t, l.Init(logger))
+
+	paths, err := websocketPaths(l.config.Websocket.Paths)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/mqtt", "/"}, paths)
+}
+
+func TestWebsocketStrictSubprotocol(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{StrictSubprotocol: true}})
+	require.NoError(t, l.Init(logger))
+
+	protocol := make(chan string, 1)
+	l.establish = func(id string, c net.Conn) error {
+		protocol <- c.(UpgradeRequestConn).UpgradeRequest().Subprotocol
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"mqttv3.1"}}
+	ws, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, "mqttv3.1", <-protocol)
+	_ = ws.Close()
+}
+
+func TestWebsocketUpgradeRequest(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{
+		Headers: []string{"authorization", "X-Missing"},
+		Cookies: []string{"session"},
+	}})
+	require.NoError(t, l.Init(logger))
+
+	upgrade := make(chan *UpgradeRequest, 1)
+	l.establish = func(id string, c net.Conn) error {
+		upgrade <- c.(UpgradeRequestConn).UpgradeRequest()
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/mqtt", http.Header{
+		"Authorization": {"Bearer abc"},
+		"X-Other":       {"hidden"},
+		"Cookie":        {"session=s1; theme=dark"},
+	})
+	require.NoError(t, err)
+	defer ws.Close()
+
+	u := <-upgrade
+	require.Equal(t, "/mqtt", u.Path)
+	require.Equal(t, http.Header{"Authorization": {"Bearer abc"}}, u.Header)
+	require.Len(t, u.Cookies, 1)
+
+	c, ok := u.Cookie("session")
+	require.True(t, ok)
+	require.Equal(t, "s1", c.Value)
+	_, ok = u.Cookie("theme")
+	require.False(t, ok)
+}
+
+func TestWebsocketReadLimit(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{ReadLimit: 16}})
+	require.NoError(t, l.Init(logger))
+
+	errs := make(chan error, 1)
+	l.establish = func(id string, c net.Conn) error {
+		_, err := c.Read(make([]byte, 64))
+		errs <- err
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteMessage(websocket.BinaryMessage, make([]byte, 32)))
+	require.ErrorIs(t, <-errs, websocket.ErrReadLimit)
+}
+
+func TestWebsocketPing(t *testing.T) {
+	l := NewWebsocket(Config{ID: "t1", Address: testAddr, Websocket: &WebsocketConfig{PingInterval: 1}})
+	require.NoError(t, l.Init(logger))
+
+	release := make(chan struct{})
+	l.establish = func(id string, c net.Conn) error {
+		<-release
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	pinged := make(chan bool, 1)
+	ws.SetPingHandler(func(string) error {
+		pinged <- true
+		return nil
+	})
+	go func() { _, _, _ = ws.ReadMessage() }()
+
+	select {
+	case <-pinged:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no ping received")
+	}
+	close(release)
+}
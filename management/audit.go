@@ -0,0 +1,144 @@
+package management
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/hooks/audit"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+)
+
+// actorKey is the request context key holding the authenticated management username.
+type actorKey struct{}
+
+// withActor returns a copy of the request carrying the authenticated username.
+func withActor(r *http.Request, username string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey{}, username))
+}
+
+// actor returns the authenticated username of a request, if any.
+func actor(r *http.Request) string {
+	v, _ := r.Context().Value(actorKey{}).(string)
+	return v
+}
+
+// SetAudit sets the audit hook which management changes are recorded to.
+// It should be called before the listener is served.
+func (l *Management) SetAudit(h *audit.Hook) {
+	l.audit = h
+}
+
+// record writes a management change to the audit log, if one is configured.
+// The endpoint is recorded as the target when no other target is given.
+func (l *Management) record(r *http.Request, action, target string, before, after any, err error) {
+	if l.audit == nil {
+		return
+	}
+
+	if target == "" {
+		target = r.URL.Path
+	}
+
+	rec := audit.Record{
+		Source: audit.SourceManagement,
+		Actor:  actor(r),
+		Action: action,
+		Target: target,
+		Remote: r.RemoteAddr,
+		Before: before,
+		After:  after,
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	l.audit.Record(rec)
+}
+
+// userSummary returns an audit summary of a user, excluding the password.
+func userSummary(ledger *auth.Ledger, username string) any {
+	for _, u := range ledger.GetUsers() {
+		if string(u.Username) == username {
+			return map[string]any{
+				"username": username,
+				"allow":    !u.Disallow,
+				"remarks":  u.Remarks,
+				"is_admin": u.IsAdmin,
+			}
+		}
+	}
+
+	return nil
+}
+
+// tlsSummary returns an audit summary of tls settings, excluding the certificate and key.
+func tlsSummary(cfg TLSConfig) any {
+	return map[string]any{
+		"enabled":  cfg.Enabled,
+		"port":     cfg.Port,
+		"has_cert": cfg.Cert != "",
+		"has_key":  cfg.Key != "",
+	}
+}
+
+// parseAuditTime parses a query time given as RFC3339 or unix seconds.
+func parseAuditTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, v)
+}
+
+// handleAudit returns audit records matching the from, to, actor, action and limit query parameters.
+func (l *Management) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.audit == nil || l.audit.Log() == nil {
+		l.jsonError(w, "audit log not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	q := audit.Query{
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+		Limit:  100,
+	}
+
+	var err error
+	if q.From, err = parseAuditTime(params.Get("from")); err != nil {
+		l.jsonError(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if q.To, err = parseAuditTime(params.Get("to")); err != nil {
+		l.jsonError(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			l.jsonError(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := l.audit.Log().Query(q)
+	if err != nil {
+		l.jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.jsonResponse(w, records, http.StatusOK)
+}
@@ -0,0 +1,92 @@
+package management
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/backup"
+)
+
+const (
+	backupContentType    = "application/gzip" // the content type of backup archives
+	backupMaxRestoreSize = 1 << 30            // the largest archive accepted for restore
+	backupQueryPasswords = "passwords"        // query parameter requesting user passwords are kept
+)
+
+// handleBackup streams a snapshot of the running broker as a backup archive. The
+// passwords of users are removed unless they are requested explicitly.
+func (l *Management) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	passwords, _ := strconv.ParseBool(r.URL.Query().Get(backupQueryPasswords))
+	a := backup.Capture(l.orgServer, l.ledger())
+	if !passwords {
+		a.RedactPasswords()
+	}
+	l.record(r, "backup.create", "", nil, map[string]any{"counts": a.Counts(), "passwords": passwords}, nil)
+
+	// large archives may take longer than the server write timeout to stream.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	name := fmt.Sprintf("mochi-backup-%s.mbk", time.Unix(a.Header.Created, 0).UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", backupContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if _, err := a.WriteTo(w); err != nil && l.log != nil {
+		l.log.Error("failed to write backup", "error", err)
+	}
+}
+
+// handleRestore loads a backup archive from the request body into the broker,
+// which must have no clients or retained messages.
+func (l *Management) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	a, err := backup.Read(http.MaxBytesReader(w, r.Body, backupMaxRestoreSize))
+	if err != nil {
+		l.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var store mqtt.Hook
+	if l.storageHook != nil {
+		store = l.storageHook
+	}
+
+	err = backup.RestoreServer(a, l.orgServer, l.ledger(), store)
+	l.record(r, "backup.restore", "", nil, a.Counts(), err)
+	if errors.Is(err, backup.ErrNotEmpty) {
+		l.jsonError(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		l.jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.jsonResponse(w, map[string]any{
+		"status":  "ok",
+		"version": a.Header.Version,
+		"counts":  a.Counts(),
+	}, http.StatusOK)
+}
+
+// ledger returns the auth ledger, if available.
+func (l *Management) ledger() *auth.Ledger {
+	if l.authHook == nil {
+		return nil
+	}
+
+	return l.authHook.Ledger()
+}
@@ -0,0 +1,30 @@
+package management
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupPasswords(t *testing.T) {
+	l, _, token := newTestManagement(t)
+	require.NoError(t, l.ledger().SetUser(auth.UserRule{Username: "alice", Password: "secret"}))
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/backup", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	a, err := backup.Read(w.Body)
+	require.NoError(t, err)
+	require.True(t, a.Header.Redacted) // passwords are removed by default
+	require.Len(t, a.Users, 1)
+	require.Empty(t, a.Users[0].Password)
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/backup?passwords=true", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	a, err = backup.Read(w.Body)
+	require.NoError(t, err)
+	require.False(t, a.Header.Redacted)
+	require.Equal(t, auth.RString("secret"), a.Users[0].Password)
+}
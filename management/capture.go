@@ -0,0 +1,94 @@
+package management
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/mochi-mqtt/server/v2/hooks/capture"
+)
+
+// SetCapture sets the packet capture hook controlled by the capture endpoints.
+// It should be called before the listener is served.
+func (l *Management) SetCapture(h *capture.Hook) {
+	l.capture = h
+}
+
+// handleCapture lists running captures and capture files (GET), and starts (POST)
+// or stops (DELETE) capturing the client given by the client query parameter.
+func (l *Management) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if l.capture == nil {
+		l.jsonError(w, "packet capture not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		files, err := l.capture.Files()
+		if err != nil {
+			l.jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		l.jsonResponse(w, map[string]any{
+			"sessions": l.capture.Sessions(),
+			"files":    files,
+		}, http.StatusOK)
+
+	case http.MethodPost:
+		clientID := r.URL.Query().Get("client")
+		session, err := l.capture.StartCapture(clientID)
+		l.record(r, "capture.start", clientID, nil, session, err)
+		if errors.Is(err, capture.ErrEmptyClientID) {
+			l.jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, capture.ErrCaptureActive) {
+			l.jsonError(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			l.jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.jsonResponse(w, session, http.StatusCreated)
+
+	case http.MethodDelete:
+		clientID := r.URL.Query().Get("client")
+		session, err := l.capture.StopCapture(clientID)
+		l.record(r, "capture.stop", clientID, nil, session, err)
+		if errors.Is(err, capture.ErrCaptureNotActive) {
+			l.jsonError(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			l.jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.jsonResponse(w, session, http.StatusOK)
+
+	default:
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCaptureFile downloads a capture file by name.
+func (l *Management) handleCaptureFile(w http.ResponseWriter, r *http.Request) {
+	if l.capture == nil {
+		l.jsonError(w, "packet capture not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/capture/files/")
+	path, err := l.capture.Path(name)
+	if err != nil {
+		l.jsonError(w, "capture not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,88 @@
+package management
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// maxDrainPeriod is the longest period clients can be drained over.
+const maxDrainPeriod = time.Hour
+
+// drainOptions reads the drain options from the query parameters of a request:
+// reason (shutdown or moved), server_reference, period (a duration such as 30s)
+// and batch (the number of clients disconnected at a time).
+func drainOptions(r *http.Request) (mqtt.DrainOptions, error) {
+	q := r.URL.Query()
+	opts := mqtt.DrainOptions{
+		Code:            packets.ErrServerShuttingDown,
+		ServerReference: q.Get("server_reference"),
+	}
+
+	switch q.Get("reason") {
+	case "", "shutdown":
+	case "moved":
+		opts.Code = packets.ErrServerMoved
+	default:
+		return opts, fmt.Errorf("invalid reason %q", q.Get("reason"))
+	}
+
+	if v := q.Get("period"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxDrainPeriod {
+			return opts, fmt.Errorf("invalid period %q", v)
+		}
+		opts.Period = d
+	}
+
+	batch, err := parseQueryInt(q.Get("batch"), 0, math.MaxInt32)
+	if err != nil {
+		return opts, err
+	}
+	opts.BatchSize = batch
+
+	return opts, nil
+}
+
+// drainSummary returns the drain options as recorded in the audit log.
+func drainSummary(opts mqtt.DrainOptions) map[string]any {
+	return map[string]any{
+		"reason":           opts.Code.Reason,
+		"server_reference": opts.ServerReference,
+		"period":           opts.Period.String(),
+		"batch":            opts.BatchSize,
+	}
+}
+
+// handleDrain stops all listeners other than the management listener accepting new
+// connections, and disconnects their clients paced over the drain period. The listeners
+// are stopped before responding, and clients are drained in the background when a period
+// is given.
+func (l *Management) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := drainOptions(r)
+	if err != nil {
+		l.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Except = []string{l.id}
+
+	opts.Background = opts.Period > 0
+
+	l.record(r, "server.drain", "", nil, drainSummary(opts), nil)
+	n := l.orgServer.Drain(opts)
+	if opts.Background {
+		l.jsonResponse(w, map[string]any{"status": "draining", "clients": n}, http.StatusAccepted)
+		return
+	}
+
+	l.jsonResponse(w, map[string]any{"status": "ok", "clients": n}, http.StatusOK)
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/tls"
 	"embed"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,7 +18,9 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/audit"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/capture"
 	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
 	"github.com/mochi-mqtt/server/v2/listeners"
 )
@@ -35,18 +39,26 @@ type Claims struct {
 // Management is a listener for the management interface.
 type Management struct {
 	sync.RWMutex
-	id          string           // the internal id of the listener
-	address     string           // the network address to bind to
-	config      listeners.Config // configuration values for the listener
-	listen      *http.Server     // the http server
-	log         *slog.Logger     // server logger
-	end         uint32           // ensure the close methods are only called once
-	orgServer   *mqtt.Server     // reference to the main server instance
-	authHook    *auth.Hook       // reference to the auth hook
-	storageHook *bolt.Hook       // reference to the storage hook
-	mdns        *MdnsService     // mDNS service
-	settings    *SettingsManager // Settings
-	jwtKey      []byte           // key for signing JWTs
+	id              string                  // the internal id of the listener
+	address         string                  // the network address to bind to
+	config          listeners.Config        // configuration values for the listener
+	listen          *http.Server            // the http server
+	log             *slog.Logger            // server logger
+	end             uint32                  // ensure the close methods are only called once
+	orgServer       *mqtt.Server            // reference to the main server instance
+	authHook        *auth.Hook              // reference to the auth hook
+	storageHook     *bolt.Hook              // reference to the storage hook
+	mdns            *MdnsService            // mDNS service
+	settings        *SettingsManager        // Settings
+	audit           *audit.Hook             // audit log for management changes, if set
+	capture         *capture.Hook           // packet capture hook, if set
+	tlsCerts        *listeners.CertStore    // certificates of the mqtts listener managed by the tls settings
+	certStores      []*listeners.CertStore  // file based certificate stores reloaded by the tls reload endpoint
+	listenerManager *ListenerManager        // creates, updates and deletes listeners from saved definitions, if set
+	taps            int32                   // the number of active message tap sessions
+	tapSeq          int32                   // sequence for message tap inline subscription ids
+	tickets         map[string]streamTicket // unused stream tickets, keyed on ticket
+	jwtKey          []byte                  // key for signing JWTs
 }
 
 //go:embed dist/*
@@ -106,12 +118,24 @@ func (l *Management) Init(log *slog.Logger) error {
 
 	// Protected Endpoints
 	mux.HandleFunc("/api/v1/listeners", l.authMiddleware(l.handleListeners))
-	mux.HandleFunc("/api/v1/listeners/", l.authMiddleware(l.handleListenerDelete))
+	mux.HandleFunc("/api/v1/listeners/", l.authMiddleware(l.handleListener))
 	mux.HandleFunc("/api/v1/users", l.authMiddleware(l.handleUsers))
 	mux.HandleFunc("/api/v1/users/", l.authMiddleware(l.handleUserDelete))
 	mux.HandleFunc("/api/v1/stats", l.authMiddleware(l.handleStats))
 	mux.HandleFunc("/api/v1/mdns", l.authMiddleware(l.handleMdns))
 	mux.HandleFunc("/api/v1/tls", l.authMiddleware(l.handleTls))
+	mux.HandleFunc("/api/v1/tls/reload", l.authMiddleware(l.handleTlsReload))
+	mux.HandleFunc("/api/v1/drain", l.authMiddleware(l.handleDrain))
+	mux.HandleFunc("/api/v1/audit", l.authMiddleware(l.handleAudit))
+	mux.HandleFunc("/api/v1/capture", l.authMiddleware(l.handleCapture))
+	mux.HandleFunc("/api/v1/capture/files/", l.authMiddleware(l.handleCaptureFile))
+	mux.HandleFunc("/api/v1/tap", l.streamAuthMiddleware(l.handleTap))
+	mux.HandleFunc("/api/v1/tap/ticket", l.authMiddleware(l.handleTapTicket))
+	mux.HandleFunc("/api/v1/publish", l.authMiddleware(l.handlePublish))
+	mux.HandleFunc("/api/v1/retained", l.authMiddleware(l.handleRetained))
+	mux.HandleFunc("/api/v1/sessions/", l.authMiddleware(l.handleSession))
+	mux.HandleFunc("/api/v1/backup", l.authMiddleware(l.handleBackup))
+	mux.HandleFunc("/api/v1/backup/restore", l.authMiddleware(l.handleRestore))
 
 	// Storage Endpoints (Protected)
 	mux.HandleFunc("/api/v1/storage/clients", l.authMiddleware(l.handleStoredClients))
@@ -120,6 +144,9 @@ func (l *Management) Init(log *slog.Logger) error {
 	mux.HandleFunc("/api/v1/storage/subscriptions/", l.authMiddleware(l.handleStoredSubscriptionDelete))
 	mux.HandleFunc("/api/v1/storage/retained", l.authMiddleware(l.handleStoredRetained))
 	mux.HandleFunc("/api/v1/storage/retained/", l.authMiddleware(l.handleStoredRetainedDelete))
+	mux.HandleFunc("/api/v1/storage/encryption", l.authMiddleware(l.handleStorageEncryption))
+	mux.HandleFunc("/api/v1/storage/encryption/rotate", l.authMiddleware(l.handleStorageEncryptionRotate))
+	mux.HandleFunc("/api/v1/storage/writebehind", l.authMiddleware(l.handleStorageWriteBehind))
 
 	// Static UI serving (Embedded)
 	// distFS serves the "dist" folder.
@@ -191,10 +218,13 @@ func (l *Management) handleMdns(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		before := l.settings.GetMDNS()
 		if err := l.settings.UpdateMDNS(req); err != nil {
+			l.record(r, "mdns.update", "", before, req, err)
 			l.jsonError(w, "failed to save settings: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		l.record(r, "mdns.update", "", before, req, nil)
 
 		// Use configured port or default 1883 if configured 0?
 		// If port is 0, keeping 1883 or whatever defaults.
@@ -247,48 +277,35 @@ func (l *Management) handleTls(w http.ResponseWriter, r *http.Request) {
 			req.Port = current.Port
 		}
 
-		var tlsConfig *tls.Config
+		var cert tls.Certificate
 		if req.Enabled {
 			if req.Cert == "" || req.Key == "" {
 				l.jsonError(w, "cert and key required", http.StatusBadRequest)
 				return
 			}
 			// Validate Cert/Key
-			cert, err := tls.X509KeyPair([]byte(req.Cert), []byte(req.Key))
+			var err error
+			cert, err = tls.X509KeyPair([]byte(req.Cert), []byte(req.Key))
 			if err != nil {
 				l.jsonError(w, "invalid cert/key: "+err.Error(), http.StatusBadRequest)
 				return
 			}
-			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 		}
 
 		if err := l.settings.UpdateTLS(req); err != nil {
+			l.record(r, "tls.update", "", tlsSummary(current), tlsSummary(req), err)
 			l.jsonError(w, "failed to save settings: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		l.record(r, "tls.update", "", tlsSummary(current), tlsSummary(req), nil)
 
-		// Apply Changes
-		// Stop existing listener if any
-		id := "mqtts"
-		l.orgServer.Listeners.Close(id, func(id string) {})
-		l.orgServer.Listeners.Delete(id)
-
-		if req.Enabled && tlsConfig != nil {
-			tcp := listeners.NewTCP(listeners.Config{
-				ID:        id,
-				Address:   req.Port,
-				TLSConfig: tlsConfig,
-			})
-			if err := l.orgServer.AddListener(tcp); err != nil {
-				l.jsonError(w, "saved but failed to start listener: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// Start serving asynchronously
-			go l.orgServer.Listeners.Serve(id, l.orgServer.EstablishConnection)
+		status, err := l.applyTLS(current, req, cert)
+		if err != nil {
+			l.jsonError(w, "saved but failed to start listener: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		l.jsonResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
+		l.jsonResponse(w, map[string]string{"status": "ok", "listener": status}, http.StatusOK)
 
 	default:
 		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -340,7 +357,9 @@ func (l *Management) handleInstall(w http.ResponseWriter, r *http.Request) {
 
 	ledger := l.authHook.Ledger()
 	// Add Admin User
-	if err := ledger.AddUser(req.Username, req.Password, true, "Super Admin", true); err != nil {
+	err := ledger.AddUser(req.Username, req.Password, true, "Super Admin", true)
+	l.record(withActor(r, req.Username), "install", req.Username, nil, userSummary(ledger, req.Username), err)
+	if err != nil {
 		l.jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -433,113 +452,22 @@ func (l *Management) jsonError(w http.ResponseWriter, err string, status int) {
 	l.jsonResponse(w, map[string]string{"error": err}, status)
 }
 
-// Listeners
-
-func (l *Management) handleListeners(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		ls := l.orgServer.Listeners.GetAll()
-		resp := make([]map[string]any, 0, len(ls))
-		for id, lst := range ls {
-			resp = append(resp, map[string]any{
-				"id":       id,
-				"address":  lst.Address(),
-				"protocol": lst.Protocol(),
-				"type":     l.getListenerType(lst),
-			})
-		}
-		l.jsonResponse(w, resp, http.StatusOK)
-
-	case http.MethodPost:
-		var req struct {
-			Type    string `json:"type"`
-			ID      string `json:"id"`
-			Address string `json:"address"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			l.jsonError(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		config := listeners.Config{
-			Type:    req.Type,
-			ID:      req.ID,
-			Address: req.Address,
-		}
-
-		var lst listeners.Listener
-		switch req.Type {
-		case "tcp":
-			lst = listeners.NewTCP(config)
-		case "ws":
-			lst = listeners.NewWebsocket(config)
-		default:
-			l.jsonError(w, "unsupported listener type", http.StatusBadRequest)
-			return
-		}
-
-		if err := l.orgServer.AddListener(lst); err != nil {
-			l.jsonError(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Hack: Start serving the listener immediately!
-		// server.AddListener puts it in the map, but we need to call Serve.
-		// Use Listener.Serve(id, establisher)
-		// How to get establisher?
-		// We can get it from server.EstablishConnection methods.
-		// server.EstablishConnection is func(listener string, c net.Conn) error.
-		// listeners.EstablishFn is func(id string, c net.Conn) error.
-		l.orgServer.Listeners.Serve(req.ID, l.orgServer.EstablishConnection)
-
-		l.jsonResponse(w, map[string]string{"status": "ok"}, http.StatusCreated)
-
-	default:
-		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+// parseQueryInt parses an optional positive integer query parameter, capped at max.
+func parseQueryInt(v string, def, max int) (int, error) {
+	if v == "" {
+		return def, nil
 	}
-}
 
-func (l *Management) handleListenerDelete(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid value %q", v)
 	}
 
-	id := strings.TrimPrefix(r.URL.Path, "/api/v1/listeners/")
-	if id == "" {
-		l.jsonError(w, "missing id", http.StatusBadRequest)
-		return
+	if n > max {
+		n = max
 	}
 
-	// Stop listener
-	l.orgServer.Listeners.Close(id, func(id string) {}) // CloseFn usually closes clients, we pass dummy or nil?
-	// server.Listeners.Close takes (id, CloserFn).
-	// We need to actually close the clients connected to this listener.
-	// But `server` doesn't expose a method to close clients for a specific listener easily
-	// except implicitly via the closer callback.
-	// In server.go `Close` calls `closeClients`.
-	// For now we might not be able to forcefully close existing clients if we don't have access to Server clients map.
-	// But `Listeners.Close` calls `listener.Close(closer)`.
-	// The listener implementation calls `closer(id)`.
-
-	l.orgServer.Listeners.Delete(id)
-
-	l.jsonResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
-}
-
-func (l *Management) getListenerType(val listeners.Listener) string {
-	switch val.(type) {
-	case *listeners.TCP:
-		return "tcp"
-	case *listeners.Websocket:
-		return "ws"
-	case *listeners.HTTPStats:
-		return "stats"
-	case *Management:
-		return "management"
-	default:
-		return "unknown"
-	}
+	return n, nil
 }
 
 // Users
@@ -569,7 +497,10 @@ func (l *Management) handleUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ledger.AddUser(req.Username, req.Password, req.Allow, req.Remarks, req.IsAdmin); err != nil {
+		before := userSummary(ledger, req.Username)
+		err := ledger.AddUser(req.Username, req.Password, req.Allow, req.Remarks, req.IsAdmin)
+		l.record(r, "user.update", req.Username, before, userSummary(ledger, req.Username), err)
+		if err != nil {
 			l.jsonError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -593,7 +524,10 @@ func (l *Management) handleUserDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
-	if err := ledger.RemoveUser(username); err != nil {
+	before := userSummary(ledger, username)
+	err := ledger.RemoveUser(username)
+	l.record(r, "user.delete", username, before, nil, err)
+	if err != nil {
 		l.jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -635,7 +569,9 @@ func (l *Management) handleStoredClientDelete(w http.ResponseWriter, r *http.Req
 		return
 	}
 	id := strings.TrimPrefix(r.URL.Path, "/api/v1/storage/clients/")
-	if err := l.storageHook.DeleteClient(id); err != nil {
+	err := l.storageHook.DeleteClient(id)
+	l.record(r, "storage.client.delete", id, nil, nil, err)
+	if err != nil {
 		l.jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -675,7 +611,9 @@ func (l *Management) handleStoredSubscriptionDelete(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := l.storageHook.DeleteSubscription(clientID, filter); err != nil {
+	err := l.storageHook.DeleteSubscription(clientID, filter)
+	l.record(r, "storage.subscription.delete", clientID+":"+filter, nil, nil, err)
+	if err != nil {
 		l.jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -709,7 +647,9 @@ func (l *Management) handleStoredRetainedDelete(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err := l.storageHook.DeleteRetained(topic); err != nil {
+	err := l.storageHook.DeleteRetained(topic)
+	l.record(r, "storage.retained.delete", topic, nil, nil, err)
+	if err != nil {
 		l.jsonError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -731,19 +671,43 @@ func (l *Management) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		tokenStr := bearerToken[1]
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return l.jwtKey, nil
-		})
+		l.serveAuthenticated(w, r, bearerToken[1], next)
+	}
+}
+
+// streamAuthMiddleware authenticates long-lived streams which browsers cannot attach
+// an authorization header to (EventSource, WebSocket), by also accepting a single use
+// stream ticket as a query parameter.
+func (l *Management) streamAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			l.authMiddleware(next)(w, r)
+			return
+		}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		username, ok := l.redeemStreamTicket(r.URL.Query().Get(tapQueryTicket))
+		if !ok {
+			http.Error(w, "authorization required", http.StatusUnauthorized)
 			return
 		}
 
-		next(w, r)
+		next(w, withActor(r, username))
+	}
+}
+
+// serveAuthenticated validates an access token and calls next with the token username as the request actor.
+func (l *Management) serveAuthenticated(w http.ResponseWriter, r *http.Request, tokenStr string, next http.HandlerFunc) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		return l.jwtKey, nil
+	})
+
+	if err != nil || !token.Valid {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
 	}
+
+	next(w, withActor(r, claims.Username))
 }
 
 func (l *Management) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -771,6 +735,7 @@ func (l *Management) handleLogin(w http.ResponseWriter, r *http.Request) {
 			if !u.Disallow {
 				// CHECK FOR ADMIN PRIVILEGE
 				if !u.IsAdmin {
+					l.record(withActor(r, req.Username), "login.forbidden", "", nil, nil, nil)
 					l.jsonError(w, "insufficient privileges", http.StatusForbidden)
 					return
 				}
@@ -781,6 +746,7 @@ func (l *Management) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !authenticated {
+		l.record(withActor(r, req.Username), "login.failed", "", nil, nil, nil)
 		l.jsonError(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
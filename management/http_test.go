@@ -0,0 +1,67 @@
+package management
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/require"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testLedger allows everything, except for the restricted client and the viewer user
+// which can't publish or subscribe to private topics.
+func testLedger() *auth.Ledger {
+	return &auth.Ledger{
+		ACL: auth.ACLRules{
+			{Client: "restricted", Filters: auth.Filters{"private/#": auth.Deny}},
+			{Username: "viewer", Filters: auth.Filters{"private/#": auth.Deny}},
+			{},
+		},
+	}
+}
+
+// newTestManagement returns an initialized management listener for a server with an
+// inline client and an auth hook using the test ledger, and an access token for it.
+func newTestManagement(t *testing.T) (*Management, *mqtt.Server, string) {
+	s := mqtt.New(&mqtt.Options{InlineClient: true, Logger: logger})
+	authHook := new(auth.Hook)
+	require.NoError(t, s.AddHook(authHook, &auth.Options{Ledger: testLedger()}))
+	t.Cleanup(func() { _ = s.Close() })
+
+	l := New(listeners.Config{ID: "mgmt", Address: "127.0.0.1:0"}, s, authHook, nil, nil, nil)
+	require.NoError(t, l.Init(logger))
+
+	token, _, err := l.generateTokens("admin")
+	require.NoError(t, err)
+
+	return l, s, token
+}
+
+// serveTestRequest makes a request to the management api, authenticated with the
+// token if it isn't empty.
+func serveTestRequest(l *Management, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	l, _, token := newTestManagement(t)
+
+	require.Equal(t, http.StatusUnauthorized, serveTestRequest(l, http.MethodGet, "/api/v1/stats", "", "").Code)
+	require.Equal(t, http.StatusUnauthorized, serveTestRequest(l, http.MethodGet, "/api/v1/stats", "nope", "").Code)
+	require.Equal(t, http.StatusOK, serveTestRequest(l, http.MethodGet, "/api/v1/stats", token, "").Code)
+}
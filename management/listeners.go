@@ -0,0 +1,609 @@
+package management
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// redacted replaces private keys in responses, and keeps the saved key when sent back in an update.
+const redacted = "********"
+
+var (
+	ErrInvalidListener    = errors.New("invalid listener")                   // the listener definition is invalid
+	ErrListenerNotManaged = errors.New("listener is not managed by the api") // the listener has no saved definition
+)
+
+// ListenerManager creates listeners from the definitions saved in the settings, so
+// they are recreated on startup, and manages the certificates of TLS listeners so
+// they can be replaced without restarting the listener.
+type ListenerManager struct {
+	sync.Mutex
+	server   *mqtt.Server
+	settings *SettingsManager
+	certs    map[string]*listeners.CertStore // certificates of tls listeners, keyed on listener id
+}
+
+// NewListenerManager returns a new instance of ListenerManager.
+func NewListenerManager(server *mqtt.Server, settings *SettingsManager) *ListenerManager {
+	return &ListenerManager{
+		server:   server,
+		settings: settings,
+		certs:    map[string]*listeners.CertStore{},
+	}
+}
+
+// validate returns an error if the listener definition is incomplete.
+func (cfg ListenerConfig) validate() error {
+	if cfg.ID == "" {
+		return fmt.Errorf("%w: id required", ErrInvalidListener)
+	}
+
+	if cfg.Address == "" {
+		return fmt.Errorf("%w: address required", ErrInvalidListener)
+	}
+
+	if cfg.Type == listeners.TypeQUIC && cfg.TLS == nil {
+		return fmt.Errorf("%w: tls required for %s listeners", ErrInvalidListener, cfg.Type)
+	}
+
+	if cfg.TLS != nil {
+		if cfg.Type == listeners.TypeUnix || cfg.Type == listeners.TypeMQTTSN || cfg.Type == listeners.TypeCoAP {
+			return fmt.Errorf("%w: tls is not available for %s listeners", ErrInvalidListener, cfg.Type)
+		}
+
+		if len(cfg.TLS.Files) == 0 && (cfg.TLS.Cert == "" || cfg.TLS.Key == "") {
+			return fmt.Errorf("%w: tls requires cert and key, or files", ErrInvalidListener)
+		}
+	}
+
+	if cfg.Policy != nil {
+		if err := cfg.Policy.Validate(); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidListener, err)
+		}
+	}
+
+	return nil
+}
+
+// loadCertificates loads the certificates of a tls definition into a certificate store.
+func loadCertificates(certs *listeners.CertStore, c *ListenerTLS) error {
+	if len(c.Files) > 0 {
+		if err := certs.LoadFiles(c.Files...); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidListener, err)
+		}
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(c.Cert), []byte(c.Key))
+	if err != nil {
+		return fmt.Errorf("%w: invalid cert/key: %s", ErrInvalidListener, err)
+	}
+
+	_ = certs.LoadFiles() // forget any files the previous certificates were loaded from
+	return certs.Set(cert)
+}
+
+// tlsConfig returns the tls config for a listener presenting the certificates in the
+// store, verifying client certificates against the client ca if one is set.
+func (c *ListenerTLS) tlsConfig(certs *listeners.CertStore) (*tls.Config, error) {
+	base := new(tls.Config)
+	if c.ClientCA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.ClientCA)) {
+			return nil, fmt.Errorf("%w: invalid client ca", ErrInvalidListener)
+		}
+		base.ClientCAs = pool
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	switch c.ClientAuth {
+	case "":
+	case "none":
+		base.ClientAuth = tls.NoClientCert
+	case "request":
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("%w: invalid client_auth %q", ErrInvalidListener, c.ClientAuth)
+	}
+
+	if base.ClientAuth != tls.NoClientCert && base.ClientCAs == nil {
+		return nil, fmt.Errorf("%w: client_auth requires a client ca", ErrInvalidListener)
+	}
+
+	return certs.TLSConfig(base), nil
+}
+
+// build creates a listener from its definition, returning the certificate store of
+// the listener if it uses tls.
+func (m *ListenerManager) build(cfg ListenerConfig) (listeners.Listener, *listeners.CertStore, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	config := listeners.Config{
+		Type:        cfg.Type,
+		ID:          cfg.ID,
+		Address:     cfg.Address,
+		Proxy:       cfg.Proxy,
+		Websocket:   cfg.Websocket,
+		QUIC:        cfg.QUIC,
+		MQTTSN:      cfg.MQTTSN,
+		HTTPGateway: cfg.HTTPGateway,
+		CoAP:        cfg.CoAP,
+		Policy:      cfg.Policy,
+	}
+
+	var certs *listeners.CertStore
+	if cfg.TLS != nil {
+		certs = listeners.NewCertStore()
+		if err := loadCertificates(certs, cfg.TLS); err != nil {
+			return nil, nil, err
+		}
+
+		tlsConfig, err := cfg.TLS.tlsConfig(certs)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.TLSConfig = tlsConfig
+	}
+
+	switch cfg.Type {
+	case listeners.TypeTCP:
+		return listeners.NewTCP(config), certs, nil
+	case listeners.TypeWS:
+		return listeners.NewWebsocket(config), certs, nil
+	case listeners.TypeUnix:
+		return listeners.NewUnixSock(config), certs, nil
+	case listeners.TypeQUIC:
+		return listeners.NewQUIC(config), certs, nil
+	case listeners.TypeMQTTSN:
+		return listeners.NewMQTTSN(config), certs, nil
+	case listeners.TypeHTTPGateway:
+		return listeners.NewHTTPGateway(config), certs, nil
+	case listeners.TypeCoAP:
+		return listeners.NewCoAP(config), certs, nil
+	case listeners.TypeHealthCheck:
+		return listeners.NewHTTPHealthCheck(config), certs, nil
+	case listeners.TypeSysInfo:
+		return listeners.NewHTTPStats(config, m.server.Info), certs, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported listener type %q", ErrInvalidListener, cfg.Type)
+	}
+}
+
+// add builds a listener and adds it to the server, serving it if serve is true.
+func (m *ListenerManager) add(cfg ListenerConfig, serve bool) error {
+	lst, certs, err := m.build(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := m.server.AddListener(lst); err != nil {
+		return err
+	}
+
+	if certs != nil {
+		m.certs[cfg.ID] = certs
+	} else {
+		delete(m.certs, cfg.ID)
+	}
+
+	if serve {
+		m.server.Listeners.Serve(cfg.ID, m.server.EstablishConnection)
+	}
+
+	return nil
+}
+
+// Restore adds the listeners saved in the settings to the server. It should be
+// called before the server is served. Listeners which can't be created are skipped,
+// and the errors are returned together.
+func (m *ListenerManager) Restore() error {
+	m.Lock()
+	defer m.Unlock()
+
+	var errs []error
+	for _, cfg := range m.settings.GetListeners() {
+		if err := m.add(cfg, false); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %w", cfg.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Create adds and serves a new listener, and saves its definition.
+func (m *ListenerManager) Create(cfg ListenerConfig) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.add(cfg, true); err != nil {
+		return err
+	}
+
+	return m.settings.UpdateListener(cfg)
+}
+
+// Update replaces the definition of a saved listener. If only the certificates have
+// changed they are swapped in the running listener and connected clients are unaffected;
+// otherwise the listener is recreated, and its clients are disconnected once the new
+// listener is running. The previous listener is restored if the update fails.
+// It returns whether the listener was reloaded or restarted.
+func (m *ListenerManager) Update(cfg ListenerConfig) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	old, ok := m.settings.GetListener(cfg.ID)
+	if !ok {
+		return "", ErrListenerNotManaged
+	}
+
+	if cfg.TLS != nil && old.TLS != nil && (cfg.TLS.Key == "" || cfg.TLS.Key == redacted) {
+		cfg.TLS.Key = old.TLS.Key
+	}
+
+	if err := cfg.validate(); err != nil {
+		return "", err
+	}
+
+	if certs, ok := m.certs[cfg.ID]; ok && certificatesOnly(old, cfg) {
+		if err := loadCertificates(certs, cfg.TLS); err != nil {
+			return "", err
+		}
+		return "reloaded", m.settings.UpdateListener(cfg)
+	}
+
+	lst, certs, err := m.build(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// the old listener stops accepting connections so that its address can be reused,
+	// but its clients are only disconnected once the new listener has replaced it.
+	clients := m.server.Clients.GetByListener(cfg.ID)
+	m.server.Listeners.Close(cfg.ID, func(id string) {})
+	m.server.Listeners.Delete(cfg.ID)
+
+	if err := m.server.AddListener(lst); err != nil {
+		return "", m.restore(old, err)
+	}
+
+	if err := m.settings.UpdateListener(cfg); err != nil {
+		m.server.Listeners.Close(cfg.ID, func(id string) {})
+		m.server.Listeners.Delete(cfg.ID)
+		return "", m.restore(old, err)
+	}
+
+	if certs != nil {
+		m.certs[cfg.ID] = certs
+	} else {
+		delete(m.certs, cfg.ID)
+	}
+	m.server.Listeners.Serve(cfg.ID, m.server.EstablishConnection)
+
+	for _, cl := range clients {
+		if !cl.Net.Inline && !cl.Closed() {
+			_ = m.server.DisconnectClient(cl, packets.ErrServerMoved)
+		}
+	}
+
+	return "restarted", nil
+}
+
+// restore recreates the previous listener after an update failed, and restores its
+// saved definition.
+func (m *ListenerManager) restore(old ListenerConfig, err error) error {
+	if rerr := m.add(old, true); rerr != nil {
+		return errors.Join(err, fmt.Errorf("restore listener: %w", rerr))
+	}
+
+	if rerr := m.settings.UpdateListener(old); rerr != nil {
+		return errors.Join(err, fmt.Errorf("restore listener definition: %w", rerr))
+	}
+
+	return err
+}
+
+// Delete drains and removes a listener, and deletes its saved definition if it has one.
+// It returns the number of clients which were disconnected.
+func (m *ListenerManager) Delete(id string, opts mqtt.DrainOptions) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	n, err := m.server.DrainListener(id, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	delete(m.certs, id)
+	if _, ok := m.settings.GetListener(id); ok {
+		return n, m.settings.DeleteListener(id)
+	}
+
+	return n, nil
+}
+
+// certificatesOnly returns true if two listener definitions differ only by their certificates.
+func certificatesOnly(a, b ListenerConfig) bool {
+	if a.TLS == nil || b.TLS == nil {
+		return false
+	}
+
+	at, bt := *a.TLS, *b.TLS
+	at.Cert, at.Key, at.Files = "", "", nil
+	bt.Cert, bt.Key, bt.Files = "", "", nil
+	a.TLS, b.TLS = &at, &bt
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Managed returns true if the listener has a saved definition.
+func (m *ListenerManager) Managed(id string) bool {
+	_, ok := m.settings.GetListener(id)
+	return ok
+}
+
+// Reload reloads the certificates of listeners which load them from files.
+func (m *ListenerManager) Reload() error {
+	m.Lock()
+	defer m.Unlock()
+
+	var errs []error
+	for id, certs := range m.certs {
+		if err := certs.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %w", id, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Watch reloads the certificates of listeners which load them from files when the
+// files change, checking at each interval until stop is closed.
+func (m *ListenerManager) Watch(interval time.Duration, log *slog.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.Lock()
+			for id, certs := range m.certs {
+				reloaded, err := certs.ReloadIfChanged()
+				if err != nil {
+					log.Error("failed to reload tls certificates", "listener", id, "error", err)
+				} else if reloaded {
+					log.Info("reloaded tls certificates", "listener", id)
+				}
+			}
+			m.Unlock()
+		}
+	}
+}
+
+// SetListenerManager sets the listener manager used by the listener endpoints to
+// create, update and delete listeners. It should be called before the listener is served.
+func (l *Management) SetListenerManager(m *ListenerManager) {
+	l.listenerManager = m
+}
+
+// listenerSummary returns a listener definition as recorded in the audit log, without secrets.
+func listenerSummary(cfg ListenerConfig) map[string]any {
+	v := map[string]any{"id": cfg.ID, "type": cfg.Type, "address": cfg.Address, "tls": cfg.TLS != nil}
+	if cfg.TLS != nil {
+		v["has_cert"] = cfg.TLS.Cert != "" || len(cfg.TLS.Files) > 0
+		v["has_key"] = cfg.TLS.Key != "" || len(cfg.TLS.Files) > 0
+		v["mtls"] = cfg.TLS.ClientCA != ""
+	}
+	return v
+}
+
+// redactListener returns a copy of a listener definition with its private key redacted.
+func redactListener(cfg ListenerConfig) ListenerConfig {
+	if cfg.TLS != nil && cfg.TLS.Key != "" {
+		t := *cfg.TLS
+		t.Key = redacted
+		cfg.TLS = &t
+	}
+	return cfg
+}
+
+// handleListeners lists the running listeners with their saved definitions (GET),
+// and creates a new listener from a definition (POST).
+func (l *Management) handleListeners(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ls := l.orgServer.Listeners.GetAll()
+		resp := make([]map[string]any, 0, len(ls))
+		for id, lst := range ls {
+			v := map[string]any{
+				"id":       id,
+				"address":  lst.Address(),
+				"protocol": lst.Protocol(),
+				"type":     l.getListenerType(lst),
+				"managed":  false,
+			}
+			if l.settings != nil {
+				if cfg, ok := l.settings.GetListener(id); ok {
+					v["managed"] = true
+					v["config"] = redactListener(cfg)
+				}
+			}
+			resp = append(resp, v)
+		}
+		l.jsonResponse(w, resp, http.StatusOK)
+
+	case http.MethodPost:
+		if l.listenerManager == nil {
+			l.jsonError(w, "listener management not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req ListenerConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			l.jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.ID == l.id || req.ID == tlsListenerID {
+			l.jsonError(w, "listener id is reserved", http.StatusBadRequest)
+			return
+		}
+
+		err := l.listenerManager.Create(req)
+		l.record(r, "listener.create", req.ID, nil, listenerSummary(req), err)
+		if err != nil {
+			l.jsonError(w, err.Error(), listenerErrorStatus(err))
+			return
+		}
+
+		l.jsonResponse(w, map[string]string{"status": "ok"}, http.StatusCreated)
+
+	default:
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListener updates a saved listener (PUT), or drains and deletes a listener (DELETE).
+func (l *Management) handleListener(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/listeners/")
+	if id == "" {
+		l.jsonError(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	if id == l.id {
+		l.jsonError(w, "the management listener can't be changed", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if l.listenerManager == nil {
+			l.jsonError(w, "listener management not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req ListenerConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			l.jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.ID = id
+
+		before, _ := l.settings.GetListener(id)
+		status, err := l.listenerManager.Update(req)
+		l.record(r, "listener.update", id, listenerSummary(before), listenerSummary(req), err)
+		if err != nil {
+			l.jsonError(w, err.Error(), listenerErrorStatus(err))
+			return
+		}
+
+		l.jsonResponse(w, map[string]string{"status": "ok", "listener": status}, http.StatusOK)
+
+	case http.MethodDelete:
+		l.handleListenerDelete(w, r, id)
+
+	default:
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListenerDelete drains and deletes a listener, paced over the drain period in the
+// background if one is given.
+func (l *Management) handleListenerDelete(w http.ResponseWriter, r *http.Request, id string) {
+	lst, ok := l.orgServer.Listeners.Get(id)
+	if !ok {
+		l.jsonError(w, "listener not found", http.StatusNotFound)
+		return
+	}
+	before := map[string]string{"id": id, "type": l.getListenerType(lst), "address": lst.Address()}
+
+	opts, err := drainOptions(r)
+	if err != nil {
+		l.jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the listener is stopped before responding, and its clients are disconnected in
+	// the background when paced over a period.
+	opts.Background = opts.Period > 0
+
+	var n int
+	if l.listenerManager != nil {
+		n, err = l.listenerManager.Delete(id, opts)
+	} else {
+		n, err = l.orgServer.DrainListener(id, opts)
+	}
+	l.record(r, "listener.delete", id, before, nil, err)
+	if err != nil {
+		l.jsonError(w, err.Error(), listenerErrorStatus(err))
+		return
+	}
+
+	if opts.Background {
+		l.jsonResponse(w, map[string]any{"status": "draining", "clients": n}, http.StatusAccepted)
+		return
+	}
+
+	l.jsonResponse(w, map[string]any{"status": "ok", "clients": n}, http.StatusOK)
+}
+
+// listenerErrorStatus returns the http status for an error creating, updating or deleting a listener.
+func listenerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidListener):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrListenerNotManaged), errors.Is(err, mqtt.ErrListenerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, mqtt.ErrListenerIDExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// getListenerType returns the type of a listener.
+func (l *Management) getListenerType(val listeners.Listener) string {
+	switch val.(type) {
+	case *listeners.TCP:
+		return listeners.TypeTCP
+	case *listeners.Websocket:
+		return listeners.TypeWS
+	case *listeners.UnixSock:
+		return listeners.TypeUnix
+	case *listeners.QUIC:
+		return listeners.TypeQUIC
+	case *listeners.MQTTSN:
+		return listeners.TypeMQTTSN
+	case *listeners.HTTPGateway:
+		return listeners.TypeHTTPGateway
+	case *listeners.CoAP:
+		return listeners.TypeCoAP
+	case *listeners.HTTPHealthCheck:
+		return listeners.TypeHealthCheck
+	case *listeners.HTTPStats:
+		return listeners.TypeSysInfo
+	case *Management:
+		return "management"
+	default:
+		return "unknown"
+	}
+}
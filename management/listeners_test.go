@@ -0,0 +1,88 @@
+package management
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestListenerManager returns a listener manager for a served server, saving its
+// settings in a temporary directory.
+func newTestListenerManager(t *testing.T) (*ListenerManager, *mqtt.Server) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	require.NoError(t, s.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, s.Serve())
+	t.Cleanup(func() { _ = s.Close() })
+
+	return NewListenerManager(s, &SettingsManager{}), s
+}
+
+// connectTestClient connects an mqtt client to a listener address.
+func connectTestClient(t *testing.T, s *mqtt.Server, address, id string) *mqtt.Client {
+	c, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	_, err = c.Write(append([]byte{0x10, byte(12 + len(id)), 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, byte(len(id))}, id...))
+	require.NoError(t, err)
+	connack := make([]byte, 4)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadFull(c, connack)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x00), connack[3])
+
+	cl, ok := s.Clients.Get(id)
+	require.True(t, ok)
+	return cl
+}
+
+func TestListenerManagerUpdate(t *testing.T) {
+	m, s := newTestListenerManager(t)
+	require.NoError(t, m.Create(ListenerConfig{Type: "tcp", ID: "t1", Address: "127.0.0.1:0"}))
+	lst, _ := s.Listeners.Get("t1")
+	cl := connectTestClient(t, s, lst.Address(), "c1")
+
+	status, err := m.Update(ListenerConfig{Type: "tcp", ID: "t1", Address: "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.Equal(t, "restarted", status)
+
+	// the clients of the old listener are moved once the new listener is running
+	require.Eventually(t, cl.Closed, time.Second, time.Millisecond)
+	lst, ok := s.Listeners.Get("t1")
+	require.True(t, ok)
+	connectTestClient(t, s, lst.Address(), "c2")
+}
+
+func TestListenerManagerUpdateRestored(t *testing.T) {
+	m, s := newTestListenerManager(t)
+	require.NoError(t, m.Create(ListenerConfig{Type: "tcp", ID: "t1", Address: "127.0.0.1:0"}))
+	lst, _ := s.Listeners.Get("t1")
+	cl := connectTestClient(t, s, lst.Address(), "c1")
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	_, err = m.Update(ListenerConfig{Type: "tcp", ID: "t1", Address: busy.Addr().String()})
+	require.Error(t, err)
+
+	// the previous listener and its definition are restored, and its clients are kept
+	require.False(t, cl.Closed())
+	cfg, ok := m.settings.GetListener("t1")
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:0", cfg.Address)
+	lst, ok = s.Listeners.Get("t1")
+	require.True(t, ok)
+	connectTestClient(t, s, lst.Address(), "c2")
+}
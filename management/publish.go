@@ -0,0 +1,197 @@
+package management
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	publishEncodingText   = "text"          // the payload is plain text
+	publishEncodingBase64 = "base64"        // the payload is base64 encoded binary
+	publishMaxBodySize    = 4 * 1024 * 1024 // the largest publish request body accepted
+)
+
+// publishRequest is the body of a management publish request.
+type publishRequest struct {
+	Topic           string            `json:"topic"`                      // the topic to publish to
+	Payload         string            `json:"payload"`                    // the message payload
+	Encoding        string            `json:"encoding,omitempty"`         // text (default) or base64
+	Qos             byte              `json:"qos"`                        // the qos to publish with
+	Retain          bool              `json:"retain"`                     // retain the message
+	ClientID        string            `json:"client_id,omitempty"`        // publish as this client id instead of the inline client
+	ContentType     string            `json:"content_type,omitempty"`     // v5 content type
+	ResponseTopic   string            `json:"response_topic,omitempty"`   // v5 response topic
+	CorrelationData string            `json:"correlation_data,omitempty"` // v5 correlation data, base64 encoded
+	UserProperties  map[string]string `json:"user_properties,omitempty"`  // v5 user properties
+	MessageExpiry   uint32            `json:"message_expiry,omitempty"`   // v5 message expiry interval in seconds
+	PayloadFormat   *byte             `json:"payload_format,omitempty"`   // v5 payload format indicator
+}
+
+// packet builds the publish packet for the request.
+func (req publishRequest) packet() (packets.Packet, error) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    req.Qos,
+			Retain: req.Retain,
+		},
+		TopicName: req.Topic,
+		Properties: packets.Properties{
+			ContentType:           req.ContentType,
+			ResponseTopic:         req.ResponseTopic,
+			MessageExpiryInterval: req.MessageExpiry,
+		},
+	}
+
+	switch req.Encoding {
+	case "", publishEncodingText:
+		pk.Payload = []byte(req.Payload)
+	case publishEncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			return pk, err
+		}
+		pk.Payload = b
+	default:
+		return pk, packets.ErrPayloadFormatInvalid
+	}
+
+	if req.CorrelationData != "" {
+		b, err := base64.StdEncoding.DecodeString(req.CorrelationData)
+		if err != nil {
+			return pk, err
+		}
+		pk.Properties.CorrelationData = b
+	}
+
+	if req.PayloadFormat != nil {
+		pk.Properties.PayloadFormat = *req.PayloadFormat
+		pk.Properties.PayloadFormatFlag = true
+	}
+
+	keys := make([]string, 0, len(req.UserProperties))
+	for k := range req.UserProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // deterministic property order
+
+	for _, k := range keys {
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: k, Val: req.UserProperties[k]})
+	}
+
+	return pk, nil
+}
+
+// summary returns an audit summary of the publish request, excluding the payload.
+func (req publishRequest) summary() map[string]any {
+	return map[string]any{
+		"topic":     req.Topic,
+		"qos":       req.Qos,
+		"retain":    req.Retain,
+		"client_id": req.ClientID,
+		"size":      len(req.Payload),
+	}
+}
+
+// publishClient returns the client a management publish is injected through, and the
+// client its ACL is checked as. Messages published as a chosen client id use a transient
+// inline client carrying that identity, so the origin (and no-local handling) matches the
+// client without sending acknowledgements to the real connection. The ACL is checked as
+// the connected client if there is one, or as a regular client with the same identity.
+func (l *Management) publishClient(clientID string) (cl *mqtt.Client, check *mqtt.Client, ok bool) {
+	if clientID == "" {
+		cl, ok = l.orgServer.Clients.Get(mqtt.InlineClientId)
+		return cl, nil, ok
+	}
+
+	cl = l.orgServer.NewClient(nil, mqtt.LocalListener, clientID, true)
+	cl.Properties.ProtocolVersion = 5
+
+	check, ok = l.orgServer.Clients.Get(clientID)
+	if !ok || check.Net.Inline {
+		check = l.orgServer.NewClient(nil, mqtt.LocalListener, clientID, false) // inline clients bypass acls
+		check.Properties.ProtocolVersion = 5
+	}
+	cl.Properties.Username = check.Properties.Username
+
+	return cl, check, true
+}
+
+// handlePublish publishes a message to the broker and reports how many subscribers matched.
+func (l *Management) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !l.orgServer.Options.InlineClient {
+		l.jsonError(w, "publishing requires the inline client", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req publishRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, publishMaxBodySize)).Decode(&req); err != nil {
+		status := http.StatusBadRequest
+		if errors.As(err, new(*http.MaxBytesError)) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		l.jsonError(w, err.Error(), status)
+		return
+	}
+
+	if !mqtt.IsValidFilter(req.Topic, true) {
+		l.jsonError(w, "invalid topic", http.StatusBadRequest)
+		return
+	}
+
+	if req.Qos > 2 {
+		l.jsonError(w, "invalid qos", http.StatusBadRequest)
+		return
+	}
+
+	pk, err := req.packet()
+	if err != nil {
+		l.jsonError(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cl, check, ok := l.publishClient(req.ClientID)
+	if !ok {
+		l.jsonError(w, "inline client not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if check != nil && !l.orgServer.ACLCheck(check, req.Topic, true) {
+		l.record(r, "publish", req.Topic, nil, req.summary(), packets.ErrNotAuthorized)
+		l.jsonError(w, "client not authorized to publish to topic", http.StatusForbidden)
+		return
+	}
+
+	if pk.FixedHeader.Qos > 0 {
+		id, err := cl.NextPacketID() // the inbound qos flow is never processed, but a packet id is required for validity checks
+		if err != nil {
+			l.jsonError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		pk.PacketID = uint16(id)
+	}
+
+	matched := l.orgServer.CountSubscribers(pk)
+	err = l.orgServer.InjectPacket(cl, pk)
+	l.record(r, "publish", req.Topic, nil, req.summary(), err)
+	if err != nil {
+		l.jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.jsonResponse(w, map[string]any{
+		"status":      "ok",
+		"subscribers": matched,
+	}, http.StatusOK)
+}
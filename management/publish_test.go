@@ -0,0 +1,127 @@
+package management
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// subscribeTest subscribes an inline handler to a filter, returning the messages it receives.
+func subscribeTest(t *testing.T, s *mqtt.Server, filter string) chan packets.Packet {
+	received := make(chan packets.Packet, 4)
+	require.NoError(t, s.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func TestPublishUnauthorized(t *testing.T) {
+	l, _, _ := newTestManagement(t)
+	w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", "", `{"topic":"a/b","payload":"x"}`)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPublishMethodNotAllowed(t *testing.T) {
+	l, _, token := newTestManagement(t)
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/publish", token, "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestPublishInvalid(t *testing.T) {
+	l, _, token := newTestManagement(t)
+
+	tt := []struct {
+		desc   string
+		body   string
+		status int
+	}{
+		{desc: "json", body: `{`, status: http.StatusBadRequest},
+		{desc: "topic", body: `{"topic":"a/#","payload":"x"}`, status: http.StatusBadRequest},
+		{desc: "qos", body: `{"topic":"a/b","payload":"x","qos":3}`, status: http.StatusBadRequest},
+		{desc: "encoding", body: `{"topic":"a/b","payload":"x","encoding":"hex"}`, status: http.StatusBadRequest},
+		{desc: "base64", body: `{"topic":"a/b","payload":"!","encoding":"base64"}`, status: http.StatusBadRequest},
+		{desc: "too large", body: `{"topic":"a/b","payload":"` + strings.Repeat("x", publishMaxBodySize) + `"}`, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, tx.body)
+			require.Equal(t, tx.status, w.Code)
+		})
+	}
+}
+
+func TestPublishQos(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	received := subscribeTest(t, s, "a/b")
+
+	for _, qos := range []byte{0, 1, 2} {
+		body := fmt.Sprintf(`{"topic":"a/b","payload":"hello","qos":%d}`, qos)
+		w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, `{"status":"ok","subscribers":1}`, w.Body.String())
+
+		pk := <-received
+		require.Equal(t, []byte("hello"), pk.Payload)
+		require.Equal(t, qos, pk.FixedHeader.Qos)
+		require.Equal(t, qos > 0, pk.PacketID > 0)
+	}
+}
+
+func TestPublishRetain(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"a/b","payload":"kept","retain":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	retained := s.Topics.Messages("a/b")
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("kept"), retained[0].Payload)
+
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"c/d","payload":"gone"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"status":"ok","subscribers":0}`, w.Body.String())
+	require.Empty(t, s.Topics.Messages("c/d"))
+}
+
+func TestPublishAsClient(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	received := subscribeTest(t, s, "#")
+
+	w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"private/a","payload":"x","client_id":"restricted"}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Empty(t, received)
+
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"public/a","payload":"x","client_id":"restricted","qos":1}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	pk := <-received
+	require.Equal(t, "restricted", pk.Origin)
+
+	// the inline client is not restricted by acls.
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"private/a","payload":"x"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	pk = <-received
+	require.Equal(t, mqtt.InlineClientId, pk.Origin)
+}
+
+func TestPublishAsConnectedClient(t *testing.T) {
+	l, s, token := newTestManagement(t)
+
+	cl := s.NewClient(nil, "tcp1", "restricted", false)
+	s.Clients.Add(cl)
+
+	w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"private/a","payload":"x","client_id":"restricted"}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestPublishInlineClientDisabled(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	s.Options.InlineClient = false
+
+	w := serveTestRequest(l, http.MethodPost, "/api/v1/publish", token, `{"topic":"a/b","payload":"x"}`)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
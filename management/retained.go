@@ -0,0 +1,204 @@
+package management
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	retainedDefaultLimit   = 100        // default number of retained messages returned per page
+	retainedMaxLimit       = 1000       // maximum number of retained messages returned per page
+	retainedDefaultPreview = 256        // default payload preview bytes per message
+	retainedMaxPreview     = 64 * 1024  // maximum payload preview bytes per message
+	retainedQueryFilter    = "filter"   // query parameter carrying the topic filter
+	retainedQueryCursor    = "cursor"   // query parameter carrying the page cursor
+	retainedQueryLimit     = "limit"    // query parameter carrying the page size
+	retainedQueryPreview   = "preview"  // query parameter carrying the payload preview size
+	retainedQueryMinSize   = "min_size" // query parameter carrying the minimum payload size
+	retainedQueryDryRun    = "dry_run"  // query parameter requesting a count instead of a delete
+)
+
+// retainedMessage is a retained message as returned by the retained message api.
+type retainedMessage struct {
+	Topic     string `json:"topic"`               // the topic the message is retained on
+	Qos       byte   `json:"qos"`                 // the qos the message was published with
+	Origin    string `json:"origin,omitempty"`    // the id of the client which published the message
+	Created   int64  `json:"created"`             // the time the message was published, in unix seconds
+	Expiry    int64  `json:"expiry,omitempty"`    // the time the message expires, in unix seconds
+	Payload   string `json:"payload"`             // the (possibly truncated) payload preview
+	Encoding  string `json:"encoding"`            // the encoding of the payload preview
+	Size      int    `json:"size"`                // the original size of the payload in bytes
+	Truncated bool   `json:"truncated,omitempty"` // the payload preview was truncated
+}
+
+// retainedPage is a page of retained messages.
+type retainedPage struct {
+	Messages   []retainedMessage `json:"messages"`              // the retained messages on the page, ordered by topic level
+	NextCursor string            `json:"next_cursor,omitempty"` // the cursor of the next page, empty on the last page
+}
+
+// newRetainedMessage returns the api representation of a retained message with a payload
+// preview of at most preview bytes.
+func newRetainedMessage(pk packets.Packet, preview int) retainedMessage {
+	m := retainedMessage{
+		Topic:   pk.TopicName,
+		Qos:     pk.FixedHeader.Qos,
+		Origin:  pk.Origin,
+		Created: pk.Created,
+		Expiry:  pk.Expiry,
+		Size:    len(pk.Payload),
+	}
+
+	payload := pk.Payload
+	if len(payload) > preview {
+		payload = payload[:preview]
+		m.Truncated = true
+	}
+
+	text := payload
+	if m.Truncated {
+		text = trimPartialRune(payload)
+	}
+
+	if utf8.Valid(text) {
+		m.Payload = string(text)
+		m.Encoding = tapEncodingUTF8
+	} else {
+		m.Payload = base64.StdEncoding.EncodeToString(payload)
+		m.Encoding = tapEncodingBase64
+	}
+
+	return m
+}
+
+// encodeRetainedCursor returns the opaque page cursor following a topic.
+func encodeRetainedCursor(topic string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(topic))
+}
+
+// decodeRetainedCursor returns the topic a page cursor follows.
+func decodeRetainedCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(b), err
+}
+
+// retainedFilter returns the validated topic filter of a retained message request,
+// matching all topics by default when listing.
+func retainedFilter(r *http.Request) (string, bool) {
+	filter := r.URL.Query().Get(retainedQueryFilter)
+	if filter == "" {
+		filter = "#"
+	}
+
+	return filter, mqtt.IsValidFilter(filter, false)
+}
+
+// handleRetained lists the live retained messages matching a topic filter a page at a
+// time, or deletes them in bulk. Deleted messages are also removed from persistent storage.
+func (l *Management) handleRetained(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l.handleRetainedList(w, r)
+	case http.MethodDelete:
+		l.handleRetainedDelete(w, r)
+	default:
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRetainedList returns a page of the retained messages matching the filter, walking
+// the topics index in order of topic level from the cursor topic.
+func (l *Management) handleRetainedList(w http.ResponseWriter, r *http.Request) {
+	filter, ok := retainedFilter(r)
+	if !ok {
+		l.jsonError(w, "invalid topic filter", http.StatusBadRequest)
+		return
+	}
+
+	params := r.URL.Query()
+	limit, err := parseQueryInt(params.Get(retainedQueryLimit), retainedDefaultLimit, retainedMaxLimit)
+	if err != nil {
+		l.jsonError(w, "limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := parseQueryInt(params.Get(retainedQueryPreview), retainedDefaultPreview, retainedMaxPreview)
+	if err != nil {
+		l.jsonError(w, "preview: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var minSize int
+	if v := params.Get(retainedQueryMinSize); v != "" {
+		if minSize, err = strconv.Atoi(v); err != nil || minSize < 0 {
+			l.jsonError(w, "invalid min_size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var after string
+	if v := params.Get(retainedQueryCursor); v != "" {
+		if after, err = decodeRetainedCursor(v); err != nil {
+			l.jsonError(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page := retainedPage{
+		Messages: []retainedMessage{},
+	}
+
+	l.orgServer.Topics.WalkMessages(filter, after, func(pk packets.Packet) bool {
+		if len(pk.Payload) < minSize {
+			return true
+		}
+
+		if len(page.Messages) == limit {
+			page.NextCursor = encodeRetainedCursor(page.Messages[limit-1].Topic)
+			return false
+		}
+
+		page.Messages = append(page.Messages, newRetainedMessage(pk, preview))
+		return true
+	})
+
+	l.jsonResponse(w, page, http.StatusOK)
+}
+
+// handleRetainedDelete deletes the retained messages matching the filter, or only counts
+// them if a dry run is requested. The filter must be given explicitly, so that deleting
+// every retained message takes a filter of #.
+func (l *Management) handleRetainedDelete(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get(retainedQueryFilter) == "" {
+		l.jsonError(w, "filter is required, use # to delete all retained messages", http.StatusBadRequest)
+		return
+	}
+
+	filter, ok := retainedFilter(r)
+	if !ok {
+		l.jsonError(w, "invalid topic filter", http.StatusBadRequest)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get(retainedQueryDryRun))
+	if dryRun {
+		l.jsonResponse(w, map[string]any{
+			"status":  "ok",
+			"dry_run": true,
+			"count":   len(l.orgServer.Topics.Messages(filter)),
+		}, http.StatusOK)
+		return
+	}
+
+	cleared := l.orgServer.ClearRetained(filter)
+	l.record(r, "retained.delete", filter, nil, map[string]any{"count": len(cleared)}, nil)
+	l.jsonResponse(w, map[string]any{
+		"status": "ok",
+		"count":  len(cleared),
+	}, http.StatusOK)
+}
@@ -0,0 +1,70 @@
+package management
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetainedList(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	for _, topic := range []string{"a/c", "a/b", "a/b/c", "b"} {
+		s.Topics.RetainMessage(packets.Packet{TopicName: topic, Payload: []byte(topic)})
+	}
+
+	var page retainedPage
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/retained?limit=2", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Messages, 2)
+	require.Equal(t, "a/b", page.Messages[0].Topic)
+	require.Equal(t, "a/b/c", page.Messages[1].Topic)
+	require.NotEmpty(t, page.NextCursor)
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/retained?limit=2&cursor="+page.NextCursor, token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	page = retainedPage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Messages, 2)
+	require.Equal(t, "a/c", page.Messages[0].Topic)
+	require.Equal(t, "b", page.Messages[1].Topic)
+	require.Empty(t, page.NextCursor) // the last page
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/retained?filter=a/%23&min_size=4", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	page = retainedPage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Messages, 1)
+	require.Equal(t, "a/b/c", page.Messages[0].Topic)
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/retained?filter=a/%23/b", token, "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRetainedDelete(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	for _, topic := range []string{"a/b", "a/c", "b"} {
+		s.Topics.RetainMessage(packets.Packet{TopicName: topic, Payload: []byte(topic)})
+	}
+
+	w := serveTestRequest(l, http.MethodDelete, "/api/v1/retained", token, "")
+	require.Equal(t, http.StatusBadRequest, w.Code) // the filter is required
+	require.Len(t, s.Topics.Messages("#"), 3)
+
+	w = serveTestRequest(l, http.MethodDelete, "/api/v1/retained?filter=a/%2B&dry_run=true", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"status":"ok","dry_run":true,"count":2}`, w.Body.String())
+	require.Len(t, s.Topics.Messages("#"), 3)
+
+	w = serveTestRequest(l, http.MethodDelete, "/api/v1/retained?filter=a/%2B", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"status":"ok","count":2}`, w.Body.String())
+	require.Len(t, s.Topics.Messages("#"), 1)
+
+	w = serveTestRequest(l, http.MethodDelete, "/api/v1/retained?filter=%23", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, s.Topics.Messages("#"))
+}
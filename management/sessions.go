@@ -0,0 +1,327 @@
+package management
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	sessionSourceLive   = "live"   // the session is held by the running broker
+	sessionSourceStored = "stored" // the session is only known to the storage hook
+)
+
+// sessionSubscription is a subscription held by a session.
+type sessionSubscription struct {
+	Filter            string         `json:"filter"`                // the topic filter
+	Qos               byte           `json:"qos"`                   // the maximum qos of the subscription
+	NoLocal           bool           `json:"no_local"`              // v5 no local option
+	RetainAsPublished bool           `json:"retain_as_published"`   // v5 retain as published option
+	RetainHandling    byte           `json:"retain_handling"`       // v5 retain handling option
+	Identifier        int            `json:"identifier,omitempty"`  // v5 subscription identifier
+	Identifiers       map[string]int `json:"identifiers,omitempty"` // subscription identifiers keyed on filter, for overlapping subscriptions
+	Stored            bool           `json:"stored"`                // the subscription is held by the storage hook
+}
+
+// sessionInflight is an inflight message held by a session.
+type sessionInflight struct {
+	PacketID uint16 `json:"packet_id"`        // the packet id of the message
+	Type     string `json:"type"`             // the packet type awaiting acknowledgement, eg. PUBLISH or PUBREL
+	Topic    string `json:"topic,omitempty"`  // the topic of the message
+	Qos      byte   `json:"qos"`              // the qos of the message
+	Size     int    `json:"size"`             // the size of the payload in bytes
+	Created  int64  `json:"created"`          // the time the message was created, in unix seconds
+	Sent     int64  `json:"sent,omitempty"`   // the time the message was last sent, in unix seconds (stored only)
+	Expiry   int64  `json:"expiry,omitempty"` // the time the message expires, in unix seconds, or -1 if waiting for send quota
+	Resends  int    `json:"resends"`          // the number of times the message has been resent
+	Stored   bool   `json:"stored"`           // the message is held by the storage hook
+}
+
+// sessionWill is the will message of a session.
+type sessionWill struct {
+	Topic   string `json:"topic"`             // the will topic
+	Qos     byte   `json:"qos"`               // the will qos
+	Retain  bool   `json:"retain"`            // the will is retained
+	Size    int    `json:"size"`              // the size of the will payload in bytes
+	Delay   uint32 `json:"delay"`             // the will delay interval in seconds
+	Pending bool   `json:"pending"`           // the client has disconnected and the will is waiting for its delay to pass
+	SendAt  int64  `json:"send_at,omitempty"` // the time a pending will is sent, in unix seconds
+}
+
+// sessionTopicAliases are the topic alias tables of a session.
+type sessionTopicAliases struct {
+	Inbound  map[uint16]string `json:"inbound"`  // aliases set by the client, keyed on alias
+	Outbound map[string]uint16 `json:"outbound"` // aliases set by the broker, keyed on topic
+}
+
+// sessionState is the state held by a client session.
+type sessionState struct {
+	ID                    string                `json:"id"`                           // the client id
+	Source                string                `json:"source"`                       // live or stored
+	Connected             bool                  `json:"connected"`                    // the client is currently connected
+	Listener              string                `json:"listener,omitempty"`           // the listener the client connected on
+	Remote                string                `json:"remote,omitempty"`             // the remote address of the client
+	Username              string                `json:"username,omitempty"`           // the username of the client
+	ProtocolVersion       byte                  `json:"protocol_version"`             // the mqtt protocol version of the client
+	Clean                 bool                  `json:"clean"`                        // the client requested a clean start
+	Keepalive             uint16                `json:"keepalive,omitempty"`          // the keepalive in seconds
+	SessionExpiryInterval uint32                `json:"session_expiry_interval"`      // the session expiry interval in seconds
+	Disconnected          int64                 `json:"disconnected,omitempty"`       // the time the client disconnected, in unix seconds
+	SessionExpiresIn      *int64                `json:"session_expires_in,omitempty"` // the seconds until a disconnected session expires
+	Subscriptions         []sessionSubscription `json:"subscriptions"`                // the subscriptions of the session
+	Inflight              []sessionInflight     `json:"inflight"`                     // the inflight messages of the session
+	Queued                int                   `json:"queued"`                       // the number of messages in the offline queue
+	TopicAliases          *sessionTopicAliases  `json:"topic_aliases,omitempty"`      // the topic alias tables of a live session
+	Will                  *sessionWill          `json:"will,omitempty"`               // the will message, if any
+	Stored                bool                  `json:"stored"`                       // the client is held by the storage hook
+}
+
+// liveSession returns the state of a session held by the running broker.
+func (l *Management) liveSession(cl *mqtt.Client) *sessionState {
+	st := &sessionState{
+		ID:              cl.ID,
+		Source:          sessionSourceLive,
+		Connected:       !cl.Closed(),
+		Listener:        cl.Net.Listener,
+		Remote:          cl.Net.Remote,
+		Username:        string(cl.Properties.Username),
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Clean:           cl.Properties.Clean,
+		Keepalive:       cl.State.Keepalive,
+		Subscriptions:   []sessionSubscription{},
+		Inflight:        []sessionInflight{},
+		Queued:          cl.State.Queue.Len(),
+		TopicAliases: &sessionTopicAliases{
+			Inbound:  cl.State.TopicAliases.Inbound.GetAll(),
+			Outbound: cl.State.TopicAliases.Outbound.GetAll(),
+		},
+	}
+
+	st.SessionExpiryInterval = uint32(l.orgServer.Options.Capabilities.MaximumSessionExpiryInterval)
+	if cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryIntervalFlag {
+		st.SessionExpiryInterval = cl.Properties.Props.SessionExpiryInterval
+	}
+
+	if at, ok := l.orgServer.SessionExpiresAt(cl); ok {
+		st.Disconnected = cl.StopTime()
+		remaining := at - time.Now().Unix()
+		if remaining < 0 {
+			remaining = 0
+		}
+		st.SessionExpiresIn = &remaining
+	}
+
+	for _, sub := range cl.State.Subscriptions.GetAll() {
+		st.Subscriptions = append(st.Subscriptions, sessionSubscription{
+			Filter:            sub.Filter,
+			Qos:               sub.Qos,
+			NoLocal:           sub.NoLocal,
+			RetainAsPublished: sub.RetainAsPublished,
+			RetainHandling:    sub.RetainHandling,
+			Identifier:        sub.Identifier,
+			Identifiers:       sub.Identifiers,
+		})
+	}
+
+	for _, pk := range cl.State.Inflight.GetAll(false) {
+		st.Inflight = append(st.Inflight, sessionInflight{
+			PacketID: pk.PacketID,
+			Type:     packets.PacketNames[pk.FixedHeader.Type],
+			Topic:    pk.TopicName,
+			Qos:      pk.FixedHeader.Qos,
+			Size:     len(pk.Payload),
+			Created:  pk.Created,
+			Expiry:   pk.Expiry,
+			Resends:  cl.State.Inflight.Resends(pk.PacketID),
+		})
+	}
+
+	will := cl.Properties.Will
+	if pk, ok := l.orgServer.PendingWill(cl.ID); ok {
+		st.Will = &sessionWill{
+			Topic:   pk.TopicName,
+			Qos:     pk.FixedHeader.Qos,
+			Retain:  pk.FixedHeader.Retain,
+			Size:    len(pk.Payload),
+			Delay:   will.WillDelayInterval,
+			Pending: true,
+			SendAt:  pk.Expiry,
+		}
+	} else if will.Flag > 0 {
+		st.Will = &sessionWill{
+			Topic:  will.TopicName,
+			Qos:    will.Qos,
+			Retain: will.Retain,
+			Size:   len(will.Payload),
+			Delay:  will.WillDelayInterval,
+		}
+	}
+
+	return st
+}
+
+// storedSession returns the state of a session known only to the storage hook.
+func storedSession(c storage.Client) *sessionState {
+	st := &sessionState{
+		ID:                    c.ID,
+		Source:                sessionSourceStored,
+		Listener:              c.Listener,
+		Remote:                c.Remote,
+		Username:              string(c.Username),
+		ProtocolVersion:       c.ProtocolVersion,
+		Clean:                 c.Clean,
+		SessionExpiryInterval: c.Properties.SessionExpiryInterval,
+		Subscriptions:         []sessionSubscription{},
+		Inflight:              []sessionInflight{},
+		Stored:                true,
+	}
+
+	if c.Will.Flag > 0 {
+		st.Will = &sessionWill{
+			Topic:  c.Will.TopicName,
+			Qos:    c.Will.Qos,
+			Retain: c.Will.Retain,
+			Size:   len(c.Will.Payload),
+			Delay:  c.Will.WillDelayInterval,
+		}
+	}
+
+	return st
+}
+
+// mergeStoredSession adds the records held by the storage hook for a client to the session
+// state, marking any subscriptions and inflight messages which are persisted.
+func (l *Management) mergeStoredSession(id string, st *sessionState) (*sessionState, error) {
+	clients, err := l.storageHook.StoredClients()
+	if err != nil {
+		return st, err
+	}
+
+	for _, c := range clients {
+		if c.ID != id {
+			continue
+		}
+
+		if st == nil {
+			st = storedSession(c)
+		}
+		st.Stored = true
+	}
+
+	if st == nil {
+		return nil, nil
+	}
+
+	subs, err := l.storageHook.StoredSubscriptions()
+	if err != nil {
+		return st, err
+	}
+
+	for _, sub := range subs {
+		if sub.Client != id {
+			continue
+		}
+
+		i := sort.Search(len(st.Subscriptions), func(i int) bool { return st.Subscriptions[i].Filter >= sub.Filter })
+		if i < len(st.Subscriptions) && st.Subscriptions[i].Filter == sub.Filter {
+			st.Subscriptions[i].Stored = true
+			continue
+		}
+
+		st.Subscriptions = append(st.Subscriptions, sessionSubscription{
+			Filter:            sub.Filter,
+			Qos:               sub.Qos,
+			NoLocal:           sub.NoLocal,
+			RetainAsPublished: sub.RetainAsPublished,
+			RetainHandling:    sub.RetainHandling,
+			Identifier:        sub.Identifier,
+			Stored:            true,
+		})
+		sortSessionSubscriptions(st.Subscriptions)
+	}
+
+	inflight, err := l.storageHook.StoredInflightMessages()
+	if err != nil {
+		return st, err
+	}
+
+	for _, msg := range inflight {
+		if msg.Client != id {
+			continue
+		}
+
+		i := sort.Search(len(st.Inflight), func(i int) bool { return st.Inflight[i].PacketID >= msg.PacketID })
+		if i < len(st.Inflight) && st.Inflight[i].PacketID == msg.PacketID {
+			st.Inflight[i].Stored = true
+			st.Inflight[i].Sent = msg.Sent
+			continue
+		}
+
+		pk := msg.ToPacket()
+		st.Inflight = append(st.Inflight, sessionInflight{
+			PacketID: pk.PacketID,
+			Type:     packets.PacketNames[pk.FixedHeader.Type],
+			Topic:    pk.TopicName,
+			Qos:      pk.FixedHeader.Qos,
+			Size:     len(pk.Payload),
+			Created:  pk.Created,
+			Sent:     msg.Sent,
+			Stored:   true,
+		})
+		sortSessionInflight(st.Inflight)
+	}
+
+	return st, nil
+}
+
+// sortSessionSubscriptions orders subscriptions by filter.
+func sortSessionSubscriptions(subs []sessionSubscription) {
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+}
+
+// sortSessionInflight orders inflight messages by packet id.
+func sortSessionInflight(msgs []sessionInflight) {
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].PacketID < msgs[j].PacketID })
+}
+
+// handleSession returns the state of the session held for a client id, merging the live
+// session held by the broker with the records held by the storage hook.
+func (l *Management) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/sessions/")
+	if id == "" {
+		l.jsonError(w, "missing client id", http.StatusBadRequest)
+		return
+	}
+
+	var st *sessionState
+	if cl, ok := l.orgServer.Clients.Get(id); ok {
+		st = l.liveSession(cl)
+		sortSessionSubscriptions(st.Subscriptions)
+		sortSessionInflight(st.Inflight)
+	}
+
+	if l.storageHook != nil {
+		var err error
+		if st, err = l.mergeStoredSession(id, st); err != nil {
+			l.jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if st == nil {
+		l.jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	l.jsonResponse(w, st, http.StatusOK)
+}
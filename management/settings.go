@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
 )
 
 const SettingsFile = "settings.json"
@@ -21,9 +23,35 @@ type MDNSConfig struct {
 	Port    int    `json:"port"`
 }
 
+// ListenerTLS configures TLS for a listener. Certificates are given either as PEM
+// content, or as files which are reloaded when they change.
+type ListenerTLS struct {
+	Cert       string               `json:"cert,omitempty"`        // PEM content
+	Key        string               `json:"key,omitempty"`         // PEM content
+	Files      []listeners.CertFile `json:"files,omitempty"`       // certificate and key files, selected by SNI
+	ClientCA   string               `json:"client_ca,omitempty"`   // PEM CA certificates which verify client certificates (mTLS)
+	ClientAuth string               `json:"client_auth,omitempty"` // none, request or require; require if a client ca is set
+}
+
+// ListenerConfig is a listener definition which is recreated on startup.
+type ListenerConfig struct {
+	Type        string                       `json:"type"`
+	ID          string                       `json:"id"`
+	Address     string                       `json:"address"`
+	TLS         *ListenerTLS                 `json:"tls,omitempty"`
+	Proxy       *listeners.ProxyConfig       `json:"proxy,omitempty"`
+	Websocket   *listeners.WebsocketConfig   `json:"websocket,omitempty"`
+	QUIC        *listeners.QUICConfig        `json:"quic,omitempty"`
+	MQTTSN      *listeners.MQTTSNConfig      `json:"mqttsn,omitempty"`
+	HTTPGateway *listeners.HTTPGatewayConfig `json:"http_gateway,omitempty"`
+	CoAP        *listeners.CoAPConfig        `json:"coap,omitempty"`
+	Policy      *listeners.Policy            `json:"policy,omitempty"`
+}
+
 type AppSettings struct {
-	MDNS MDNSConfig `json:"mdns"`
-	TLS  TLSConfig  `json:"tls"`
+	MDNS      MDNSConfig       `json:"mdns"`
+	TLS       TLSConfig        `json:"tls"`
+	Listeners []ListenerConfig `json:"listeners"` // nil until listeners are first saved
 }
 
 type SettingsManager struct {
@@ -105,3 +133,66 @@ func (s *SettingsManager) UpdateTLS(cfg TLSConfig) error {
 	s.Unlock()
 	return s.Save()
 }
+
+// HasListeners returns true if listener definitions have been saved, even if
+// all of the listeners have since been deleted.
+func (s *SettingsManager) HasListeners() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Config.Listeners != nil
+}
+
+// SetListeners replaces all listener definitions.
+func (s *SettingsManager) SetListeners(ls []ListenerConfig) error {
+	s.Lock()
+	s.Config.Listeners = append([]ListenerConfig{}, ls...)
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *SettingsManager) GetListeners() []ListenerConfig {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]ListenerConfig{}, s.Config.Listeners...)
+}
+
+func (s *SettingsManager) GetListener(id string) (ListenerConfig, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, cfg := range s.Config.Listeners {
+		if cfg.ID == id {
+			return cfg, true
+		}
+	}
+	return ListenerConfig{}, false
+}
+
+// UpdateListener adds a listener definition, or replaces the definition with the same id.
+func (s *SettingsManager) UpdateListener(cfg ListenerConfig) error {
+	s.Lock()
+	updated := false
+	for i := range s.Config.Listeners {
+		if s.Config.Listeners[i].ID == cfg.ID {
+			s.Config.Listeners[i] = cfg
+			updated = true
+		}
+	}
+	if !updated {
+		s.Config.Listeners = append(s.Config.Listeners, cfg)
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *SettingsManager) DeleteListener(id string) error {
+	s.Lock()
+	ls := make([]ListenerConfig, 0, len(s.Config.Listeners))
+	for _, cfg := range s.Config.Listeners {
+		if cfg.ID != id {
+			ls = append(ls, cfg)
+		}
+	}
+	s.Config.Listeners = ls
+	s.Unlock()
+	return s.Save()
+}
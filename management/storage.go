@@ -0,0 +1,78 @@
+package management
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+)
+
+// handleStorageEncryption returns the encryption keys and re-encryption progress of the
+// storage hook.
+func (l *Management) handleStorageEncryption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.storageHook == nil {
+		l.jsonError(w, "storage not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	status, ok := l.storageHook.EncryptionStatus()
+	if !ok {
+		l.jsonError(w, storage.ErrEncryptionDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	l.jsonResponse(w, status, http.StatusOK)
+}
+
+// handleStorageEncryptionRotate reloads the encryption keys of the storage hook and
+// re-encrypts the records not sealed with the active key in the background.
+func (l *Management) handleStorageEncryptionRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.storageHook == nil {
+		l.jsonError(w, "storage not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := l.storageHook.RotateKeys()
+	l.record(r, "storage.encryption.rotate", "", nil, nil, err)
+	if errors.Is(err, storage.ErrEncryptionDisabled) {
+		l.jsonError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		l.jsonError(w, "failed to rotate keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status, _ := l.storageHook.EncryptionStatus()
+	l.jsonResponse(w, status, http.StatusAccepted)
+}
+
+// handleStorageWriteBehind returns the write-behind counters of the storage hook.
+func (l *Management) handleStorageWriteBehind(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if l.storageHook == nil {
+		l.jsonError(w, "storage not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	metrics, ok := l.storageHook.WriteBehindMetrics()
+	if !ok {
+		l.jsonError(w, "write-behind not enabled", http.StatusNotFound)
+		return
+	}
+
+	l.jsonResponse(w, metrics, http.StatusOK)
+}
@@ -0,0 +1,101 @@
+package management
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStorageManagement returns a management api with a bolt storage hook in a
+// temporary directory, configured with the options.
+func newTestStorageManagement(t *testing.T, opts *bolt.Options) (*Management, *bolt.Hook, string) {
+	opts.Path = filepath.Join(t.TempDir(), "data.db")
+	s := mqtt.New(&mqtt.Options{Logger: logger})
+	storageHook := new(bolt.Hook)
+	require.NoError(t, s.AddHook(storageHook, opts))
+	t.Cleanup(func() { _ = s.Close() })
+
+	l := New(listeners.Config{ID: "mgmt", Address: "127.0.0.1:0"}, s, nil, storageHook, nil, nil)
+	require.NoError(t, l.Init(logger))
+
+	token, _, err := l.generateTokens("admin")
+	require.NoError(t, err)
+
+	return l, storageHook, token
+}
+
+func TestStorageEncryption(t *testing.T) {
+	k1 := "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+	t.Setenv("MOCHI_TEST_KEYS", k1)
+	l, h, token := newTestStorageManagement(t, &bolt.Options{
+		Encryption: &storage.EncryptionOptions{KeyEnv: "MOCHI_TEST_KEYS"},
+	})
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/storage/encryption", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var status storage.EncryptionStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, "k1", status.ActiveKey)
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/storage/encryption/rotate", token, "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	t.Setenv("MOCHI_TEST_KEYS", k1+",k2:"+base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/storage/encryption/rotate", token, "")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, "k2", status.ActiveKey)
+	require.Equal(t, []string{"k1", "k2"}, status.Keys)
+	h.WaitEncryption()
+
+	t.Setenv("MOCHI_TEST_KEYS", "")
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/storage/encryption/rotate", token, "")
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestStorageEncryptionDisabled(t *testing.T) {
+	l, _, token := newTestStorageManagement(t, new(bolt.Options))
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/storage/encryption", token, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/storage/encryption/rotate", token, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	l, _, token = newTestManagement(t)
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/storage/encryption", token, "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestStorageWriteBehind(t *testing.T) {
+	l, h, token := newTestStorageManagement(t, &bolt.Options{
+		WriteBehind: &storage.WriteBehindOptions{Mode: storage.DurabilitySync},
+	})
+	require.NoError(t, h.DeleteClient("cl1"))
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/storage/writebehind", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var metrics storage.WriteBehindMetrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	require.Equal(t, int64(1), metrics.Writes)
+	require.Equal(t, int64(1), metrics.Applied)
+
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/storage/writebehind", token, "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	l, _, token = newTestStorageManagement(t, new(bolt.Options))
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/storage/writebehind", token, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	l, _, token = newTestManagement(t)
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/storage/writebehind", token, "")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,398 @@
+package management
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	tapDefaultRate       = 20                  // default messages per second delivered to a tap session
+	tapMaxRate           = 500                 // maximum messages per second a tap session may request
+	tapDefaultPayload    = 1024                // default maximum payload bytes delivered per message
+	tapMaxPayload        = 64 * 1024           // maximum payload bytes a tap session may request
+	tapMaxSessions       = 16                  // maximum concurrent tap sessions
+	tapBuffer            = 64                  // messages buffered per session before dropping
+	tapHeartbeat         = 15 * time.Second    // interval for keepalives and dropped message notices
+	tapSubscriptionBase  = 1 << 24             // inline subscription ids used by tap sessions start here
+	tapWebsocketDeadline = 10 * time.Second    // write deadline for websocket tap frames
+	tapMaxDuration       = 8 * time.Hour       // maximum lifetime of a tap session
+	tapEventMessage      = "message"           // a published message matching the filter
+	tapEventDropped      = "dropped"           // messages were dropped by the rate cap or a slow reader
+	tapEncodingUTF8      = "utf8"              // the payload is a utf8 string
+	tapEncodingBase64    = "base64"            // the payload is base64 encoded binary
+	tapQueryTicket       = "ticket"            // query parameter carrying a stream ticket
+	tapTicketExpiry      = 30 * time.Second    // the time a stream ticket may be used within
+	tapMaxTickets        = 256                 // maximum unused stream tickets
+	tapQueryFilter       = "filter"            // query parameter carrying the topic filter
+	tapQueryRate         = "rate"              // query parameter carrying the rate cap
+	tapQueryPayload      = "max_payload"       // query parameter carrying the payload truncation size
+	tapContentTypeStream = "text/event-stream" // the content type of server-sent event streams
+)
+
+var (
+	// errTooManyTickets indicates a stream ticket was not issued because too many are unused.
+	errTooManyTickets = errors.New("too many unused stream tickets")
+)
+
+// tapEvent is a single event delivered to a tap session.
+type tapEvent struct {
+	Type      string `json:"type"`                // tapEventMessage or tapEventDropped
+	Topic     string `json:"topic,omitempty"`     // the topic the message was published to
+	Qos       byte   `json:"qos,omitempty"`       // the qos the message was published with
+	Retain    bool   `json:"retain,omitempty"`    // the message was retained
+	Origin    string `json:"origin,omitempty"`    // the id of the client which published the message
+	Payload   string `json:"payload,omitempty"`   // the (possibly truncated) payload
+	Encoding  string `json:"encoding,omitempty"`  // the encoding of the payload
+	Size      int    `json:"size,omitempty"`      // the original size of the payload in bytes
+	Truncated bool   `json:"truncated,omitempty"` // the payload was truncated
+	Dropped   int64  `json:"dropped,omitempty"`   // the number of messages dropped since the last notice
+	Timestamp int64  `json:"ts"`                  // the time of the event in unix milliseconds
+}
+
+// tapLimiter is a token bucket limiting the rate of messages delivered to a tap session.
+type tapLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// allow returns true if a message may be delivered now.
+func (t *tapLimiter) allow() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+
+	if t.tokens < 1 {
+		return false
+	}
+
+	t.tokens--
+	return true
+}
+
+// tapSession is a single client of the message tap.
+type tapSession struct {
+	id         int
+	username   string
+	maxPayload int
+	limiter    *tapLimiter
+	events     chan tapEvent
+	dropped    int64
+}
+
+// newTapEvent returns a message event for a packet, truncating the payload if required.
+func (t *tapSession) newTapEvent(pk packets.Packet) tapEvent {
+	e := tapEvent{
+		Type:      tapEventMessage,
+		Topic:     pk.TopicName,
+		Qos:       pk.FixedHeader.Qos,
+		Retain:    pk.FixedHeader.Retain,
+		Origin:    pk.Origin,
+		Size:      len(pk.Payload),
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	payload := pk.Payload
+	if len(payload) > t.maxPayload {
+		payload = payload[:t.maxPayload]
+		e.Truncated = true
+	}
+
+	text := payload
+	if e.Truncated {
+		text = trimPartialRune(payload)
+	}
+
+	if utf8.Valid(text) {
+		e.Payload = string(text)
+		e.Encoding = tapEncodingUTF8
+	} else {
+		e.Payload = base64.StdEncoding.EncodeToString(payload)
+		e.Encoding = tapEncodingBase64
+	}
+
+	return e
+}
+
+// trimPartialRune removes an incomplete utf8 sequence left at the end of truncated bytes.
+func trimPartialRune(b []byte) []byte {
+	for i := 0; i < utf8.UTFMax && i < len(b); i++ {
+		if utf8.Valid(b[:len(b)-i]) {
+			return b[:len(b)-i]
+		}
+	}
+	return b
+}
+
+// streamTicket is a short-lived, single use credential for opening a stream, so that
+// access tokens don't need to be sent in urls, which are recorded by servers and proxies.
+type streamTicket struct {
+	username string    // the user the ticket was issued to
+	expires  time.Time // the time after which the ticket can't be used
+}
+
+// issueStreamTicket returns a new stream ticket for a user.
+func (l *Management) issueStreamTicket(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ticket := hex.EncodeToString(b)
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for k, v := range l.tickets {
+		if now.After(v.expires) {
+			delete(l.tickets, k)
+		}
+	}
+
+	if len(l.tickets) >= tapMaxTickets {
+		return "", errTooManyTickets
+	}
+
+	if l.tickets == nil {
+		l.tickets = map[string]streamTicket{}
+	}
+	l.tickets[ticket] = streamTicket{username: username, expires: now.Add(tapTicketExpiry)}
+
+	return ticket, nil
+}
+
+// redeemStreamTicket returns the user a stream ticket was issued to, if it is valid.
+// Tickets can only be redeemed once.
+func (l *Management) redeemStreamTicket(ticket string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	t, ok := l.tickets[ticket]
+	if !ok {
+		return "", false
+	}
+	delete(l.tickets, ticket)
+
+	return t.username, time.Now().Before(t.expires)
+}
+
+// handleTapTicket issues a stream ticket for the message tap to the authenticated user.
+func (l *Management) handleTapTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := l.issueStreamTicket(actor(r))
+	if errors.Is(err, errTooManyTickets) {
+		l.jsonError(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		l.jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.jsonResponse(w, map[string]any{
+		"ticket":     ticket,
+		"expires_in": int(tapTicketExpiry.Seconds()),
+	}, http.StatusOK)
+}
+
+// tapHandler returns the inline subscription handler feeding the session. It is called
+// synchronously on the publishing path, so it never blocks. Messages are checked against
+// the ACL hooks of the server as a regular client with the username of the session.
+func (l *Management) tapHandler(t *tapSession) mqtt.InlineSubFn {
+	reader := l.orgServer.NewClient(nil, mqtt.LocalListener, "management-tap", false)
+	reader.Properties.ProtocolVersion = 5
+	reader.Properties.Username = []byte(t.username)
+
+	return func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		if !l.orgServer.ACLCheck(reader, pk.TopicName, false) {
+			return
+		}
+
+		if !t.limiter.allow() {
+			atomic.AddInt64(&t.dropped, 1)
+			return
+		}
+
+		select {
+		case t.events <- t.newTapEvent(pk):
+		default:
+			atomic.AddInt64(&t.dropped, 1)
+		}
+	}
+}
+
+// handleTap streams messages matching a topic filter to the caller, as Server-Sent
+// Events or over a websocket if the request is a websocket upgrade. Messages are
+// subject to the broker ACLs of the authenticated management user.
+func (l *Management) handleTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !l.orgServer.Options.InlineClient {
+		l.jsonError(w, "message tap requires the inline client", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	filter := params.Get(tapQueryFilter)
+	if !mqtt.IsValidFilter(filter, false) {
+		l.jsonError(w, "invalid topic filter", http.StatusBadRequest)
+		return
+	}
+
+	rate, err := parseQueryInt(params.Get(tapQueryRate), tapDefaultRate, tapMaxRate)
+	if err != nil {
+		l.jsonError(w, "rate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxPayload, err := parseQueryInt(params.Get(tapQueryPayload), tapDefaultPayload, tapMaxPayload)
+	if err != nil {
+		l.jsonError(w, "max_payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if n := atomic.AddInt32(&l.taps, 1); n > tapMaxSessions {
+		atomic.AddInt32(&l.taps, -1)
+		l.jsonError(w, "too many tap sessions", http.StatusTooManyRequests)
+		return
+	}
+	defer atomic.AddInt32(&l.taps, -1)
+
+	t := &tapSession{
+		id:         tapSubscriptionBase + int(atomic.AddInt32(&l.tapSeq, 1)),
+		username:   actor(r),
+		maxPayload: maxPayload,
+		limiter:    &tapLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()},
+		events:     make(chan tapEvent, tapBuffer),
+	}
+
+	done := r.Context().Done()
+	var send func(e tapEvent) error
+	var ping func() error
+	if websocket.IsWebSocketUpgrade(r) {
+		upgrader := websocket.Upgrader{} // only same origin requests, such as from the management ui, are upgraded
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // the upgrader has already responded
+		}
+		defer conn.Close()
+
+		closed := make(chan struct{})
+		done = closed
+		go func() { // read and discard frames so close and ping frames are processed
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		send = func(e tapEvent) error {
+			_ = conn.SetWriteDeadline(time.Now().Add(tapWebsocketDeadline))
+			return conn.WriteJSON(e)
+		}
+
+		ping = func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tapWebsocketDeadline))
+		}
+	} else {
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			l.jsonError(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", tapContentTypeStream)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		_ = rc.Flush()
+
+		send = func(e tapEvent) error {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return err
+			}
+
+			return rc.Flush()
+		}
+
+		ping = func() error {
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return err
+			}
+
+			return rc.Flush()
+		}
+	}
+
+	if err := l.orgServer.Subscribe(filter, t.id, l.tapHandler(t)); err != nil {
+		_ = send(tapEvent{Type: "error", Payload: err.Error(), Timestamp: time.Now().UnixMilli()})
+		return
+	}
+	defer func() {
+		_ = l.orgServer.Unsubscribe(filter, t.id)
+	}()
+
+	l.log.Info("management tap started", "filter", filter, "user", t.username, "remote", r.RemoteAddr)
+	defer l.log.Info("management tap stopped", "filter", filter, "user", t.username, "remote", r.RemoteAddr)
+
+	heartbeat := time.NewTicker(tapHeartbeat)
+	defer heartbeat.Stop()
+
+	expire := time.NewTimer(tapMaxDuration)
+	defer expire.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-expire.C:
+			return
+		case e := <-t.events:
+			if err := send(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+				if err := send(tapEvent{Type: tapEventDropped, Dropped: n, Timestamp: time.Now().UnixMilli()}); err != nil {
+					return
+				}
+			} else if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
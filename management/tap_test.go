@@ -0,0 +1,215 @@
+package management
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTapLimiter(t *testing.T) {
+	l := &tapLimiter{rate: 2, tokens: 2, last: time.Now()}
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+
+	l.last = l.last.Add(-time.Second) // a second of tokens, capped at the rate
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+
+	l.last = l.last.Add(-time.Minute)
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+}
+
+func TestTrimPartialRune(t *testing.T) {
+	b := []byte("añb€")
+	require.Equal(t, []byte("añb€"), trimPartialRune(b))
+	require.Equal(t, []byte("añb"), trimPartialRune(b[:len(b)-1]))
+	require.Equal(t, []byte("añb"), trimPartialRune(b[:len(b)-2]))
+	require.Equal(t, []byte("a"), trimPartialRune(b[:2]))
+	require.Equal(t, []byte{}, trimPartialRune([]byte{}))
+}
+
+func TestNewTapEvent(t *testing.T) {
+	session := &tapSession{maxPayload: 4}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "a/b",
+		Origin:      "client",
+	}
+
+	tt := []struct {
+		desc      string
+		payload   []byte
+		want      string
+		encoding  string
+		truncated bool
+	}{
+		{desc: "text", payload: []byte("abc"), want: "abc", encoding: tapEncodingUTF8},
+		{desc: "text truncated", payload: []byte("abcdef"), want: "abcd", encoding: tapEncodingUTF8, truncated: true},
+		{desc: "rune truncated", payload: []byte("ab€"), want: "ab", encoding: tapEncodingUTF8, truncated: true},
+		{desc: "binary", payload: []byte{0xff, 0x00}, want: "/wA=", encoding: tapEncodingBase64},
+		{desc: "binary truncated", payload: []byte{0xff, 0, 1, 2, 3}, want: "/wABAg==", encoding: tapEncodingBase64, truncated: true},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			pk.Payload = tx.payload
+			e := session.newTapEvent(pk)
+			require.Equal(t, tapEventMessage, e.Type)
+			require.Equal(t, "a/b", e.Topic)
+			require.Equal(t, byte(1), e.Qos)
+			require.True(t, e.Retain)
+			require.Equal(t, "client", e.Origin)
+			require.Equal(t, len(tx.payload), e.Size)
+			require.Equal(t, tx.want, e.Payload)
+			require.Equal(t, tx.encoding, e.Encoding)
+			require.Equal(t, tx.truncated, e.Truncated)
+		})
+	}
+}
+
+func TestStreamTicket(t *testing.T) {
+	l, _, token := newTestManagement(t)
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/tap/ticket", token, "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = serveTestRequest(l, http.MethodPost, "/api/v1/tap/ticket", token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, int(tapTicketExpiry.Seconds()), resp.ExpiresIn)
+
+	username, ok := l.redeemStreamTicket(resp.Ticket)
+	require.True(t, ok)
+	require.Equal(t, "admin", username)
+
+	_, ok = l.redeemStreamTicket(resp.Ticket) // single use
+	require.False(t, ok)
+
+	ticket, err := l.issueStreamTicket("admin")
+	require.NoError(t, err)
+	l.tickets[ticket] = streamTicket{username: "admin", expires: time.Now().Add(-time.Second)}
+	_, ok = l.redeemStreamTicket(ticket)
+	require.False(t, ok)
+}
+
+func TestStreamTicketLimit(t *testing.T) {
+	l, _, _ := newTestManagement(t)
+	for i := 0; i < tapMaxTickets; i++ {
+		_, err := l.issueStreamTicket("admin")
+		require.NoError(t, err)
+	}
+
+	_, err := l.issueStreamTicket("admin")
+	require.ErrorIs(t, err, errTooManyTickets)
+}
+
+func TestTapUnauthorized(t *testing.T) {
+	l, _, token := newTestManagement(t)
+
+	w := serveTestRequest(l, http.MethodGet, "/api/v1/tap?filter=%23", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/tap?filter=%23&access_token="+token, "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code) // access tokens aren't accepted in urls
+
+	w = serveTestRequest(l, http.MethodGet, "/api/v1/tap?filter=%23&ticket=nope", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTapInvalid(t *testing.T) {
+	l, _, token := newTestManagement(t)
+
+	for _, target := range []string{
+		"/api/v1/tap?filter=a/%23/b",
+		"/api/v1/tap?filter=%23&rate=0",
+		"/api/v1/tap?filter=%23&max_payload=x",
+	} {
+		w := serveTestRequest(l, http.MethodGet, target, token, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+}
+
+// waitTapSubscribed waits until a tap session has subscribed to a topic.
+func waitTapSubscribed(t *testing.T, s *mqtt.Server, topic string) {
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Subscribers(topic).InlineSubscriptions) > 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestTapEventStream(t *testing.T) {
+	l, s, _ := newTestManagement(t)
+	srv := httptest.NewServer(l.listen.Handler)
+	defer srv.Close()
+
+	ticket, err := l.issueStreamTicket("viewer")
+	require.NoError(t, err)
+
+	resp, err := http.Get(srv.URL + "/api/v1/tap?filter=%23&ticket=" + ticket)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, tapContentTypeStream, resp.Header.Get("Content-Type"))
+
+	waitTapSubscribed(t, s, "public/a")
+	require.NoError(t, s.Publish("private/a", []byte("secret"), false, 0)) // denied to the viewer by the acl hooks
+	require.NoError(t, s.Publish("public/a", []byte("hello"), false, 0))
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "event: message\n", line)
+
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "data: "))
+
+	var e tapEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e))
+	require.Equal(t, "public/a", e.Topic)
+	require.Equal(t, "hello", e.Payload)
+}
+
+func TestTapWebsocket(t *testing.T) {
+	l, s, token := newTestManagement(t)
+	srv := httptest.NewServer(l.listen.Handler)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/tap?filter=%23"
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	header.Set("Origin", "http://attacker.example")
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	header.Set("Origin", srv.URL)
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	waitTapSubscribed(t, s, "private/a")
+	require.NoError(t, s.Publish("private/a", []byte("hello"), false, 1))
+
+	var e tapEvent
+	require.NoError(t, ws.ReadJSON(&e))
+	require.Equal(t, "private/a", e.Topic)
+	require.Equal(t, byte(1), e.Qos)
+}
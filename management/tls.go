@@ -0,0 +1,110 @@
+package management
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// tlsListenerID is the id of the mqtts listener managed by the tls settings.
+const tlsListenerID = "mqtts"
+
+// SetTLSCertificates sets the certificate store presented by the mqtts listener
+// managed by the tls settings, so that certificate updates are applied without
+// restarting the listener. It should be called before the listener is served.
+func (l *Management) SetTLSCertificates(s *listeners.CertStore) {
+	l.tlsCerts = s
+}
+
+// AddCertStores adds file based certificate stores which are reloaded by the tls
+// reload endpoint. It should be called before the listener is served.
+func (l *Management) AddCertStores(stores ...*listeners.CertStore) {
+	l.certStores = append(l.certStores, stores...)
+}
+
+// applyTLS applies a change to the tls settings to the mqtts listener. If only the
+// certificate has changed, the certificate is replaced in the running listener and
+// connected clients are unaffected; otherwise the listener is drained and restarted. It returns
+// whether the listener was reloaded, started, or stopped.
+func (l *Management) applyTLS(current, req TLSConfig, cert tls.Certificate) (string, error) {
+	_, running := l.orgServer.Listeners.Get(tlsListenerID)
+	if !req.Enabled {
+		if running {
+			_, _ = l.orgServer.DrainListener(tlsListenerID, mqtt.DrainOptions{Code: packets.ErrServerShuttingDown})
+		}
+		return "stopped", nil
+	}
+
+	l.Lock()
+	if l.tlsCerts == nil {
+		l.tlsCerts = listeners.NewCertStore()
+	}
+	certs := l.tlsCerts
+	l.Unlock()
+
+	if err := certs.Set(cert); err != nil {
+		return "", err
+	}
+
+	if running && req.Port == current.Port {
+		return "reloaded", nil
+	}
+
+	if running {
+		_, _ = l.orgServer.DrainListener(tlsListenerID, mqtt.DrainOptions{Code: packets.ErrServerMoved})
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{
+		ID:        tlsListenerID,
+		Address:   req.Port,
+		TLSConfig: certs.TLSConfig(nil),
+	})
+	if err := l.orgServer.AddListener(tcp); err != nil {
+		return "", err
+	}
+
+	go l.orgServer.Listeners.Serve(tlsListenerID, l.orgServer.EstablishConnection)
+	return "started", nil
+}
+
+// ReloadCertificates reloads the file based tls certificates of all listeners,
+// including those of listeners managed by the listener manager.
+func (l *Management) ReloadCertificates() error {
+	var errs []error
+	for _, s := range l.certStores {
+		if err := s.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if l.listenerManager != nil {
+		if err := l.listenerManager.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleTlsReload reloads the file based tls certificates of all listeners. Clients
+// which are already connected are unaffected, and new connections are presented
+// with the reloaded certificates.
+func (l *Management) handleTlsReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		l.jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := l.ReloadCertificates()
+	l.record(r, "tls.reload", "", nil, nil, err)
+	if err != nil {
+		l.jsonError(w, "failed to reload certificates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	l.jsonResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/require"
+)
+
+// newMQTTSNServer returns a served server with an MQTT-SN gateway listener, and a udp
+// client connected to the gateway.
+func newMQTTSNServer(t *testing.T, config *listeners.MQTTSNConfig) (*Server, *net.UDPConn) {
+	gw := listeners.NewMQTTSN(listeners.Config{ID: "sn1", Address: "127.0.0.1:0", MQTTSN: config})
+	s := newListenerServer(t, new(AllowHook), gw)
+	return s, dialUDP(t, gw.Address())
+}
+
+// snWrite sends an MQTT-SN message to the gateway.
+func snWrite(t *testing.T, c *net.UDPConn, msgType byte, body ...byte) {
+	_, err := c.Write(append([]byte{byte(len(body) + 2), msgType}, body...))
+	require.NoError(t, err)
+}
+
+// snRead reads an MQTT-SN message from the gateway, returning its type and body.
+func snRead(t *testing.T, c *net.UDPConn) (byte, []byte) {
+	buf := make([]byte, 1024)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, int(buf[0]), n)
+	return buf[1], buf[2:n]
+}
+
+// snExpect reads an MQTT-SN message and checks its type and body.
+func snExpect(t *testing.T, c *net.UDPConn, msgType byte, body ...byte) {
+	mt, b := snRead(t, c)
+	require.Equal(t, msgType, mt)
+	require.Equal(t, string(body), string(b))
+}
+
+// snConnect connects a client to the gateway with a clean session and a 60 second keepalive.
+func snConnect(t *testing.T, c *net.UDPConn, id string) {
+	snWrite(t, c, 0x04, append([]byte{0x04, 0x01, 0x00, 0x3C}, id...)...)
+	snExpect(t, c, 0x05, 0x00)
+}
+
+func TestMQTTSNConnectRegisterPublish(t *testing.T) {
+	s, c := newMQTTSNServer(t, nil)
+	snConnect(t, c, "sensor1")
+
+	require.Eventually(t, func() bool {
+		cl, ok := s.Clients.Get("sensor1")
+		return ok && cl.Net.Listener == "sn1" && cl.Net.Remote == c.LocalAddr().String()
+	}, time.Second, time.Millisecond)
+
+	// register
+	snWrite(t, c, 0x0A, append([]byte{0x00, 0x00, 0x00, 0x01}, "sensors/1/temp"...)...)
+	snExpect(t, c, 0x0B, 0x00, 0x01, 0x00, 0x01, 0x00)
+
+	// retained qos 1 publish on topic id 1
+	snWrite(t, c, 0x0C, 0x30, 0x00, 0x01, 0x00, 0x02, '2', '1')
+	snExpect(t, c, 0x0D, 0x00, 0x01, 0x00, 0x02, 0x00)
+
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Messages("sensors/1/temp")) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []byte("21"), s.Topics.Messages("sensors/1/temp")[0].Payload)
+
+	// unknown topic id
+	snWrite(t, c, 0x0C, 0x20, 0x00, 0x09, 0x00, 0x03, 'x')
+	snExpect(t, c, 0x0D, 0x00, 0x09, 0x00, 0x03, 0x02)
+
+	// disconnect
+	snWrite(t, c, 0x18)
+	snExpect(t, c, 0x18)
+	require.Eventually(t, func() bool {
+		_, ok := s.Clients.Get("sensor1")
+		return !ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNSubscribeRegistersTopics(t *testing.T) {
+	s, c := newMQTTSNServer(t, nil)
+	snConnect(t, c, "sensor1")
+
+	// wildcard subscription at qos 1
+	snWrite(t, c, 0x12, append([]byte{0x20, 0x00, 0x01}, "actuators/#"...)...)
+	snExpect(t, c, 0x13, 0x20, 0x00, 0x00, 0x00, 0x01, 0x00)
+
+	require.NoError(t, s.Publish("actuators/valve", []byte("open"), false, 1))
+
+	// the gateway registers the topic before publishing to it
+	mt, b := snRead(t, c)
+	require.Equal(t, byte(0x0A), mt)
+	require.Equal(t, "actuators/valve", string(b[4:]))
+	topicID := b[:2]
+	snWrite(t, c, 0x0B, append(append([]byte{}, b[:4]...), 0x00)...)
+
+	mt, b = snRead(t, c)
+	require.Equal(t, byte(0x0C), mt)
+	require.Equal(t, byte(0x20), b[0])
+	require.Equal(t, topicID, b[1:3])
+	require.Equal(t, "open", string(b[5:]))
+	snWrite(t, c, 0x0D, append(append(append([]byte{}, topicID...), b[3:5]...), 0x00)...)
+
+	// short topic subscription, acknowledged with topic id 0
+	snWrite(t, c, 0x12, 0x02, 0x00, 0x02, 'a', 'b')
+	snExpect(t, c, 0x13, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00)
+
+	require.NoError(t, s.Publish("ab", []byte("x"), false, 0))
+	snExpect(t, c, 0x0C, 0x02, 'a', 'b', 0x00, 0x00, 'x')
+}
+
+func TestMQTTSNPredefinedAndQosMinusOne(t *testing.T) {
+	s, c := newMQTTSNServer(t, &listeners.MQTTSNConfig{
+		PredefinedTopics: map[uint16]string{7: "sensors/shared"},
+	})
+
+	// retained qos -1 publishes don't need a connection
+	snWrite(t, c, 0x0C, 0x71, 0x00, 0x07, 0x00, 0x00, '1')
+	require.Eventually(t, func() bool {
+		return len(s.Topics.Messages("sensors/shared")) == 1
+	}, time.Second, time.Millisecond)
+
+	_, ok := s.Clients.Get("mqttsn-sn1")
+	require.True(t, ok)
+
+	// predefined topic subscription
+	snConnect(t, c, "sensor1")
+	snWrite(t, c, 0x12, 0x01, 0x00, 0x01, 0x00, 0x07)
+	snExpect(t, c, 0x13, 0x00, 0x00, 0x07, 0x00, 0x01, 0x00)
+	snExpect(t, c, 0x0C, 0x11, 0x00, 0x07, 0x00, 0x00, '1')
+
+	require.NoError(t, s.Publish("sensors/shared", []byte("2"), false, 0))
+	snExpect(t, c, 0x0C, 0x01, 0x00, 0x07, 0x00, 0x00, '2')
+}
+
+func TestMQTTSNSleepingClient(t *testing.T) {
+	s, c := newMQTTSNServer(t, nil)
+	snConnect(t, c, "sensor1")
+
+	snWrite(t, c, 0x12, 0x02, 0x00, 0x01, 'z', 'z')
+	snExpect(t, c, 0x13, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00)
+
+	// sleep for 60 seconds
+	snWrite(t, c, 0x18, 0x00, 0x3C)
+	snExpect(t, c, 0x18)
+
+	require.NoError(t, s.Publish("zz", []byte("1"), false, 0))
+	require.NoError(t, s.Publish("zz", []byte("2"), false, 0))
+
+	// messages are held until the client wakes
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := c.Read(make([]byte, 16))
+	require.Error(t, err)
+
+	snWrite(t, c, 0x16, []byte("sensor1")...)
+	snExpect(t, c, 0x0C, 0x02, 'z', 'z', 0x00, 0x00, '1')
+	snExpect(t, c, 0x0C, 0x02, 'z', 'z', 0x00, 0x00, '2')
+	snExpect(t, c, 0x17)
+
+	// the session is still connected to the server
+	cl, ok := s.Clients.Get("sensor1")
+	require.True(t, ok)
+	require.False(t, cl.Closed())
+}
+
+func TestMQTTSNSleepingClientBufferFull(t *testing.T) {
+	s, c := newMQTTSNServer(t, &listeners.MQTTSNConfig{MaxBufferedMessages: 1})
+	snConnect(t, c, "sensor1")
+
+	snWrite(t, c, 0x12, 0x22, 0x00, 0x01, 'z', 'z')
+	snExpect(t, c, 0x13, 0x20, 0x00, 0x00, 0x00, 0x01, 0x00)
+
+	snWrite(t, c, 0x18, 0x00, 0x3C)
+	snExpect(t, c, 0x18)
+
+	for _, m := range []string{"1", "2", "3"} {
+		require.NoError(t, s.Publish("zz", []byte(m), false, 1))
+	}
+
+	// qos 1 publishes beyond the buffer are held by the server rather than dropped,
+	// and are delivered as the client wakes.
+	var got []string
+	for i := 0; len(got) < 3 && i < 100; i++ {
+		snWrite(t, c, 0x16, []byte("sensor1")...)
+		mt, b := snRead(t, c)
+		if mt == 0x17 {
+			time.Sleep(10 * time.Millisecond) // nothing held yet
+			continue
+		}
+
+		require.Equal(t, byte(0x0C), mt)
+		require.Equal(t, byte(0x22), b[0])
+		got = append(got, string(b[5:]))
+		snWrite(t, c, 0x0D, 'z', 'z', b[3], b[4], 0x00)
+		snExpect(t, c, 0x17)
+	}
+
+	require.Equal(t, []string{"1", "2", "3"}, got)
+}
+
+func TestMQTTSNWill(t *testing.T) {
+	s, c := newMQTTSNServer(t, nil)
+
+	snWrite(t, c, 0x04, append([]byte{0x0C, 0x01, 0x00, 0x3C}, "sensor1"...)...)
+	snExpect(t, c, 0x06)
+	snWrite(t, c, 0x07, append([]byte{0x10}, "sensors/1/status"...)...)
+	snExpect(t, c, 0x08)
+	snWrite(t, c, 0x09, []byte("offline")...)
+	snExpect(t, c, 0x05, 0x00)
+
+	cl, ok := s.Clients.Get("sensor1")
+	require.True(t, ok)
+	require.Equal(t, "sensors/1/status", cl.Properties.Will.TopicName)
+	require.Equal(t, []byte("offline"), cl.Properties.Will.Payload)
+	require.True(t, cl.Properties.Will.Retain)
+}
+
+func TestMQTTSNUnknownClient(t *testing.T) {
+	_, c := newMQTTSNServer(t, nil)
+	snWrite(t, c, 0x0C, 0x00, 0x00, 0x01, 0x00, 0x00, 'x')
+	snExpect(t, c, 0x18)
+}
+
+func TestMQTTSNConnectRefused(t *testing.T) {
+	gw := listeners.NewMQTTSN(listeners.Config{ID: "sn1", Address: "127.0.0.1:0"})
+	s := newListenerServer(t, new(DenyHook), gw)
+	c := dialUDP(t, gw.Address())
+
+	snWrite(t, c, 0x04, append([]byte{0x04, 0x01, 0x00, 0x3C}, "sensor1"...)...)
+	snExpect(t, c, 0x05, 0x03)
+	_, ok := s.Clients.Get("sensor1")
+	require.False(t, ok)
+}
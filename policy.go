@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"sync/atomic"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// listenerPolicy returns the capability and policy overrides of a listener, or nil
+// if the listener doesn't have any.
+func (s *Server) listenerPolicy(id string) *listeners.Policy {
+	l, ok := s.Listeners.Get(id)
+	if !ok {
+		return nil
+	}
+
+	if pl, ok := l.(listeners.PolicyListener); ok {
+		return pl.Policy()
+	}
+
+	return nil
+}
+
+// withPolicy returns a copy of the server options with the capabilities overridden
+// by a listener policy.
+func withPolicy(o *Options, p *listeners.Policy) *Options {
+	opts := *o
+	caps := *o.Capabilities
+	if p.MaximumPacketSize != nil {
+		caps.MaximumPacketSize = *p.MaximumPacketSize
+	}
+	if p.MaximumSessionExpiryInterval != nil {
+		caps.MaximumSessionExpiryInterval = *p.MaximumSessionExpiryInterval
+	}
+	if p.MaximumClientWritesPending != nil {
+		caps.MaximumClientWritesPending = *p.MaximumClientWritesPending
+	}
+	if p.ReceiveMaximum != nil {
+		caps.ReceiveMaximum = *p.ReceiveMaximum
+	}
+	if p.MaximumInflight != nil && *p.MaximumInflight > 0 {
+		caps.MaximumInflight = *p.MaximumInflight
+	}
+	if p.TopicAliasMaximum != nil {
+		caps.TopicAliasMaximum = *p.TopicAliasMaximum
+	}
+	if p.MaximumQos != nil {
+		caps.MaximumQos = *p.MaximumQos
+	}
+	if p.RetainAvailable != nil {
+		caps.RetainAvailable = *p.RetainAvailable
+	}
+
+	opts.Capabilities = &caps
+	return &opts
+}
+
+// capabilities returns the capabilities which apply to a client, being the server
+// capabilities with any overrides from the policy of the client's listener.
+func (s *Server) capabilities(cl *Client) *Capabilities {
+	if cl != nil && cl.policy() != nil {
+		return cl.ops.options.Capabilities
+	}
+
+	return s.Options.Capabilities
+}
+
+// listenerClients returns the counter of clients connected to a listener.
+func (s *Server) listenerClients(id string) *atomic.Int64 {
+	v, _ := s.connected.LoadOrStore(id, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+// validatePolicy validates that a connecting client is permitted by the policy of
+// its listener.
+func (s *Server) validatePolicy(cl *Client, pk packets.Packet) packets.Code {
+	p := cl.policy()
+	if p == nil {
+		return packets.CodeSuccess
+	}
+
+	if !p.AllowsProtocol(cl.Properties.ProtocolVersion) {
+		return packets.ErrUnsupportedProtocolVersion
+	}
+
+	// v3 clients can't be told of a changed keepalive, so refuse those which would be
+	// disconnected before they expect to send a ping, being those which asked for no
+	// keepalive or a longer keepalive than the policy allows.
+	if k := pk.Connect.Keepalive; cl.Properties.ProtocolVersion < 5 {
+		if bounded := p.Keepalive(k); bounded != k && (k == 0 || bounded < k) {
+			return packets.ErrServerUnavailable
+		}
+	}
+
+	return packets.CodeSuccess
+}
+
+// policy returns the capability and policy overrides of the client's listener, if any.
+func (cl *Client) policy() *listeners.Policy {
+	if cl.ops == nil {
+		return nil
+	}
+
+	return cl.ops.policy
+}
+
+// applyKeepalivePolicy bounds the keepalive of the client by the policy of its listener,
+// informing the client of the change in the connack.
+func (cl *Client) applyKeepalivePolicy() {
+	p := cl.policy()
+	if p == nil {
+		return
+	}
+
+	if k := p.Keepalive(cl.State.Keepalive); k != cl.State.Keepalive {
+		cl.State.Keepalive = k
+		cl.State.ServerKeepalive = true // [MQTT-3.1.2-21]
+	}
+}
+
+// authHookAllowed returns true if the hook may authenticate the client and check its acls.
+func (cl *Client) authHookAllowed(id string) bool {
+	p := cl.policy()
+	return p == nil || p.AllowsAuthHook(id)
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// newPolicyServer returns a server with a mock listener using the given policy.
+func newPolicyServer(t *testing.T, p *listeners.Policy) *Server {
+	s := newServer()
+	ml := listeners.NewMockListener("policy", ":1882")
+	ml.Config = &listeners.Config{ID: "policy", Policy: p}
+	require.NoError(t, s.AddListener(ml))
+	return s
+}
+
+// connectPolicy connects a client to the policy listener with a test connect packet,
+// returning the connack and the error returned when establishing the connection.
+func connectPolicy(t *testing.T, s *Server, tc byte) (packets.Packet, error) {
+	connect := packets.TPacketData[packets.Connect].Get(tc)
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("policy", r)
+	}()
+
+	go func() {
+		_, _ = w.Write(connect.RawBytes)
+		_, _ = w.Write(packets.TPacketData[packets.Disconnect].Get(packets.TDisconnect).RawBytes)
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(w)
+		recv <- buf
+	}()
+
+	err := <-o
+	_ = r.Close()
+	buf := <-recv
+	_ = w.Close()
+
+	require.Greater(t, len(buf), 2)
+	pk := packets.Packet{ProtocolVersion: connect.Packet.ProtocolVersion}
+	require.NoError(t, pk.FixedHeader.Decode(buf[0]))
+	require.NoError(t, pk.ConnackDecode(buf[2:]))
+	return pk, err
+}
+
+func TestWithPolicy(t *testing.T) {
+	size := uint32(64 * 1024)
+	qos := byte(1)
+	retain := byte(0)
+	o := &Options{Capabilities: NewDefaultServerCapabilities()}
+
+	po := withPolicy(o, &listeners.Policy{
+		MaximumPacketSize: &size,
+		MaximumQos:        &qos,
+		RetainAvailable:   &retain,
+	})
+
+	require.Equal(t, size, po.Capabilities.MaximumPacketSize)
+	require.Equal(t, qos, po.Capabilities.MaximumQos)
+	require.Equal(t, retain, po.Capabilities.RetainAvailable)
+	require.Equal(t, o.Capabilities.ReceiveMaximum, po.Capabilities.ReceiveMaximum)
+
+	require.Equal(t, uint32(0), o.Capabilities.MaximumPacketSize)
+	require.Equal(t, byte(2), o.Capabilities.MaximumQos)
+	require.Equal(t, byte(1), o.Capabilities.RetainAvailable)
+}
+
+func TestNewClientListenerPolicy(t *testing.T) {
+	size := uint32(10 * 1024 * 1024)
+	s := newPolicyServer(t, &listeners.Policy{MaximumPacketSize: &size})
+	defer s.Close()
+
+	cl := s.NewClient(nil, "policy", "a", false)
+	require.NotNil(t, cl.policy())
+	require.Equal(t, size, s.capabilities(cl).MaximumPacketSize)
+	require.Equal(t, uint32(0), s.Options.Capabilities.MaximumPacketSize)
+
+	cl = s.NewClient(nil, "other", "b", false)
+	require.Nil(t, cl.policy())
+	require.Same(t, s.Options.Capabilities, s.capabilities(cl))
+}
+
+func TestEstablishConnectionPolicyCapabilities(t *testing.T) {
+	size := uint32(64 * 1024)
+	qos := byte(1)
+	retain := byte(0)
+	s := newPolicyServer(t, &listeners.Policy{
+		MaximumPacketSize: &size,
+		MaximumQos:        &qos,
+		RetainAvailable:   &retain,
+	})
+	defer s.Close()
+
+	ack, err := connectPolicy(t, s, packets.TConnectMqtt5)
+	require.NoError(t, err)
+	require.Equal(t, packets.CodeSuccess.Code, ack.ReasonCode)
+	require.Equal(t, size, ack.Properties.MaximumPacketSize)
+	require.True(t, ack.Properties.MaximumQosFlag)
+	require.Equal(t, qos, ack.Properties.MaximumQos)
+	require.True(t, ack.Properties.RetainAvailableFlag)
+	require.Equal(t, retain, ack.Properties.RetainAvailable)
+}
+
+func TestEstablishConnectionPolicyProtocolVersion(t *testing.T) {
+	s := newPolicyServer(t, &listeners.Policy{ProtocolVersions: []byte{5}})
+	defer s.Close()
+
+	ack, err := connectPolicy(t, s, packets.TConnectClean)
+	require.ErrorIs(t, err, packets.ErrUnsupportedProtocolVersion)
+	require.Equal(t, packets.Err3UnsupportedProtocolVersion.Code, ack.ReasonCode)
+}
+
+func TestEstablishConnectionPolicyMaximumClients(t *testing.T) {
+	s := newPolicyServer(t, &listeners.Policy{MaximumClients: 1})
+	defer s.Close()
+
+	s.listenerClients("policy").Store(1)
+	ack, err := connectPolicy(t, s, packets.TConnectMqtt5)
+	require.ErrorIs(t, err, packets.ErrServerBusy)
+	require.Equal(t, packets.ErrServerBusy.Code, ack.ReasonCode)
+
+	s.listenerClients("policy").Store(0)
+	_, err = connectPolicy(t, s, packets.TConnectMqtt5)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), s.listenerClients("policy").Load())
+}
+
+func TestEstablishConnectionPolicyAuthHooks(t *testing.T) {
+	s := newPolicyServer(t, &listeners.Policy{AuthHooks: []string{"other-auth"}})
+	defer s.Close()
+
+	ack, err := connectPolicy(t, s, packets.TConnectMqtt5)
+	require.ErrorIs(t, err, packets.ErrBadUsernameOrPassword)
+	require.Equal(t, packets.ErrBadUsernameOrPassword.Code, ack.ReasonCode)
+
+	s = newPolicyServer(t, &listeners.Policy{AuthHooks: []string{"allow-all-auth"}})
+	defer s.Close()
+
+	_, err = connectPolicy(t, s, packets.TConnectMqtt5)
+	require.NoError(t, err)
+}
+
+func TestEstablishConnectionPolicyKeepalive(t *testing.T) {
+	s := newPolicyServer(t, &listeners.Policy{MaximumKeepalive: 20})
+	defer s.Close()
+
+	ack, err := connectPolicy(t, s, packets.TConnectMqtt5)
+	require.NoError(t, err)
+	require.True(t, ack.Properties.ServerKeepAliveFlag)
+	require.Equal(t, uint16(20), ack.Properties.ServerKeepAlive)
+
+	ack, err = connectPolicy(t, s, packets.TConnectClean)
+	require.ErrorIs(t, err, packets.ErrServerUnavailable)
+	require.Equal(t, packets.Err3ServerUnavailable.Code, ack.ReasonCode)
+}
+
+func TestClientApplyKeepalivePolicy(t *testing.T) {
+	cl, _, _ := newTestClient()
+	cl.State.Keepalive = 5
+	cl.applyKeepalivePolicy()
+	require.Equal(t, uint16(5), cl.State.Keepalive)
+	require.False(t, cl.State.ServerKeepalive)
+
+	cl.ops.policy = &listeners.Policy{MinimumKeepalive: 10}
+	cl.applyKeepalivePolicy()
+	require.Equal(t, uint16(10), cl.State.Keepalive)
+	require.True(t, cl.State.ServerKeepalive)
+
+	// a client which asks for no keepalive is raised to the minimum
+	cl.State.Keepalive = 0
+	cl.State.ServerKeepalive = false
+	cl.applyKeepalivePolicy()
+	require.Equal(t, uint16(10), cl.State.Keepalive)
+	require.True(t, cl.State.ServerKeepalive)
+}
+
+func TestValidatePolicyMinimumKeepalive(t *testing.T) {
+	s := newServer()
+	cl, _, _ := newTestClient()
+	cl.ops.policy = &listeners.Policy{MinimumKeepalive: 10}
+	cl.Properties.ProtocolVersion = 4
+
+	// v3 clients may be given a longer keepalive, but not one where they asked for none
+	pk := packets.Packet{Connect: packets.ConnectParams{Keepalive: 5}}
+	require.Equal(t, packets.CodeSuccess, s.validatePolicy(cl, pk))
+
+	pk.Connect.Keepalive = 0
+	require.Equal(t, packets.ErrServerUnavailable, s.validatePolicy(cl, pk))
+
+	cl.Properties.ProtocolVersion = 5
+	require.Equal(t, packets.CodeSuccess, s.validatePolicy(cl, pk))
+}
+
+func TestAddListenerInvalidPolicy(t *testing.T) {
+	qos := byte(3)
+	s := newServer()
+	defer s.Close()
+
+	ml := listeners.NewMockListener("policy", ":1882")
+	ml.Config = &listeners.Config{ID: "policy", Policy: &listeners.Policy{MaximumQos: &qos}}
+	require.ErrorIs(t, s.AddListener(ml), listeners.ErrInvalidPolicyQos)
+	require.Equal(t, 0, s.Listeners.Len())
+}
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	OverflowDropOldest = "drop_oldest" // discard the oldest queued message to make room for a new one
+	OverflowDropNewest = "drop_newest" // discard the new message if the queue is full
+	OverflowReject     = "reject"      // discard the new message and report quota exceeded to the publisher
+)
+
+var (
+	// ErrOfflineQueueFull indicates a message was not queued because the offline queue for a client was full.
+	ErrOfflineQueueFull = errors.New("offline queue full")
+)
+
+// OfflineQueueOptions configures the queues which hold messages for persistent sessions
+// while their clients are disconnected.
+type OfflineQueueOptions struct {
+	MaxMessages int    `yaml:"max_messages" json:"max_messages"` // maximum number of messages queued per session, 0 is unlimited
+	MaxBytes    int64  `yaml:"max_bytes" json:"max_bytes"`       // maximum topic and payload bytes queued per session, 0 is unlimited
+	Overflow    string `yaml:"overflow" json:"overflow"`         // drop_oldest (default), drop_newest, or reject
+	QueueQos0   bool   `yaml:"queue_qos0" json:"queue_qos0"`     // also queue qos 0 messages
+}
+
+// QueuedMessage is a message held in an offline queue.
+type QueuedMessage struct {
+	Packet   packets.Packet // the message, as it will be sent to the client
+	Sequence int64          // the position of the message in the queue
+}
+
+// OfflineQueue is an ordered queue of messages waiting to be delivered to a client
+// with a persistent session, either because the client is disconnected or because it
+// has no quota left to receive them.
+type OfflineQueue struct {
+	sync.RWMutex
+	serial   sync.Mutex      // serializes changes to the queue with their hook calls
+	internal []QueuedMessage // the queued messages, oldest first
+	bytes    int64           // the size of the queued messages
+	sequence int64           // the sequence of the most recently queued message
+}
+
+// NewOfflineQueue returns a new instance of an OfflineQueue.
+func NewOfflineQueue() *OfflineQueue {
+	return &OfflineQueue{
+		internal: []QueuedMessage{},
+	}
+}
+
+// queuedSize returns the number of bytes a message counts against a queue's byte limit.
+func queuedSize(pk packets.Packet) int64 {
+	return int64(len(pk.TopicName) + len(pk.Payload))
+}
+
+// Push adds a message to the end of the queue, returning its sequence. If the queue
+// would exceed maxMessages or maxBytes (0 is unlimited) and dropOldest is true, the
+// oldest messages are removed and returned to make room, otherwise the message is
+// not queued and ok is false.
+func (q *OfflineQueue) Push(pk packets.Packet, maxMessages int, maxBytes int64, dropOldest bool) (seq int64, dropped []QueuedMessage, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	size := queuedSize(pk)
+	if maxBytes > 0 && size > maxBytes {
+		return 0, nil, false
+	}
+
+	for (maxMessages > 0 && len(q.internal) >= maxMessages) || (maxBytes > 0 && q.bytes+size > maxBytes) {
+		if !dropOldest {
+			return 0, dropped, false
+		}
+
+		dropped = append(dropped, q.popLocked())
+	}
+
+	q.sequence++
+	q.internal = append(q.internal, QueuedMessage{Packet: pk, Sequence: q.sequence})
+	q.bytes += size
+	return q.sequence, dropped, true
+}
+
+// Fits returns true if a message could be pushed to the queue without exceeding
+// maxMessages or maxBytes (0 is unlimited) and without dropping other messages.
+func (q *OfflineQueue) Fits(pk packets.Packet, maxMessages int, maxBytes int64) bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	size := queuedSize(pk)
+	return (maxMessages == 0 || len(q.internal) < maxMessages) && (maxBytes == 0 || q.bytes+size <= maxBytes)
+}
+
+// Restore adds a previously queued message with a known sequence, such as when
+// loading queued messages from a store. The queue is kept in sequence order.
+func (q *OfflineQueue) Restore(seq int64, pk packets.Packet) {
+	q.Lock()
+	defer q.Unlock()
+
+	i := sort.Search(len(q.internal), func(i int) bool {
+		return q.internal[i].Sequence >= seq
+	})
+
+	if i < len(q.internal) && q.internal[i].Sequence == seq {
+		q.bytes -= queuedSize(q.internal[i].Packet)
+		q.internal[i].Packet = pk
+	} else {
+		q.internal = append(q.internal, QueuedMessage{})
+		copy(q.internal[i+1:], q.internal[i:])
+		q.internal[i] = QueuedMessage{Packet: pk, Sequence: seq}
+	}
+
+	q.bytes += queuedSize(pk)
+	if seq > q.sequence {
+		q.sequence = seq
+	}
+}
+
+// Peek returns the oldest message in the queue without removing it.
+func (q *OfflineQueue) Peek() (QueuedMessage, bool) {
+	q.RLock()
+	defer q.RUnlock()
+
+	if len(q.internal) == 0 {
+		return QueuedMessage{}, false
+	}
+
+	return q.internal[0], true
+}
+
+// Pop removes and returns the oldest message in the queue.
+func (q *OfflineQueue) Pop() (QueuedMessage, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.internal) == 0 {
+		return QueuedMessage{}, false
+	}
+
+	return q.popLocked(), true
+}
+
+// popLocked removes and returns the oldest message. The queue must be locked and not empty.
+func (q *OfflineQueue) popLocked() QueuedMessage {
+	m := q.internal[0]
+	q.internal[0] = QueuedMessage{} // release the packet for garbage collection
+	q.internal = q.internal[1:]
+	q.bytes -= queuedSize(m.Packet)
+	return m
+}
+
+// Len returns the number of messages in the queue.
+func (q *OfflineQueue) Len() int {
+	q.RLock()
+	defer q.RUnlock()
+	return len(q.internal)
+}
+
+// Bytes returns the size of the messages in the queue.
+func (q *OfflineQueue) Bytes() int64 {
+	q.RLock()
+	defer q.RUnlock()
+	return q.bytes
+}
+
+// GetAll returns all the queued messages, oldest first.
+func (q *OfflineQueue) GetAll() []QueuedMessage {
+	q.RLock()
+	defer q.RUnlock()
+	m := make([]QueuedMessage, len(q.internal))
+	copy(m, q.internal)
+	return m
+}
+
+// Clear removes and returns all the messages in the queue.
+func (q *OfflineQueue) Clear() []QueuedMessage {
+	q.Lock()
+	defer q.Unlock()
+	m := q.internal
+	q.internal = []QueuedMessage{}
+	q.bytes = 0
+	return m
+}
+
+// ClearExpired removes and returns any messages which have expired.
+func (q *OfflineQueue) ClearExpired(now int64) []QueuedMessage {
+	q.Lock()
+	defer q.Unlock()
+
+	var deleted []QueuedMessage
+	kept := q.internal[:0]
+	for _, m := range q.internal {
+		if m.Packet.Expiry > 0 && m.Packet.Expiry < now {
+			deleted = append(deleted, m)
+			q.bytes -= queuedSize(m.Packet)
+			continue
+		}
+		kept = append(kept, m)
+	}
+
+	for i := len(kept); i < len(q.internal); i++ {
+		q.internal[i] = QueuedMessage{}
+	}
+	q.internal = kept
+
+	return deleted
+}
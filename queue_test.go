@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func queuedPacket(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func TestOfflineQueuePushPop(t *testing.T) {
+	q := NewOfflineQueue()
+	require.Equal(t, 0, q.Len())
+
+	_, ok := q.Peek()
+	require.False(t, ok)
+	_, ok = q.Pop()
+	require.False(t, ok)
+
+	seq, dropped, ok := q.Push(queuedPacket("a/b", "one"), 0, 0, false)
+	require.True(t, ok)
+	require.Empty(t, dropped)
+	require.Equal(t, int64(1), seq)
+
+	seq, _, ok = q.Push(queuedPacket("a/b", "two"), 0, 0, false)
+	require.True(t, ok)
+	require.Equal(t, int64(2), seq)
+	require.Equal(t, 2, q.Len())
+	require.Equal(t, int64(12), q.Bytes())
+
+	m, ok := q.Peek()
+	require.True(t, ok)
+	require.Equal(t, int64(1), m.Sequence)
+	require.Equal(t, 2, q.Len())
+
+	m, ok = q.Pop()
+	require.True(t, ok)
+	require.Equal(t, []byte("one"), m.Packet.Payload)
+	require.Equal(t, 1, q.Len())
+	require.Equal(t, int64(6), q.Bytes())
+}
+
+func TestOfflineQueuePushLimits(t *testing.T) {
+	q := NewOfflineQueue()
+	for i := 0; i < 3; i++ {
+		_, _, ok := q.Push(queuedPacket("a", "12345"), 3, 0, false)
+		require.True(t, ok)
+	}
+
+	_, dropped, ok := q.Push(queuedPacket("a", "12345"), 3, 0, false)
+	require.False(t, ok)
+	require.Empty(t, dropped)
+	require.Equal(t, 3, q.Len())
+
+	seq, dropped, ok := q.Push(queuedPacket("a", "new"), 3, 0, true)
+	require.True(t, ok)
+	require.Equal(t, int64(4), seq)
+	require.Len(t, dropped, 1)
+	require.Equal(t, int64(1), dropped[0].Sequence)
+	require.Equal(t, 3, q.Len())
+
+	// bytes limit drops as many messages as needed to fit the new message.
+	seq, dropped, ok = q.Push(queuedPacket("a", "0123456789"), 0, 16, true)
+	require.True(t, ok)
+	require.Equal(t, int64(5), seq)
+	require.Len(t, dropped, 2)
+	require.Equal(t, 2, q.Len())
+	require.Equal(t, int64(15), q.Bytes())
+
+	// a message larger than the bytes limit can never be queued.
+	_, dropped, ok = q.Push(queuedPacket("a", "0123456789abcdef"), 0, 16, true)
+	require.False(t, ok)
+	require.Empty(t, dropped)
+	require.Equal(t, 2, q.Len())
+}
+
+func TestOfflineQueueRestore(t *testing.T) {
+	q := NewOfflineQueue()
+	q.Restore(5, queuedPacket("a", "5"))
+	q.Restore(2, queuedPacket("a", "2"))
+	q.Restore(9, queuedPacket("a", "9"))
+	q.Restore(2, queuedPacket("a", "two"))
+
+	all := q.GetAll()
+	require.Len(t, all, 3)
+	require.Equal(t, int64(2), all[0].Sequence)
+	require.Equal(t, []byte("two"), all[0].Packet.Payload)
+	require.Equal(t, int64(5), all[1].Sequence)
+	require.Equal(t, int64(9), all[2].Sequence)
+	require.Equal(t, int64(8), q.Bytes())
+
+	seq, _, ok := q.Push(queuedPacket("a", "10"), 0, 0, false)
+	require.True(t, ok)
+	require.Equal(t, int64(10), seq)
+}
+
+func TestOfflineQueueClear(t *testing.T) {
+	q := NewOfflineQueue()
+	q.Push(queuedPacket("a", "1"), 0, 0, false)
+	q.Push(queuedPacket("a", "2"), 0, 0, false)
+
+	cleared := q.Clear()
+	require.Len(t, cleared, 2)
+	require.Equal(t, 0, q.Len())
+	require.Equal(t, int64(0), q.Bytes())
+}
+
+func TestOfflineQueueClearExpired(t *testing.T) {
+	q := NewOfflineQueue()
+	for _, expiry := range []int64{0, 5, 15, 8, 20} {
+		pk := queuedPacket("a", "1")
+		pk.Expiry = expiry
+		q.Push(pk, 0, 0, false)
+	}
+
+	deleted := q.ClearExpired(10)
+	require.Len(t, deleted, 2)
+	require.Equal(t, int64(2), deleted[0].Sequence)
+	require.Equal(t, int64(4), deleted[1].Sequence)
+
+	all := q.GetAll()
+	require.Len(t, all, 3)
+	require.Equal(t, int64(1), all[0].Sequence)
+	require.Equal(t, int64(3), all[1].Sequence)
+	require.Equal(t, int64(5), all[2].Sequence)
+	require.Equal(t, int64(6), q.Bytes())
+}
+
+func TestOfflineQueueFits(t *testing.T) {
+	q := NewOfflineQueue()
+	pk := packets.Packet{TopicName: "a", Payload: []byte("bc")}
+	require.True(t, q.Fits(pk, 0, 0))
+	q.Push(pk, 0, 0, false)
+	require.False(t, q.Fits(pk, 1, 0))
+	require.True(t, q.Fits(pk, 2, 0))
+	require.False(t, q.Fits(pk, 0, 5))
+	require.True(t, q.Fits(pk, 0, 6))
+}
@@ -0,0 +1,247 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	RetainedLimitReject = "reject" // reject new retained messages which would exceed a limit
+	RetainedLimitEvict  = "evict"  // evict the least recently updated retained messages to make room
+)
+
+var (
+	// ErrRetainedLimitExceeded indicates a retained message was not stored because a retained message limit was reached.
+	ErrRetainedLimitExceeded = errors.New("retained message limit exceeded")
+
+	// ErrRetainedMessageTooLarge indicates a retained message was not stored because it was larger than the limits allow.
+	ErrRetainedMessageTooLarge = errors.New("retained message too large")
+)
+
+// RetainedLimits are limits on the number and size of retained messages.
+type RetainedLimits struct {
+	MaxMessages    int   `yaml:"max_messages" json:"max_messages"`         // maximum number of retained messages, 0 is unlimited
+	MaxBytes       int64 `yaml:"max_bytes" json:"max_bytes"`               // maximum topic and payload bytes of all retained messages, 0 is unlimited
+	MaxMessageSize int64 `yaml:"max_message_size" json:"max_message_size"` // maximum topic and payload bytes of a single retained message, 0 is unlimited
+}
+
+// RetainedPrefixLimits are limits on the retained messages with topics beginning with a prefix.
+type RetainedPrefixLimits struct {
+	Prefix         string `yaml:"prefix" json:"prefix"` // the topic prefix the limits apply to, eg. sensors/
+	RetainedLimits `yaml:",inline"`
+}
+
+// RetainedLimitsOptions configures limits on the retained messages held by the server.
+// $SYS topics are not counted against the limits.
+type RetainedLimitsOptions struct {
+	RetainedLimits `yaml:",inline"`       // limits on all retained messages
+	Prefixes       []RetainedPrefixLimits `yaml:"prefixes" json:"prefixes"` // limits on the retained messages under a topic prefix
+	Policy         string                 `yaml:"policy" json:"policy"`     // reject (default) or evict
+}
+
+// retainedSize returns the number of bytes a retained message counts against the limits.
+func retainedSize(pk packets.Packet) int64 {
+	return int64(len(pk.TopicName) + len(pk.Payload))
+}
+
+// retainedUsage is the number and size of retained messages within a scope.
+type retainedUsage struct {
+	messages int
+	bytes    int64
+}
+
+// retainedEntry is the size of the retained message on a topic.
+type retainedEntry struct {
+	topic string
+	size  int64
+}
+
+// retainedScope is a set of limits and the topic prefix they apply to.
+type retainedScope struct {
+	prefix string
+	limits RetainedLimits
+	usage  retainedUsage
+}
+
+// exceeded returns true if adding a message of size to the scope would exceed its limits.
+func (sc *retainedScope) exceeded(size int64) bool {
+	return (sc.limits.MaxMessages > 0 && sc.usage.messages+1 > sc.limits.MaxMessages) ||
+		(sc.limits.MaxBytes > 0 && sc.usage.bytes+size > sc.limits.MaxBytes)
+}
+
+// retainedTracker accounts for the size of retained messages, ordered by when they
+// were last updated, so that limits can be enforced.
+type retainedTracker struct {
+	sync.Mutex
+	order    *list.List                // retained entries, least recently updated first
+	entries  map[string]*list.Element  // order elements keyed on topic
+	bytes    int64                     // the size of all tracked messages
+	prefixes map[string]*retainedUsage // usage of prefixes which have limits, computed when first needed
+}
+
+// newRetainedTracker returns a new instance of retainedTracker.
+func newRetainedTracker() *retainedTracker {
+	return &retainedTracker{
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		prefixes: map[string]*retainedUsage{},
+	}
+}
+
+// usage returns the usage of the retained messages with topics beginning with prefix.
+// An empty prefix returns the usage of all retained messages.
+func (t *retainedTracker) usage(prefix string) retainedUsage {
+	if prefix == "" {
+		return retainedUsage{messages: len(t.entries), bytes: t.bytes}
+	}
+
+	u, ok := t.prefixes[prefix]
+	if !ok {
+		u = new(retainedUsage)
+		for topic, e := range t.entries {
+			if strings.HasPrefix(topic, prefix) {
+				u.messages++
+				u.bytes += e.Value.(*retainedEntry).size
+			}
+		}
+		t.prefixes[prefix] = u
+	}
+
+	return *u
+}
+
+// admit returns the topics of the retained messages which must be removed so that a
+// message of size can be retained on topic without exceeding the limits. If the limits
+// cannot be met, or could only be met by evicting messages when the policy is to
+// reject, an error is returned.
+func (t *retainedTracker) admit(topic string, size int64, limits *RetainedLimitsOptions) (evicted []string, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	scopes := []*retainedScope{{limits: limits.RetainedLimits}}
+	for _, p := range limits.Prefixes {
+		if p.Prefix != "" && strings.HasPrefix(topic, p.Prefix) {
+			scopes = append(scopes, &retainedScope{prefix: p.Prefix, limits: p.RetainedLimits})
+		}
+	}
+
+	var existing int64
+	e, exists := t.entries[topic]
+	if exists {
+		existing = e.Value.(*retainedEntry).size
+	}
+
+	for _, sc := range scopes {
+		if (sc.limits.MaxMessageSize > 0 && size > sc.limits.MaxMessageSize) ||
+			(sc.limits.MaxBytes > 0 && size > sc.limits.MaxBytes) {
+			return nil, ErrRetainedMessageTooLarge
+		}
+
+		sc.usage = t.usage(sc.prefix)
+		if exists { // the existing message on the topic is replaced
+			sc.usage.messages--
+			sc.usage.bytes -= existing
+		}
+	}
+
+	removed := map[string]struct{}{}
+	for _, sc := range scopes {
+		for sc.exceeded(size) {
+			if limits.Policy != RetainedLimitEvict {
+				return nil, ErrRetainedLimitExceeded
+			}
+
+			victim, ok := t.oldest(sc.prefix, topic, removed)
+			if !ok {
+				return nil, ErrRetainedLimitExceeded
+			}
+
+			removed[victim.topic] = struct{}{}
+			evicted = append(evicted, victim.topic)
+			for _, other := range scopes {
+				if strings.HasPrefix(victim.topic, other.prefix) {
+					other.usage.messages--
+					other.usage.bytes -= victim.size
+				}
+			}
+		}
+	}
+
+	return evicted, nil
+}
+
+// oldest returns the least recently updated entry with a topic beginning with prefix,
+// other than the excluded topic and any topics which have already been removed.
+func (t *retainedTracker) oldest(prefix, exclude string, removed map[string]struct{}) (*retainedEntry, bool) {
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*retainedEntry)
+		if e.topic == exclude || !strings.HasPrefix(e.topic, prefix) {
+			continue
+		}
+
+		if _, ok := removed[e.topic]; ok {
+			continue
+		}
+
+		return e, true
+	}
+
+	return nil, false
+}
+
+// set records the size of the retained message on a topic, marking it as the most recently updated.
+func (t *retainedTracker) set(topic string, size int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if el, ok := t.entries[topic]; ok {
+		t.adjust(topic, -1, -el.Value.(*retainedEntry).size)
+		el.Value.(*retainedEntry).size = size
+		t.order.MoveToBack(el)
+	} else {
+		t.entries[topic] = t.order.PushBack(&retainedEntry{topic: topic, size: size})
+	}
+
+	t.adjust(topic, 1, size)
+}
+
+// remove stops tracking the retained message on a topic.
+func (t *retainedTracker) remove(topic string) {
+	t.Lock()
+	defer t.Unlock()
+
+	el, ok := t.entries[topic]
+	if !ok {
+		return
+	}
+
+	t.adjust(topic, -1, -el.Value.(*retainedEntry).size)
+	t.order.Remove(el)
+	delete(t.entries, topic)
+}
+
+// adjust applies a change in the number and size of messages to the totals.
+func (t *retainedTracker) adjust(topic string, messages int, bytes int64) {
+	t.bytes += bytes
+	for prefix, u := range t.prefixes {
+		if strings.HasPrefix(topic, prefix) {
+			u.messages += messages
+			u.bytes += bytes
+		}
+	}
+}
+
+// total returns the size of all tracked retained messages.
+func (t *retainedTracker) total() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.bytes
+}
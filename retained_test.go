@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2023 mochi-mqtt, mochi-co
+// SPDX-FileContributor: mochi-co
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetainedTrackerSetRemove(t *testing.T) {
+	tr := newRetainedTracker()
+	tr.set("a/b", 5)
+	tr.set("a/c", 7)
+	require.Equal(t, int64(12), tr.total())
+	require.Equal(t, retainedUsage{messages: 2, bytes: 12}, tr.usage(""))
+	require.Equal(t, retainedUsage{messages: 2, bytes: 12}, tr.usage("a/"))
+
+	tr.set("a/b", 3)
+	require.Equal(t, int64(10), tr.total())
+	require.Equal(t, retainedUsage{messages: 2, bytes: 10}, tr.usage("a/"))
+
+	e, ok := tr.oldest("", "", nil)
+	require.True(t, ok)
+	require.Equal(t, "a/c", e.topic) // a/b was updated more recently
+
+	tr.remove("a/c")
+	tr.remove("x/y")
+	require.Equal(t, int64(3), tr.total())
+	require.Equal(t, retainedUsage{messages: 1, bytes: 3}, tr.usage("a/"))
+}
+
+func TestRetainedTrackerAdmitReject(t *testing.T) {
+	tr := newRetainedTracker()
+	limits := &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessages: 2, MaxMessageSize: 10},
+		Policy:         RetainedLimitReject,
+	}
+
+	_, err := tr.admit("a/b", 11, limits)
+	require.ErrorIs(t, err, ErrRetainedMessageTooLarge)
+
+	tr.set("a/b", 5)
+	tr.set("a/c", 5)
+	_, err = tr.admit("a/d", 5, limits)
+	require.ErrorIs(t, err, ErrRetainedLimitExceeded)
+
+	// replacing an existing message does not add to the count.
+	evicted, err := tr.admit("a/b", 8, limits)
+	require.NoError(t, err)
+	require.Empty(t, evicted)
+}
+
+func TestRetainedTrackerAdmitEvict(t *testing.T) {
+	tr := newRetainedTracker()
+	limits := &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxBytes: 20},
+		Policy:         RetainedLimitEvict,
+	}
+
+	tr.set("a/1", 5)
+	tr.set("a/2", 5)
+	tr.set("a/3", 5)
+	tr.set("a/1", 5) // a/2 is now the least recently updated
+
+	evicted, err := tr.admit("a/4", 11, limits)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/2", "a/3"}, evicted)
+
+	_, err = tr.admit("a/4", 21, limits)
+	require.ErrorIs(t, err, ErrRetainedMessageTooLarge)
+}
+
+func TestRetainedTrackerAdmitPrefix(t *testing.T) {
+	tr := newRetainedTracker()
+	limits := &RetainedLimitsOptions{
+		Prefixes: []RetainedPrefixLimits{
+			{Prefix: "sensors/", RetainedLimits: RetainedLimits{MaxMessages: 1}},
+		},
+		Policy: RetainedLimitEvict,
+	}
+
+	tr.set("sensors/1", 5)
+	tr.set("other/1", 5)
+
+	evicted, err := tr.admit("other/2", 5, limits)
+	require.NoError(t, err)
+	require.Empty(t, evicted)
+
+	evicted, err = tr.admit("sensors/2", 5, limits)
+	require.NoError(t, err)
+	require.Equal(t, []string{"sensors/1"}, evicted)
+
+	limits.Policy = RetainedLimitReject
+	_, err = tr.admit("sensors/2", 5, limits)
+	require.ErrorIs(t, err, ErrRetainedLimitExceeded)
+}
@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -129,6 +130,15 @@ type Options struct {
 	// Enable Inline client to allow direct subscribing and publishing from the parent codebase,
 	// with negligible performance difference (disabled by default to prevent confusion in statistics).
 	InlineClient bool `yaml:"inline_client" json:"inline_client"`
+
+	// OfflineQueue enables a queue for each persistent session which holds messages while
+	// the client is disconnected, and delivers them in order when it reconnects. If nil,
+	// qos > 0 messages for disconnected clients are held as inflight messages instead.
+	OfflineQueue *OfflineQueueOptions `yaml:"offline_queue" json:"offline_queue"`
+
+	// RetainedLimits limits the number and size of retained messages, globally and under
+	// topic prefixes. If nil, retained messages are not limited.
+	RetainedLimits *RetainedLimitsOptions `yaml:"retained_limits" json:"retained_limits"`
 }
 
 // Server is an MQTT broker server. It should be created with server.New()
@@ -144,6 +154,7 @@ type Server struct {
 	Log          *slog.Logger         // minimal no-alloc logger
 	hooks        *Hooks               // hooks contains hooks for extra functionality such as auth and persistent storage
 	inlineClient *Client              // inlineClient is a special client used for inline subscriptions and inline Publish
+	connected    sync.Map             // the number of clients connected to each listener, for listener client limits
 }
 
 // loop contains interval tickers for the system events loop.
@@ -158,10 +169,11 @@ type loop struct {
 
 // ops contains server values which can be propagated to other structs.
 type ops struct {
-	options *Options     // a pointer to the server options and capabilities, for referencing in clients
-	info    *system.Info // pointers to server system info
-	hooks   *Hooks       // pointer to the server hooks
-	log     *slog.Logger // a structured logger for the client
+	options *Options          // a pointer to the server options and capabilities, for referencing in clients
+	info    *system.Info      // pointers to server system info
+	hooks   *Hooks            // pointer to the server hooks
+	log     *slog.Logger      // a structured logger for the client
+	policy  *listeners.Policy // capability and policy overrides of the client's listener, if any
 }
 
 // New returns a new instance of mochi mqtt broker. Optional parameters
@@ -233,6 +245,14 @@ func (o *Options) ensureDefaults() {
 		log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 		o.Logger = log
 	}
+
+	if o.OfflineQueue != nil && o.OfflineQueue.Overflow != OverflowDropNewest && o.OfflineQueue.Overflow != OverflowReject {
+		o.OfflineQueue.Overflow = OverflowDropOldest
+	}
+
+	if o.RetainedLimits != nil && o.RetainedLimits.Policy != RetainedLimitEvict {
+		o.RetainedLimits.Policy = RetainedLimitReject
+	}
 }
 
 // NewClient returns a new Client instance, populated with all the required values and
@@ -240,12 +260,19 @@ func (o *Options) ensureDefaults() {
 // messages from the embedding application, set the inline flag to true to bypass ACL and
 // topic validation checks.
 func (s *Server) NewClient(c net.Conn, listener string, id string, inline bool) *Client {
-	cl := newClient(c, &ops{ // [MQTT-3.1.2-6] implicit
+	o := &ops{ // [MQTT-3.1.2-6] implicit
 		options: s.Options,
 		info:    s.Info,
 		hooks:   s.hooks,
 		log:     s.Log,
-	})
+	}
+
+	if p := s.listenerPolicy(listener); p != nil {
+		o.options = withPolicy(s.Options, p)
+		o.policy = p
+	}
+
+	cl := newClient(c, o)
 
 	cl.ID = id
 	cl.Net.Listener = listener
@@ -289,6 +316,16 @@ func (s *Server) AddListener(l listeners.Listener) error {
 		return ErrListenerIDExists
 	}
 
+	if pl, ok := l.(listeners.PolicyListener); ok && pl.Policy() != nil {
+		if err := pl.Policy().Validate(); err != nil {
+			return err
+		}
+	}
+
+	if al, ok := l.(listeners.ACLListener); ok {
+		al.SetACLCheck(s.listenerACLCheck)
+	}
+
 	nl := s.Log.With(slog.String("listener", l.ID()))
 	err := l.Init(nl)
 	if err != nil {
@@ -301,6 +338,23 @@ func (s *Server) AddListener(l listeners.Listener) error {
 	return nil
 }
 
+// listenerACLCheck returns true if a client connected through a listener may publish
+// to a topic, reporting the refusal to the hooks if not. It is used by listeners which
+// check publishes before sending them to the server.
+func (s *Server) listenerACLCheck(listener, clientID, topic string) bool {
+	cl, ok := s.Clients.Get(clientID)
+	if !ok || cl.Net.Listener != listener {
+		return false
+	}
+
+	if !s.hooks.OnACLCheck(cl, topic, true) {
+		s.hooks.OnACLCheckFailed(cl, topic, true)
+		return false
+	}
+
+	return true
+}
+
 // AddListenersFromConfig adds listeners to the server which were specified in the listeners config (usually from a config file).
 // New built-in listeners should be added to this list.
 func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
@@ -313,6 +367,14 @@ func (s *Server) AddListenersFromConfig(configs []listeners.Config) error {
 			l = listeners.NewWebsocket(conf)
 		case listeners.TypeUnix:
 			l = listeners.NewUnixSock(conf)
+		case listeners.TypeQUIC:
+			l = listeners.NewQUIC(conf)
+		case listeners.TypeMQTTSN:
+			l = listeners.NewMQTTSN(conf)
+		case listeners.TypeHTTPGateway:
+			l = listeners.NewHTTPGateway(conf)
+		case listeners.TypeCoAP:
+			l = listeners.NewCoAP(conf)
 		case listeners.TypeHealthCheck:
 			l = listeners.NewHTTPHealthCheck(conf)
 		case listeners.TypeSysInfo:
@@ -355,6 +417,7 @@ func (s *Server) Serve() error {
 		StoredInflightMessages,
 		StoredRetainedMessages,
 		StoredSubscriptions,
+		StoredQueuedMessages,
 		StoredSysInfo,
 	) {
 		err := s.readStore()
@@ -391,6 +454,7 @@ func (s *Server) eventLoop() {
 			s.sendDelayedLWT(time.Now().Unix())
 		case <-s.loop.inflightExpiry.C:
 			s.clearExpiredInflights(time.Now().Unix())
+			s.processOfflineQueues(time.Now().Unix())
 		}
 	}
 }
@@ -426,6 +490,19 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		return packets.ErrServerBusy
 	}
 
+	lc := s.listenerClients(listener)
+	n := lc.Add(1) // counted before checking, so concurrent connects can't exceed the limit
+	defer lc.Add(-1)
+	if p := cl.policy(); p != nil && p.MaximumClients > 0 && n > p.MaximumClients {
+		if cl.Properties.ProtocolVersion < 5 {
+			s.SendConnack(cl, packets.ErrServerUnavailable, false, nil)
+		} else {
+			s.SendConnack(cl, packets.ErrServerBusy, false, nil)
+		}
+
+		return packets.ErrServerBusy
+	}
+
 	code := s.validateConnect(cl, pk) // [MQTT-3.1.4-1] [MQTT-3.1.4-2]
 	if code != packets.CodeSuccess {
 		if err := s.SendConnack(cl, code, false, nil); err != nil {
@@ -441,6 +518,7 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	cl.refreshDeadline(cl.State.Keepalive)
 	if !s.hooks.OnConnectAuthenticate(cl, pk) { // [MQTT-3.1.4-2]
+		s.hooks.OnConnectAuthenticateFailed(cl, pk)
 		err := s.SendConnack(cl, packets.ErrBadUsernameOrPassword, false, nil)
 		if err != nil {
 			return fmt.Errorf("invalid connection send ack: %w", err)
@@ -451,7 +529,6 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	atomic.AddInt64(&s.Info.ClientsConnected, 1)
 	defer atomic.AddInt64(&s.Info.ClientsConnected, -1)
-
 	s.hooks.OnSessionEstablish(cl, pk)
 
 	sessionPresent := s.inheritClientSession(pk, cl)
@@ -471,6 +548,9 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 		}
 	}
 
+	cl.State.queueOpen.Store(true)
+	s.drainQueue(cl)
+
 	s.hooks.OnSessionEstablished(cl, pk)
 
 	err = cl.Read(s.receivePacket)
@@ -487,6 +567,7 @@ func (s *Server) attachClient(cl *Client, listener string) error {
 
 	if expire && !cl.IsTakenOver() {
 		cl.ClearInflights()
+		s.clearQueue(cl)
 		s.UnsubscribeClient(cl)
 		s.Clients.Delete(cl.ID) // [MQTT-4.1.0-2] ![MQTT-3.1.2-23]
 	}
@@ -545,15 +626,16 @@ func (s *Server) validateConnect(cl *Client, pk packets.Packet) packets.Code {
 		return packets.ErrUnspecifiedError
 	}
 
-	if cl.Properties.ProtocolVersion < s.Options.Capabilities.MinimumProtocolVersion {
+	caps := s.capabilities(cl)
+	if cl.Properties.ProtocolVersion < caps.MinimumProtocolVersion {
 		return packets.ErrUnsupportedProtocolVersion // [MQTT-3.1.2-2]
-	} else if cl.Properties.Will.Qos > s.Options.Capabilities.MaximumQos {
+	} else if cl.Properties.Will.Qos > caps.MaximumQos {
 		return packets.ErrQosNotSupported // [MQTT-3.2.2-12]
-	} else if cl.Properties.Will.Retain && s.Options.Capabilities.RetainAvailable == 0x00 {
+	} else if cl.Properties.Will.Retain && caps.RetainAvailable == 0x00 {
 		return packets.ErrRetainNotSupported // [MQTT-3.2.2-13]
 	}
 
-	return code
+	return s.validatePolicy(cl, pk)
 }
 
 // inheritClientSession inherits the state of an existing client sharing the same
@@ -565,6 +647,7 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 		if pk.Connect.Clean || (existing.Properties.Clean && existing.Properties.ProtocolVersion < 5) { // [MQTT-3.1.2-4] [MQTT-3.1.4-4]
 			s.UnsubscribeClient(existing)
 			existing.ClearInflights()
+			s.clearQueue(existing)
 			existing.State.isTakenOver.Store(true) // only set isTakenOver after unsubscribe has occurred
 			return false                           // [MQTT-3.2.2-3]
 		}
@@ -578,6 +661,9 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 			}
 		}
 
+		existing.State.queueOpen.Store(false)
+		cl.State.Queue = existing.State.Queue // messages queued for the existing client are delivered to the new one
+
 		for _, sub := range existing.State.Subscriptions.GetAll() {
 			existed := !s.Topics.Subscribe(cl.ID, sub) // [MQTT-3.8.4-3]
 			if !existed {
@@ -605,14 +691,15 @@ func (s *Server) inheritClientSession(pk packets.Packet, cl *Client) bool {
 
 // SendConnack returns a Connack packet to a client.
 func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, properties *packets.Properties) error {
+	caps := s.capabilities(cl)
 	if properties == nil {
 		properties = &packets.Properties{
-			ReceiveMaximum: s.Options.Capabilities.ReceiveMaximum,
+			ReceiveMaximum: caps.ReceiveMaximum,
 		}
 	}
 
-	properties.ReceiveMaximum = s.Options.Capabilities.ReceiveMaximum // 3.2.2.3.3 Receive Maximum
-	if cl.State.ServerKeepalive {                                     // You can set this dynamically using the OnConnect hook.
+	properties.ReceiveMaximum = caps.ReceiveMaximum // 3.2.2.3.3 Receive Maximum
+	if cl.State.ServerKeepalive {                   // You can set this dynamically using the OnConnect hook.
 		properties.ServerKeepAlive = cl.State.Keepalive // [MQTT-3.1.2-21]
 		properties.ServerKeepAliveFlag = true
 	}
@@ -636,17 +723,26 @@ func (s *Server) SendConnack(cl *Client, reason packets.Code, present bool, prop
 		return cl.WritePacket(ack)
 	}
 
-	if s.Options.Capabilities.MaximumQos < 2 {
-		properties.MaximumQos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+	if caps.MaximumQos < 2 {
+		properties.MaximumQos = caps.MaximumQos // [MQTT-3.2.2-9]
 		properties.MaximumQosFlag = true
 	}
 
+	if caps.RetainAvailable == 0 {
+		properties.RetainAvailable = caps.RetainAvailable // 3.2.2.3.5 Retain Available
+		properties.RetainAvailableFlag = true
+	}
+
+	if caps.MaximumPacketSize > 0 {
+		properties.MaximumPacketSize = caps.MaximumPacketSize // 3.2.2.3.6 Maximum Packet Size
+	}
+
 	if cl.Properties.Props.AssignedClientID != "" {
 		properties.AssignedClientID = cl.Properties.Props.AssignedClientID // [MQTT-3.1.3-7] [MQTT-3.2.2-16]
 	}
 
-	if cl.Properties.Props.SessionExpiryInterval > s.Options.Capabilities.MaximumSessionExpiryInterval {
-		properties.SessionExpiryInterval = s.Options.Capabilities.MaximumSessionExpiryInterval
+	if cl.Properties.Props.SessionExpiryInterval > caps.MaximumSessionExpiryInterval {
+		properties.SessionExpiryInterval = caps.MaximumSessionExpiryInterval
 		properties.SessionExpiryIntervalFlag = true
 		cl.Properties.Props.SessionExpiryInterval = properties.SessionExpiryInterval
 		cl.Properties.Props.SessionExpiryIntervalFlag = true
@@ -676,7 +772,7 @@ func (s *Server) processPacket(cl *Client, pk packets.Packet) error {
 	case packets.Pingreq:
 		err = s.processPingreq(cl, pk)
 	case packets.Publish:
-		code := pk.PublishValidate(s.Options.Capabilities.TopicAliasMaximum)
+		code := pk.PublishValidate(s.capabilities(cl).TopicAliasMaximum)
 		if code != packets.CodeSuccess {
 			return code
 		}
@@ -727,6 +823,10 @@ func (s *Server) processPacket(cl *Client, pk packets.Packet) error {
 		}
 	}
 
+	if cl.State.Queue.Len() > 0 {
+		s.drainQueue(cl) // acks may have freed quota for queued messages
+	}
+
 	return nil
 }
 
@@ -836,6 +936,13 @@ func (s *Server) Unsubscribe(filter string, subscriptionId int) error {
 	return nil
 }
 
+// ACLCheck returns true if any OnACLCheck hook allows a client to publish (write) to a
+// topic or subscribe (read) to a filter. Unlike the checks made by the server, inline
+// clients are not exempt, so it can be used to check access on behalf of a client.
+func (s *Server) ACLCheck(cl *Client, topic string, write bool) bool {
+	return s.hooks.OnACLCheck(cl, topic, write)
+}
+
 // InjectPacket injects a packet into the broker as if it were sent from the specified client.
 // InlineClients using this method can publish packets to any topic (including $SYS) and bypass ACL checks.
 func (s *Server) InjectPacket(cl *Client, pk packets.Packet) error {
@@ -865,6 +972,7 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	}
 
 	if !cl.Net.Inline && !s.hooks.OnACLCheck(cl, pk.TopicName, true) {
+		s.hooks.OnACLCheckFailed(cl, pk.TopicName, true)
 		if pk.FixedHeader.Qos == 0 {
 			return nil
 		}
@@ -906,8 +1014,8 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		pk.TopicName = cl.State.TopicAliases.Inbound.Set(pk.Properties.TopicAlias, pk.TopicName)
 	}
 
-	if pk.FixedHeader.Qos > s.Options.Capabilities.MaximumQos {
-		pk.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9] Reduce qos based on server max qos capability
+	if maxQos := s.capabilities(cl).MaximumQos; pk.FixedHeader.Qos > maxQos {
+		pk.FixedHeader.Qos = maxQos // [MQTT-3.2.2-9] Reduce qos based on server max qos capability
 	}
 
 	pkx, err := s.hooks.OnPublish(cl, pk)
@@ -926,7 +1034,15 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	}
 
 	if pk.FixedHeader.Retain { // [MQTT-3.3.1-5] ![MQTT-3.3.1-8]
-		s.retainMessage(cl, pk)
+		// A retained message which exceeds the retained limits is refused outright if the
+		// publisher can be told, otherwise it is still published but not retained.
+		if err := s.retainMessage(cl, pk); err != nil && cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 && !cl.Net.Inline {
+			ackType := packets.Puback
+			if pk.FixedHeader.Qos == 2 {
+				ackType = packets.Pubrec
+			}
+			return cl.WritePacket(s.buildAck(pk.PacketID, ackType, 0, pk.Properties, packets.ErrQuotaExceeded))
+		}
 	}
 
 	// If it's inlineClient, it can't handle PUBREC and PUBREL.
@@ -939,9 +1055,33 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 	}
 
 	cl.State.Inflight.DecreaseReceiveQuota()
-	ack := s.buildAck(pk.PacketID, packets.Puback, 0, pk.Properties, packets.QosCodes[pk.FixedHeader.Qos]) // [MQTT-4.3.2-4]
+
+	// If full offline queues reject messages, the queues of the selected subscribers are
+	// checked before the message is acknowledged, and a message which doesn't fit is
+	// refused without being delivered to anyone so that the publisher can safely retry.
+	var subscribers *Subscribers
+	if !pk.Ignore {
+		subscribers = s.selectSubscribers(pk)
+	}
+
+	reason := packets.QosCodes[pk.FixedHeader.Qos]
+	if s.Options.OfflineQueue != nil && s.Options.OfflineQueue.Overflow == OverflowReject &&
+		cl.Properties.ProtocolVersion == 5 && s.queuesFull(pk, subscribers) {
+		atomic.AddInt64(&s.Info.MessagesDropped, 1)
+		reason = packets.ErrQuotaExceeded
+	}
+
+	ack := s.buildAck(pk.PacketID, packets.Puback, 0, pk.Properties, reason) // [MQTT-4.3.2-4]
 	if pk.FixedHeader.Qos == 2 {
-		ack = s.buildAck(pk.PacketID, packets.Pubrec, 0, pk.Properties, packets.CodeSuccess) // [MQTT-3.3.4-1] [MQTT-4.3.3-8]
+		if reason.Code < packets.ErrUnspecifiedError.Code {
+			reason = packets.CodeSuccess
+		}
+		ack = s.buildAck(pk.PacketID, packets.Pubrec, 0, pk.Properties, reason) // [MQTT-3.3.4-1] [MQTT-4.3.3-8]
+	}
+
+	if reason.Code >= packets.ErrUnspecifiedError.Code {
+		cl.State.Inflight.IncreaseReceiveQuota() // the qos flow ends with the failed ack
+		return cl.WritePacket(ack)
 	}
 
 	if ok := cl.State.Inflight.Set(ack); ok {
@@ -962,23 +1102,75 @@ func (s *Server) processPublish(cl *Client, pk packets.Packet) error {
 		s.hooks.OnQosComplete(cl, ack)
 	}
 
-	s.publishToSubscribers(pk)
+	s.deliverToSubscribers(pk, subscribers)
 	s.hooks.OnPublished(cl, pk)
 
 	return nil
 }
 
 // retainMessage adds a message to a topic, and if a persistent store is provided,
-// adds the message to the store to be reloaded if necessary.
-func (s *Server) retainMessage(cl *Client, pk packets.Packet) {
-	if s.Options.Capabilities.RetainAvailable == 0 || pk.Ignore {
-		return
+// adds the message to the store to be reloaded if necessary. An error is returned if
+// the message was not retained because it would exceed the retained limits.
+func (s *Server) retainMessage(cl *Client, pk packets.Packet) error {
+	if s.capabilities(cl).RetainAvailable == 0 || pk.Ignore {
+		return nil
 	}
 
 	out := pk.Copy(false)
-	r := s.Topics.RetainMessage(out)
+	r, evicted, err := s.Topics.RetainMessageLimited(out, s.Options.RetainedLimits)
+	if err != nil {
+		atomic.AddInt64(&s.Info.RetainedRejected, 1)
+		s.Log.Debug("retained message rejected", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return err
+	}
+
+	s.retainedEvicted(evicted)
 	s.hooks.OnRetainMessage(cl, pk, r)
 	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	atomic.StoreInt64(&s.Info.RetainedBytes, s.Topics.RetainedBytes())
+	return nil
+}
+
+// retainedEvicted removes retained messages which were evicted to make room for
+// others from the persistent stores.
+func (s *Server) retainedEvicted(topics []string) {
+	for _, topic := range topics {
+		atomic.AddInt64(&s.Info.RetainedEvicted, 1)
+		s.hooks.OnRetainedExpired(topic)
+	}
+}
+
+// ClearRetained deletes the retained messages on all topics matching a filter, including
+// from any persistent stores, and returns the topics which were cleared.
+func (s *Server) ClearRetained(filter string) []string {
+	pks := s.Topics.Messages(filter)
+	topics := make([]string, 0, len(pks))
+	for _, pk := range pks {
+		s.Topics.RetainMessage(packets.Packet{TopicName: pk.TopicName})
+		s.hooks.OnRetainedExpired(pk.TopicName)
+		topics = append(topics, pk.TopicName)
+	}
+
+	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	atomic.StoreInt64(&s.Info.RetainedBytes, s.Topics.RetainedBytes())
+	return topics
+}
+
+// SyncRetained applies a retained message changed outside of the server, such as by
+// another broker sharing a persistent store, to the topics index. The retained limits
+// are applied as for a published message, and an empty payload removes the message.
+// An error is returned if the message was not retained because it would exceed the limits.
+func (s *Server) SyncRetained(pk packets.Packet) error {
+	_, evicted, err := s.Topics.RetainMessageLimited(pk, s.Options.RetainedLimits)
+	if err != nil {
+		atomic.AddInt64(&s.Info.RetainedRejected, 1)
+		return err
+	}
+
+	s.retainedEvicted(evicted)
+	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+	atomic.StoreInt64(&s.Info.RetainedBytes, s.Topics.RetainedBytes())
+	return nil
 }
 
 // publishToSubscribers publishes a publish packet to all subscribers with matching topic filters.
@@ -987,6 +1179,37 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 		return
 	}
 
+	s.deliverToSubscribers(pk, s.selectSubscribers(pk))
+}
+
+// selectSubscribers returns the subscribers with topic filters matching a publish packet,
+// with one subscriber selected from each shared subscription group.
+func (s *Server) selectSubscribers(pk packets.Packet) *Subscribers {
+	subscribers := s.Topics.Subscribers(pk.TopicName)
+	if len(subscribers.Shared) > 0 {
+		subscribers = s.hooks.OnSelectSubscribers(subscribers, pk)
+		if len(subscribers.SharedSelected) == 0 {
+			subscribers.SelectShared()
+		}
+		subscribers.MergeSharedSelected()
+	}
+
+	return subscribers
+}
+
+// CountSubscribers returns the number of subscribers a publish packet would be delivered
+// to, counting one subscriber for each shared subscription group.
+func (s *Server) CountSubscribers(pk packets.Packet) int {
+	subscribers := s.selectSubscribers(pk)
+	return len(subscribers.Subscriptions) + len(subscribers.InlineSubscriptions)
+}
+
+// deliverToSubscribers publishes a publish packet to previously selected subscribers.
+func (s *Server) deliverToSubscribers(pk packets.Packet, subscribers *Subscribers) {
+	if pk.Ignore {
+		return
+	}
+
 	if pk.Created == 0 {
 		pk.Created = time.Now().Unix()
 	}
@@ -998,15 +1221,6 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 		}
 	}
 
-	subscribers := s.Topics.Subscribers(pk.TopicName)
-	if len(subscribers.Shared) > 0 {
-		subscribers = s.hooks.OnSelectSubscribers(subscribers, pk)
-		if len(subscribers.SharedSelected) == 0 {
-			subscribers.SelectShared()
-		}
-		subscribers.MergeSharedSelected()
-	}
-
 	for _, inlineSubscription := range subscribers.InlineSubscriptions {
 		inlineSubscription.Handler(s.inlineClient, inlineSubscription.Subscription, pk)
 	}
@@ -1021,6 +1235,31 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 	}
 }
 
+// queuesFull returns true if a publish packet would be queued for any of the subscribers
+// and doesn't fit in their offline queue. Another publisher may fill a queue between the
+// check and the delivery, in which case that queue drops the message as usual.
+func (s *Server) queuesFull(pk packets.Packet, subscribers *Subscribers) bool {
+	if pk.Ignore {
+		return false
+	}
+
+	opts := s.Options.OfflineQueue
+	for id, sub := range subscribers.Subscriptions {
+		cl, ok := s.Clients.Get(id)
+		if !ok || (sub.NoLocal && pk.Origin == cl.ID) {
+			continue
+		}
+
+		out := pk.Copy(false)
+		out.FixedHeader.Qos = min(out.FixedHeader.Qos, sub.Qos, s.capabilities(cl).MaximumQos)
+		if s.shouldQueue(cl, out) && !cl.State.Queue.Fits(out, opts.MaxMessages, opts.MaxBytes) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packets.Packet) (packets.Packet, error) {
 	if sub.NoLocal && pk.Origin == cl.ID {
 		return pk, nil // [MQTT-3.8.3-3]
@@ -1028,7 +1267,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 
 	out := pk.Copy(false)
 	if !s.hooks.OnACLCheck(cl, pk.TopicName, false) {
-		return out, packets.ErrNotAuthorized
+		return out, packets.ErrNotAuthorized // not reported to OnACLCheckFailed, as it would fire for every delivery
 	}
 	if !sub.FwdRetainedFlag && ((cl.Properties.ProtocolVersion == 5 && !sub.RetainAsPublished) || cl.Properties.ProtocolVersion < 5) { // ![MQTT-3.3.1-13] [v3 MQTT-3.3.1-9]
 		out.FixedHeader.Retain = false // [MQTT-3.3.1-12]
@@ -1046,8 +1285,16 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 		out.FixedHeader.Qos = sub.Qos
 	}
 
-	if out.FixedHeader.Qos > s.Options.Capabilities.MaximumQos {
-		out.FixedHeader.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+	if maxQos := s.capabilities(cl).MaximumQos; out.FixedHeader.Qos > maxQos {
+		out.FixedHeader.Qos = maxQos // [MQTT-3.2.2-9]
+	}
+
+	if s.shouldQueue(cl, out) {
+		if err := s.queueMessage(cl, out); err != nil {
+			return out, err
+		}
+		s.drainQueue(cl)
+		return out, nil
 	}
 
 	if cl.Properties.Props.TopicAliasMaximum > 0 {
@@ -1062,7 +1309,7 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	}
 
 	if out.FixedHeader.Qos > 0 {
-		if cl.State.Inflight.Len() >= int(s.Options.Capabilities.MaximumInflight) {
+		if cl.State.Inflight.Len() >= int(s.capabilities(cl).MaximumInflight) {
 			// add hook?
 			atomic.AddInt64(&s.Info.InflightDropped, 1)
 			s.Log.Warn("client store quota reached", "client", cl.ID, "listener", cl.Net.Listener)
@@ -1113,6 +1360,159 @@ func (s *Server) publishToClient(cl *Client, sub packets.Subscription, pk packet
 	return out, nil
 }
 
+// shouldQueue returns true if a message for a client should be added to the client's
+// offline queue instead of being sent. Messages are queued while a persistent session
+// is disconnected, and while earlier messages are still waiting in the queue.
+func (s *Server) shouldQueue(cl *Client, pk packets.Packet) bool {
+	opts := s.Options.OfflineQueue
+	if opts == nil || cl.Net.Inline || !cl.hasPersistentSession() {
+		return false
+	}
+
+	if pk.FixedHeader.Qos == 0 && !opts.QueueQos0 {
+		return false
+	}
+
+	return cl.Net.Conn == nil || cl.Closed() || cl.State.Queue.Len() > 0
+}
+
+// queueMessage adds a message to the offline queue of a client, applying the overflow
+// policy if the queue is full.
+func (s *Server) queueMessage(cl *Client, pk packets.Packet) error {
+	opts := s.Options.OfflineQueue
+	q := cl.State.Queue
+
+	q.serial.Lock()
+	defer q.serial.Unlock()
+
+	seq, dropped, ok := q.Push(pk, opts.MaxMessages, opts.MaxBytes, opts.Overflow == OverflowDropOldest)
+	for _, m := range dropped {
+		atomic.AddInt64(&s.Info.MessagesDropped, 1)
+		s.hooks.OnDequeued(cl, m.Sequence)
+		s.hooks.OnPublishDropped(cl, m.Packet)
+	}
+
+	if !ok {
+		atomic.AddInt64(&s.Info.MessagesDropped, 1)
+		s.hooks.OnPublishDropped(cl, pk)
+		s.Log.Debug("offline queue full", "client", cl.ID, "listener", cl.Net.Listener, "overflow", opts.Overflow)
+		return ErrOfflineQueueFull
+	}
+
+	s.hooks.OnQueued(cl, pk, seq)
+	return nil
+}
+
+// drainQueue sends queued messages to a connected client in order. Draining stops when
+// the client has no quota left to receive qos messages (respecting the client's receive
+// maximum), or its pending writes are full, and resumes when quota becomes available.
+func (s *Server) drainQueue(cl *Client) {
+	q := cl.State.Queue
+	q.serial.Lock()
+	defer q.serial.Unlock()
+
+	now := time.Now().Unix()
+	for cl.State.queueOpen.Load() && cl.Net.Conn != nil && !cl.Closed() {
+		m, ok := q.Peek()
+		if !ok {
+			return
+		}
+
+		pk := m.Packet
+		if pk.Expiry > 0 && pk.Expiry < now { // [MQTT-3.3.2-5]
+			q.Pop()
+			s.hooks.OnDequeued(cl, m.Sequence)
+			continue
+		}
+
+		if pk.FixedHeader.Qos > 0 {
+			if !s.hasSendQuota(cl) {
+				return
+			}
+
+			i, err := cl.NextPacketID() // [MQTT-4.3.2-1] [MQTT-4.3.3-1]
+			if err != nil {
+				return
+			}
+
+			// the packet id is reserved before the message is written so that an ack can't
+			// arrive before it is inflight, but it is only reported to the hooks once sent.
+			pk.PacketID = uint16(i) // [MQTT-2.2.1-4]
+			if ok := cl.State.Inflight.Set(pk); !ok {
+				return // the packet id is already in use
+			}
+			cl.State.Inflight.DecreaseSendQuota()
+		}
+
+		select {
+		case cl.State.outbound <- &pk:
+			atomic.AddInt32(&cl.State.outboundQty, 1)
+		default:
+			if pk.FixedHeader.Qos > 0 { // leave the message queued until there is room to write it.
+				cl.State.Inflight.Delete(pk.PacketID)
+				cl.State.Inflight.IncreaseSendQuota()
+			}
+			return
+		}
+
+		if pk.FixedHeader.Qos > 0 {
+			atomic.AddInt64(&s.Info.Inflight, 1)
+			s.hooks.OnQosPublish(cl, pk, pk.Created, 0)
+		}
+
+		q.Pop()
+		s.hooks.OnDequeued(cl, m.Sequence)
+	}
+}
+
+// hasSendQuota returns true if a client can be sent another qos > 0 message without
+// exceeding its receive maximum or the server's maximum inflight messages.
+func (s *Server) hasSendQuota(cl *Client) bool {
+	if atomic.LoadInt32(&cl.State.Inflight.maximumSendQuota) > 0 && atomic.LoadInt32(&cl.State.Inflight.sendQuota) == 0 {
+		return false
+	}
+
+	limit := int(s.capabilities(cl).MaximumInflight)
+	if rm := int(cl.Properties.Props.ReceiveMaximum); rm > 0 && rm < limit {
+		limit = rm // inherited inflight messages count against the receive maximum
+	}
+
+	return cl.State.Inflight.Len() < limit
+}
+
+// clearQueue deletes all messages in the offline queue of a client, e.g. when the session ends.
+func (s *Server) clearQueue(cl *Client) {
+	q := cl.State.Queue
+	q.serial.Lock()
+	defer q.serial.Unlock()
+
+	for _, m := range q.Clear() {
+		s.hooks.OnDequeued(cl, m.Sequence)
+	}
+}
+
+// processOfflineQueues deletes expired messages from the offline queues of all clients,
+// and resumes draining the queues of connected clients.
+func (s *Server) processOfflineQueues(now int64) {
+	if s.Options.OfflineQueue == nil {
+		return
+	}
+
+	for _, cl := range s.Clients.GetAll() {
+		if cl.State.Queue.Len() == 0 {
+			continue
+		}
+
+		cl.State.Queue.serial.Lock()
+		for _, m := range cl.State.Queue.ClearExpired(now) {
+			s.hooks.OnDequeued(cl, m.Sequence)
+		}
+		cl.State.Queue.serial.Unlock()
+
+		s.drainQueue(cl)
+	}
+}
+
 func (s *Server) publishRetainedToClient(cl *Client, sub packets.Subscription, existed bool) {
 	if IsSharedFilter(sub.Filter) {
 		return // 4.8.2 Non-normative - Shared Subscriptions - No Retained Messages are sent to the Session when it first subscribes.
@@ -1256,6 +1656,7 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 		} else if sub.NoLocal && IsSharedFilter(sub.Filter) {
 			reasonCodes[i] = packets.ErrProtocolViolationInvalidSharedNoLocal.Code // [MQTT-3.8.3-4]
 		} else if !s.hooks.OnACLCheck(cl, sub.Filter, false) {
+			s.hooks.OnACLCheckFailed(cl, sub.Filter, false)
 			reasonCodes[i] = packets.ErrNotAuthorized.Code
 			if s.Options.Capabilities.Compatibilities.ObscureNotAuthorized {
 				reasonCodes[i] = packets.ErrUnspecifiedError.Code
@@ -1267,8 +1668,8 @@ func (s *Server) processSubscribe(cl *Client, pk packets.Packet) error {
 			}
 			cl.State.Subscriptions.Add(sub.Filter, sub) // [MQTT-3.2.2-10]
 
-			if sub.Qos > s.Options.Capabilities.MaximumQos {
-				sub.Qos = s.Options.Capabilities.MaximumQos // [MQTT-3.2.2-9]
+			if maxQos := s.capabilities(cl).MaximumQos; sub.Qos > maxQos {
+				sub.Qos = maxQos // [MQTT-3.2.2-9]
 			}
 
 			filterExisted[i] = !isNew
@@ -1412,12 +1813,17 @@ func (s *Server) processDisconnect(cl *Client, pk packets.Packet) error {
 
 // DisconnectClient sends a Disconnect packet to a client and then closes the client connection.
 func (s *Server) DisconnectClient(cl *Client, code packets.Code) error {
+	return s.disconnectClient(cl, code, packets.Properties{})
+}
+
+// disconnectClient sends a Disconnect packet with the given properties to a client and closes the connection.
+func (s *Server) disconnectClient(cl *Client, code packets.Code, properties packets.Properties) error {
 	out := packets.Packet{
 		FixedHeader: packets.FixedHeader{
 			Type: packets.Disconnect,
 		},
 		ReasonCode: code.Code,
-		Properties: packets.Properties{},
+		Properties: properties,
 	}
 
 	if code.Code >= packets.ErrUnspecifiedError.Code {
@@ -1580,6 +1986,15 @@ func (s *Server) readStore() error {
 		s.Log.Debug("loaded inflights from store", "len", len(inflight))
 	}
 
+	if s.hooks.Provides(StoredQueuedMessages) {
+		queued, err := s.hooks.StoredQueuedMessages()
+		if err != nil {
+			return fmt.Errorf("load queued; %w", err)
+		}
+		s.loadQueued(queued)
+		s.Log.Debug("loaded queued messages from store", "len", len(queued))
+	}
+
 	if s.hooks.Provides(StoredRetainedMessages) {
 		retained, err := s.hooks.StoredRetainedMessages()
 		if err != nil {
@@ -1601,6 +2016,25 @@ func (s *Server) readStore() error {
 	return nil
 }
 
+// RestoreState loads clients, subscriptions, inflight and retained messages and
+// system info into the server in the same way they are read from the storage hooks
+// on startup. It is intended for loading a backup into a server which has no clients
+// or retained messages.
+func (s *Server) RestoreState(clients []storage.Client, subs []storage.Subscription, inflight, retained []storage.Message, info system.Info) {
+	s.loadClients(clients)
+	s.loadSubscriptions(subs)
+	s.loadInflight(inflight)
+	s.loadRetained(retained)
+	s.loadServerInfo(info)
+	atomic.StoreInt64(&s.Info.Retained, int64(s.Topics.Retained.Len()))
+}
+
+// RestoreQueued loads offline queued messages into the queues of clients which have
+// already been restored, such as after RestoreState.
+func (s *Server) RestoreQueued(queued []storage.Message) {
+	s.loadQueued(queued)
+}
+
 // loadServerInfo restores server info from the datastore.
 func (s *Server) loadServerInfo(v system.Info) {
 	if s.Options.Capabilities.Compatibilities.RestoreSysInfoOnRestart {
@@ -1615,6 +2049,8 @@ func (s *Server) loadServerInfo(v system.Info) {
 		atomic.StoreInt64(&s.Info.PacketsReceived, v.PacketsReceived)
 		atomic.StoreInt64(&s.Info.PacketsSent, v.PacketsSent)
 		atomic.StoreInt64(&s.Info.InflightDropped, v.InflightDropped)
+		atomic.StoreInt64(&s.Info.RetainedRejected, v.RetainedRejected)
+		atomic.StoreInt64(&s.Info.RetainedEvicted, v.RetainedEvicted)
 	}
 	atomic.StoreInt64(&s.Info.Retained, v.Retained)
 	atomic.StoreInt64(&s.Info.Inflight, v.Inflight)
@@ -1669,6 +2105,7 @@ func (s *Server) loadClients(v []storage.Client) {
 		s.hooks.OnDisconnect(cl, packets.ErrServerShuttingDown, expire)
 		if expire {
 			cl.ClearInflights()
+			s.clearQueue(cl)
 			s.UnsubscribeClient(cl)
 		} else {
 			s.Clients.Add(cl)
@@ -1685,34 +2122,77 @@ func (s *Server) loadInflight(v []storage.Message) {
 	}
 }
 
-// loadRetained restores retained messages from the datastore.
-func (s *Server) loadRetained(v []storage.Message) {
+// loadQueued restores offline queued messages from the datastore.
+func (s *Server) loadQueued(v []storage.Message) {
 	for _, msg := range v {
-		s.Topics.RetainMessage(msg.ToPacket())
+		if client, ok := s.Clients.Get(msg.Client); ok {
+			pk := msg.ToPacket()
+			if expiry := minimum(s.Options.Capabilities.MaximumMessageExpiryInterval,
+				int64(pk.Properties.MessageExpiryInterval)); expiry > 0 {
+				pk.Expiry = pk.Created + expiry
+			}
+			client.State.Queue.Restore(msg.Sequence, pk)
+		}
 	}
 }
 
-// clearExpiredClients deletes all clients which have been disconnected for longer
-// than their given expiry intervals.
-func (s *Server) clearExpiredClients(dt int64) {
-	for id, client := range s.Clients.GetAll() {
-		disconnected := client.StopTime()
-		if disconnected == 0 {
+// loadRetained restores retained messages from the datastore, oldest first, applying
+// the retained limits. Messages which exceed the limits are removed from the store.
+func (s *Server) loadRetained(v []storage.Message) {
+	msgs := make([]storage.Message, len(v))
+	copy(msgs, v)
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Created < msgs[j].Created
+	})
+
+	for _, msg := range msgs {
+		_, evicted, err := s.Topics.RetainMessageLimited(msg.ToPacket(), s.Options.RetainedLimits)
+		if err != nil {
+			atomic.AddInt64(&s.Info.RetainedRejected, 1)
+			s.Log.Warn("stored retained message exceeds retained limits", "error", err, "topic", msg.TopicName)
+			s.hooks.OnRetainedExpired(msg.TopicName)
 			continue
 		}
+		s.retainedEvicted(evicted)
+	}
 
-		expire := s.Options.Capabilities.MaximumSessionExpiryInterval
-		if client.Properties.ProtocolVersion == 5 && client.Properties.Props.SessionExpiryIntervalFlag {
-			expire = client.Properties.Props.SessionExpiryInterval
-		}
+	atomic.StoreInt64(&s.Info.RetainedBytes, s.Topics.RetainedBytes())
+}
 
-		if disconnected+int64(expire) < dt {
+// clearExpiredClients deletes all clients which have been disconnected for longer
+// than their given expiry intervals.
+func (s *Server) clearExpiredClients(dt int64) {
+	for id, client := range s.Clients.GetAll() {
+		if at, ok := s.SessionExpiresAt(client); ok && at < dt {
+			s.clearQueue(client)
 			s.hooks.OnClientExpired(client)
 			s.Clients.Delete(id) // [MQTT-4.1.0-2]
 		}
 	}
 }
 
+// SessionExpiresAt returns the unix time at which the session of a disconnected client
+// expires, or false if the client is still connected.
+func (s *Server) SessionExpiresAt(cl *Client) (int64, bool) {
+	disconnected := cl.StopTime()
+	if disconnected == 0 {
+		return 0, false
+	}
+
+	expire := s.Options.Capabilities.MaximumSessionExpiryInterval
+	if cl.Properties.ProtocolVersion == 5 && cl.Properties.Props.SessionExpiryIntervalFlag {
+		expire = cl.Properties.Props.SessionExpiryInterval
+	}
+
+	return disconnected + int64(expire), true
+}
+
+// PendingWill returns the will message of a disconnected client which is waiting for its
+// will delay interval to pass before being sent. The packet expiry is the time it will be sent.
+func (s *Server) PendingWill(id string) (packets.Packet, bool) {
+	return s.loop.willDelayed.Get(id)
+}
+
 // clearExpiredRetainedMessage deletes retained messages from topics if they have expired.
 func (s *Server) clearExpiredRetainedMessages(now int64) {
 	for filter, pk := range s.Topics.Retained.GetAll() {
@@ -1724,10 +2204,12 @@ func (s *Server) clearExpiredRetainedMessages(now int64) {
 			now-pk.Created > s.Options.Capabilities.MaximumMessageExpiryInterval
 
 		if expired || enforced {
-			s.Topics.Retained.Delete(filter)
+			s.Topics.RetainMessage(packets.Packet{TopicName: filter})
 			s.hooks.OnRetainedExpired(filter)
 		}
 	}
+
+	atomic.StoreInt64(&s.Info.RetainedBytes, s.Topics.RetainedBytes())
 }
 
 // clearExpiredInflights deletes any inflight messages which have expired.
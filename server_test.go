@@ -107,6 +107,28 @@ func newServer() *Server {
 	return s
 }
 
+// newListenerServer returns a served server with an inline client, a hook and a
+// listener, which is closed when the test ends.
+func newListenerServer(t *testing.T, hook Hook, l listeners.Listener) *Server {
+	s := New(&Options{Logger: logger, InlineClient: true})
+	_ = s.AddHook(hook, nil)
+	require.NoError(t, s.AddListener(l))
+	require.NoError(t, s.Serve())
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// dialUDP returns a udp client connected to a listener address, which is closed when
+// the test ends.
+func dialUDP(t *testing.T, address string) *net.UDPConn {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	require.NoError(t, err)
+	c, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
 func newServerWithInlineClient() *Server {
 	cc := NewDefaultServerCapabilities()
 	cc.MaximumMessageExpiryInterval = 0
@@ -272,13 +294,16 @@ func TestServerAddListenersFromConfig(t *testing.T) {
 		{Type: listeners.TypeHealthCheck, ID: "health", Address: ":1881"},
 		{Type: listeners.TypeSysInfo, ID: "info", Address: ":1880"},
 		{Type: listeners.TypeUnix, ID: "unix", Address: "mochi.sock"},
+		{Type: listeners.TypeMQTTSN, ID: "sn", Address: "127.0.0.1:0"},
+		{Type: listeners.TypeHTTPGateway, ID: "gw", Address: "127.0.0.1:0"},
+		{Type: listeners.TypeCoAP, ID: "coap", Address: "127.0.0.1:0"},
 		{Type: listeners.TypeMock, ID: "mock", Address: "0"},
 		{Type: "unknown", ID: "unknown"},
 	}
 
 	err := s.AddListenersFromConfig(lc)
 	require.NoError(t, err)
-	require.Equal(t, 6, s.Listeners.Len())
+	require.Equal(t, 9, s.Listeners.Len())
 
 	tcp, _ := s.Listeners.Get("tcp")
 	require.Equal(t, "[::]:1883", tcp.Address())
@@ -295,6 +320,15 @@ func TestServerAddListenersFromConfig(t *testing.T) {
 	unix, _ := s.Listeners.Get("unix")
 	require.Equal(t, "mochi.sock", unix.Address())
 
+	sn, _ := s.Listeners.Get("sn")
+	require.IsType(t, new(listeners.MQTTSN), sn)
+
+	gw, _ := s.Listeners.Get("gw")
+	require.IsType(t, new(listeners.HTTPGateway), gw)
+
+	coap, _ := s.Listeners.Get("coap")
+	require.IsType(t, new(listeners.CoAP), coap)
+
 	mock, _ := s.Listeners.Get("mock")
 	require.Equal(t, "0", mock.Address())
 }
@@ -314,6 +348,18 @@ func TestServerAddListenersFromConfigError(t *testing.T) {
 	require.Equal(t, 0, s.Listeners.Len())
 }
 
+func TestServerAddListenersFromConfigQUICRequiresTLS(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	s.Log = logger
+
+	err := s.AddListenersFromConfig([]listeners.Config{
+		{Type: listeners.TypeQUIC, ID: "quic", Address: ":14567"},
+	})
+	require.ErrorIs(t, err, listeners.ErrQUICRequiresTLS)
+	require.Equal(t, 0, s.Listeners.Len())
+}
+
 func TestServerServe(t *testing.T) {
 	s := newServer()
 	defer s.Close()
@@ -1879,6 +1925,17 @@ func TestPublishToSubscribersSelfNoLocal(t *testing.T) {
 	require.Equal(t, []byte{}, <-receiverBuf)
 }
 
+func TestCountSubscribers(t *testing.T) {
+	s := newServer()
+	require.True(t, s.Topics.Subscribe("cl1", packets.Subscription{Filter: "a/b/c"}))
+	require.True(t, s.Topics.Subscribe("cl2", packets.Subscription{Filter: SharePrefix + "/tmp/a/b/c"}))
+	require.True(t, s.Topics.Subscribe("cl3", packets.Subscription{Filter: SharePrefix + "/tmp/a/b/c"}))
+	require.True(t, s.Topics.Subscribe("cl4", packets.Subscription{Filter: "d/e"}))
+
+	require.Equal(t, 2, s.CountSubscribers(*packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet))
+	require.Equal(t, 0, s.CountSubscribers(packets.Packet{TopicName: "x/y"}))
+}
+
 func TestPublishToSubscribers(t *testing.T) {
 	s := newServer()
 	cl, r1, w1 := newTestClient()
@@ -2164,6 +2221,336 @@ func TestPublishToClientMqtt3RetainFalseLeverageNoConn(t *testing.T) {
 	require.ErrorIs(t, err, packets.CodeDisconnect)
 }
 
+// queueHook records the messages held in the offline queues.
+type queueHook struct {
+	HookBase
+	sync.Mutex
+	queued map[string]map[int64]packets.Packet
+}
+
+func newQueueHook() *queueHook {
+	return &queueHook{queued: map[string]map[int64]packets.Packet{}}
+}
+
+func (h *queueHook) ID() string {
+	return "queue"
+}
+
+func (h *queueHook) Provides(b byte) bool {
+	return b == OnQueued || b == OnDequeued
+}
+
+func (h *queueHook) OnQueued(cl *Client, pk packets.Packet, seq int64) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.queued[cl.ID]; !ok {
+		h.queued[cl.ID] = map[int64]packets.Packet{}
+	}
+	h.queued[cl.ID][seq] = pk
+}
+
+func (h *queueHook) OnDequeued(cl *Client, seq int64) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.queued[cl.ID], seq)
+}
+
+func (h *queueHook) len(id string) int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.queued[id])
+}
+
+func newQueueServer(opts *OfflineQueueOptions) (*Server, *queueHook) {
+	s := newServer()
+	s.Options.OfflineQueue = opts
+	s.Options.ensureDefaults()
+	hook := newQueueHook()
+	_ = s.AddHook(hook, nil)
+	return s, hook
+}
+
+func TestPublishToClientOfflineQueue(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{})
+	require.Equal(t, OverflowDropOldest, s.Options.OfflineQueue.Overflow)
+
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.NoError(t, err)
+	require.Equal(t, 1, cl.State.Queue.Len())
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, 1, hook.len(cl.ID))
+
+	m, ok := cl.State.Queue.Peek()
+	require.True(t, ok)
+	require.Equal(t, uint16(0), m.Packet.PacketID) // packet ids are assigned when the message is sent
+	require.Equal(t, byte(1), m.Packet.FixedHeader.Qos)
+
+	qos0 := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, qos0)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 1, cl.State.Queue.Len())
+
+	s.Options.OfflineQueue.QueueQos0 = true
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, qos0)
+	require.NoError(t, err)
+	require.Equal(t, 2, cl.State.Queue.Len())
+
+	cl.Properties.Clean = true // clean sessions end when the client disconnects
+	_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.ErrorIs(t, err, packets.CodeDisconnect)
+	require.Equal(t, 2, cl.State.Queue.Len())
+	require.Equal(t, 1, cl.State.Inflight.Len())
+}
+
+func TestPublishToClientOfflineQueueOverflow(t *testing.T) {
+	tt := []struct {
+		overflow string
+		err      error
+		payloads []string
+	}{
+		{overflow: OverflowDropOldest, payloads: []string{"2", "3"}},
+		{overflow: OverflowDropNewest, err: ErrOfflineQueueFull, payloads: []string{"1", "2"}},
+		{overflow: OverflowReject, err: ErrOfflineQueueFull, payloads: []string{"1", "2"}},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.overflow, func(t *testing.T) {
+			s, hook := newQueueServer(&OfflineQueueOptions{MaxMessages: 2, Overflow: tx.overflow})
+			cl, _, _ := newTestClient()
+			cl.Net.Conn = nil
+			s.Clients.Add(cl)
+
+			var err error
+			for _, p := range []string{"1", "2", "3"} {
+				pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+				pk.Payload = []byte(p)
+				_, err = s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+			}
+
+			if tx.err != nil {
+				require.ErrorIs(t, err, tx.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var payloads []string
+			for _, m := range cl.State.Queue.GetAll() {
+				payloads = append(payloads, string(m.Packet.Payload))
+			}
+			require.Equal(t, tx.payloads, payloads)
+			require.Equal(t, 2, hook.len(cl.ID))
+			require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+		})
+	}
+}
+
+func TestServerProcessPublishOfflineQueueReject(t *testing.T) {
+	s, _ := newQueueServer(&OfflineQueueOptions{MaxMessages: 1, Overflow: OverflowReject})
+
+	receiver, _, _ := newTestClient()
+	receiver.ID = "receiver"
+	receiver.Net.Conn = nil
+	s.Clients.Add(receiver)
+	s.Topics.Subscribe(receiver.ID, packets.Subscription{Filter: "a/b/c", Qos: 1})
+
+	online, _, _ := newTestClient()
+	online.ID = "online"
+	s.Clients.Add(online)
+	s.Topics.Subscribe(online.ID, packets.Subscription{Filter: "a/b/c", Qos: 0})
+
+	sender, r, w := newTestClient()
+	sender.ID = "sender"
+	sender.Properties.ProtocolVersion = 5
+	s.Clients.Add(sender)
+
+	go func() {
+		pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+		require.NoError(t, s.processPublish(sender, pk))
+		require.NoError(t, s.processPublish(sender, pk))
+		_ = w.Close()
+	}()
+
+	acks := make([][]byte, 0, 2)
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, 64)
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		acks = append(acks, buf[:n])
+	}
+
+	require.Equal(t, packets.Puback<<4, acks[0][0])
+	require.True(t, len(acks[0]) == 4 || acks[0][4] == packets.CodeSuccess.Code)
+	require.Equal(t, packets.Puback<<4, acks[1][0])
+	require.Equal(t, packets.ErrQuotaExceeded.Code, acks[1][4])
+	require.Equal(t, 1, receiver.State.Queue.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.MessagesDropped))
+	require.Equal(t, int32(1), atomic.LoadInt32(&online.State.outboundQty)) // the rejected message was not delivered
+}
+
+func TestServerDrainQueuePendingWritesFull(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{})
+	cl, _, _ := newTestClient()
+	cl.State.queueOpen.Store(true)
+	s.Clients.Add(cl)
+
+	for i := 0; i < cap(cl.State.outbound); i++ {
+		cl.State.outbound <- &packets.Packet{}
+	}
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	seq, _, _ := cl.State.Queue.Push(pk, 0, 0, false)
+	hook.OnQueued(cl, pk, seq)
+
+	for i := 0; i < 3; i++ {
+		s.drainQueue(cl)
+	}
+
+	require.Equal(t, 1, cl.State.Queue.Len())
+	require.Equal(t, 1, hook.len(cl.ID))
+	require.Equal(t, 0, cl.State.Inflight.Len())
+	require.Equal(t, int32(5), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.Inflight))
+
+	<-cl.State.outbound
+	s.drainQueue(cl)
+	require.Equal(t, 0, cl.State.Queue.Len())
+	require.Equal(t, 1, cl.State.Inflight.Len())
+	require.Equal(t, int32(4), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Inflight))
+}
+
+func TestServerDrainQueue(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{QueueQos0: true})
+	cl, _, w := newTestClient()
+	cl.Net.Conn = nil
+	s.Clients.Add(cl)
+
+	for i := 0; i < 3; i++ {
+		pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, cl.State.Queue.Len())
+
+	// the queue is not drained until the connection is ready.
+	cl.Net.Conn = w
+	s.drainQueue(cl)
+	require.Equal(t, 3, cl.State.Queue.Len())
+
+	cl.State.queueOpen.Store(true)
+	cl.State.Inflight.ResetSendQuota(2) // client receive maximum
+	s.drainQueue(cl)
+	require.Equal(t, 1, cl.State.Queue.Len())
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	require.Equal(t, int32(2), atomic.LoadInt32(&cl.State.outboundQty))
+	require.Equal(t, int32(0), atomic.LoadInt32(&cl.State.Inflight.sendQuota))
+	require.Equal(t, int64(2), atomic.LoadInt64(&s.Info.Inflight))
+	require.Equal(t, 1, hook.len(cl.ID))
+
+	// new messages are queued behind the waiting messages to keep them in order.
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, pk)
+	require.NoError(t, err)
+	require.Equal(t, 2, cl.State.Queue.Len())
+
+	// acknowledging a message frees quota for the next queued message.
+	err = s.processPacket(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, cl.State.Queue.Len()) // the qos 0 message waits for room in the pending writes
+	require.Equal(t, 2, cl.State.Inflight.Len())
+	require.Equal(t, int32(3), atomic.LoadInt32(&cl.State.outboundQty))
+
+	<-cl.State.outbound
+	atomic.AddInt32(&cl.State.outboundQty, -1)
+	s.processOfflineQueues(time.Now().Unix())
+	require.Equal(t, 0, cl.State.Queue.Len())
+	require.Equal(t, 0, hook.len(cl.ID))
+}
+
+func TestServerDrainQueueReceiveMaximum(t *testing.T) {
+	s, _ := newQueueServer(&OfflineQueueOptions{})
+	cl, _, _ := newTestClient()
+	cl.Properties.Props.ReceiveMaximum = 1
+	cl.State.Inflight.Set(packets.Packet{PacketID: 1}) // an inherited inflight message
+	cl.State.queueOpen.Store(true)
+	s.Clients.Add(cl)
+
+	cl.State.Queue.Push(*packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet, 0, 0, false)
+	s.drainQueue(cl)
+	require.Equal(t, 1, cl.State.Queue.Len())
+
+	cl.State.Inflight.Delete(1)
+	s.drainQueue(cl)
+	require.Equal(t, 0, cl.State.Queue.Len())
+}
+
+func TestServerDrainQueueExpired(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{})
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	s.Clients.Add(cl)
+
+	n := time.Now().Unix()
+	for _, expiry := range []int64{n - 10, 0} {
+		pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+		pk.Expiry = expiry
+		_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+		require.NoError(t, err)
+	}
+
+	s.processOfflineQueues(n)
+	require.Equal(t, 1, cl.State.Queue.Len())
+	require.Equal(t, 1, hook.len(cl.ID))
+}
+
+func TestInheritClientSessionQueue(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{})
+
+	existing, _, _ := newTestClient()
+	existing.Net.Conn = nil
+	s.Clients.Add(existing)
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_, err := s.publishToClient(existing, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.NoError(t, err)
+
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	b := s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: existing.ID}}, cl)
+	require.True(t, b)
+	require.Equal(t, 1, cl.State.Queue.Len())
+
+	s.Clients.Add(cl)
+	cl2, _, _ := newTestClient()
+	b = s.inheritClientSession(packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: existing.ID, Clean: true}}, cl2)
+	require.False(t, b)
+	require.Equal(t, 0, cl2.State.Queue.Len())
+	require.Equal(t, 0, cl.State.Queue.Len())
+	require.Equal(t, 0, hook.len(existing.ID))
+}
+
+func TestServerClearExpiredClientsQueue(t *testing.T) {
+	s, hook := newQueueServer(&OfflineQueueOptions{})
+	cl, _, _ := newTestClient()
+	cl.Net.Conn = nil
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c", Qos: 1}, pk)
+	require.NoError(t, err)
+	require.Equal(t, 1, hook.len(cl.ID))
+
+	cl.Stop(packets.CodeDisconnect)
+	s.Options.Capabilities.MaximumSessionExpiryInterval = 0
+	s.clearExpiredClients(time.Now().Unix() + 1)
+	require.Equal(t, 0, cl.State.Queue.Len())
+	require.Equal(t, 0, hook.len(cl.ID))
+}
+
 func TestPublishToClientMqtt5RetainAsPublishedTrueLeverageNoConn(t *testing.T) {
 	s := newServer()
 	cl, _, _ := newTestClient()
@@ -2218,6 +2605,52 @@ func TestPublishToClientACLNotAuthorized(t *testing.T) {
 	require.ErrorIs(t, err, packets.ErrNotAuthorized)
 }
 
+func TestServerACLCheck(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	require.NoError(t, s.AddHook(new(DenyHook), nil))
+	cl := s.NewClient(nil, LocalListener, "inline", true)
+	require.False(t, s.ACLCheck(cl, "a/b/c", true)) // inline clients are not exempt
+
+	s = New(&Options{
+		Logger: logger,
+	})
+	require.NoError(t, s.AddHook(new(AllowHook), nil))
+	require.True(t, s.ACLCheck(cl, "a/b/c", false))
+}
+
+type aclFailedHook struct {
+	HookBase
+	failed atomic.Int32
+}
+
+func (h *aclFailedHook) ID() string {
+	return "acl-failed"
+}
+
+func (h *aclFailedHook) Provides(b byte) bool {
+	return b == OnACLCheckFailed
+}
+
+func (h *aclFailedHook) OnACLCheckFailed(cl *Client, topic string, write bool) {
+	h.failed.Add(1)
+}
+
+func TestPublishToClientACLNotAuthorizedNotReported(t *testing.T) {
+	s := New(&Options{
+		Logger: logger,
+	})
+	require.NoError(t, s.AddHook(new(DenyHook), nil))
+	hook := new(aclFailedHook)
+	require.NoError(t, s.AddHook(hook, nil))
+	cl, _, _ := newTestClient()
+
+	_, err := s.publishToClient(cl, packets.Subscription{Filter: "a/b/c"}, *packets.TPacketData[packets.Publish].Get(packets.TPublishBasic).Packet)
+	require.ErrorIs(t, err, packets.ErrNotAuthorized)
+	require.Equal(t, int32(0), hook.failed.Load())
+}
+
 func TestPublishToClientNoConn(t *testing.T) {
 	s := newServer()
 	cl, _, _ := newTestClient()
@@ -2397,6 +2830,174 @@ func TestNoRetainMessage(t *testing.T) {
 	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
 }
 
+// retainedExpiredHook records the retained messages removed from the store.
+type retainedExpiredHook struct {
+	HookBase
+	sync.Mutex
+	expired []string
+}
+
+func (h *retainedExpiredHook) ID() string {
+	return "retained-expired"
+}
+
+func (h *retainedExpiredHook) Provides(b byte) bool {
+	return b == OnRetainedExpired
+}
+
+func (h *retainedExpiredHook) OnRetainedExpired(filter string) {
+	h.Lock()
+	defer h.Unlock()
+	h.expired = append(h.expired, filter)
+}
+
+func TestSyncRetained(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessageSize: 16},
+	}
+
+	require.NoError(t, s.SyncRetained(packets.Packet{TopicName: "a/b", Payload: []byte("hello")}))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(8), atomic.LoadInt64(&s.Info.RetainedBytes))
+
+	err := s.SyncRetained(packets.Packet{TopicName: "a/c", Payload: make([]byte, 16)})
+	require.ErrorIs(t, err, ErrRetainedMessageTooLarge)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+
+	require.NoError(t, s.SyncRetained(packets.Packet{TopicName: "a/b"}))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.RetainedBytes))
+}
+
+func TestRetainMessageLimitsEvict(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessages: 1},
+		Policy:         RetainedLimitEvict,
+	}
+	hook := new(retainedExpiredHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishRetain).Packet
+	require.NoError(t, s.retainMessage(new(Client), pk))
+	pk.TopicName = "d/e/f"
+	require.NoError(t, s.retainMessage(new(Client), pk))
+
+	require.Equal(t, []string{"a/b/c"}, hook.expired)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedEvicted))
+	require.Equal(t, int64(len("d/e/f")+len(pk.Payload)), atomic.LoadInt64(&s.Info.RetainedBytes))
+	require.Len(t, s.Topics.Messages("d/e/f"), 1)
+}
+
+func TestServerClearRetained(t *testing.T) {
+	s := newServer()
+	hook := new(retainedExpiredHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishRetain).Packet
+	for _, topic := range []string{"a/b/c", "a/b/d", "e/f"} {
+		pk.TopicName = topic
+		require.NoError(t, s.retainMessage(new(Client), pk))
+	}
+
+	cleared := s.ClearRetained("a/b/+")
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d"}, cleared)
+	require.ElementsMatch(t, []string{"a/b/c", "a/b/d"}, hook.expired)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(len("e/f")+len(pk.Payload)), atomic.LoadInt64(&s.Info.RetainedBytes))
+	require.Len(t, s.Topics.Messages("#"), 1)
+
+	require.Empty(t, s.ClearRetained("x/#"))
+}
+
+func TestRetainMessageLimitsReject(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessageSize: 5},
+	}
+	s.Options.ensureDefaults()
+	require.Equal(t, RetainedLimitReject, s.Options.RetainedLimits.Policy)
+
+	err := s.retainMessage(new(Client), *packets.TPacketData[packets.Publish].Get(packets.TPublishRetain).Packet)
+	require.ErrorIs(t, err, ErrRetainedMessageTooLarge)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+}
+
+func TestServerProcessPublishRetainedLimitMqtt5(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessageSize: 5},
+	}
+
+	receiver, _, _ := newTestClient()
+	receiver.ID = "receiver"
+	receiver.Net.Conn = nil
+	s.Clients.Add(receiver)
+	s.Topics.Subscribe(receiver.ID, packets.Subscription{Filter: "a/b/c", Qos: 1})
+
+	online, _, _ := newTestClient()
+	online.ID = "online"
+	s.Clients.Add(online)
+	s.Topics.Subscribe(online.ID, packets.Subscription{Filter: "a/b/c", Qos: 0})
+
+	cl, r, w := newTestClient()
+	cl.Properties.ProtocolVersion = 5
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	pk.FixedHeader.Retain = true
+
+	go func() {
+		require.NoError(t, s.processPublish(cl, pk))
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.Puback<<4, buf[0])
+	require.Equal(t, packets.ErrQuotaExceeded.Code, buf[4])
+	require.Equal(t, 0, s.Topics.Retained.Len())
+	require.Equal(t, 0, receiver.State.Inflight.Len()) // the message was not published
+}
+
+func TestServerProcessPublishRetainedLimitMqtt3(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessageSize: 5},
+	}
+
+	receiver, _, _ := newTestClient()
+	receiver.ID = "receiver"
+	receiver.Net.Conn = nil
+	s.Clients.Add(receiver)
+	s.Topics.Subscribe(receiver.ID, packets.Subscription{Filter: "a/b/c", Qos: 1})
+
+	online, _, _ := newTestClient()
+	online.ID = "online"
+	s.Clients.Add(online)
+	s.Topics.Subscribe(online.ID, packets.Subscription{Filter: "a/b/c", Qos: 0})
+
+	cl, r, w := newTestClient()
+	s.Clients.Add(cl)
+
+	pk := *packets.TPacketData[packets.Publish].Get(packets.TPublishQos1).Packet
+	pk.FixedHeader.Retain = true
+
+	go func() {
+		require.NoError(t, s.processPublish(cl, pk))
+		_ = w.Close()
+	}()
+
+	buf, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, packets.TPacketData[packets.Puback].Get(packets.TPuback).RawBytes, buf)
+	require.Equal(t, 0, s.Topics.Retained.Len())
+	require.Equal(t, 1, receiver.State.Inflight.Len()) // published, but not retained
+}
+
 func TestServerProcessPacketPuback(t *testing.T) {
 	tt := ProtocolTest{
 		{
@@ -3341,6 +3942,10 @@ func TestServerReadStore(t *testing.T) {
 	err = s.readStore()
 	require.Error(t, err)
 
+	hook.failAt = 6 // queued
+	err = s.readStore()
+	require.Error(t, err)
+
 	hook.failAt = 5 // sys info
 	err = s.readStore()
 	require.Error(t, err)
@@ -3445,6 +4050,37 @@ func TestServerLoadInflightMessages(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestServerLoadQueuedMessages(t *testing.T) {
+	s := newServer()
+	s.Options.Capabilities.MaximumMessageExpiryInterval = 60
+	s.loadClients([]storage.Client{
+		{ID: "mochi"},
+		{ID: "zen"},
+	})
+
+	v := []storage.Message{
+		{Client: "mochi", Sequence: 3, Payload: []byte("c"), TopicName: "a/b/c", Created: 100},
+		{Client: "zen", Sequence: 1, Payload: []byte("z"), TopicName: "a/b/c", Created: 100},
+		{Client: "mochi", Sequence: 1, Payload: []byte("a"), TopicName: "a/b/c", Created: 100,
+			Properties: storage.MessageProperties{MessageExpiryInterval: 10}},
+		{Client: "unknown", Sequence: 1, Payload: []byte("x"), TopicName: "a/b/c"},
+	}
+	s.loadQueued(v)
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	all := cl.State.Queue.GetAll()
+	require.Len(t, all, 2)
+	require.Equal(t, []byte("a"), all[0].Packet.Payload)
+	require.Equal(t, int64(110), all[0].Packet.Expiry)
+	require.Equal(t, []byte("c"), all[1].Packet.Payload)
+	require.Equal(t, int64(160), all[1].Packet.Expiry)
+
+	cl, ok = s.Clients.Get("zen")
+	require.True(t, ok)
+	require.Equal(t, 1, cl.State.Queue.Len())
+}
+
 func TestServerLoadRetainedMessages(t *testing.T) {
 	s := newServer()
 
@@ -3460,6 +4096,53 @@ func TestServerLoadRetainedMessages(t *testing.T) {
 	require.Equal(t, 0, len(s.Topics.Messages("w/x/y")))
 }
 
+func TestServerLoadRetainedMessagesLimits(t *testing.T) {
+	s := newServer()
+	s.Options.RetainedLimits = &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessages: 2, MaxMessageSize: 16},
+		Policy:         RetainedLimitEvict,
+	}
+	hook := new(retainedExpiredHook)
+	require.NoError(t, s.AddHook(hook, nil))
+
+	v := []storage.Message{
+		{FixedHeader: packets.FixedHeader{Retain: true}, Payload: []byte("new"), TopicName: "a/b/c", Created: 30},
+		{FixedHeader: packets.FixedHeader{Retain: true}, Payload: []byte("old"), TopicName: "d/e/f", Created: 10},
+		{FixedHeader: packets.FixedHeader{Retain: true}, Payload: []byte("mid"), TopicName: "h/i/j", Created: 20},
+		{FixedHeader: packets.FixedHeader{Retain: true}, Payload: []byte("much too large"), TopicName: "k/l/m", Created: 5},
+	}
+	s.loadRetained(v)
+
+	require.Equal(t, 2, s.Topics.Retained.Len())
+	require.Empty(t, s.Topics.Messages("d/e/f"))
+	require.Len(t, s.Topics.Messages("a/b/c"), 1)
+	require.ElementsMatch(t, []string{"k/l/m", "d/e/f"}, hook.expired)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedRejected))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.RetainedEvicted))
+	require.Equal(t, int64(16), atomic.LoadInt64(&s.Info.RetainedBytes))
+	require.Equal(t, "new", string(v[0].Payload)) // the stored messages are not reordered
+}
+
+func TestServerRestoreState(t *testing.T) {
+	s := newServer()
+	s.RestoreState(
+		[]storage.Client{{ID: "mochi", ProtocolVersion: 5, Properties: storage.ClientProperties{SessionExpiryInterval: 10}}},
+		[]storage.Subscription{{Client: "mochi", Filter: "a/b/c", Qos: 1}},
+		[]storage.Message{{Client: "mochi", PacketID: 7, TopicName: "a/b/c"}},
+		[]storage.Message{{FixedHeader: packets.FixedHeader{Retain: true}, Payload: []byte("hello"), TopicName: "d/e/f"}},
+		system.Info{Subscriptions: 1},
+	)
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, 1, cl.State.Subscriptions.Len())
+	_, ok = cl.State.Inflight.Get(7)
+	require.True(t, ok)
+	require.Len(t, s.Topics.Messages("d/e/f"), 1)
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Retained))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.Info.Subscriptions))
+}
+
 func TestServerClose(t *testing.T) {
 	s := newServer()
 
@@ -3600,6 +4283,39 @@ func TestServerClearExpiredClients(t *testing.T) {
 	require.Equal(t, 2, s.Clients.Len())
 }
 
+func TestServerSessionExpiresAt(t *testing.T) {
+	s := New(nil)
+	s.Options.Capabilities.MaximumSessionExpiryInterval = 30
+
+	cl, _, _ := newTestClient()
+	_, ok := s.SessionExpiresAt(cl)
+	require.False(t, ok)
+
+	cl.State.disconnected = 100
+	at, ok := s.SessionExpiresAt(cl)
+	require.True(t, ok)
+	require.Equal(t, int64(130), at)
+
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.SessionExpiryInterval = 8
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	at, ok = s.SessionExpiresAt(cl)
+	require.True(t, ok)
+	require.Equal(t, int64(108), at)
+}
+
+func TestServerPendingWill(t *testing.T) {
+	s := New(nil)
+	_, ok := s.PendingWill("cl1")
+	require.False(t, ok)
+
+	s.loop.willDelayed.Add("cl1", packets.Packet{TopicName: "a/b/c", Expiry: 200})
+	pk, ok := s.PendingWill("cl1")
+	require.True(t, ok)
+	require.Equal(t, "a/b/c", pk.TopicName)
+	require.Equal(t, int64(200), pk.Expiry)
+}
+
 func TestLoadServerInfoRestoreOnRestart(t *testing.T) {
 	s := New(nil)
 	s.Options.Capabilities.Compatibilities.RestoreSysInfoOnRestart = true
@@ -24,6 +24,9 @@ type Info struct {
 	MessagesSent        int64  `json:"messages_sent"`        // total number of publish messages sent
 	MessagesDropped     int64  `json:"messages_dropped"`     // total number of publish messages dropped to slow subscriber
 	Retained            int64  `json:"retained"`             // total number of retained messages active on the broker
+	RetainedBytes       int64  `json:"retained_bytes"`       // topic and payload bytes of the retained messages, excluding $SYS topics
+	RetainedRejected    int64  `json:"retained_rejected"`    // the number of retained messages which were not retained as they exceeded the retained limits
+	RetainedEvicted     int64  `json:"retained_evicted"`     // the number of retained messages which were evicted to make room for newer messages
 	Inflight            int64  `json:"inflight"`             // the number of messages currently in-flight
 	InflightDropped     int64  `json:"inflight_dropped"`     // the number of inflight messages which were dropped
 	Subscriptions       int64  `json:"subscriptions"`        // total number of subscriptions active on the broker
@@ -50,6 +53,9 @@ func (i *Info) Clone() *Info {
 		MessagesSent:        atomic.LoadInt64(&i.MessagesSent),
 		MessagesDropped:     atomic.LoadInt64(&i.MessagesDropped),
 		Retained:            atomic.LoadInt64(&i.Retained),
+		RetainedBytes:       atomic.LoadInt64(&i.RetainedBytes),
+		RetainedRejected:    atomic.LoadInt64(&i.RetainedRejected),
+		RetainedEvicted:     atomic.LoadInt64(&i.RetainedEvicted),
 		Inflight:            atomic.LoadInt64(&i.Inflight),
 		InflightDropped:     atomic.LoadInt64(&i.InflightDropped),
 		Subscriptions:       atomic.LoadInt64(&i.Subscriptions),
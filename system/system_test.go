@@ -29,6 +29,9 @@ func TestClone(t *testing.T) {
 		PacketsSent:         17,
 		MemoryAlloc:         18,
 		Threads:             19,
+		RetainedBytes:       21,
+		RetainedRejected:    22,
+		RetainedEvicted:     23,
 	}
 
 	n := o.Clone()
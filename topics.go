@@ -5,6 +5,7 @@
 package mqtt
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -63,6 +64,18 @@ func (a *InboundTopicAliases) Set(id uint16, topic string) string {
 	return topic
 }
 
+// GetAll returns a copy of the topic aliases, keyed on alias.
+func (a *InboundTopicAliases) GetAll() map[uint16]string {
+	a.RLock()
+	defer a.RUnlock()
+
+	m := make(map[uint16]string, len(a.internal))
+	for k, v := range a.internal {
+		m[k] = v
+	}
+	return m
+}
+
 // OutboundTopicAliases contains a map of topic aliases sent from the broker to the client.
 type OutboundTopicAliases struct {
 	internal map[string]uint16
@@ -104,6 +117,18 @@ func (a *OutboundTopicAliases) Set(topic string) (uint16, bool) {
 	return uint16(i) + 1, false
 }
 
+// GetAll returns a copy of the topic aliases, keyed on topic.
+func (a *OutboundTopicAliases) GetAll() map[string]uint16 {
+	a.RLock()
+	defer a.RUnlock()
+
+	m := make(map[string]uint16, len(a.internal))
+	for k, v := range a.internal {
+		m[k] = v
+	}
+	return m
+}
+
 // SharedSubscriptions contains a map of subscriptions to a shared filter,
 // keyed on share group then client id.
 type SharedSubscriptions struct {
@@ -349,13 +374,15 @@ func (s *Subscribers) MergeSharedSelected() {
 // TopicsIndex is a prefix/trie tree containing topic subscribers and retained messages.
 type TopicsIndex struct {
 	Retained *packets.Packets
-	root     *particle // a leaf containing a message and more leaves.
+	root     *particle        // a leaf containing a message and more leaves.
+	retained *retainedTracker // the size and update order of retained messages, for enforcing limits.
 }
 
 // NewTopicsIndex returns a pointer to a new instance of Index.
 func NewTopicsIndex() *TopicsIndex {
 	return &TopicsIndex{
 		Retained: packets.NewPackets(),
+		retained: newRetainedTracker(),
 		root: &particle{
 			particles:     newParticles(),
 			subscriptions: NewSubscriptions(),
@@ -453,13 +480,48 @@ func (x *TopicsIndex) Unsubscribe(filter, client string) bool {
 func (x *TopicsIndex) RetainMessage(pk packets.Packet) int64 {
 	x.root.Lock()
 	defer x.root.Unlock()
+	return x.retainMessage(pk)
+}
 
+// RetainMessageLimited saves a retained message in the same way as RetainMessage, as long
+// as it would not exceed the limits. If the limits policy is to evict, the least recently
+// updated retained messages are removed to make room and their topics are returned.
+// Messages on $SYS topics, and removals, are not limited.
+func (x *TopicsIndex) RetainMessageLimited(pk packets.Packet, limits *RetainedLimitsOptions) (r int64, evicted []string, err error) {
+	x.root.Lock()
+	defer x.root.Unlock()
+
+	if limits != nil && len(pk.Payload) > 0 && !strings.HasPrefix(pk.TopicName, SysPrefix) {
+		evicted, err = x.retained.admit(pk.TopicName, retainedSize(pk), limits)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, topic := range evicted {
+			x.retainMessage(packets.Packet{TopicName: topic})
+		}
+	}
+
+	return x.retainMessage(pk), evicted, nil
+}
+
+// RetainedBytes returns the topic and payload bytes of all retained messages,
+// excluding $SYS topics.
+func (x *TopicsIndex) RetainedBytes() int64 {
+	return x.retained.total()
+}
+
+// retainMessage saves or removes a retained message. The root must be locked.
+func (x *TopicsIndex) retainMessage(pk packets.Packet) int64 {
 	n := x.set(pk.TopicName, 0)
 	n.Lock()
 	defer n.Unlock()
 	if len(pk.Payload) > 0 {
 		n.retainPath = pk.TopicName
 		x.Retained.Add(pk.TopicName, pk)
+		if !strings.HasPrefix(pk.TopicName, SysPrefix) {
+			x.retained.set(pk.TopicName, retainedSize(pk))
+		}
 		return 1
 	}
 
@@ -470,6 +532,7 @@ func (x *TopicsIndex) RetainMessage(pk packets.Packet) int64 {
 
 	n.retainPath = ""
 	x.Retained.Delete(pk.TopicName) // [MQTT-3.3.1-6] [MQTT-3.3.1-7]
+	x.retained.remove(pk.TopicName)
 	x.trim(n)
 
 	return out
@@ -578,6 +641,82 @@ func (x *TopicsIndex) scanMessages(filter string, d int, n *particle, pks []pack
 	return pks
 }
 
+// WalkMessages calls fn with each retained message on a topic matching a filter, in
+// order of topic level, starting after the topic after, or from the first topic if it is
+// empty. Topics are ordered level by level, so a topic comes before the topics beneath it.
+// The walk stops when fn returns false.
+func (x *TopicsIndex) WalkMessages(filter, after string, fn func(pk packets.Packet) bool) {
+	if len(filter) == 0 || x.Retained.Len() == 0 {
+		return
+	}
+
+	var cursor []string
+	if after != "" {
+		cursor = strings.Split(after, "/")
+	}
+
+	x.walkMessages(strings.Split(filter, "/"), 0, x.root, cursor, fn)
+}
+
+// walkMessages visits the retained messages beneath a particle matching the filter levels
+// from depth d, in order. Any cursor holds the remaining levels of the topic to start after,
+// while the path of the particle is equal to its start. Returns false if the walk was stopped.
+func (x *TopicsIndex) walkMessages(filter []string, d int, n *particle, cursor []string, fn func(pk packets.Packet) bool) bool {
+	level := filter[d]
+	wild := level == "+" || level == "#"
+
+	var keys []string
+	children := n.particles.getAll()
+	if wild {
+		keys = make([]string, 0, len(children))
+		for k := range children {
+			if n == x.root && k == SysPrefix {
+				continue
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	} else if _, ok := children[level]; ok {
+		keys = []string{level}
+	}
+
+	last := d == len(filter)-1
+	for _, k := range keys {
+		include := true
+		var sub []string
+		if len(cursor) > 0 {
+			if k < cursor[0] {
+				continue
+			}
+
+			if k == cursor[0] {
+				include = false // the topic is the cursor or comes before it
+				sub = cursor[1:]
+			}
+		}
+
+		child := children[k]
+		if include && (last || level == "#") && child.retainPath != "" {
+			if pk, ok := x.Retained.Get(child.retainPath); ok && !fn(pk) {
+				return false
+			}
+		}
+
+		next := d + 1
+		if level == "#" {
+			next = d
+		} else if last {
+			continue
+		}
+
+		if !x.walkMessages(filter, next, child, sub, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Subscribers returns a map of clients who are subscribed to matching filters,
 // their subscription ids and highest qos.
 func (x *TopicsIndex) Subscribers(topic string) *Subscribers {
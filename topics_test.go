@@ -442,6 +442,50 @@ func TestRetainMessage(t *testing.T) {
 	require.Equal(t, int64(0), r)
 }
 
+func TestRetainMessageLimited(t *testing.T) {
+	index := NewTopicsIndex()
+	limits := &RetainedLimitsOptions{
+		RetainedLimits: RetainedLimits{MaxMessages: 2},
+		Policy:         RetainedLimitEvict,
+	}
+
+	for _, topic := range []string{"a/1", "a/2", "a/3"} {
+		_, _, err := index.RetainMessageLimited(packets.Packet{FixedHeader: packets.FixedHeader{Retain: true}, TopicName: topic, Payload: []byte("hi")}, limits)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 2, index.Retained.Len())
+	_, ok := index.Retained.Get("a/1")
+	require.False(t, ok)
+	require.Empty(t, index.Messages("a/1"))
+	require.Equal(t, int64(10), index.RetainedBytes())
+
+	// $SYS topics and removals are not limited.
+	r, evicted, err := index.RetainMessageLimited(packets.Packet{TopicName: SysPrefix + "/broker/version", Payload: []byte("v")}, limits)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r)
+	require.Empty(t, evicted)
+	require.Equal(t, int64(10), index.RetainedBytes())
+
+	r, _, err = index.RetainMessageLimited(packets.Packet{TopicName: "a/2"}, limits)
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), r)
+	require.Equal(t, int64(5), index.RetainedBytes())
+
+	limits.Policy = RetainedLimitReject
+	limits.MaxMessages = 1
+	r, _, err = index.RetainMessageLimited(packets.Packet{TopicName: "a/4", Payload: []byte("hi")}, limits)
+	require.ErrorIs(t, err, ErrRetainedLimitExceeded)
+	require.Equal(t, int64(0), r)
+	_, ok = index.Retained.Get("a/4")
+	require.False(t, ok)
+
+	r, evicted, err = index.RetainMessageLimited(packets.Packet{TopicName: "a/4", Payload: []byte("hi")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r)
+	require.Empty(t, evicted)
+}
+
 func BenchmarkRetainMessage(b *testing.B) {
 	index := NewTopicsIndex()
 	for n := 0; n < b.N; n++ {
@@ -684,6 +728,49 @@ func TestMessagesPattern(t *testing.T) {
 	}
 }
 
+func TestWalkMessages(t *testing.T) {
+	index := NewTopicsIndex()
+	for _, topic := range []string{"$SYS/info", "b", "a/b/c", "a/b", "a-b", "a/c", "c/b", "a/bb/c"} {
+		index.RetainMessage(packets.Packet{TopicName: topic, Payload: []byte("hello")})
+	}
+
+	walk := func(filter, after string, limit int) []string {
+		topics := []string{}
+		index.WalkMessages(filter, after, func(pk packets.Packet) bool {
+			topics = append(topics, pk.TopicName)
+			return len(topics) < limit
+		})
+		return topics
+	}
+
+	tt := []struct {
+		filter string
+		after  string
+		limit  int
+		want   []string
+	}{
+		{"#", "", 100, []string{"a/b", "a/b/c", "a/bb/c", "a/c", "a-b", "b", "c/b"}},
+		{"#", "", 2, []string{"a/b", "a/b/c"}},
+		{"#", "a/b/c", 100, []string{"a/bb/c", "a/c", "a-b", "b", "c/b"}},
+		{"#", "a/b", 2, []string{"a/b/c", "a/bb/c"}},
+		{"#", "a/bz", 100, []string{"a/c", "a-b", "b", "c/b"}},
+		{"#", "c/b", 100, []string{}},
+		{"+/b", "", 100, []string{"a/b", "c/b"}},
+		{"+/b", "a/b", 100, []string{"c/b"}},
+		{"a/+/c", "", 100, []string{"a/b/c", "a/bb/c"}},
+		{"a/#", "a/b/c", 100, []string{"a/bb/c", "a/c"}},
+		{"$SYS/#", "", 100, []string{"$SYS/info"}},
+		{"b", "", 100, []string{"b"}},
+		{"d", "", 100, []string{}},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.filter+" after "+tx.after, func(t *testing.T) {
+			require.Equal(t, tx.want, walk(tx.filter, tx.after, tx.limit))
+		})
+	}
+}
+
 func BenchmarkMessages(b *testing.B) {
 	index := NewTopicsIndex()
 	index.RetainMessage(packets.Packet{TopicName: "a/b/c/d"})
@@ -855,6 +942,19 @@ func TestNewTopicAliases(t *testing.T) {
 	require.Equal(t, uint16(5), a.Outbound.maximum)
 }
 
+func TestTopicAliasesGetAll(t *testing.T) {
+	a := NewTopicAliases(5)
+	a.Inbound.Set(1, "a/b/c")
+	a.Outbound.Set("d/e/f")
+
+	inbound := a.Inbound.GetAll()
+	require.Equal(t, map[uint16]string{1: "a/b/c"}, inbound)
+	inbound[2] = "x"
+	require.Len(t, a.Inbound.GetAll(), 1)
+
+	require.Equal(t, map[string]uint16{"d/e/f": 1}, a.Outbound.GetAll())
+}
+
 func TestNewInlineSubscriptions(t *testing.T) {
 	subscriptions := NewInlineSubscriptions()
 	require.NotNil(t, subscriptions)